@@ -0,0 +1,130 @@
+package api
+
+import (
+	"augment2api/config"
+	"strings"
+	"unicode"
+)
+
+// minLanguageLetters 检测语言所需的最少字母数，过短的消息无法可靠判断
+const minLanguageLetters = 6
+
+// scriptLanguages 由文字系统即可确定的语言，按检查顺序排列，第一项必须是日文
+var scriptLanguages = []struct {
+	table    []*unicode.RangeTable
+	language string
+}{
+	{[]*unicode.RangeTable{unicode.Hiragana, unicode.Katakana}, "Japanese"},
+	{[]*unicode.RangeTable{unicode.Hangul}, "Korean"},
+	{[]*unicode.RangeTable{unicode.Han}, "Chinese"},
+	{[]*unicode.RangeTable{unicode.Cyrillic}, "Russian"},
+	{[]*unicode.RangeTable{unicode.Arabic}, "Arabic"},
+	{[]*unicode.RangeTable{unicode.Hebrew}, "Hebrew"},
+	{[]*unicode.RangeTable{unicode.Greek}, "Greek"},
+	{[]*unicode.RangeTable{unicode.Thai}, "Thai"},
+	{[]*unicode.RangeTable{unicode.Devanagari}, "Hindi"},
+}
+
+// latinStopwords 拉丁字母语言的常用词，按命中次数最多的语言判断，都未命中时视为英语
+var latinStopwords = map[string][]string{
+	"English":    {"the", "and", "is", "are", "what", "how", "this", "that", "with", "you", "please", "can"},
+	"Spanish":    {"el", "los", "las", "que", "es", "por", "para", "una", "cómo", "qué", "con", "del"},
+	"French":     {"le", "les", "des", "est", "une", "pour", "que", "avec", "dans", "comment", "vous", "je"},
+	"German":     {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "wie", "mit", "ich", "bitte"},
+	"Portuguese": {"o", "os", "que", "não", "uma", "para", "com", "como", "você", "é", "do", "da"},
+	"Italian":    {"il", "che", "non", "una", "per", "sono", "come", "della", "con", "questo", "è", "gli"},
+}
+
+// latinLanguageOrder 命中次数相同时的优先顺序
+var latinLanguageOrder = []string{"English", "Spanish", "French", "German", "Portuguese", "Italian"}
+
+// answerLanguageEnabled 是否为该模型别名开启回答语言检测，LANGUAGE_DETECTION 为 * 时对所有模型开启
+func answerLanguageEnabled(model string) bool {
+	for _, item := range strings.Split(config.AppConfig.LanguageDetection, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" || (item != "" && strings.EqualFold(item, model)) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectAnswerLanguage 按最后一条用户消息检测回答应使用的语言，未开启检测或无法判断时返回空
+func detectAnswerLanguage(model string, messages []ChatMessage) string {
+	if !answerLanguageEnabled(model) {
+		return ""
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return detectTextLanguage(messages[i].GetContent())
+		}
+	}
+	return ""
+}
+
+// detectTextLanguage 按文字系统和常用词判断文本的语言，字母过少时返回空
+func detectTextLanguage(text string) string {
+	counts := make([]int, len(scriptLanguages))
+	latin, letters := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for i, script := range scriptLanguages {
+			if unicode.In(r, script.table...) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	if letters < minLanguageLetters {
+		return ""
+	}
+
+	// 非拉丁文字占比较高时按文字系统判断，代码和英文术语混在其中很常见
+	best := -1
+	for i, count := range counts {
+		if count > 0 && (best < 0 || count > counts[best]) {
+			best = i
+		}
+	}
+	if best >= 0 && counts[best]*4 >= latin {
+		// 日文通常汉字多于假名，出现假名即可判断为日文
+		if scriptLanguages[best].language == "Chinese" && counts[0] > 0 {
+			return scriptLanguages[0].language
+		}
+		return scriptLanguages[best].language
+	}
+	if latin == 0 {
+		return ""
+	}
+	return detectLatinLanguage(text)
+}
+
+// detectLatinLanguage 按常用词命中次数判断拉丁字母语言
+func detectLatinLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	hits := make(map[string]int, len(latinStopwords))
+	for _, word := range words {
+		for language, stopwords := range latinStopwords {
+			if containsString(stopwords, word) {
+				hits[language]++
+			}
+		}
+	}
+
+	detected := "English"
+	for _, language := range latinLanguageOrder {
+		if hits[language] > hits[detected] {
+			detected = language
+		}
+	}
+	return detected
+}
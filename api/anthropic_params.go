@@ -0,0 +1,95 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anthropicParamsAuditInterval 同一API密钥使用相同的扩展参数时，审计日志的最短记录间隔
+const anthropicParamsAuditInterval = time.Hour
+
+// UnmarshalJSON 解析请求元数据，user_id 为数字时转为字符串，无法识别的元数据直接忽略而不是拒绝请求
+func (m *AnthropicMetadata) UnmarshalJSON(data []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+
+	switch userID := fields["user_id"].(type) {
+	case string:
+		m.UserID = userID
+	case float64:
+		m.UserID = strconv.FormatFloat(userID, 'f', -1, 64)
+	}
+	delete(fields, "user_id")
+	if len(fields) > 0 {
+		m.Extra = fields
+	}
+	return nil
+}
+
+// anthropicExtensionParams 收集请求中只记录不生效的扩展参数
+func anthropicExtensionParams(c *gin.Context, req AnthropicRequest) map[string]interface{} {
+	params := make(map[string]interface{})
+	if req.ServiceTier != "" {
+		params["service_tier"] = req.ServiceTier
+	}
+	if len(req.Betas) > 0 {
+		params["betas"] = req.Betas
+	}
+	// 官方SDK通过请求头传递beta特性
+	if header := c.GetHeader("anthropic-beta"); header != "" {
+		var betas []string
+		for _, beta := range strings.Split(header, ",") {
+			if beta = strings.TrimSpace(beta); beta != "" {
+				betas = append(betas, beta)
+			}
+		}
+		params["anthropic_beta"] = betas
+	}
+	if req.Metadata != nil && len(req.Metadata.Extra) > 0 {
+		keys := make([]string, 0, len(req.Metadata.Extra))
+		for key := range req.Metadata.Extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		params["metadata_keys"] = keys
+	}
+	return params
+}
+
+// auditAnthropicParams 将上游不支持的扩展参数记入审计日志，便于确认客户端SDK的版本变化
+// 同一API密钥使用相同参数时每小时只记录一次，避免每个请求都写入审计日志
+func auditAnthropicParams(c *gin.Context, req AnthropicRequest) {
+	params := anthropicExtensionParams(c, req)
+	if len(params) == 0 || config.RDB == nil {
+		return
+	}
+
+	key := c.GetString("api_key")
+	data, _ := json.Marshal(params)
+	digest := sha256.Sum256(data)
+	dedupeKey := "anthropic_params_audit:" + tokenFingerprint(key) + ":" + hex.EncodeToString(digest[:8])
+	if first, err := config.RedisSetNX(dedupeKey, "1", anthropicParamsAuditInterval); err != nil || !first {
+		return
+	}
+
+	params["path"] = c.Request.URL.Path
+	params["model"] = req.Model
+	audit.Record(audit.Entry{
+		Actor:  apikey.Mask(key),
+		Action: "anthropic_params_ignored",
+		Target: req.Model,
+		Detail: params,
+	})
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyRequest 创建或更新API密钥的请求
+type APIKeyRequest struct {
+	Name      string   `json:"name"`
+	Models    []string `json:"models"`
+	Status    string   `json:"status"`
+	Admin     *bool    `json:"admin"`
+	Shard     string   `json:"shard"`
+	Footer    *string  `json:"footer"`     // 为空字符串时清除
+	RateLimit *int     `json:"rate_limit"` // 每分钟请求数配额，0表示不限制
+}
+
+// currentAPIKey 获取当前请求使用的受管理API密钥，使用全局 AUTH_TOKEN 时返回nil
+func currentAPIKey(c *gin.Context) *apikey.APIKey {
+	value, exists := c.Get("api_key_info")
+	if !exists {
+		return nil
+	}
+	apiKey, _ := value.(*apikey.APIKey)
+	return apiKey
+}
+
+// enforceModelAllowlist 检查当前API密钥是否允许使用指定模型，不允许时返回OpenAI格式的错误
+func enforceModelAllowlist(c *gin.Context, model string) bool {
+	// 换用的备用模型由服务端决定，按客户端请求的模型检查
+	if requested := c.GetString("requested_model"); requested != "" {
+		model = requested
+	}
+	apiKey := currentAPIKey(c)
+	if apiKey == nil || apiKey.AllowsModel(model) {
+		return true
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  apikey.Mask(apiKey.Key),
+		Action: "model_denied",
+		Target: model,
+		Detail: map[string]interface{}{
+			"key_name":         apiKey.Name,
+			"permitted_models": apiKey.Models,
+			"path":             c.Request.URL.Path,
+		},
+	})
+
+	c.Set("error_class", "model_not_found")
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": gin.H{
+			"message":          "The model `" + model + "` does not exist or you do not have access to it. Permitted models: " + strings.Join(apiKey.Models, ", "),
+			"type":             "invalid_request_error",
+			"param":            "model",
+			"code":             "model_not_found",
+			"permitted_models": apiKey.Models,
+		},
+	})
+	return false
+}
+
+// validateAPIKeyRequest 校验并规范化请求中的模型列表和状态
+func validateAPIKeyRequest(req *APIKeyRequest) string {
+	models := make([]string, 0, len(req.Models))
+	for _, model := range req.Models {
+		if model = strings.TrimSpace(model); model != "" {
+			models = append(models, model)
+		}
+	}
+	req.Models = models
+	req.Shard = tokenmanager.NormalizeShard(req.Shard)
+	if req.Footer != nil {
+		footer := strings.TrimSpace(*req.Footer)
+		if len(footer) > maxResponseFooterBytes {
+			return "回复末尾说明过长，最多 " + strconv.Itoa(maxResponseFooterBytes) + " 字节"
+		}
+		req.Footer = &footer
+	}
+	if req.RateLimit != nil && *req.RateLimit < 0 {
+		return "每分钟请求数配额不能小于0"
+	}
+
+	if req.Status != "" && req.Status != "active" && req.Status != "disabled" {
+		return "无效的状态: " + req.Status
+	}
+	return ""
+}
+
+// ListAPIKeysHandler 获取所有API密钥
+func ListAPIKeysHandler(c *gin.Context) {
+	keys, err := apikey.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取API密钥列表失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"keys":   keys,
+	})
+}
+
+// CreateAPIKeyHandler 创建新的API密钥
+func CreateAPIKeyHandler(c *gin.Context) {
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+	if msg := validateAPIKeyRequest(&req); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  msg,
+		})
+		return
+	}
+
+	key, err := apikey.Generate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "生成API密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	apiKey := &apikey.APIKey{
+		Key:    key,
+		Name:   req.Name,
+		Models: req.Models,
+		Status: req.Status,
+		Admin:  req.Admin != nil && *req.Admin,
+		Shard:  req.Shard,
+	}
+	if req.Footer != nil {
+		apiKey.Footer = *req.Footer
+	}
+	if req.RateLimit != nil {
+		apiKey.RateLimit = *req.RateLimit
+	}
+	if err := apikey.Save(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存API密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "api_key_created",
+		Target: apikey.Mask(key),
+		Detail: map[string]interface{}{"name": req.Name, "models": req.Models, "admin": apiKey.Admin, "shard": apiKey.Shard, "footer": apiKey.Footer, "rate_limit": apiKey.RateLimit},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"key":    apiKey,
+	})
+}
+
+// UpdateAPIKeyHandler 更新API密钥的名称、可用模型、状态、回复末尾说明和每分钟请求数配额
+func UpdateAPIKeyHandler(c *gin.Context) {
+	apiKey, err := apikey.Get(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "API密钥不存在",
+		})
+		return
+	}
+
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+	if msg := validateAPIKeyRequest(&req); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  msg,
+		})
+		return
+	}
+
+	apiKey.Name = req.Name
+	apiKey.Models = req.Models
+	apiKey.Shard = req.Shard
+	if req.Status != "" {
+		apiKey.Status = req.Status
+	}
+	if req.Admin != nil {
+		apiKey.Admin = *req.Admin
+	}
+	if req.Footer != nil {
+		apiKey.Footer = *req.Footer
+	}
+	if req.RateLimit != nil {
+		apiKey.RateLimit = *req.RateLimit
+	}
+	if err := apikey.Save(apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存API密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "api_key_updated",
+		Target: apikey.Mask(apiKey.Key),
+		Detail: map[string]interface{}{"name": apiKey.Name, "models": apiKey.Models, "status": apiKey.Status, "admin": apiKey.Admin, "shard": apiKey.Shard, "footer": apiKey.Footer, "rate_limit": apiKey.RateLimit},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"key":    apiKey,
+	})
+}
+
+// DeleteAPIKeyHandler 删除API密钥
+func DeleteAPIKeyHandler(c *gin.Context) {
+	key := c.Param("key")
+	if _, err := apikey.Get(key); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "API密钥不存在",
+		})
+		return
+	}
+
+	if err := apikey.Delete(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除API密钥失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "api_key_deleted",
+		Target: apikey.Mask(key),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// AuditLogHandler 获取最近的审计日志
+func AuditLogHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		limit = 100
+	}
+
+	entries, err := audit.List(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取审计日志失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"entries": entries,
+	})
+}
@@ -2,7 +2,9 @@ package api
 
 import (
 	"augment2api/config"
+	"augment2api/pkg/apikey"
 	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
 	"fmt"
 	"net/http"
 	"strings"
@@ -13,8 +15,25 @@ import (
 // AuthMiddleware 验证请求的Authorization header
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// 优先匹配后台创建的API密钥，每个密钥可单独限制可用模型
+		if apiKey, err := apikey.Get(extractAPIKey(c)); err == nil {
+			if !apiKey.Active() {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "API key is disabled"})
+				c.Abort()
+				return
+			}
+			c.Set("api_key", apiKey.Key)
+			c.Set("api_key_info", apiKey)
+			c.Set("token_shard", requestShard(c, apiKey, apiKey.Admin))
+			c.Next()
+			return
+		}
+
 		// 如果未设置 AuthToken，则不启用鉴权
 		if config.AppConfig.AuthToken == "" {
+			// 仍然记录调用方密钥，用于会话隔离等按调用方区分的功能
+			c.Set("api_key", extractAPIKey(c))
+			c.Set("token_shard", requestShard(c, nil, true))
 			c.Next()
 			return
 		}
@@ -38,6 +57,49 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		c.Set("api_key", token)
+		c.Set("token_shard", requestShard(c, nil, true))
+		c.Next()
+	}
+}
+
+// PrivilegedKeyMiddleware 要求请求使用管理密钥或 AUTH_TOKEN，需放在 AuthMiddleware 之后；
+// 未启用鉴权且未使用受管理密钥时保持原有行为放行
+func PrivilegedKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := currentAPIKey(c)
+		if info == nil && config.AppConfig.AuthToken == "" {
+			c.Next()
+			return
+		}
+		if !apikey.IsPrivileged(info, c.GetString("api_key")) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "error",
+				"error":  "只有管理密钥可以执行此操作",
+			})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
+
+// requestShard 请求使用的token分片：API密钥设置的分片优先，其次是配置的分片请求头，都没有时使用未划分分片的token；
+// 分片请求头只对管理密钥和 AUTH_TOKEN 生效（未启用鉴权时对所有请求生效），普通API密钥不能借此使用其他分片的token
+func requestShard(c *gin.Context, apiKey *apikey.APIKey, trustHeader bool) string {
+	if apiKey != nil && apiKey.Shard != "" {
+		return apiKey.Shard
+	}
+	if header := config.AppConfig.ShardHeader; header != "" && trustHeader {
+		return tokenmanager.NormalizeShard(c.GetHeader(header))
+	}
+	return ""
+}
+
+// extractAPIKey 从请求头中提取调用方密钥，兼容OpenAI和Anthropic两种格式
+func extractAPIKey(c *gin.Context) string {
+	if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	return strings.TrimSpace(c.GetHeader("x-api-key"))
+}
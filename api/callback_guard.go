@@ -0,0 +1,102 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errCallbackAddressBlocked 回调地址指向内网、回环或链路本地地址
+var errCallbackAddressBlocked = errors.New("回调地址不能指向内网、回环或链路本地地址")
+
+// sharedAddressSpace 运营商级NAT地址段，部分云厂商的元数据服务位于该地址段
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// callbackClient 推送回调结果的客户端，连接时检查解析出的地址，不跟随重定向，不使用环境变量中的代理
+var callbackClient = &http.Client{
+	Timeout: callbackDeliveryTimeout,
+	Transport: &http.Transport{
+		DialContext:         dialCallback,
+		TLSHandshakeTimeout: callbackDeliveryTimeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	// 重定向可能指向内网地址，3xx按非2xx状态码处理
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// blockedCallbackIP 回调不允许连接的地址：回环、内网、链路本地、未指定、组播和运营商级NAT地址
+func blockedCallbackIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// callbackHostAllowlisted 域名是否在 CALLBACK_ALLOWED_HOSTS 中，以点开头的配置项匹配其子域名
+func callbackHostAllowlisted(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, item := range strings.Split(config.AppConfig.CallbackAllowedHosts, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if host == item || (strings.HasPrefix(item, ".") && strings.HasSuffix(host, item)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCallbackURL 提交请求时检查回调地址：配置了允许的域名时只能使用这些域名，
+// 否则不能直接使用内网等地址，域名解析出的地址在连接时再检查
+func validateCallbackURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Hostname() == "" {
+		return errors.New("必须为 http 或 https 地址")
+	}
+	host := parsed.Hostname()
+	if callbackHostAllowlisted(host) {
+		return nil
+	}
+	if config.AppConfig.CallbackAllowedHosts != "" {
+		return fmt.Errorf("域名 %s 不在允许的回调域名中", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedCallbackIP(ip) {
+		return errCallbackAddressBlocked
+	}
+	return nil
+}
+
+// dialCallback 建立回调连接，允许的域名直接连接，其他域名在解析后检查实际连接的地址，避免通过DNS指向内网
+func dialCallback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: callbackDeliveryTimeout}
+	if callbackHostAllowlisted(host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if config.AppConfig.CallbackAllowedHosts != "" {
+		return nil, fmt.Errorf("域名 %s 不在允许的回调域名中", host)
+	}
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		ip, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if parsed := net.ParseIP(ip); parsed == nil || blockedCallbackIP(parsed) {
+			return errCallbackAddressBlocked
+		}
+		return nil
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/convert"
+	"augment2api/pkg/job"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxContextTokens 单个请求允许的估算上下文token数，0表示不限制
+func maxContextTokens() int {
+	limit, err := strconv.Atoi(config.AppConfig.MaxContextTokens)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// requestContextTokens 估算请求中系统提示和所有消息的token数
+func requestContextTokens(parsed interface{}) int {
+	var messages []ChatMessage
+	total := 0
+	switch req := parsed.(type) {
+	case *OpenAIRequest:
+		messages = req.Messages
+	case *AnthropicRequest:
+		messages = req.Messages
+		total += estimateTokenCount(convert.SystemText(req.System))
+	}
+	for _, message := range messages {
+		total += estimateTokenCount(message.GetContent())
+	}
+	return total
+}
+
+// respondContextLengthExceeded 返回上下文超过上限的错误
+func respondContextLengthExceeded(c *gin.Context, tokens, limit int) {
+	c.Set("error_class", "invalid_request")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"message": fmt.Sprintf("This deployment's maximum context length is %d tokens. However, your messages resulted in about %d tokens. Please reduce the length of the messages.", limit, tokens),
+			"type":    "invalid_request_error",
+			"param":   "messages",
+			"code":    "context_length_exceeded",
+		},
+	})
+}
+
+// CapabilitiesHandler 返回当前部署支持的功能和限制，结果由实际配置决定，客户端可据此调整请求方式
+func CapabilitiesHandler(c *gin.Context) {
+	models := []gin.H{}
+	apiKey := currentAPIKey(c)
+	for _, model := range knownModels {
+		if apiKey == nil || apiKey.AllowsModel(model) {
+			models = append(models, gin.H{"id": model, "mode": strings.ToLower(modeForModel(model))})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":  "capabilities",
+		"version": config.Version,
+		"models":  models,
+		"endpoints": gin.H{
+			"chat_completions":   true,
+			"messages":           true,
+			"models":             true,
+			"conversation_title": true,
+			"jobs":               job.Enabled(),
+		},
+		"features": gin.H{
+			"streaming":           true,
+			"stream_usage":        true,
+			"tools":               false, // 不接受客户端定义的工具
+			"agent_tools":         true,  // AGENT模式使用内置工具并返回工具调用
+			"stop_on_tool":        config.AppConfig.StopOnTool == "true",
+			"vision":              false, // 图片内容块会被忽略
+			"json_mode":           false,
+			"batches":             false,
+			"async_callbacks":     job.Enabled(),
+			"async_requests":      job.Enabled(),
+			"stop_sequences":      true, // 仅Anthropic消息接口
+			"multiple_choices":    maxCompletionChoices() > 1,
+			"model_fallback":      strings.TrimSpace(config.AppConfig.ModelFallbacks) != "",
+			"language_detection":  strings.TrimSpace(config.AppConfig.LanguageDetection) != "",
+			"cluster_queue":       clusterQueueEnabled(),
+			"token_contribution":  config.AppConfig.TokenContribution == "true",
+			"key_system_prompt":   currentAPIKey(c) != nil,
+			"conversation_export": conversationStoreEnabled(),
+			"strict_params":       strictParams(c),
+			"rate_limit_headers":  config.AppConfig.RateLimitHeaders == "true",
+			"response_footer":     keyResponseFooter(c) != "",
+		},
+		"limits": gin.H{
+			"max_context_tokens":      maxContextTokens(),
+			"max_request_body_bytes":  maxRequestBodyBytes(),
+			"max_completion_choices":  maxCompletionChoices(),
+			"request_timeout_seconds": requestTimeoutSeconds(),
+		},
+	})
+}
@@ -0,0 +1,355 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chatCallbackJobType 带回调地址的聊天请求的任务类型
+	chatCallbackJobType = "chat_completion_callback"
+	// callbackDeliveryTimeout 单次回调请求的超时时间
+	callbackDeliveryTimeout = 10 * time.Second
+)
+
+// chatCallbackPayload 回调任务的参数，保存执行请求所需的全部信息
+type chatCallbackPayload struct {
+	Request     OpenAIRequest `json:"request"`
+	CallbackURL string        `json:"callback_url"`                // 为空时不推送结果，由调用方查询
+	Country     string        `json:"client_ip_country,omitempty"` // 提交请求的客户端国家，用于提示词模板
+	Shard       string        `json:"shard,omitempty"`             // 提交请求时所属的token分片
+	Footer      string        `json:"footer,omitempty"`            // 提交请求的API密钥配置的回复末尾说明
+}
+
+// chatCallbackResult 回调任务的结果，生成成功后保存响应，回调失败重试时不再重复请求上游
+type chatCallbackResult struct {
+	Response  *OpenAIResponse `json:"response,omitempty"`
+	Delivered bool            `json:"delivered"`
+}
+
+// chatCallbackEvent 推送到回调地址的内容
+type chatCallbackEvent struct {
+	ID       string          `json:"id"`
+	Object   string          `json:"object"`
+	Status   string          `json:"status"`
+	Response *OpenAIResponse `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// RegisterJobs 注册api包中的后台任务类型
+func RegisterJobs() {
+	job.Register(chatCallbackJobType, runChatCallbackJob, job.Options{
+		MaxAttempts: 5,
+		Timeout:     10 * time.Minute,
+	})
+	job.Register(tokenConfirmJobType, runTokenConfirmJob, job.Options{
+		MaxAttempts: 3,
+		Timeout:     2 * time.Minute,
+	})
+	job.Register(rebalanceWebhookJobType, runRebalanceWebhookJob, job.Options{
+		MaxAttempts: 5,
+		Timeout:     time.Minute,
+	})
+	job.Register(tokenDedupeJobType, runTokenDedupeJob, job.Options{
+		MaxAttempts: 2,
+		Timeout:     10 * time.Minute,
+	})
+	job.Register(tokenImportJobType, runTokenImportJob, job.Options{
+		MaxAttempts: 3,
+		Timeout:     30 * time.Minute,
+	})
+	job.Register(clusterChatJobType, runClusterChatJob, job.Options{
+		MaxAttempts: 2,
+		Timeout:     10 * time.Minute,
+		Queue:       clusterQueueName,
+	})
+}
+
+// enqueueChatCallback 将带回调地址或异步的请求提交为后台任务，立即返回任务编号和查询地址
+func enqueueChatCallback(c *gin.Context, req OpenAIRequest) {
+	if !job.Enabled() {
+		param := "callback_url"
+		if req.CallbackURL == "" {
+			param = "async"
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": gin.H{
+				"message": "Asynchronous requests are not available on this server.",
+				"type":    "server_error",
+				"param":   param,
+				"code":    "callback_unavailable",
+			},
+		})
+		return
+	}
+
+	payload := chatCallbackPayload{
+		CallbackURL: req.CallbackURL,
+		Country:     clientIPCountry(c),
+		Shard:       c.GetString("token_shard"),
+		Footer:      keyResponseFooter(c),
+	}
+	req.CallbackURL = ""
+	req.Async = false
+	payload.Request = req
+
+	j, err := job.Enqueue(chatCallbackJobType, tokenFingerprint(c.GetString("api_key")), payload)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("提交回调任务失败")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": gin.H{
+				"message": "Failed to queue the request.",
+				"type":    "server_error",
+				"param":   nil,
+				"code":    nil,
+			},
+		})
+		return
+	}
+
+	// 查询地址与当前请求使用相同的路由前缀
+	prefix := c.FullPath()
+	if idx := strings.LastIndex(prefix, "/v1"); idx >= 0 {
+		prefix = prefix[:idx]
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":         j.ID,
+		"object":     "chat.completion.job",
+		"status":     j.Status,
+		"created":    j.CreatedAt.Unix(),
+		"status_url": prefix + "/v1/requests/" + j.ID,
+	})
+}
+
+// runChatCallbackJob 执行聊天请求并将结果推送到回调地址，没有回调地址时只保存结果
+// 生成结果保存在任务中，回调失败重试时只重新推送
+func runChatCallbackJob(ctx context.Context, j *job.Job) error {
+	var payload chatCallbackPayload
+	if err := j.DecodePayload(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	var result chatCallbackResult
+	if len(j.Result) > 0 {
+		json.Unmarshal(j.Result, &result)
+	}
+
+	if result.Response == nil {
+		resp, err := generateCallbackResponse(ctx, payload.Request, payload.Country, payload.Shard, payload.Footer, "")
+		if err != nil {
+			// 最后一次尝试仍失败时通知调用方，通知失败不影响任务结果
+			if j.Attempts >= j.MaxAttempts && payload.CallbackURL != "" {
+				deliverCallback(ctx, payload.CallbackURL, chatCallbackEvent{
+					ID:     j.ID,
+					Object: "chat.completion.callback",
+					Status: job.StatusFailed,
+					Error:  err.Error(),
+				})
+			}
+			return err
+		}
+		result.Response = resp
+		j.SetResult(result)
+	}
+	if payload.CallbackURL == "" {
+		return nil
+	}
+
+	err := deliverCallback(ctx, payload.CallbackURL, chatCallbackEvent{
+		ID:       j.ID,
+		Object:   "chat.completion.callback",
+		Status:   job.StatusSucceeded,
+		Response: result.Response,
+	})
+	if err != nil {
+		return err
+	}
+	result.Delivered = true
+	j.SetResult(result)
+	return nil
+}
+
+// errNoAvailableToken 后台执行聊天请求时没有可用token
+var errNoAvailableToken = errors.New("当前无可用token")
+
+// generateCallbackResponse 在后台任务中执行一次非流式聊天请求，ctx为任务的执行上下文
+// 没有可用token时立即返回 errNoAvailableToken，由任务决定是否稍后重新执行；footer 追加在回复末尾，
+// reservation 为提交时通过检查的额度预留，获取到token后计数
+func generateCallbackResponse(ctx context.Context, req OpenAIRequest, country, shard, footer, reservation string) (*OpenAIResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	augmentReq := convertToAugmentRequest(req)
+	vars := templateVarsFor(req.Model, country)
+	applyRequestTransforms(&augmentReq, req.Model, vars)
+	applyPromptTemplates(&augmentReq, vars)
+
+	lease, ok := tokenmanager.AcquireToken(augmentReq.Mode, shard, nil)
+	if !ok {
+		return nil, errNoAvailableToken
+	}
+	defer lease.Release()
+	tokenmanager.CommitReservation(reservation)
+
+	asyncIncrementTokenUsage(lease.Token, req.Model)
+	text, err := fetchAugmentText(ctx, lease.Token, lease.TenantURL, lease.SessionID, augmentReq)
+	if err != nil {
+		// 任务被取消或超时不计入token的失败次数
+		if ctx.Err() == nil {
+			tokenmanager.RecordGenerationFailure(lease.Token)
+		}
+		return nil, err
+	}
+	tokenmanager.ResetGenerationFailures(lease.Token)
+	text = withResponseFooter(filterOutputText(text), footer)
+
+	promptTokens := estimatePromptTokens(augmentReq)
+	completionTokens := estimateTokenCount(text)
+	finishReason := "stop"
+	return &OpenAIResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []Choice{
+			{
+				Index: 0,
+				Message: ChatMessage{
+					Role:    "assistant",
+					Content: text,
+				},
+				FinishReason: &finishReason,
+			},
+		},
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}, nil
+}
+
+// callbackSecret 回调签名密钥，未配置时使用 AUTH_TOKEN
+func callbackSecret() string {
+	if config.AppConfig.CallbackSecret != "" {
+		return config.AppConfig.CallbackSecret
+	}
+	return config.AppConfig.AuthToken
+}
+
+// signCallback 计算回调签名，签名内容为 "时间戳.请求体"，接收方应同时校验时间戳防止重放
+func signCallback(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(callbackSecret()))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback 将结果推送到回调地址，返回非2xx状态码时视为失败
+func deliverCallback(ctx context.Context, callbackURL string, event chatCallbackEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return job.Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return job.Permanent(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "augment2api-callback")
+	req.Header.Set("X-Augment-Timestamp", timestamp)
+	req.Header.Set("X-Augment-Signature", signCallback(timestamp, body))
+
+	resp, err := callbackClient.Do(req)
+	if errors.Is(err, errCallbackAddressBlocked) {
+		return job.Permanent(fmt.Errorf("回调请求失败: %w", err))
+	}
+	if err != nil {
+		return fmt.Errorf("回调请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("回调地址返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// JobStatusHandler 查询回调任务的状态和结果，只能查询当前API密钥提交的任务
+func JobStatusHandler(c *gin.Context) {
+	j, ok := ownedJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, chatJobStatus(j))
+}
+
+// ownedJob 获取当前API密钥提交的任务，不存在或不属于当前调用方时返回404
+func ownedJob(c *gin.Context) (*job.Job, bool) {
+	j, err := job.Get(c.Param("id"))
+	if err != nil || j.Owner != tokenFingerprint(c.GetString("api_key")) {
+		respondJobNotFound(c)
+		return nil, false
+	}
+	return j, true
+}
+
+// respondJobNotFound 返回任务不存在的错误
+func respondJobNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": gin.H{
+			"message": "No job found with id '" + c.Param("id") + "'.",
+			"type":    "invalid_request_error",
+			"param":   "id",
+			"code":    "job_not_found",
+		},
+	})
+}
+
+// chatJobStatus 后台聊天任务的状态和结果
+func chatJobStatus(j *job.Job) gin.H {
+	var result chatCallbackResult
+	if len(j.Result) > 0 {
+		json.Unmarshal(j.Result, &result)
+	}
+	response := gin.H{
+		"id":         j.ID,
+		"object":     "chat.completion.job",
+		"status":     j.Status,
+		"attempts":   j.Attempts,
+		"delivered":  result.Delivered,
+		"created":    j.CreatedAt.Unix(),
+		"updated":    j.UpdatedAt.Unix(),
+		"response":   result.Response,
+		"last_error": nil,
+	}
+	if j.Error != "" {
+		response["last_error"] = j.Error
+	}
+	return response
+}
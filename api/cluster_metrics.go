@@ -0,0 +1,167 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metricsSnapshotKeyPrefix 各实例指标快照在Redis中的键前缀
+	metricsSnapshotKeyPrefix = "metrics_snapshot:"
+	// metricsPublishInterval 实例发布指标快照的间隔
+	metricsPublishInterval = 15 * time.Second
+	// metricsSnapshotTTL 快照有效期，实例退出后其指标在过期后不再计入汇总
+	metricsSnapshotTTL = 3 * metricsPublishInterval
+)
+
+// metricsSnapshot 单个实例发布的指标快照
+type metricsSnapshot struct {
+	Instance  string           `json:"instance"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Families  []metrics.Family `json:"families"`
+}
+
+// MetricTotal 所有实例汇总后的单个指标
+type MetricTotal struct {
+	Kind   string             `json:"kind"`
+	Values map[string]float64 `json:"values,omitempty"` // 标签值 -> 合计，无标签时键为空字符串
+	Count  uint64             `json:"count,omitempty"`  // summary 的累计观测次数
+	Sum    float64            `json:"sum,omitempty"`    // summary 的累计总和
+}
+
+// sharedMetricsEnabled 是否通过Redis汇总所有实例的指标
+func sharedMetricsEnabled() bool {
+	return config.AppConfig.SharedMetrics == "true" && config.RDB != nil
+}
+
+// localMetricsSnapshot 生成本实例的指标快照
+func localMetricsSnapshot() metricsSnapshot {
+	return metricsSnapshot{
+		Instance:  leader.InstanceID(),
+		UpdatedAt: time.Now(),
+		Families:  metrics.Snapshot(),
+	}
+}
+
+// publishMetricsSnapshot 将本实例的指标快照写入Redis
+func publishMetricsSnapshot() {
+	snapshot := localMetricsSnapshot()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	if err := config.RedisSet(metricsSnapshotKeyPrefix+snapshot.Instance, string(data), metricsSnapshotTTL); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("发布指标快照失败")
+	}
+}
+
+// loadMetricsSnapshots 读取所有实例的指标快照，本实例使用实时数据
+func loadMetricsSnapshots() []metricsSnapshot {
+	local := localMetricsSnapshot()
+	snapshots := []metricsSnapshot{local}
+	if !sharedMetricsEnabled() {
+		return snapshots
+	}
+
+	keys, err := config.RedisKeys(metricsSnapshotKeyPrefix + "*")
+	if err != nil {
+		return snapshots
+	}
+	for _, key := range keys {
+		if key == metricsSnapshotKeyPrefix+local.Instance {
+			continue
+		}
+		data, err := config.RedisGet(key)
+		if err != nil {
+			continue
+		}
+		var snapshot metricsSnapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Instance < snapshots[j].Instance
+	})
+	return snapshots
+}
+
+// StartMetricsPublisher 定期发布本实例的指标快照，供其他实例汇总
+func StartMetricsPublisher() {
+	if !sharedMetricsEnabled() {
+		return
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"instance": leader.InstanceID(),
+		"interval": metricsPublishInterval.String(),
+	}).Info("指标汇总已启动")
+
+	ticker := time.NewTicker(metricsPublishInterval)
+	defer ticker.Stop()
+	for {
+		publishMetricsSnapshot()
+		<-ticker.C
+	}
+}
+
+// MetricsHandler 以Prometheus文本格式输出监控指标，开启指标汇总时输出所有实例的合计和各实例的值
+func MetricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if !sharedMetricsEnabled() {
+		metrics.WriteText(c.Writer)
+		return
+	}
+
+	replicas := make(map[string][]metrics.Family)
+	for _, snapshot := range loadMetricsSnapshots() {
+		replicas[snapshot.Instance] = snapshot.Families
+	}
+	metrics.WriteCluster(c.Writer, replicas)
+}
+
+// StatsHandler 以JSON格式返回所有实例汇总后的指标及各实例的快照
+func StatsHandler(c *gin.Context) {
+	snapshots := loadMetricsSnapshots()
+
+	totals := make(map[string]*MetricTotal)
+	for _, snapshot := range snapshots {
+		for _, family := range snapshot.Families {
+			total, ok := totals[family.Name]
+			if !ok {
+				total = &MetricTotal{Kind: family.Kind}
+				totals[family.Name] = total
+			}
+			for key, value := range family.Values {
+				if total.Values == nil {
+					total.Values = make(map[string]float64)
+				}
+				total.Values[key] += value
+			}
+			total.Count += family.Count
+			total.Sum += family.Sum
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"shared":    sharedMetricsEnabled(),
+		"instance":  leader.InstanceID(),
+		"totals":    totals,
+		"instances": snapshots,
+	})
+}
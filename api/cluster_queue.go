@@ -0,0 +1,247 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"augment2api/pkg/queue"
+	tokenmanager "augment2api/pkg/token"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clusterChatJobType 共享队列中的非流式聊天请求的任务类型
+	clusterChatJobType = "cluster_chat_completion"
+	// clusterQueueName 共享请求队列的名称，与其他后台任务分开领取
+	clusterQueueName = "chat"
+	// clusterPollInterval 等待共享队列结果的间隔
+	clusterPollInterval = 200 * time.Millisecond
+	// clusterRetryInterval 没有可用token时任务放回队列后重新领取的间隔
+	clusterRetryInterval = time.Second
+)
+
+var (
+	_ = metrics.NewGaugeFunc("augment2api_cluster_queue_depth",
+		"Requests waiting in the shared cluster request queue.", func() float64 {
+			return float64(job.Pending(clusterQueueName))
+		})
+	clusterQueueOutcomes = metrics.NewCounterVec("augment2api_cluster_queue_requests_total",
+		"Requests served through the shared cluster request queue, by outcome.", "outcome")
+)
+
+// clusterChatPayload 共享队列任务的参数，保存执行请求所需的全部信息
+type clusterChatPayload struct {
+	Request     OpenAIRequest `json:"request"`
+	Country     string        `json:"client_ip_country,omitempty"`
+	Shard       string        `json:"shard,omitempty"`
+	Footer      string        `json:"footer,omitempty"`
+	Reservation string        `json:"reservation,omitempty"` // 应计入的额度预留，任务获取到token后计数
+	WaitUntil   time.Time     `json:"wait_until"`            // 没有可用token时最多等待到该时间
+}
+
+// clusterChatResult 共享队列任务的结果
+type clusterChatResult struct {
+	Response *OpenAIResponse `json:"response,omitempty"`
+}
+
+// clusterQueueEnabled 是否将非流式聊天请求提交到共享队列
+func clusterQueueEnabled() bool {
+	return config.AppConfig.ClusterQueue == "true" && job.Enabled()
+}
+
+// clusterQueueWorkers 当前实例执行共享队列请求的工作协程数
+func clusterQueueWorkers() int {
+	workers, err := strconv.Atoi(config.AppConfig.ClusterQueueWorkers)
+	if err != nil || workers < 0 {
+		return 4
+	}
+	return workers
+}
+
+// StartClusterQueue 开启共享队列时启动当前实例的工作协程
+func StartClusterQueue() {
+	if !clusterQueueEnabled() {
+		return
+	}
+	job.StartQueue(clusterQueueName, clusterQueueWorkers())
+}
+
+// clusterQueueable 请求是否可以由其他实例执行，流式、后台执行、多候选、指定token和绑定对话的请求仍在本实例处理
+func clusterQueueable(c *gin.Context) (*OpenAIRequest, bool) {
+	value, exists := c.Get("request_body")
+	if !exists {
+		return nil, false
+	}
+	req, ok := value.(*OpenAIRequest)
+	if !ok || req.Stream || req.CallbackURL != "" || req.Async || req.N > 1 {
+		return nil, false
+	}
+	if c.GetHeader("X-Augment-Token-Fingerprint") != "" || c.GetString("conversation_id") != "" {
+		return nil, false
+	}
+	return req, true
+}
+
+// ClusterQueueMiddleware 开启共享队列时将非流式聊天请求提交到Redis，由任意实例的工作协程领取执行，
+// 本实例只等待结果并返回，不占用本实例的token；需挂载在校验中间件之后、并发控制中间件之前
+func ClusterQueueMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !clusterQueueEnabled() {
+			c.Next()
+			return
+		}
+		req, ok := clusterQueueable(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		// 与处理函数一致的前置检查，未通过时已写入错误响应
+		if !enforceModelAllowlist(c, req.Model) || !setEndUser(c, req.User) {
+			c.Abort()
+			cleanupRequestStatus(c)
+			return
+		}
+		allowed, wait, reservation := tokenmanager.AdmitReservation(c.GetString("api_key"), c.GetString("augment_mode"))
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前额度已为计划任务预留，请稍后再试"})
+			c.Abort()
+			cleanupRequestStatus(c)
+			return
+		}
+		c.Set("model", req.Model)
+
+		_, maxWait := queue.Limits()
+		payload := clusterChatPayload{
+			Request:     *req,
+			Country:     clientIPCountry(c),
+			Shard:       c.GetString("token_shard"),
+			Footer:      keyResponseFooter(c),
+			Reservation: reservation,
+			WaitUntil:   time.Now().Add(maxWait),
+		}
+		if deadline, ok := tokenmanager.RequestDeadline(c); ok && deadline.Before(payload.WaitUntil) {
+			payload.WaitUntil = deadline
+		}
+		j, err := job.Enqueue(clusterChatJobType, tokenFingerprint(c.GetString("api_key")), payload)
+		if err != nil {
+			// 提交失败时交给后续中间件在本实例处理，预留额度由并发控制中间件获取到token后计数
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("提交共享队列请求失败，改为本实例处理")
+			clusterQueueOutcomes.Inc("local")
+			c.Next()
+			return
+		}
+		c.Abort()
+		defer cleanupRequestStatus(c)
+		c.Header("X-Job-Id", j.ID)
+
+		waitForClusterResult(c, j.ID)
+	}
+}
+
+// waitForClusterResult 等待共享队列任务完成并返回结果，客户端断开时取消任务，避免无人接收的请求继续占用token；
+// 超出总耗时预算时只停止等待，任务本身不会取消，结果仍可通过任务查询接口获取
+func waitForClusterResult(c *gin.Context, id string) {
+	ctx := c.Request.Context()
+	if deadline, ok := tokenmanager.RequestDeadline(c); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(clusterPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			clusterQueueOutcomes.Inc("abandoned")
+			if c.Request.Context().Err() != nil {
+				job.Cancel(id)
+				return
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				tokenmanager.RecordBudgetExhausted("queue")
+				c.JSON(http.StatusGatewayTimeout, gin.H{"error": "等待共享队列结果超出请求的总耗时预算"})
+			}
+			return
+		case <-ticker.C:
+		}
+
+		j, err := job.Get(id)
+		if err != nil {
+			clusterQueueOutcomes.Inc("failed")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "共享队列任务已丢失"})
+			return
+		}
+		switch j.Status {
+		case job.StatusSucceeded:
+			var result clusterChatResult
+			if err := json.Unmarshal(j.Result, &result); err != nil || result.Response == nil {
+				clusterQueueOutcomes.Inc("failed")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "解析共享队列结果失败"})
+				return
+			}
+			clusterQueueOutcomes.Inc("succeeded")
+			recordCompletionLength(c, result.Response.Choices[0].Message.GetContent())
+			c.JSON(http.StatusOK, result.Response)
+			recordReviewSample(c)
+			recordTranscript(c)
+			return
+		case job.StatusFailed:
+			if j.Error == errNoAvailableToken.Error() {
+				clusterQueueOutcomes.Inc("no_token")
+				if wait, ok := tokenmanager.RetryAfter(); ok {
+					c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+				}
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
+				return
+			}
+			clusterQueueOutcomes.Inc("failed")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + j.Error})
+			return
+		}
+	}
+}
+
+// runClusterChatJob 执行共享队列中的聊天请求，没有可用token时放回队列稍后重新领取，
+// 等待期间不占用工作协程，超出排队时限后结束任务
+func runClusterChatJob(ctx context.Context, j *job.Job) error {
+	var payload clusterChatPayload
+	if err := j.DecodePayload(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	resp, err := generateCallbackResponse(ctx, payload.Request, payload.Country, payload.Shard, payload.Footer, payload.Reservation)
+	if err == errNoAvailableToken {
+		if wait := time.Until(payload.WaitUntil); wait > 0 {
+			return job.Defer(err, min(clusterRetryInterval, wait))
+		}
+		// 等待时限已过，提交请求的实例会返回429
+		return job.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	return j.SetResult(clusterChatResult{Response: resp})
+}
+
+// clusterQueueStatus 共享队列的状态
+func clusterQueueStatus() gin.H {
+	return gin.H{
+		"enabled":  clusterQueueEnabled(),
+		"depth":    job.Pending(clusterQueueName),
+		"workers":  clusterQueueWorkers(),
+		"outcomes": clusterQueueOutcomes.Values(),
+	}
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+// knownModels 上游实际提供的模型
+var knownModels = []string{"claude-4-agent", "claude-4-chat"}
+
+// secretConfigKeys 可能包含凭据的配置项，对比结果中不返回原值
+var secretConfigKeys = map[string]bool{
+	"REDIS_CONN_STRING": true,
+	"ACCESS_PWD":        true,
+	"AUTH_TOKEN":        true,
+	"CODING_TOKEN":      true,
+	"PROXY_URL":         true,
+	"REQUEST_SIGNERS":   true,
+	"UPSTREAM_HEADERS":  true,
+	"CALLBACK_SECRET":   true,
+	"UPDATE_WEBHOOK":    true,
+	"ALERT_WEBHOOK":     true,
+	"REBALANCE_WEBHOOK": true,
+	"REDIS_PASSWORD":    true,
+}
+
+// 按取值类型分组的配置项
+var (
+	boolConfigKeys = []string{
+		"CODING_MODE", "REMOVE_FREE", "STARTUP_VALIDATION", "DISABLE_INJECTION", "DEBUG_PAYLOAD_HEADER",
+		"LEADER_ELECTION", "MOCK_UPSTREAM", "OUTPUT_FILTER", "STOP_ON_TOOL", "CHAOS_MODE",
+		"CLIENT_TOKEN_ROTATION", "UPDATE_CHECK", "TRACE_HEADERS", "TOKEN_SCORING", "SHARED_METRICS",
+		"AGENT_CONVERSATION_AFFINITY", "UPSTREAM_HTTP2", "CLUSTER_QUEUE",
+		"TOKEN_CONTRIBUTION", "REVIEW_SAMPLE_SCRUB", "CONVERSATION_STORE", "STRICT_PARAMS", "REDIS_TLS",
+		"RATE_LIMIT_HEADERS", "GUIDELINE_GUARD", "REDIS_DEGRADE",
+	}
+	intConfigKeys = []string{
+		"STARTUP_VALIDATION_CONCURRENCY", "MAX_COMPLETION_CHOICES", "REQUEST_QUEUE_LENGTH", "REQUEST_QUEUE_MAX_WAIT",
+		"CHAOS_SLOW_DELAY_MS", "USER_RATE_LIMIT", "UPSTREAM_IDLE_CONNS", "UPSTREAM_WARM_INTERVAL",
+		"MAX_REQUEST_BODY_MB", "KEY_CLEANUP_INTERVAL", "DISABLED_TOKEN_RETENTION_DAYS", "AGENT_MIGRATE_THRESHOLD",
+		"USAGE_FLUSH_INTERVAL", "UPSTREAM_HTTP2_PING_INTERVAL", "JOB_WORKERS", "FIRST_TOKEN_SLO_MS",
+		"FIRST_TOKEN_SLO_SUSTAIN", "INVALID_TOKEN_CONFIRM_DELAY", "MAX_CONTEXT_TOKENS", "REQUEST_TIMEOUT",
+		"CLUSTER_QUEUE_WORKERS", "UPSTREAM_IDLE_TIMEOUT", "MAINTENANCE_RETRY_AFTER",
+		"CONVERSATION_RETENTION_DAYS", "SHARD_CONCURRENCY_LIMIT", "SHARD_CONCURRENCY_MIN",
+		"TENANT_CHECK_MAX_CANDIDATES", "GUIDELINE_MAX_LENGTH", "REDIS_DEGRADE_LATENCY_MS",
+		"REDIS_DEGRADE_TRIPS", "REDIS_DEGRADE_COOLDOWN",
+	}
+	ratioConfigKeys    = []string{"TOKEN_SCORE_EXPLORATION", "SUSPECT_OUTPUT_RATIO", "REVIEW_SAMPLE_RATE"}
+	durationConfigKeys = []string{"LATENCY_PROBE_INTERVAL", "VALIDATOR_INTERVAL"}
+	urlConfigKeys      = []string{"TENANT_URL", "PROXY_URL", "UPDATE_WEBHOOK", "ALERT_WEBHOOK", "REBALANCE_WEBHOOK"}
+	enumConfigKeys     = map[string][]string{
+		"SESSION_STRATEGY":      {"token", "api_key"},
+		"PARTIAL_FINISH_REASON": {"length", "error"},
+		"USAGE_COUNTER_STORE":   {"redis", "memory"},
+		"REVIEW_SAMPLE_CONSENT": {"all", "opt_in"},
+	}
+)
+
+// ConfigIssue 候选配置中的一个问题
+type ConfigIssue struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+// ConfigChange 候选配置与当前配置不同的配置项
+type ConfigChange struct {
+	Key       string `json:"key"`
+	Field     string `json:"field"`
+	Current   string `json:"current"`
+	Candidate string `json:"candidate"`
+}
+
+// configValidator 收集校验结果
+type configValidator struct {
+	values   map[string]string
+	errors   []ConfigIssue
+	warnings []ConfigIssue
+}
+
+func (v *configValidator) fail(key, format string, args ...interface{}) {
+	v.errors = append(v.errors, ConfigIssue{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) warn(key, format string, args ...interface{}) {
+	v.warnings = append(v.warnings, ConfigIssue{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// validate 校验完整的候选配置，空值表示未配置或使用默认值
+func (v *configValidator) validate() {
+	for _, key := range boolConfigKeys {
+		if value := v.values[key]; value != "" && value != "true" && value != "false" {
+			v.fail(key, "应为 true 或 false: %s", value)
+		}
+	}
+	for _, key := range intConfigKeys {
+		if value := v.values[key]; value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				v.fail(key, "应为非负整数: %s", value)
+			}
+		}
+	}
+	for _, key := range ratioConfigKeys {
+		if value := v.values[key]; value != "" {
+			if r, err := strconv.ParseFloat(value, 64); err != nil || r < 0 || r > 1 {
+				v.fail(key, "应为0到1之间的小数: %s", value)
+			}
+		}
+	}
+	for _, key := range durationConfigKeys {
+		if value := v.values[key]; value != "" {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				v.fail(key, "时长格式无效，示例: 10m、30s: %s", value)
+			}
+		}
+	}
+	for _, key := range urlConfigKeys {
+		if value := v.values[key]; value != "" {
+			if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+				v.fail(key, "URL格式无效")
+			}
+		}
+	}
+	for key, allowed := range enumConfigKeys {
+		if value := v.values[key]; value != "" && !containsString(allowed, value) {
+			v.fail(key, "应为 %s 之一: %s", strings.Join(allowed, "、"), value)
+		}
+	}
+
+	if value := v.values["REDIS_CONN_STRING"]; value != "" {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			v.fail("REDIS_CONN_STRING", "应为 redis:// 或 rediss:// 格式的连接地址")
+		}
+	} else if v.values["CODING_MODE"] != "true" {
+		v.fail("REDIS_CONN_STRING", "未开启调试模式时必须配置")
+	}
+	if (v.values["REDIS_TLS_CERT_FILE"] == "") != (v.values["REDIS_TLS_KEY_FILE"] == "") {
+		v.fail("REDIS_TLS_CERT_FILE", "客户端证书和私钥文件需要同时配置")
+	}
+	for _, key := range []string{"REDIS_TLS_CA_FILE", "REDIS_TLS_CERT_FILE", "REDIS_TLS_KEY_FILE"} {
+		if value := v.values[key]; value != "" {
+			if _, err := os.Stat(value); err != nil {
+				v.warn(key, "证书文件在本实例上无法读取: %v", err)
+			}
+		}
+	}
+	if v.values["ACCESS_PWD"] == "" {
+		v.fail("ACCESS_PWD", "必须配置访问密码")
+	}
+	if value := v.values["ADMIN_LISTEN"]; value != "" {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			v.fail("ADMIN_LISTEN", "监听地址格式无效，示例: 127.0.0.1:27081")
+		}
+	}
+	if value := v.values["REBALANCE_REPORT_CRON"]; value != "" {
+		if _, err := cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor).Parse(value); err != nil {
+			v.fail("REBALANCE_REPORT_CRON", "cron表达式无效: %v", err)
+		}
+	}
+	if value := v.values["UPSTREAM_HEADERS"]; value != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(value), &headers); err != nil {
+			v.fail("UPSTREAM_HEADERS", "应为请求头名称到值的JSON对象: %v", err)
+		}
+	}
+	if value := v.values["CHAOS_RATES"]; value != "" {
+		v.validateChaosRates(value)
+	}
+	if _, err := compileGuidelinePatterns(v.values["GUIDELINE_BANNED_PATTERNS"]); err != nil {
+		v.fail("GUIDELINE_BANNED_PATTERNS", "%v", err)
+	}
+
+	v.validateRequestTransforms()
+	v.validateRequestSigners()
+	v.validateModelFallbacks()
+}
+
+// validateChaosRates 检查故障注入比例的格式和故障类型
+func (v *configValidator) validateChaosRates(value string) {
+	known := []string{"429", "slow", "drop", "malformed"}
+	for _, item := range strings.Split(value, ",") {
+		name, rate, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			v.fail("CHAOS_RATES", "格式应为 故障=比例: %s", item)
+			continue
+		}
+		if !containsString(known, strings.TrimSpace(name)) {
+			v.fail("CHAOS_RATES", "未知的故障类型: %s", name)
+		}
+		if r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || r < 0 || r > 1 {
+			v.fail("CHAOS_RATES", "故障 %s 的比例应为0到1之间的小数", name)
+		}
+	}
+}
+
+// validateRequestTransforms 编译预处理规则，规则对应的模型不是上游模型时给出提示
+func (v *configValidator) validateRequestTransforms() {
+	rules, err := compileRequestTransforms(v.values["REQUEST_TRANSFORMS"])
+	if err != nil {
+		v.fail("REQUEST_TRANSFORMS", "%v", err)
+		return
+	}
+	for model := range rules {
+		if model != "*" && !containsString(knownModels, model) {
+			v.warn("REQUEST_TRANSFORMS", "规则对应的模型 %s 不是上游提供的模型，只有客户端使用该名称时才会生效", model)
+		}
+	}
+}
+
+// validateRequestSigners 创建签名器，并检查token单独指定的签名器是否都在配置中
+func (v *configValidator) validateRequestSigners() {
+	signers, err := buildRequestSigners(v.values["REQUEST_SIGNERS"])
+	if err != nil {
+		v.fail("REQUEST_SIGNERS", "%v", err)
+		return
+	}
+	if config.RDB == nil {
+		return
+	}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		v.warn("REQUEST_SIGNERS", "无法读取token列表，未检查token使用的签名器: %v", err)
+		return
+	}
+	for _, key := range keys {
+		name, err := config.RedisHGet(key, "signer")
+		if err != nil || name == "" {
+			continue
+		}
+		if _, ok := signers[name]; !ok {
+			v.fail("REQUEST_SIGNERS", "token %s 使用的签名器 %s 不在配置中", tokenFingerprint(strings.TrimPrefix(key, "token:")), name)
+		}
+	}
+}
+
+// validateModelFallbacks 检查备用模型的格式，备用模型必须是上游提供的模型
+func (v *configValidator) validateModelFallbacks() {
+	value := v.values["MODEL_FALLBACKS"]
+	if value == "" {
+		return
+	}
+	for _, item := range strings.Split(value, ",") {
+		model, fallback, ok := strings.Cut(strings.TrimSpace(item), "=")
+		model, fallback = strings.TrimSpace(model), strings.TrimSpace(fallback)
+		if !ok || model == "" || fallback == "" {
+			v.fail("MODEL_FALLBACKS", "格式应为 原模型=备用模型: %s", item)
+			continue
+		}
+		if !containsString(knownModels, fallback) {
+			v.fail("MODEL_FALLBACKS", "备用模型 %s 不是上游提供的模型", fallback)
+		}
+		if strings.EqualFold(model, fallback) {
+			v.fail("MODEL_FALLBACKS", "模型 %s 的备用模型不能是其本身", model)
+		}
+	}
+}
+
+// containsString 列表中是否包含指定的值
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfigHandler 校验候选配置并返回与当前配置的差异，不会应用候选配置
+// 请求体为环境变量名到值的JSON对象，未包含的配置项沿用当前值，值为空字符串表示恢复默认值
+func ValidateConfigHandler(c *gin.Context) {
+	var candidate map[string]string
+	if err := c.ShouldBindJSON(&candidate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据，应为环境变量名到值的JSON对象",
+		})
+		return
+	}
+
+	fields := config.EnvFields()
+	known := make(map[string]string, len(fields))
+	for _, field := range fields {
+		known[field.Env] = field.Field
+	}
+
+	var unknown []string
+	for key := range candidate {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未知的配置项: " + strings.Join(unknown, ", "),
+		})
+		return
+	}
+
+	// 按与启动时相同的规则生成完整的候选配置，默认值同样生效
+	merged := config.Load(func(key string) string {
+		if value, ok := candidate[key]; ok {
+			return value
+		}
+		value, _ := config.AppConfig.FieldValue(known[key])
+		return value
+	})
+
+	validator := &configValidator{
+		values:   make(map[string]string, len(fields)),
+		errors:   []ConfigIssue{},
+		warnings: []ConfigIssue{},
+	}
+	changes := []ConfigChange{}
+	for _, field := range fields {
+		current, _ := config.AppConfig.FieldValue(field.Field)
+		value, _ := merged.FieldValue(field.Field)
+		validator.values[field.Env] = value
+		if current == value {
+			continue
+		}
+		change := ConfigChange{Key: field.Env, Field: field.Field, Current: current, Candidate: value}
+		if secretConfigKeys[field.Env] {
+			change.Current, change.Candidate = maskConfigValue(current), maskConfigValue(value)
+		}
+		changes = append(changes, change)
+	}
+	validator.validate()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"valid":    len(validator.errors) == 0,
+		"errors":   validator.errors,
+		"warnings": validator.warnings,
+		"changes":  changes,
+	})
+}
+
+// maskConfigValue 隐藏凭据类配置的值，只保留是否已配置
+func maskConfigValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamIdleConnTimeout 空闲连接的保留时间，预热间隔需小于该值
+const upstreamIdleConnTimeout = 90 * time.Second
+
+var (
+	upstreamTransport     http.RoundTripper
+	upstreamTransportOnce sync.Once
+
+	upstreamConnections = metrics.NewCounterVec("augment2api_upstream_connections_total",
+		"Upstream connections obtained for requests, by whether an idle connection was reused.", "state")
+	upstreamTLSHandshakeSeconds = metrics.NewSummary("augment2api_upstream_tls_handshake_seconds",
+		"TLS handshake duration for new upstream connections.", 500, 0.5, 0.9, 0.99)
+)
+
+// upstreamIdleConns 每个租户地址保留的空闲连接数
+func upstreamIdleConns() int {
+	idle, err := strconv.Atoi(config.AppConfig.UpstreamIdleConns)
+	if err != nil || idle < 0 {
+		return 4
+	}
+	return idle
+}
+
+// sharedUpstreamTransport 返回所有上游请求共用的传输层，复用到各租户分片的长连接
+func sharedUpstreamTransport() http.RoundTripper {
+	upstreamTransportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = upstreamIdleConns()
+		transport.IdleConnTimeout = upstreamIdleConnTimeout
+
+		// 检查是否配置了代理
+		if config.AppConfig.ProxyURL != "" {
+			proxyURL, err := url.Parse(config.AppConfig.ProxyURL)
+			if err == nil {
+				transport.Proxy = http.ProxyURL(proxyURL)
+				log.Printf("使用代理: %s", config.AppConfig.ProxyURL)
+			} else {
+				log.Printf("代理URL格式错误: %v", err)
+			}
+		}
+
+		// 按租户地址强制使用HTTP/1.1的请求走单独的传输层
+		http1 := transport.Clone()
+		disableHTTP2(http1)
+		if upstreamHTTP2Enabled() {
+			configureHTTP2(transport)
+		} else {
+			disableHTTP2(transport)
+		}
+
+		upstreamTransport = tracingTransport{base: protocolTransport{http2: transport, http1: http1}}
+	})
+	return upstreamTransport
+}
+
+// tracingTransport 统计连接复用情况和TLS握手耗时
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip 为请求附加连接追踪
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var handshakeStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamConnections.Inc("reused")
+			} else {
+				upstreamConnections.Inc("new")
+			}
+		},
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if !handshakeStart.IsZero() {
+				upstreamTLSHandshakeSeconds.Observe(time.Since(handshakeStart).Seconds())
+			}
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil {
+		recordUpstreamProtocol(req.URL.Host, resp.Proto)
+		decodeContentEncoding(resp)
+	}
+	return resp, err
+}
+
+// poolTenantURLs 返回token池中正在使用的租户地址
+func poolTenantURLs() []string {
+	if config.AppConfig.CodingMode == "true" {
+		if config.AppConfig.TenantURL == "" {
+			return nil
+		}
+		return []string{config.AppConfig.TenantURL}
+	}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil
+	}
+
+	unique := make(map[string]bool)
+	var urls []string
+	for _, key := range keys {
+		tenantURL, err := config.RedisHGet(key, "tenant_url")
+		if err != nil || tenantURL == "" || unique[tenantURL] {
+			continue
+		}
+		unique[tenantURL] = true
+		urls = append(urls, tenantURL)
+	}
+	return urls
+}
+
+// warmTenantConnections 向租户地址并发发起轻量请求，使空闲连接池保持在配置的数量
+func warmTenantConnections(tenantURL string, conns int) {
+	client := &http.Client{
+		Transport: sharedUpstreamTransport(),
+		Timeout:   10 * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest("HEAD", tenantURL, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("User-Agent", config.AppConfig.UserAgent)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				logger.Upstream.WithFields(logrus.Fields{
+					"tenant_url": tenantURL,
+					"error":      err.Error(),
+				}).Debug("预热上游连接失败")
+				return
+			}
+			// 读完响应体才能将连接放回空闲池
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// StartConnectionWarmer 定时预热到各租户分片的连接，减少流式请求首个分块的TLS握手延迟
+func StartConnectionWarmer() {
+	if mockUpstreamEnabled() {
+		return
+	}
+
+	conns := upstreamIdleConns()
+	seconds, err := strconv.Atoi(config.AppConfig.UpstreamWarmInterval)
+	if err != nil || seconds <= 0 || conns == 0 {
+		return
+	}
+	interval := time.Duration(seconds) * time.Second
+	if interval >= upstreamIdleConnTimeout {
+		interval = upstreamIdleConnTimeout / 2
+	}
+
+	logger.Upstream.WithFields(logrus.Fields{
+		"idle_conns": conns,
+		"interval":   interval.String(),
+	}).Info("上游连接预热已启动")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !maintenanceActive() {
+			for _, tenantURL := range poolTenantURLs() {
+				warmTenantConnections(tenantURL, conns)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	tokenmanager "augment2api/pkg/token"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// markConversation 为AGENT请求计算对话ID，供调度时将同一对话保持在同一token上
+// 对话由调用方、系统提示词和第一条用户消息识别，客户端每次都会带上完整历史，后续请求得到相同的ID
+func markConversation(c *gin.Context, model, system string, messages []ChatMessage) {
+	if !tokenmanager.ConversationAffinityEnabled() || !strings.HasSuffix(strings.ToLower(model), "-agent") {
+		return
+	}
+
+	if id := conversationID(c.GetString("api_key"), system, messages); id != "" {
+		c.Set("conversation_id", id)
+	}
+}
+
+// conversationID 按调用方、系统提示词和第一条用户消息计算对话ID，没有用户消息时返回空
+func conversationID(apiKey, system string, messages []ChatMessage) string {
+	hash := sha256.New()
+	hash.Write([]byte(apiKey))
+	hash.Write([]byte{0})
+	hash.Write([]byte(system))
+	for _, msg := range messages {
+		if msg.Role == "system" || msg.Role == "developer" {
+			hash.Write([]byte{0})
+			hash.Write([]byte(msg.GetContent()))
+			continue
+		}
+		if msg.Role == "user" {
+			hash.Write([]byte{0})
+			hash.Write([]byte(msg.GetContent()))
+			return hex.EncodeToString(hash.Sum(nil)[:16])
+		}
+	}
+	return ""
+}
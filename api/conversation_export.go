@@ -0,0 +1,145 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/conversation"
+	"augment2api/pkg/convert"
+	"augment2api/pkg/logger"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// conversationStoreEnabled 是否在服务端保存对话记录
+func conversationStoreEnabled() bool {
+	return config.AppConfig.ConversationStore == "true" && config.RDB != nil
+}
+
+// conversationRetention 对话记录的保留时间
+func conversationRetention() time.Duration {
+	days, err := strconv.Atoi(config.AppConfig.ConversationRetentionDays)
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// markTranscript 开启对话保存时计算对话ID并保存请求中的消息，对话ID通过 X-Conversation-ID 响应头返回，
+// 与AGENT调度使用的对话ID计算方式相同，但单独保存，不影响调度
+func markTranscript(c *gin.Context, parsed interface{}) {
+	if !conversationStoreEnabled() {
+		return
+	}
+
+	transcript := &conversation.Transcript{Owner: tokenFingerprint(c.GetString("api_key"))}
+	var source []ChatMessage
+	switch req := parsed.(type) {
+	case *OpenAIRequest:
+		transcript.Model = req.Model
+		transcript.ID = conversationID(c.GetString("api_key"), "", req.Messages)
+		source = req.Messages
+	case *AnthropicRequest:
+		transcript.Model = req.Model
+		transcript.System = convert.SystemText(req.System)
+		transcript.ID = conversationID(c.GetString("api_key"), transcript.System, req.Messages)
+		source = req.Messages
+	default:
+		return
+	}
+	if transcript.ID == "" {
+		return
+	}
+	for _, message := range source {
+		transcript.Messages = append(transcript.Messages, conversation.Message{Role: message.Role, Content: message.GetContent()})
+	}
+	c.Set("transcript", transcript)
+	c.Header("X-Conversation-ID", transcript.ID)
+}
+
+// captureTranscriptResponse 保存本次请求的完整回复，供请求结束时写入对话记录
+func captureTranscriptResponse(c *gin.Context, text string) {
+	if _, ok := c.Get("transcript"); ok {
+		c.Set("transcript_response", text)
+	}
+}
+
+// recordTranscript 请求成功结束时写入对话记录，多次调用只记录一次
+func recordTranscript(c *gin.Context) {
+	value, ok := c.Get("transcript")
+	if !ok || c.GetBool("transcript_recorded") {
+		return
+	}
+	response, captured := c.Get("transcript_response")
+	if !captured || c.Writer.Status() != http.StatusOK {
+		return
+	}
+	c.Set("transcript_recorded", true)
+
+	transcript := value.(*conversation.Transcript)
+	transcript.Messages = append(transcript.Messages, conversation.Message{Role: "assistant", Content: response.(string)})
+	if err := conversation.Save(transcript, conversationRetention()); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"conversation_id": transcript.ID,
+			"error":           err.Error(),
+		}).Error("保存对话记录失败")
+	}
+}
+
+// ExportConversationHandler 导出服务端保存的对话记录，format 可选 openai（默认）、anthropic 和 markdown，
+// 只能导出使用同一API密钥产生的对话
+func ExportConversationHandler(c *gin.Context) {
+	if !conversationStoreEnabled() {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", "conversation_store_disabled",
+			"Conversation persistence is not enabled on this deployment.")
+		return
+	}
+
+	transcript, err := conversation.Get(c.Param("id"))
+	if err == nil && transcript.Owner != tokenFingerprint(c.GetString("api_key")) {
+		err = conversation.ErrNotFound
+	}
+	if err == conversation.ErrNotFound {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", "conversation_not_found",
+			"No conversation found with id '"+c.Param("id")+"'.")
+		return
+	}
+	if err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to load the conversation.")
+		return
+	}
+
+	format := c.DefaultQuery("format", "openai")
+	switch format {
+	case "openai":
+		c.Header("Content-Disposition", `attachment; filename="conversation-`+transcript.ID+`.json"`)
+		c.JSON(http.StatusOK, gin.H{
+			"object":     "conversation.export",
+			"id":         transcript.ID,
+			"model":      transcript.Model,
+			"created_at": transcript.CreatedAt.Unix(),
+			"updated_at": transcript.UpdatedAt.Unix(),
+			"messages":   transcript.OpenAIMessages(),
+		})
+	case "anthropic":
+		system, messages := transcript.AnthropicMessages()
+		c.Header("Content-Disposition", `attachment; filename="conversation-`+transcript.ID+`.json"`)
+		c.JSON(http.StatusOK, gin.H{
+			"id":         transcript.ID,
+			"model":      transcript.Model,
+			"created_at": transcript.CreatedAt.Unix(),
+			"updated_at": transcript.UpdatedAt.Unix(),
+			"system":     system,
+			"messages":   messages,
+		})
+	case "markdown":
+		c.Header("Content-Disposition", `attachment; filename="conversation-`+transcript.ID+`.md"`)
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(transcript.Markdown()))
+	default:
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_format",
+			"'format' must be one of 'openai', 'anthropic' or 'markdown'.")
+	}
+}
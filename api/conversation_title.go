@@ -0,0 +1,157 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// titleModel 标题生成使用的模型，按CHAT模式计数
+	titleModel = "claude-4-chat"
+	// titleSourceMessages 参与生成标题的开头消息数
+	titleSourceMessages = 4
+	// titleSourceRunes 每条消息参与生成标题的最大字符数
+	titleSourceRunes = 1000
+	// defaultTitleLength 标题默认最大字符数
+	defaultTitleLength = 20
+	// maxTitleLength 标题最大字符数上限
+	maxTitleLength = 100
+)
+
+// ConversationTitleRequest 生成对话标题的请求
+type ConversationTitleRequest struct {
+	Messages  []ChatMessage `json:"messages"`
+	MaxLength int           `json:"max_length"` // 标题最大字符数
+}
+
+// truncateRunes 按字符截断文本
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit])
+}
+
+// buildTitlePrompt 根据对话开头的消息构建生成标题的提示
+func buildTitlePrompt(messages []ChatMessage, maxLength int) string {
+	var transcript strings.Builder
+	count := 0
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			continue
+		}
+		content := strings.TrimSpace(msg.GetContent())
+		if content == "" {
+			continue
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, truncateRunes(content, titleSourceRunes))
+		count++
+		if count >= titleSourceMessages {
+			break
+		}
+	}
+	if count == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("Generate a concise title of at most %d characters for the following conversation. "+
+		"Use the same language as the conversation. Reply with the title only, without quotes or trailing punctuation.\n\n%s",
+		maxLength, transcript.String())
+}
+
+// cleanTitle 取回复的第一行作为标题，去掉引号和末尾标点
+func cleanTitle(text string, maxLength int) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimPrefix(line, "#")
+		line = strings.TrimSpace(strings.TrimPrefix(line, "Title:"))
+		line = strings.Trim(line, "\"'“”‘’《》`*")
+		line = strings.TrimRight(line, "。.!！?？")
+		if line != "" {
+			return truncateRunes(line, maxLength)
+		}
+	}
+	return ""
+}
+
+// ConversationTitleHandler 根据对话开头的消息生成简短标题
+// 使用精简的CHAT请求并优先调度 priority=low 的token，不占用主要对话的token；请求体由校验中间件解析
+func ConversationTitleHandler(c *gin.Context) {
+	var req ConversationTitleRequest
+	if parsed, ok := takeValidatedRequest(c); ok {
+		req = *parsed.(*ConversationTitleRequest)
+	} else if err := decodeRequestBody(c, &req); err != nil {
+		respondDecodeError(c, err)
+		return
+	}
+	if !enforceModelAllowlist(c, titleModel) {
+		return
+	}
+
+	maxLength := req.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultTitleLength
+	}
+	if maxLength > maxTitleLength {
+		maxLength = maxTitleLength
+	}
+
+	prompt := buildTitlePrompt(req.Messages, maxLength)
+	if prompt == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "messages 不能为空"})
+		return
+	}
+
+	augmentReq := convertToAugmentRequest(OpenAIRequest{
+		Model:    titleModel,
+		Messages: []ChatMessage{{Role: "user", Content: prompt}},
+	})
+	// 标题生成不需要默认的前缀和指南
+	augmentReq.Prefix = ""
+	augmentReq.UserGuideLines = ""
+
+	token, tenantURL, sessionID := config.AppConfig.CodingToken, config.AppConfig.TenantURL, ""
+	if config.AppConfig.CodingMode != "true" {
+		lease, ok := tokenmanager.AcquireLowPriorityToken(augmentReq.Mode, c.GetString("token_shard"), nil)
+		if !ok {
+			if wait, ok := tokenmanager.RetryAfter(); ok {
+				c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+			}
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
+			return
+		}
+		defer lease.Release()
+		token, tenantURL, sessionID = lease.Token, lease.TenantURL, lease.SessionID
+		asyncIncrementTokenUsage(token, titleModel)
+	}
+
+	text, err := fetchAugmentText(c.Request.Context(), token, tenantURL, sessionID, augmentReq)
+	if err != nil {
+		if config.AppConfig.CodingMode != "true" {
+			tokenmanager.RecordGenerationFailure(token)
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"token": tokenFingerprint(token),
+			"error": err.Error(),
+		}).Warn("生成对话标题失败")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "生成标题失败"})
+		return
+	}
+	if config.AppConfig.CodingMode != "true" {
+		tokenmanager.ResetGenerationFailures(token)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"title": cleanTitle(text, maxLength),
+	})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"augment2api/config"
+	tokenmanager "augment2api/pkg/token"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTimeoutHeader 客户端指定本次请求的总耗时预算（秒），只能缩短 REQUEST_TIMEOUT
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// errRequestBudgetExceeded 请求已用完总耗时预算，不再向上游发送请求
+var errRequestBudgetExceeded = errors.New("请求已超出总耗时预算")
+
+// requestTimeoutSeconds 配置的请求总耗时预算（秒），0表示不限制
+func requestTimeoutSeconds() int {
+	seconds, err := strconv.Atoi(config.AppConfig.RequestTimeout)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+// requestBudget 计算请求的总耗时预算，包含排队、选择token、重试和上游响应，返回0表示不限制
+// 请求头的值无效时忽略，超过 REQUEST_TIMEOUT 时按配置截断
+func requestBudget(c *gin.Context) time.Duration {
+	budget := time.Duration(requestTimeoutSeconds()) * time.Second
+
+	if value := strings.TrimSpace(c.GetHeader(requestTimeoutHeader)); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err == nil && seconds > 0 {
+			requested := time.Duration(seconds * float64(time.Second))
+			if budget == 0 || requested < budget {
+				budget = requested
+			}
+		}
+	}
+	return budget
+}
+
+// withRequestDeadline 按请求的时间预算设置截止时间，返回带截止时间的上游context
+func withRequestDeadline(c *gin.Context, start time.Time) (context.Context, context.CancelFunc) {
+	budget := requestBudget(c)
+	if budget <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	deadline := start.Add(budget)
+	c.Set("request_deadline", deadline)
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// budgetError 上游请求因超出时间预算失败时返回明确的错误，便于与上游超时区分
+func budgetError(ctx context.Context, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	tokenmanager.RecordBudgetExhausted("upstream")
+	if err == nil {
+		return errRequestBudgetExceeded
+	}
+	return fmt.Errorf("%w: %v", errRequestBudgetExceeded, err)
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// firstTokenRetention 首个分块延迟样本的保留时间
+	firstTokenRetention = time.Hour
+	// firstTokenMaxSamples 每个token或分片最多保留的样本数
+	firstTokenMaxSamples = 1000
+	// firstTokenMinSamples 计算SLO时窗口内至少需要的样本数，样本过少时不判断
+	firstTokenMinSamples = 10
+	// firstTokenCheckInterval 检查SLO的间隔
+	firstTokenCheckInterval = 30 * time.Second
+)
+
+// latencySample 一次请求的首个分块延迟
+type latencySample struct {
+	at time.Time
+	ms int64
+}
+
+// FirstTokenStats 一组请求的首个分块延迟分位数，统计最近一小时的样本
+type FirstTokenStats struct {
+	Key      string    `json:"key"`
+	Samples  int       `json:"samples"`
+	P50      int64     `json:"p50_ms"`
+	P95      int64     `json:"p95_ms"`
+	P99      int64     `json:"p99_ms"`
+	LastSeen time.Time `json:"last_seen"`
+	// 以下字段只用于分片
+	Breaching   bool       `json:"breaching,omitempty"`
+	BreachSince *time.Time `json:"breach_since,omitempty"`
+	Alerted     bool       `json:"alerted,omitempty"`
+}
+
+// sloState 分片的SLO状态
+type sloState struct {
+	breachSince time.Time
+	alerted     bool
+}
+
+var (
+	firstTokenByToken = make(map[string][]latencySample)
+	firstTokenByShard = make(map[string][]latencySample)
+	shardSLOStates    = make(map[string]*sloState)
+	firstTokenGuard   sync.Mutex
+
+	firstTokenSeconds = metrics.NewSummary("augment2api_first_token_seconds",
+		"Time from token assignment to the first generated text chunk.", 1000, 0.5, 0.95, 0.99)
+	firstTokenSLOAlerts = metrics.NewCounterVec("augment2api_first_token_slo_alerts_total",
+		"First-token latency SLO alerts by event.", "event")
+)
+
+// firstTokenSLO 首个分块延迟p95的目标值，未配置时返回0
+func firstTokenSLO() time.Duration {
+	ms, err := strconv.Atoi(config.AppConfig.FirstTokenSLOMs)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// firstTokenSLOSustain p95持续超过目标多久后告警，同时作为计算p95的时间窗口
+func firstTokenSLOSustain() time.Duration {
+	minutes, err := strconv.Atoi(config.AppConfig.FirstTokenSLOSustain)
+	if err != nil || minutes <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// firstTokenBody 包装上游响应体，上游解析出第一段文本时记录首个分块延迟
+type firstTokenBody struct {
+	io.ReadCloser
+	mark func()
+}
+
+// watchFirstToken 包装成功的上游响应，由 upstreamReader 在解析出第一段文本时回调
+func watchFirstToken(c *gin.Context, resp *http.Response, token, shard string, upstreamStart time.Time) {
+	if resp == nil || resp.StatusCode != http.StatusOK || c.GetBool("first_token_recorded") {
+		return
+	}
+	resp.Body = &firstTokenBody{
+		ReadCloser: resp.Body,
+		mark: func() {
+			recordFirstToken(c, token, shard, upstreamStart)
+		},
+	}
+}
+
+// recordFirstToken 记录请求的首个分块延迟，从分配token开始计算，重试时只记录第一次输出
+func recordFirstToken(c *gin.Context, token, shard string, upstreamStart time.Time) {
+	if c.GetBool("first_token_recorded") {
+		return
+	}
+	c.Set("first_token_recorded", true)
+
+	start := upstreamStart
+	if value, ok := c.Get("request_start"); ok {
+		if requestStart, ok := value.(time.Time); ok {
+			start = requestStart
+		}
+	}
+	elapsed := time.Since(start)
+	c.Set("first_token_ms", elapsed.Milliseconds())
+	firstTokenSeconds.Observe(elapsed.Seconds())
+
+	sample := latencySample{at: time.Now(), ms: elapsed.Milliseconds()}
+	firstTokenGuard.Lock()
+	firstTokenByToken[token] = appendSample(firstTokenByToken[token], sample)
+	firstTokenByShard[shard] = appendSample(firstTokenByShard[shard], sample)
+	firstTokenGuard.Unlock()
+}
+
+// appendSample 追加样本并丢弃过期和超出数量的样本
+func appendSample(samples []latencySample, sample latencySample) []latencySample {
+	samples = append(samples, sample)
+	cutoff := time.Now().Add(-firstTokenRetention)
+	drop := 0
+	for drop < len(samples) && samples[drop].at.Before(cutoff) {
+		drop++
+	}
+	drop = max(drop, len(samples)-firstTokenMaxSamples)
+	if drop > 0 {
+		samples = append(samples[:0:0], samples[drop:]...)
+	}
+	return samples
+}
+
+// percentiles 计算指定时间之后样本的分位数
+func percentiles(key string, samples []latencySample, since time.Time) FirstTokenStats {
+	stats := FirstTokenStats{Key: key}
+	values := make([]int64, 0, len(samples))
+	for _, sample := range samples {
+		if sample.at.Before(since) {
+			continue
+		}
+		values = append(values, sample.ms)
+		stats.LastSeen = sample.at
+	}
+	stats.Samples = len(values)
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	at := func(q float64) int64 {
+		index := int(math.Ceil(q*float64(len(values)))) - 1
+		return values[max(index, 0)]
+	}
+	stats.P50, stats.P95, stats.P99 = at(0.5), at(0.95), at(0.99)
+	return stats
+}
+
+// collectFirstTokenStats 汇总各分组最近一小时的分位数，按p95倒序
+func collectFirstTokenStats(groups map[string][]latencySample) []FirstTokenStats {
+	since := time.Now().Add(-firstTokenRetention)
+	result := make([]FirstTokenStats, 0, len(groups))
+	for key, samples := range groups {
+		if stats := percentiles(key, samples, since); stats.Samples > 0 {
+			result = append(result, stats)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].P95 > result[j].P95
+	})
+	return result
+}
+
+// StartFirstTokenSLOMonitor 定期检查各分片的首个分块延迟，p95持续超过目标时告警，恢复后再通知一次
+func StartFirstTokenSLOMonitor() {
+	ticker := time.NewTicker(firstTokenCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkFirstTokenSLO()
+	}
+}
+
+// checkFirstTokenSLO 检查一次各分片的SLO状态
+func checkFirstTokenSLO() {
+	slo := firstTokenSLO()
+	if slo == 0 {
+		return
+	}
+	sustain := firstTokenSLOSustain()
+	now := time.Now()
+
+	type alert struct {
+		event string
+		stats FirstTokenStats
+	}
+	var alerts []alert
+
+	firstTokenGuard.Lock()
+	for shard, samples := range firstTokenByShard {
+		stats := percentiles(shard, samples, now.Add(-sustain))
+		if stats.Samples < firstTokenMinSamples {
+			continue
+		}
+		state := shardSLOStates[shard]
+		if state == nil {
+			state = &sloState{}
+			shardSLOStates[shard] = state
+		}
+
+		if time.Duration(stats.P95)*time.Millisecond > slo {
+			if state.breachSince.IsZero() {
+				state.breachSince = now
+			}
+			if !state.alerted && now.Sub(state.breachSince) >= sustain {
+				state.alerted = true
+				alerts = append(alerts, alert{event: "first_token_slo_breach", stats: stats})
+			}
+			continue
+		}
+
+		if state.alerted {
+			alerts = append(alerts, alert{event: "first_token_slo_recovered", stats: stats})
+		}
+		state.breachSince = time.Time{}
+		state.alerted = false
+	}
+	firstTokenGuard.Unlock()
+
+	for _, a := range alerts {
+		sendFirstTokenAlert(a.event, a.stats, slo)
+	}
+}
+
+// sendFirstTokenAlert 记录并通过Webhook发送SLO告警，多实例部署时同一分片的同类告警在持续时间内只发送一次
+func sendFirstTokenAlert(event string, stats FirstTokenStats, slo time.Duration) {
+	firstTokenSLOAlerts.Inc(event)
+	fields := logrus.Fields{
+		"shard":   stats.Key,
+		"p95_ms":  stats.P95,
+		"slo_ms":  slo.Milliseconds(),
+		"samples": stats.Samples,
+	}
+	if event == "first_token_slo_breach" {
+		logger.Upstream.WithFields(fields).Warn("租户分片首个分块延迟持续超过目标")
+	} else {
+		logger.Upstream.WithFields(fields).Info("租户分片首个分块延迟已恢复")
+	}
+
+	if config.AppConfig.AlertWebhook == "" {
+		return
+	}
+	if config.RDB != nil {
+		first, err := config.RedisSetNX("first_token_alert:"+event+":"+stats.Key, leader.InstanceID(), firstTokenSLOSustain())
+		if err != nil || !first {
+			return
+		}
+	}
+
+	payload, _ := json.Marshal(gin.H{
+		"event":    event,
+		"shard":    stats.Key,
+		"p50_ms":   stats.P50,
+		"p95_ms":   stats.P95,
+		"p99_ms":   stats.P99,
+		"slo_ms":   slo.Milliseconds(),
+		"samples":  stats.Samples,
+		"window":   firstTokenSLOSustain().String(),
+		"instance": leader.InstanceID(),
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(config.AppConfig.AlertWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Upstream.WithFields(logrus.Fields{
+			"event": event,
+			"error": err.Error(),
+		}).Error("发送首个分块延迟告警失败")
+		return
+	}
+	resp.Body.Close()
+}
+
+// FirstTokenLatencyHandler 获取本实例各租户分片和token的首个分块延迟分位数及SLO状态
+func FirstTokenLatencyHandler(c *gin.Context) {
+	firstTokenGuard.Lock()
+	shards := collectFirstTokenStats(firstTokenByShard)
+	tokens := collectFirstTokenStats(firstTokenByToken)
+	for i := range shards {
+		if state := shardSLOStates[shards[i].Key]; state != nil && !state.breachSince.IsZero() {
+			since := state.breachSince
+			shards[i].Breaching = true
+			shards[i].BreachSince = &since
+			shards[i].Alerted = state.alerted
+		}
+	}
+	firstTokenGuard.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":          "success",
+		"slo_ms":          firstTokenSLO().Milliseconds(),
+		"sustain_minutes": int(firstTokenSLOSustain().Minutes()),
+		"instance":        leader.InstanceID(),
+		"shards":          shards,
+		"tokens":          tokens,
+	})
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/convert"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 系统提示词被修改的原因
+const (
+	guardReasonOverride  = "directive_override"
+	guardReasonBanned    = "banned_pattern"
+	guardReasonTruncated = "truncated"
+)
+
+var guidelineSanitizations = metrics.NewCounterVec("augment2api_guideline_sanitizations_total",
+	"Client system prompts modified before being mapped into Augment guidelines, by reason.", "reason")
+
+// directiveOverridePatterns 内置的改写注入指令的句式，匹配的行会被删除
+var directiveOverridePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override|bypass)\b[^\n]{0,60}\b(?:previous|prior|above|earlier|preceding|system|default|injected|all)\b[^\n]{0,40}\b(?:instructions?|directives?|guidelines?|rules|prompts?)\b`),
+	regexp.MustCompile(`(?i)\b(?:do not|don't|never)\s+(?:follow|obey)\b[^\n]{0,40}\b(?:instructions?|directives?|guidelines?|rules)\b`),
+	regexp.MustCompile(`(?:忽略|无视|忘记|覆盖|不要遵守)[^\n]{0,30}(?:之前|以上|上面|前面|系统|默认|所有)[^\n]{0,20}(?:指令|指示|提示词|规则|指南)`),
+}
+
+// guidelineBannedPatterns 部署配置的禁止出现在系统提示词中的正则，匹配的行会被删除
+var guidelineBannedPatterns []*regexp.Regexp
+
+// InitGuidelineGuard 编译 GUIDELINE_BANNED_PATTERNS 中的正则
+func InitGuidelineGuard() error {
+	patterns, err := compileGuidelinePatterns(config.AppConfig.GuidelineBannedPatterns)
+	if err != nil {
+		return err
+	}
+	guidelineBannedPatterns = patterns
+	if config.AppConfig.GuidelineGuard == "true" {
+		logger.Log.WithFields(logrus.Fields{
+			"banned_patterns": len(patterns),
+			"max_length":      guidelineMaxLength(),
+		}).Info("系统提示词检查规则加载完成")
+	}
+	return nil
+}
+
+// compileGuidelinePatterns 解析并编译JSON数组格式的正则列表，未配置时返回nil
+func compileGuidelinePatterns(raw string) ([]*regexp.Regexp, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		return nil, fmt.Errorf("解析GUIDELINE_BANNED_PATTERNS失败，应为正则的JSON数组: %v", err)
+	}
+	patterns := make([]*regexp.Regexp, 0, len(list))
+	for i, pattern := range list {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("第%d个正则无效: %v", i+1, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// guidelineMaxLength 系统提示词的最大字符数，0表示不限制
+func guidelineMaxLength() int {
+	limit, err := strconv.Atoi(config.AppConfig.GuidelineMaxLength)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// overridesDirectives 该行是否试图改写服务端注入的指令：使用改写指令的句式，或冒充默认的前缀和提示词
+func overridesDirectives(line string) bool {
+	for _, re := range directiveOverridePatterns {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	lower := strings.ToLower(line)
+	return strings.Contains(lower, strings.ToLower(convert.DefaultPrompt)) || strings.Contains(lower, strings.ToLower(convert.DefaultPrefix))
+}
+
+// sanitizeSystemPrompt 检查客户端的系统提示词，返回处理后的内容和修改原因：
+// 删除改写注入指令和匹配禁用正则的行，超出长度上限的部分截断
+func sanitizeSystemPrompt(prompt string) (string, []string) {
+	var reasons []string
+	addReason := func(reason string) {
+		if !containsString(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	lines := strings.Split(prompt, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if overridesDirectives(line) {
+			addReason(guardReasonOverride)
+			continue
+		}
+		banned := false
+		for _, re := range guidelineBannedPatterns {
+			if re.MatchString(line) {
+				banned = true
+				break
+			}
+		}
+		if banned {
+			addReason(guardReasonBanned)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	prompt = strings.TrimSpace(strings.Join(kept, "\n"))
+
+	if limit := guidelineMaxLength(); limit > 0 {
+		if runes := []rune(prompt); len(runes) > limit {
+			prompt = string(runes[:limit])
+			addReason(guardReasonTruncated)
+		}
+	}
+	return prompt, reasons
+}
+
+// guardSystemPrompt 开启 GUIDELINE_GUARD 时在系统提示词放入指南前检查并记录修改，
+// 包括Anthropic的system参数和OpenAI请求的system、developer消息
+func guardSystemPrompt(prompt string) string {
+	if config.AppConfig.GuidelineGuard != "true" || prompt == "" {
+		return prompt
+	}
+	sanitized, reasons := sanitizeSystemPrompt(prompt)
+	if len(reasons) == 0 {
+		return prompt
+	}
+
+	for _, reason := range reasons {
+		guidelineSanitizations.Inc(reason)
+	}
+	logger.Log.WithFields(logrus.Fields{
+		"reasons":         reasons,
+		"original_length": len([]rune(prompt)),
+		"length":          len([]rune(sanitized)),
+	}).Warn("客户端系统提示词已被修改")
+	return sanitized
+}
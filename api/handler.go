@@ -2,11 +2,10 @@ package api
 
 import (
 	"augment2api/config"
+	"augment2api/pkg/convert"
 	"augment2api/pkg/logger"
 	tokenmanager "augment2api/pkg/token"
-	"bufio"
 	"bytes"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,7 +13,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -29,15 +27,34 @@ type OpenAIRequest struct {
 	Stream      bool          `json:"stream,omitempty"`
 	Temperature float64       `json:"temperature,omitempty"`
 	MaxTokens   int           `json:"max_tokens,omitempty"`
+	N           int           `json:"n,omitempty"`
+	User        string        `json:"user,omitempty"`
+	// StreamOptions 流式选项，include_usage 为true时在流末尾返回用量
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// CallbackURL 设置后请求在后台执行，完成后将结果推送到该地址
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Async 为true时请求在后台执行，不推送结果，通过 /v1/requests/:id 查询
+	Async bool `json:"async,omitempty"`
 }
 
 // Anthropic兼容的请求结构
 type AnthropicRequest struct {
-	Model       string        `json:"model"`
-	MaxTokens   int           `json:"max_tokens"`
-	Messages    []ChatMessage `json:"messages"`
-	Stream      bool          `json:"stream,omitempty"`
-	Temperature float64       `json:"temperature,omitempty"`
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	Messages      []ChatMessage      `json:"messages"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   float64            `json:"temperature,omitempty"`
+	Metadata      *AnthropicMetadata `json:"metadata,omitempty"`
+	System        interface{}        `json:"system,omitempty"`         // 字符串或内容块数组
+	ServiceTier   string             `json:"service_tier,omitempty"`   // 上游没有服务等级，只记录不生效
+	Betas         []string           `json:"betas,omitempty"`          // 请求体中的beta特性，只记录不生效
+	StopSequences []string           `json:"stop_sequences,omitempty"` // 输出中出现任一序列时停止生成
+}
+
+// AnthropicMetadata Anthropic请求的元数据
+type AnthropicMetadata struct {
+	UserID string                 `json:"user_id,omitempty"`
+	Extra  map[string]interface{} `json:"-"` // user_id 以外的字段
 }
 
 // OpenAI兼容的响应结构
@@ -57,6 +74,7 @@ type OpenAIStreamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"`
 }
 
 // Anthropic兼容的响应结构
@@ -103,30 +121,14 @@ type Choice struct {
 }
 
 type ChatMessage struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
+	Role      string           `json:"role"`
+	Content   interface{}      `json:"content"`
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
 }
 
 // GetContent 添加一个辅助方法来获取消息内容
 func (m ChatMessage) GetContent() string {
-	switch v := m.Content.(type) {
-	case string:
-		return v
-	case []interface{}:
-		var result string
-		for _, item := range v {
-			if contentMap, ok := item.(map[string]interface{}); ok {
-				if text, exists := contentMap["text"]; exists {
-					if textStr, ok := text.(string); ok {
-						result += textStr
-					}
-				}
-			}
-		}
-		return result
-	default:
-		return ""
-	}
+	return convert.ContentText(m.Content)
 }
 
 type Usage struct {
@@ -135,70 +137,21 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
-// ToolDefinition 工具定义结构
-type ToolDefinition struct {
-	Name            string `json:"name"`
-	Description     string `json:"description"`
-	InputSchemaJSON string `json:"input_schema_json"`
-	ToolSafety      int    `json:"tool_safety"`
-}
-
-// Node 节点结构
-type Node struct {
-	ID          int         `json:"id"`
-	Type        int         `json:"type"`
-	Content     string      `json:"content"`
-	ToolUse     ToolUse     `json:"tool_use"`
-	AgentMemory AgentMemory `json:"agent_memory"`
-}
-
-type ToolUse struct {
-	ToolUseID string `json:"tool_use_id"`
-	ToolName  string `json:"tool_name"`
-	InputJSON string `json:"input_json"`
-}
-
-type AgentMemory struct {
-	Content string `json:"content"`
-}
-
-// AugmentRequest Augment API请求结构
-type AugmentRequest struct {
-	ChatHistory    []AugmentChatHistory `json:"chat_history"`
-	Message        string               `json:"message"`
-	AgentMemories  string               `json:"agent_memories"`
-	Mode           string               `json:"mode"`
-	Prefix         string               `json:"prefix"`
-	Suffix         string               `json:"suffix"`
-	Lang           string               `json:"lang"`
-	Path           string               `json:"path"`
-	UserGuideLines string               `json:"user_guidelines"`
-	Blobs          struct {
-		CheckpointID string        `json:"checkpoint_id"`
-		AddedBlobs   []interface{} `json:"added_blobs"`
-		DeletedBlobs []interface{} `json:"deleted_blobs"`
-	} `json:"blobs"`
-	UserGuidedBlobs       []interface{} `json:"user_guided_blobs"`
-	ExternalSourceIds     []interface{} `json:"external_source_ids"`
-	FeatureDetectionFlags struct {
-		SupportRawOutput bool `json:"support_raw_output"`
-	} `json:"feature_detection_flags"`
-	ToolDefinitions []ToolDefinition `json:"tool_definitions"`
-	Nodes           []Node           `json:"nodes"`
-}
-
-type AugmentChatHistory struct {
-	ResponseText   string `json:"response_text"`
-	RequestMessage string `json:"request_message"`
-	RequestID      string `json:"request_id"`
-	RequestNodes   []Node `json:"request_nodes"`
-	ResponseNodes  []Node `json:"response_nodes"`
-}
+// Augment请求的结构由 convert 包定义，这里保留别名供处理函数使用
+type (
+	ToolDefinition     = convert.ToolDefinition
+	Node               = convert.Node
+	ToolUse            = convert.NodeToolUse
+	AgentMemory        = convert.AgentMemory
+	AugmentRequest     = convert.AugmentRequest
+	AugmentChatHistory = convert.AugmentChatHistory
+)
 
 // AugmentResponse Augment API响应结构
 type AugmentResponse struct {
-	Text string `json:"text"`
-	Done bool   `json:"done"`
+	Text  string `json:"text"`
+	Done  bool   `json:"done"`
+	Nodes []Node `json:"nodes,omitempty"`
 }
 
 // CodeResponse 用于解析从授权服务返回的代码
@@ -250,394 +203,50 @@ func GetAuthInfo() (string, string) {
 	return accessToken, tenantURL
 }
 
-const (
-	// 默认提示，不加这个会导致Agent触发文件创建，回复截断
-	defaultPrompt = "Your are claude4, All replies cannot create, modify, or delete files, and must provide content directly!"
-	// 默认上下文，影响模型回复风格
-	defaultPrefix = "You are AI assistant,help me to solve problems!"
-)
-
-// generateCheckpointID 生成一个基于时间戳的SHA-256哈希值作为CheckpointID
-func generateCheckpointID() string {
-	// 使用当前时间戳作为输入
-	timestamp := fmt.Sprintf("%d", time.Now().UnixNano())
-	hash := sha256.New()
-	hash.Write([]byte(timestamp))
-	// 将哈希值转换为十六进制字符串
-	return fmt.Sprintf("%x", hash.Sum(nil))
+// injectionDisabled 是否关闭默认的前缀、后缀和指南注入
+func injectionDisabled() bool {
+	return config.AppConfig.DisableInjection == "true"
 }
 
-// convertToAugmentRequest 将OpenAI请求转换为Augment请求
-func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
-	// 确定模式和其他参数基于模型名称
-	mode := "CHAT" // 默认使用CHAT模式
-	userGuideLines := "must answer in Chinese."
-	includeToolDefinitions := false
-	includeDefaultPrompt := false
-
-	// 将模型名称转换为小写，然后检查后缀
-	modelLower := strings.ToLower(req.Model)
-
-	// 检查模型名称后缀 (不区分大小写)
-	if strings.HasSuffix(modelLower, "-chat") {
-		// 保持使用CHAT模式的默认设置
-		mode = "CHAT"
-	} else if strings.HasSuffix(modelLower, "-agent") {
-		// 使用AGENT模式
-		mode = "AGENT"
-		userGuideLines = "must answer in Chinese, do not use tools, and for questions involving internet searches, please answer based on your existing knowledge."
-		includeToolDefinitions = true
-		includeDefaultPrompt = true
-	}
-
-	augmentReq := AugmentRequest{
-		Path:           "",                  // 这个是关联的项目文件路径，暂时传空，不影响对话
-		Mode:           mode,                // 根据模型名称决定模式
-		Prefix:         defaultPrefix,       // 固定前缀，影响模型回复风格
-		Suffix:         " ",                 // 固定后缀，暂时传空，不影响对话
-		Lang:           detectLanguage(req), // 简单检测当前对话语言类型，不传好像回答有问题
-		Message:        "",                  // 当前对话消息
-		UserGuideLines: userGuideLines,      // 根据模型类型设置指南
-		// 初始化为空列表
-		ChatHistory: make([]AugmentChatHistory, 0),
-		Blobs: struct {
-			CheckpointID string        `json:"checkpoint_id"`
-			AddedBlobs   []interface{} `json:"added_blobs"`
-			DeletedBlobs []interface{} `json:"deleted_blobs"`
-		}{
-			CheckpointID: generateCheckpointID(),
-			AddedBlobs:   make([]interface{}, 0),
-			DeletedBlobs: make([]interface{}, 0),
-		},
-		UserGuidedBlobs:   make([]interface{}, 0),
-		ExternalSourceIds: make([]interface{}, 0),
-		FeatureDetectionFlags: struct {
-			SupportRawOutput bool `json:"support_raw_output"`
-		}{
-			SupportRawOutput: true,
-		},
-		ToolDefinitions: []ToolDefinition{}, // 初始化为空
-		Nodes:           make([]Node, 0),
-	}
-
-	// 根据模型类型决定是否包含工具定义
-	if includeToolDefinitions {
-		augmentReq.ToolDefinitions = getFullToolDefinitions()
-	}
-
-	// 处理消息历史
-	if len(req.Messages) > 1 { // 有历史消息
-		// 每次处理一对消息（用户问题和助手回答）
-		for i := 0; i < len(req.Messages)-1; i += 2 {
-			if i+1 < len(req.Messages) {
-				userMsg := req.Messages[i]
-				assistantMsg := req.Messages[i+1]
-
-				chatHistory := AugmentChatHistory{
-					RequestMessage: userMsg.GetContent(),
-					ResponseText:   assistantMsg.GetContent(),
-					RequestID:      generateRequestID(), // 生成唯一的请求ID
-					RequestNodes:   make([]Node, 0),
-					ResponseNodes: []Node{
-						{
-							ID:      0,
-							Type:    0,
-							Content: assistantMsg.GetContent(),
-							ToolUse: ToolUse{
-								ToolUseID: "",
-								ToolName:  "",
-								InputJSON: "",
-							},
-							AgentMemory: AgentMemory{
-								Content: "",
-							},
-						},
-					},
-				}
-				augmentReq.ChatHistory = append(augmentReq.ChatHistory, chatHistory)
-			}
-		}
+// fallbackGuidelines 降级到CHAT模式时使用的指南，配置了指南模板时使用模板，关闭默认注入时只保留客户端的系统提示词
+func fallbackGuidelines(augmentReq AugmentRequest, guidelines string) string {
+	if augmentReq.AnswerLanguage != "" {
+		guidelines = "You must answer in " + augmentReq.AnswerLanguage + "."
 	}
-
-	// 设置当前消息
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		if includeDefaultPrompt {
-			augmentReq.Message = defaultPrompt + "\n" + lastMsg.GetContent()
-		} else {
-			augmentReq.Message = lastMsg.GetContent()
-		}
+	if augmentReq.CustomGuidelines != "" {
+		guidelines = augmentReq.CustomGuidelines
+	} else if injectionDisabled() {
+		guidelines = ""
 	}
+	return convert.WithSystemPrompt(augmentReq.SystemPrompt, guidelines)
+}
 
-	return augmentReq
+// convertToAugmentRequest 将OpenAI请求转换为Augment请求
+func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
+	return convert.FromOpenAI(req.Model, convertMessages(req.Messages), requestOptions(req.Model, req.Messages))
 }
 
 // convertAnthropicToAugmentRequest 将Anthropic请求转换为Augment请求
 func convertAnthropicToAugmentRequest(req AnthropicRequest) AugmentRequest {
-	// 确定模式和其他参数基于模型名称
-	mode := "CHAT" // 默认使用CHAT模式
-	userGuideLines := "must answer in Chinese."
-	includeToolDefinitions := false
-	includeDefaultPrompt := false
-
-	// 将模型名称转换为小写，然后检查后缀
-	modelLower := strings.ToLower(req.Model)
-
-	// 检查模型名称后缀 (不区分大小写)
-	if strings.HasSuffix(modelLower, "-chat") {
-		// 保持使用CHAT模式的默认设置
-		mode = "CHAT"
-	} else if strings.HasSuffix(modelLower, "-agent") {
-		// 使用AGENT模式
-		mode = "AGENT"
-		userGuideLines = "must answer in Chinese, do not use tools, and for questions involving internet searches, please answer based on your existing knowledge."
-		includeToolDefinitions = true
-		includeDefaultPrompt = true
-	}
-
-	augmentReq := AugmentRequest{
-		Path:           "",                  // 这个是关联的项目文件路径，暂时传空，不影响对话
-		Mode:           mode,                // 根据模型名称决定模式
-		Prefix:         defaultPrefix,       // 固定前缀，影响模型回复风格
-		Suffix:         " ",                 // 固定后缀，暂时传空，不影响对话
-		Lang:           detectLanguageFromAnthropic(req), // 简单检测当前对话语言类型
-		Message:        "",                  // 当前对话消息
-		UserGuideLines: userGuideLines,      // 根据模型类型设置指南
-		// 初始化为空列表
-		ChatHistory: make([]AugmentChatHistory, 0),
-		Blobs: struct {
-			CheckpointID string        `json:"checkpoint_id"`
-			AddedBlobs   []interface{} `json:"added_blobs"`
-			DeletedBlobs []interface{} `json:"deleted_blobs"`
-		}{
-			CheckpointID: generateCheckpointID(),
-			AddedBlobs:   make([]interface{}, 0),
-			DeletedBlobs: make([]interface{}, 0),
-		},
-		UserGuidedBlobs:   make([]interface{}, 0),
-		ExternalSourceIds: make([]interface{}, 0),
-		FeatureDetectionFlags: struct {
-			SupportRawOutput bool `json:"support_raw_output"`
-		}{
-			SupportRawOutput: true,
-		},
-		ToolDefinitions: []ToolDefinition{}, // 初始化为空
-		Nodes:           make([]Node, 0),
-	}
-
-	// 根据模型类型决定是否包含工具定义
-	if includeToolDefinitions {
-		augmentReq.ToolDefinitions = getFullToolDefinitions()
-	}
-
-	// 处理消息历史
-	if len(req.Messages) > 1 { // 有历史消息
-		// 每次处理一对消息（用户问题和助手回答）
-		for i := 0; i < len(req.Messages)-1; i += 2 {
-			if i+1 < len(req.Messages) {
-				userMsg := req.Messages[i]
-				assistantMsg := req.Messages[i+1]
-
-				chatHistory := AugmentChatHistory{
-					RequestMessage: userMsg.GetContent(),
-					ResponseText:   assistantMsg.GetContent(),
-					RequestID:      generateRequestID(), // 生成唯一的请求ID
-					RequestNodes:   make([]Node, 0),
-					ResponseNodes: []Node{
-						{
-							ID:      0,
-							Type:    0,
-							Content: assistantMsg.GetContent(),
-							ToolUse: ToolUse{
-								ToolUseID: "",
-								ToolName:  "",
-								InputJSON: "",
-							},
-							AgentMemory: AgentMemory{
-								Content: "",
-							},
-						},
-					},
-				}
-				augmentReq.ChatHistory = append(augmentReq.ChatHistory, chatHistory)
-			}
-		}
-	}
-
-	// 设置当前消息
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		if includeDefaultPrompt {
-			augmentReq.Message = defaultPrompt + "\n" + lastMsg.GetContent()
-		} else {
-			augmentReq.Message = lastMsg.GetContent()
-		}
-	}
-
-	return augmentReq
+	return convert.FromAnthropic(req.Model, req.System, convertMessages(req.Messages), requestOptions(req.Model, req.Messages))
 }
 
-// detectLanguageFromAnthropic 从Anthropic请求中检测编程语言
-func detectLanguageFromAnthropic(req AnthropicRequest) string {
-	if len(req.Messages) == 0 {
-		return ""
+// convertMessages 将客户端消息展开为转换所需的纯文本消息
+func convertMessages(messages []ChatMessage) []convert.Message {
+	result := make([]convert.Message, len(messages))
+	for i, message := range messages {
+		result[i] = convert.Message{Role: message.Role, Text: message.GetContent()}
 	}
-
-	content := req.Messages[len(req.Messages)-1].GetContent()
-	// 简单判断一下当前对话语言类型
-	if strings.Contains(strings.ToLower(content), "html") {
-		return "HTML"
-	} else if strings.Contains(strings.ToLower(content), "python") {
-		return "Python"
-	} else if strings.Contains(strings.ToLower(content), "javascript") {
-		return "JavaScript"
-	} else if strings.Contains(strings.ToLower(content), "go") {
-		return "Go"
-	} else if strings.Contains(strings.ToLower(content), "rust") {
-		return "Rust"
-	} else if strings.Contains(strings.ToLower(content), "java") {
-		return "Java"
-	} else if strings.Contains(strings.ToLower(content), "c++") {
-		return "C++"
-	} else if strings.Contains(strings.ToLower(content), "c#") {
-		return "C#"
-	} else if strings.Contains(strings.ToLower(content), "php") {
-		return "PHP"
-	} else if strings.Contains(strings.ToLower(content), "ruby") {
-		return "Ruby"
-	} else if strings.Contains(strings.ToLower(content), "swift") {
-		return "Swift"
-	} else if strings.Contains(strings.ToLower(content), "kotlin") {
-		return "Kotlin"
-	} else if strings.Contains(strings.ToLower(content), "typescript") {
-		return "TypeScript"
-	} else if strings.Contains(strings.ToLower(content), "c") {
-		return "C"
-	}
-	return "HTML"
+	return result
 }
 
-// generateRequestID 生成唯一的请求ID
-func generateRequestID() string {
-	// 使用UUID v4生成唯一ID
-	return uuid.New().String()
-}
-
-// detectLanguage 检测编程语言
-func detectLanguage(req OpenAIRequest) string {
-	if len(req.Messages) == 0 {
-		return ""
-	}
-
-	content := req.Messages[len(req.Messages)-1].GetContent()
-	// 简单判断一下当前对话语言类型
-	if strings.Contains(strings.ToLower(content), "html") {
-		return "HTML"
-	} else if strings.Contains(strings.ToLower(content), "python") {
-		return "Python"
-	} else if strings.Contains(strings.ToLower(content), "javascript") {
-		return "JavaScript"
-	} else if strings.Contains(strings.ToLower(content), "go") {
-		return "Go"
-	} else if strings.Contains(strings.ToLower(content), "rust") {
-		return "Rust"
-	} else if strings.Contains(strings.ToLower(content), "java") {
-		return "Java"
-	} else if strings.Contains(strings.ToLower(content), "c++") {
-		return "C++"
-	} else if strings.Contains(strings.ToLower(content), "c#") {
-		return "C#"
-	} else if strings.Contains(strings.ToLower(content), "php") {
-		return "PHP"
-	} else if strings.Contains(strings.ToLower(content), "ruby") {
-		return "Ruby"
-	} else if strings.Contains(strings.ToLower(content), "swift") {
-		return "Swift"
-	} else if strings.Contains(strings.ToLower(content), "kotlin") {
-		return "Kotlin"
-	} else if strings.Contains(strings.ToLower(content), "typescript") {
-		return "TypeScript"
-	} else if strings.Contains(strings.ToLower(content), "c") {
-		return "C"
-	}
-	return "HTML"
-}
-
-// getFullToolDefinitions 返回官方定义的完整工具定义列表
-func getFullToolDefinitions() []ToolDefinition {
-	return []ToolDefinition{
-		{
-			Name:            "save-file",
-			Description:     "Save a new file. Use this tool to write new files with the attached content. It CANNOT modify existing files. Do NOT use this tool to edit an existing file by overwriting it entirely. Use the str-replace-editor tool to edit existing files instead.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"file_path\":{\"type\":\"string\",\"description\":\"The path of the file to save.\"},\"file_content\":{\"type\":\"string\",\"description\":\"The content of the file.\"},\"add_last_line_newline\":{\"type\":\"boolean\",\"description\":\"Whether to add a newline at the end of the file (default: true).\"}},\"required\":[\"file_path\",\"file_content\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "launch-process",
-			Description:     "Launch a new process with a shell command. A process can be waiting (`wait=true`) or non-waiting (`wait=false`).\n\nIf `wait=true`, launches the process in an interactive terminal, and waits for the process to complete up to\n`max_wait_seconds` seconds. If the process ends during this period, the tool call returns. If the timeout\nexpires, the process will continue running in the background but the tool call will return. You can then\ninteract with the process using the other process tools.\n\nNote: Only one waiting process can be running at a time. If you try to launch a process with `wait=true`\nwhile another is running, the tool will return an error.\n\nIf `wait=false`, launches a background process in a separate terminal. This returns immediately, while the\nprocess keeps running in the background.\n\nNotes:\n- Use `wait=true` processes when the command is expected to be short, or when you can't\nproceed with your task until the process is complete. Use `wait=false` for processes that are\nexpected to run in the background, such as starting a server you'll need to interact with, or a\nlong-running process that does not need to complete before proceeding with the task.\n- If this tool returns while the process is still running, you can continue to interact with the process\nusing the other available tools. You can wait for the process, read from it, write to it, kill it, etc.\n- You can use this tool to interact with the user's local version control system. Do not use the\nretrieval tool for that purpose.\n- If there is a more specific tool available that can perform the function, use that tool instead of\nthis one.\n\nThe OS is darwin.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"command\":{\"type\":\"string\",\"description\":\"The shell command to execute.\"},\"wait\":{\"type\":\"boolean\",\"description\":\"Whether to wait for the command to complete.\"},\"max_wait_seconds\":{\"type\":\"number\",\"description\":\"Number of seconds to wait for the command to complete. Only relevant when wait=true. 10 minutes may be a good default: increase from there if needed.\"},\"cwd\":{\"type\":\"string\",\"description\":\"Working directory for the command. If not supplied, uses the current working directory.\"}},\"required\":[\"command\",\"wait\",\"max_wait_seconds\"]}",
-			ToolSafety:      2,
-		},
-		{
-			Name:            "read-process",
-			Description:     "Read output from a terminal.\n\nIf `wait=true` and the process has not yet completed, waits for the terminal to complete up to `max_wait_seconds` seconds before returning its output.\n\nIf `wait=false` or the process has already completed, returns immediately with the current output.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"terminal_id\":{\"type\":\"integer\",\"description\":\"Terminal ID to read from.\"},\"wait\":{\"type\":\"boolean\",\"description\":\"Whether to wait for the command to complete.\"},\"max_wait_seconds\":{\"type\":\"number\",\"description\":\"Number of seconds to wait for the command to complete. Only relevant when wait=true. 1 minute may be a good default: increase from there if needed.\"}},\"required\":[\"terminal_id\",\"wait\",\"max_wait_seconds\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "kill-process",
-			Description:     "Kill a process by its process ID.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"terminal_id\":{\"type\":\"integer\",\"description\":\"Process ID to kill.\"}},\"required\":[\"terminal_id\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "write-process",
-			Description:     "Write input to a process's stdin.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"terminal_id\":{\"type\":\"integer\",\"description\":\"Process ID to write to.\"},\"input_text\":{\"type\":\"string\",\"description\":\"Text to write to the process's stdin.\"}},\"required\":[\"terminal_id\",\"input_text\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "list-processes",
-			Description:     "List all known processes and their states.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{},\"required\":[]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "web-search",
-			Description:     "Search the web for information. Returns results in markdown format.\nEach result includes the URL, title, and a snippet from the page if available.\n\nThis tool uses Google's Custom Search API to find relevant web pages.",
-			InputSchemaJSON: "{\"description\": \"Input schema for the web search tool.\", \"properties\": {\"query\": {\"description\": \"The search query to send.\", \"title\": \"Query\", \"type\": \"string\"}, \"num_results\": {\"default\": 5, \"description\": \"Number of results to return\", \"maximum\": 10, \"minimum\": 1, \"title\": \"Num Results\", \"type\": \"integer\"}}, \"required\": [\"query\"], \"title\": \"WebSearchInput\", \"type\": \"object\"}",
-			ToolSafety:      0,
-		},
-		{
-			Name:            "web-fetch",
-			Description:     "Fetches data from a webpage and converts it into Markdown.\n\n1. The tool takes in a URL and returns the content of the page in Markdown format;\n2. If the return is not valid Markdown, it means the tool cannot successfully parse this page.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"url\":{\"type\":\"string\",\"description\":\"The URL to fetch.\"}},\"required\":[\"url\"]}",
-			ToolSafety:      0,
-		},
-		{
-			Name:            "codebase-retrieval",
-			Description:     "This tool is Augment's context engine, the world's best codebase context engine. It:\n1. Takes in a natural language description of the code you are looking for;\n2. Uses a proprietary retrieval/embedding model suite that produces the highest-quality recall of relevant code snippets from across the codebase;\n3. Maintains a real-time index of the codebase, so the results are always up-to-date and reflects the current state of the codebase;\n4. Can retrieve across different programming languages;\n5. Only reflects the current state of the codebase on the disk, and has no information on version control or code history.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"information_request\":{\"type\":\"string\",\"description\":\"A description of the information you need.\"}},\"required\":[\"information_request\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "remove-files",
-			Description:     "Remove files. ONLY use this tool to delete files in the user's workspace. This is the only safe tool to delete files in a way that the user can undo the change. Do NOT use the shell or launch-process tools to remove files.",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"file_paths\":{\"type\":\"array\",\"description\":\"The paths of the files to remove.\",\"items\":{\"type\":\"string\"}}},\"required\":[\"file_paths\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "remember",
-			Description:     "Call this tool when user asks you:\n- to remember something\n- to create memory/memories\n\nUse this tool only with information that can be useful in the long-term.\nDo not use this tool for temporary information.\n",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"memory\":{\"type\":\"string\",\"description\":\"The concise (1 sentence) memory to remember.\"}},\"required\":[\"memory\"]}",
-			ToolSafety:      1,
-		},
-		{
-			Name:            "str-replace-editor",
-			Description:     "Custom editing tool for viewing, creating and editing files\n* `path` is a file path relative to the workspace root\n* command `view` displays the result of applying `cat -n`.\n* If a `command` generates a long output, it will be truncated and marked with `<response clipped>`\n* `insert` and `str_replace` commands output a snippet of the edited section for each entry. This snippet reflects the final state of the file after all edits and IDE auto-formatting have been applied.\n\n\nNotes for using the `str_replace` command:\n* Use the `str_replace_entries` parameter with an array of objects\n* Each object should have `old_str`, `new_str`, `old_str_start_line_number` and `old_str_end_line_number` properties\n* The `old_str_start_line_number` and `old_str_end_line_number` parameters are 1-based line numbers\n* Both `old_str_start_line_number` and `old_str_end_line_number` are INCLUSIVE\n* The `old_str` parameter should match EXACTLY one or more consecutive lines from the original file. Be mindful of whitespace!\n* Empty `old_str` is allowed only when the file is empty or contains only whitespaces\n* It is important to specify `old_str_start_line_number` and `old_str_end_line_number` to disambiguate between multiple occurrences of `old_str` in the file\n* Make sure that `old_str_start_line_number` and `old_str_end_line_number` do not overlap with other entries in `str_replace_entries`\n* The `new_str` parameter should contain the edited lines that should replace the `old_str`. Can be an empty string to delete content\n\nNotes for using the `insert` command:\n* Use the `insert_line_entries` parameter with an array of objects\n* Each object should have `insert_line` and `new_str` properties\n* The `insert_line` parameter specifies the line number after which to insert the new string\n* The `insert_line` parameter is 1-based line number\n* To insert at the very beginning of the file, use `insert_line: 0`\n\nNotes for using the `view` command:\n* Strongly prefer to use larger ranges of at least 500 lines when scanning through files. One call with large range is much more efficient than many calls with small ranges\n\nIMPORTANT:\n* This is the only tool you should use for editing files.\n* If it fails try your best to fix inputs and retry.\n* DO NOT fall back to removing the whole file and recreating it from scratch.\n* DO NOT use sed or any other command line tools for editing files.\n* Try to fit as many edits in one tool call as possible\n* Use view command to read the file before editing it.\n",
-			InputSchemaJSON: "{\"type\":\"object\",\"properties\":{\"command\":{\"type\":\"string\",\"enum\":[\"view\",\"str_replace\",\"insert\"],\"description\":\"The commands to run. Allowed options are: 'view', 'str_replace', 'insert'.\"},\"path\":{\"description\":\"Full path to file relative to the workspace root, e.g. 'services/api_proxy/file.py' or 'services/api_proxy'.\",\"type\":\"string\"},\"view_range\":{\"description\":\"Optional parameter of `view` command when `path` points to a file. If none is given, the full file is shown. If provided, the file will be shown in the indicated line number range, e.g. [501, 1000] will show lines from 501 to 1000. Indices are 1-based and inclusive. Setting `[start_line, -1]` shows all lines from `start_line` to the end of the file.\",\"type\":\"array\",\"items\":{\"type\":\"integer\"}},\"insert_line_entries\":{\"description\":\"Required parameter of `insert` command. A list of entries to insert. Each entry is a dictionary with keys `insert_line` and `new_str`.\",\"type\":\"array\",\"items\":{\"type\":\"object\",\"properties\":{\"insert_line\":{\"description\":\"The line number after which to insert the new string. This line number is relative to the state of the file before any insertions in the current tool call have been applied.\",\"type\":\"integer\"},\"new_str\":{\"description\":\"The string to insert. Can be an empty string.\",\"type\":\"string\"}},\"required\":[\"insert_line\",\"new_str\"]}},\"str_replace_entries\":{\"description\":\"Required parameter of `str_replace` command. A list of entries to replace. Each entry is a dictionary with keys `old_str`, `old_str_start_line_number`, `old_str_end_line_number` and `new_str`. `old_str` from different entries should not overlap.\",\"type\":\"array\",\"items\":{\"type\":\"object\",\"properties\":{\"old_str\":{\"description\":\"The string in `path` to replace.\",\"type\":\"string\"},\"old_str_start_line_number\":{\"description\":\"The line number of the first line of `old_str` in the file. This is used to disambiguate between multiple occurrences of `old_str` in the file.\",\"type\":\"integer\"},\"old_str_end_line_number\":{\"description\":\"The line number of the last line of `old_str` in the file. This is used to disambiguate between multiple occurrences of `old_str` in the file.\",\"type\":\"integer\"},\"new_str\":{\"description\":\"The string to replace `old_str` with. Can be an empty string to delete content.\",\"type\":\"string\"}},\"required\":[\"old_str\",\"new_str\",\"old_str_start_line_number\",\"old_str_end_line_number\"]}}},\"required\":[\"command\",\"path\"]}",
-			ToolSafety:      1,
-		},
+// requestOptions 按当前配置生成请求转换参数
+func requestOptions(model string, messages []ChatMessage) convert.RequestOptions {
+	return convert.RequestOptions{
+		// 开启语言检测时按用户消息的语言调整默认指南
+		AnswerLanguage:   detectAnswerLanguage(model, messages),
+		DisableInjection: injectionDisabled(),
+		GuardSystem:      guardSystemPrompt,
 	}
 }
 
@@ -701,22 +310,84 @@ func ModelsHandler(c *gin.Context) {
 		},
 	}
 
+	// 只返回当前API密钥允许使用的模型
+	if apiKey := currentAPIKey(c); apiKey != nil {
+		allowed := response.Data[:0]
+		for _, model := range response.Data {
+			if apiKey.AllowsModel(model.ID) {
+				allowed = append(allowed, model)
+			}
+		}
+		response.Data = allowed
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
 // ChatCompletionsHandler 处理OpenAI兼容的聊天完成请求
 func ChatCompletionsHandler(c *gin.Context) {
-	// 获取请求数据
+	// 获取请求数据，已通过校验中间件时直接使用其解析结果
 	var req OpenAIRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+	if parsed, ok := takeValidatedRequest(c); ok {
+		req = *parsed.(*OpenAIRequest)
+	} else if err := decodeRequestBody(c, &req); err != nil {
+		respondDecodeError(c, err)
 		// 确保在错误情况下也清理请求状态
 		cleanupRequestStatus(c)
 		return
 	}
 
+	// 检查API密钥的模型白名单
+	if !enforceModelAllowlist(c, req.Model) {
+		cleanupRequestStatus(c)
+		return
+	}
+
+	// 记录终端用户并检查其请求频率
+	if !setEndUser(c, req.User) {
+		cleanupRequestStatus(c)
+		return
+	}
+
+	// 带回调地址或异步的请求在后台执行，完成后通过Webhook推送结果或由调用方查询
+	if req.CallbackURL != "" || req.Async {
+		enqueueChatCallback(c, req)
+		cleanupRequestStatus(c)
+		return
+	}
+
 	// 转换为Augment请求格式
 	augmentReq := convertToAugmentRequest(req)
+	// 原始消息已转换为Augment请求，释放以免超长对话在内存中保留多份
+	req.Messages = nil
+
+	// 出站前预处理
+	vars := newTemplateVars(c, req.Model)
+	applyRequestTransforms(&augmentReq, req.Model, vars)
+	applyPromptTemplates(&augmentReq, vars)
+	c.Set("model", req.Model)
+	c.Set("augment_mode", augmentReq.Mode)
+
+	// 按token备注中的调度提示确认当前token适合该模式
+	if !tokenmanager.EnsureTokenForMode(c, augmentReq.Mode) {
+		// 本地没有适合该模式的token，请求未发往上游，不计入token的生成失败
+		c.Set("error_class", "token_unavailable")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
+		cleanupRequestStatus(c)
+		return
+	}
+
+	// 客户端要求在流末尾返回用量
+	if req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		c.Set("include_usage", true)
+		c.Set("prompt_tokens", estimatePromptTokens(augmentReq))
+	}
+
+	// 多候选请求并行扇出
+	if req.N > 1 {
+		handleMultiChoiceRequest(c, augmentReq, req)
+		return
+	}
 
 	// 优先使用流式输出，如果失败则降级到非流式输出
 	handleRequestWithStreamFallback(c, augmentReq, req.Model, req.Stream)
@@ -724,17 +395,55 @@ func ChatCompletionsHandler(c *gin.Context) {
 
 // AnthropicMessagesHandler 处理Anthropic兼容的消息请求
 func AnthropicMessagesHandler(c *gin.Context) {
-	// 获取请求数据
+	// 获取请求数据，已通过校验中间件时直接使用其解析结果
 	var req AnthropicRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+	if parsed, ok := takeValidatedRequest(c); ok {
+		req = *parsed.(*AnthropicRequest)
+	} else if err := decodeRequestBody(c, &req); err != nil {
+		respondDecodeError(c, err)
 		// 确保在错误情况下也清理请求状态
 		cleanupRequestStatus(c)
 		return
 	}
 
+	// 检查API密钥的模型白名单
+	if !enforceModelAllowlist(c, req.Model) {
+		cleanupRequestStatus(c)
+		return
+	}
+
+	// 记录终端用户并检查其请求频率
+	endUser := ""
+	if req.Metadata != nil {
+		endUser = req.Metadata.UserID
+	}
+	if !setEndUser(c, endUser) {
+		cleanupRequestStatus(c)
+		return
+	}
+	auditAnthropicParams(c, req)
+
 	// 转换为Augment请求格式
 	augmentReq := convertAnthropicToAugmentRequest(req)
+	// 原始消息已转换为Augment请求，释放以免超长对话在内存中保留多份
+	req.Messages = nil
+
+	// 出站前预处理
+	vars := newTemplateVars(c, req.Model)
+	applyRequestTransforms(&augmentReq, req.Model, vars)
+	applyPromptTemplates(&augmentReq, vars)
+	c.Set("model", req.Model)
+	c.Set("augment_mode", augmentReq.Mode)
+	c.Set("stop_sequences", req.StopSequences)
+
+	// 按token备注中的调度提示确认当前token适合该模式
+	if !tokenmanager.EnsureTokenForMode(c, augmentReq.Mode) {
+		// 本地没有适合该模式的token，请求未发往上游，不计入token的生成失败
+		c.Set("error_class", "token_unavailable")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
+		cleanupRequestStatus(c)
+		return
+	}
 
 	// 优先使用流式输出，如果失败则降级到非流式输出
 	handleAnthropicRequestWithStreamFallback(c, augmentReq, req.Model, req.Stream)
@@ -797,7 +506,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 	asyncIncrementTokenUsage(token, model)
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 		return
@@ -826,6 +535,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "2")
+	applyTokenHeaderOverrides(req, token)
 
 	// 生成请求ID
 	requestID := uuid.New().String()
@@ -852,7 +562,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		return
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		logger.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -870,11 +580,11 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = fallbackGuidelines(augmentReq, "使用中文回答")
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
+		jsonData, err = marshalAugmentPayload(augmentReq)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 			return
@@ -894,11 +604,12 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 		req.Header.Set("x-api-version", "5")
+		applyTokenHeaderOverrides(req, token)
 		req.Header.Set("x-request-id", requestID)
 		req.Header.Set("x-request-session-id", sessionID)
 
 		// 重新发送请求
-		resp, err = client.Do(req)
+		resp, err = doUpstream(c, client, req)
 		if err != nil {
 			// 再次检查是否是连接错误，如果是则尝试切换Token重试
 			if shouldRetryError(err.Error()) {
@@ -932,11 +643,15 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			}
 		}
 
+		if c.GetBool("upstream_overloaded") {
+			respondUpstreamOverloaded(c)
+			return
+		}
 		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 		return
 	}
 
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
 	var fullText string
@@ -961,11 +676,11 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 				}).Info("切换到CHAT模式")
 
 				augmentReq.Mode = "CHAT"
-				augmentReq.UserGuideLines = "You must answer in Chinese."
+				augmentReq.UserGuideLines = fallbackGuidelines(augmentReq, "You must answer in Chinese.")
 				augmentReq.ToolDefinitions = []ToolDefinition{}
 
 				// 重新准备请求数据
-				jsonData, err = json.Marshal(augmentReq)
+				jsonData, err = marshalAugmentPayload(augmentReq)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 					return
@@ -985,11 +700,12 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 				req.Header.Set("Authorization", "Bearer "+token)
 				req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 				req.Header.Set("x-api-version", "5")
+				applyTokenHeaderOverrides(req, token)
 				req.Header.Set("x-request-id", requestID)
 				req.Header.Set("x-request-session-id", sessionID)
 
 				// 重新发送请求
-				resp, err = client.Do(req)
+				resp, err = doUpstream(c, client, req)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
 					return
@@ -1003,12 +719,16 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 					if err == nil {
 						errMsg = errMsg + ": " + string(body)
 					}
+					if c.GetBool("upstream_overloaded") {
+						respondUpstreamOverloaded(c)
+						return
+					}
 					c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 					return
 				}
 
 				// 重新设置reader
-				reader = bufio.NewReader(resp.Body)
+				reader = newUpstreamReader(resp.Body)
 				continue
 			}
 			break
@@ -1019,9 +739,8 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-			log.Printf("解析响应失败: %v", err)
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
@@ -1048,43 +767,17 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 		fullText += augmentResp.Text
 
-		// 创建OpenAI兼容的流式响应
-		streamResp := OpenAIStreamResponse{
-			ID:      responseID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   model,
-			Choices: []StreamChoice{
-				{
-					Index: 0,
-					Delta: ChatMessage{
-						Role:    "assistant",
-						Content: augmentResp.Text,
-					},
-					FinishReason: nil,
-				},
-			},
-		}
-
-		// 如果是最后一条消息，设置完成原因
+		// 创建OpenAI兼容的流式响应，最后一条消息带有完成原因
+		finishReason := ""
 		if augmentResp.Done {
-			finishReason := "stop"
-			streamResp.Choices[0].FinishReason = &finishReason
+			finishReason = "stop"
 		}
-
-		// 序列化并发送响应
-		jsonResp, err := json.Marshal(streamResp)
-		if err != nil {
-			log.Printf("序列化响应失败: %v", err)
-			continue
-		}
-
-		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		c.Writer.Write(convert.NewOpenAIStream(responseID, model).Chunk(augmentResp.Text, finishReason))
 		flusher.Flush()
 
 		// 如果完成，发送最后的[DONE]标记
 		if augmentResp.Done {
-			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+			writeOpenAIStreamDone(c, responseID, model, fullText)
 			flusher.Flush()
 			break
 		}
@@ -1098,11 +791,11 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = fallbackGuidelines(augmentReq, "使用中文回答")
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
+		jsonData, err = marshalAugmentPayload(augmentReq)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 			return
@@ -1122,11 +815,12 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 		req.Header.Set("x-api-version", "5")
+		applyTokenHeaderOverrides(req, token)
 		req.Header.Set("x-request-id", requestID)
 		req.Header.Set("x-request-session-id", sessionID)
 
 		// 重新发送请求
-		resp, err = client.Do(req)
+		resp, err = doUpstream(c, client, req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
 			return
@@ -1140,12 +834,16 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			if err == nil {
 				errMsg = errMsg + ": " + string(body)
 			}
+			if c.GetBool("upstream_overloaded") {
+				respondUpstreamOverloaded(c)
+				return
+			}
 			c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 			return
 		}
 
 		// 读取并转发响应
-		reader = bufio.NewReader(resp.Body)
+		reader = newUpstreamReader(resp.Body)
 		responseID = fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
 		fullText = ""
@@ -1164,51 +862,24 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 				continue
 			}
 
-			var augmentResp AugmentResponse
-			if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-				log.Printf("解析响应失败: %v", err)
+			augmentResp, ok := reader.parse(line)
+			if !ok {
 				continue
 			}
 
 			fullText += augmentResp.Text
 
-			// 创建OpenAI兼容的流式响应
-			streamResp := OpenAIStreamResponse{
-				ID:      responseID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   model,
-				Choices: []StreamChoice{
-					{
-						Index: 0,
-						Delta: ChatMessage{
-							Role:    "assistant",
-							Content: augmentResp.Text,
-						},
-						FinishReason: nil,
-					},
-				},
-			}
-
-			// 如果是最后一条消息，设置完成原因
+			// 创建OpenAI兼容的流式响应，最后一条消息带有完成原因
+			finishReason := ""
 			if augmentResp.Done {
-				finishReason := "stop"
-				streamResp.Choices[0].FinishReason = &finishReason
-			}
-
-			// 序列化并发送响应
-			jsonResp, err := json.Marshal(streamResp)
-			if err != nil {
-				log.Printf("序列化响应失败: %v", err)
-				continue
+				finishReason = "stop"
 			}
-
-			fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+			c.Writer.Write(convert.NewOpenAIStream(responseID, model).Chunk(augmentResp.Text, finishReason))
 			flusher.Flush()
 
 			// 如果完成，发送最后的[DONE]标记
 			if augmentResp.Done {
-				fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+				writeOpenAIStreamDone(c, responseID, model, fullText)
 				flusher.Flush()
 				break
 			}
@@ -1219,22 +890,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 // estimateTokenCount 粗略估计文本中的token数量
 // 这是一个简单的估算方法，实际token数量取决于具体的分词算法
 func estimateTokenCount(text string) int {
-	// 英文单词和标点符号大约是1个token
-	// 中文字符大约是1.5个token（每个字符约为0.75个token）
-	// 按空格分割英文单词
-	words := strings.Fields(text)
-	wordCount := len(words)
-
-	// 计算中文字符数量
-	chineseCount := 0
-	for _, r := range text {
-		if r >= 0x4E00 && r <= 0x9FFF {
-			chineseCount++
-		}
-	}
-
-	// 粗略估计：英文单词按1个token计算，中文字符按0.75个token计算
-	return wordCount + int(float64(chineseCount)*0.75)
+	return convert.EstimateTokens(text)
 }
 
 // 处理非流式请求
@@ -1275,7 +931,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	asyncIncrementTokenUsage(token, model)
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 		return
@@ -1303,6 +959,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "5")
+	applyTokenHeaderOverrides(req, token)
 
 	// 生成请求ID
 	requestID := uuid.New().String()
@@ -1322,7 +979,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	req.Header.Set("x-request-session-id", sessionID)
 
 	client := createHTTPClient()
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		// 检查是否是连接错误，如果是则尝试切换Token重试
 		if shouldRetryError(err.Error()) {
@@ -1355,12 +1012,16 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 			}
 		}
 
+		if c.GetBool("upstream_overloaded") {
+			respondUpstreamOverloaded(c)
+			return
+		}
 		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 		return
 	}
 
 	// 读取完整响应
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	var fullText string
 
 	for {
@@ -1369,6 +1030,10 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 			if err == io.EOF {
 				break
 			}
+			if fullText != "" {
+				markPartialResponse(c, model, fullText, err)
+				break
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取响应失败: " + err.Error()})
 			return
 		}
@@ -1378,8 +1043,8 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
@@ -1407,16 +1072,15 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 		}
 	}
 
+	fullText = appendResponseFooter(c, filterOutputText(fullText))
+
 	// 创建OpenAI兼容的响应
-	finishReason := "stop"
+	finishReason := responseFinishReason(c)
 
 	// 估算token数量
-	promptTokens := estimateTokenCount(augmentReq.Message)
-	for _, history := range augmentReq.ChatHistory {
-		promptTokens += estimateTokenCount(history.RequestMessage)
-		promptTokens += estimateTokenCount(history.ResponseText)
-	}
+	promptTokens := estimatePromptTokens(augmentReq)
 	completionTokens := estimateTokenCount(fullText)
+	recordCompletionLength(c, fullText)
 
 	openAIResp := OpenAIResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
@@ -1453,6 +1117,17 @@ func cleanupRequestStatus(c *gin.Context) {
 		}
 	}()
 
+	// 终端用户统计不依赖token锁，调试模式下同样记录
+	recordEndUserStats(c)
+	recordReviewSample(c)
+	recordTranscript(c)
+	releaseShardSlots(c)
+
+	// 多层处理函数都会调用清理，只执行一次，避免重复释放锁
+	if c.GetBool("request_status_cleaned") {
+		return
+	}
+
 	// 获取锁和 token
 	lockInterface, exists := c.Get("token_lock")
 	if !exists {
@@ -1464,7 +1139,7 @@ func cleanupRequestStatus(c *gin.Context) {
 		return
 	}
 
-	lock, ok := lockInterface.(*sync.Mutex)
+	lock, ok := lockInterface.(*tokenmanager.TokenLock)
 	if !ok {
 		return
 	}
@@ -1473,6 +1148,12 @@ func cleanupRequestStatus(c *gin.Context) {
 	if !ok {
 		return
 	}
+	c.Set("request_status_cleaned", true)
+
+	// 记录本次请求摘要
+	recordTokenRequestHistory(c, token)
+	recordRequestActivity(c)
+	trackGenerationOutcome(c, token)
 
 	// 更新请求状态为已完成
 	err := tokenmanager.SetTokenRequestStatus(token, tokenmanager.TokenRequestStatus{
@@ -1491,58 +1172,60 @@ func cleanupRequestStatus(c *gin.Context) {
 	}
 }
 
-// 创建 HTTP 客户端，如果配置了代理则使用
+// 创建 HTTP 客户端，共用到各租户分片的连接池，如果配置了代理则使用
 func createHTTPClient() *http.Client {
-	client := &http.Client{}
-
-	// 检查是否配置了代理
-	if config.AppConfig.ProxyURL != "" {
-		proxyURL, err := url.Parse(config.AppConfig.ProxyURL)
-		if err == nil {
-			transport := &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			}
-			client.Transport = transport
-			log.Printf("使用代理: %s", config.AppConfig.ProxyURL)
-		} else {
-			log.Printf("代理URL格式错误: %v", err)
-		}
+	// 开发模式下使用模拟上游
+	if mockUpstreamEnabled() {
+		return withRequestSigning(&http.Client{Transport: mockUpstreamTransport{}})
 	}
 
-	return client
+	client := &http.Client{Transport: sharedUpstreamTransport()}
+
+	return withRequestSigning(client)
 }
 
 // 在处理聊天请求时增加token使用计数
 func incrementTokenUsage(token string, model string) {
+	// 未启用Redis（调试模式）时不计数
+	if config.RDB == nil {
+		return
+	}
+
 	// 先将模型名称转换为小写
 	modelLower := strings.ToLower(model)
 
 	// 根据模型类型确定计数键 (不区分大小写)
-	var countKey string
+	var countKey, mode string
 	if strings.HasSuffix(modelLower, "-chat") {
 		countKey = "token_usage_chat:" + token
+		mode = "chat"
 	} else if strings.HasSuffix(modelLower, "-agent") {
 		countKey = "token_usage_agent:" + token
+		mode = "agent"
 	} else {
 		countKey = "token_usage:" + token // 默认键
 		// 非特定结尾的模型，增加chat计数
-		err := config.RedisIncr("token_usage_chat:" + token)
+		count, err := tokenmanager.IncrUsage("token_usage_chat:" + token)
 		if err != nil {
-			logger.Log.Error("增加token chat使用计数失败: %v", err)
+			logger.Log.Errorf("增加token chat使用计数失败: %v", err)
+		} else {
+			tokenmanager.NotifyUsage(token, "chat", count)
 		}
 	}
 
-	err := config.RedisIncr(countKey)
+	count, err := tokenmanager.IncrUsage(countKey)
 	if err != nil {
-		logger.Log.Error("增加token使用计数失败: %v", err)
+		logger.Log.Errorf("增加token使用计数失败: %v", err)
+	} else if mode != "" {
+		tokenmanager.NotifyUsage(token, mode, count)
 	}
 
 	// 增加总使用计数
 	totalCountKey := "token_usage:" + token
 	if countKey != totalCountKey { // 避免重复计数
-		err = config.RedisIncr(totalCountKey)
+		_, err = tokenmanager.IncrUsage(totalCountKey)
 		if err != nil {
-			logger.Log.Error("增加token总使用计数失败: %v", err)
+			logger.Log.Errorf("增加token总使用计数失败: %v", err)
 		}
 	}
 }
@@ -1586,7 +1269,7 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 	asyncIncrementTokenUsage(token, model)
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 		return
@@ -1615,6 +1298,7 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "5")
+	applyTokenHeaderOverrides(req, token)
 
 	// 生成请求ID
 	requestID := uuid.New().String()
@@ -1646,7 +1330,7 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		logger.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -1664,11 +1348,11 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = fallbackGuidelines(augmentReq, "使用中文回答")
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
+		jsonData, err = marshalAugmentPayload(augmentReq)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 			return
@@ -1688,11 +1372,12 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 		req.Header.Set("x-api-version", "5")
+		applyTokenHeaderOverrides(req, token)
 		req.Header.Set("x-request-id", requestID)
 		req.Header.Set("x-request-session-id", sessionID)
 
 		// 重新发送请求
-		resp, err = client.Do(req)
+		resp, err = doUpstream(c, client, req)
 		if err != nil {
 			// 再次检查是否是连接错误，如果是则尝试切换Token重试
 			if shouldRetryError(err.Error()) {
@@ -1726,14 +1411,22 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 			}
 		}
 
+		if c.GetBool("upstream_overloaded") {
+			respondUpstreamOverloaded(c)
+			return
+		}
 		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 		return
 	}
 
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
+	// 切换到CHAT模式重新请求时继续输出同一条消息，消息开始事件只发送一次
+	writeAnthropicMessageStart(c, flusher, model, estimatePromptTokens(augmentReq))
 
 	var fullText string
 	var hasError bool
+	output := newOutputFilter(c)
+	stops := newStopSequenceScanner(c)
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -1753,9 +1446,8 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-			log.Printf("解析响应失败: %v", err)
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
@@ -1780,40 +1472,36 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 			break
 		}
 
+		output.Apply(&augmentResp)
+		stopped := applyStopSequences(c, stops, &augmentResp)
+		if stopped {
+			augmentResp.Text += output.Footer()
+		}
 		fullText += augmentResp.Text
 
 		// 创建Anthropic兼容的流式响应
 		if augmentResp.Text != "" {
-			streamResp := AnthropicStreamResponse{
-				Type: "content_block_delta",
-				Index: 0,
-				Delta: map[string]interface{}{
-					"type": "text_delta",
-					"text": augmentResp.Text,
-				},
-			}
+			c.Writer.Write(convert.AnthropicTextDelta(augmentResp.Text))
+			flusher.Flush()
+		}
 
-			// 序列化并发送响应
-			jsonResp, err := json.Marshal(streamResp)
-			if err != nil {
-				log.Printf("序列化响应失败: %v", err)
-				continue
-			}
+		// 匹配到停止序列时结束消息，返回后关闭连接停止上游继续生成
+		if stopped {
+			recordCompletionLength(c, fullText)
+			writeAnthropicMessageEnd(c, flusher, fullText)
+			return
+		}
 
-			fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", jsonResp)
-			flusher.Flush()
+		// AGENT模式下收到完整的工具调用后立即结束，返回后关闭连接停止上游继续生成
+		if toolUse := completedToolUse(augmentResp); toolUse != nil && stopOnToolEnabled(c) {
+			writeAnthropicToolUseStop(c, flusher, output.Flush(), fullText, toolUse)
+			return
 		}
 
 		// 如果完成，发送最后的消息完成事件
 		if augmentResp.Done {
-			stopResp := AnthropicStreamResponse{
-				Type: "message_stop",
-			}
-			jsonResp, err := json.Marshal(stopResp)
-			if err == nil {
-				fmt.Fprintf(c.Writer, "event: message_stop\ndata: %s\n\n", jsonResp)
-				flusher.Flush()
-			}
+			recordCompletionLength(c, fullText)
+			writeAnthropicMessageEnd(c, flusher, fullText)
 			break
 		}
 	}
@@ -1826,11 +1514,11 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = fallbackGuidelines(augmentReq, "使用中文回答")
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
-		jsonData, err = json.Marshal(augmentReq)
+		jsonData, err = marshalAugmentPayload(augmentReq)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 			return
@@ -1850,11 +1538,12 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 		req.Header.Set("x-api-version", "5")
+		applyTokenHeaderOverrides(req, token)
 		req.Header.Set("x-request-id", requestID)
 		req.Header.Set("x-request-session-id", sessionID)
 
 		// 重新发送请求
-		resp, err = client.Do(req)
+		resp, err = doUpstream(c, client, req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求失败: " + err.Error()})
 			return
@@ -1868,14 +1557,20 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 			if err == nil {
 				errMsg = errMsg + ": " + string(body)
 			}
+			if c.GetBool("upstream_overloaded") {
+				respondUpstreamOverloaded(c)
+				return
+			}
 			c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 			return
 		}
 
 		// 读取并转发响应
-		reader = bufio.NewReader(resp.Body)
+		reader = newUpstreamReader(resp.Body)
 
 		fullText = ""
+		output = newOutputFilter(c)
+		stops = newStopSequenceScanner(c)
 		for {
 			line, err := reader.ReadString('\n')
 			if err != nil {
@@ -1891,46 +1586,28 @@ func handleAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, mod
 				continue
 			}
 
-			var augmentResp AugmentResponse
-			if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-				log.Printf("解析响应失败: %v", err)
+			augmentResp, ok := reader.parse(line)
+			if !ok {
 				continue
 			}
 
+			output.Apply(&augmentResp)
+			stopped := applyStopSequences(c, stops, &augmentResp)
+			if stopped {
+				augmentResp.Text += output.Footer()
+			}
 			fullText += augmentResp.Text
 
 			// 创建Anthropic兼容的流式响应
 			if augmentResp.Text != "" {
-				streamResp := AnthropicStreamResponse{
-					Type: "content_block_delta",
-					Index: 0,
-					Delta: map[string]interface{}{
-						"type": "text_delta",
-						"text": augmentResp.Text,
-					},
-				}
-
-				// 序列化并发送响应
-				jsonResp, err := json.Marshal(streamResp)
-				if err != nil {
-					log.Printf("序列化响应失败: %v", err)
-					continue
-				}
-
-				fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", jsonResp)
+				c.Writer.Write(convert.AnthropicTextDelta(augmentResp.Text))
 				flusher.Flush()
 			}
 
-			// 如果完成，发送最后的消息完成事件
-			if augmentResp.Done {
-				stopResp := AnthropicStreamResponse{
-					Type: "message_stop",
-				}
-				jsonResp, err := json.Marshal(stopResp)
-				if err == nil {
-					fmt.Fprintf(c.Writer, "event: message_stop\ndata: %s\n\n", jsonResp)
-					flusher.Flush()
-				}
+			// 匹配到停止序列或完成时，发送最后的消息完成事件
+			if stopped || augmentResp.Done {
+				recordCompletionLength(c, fullText)
+				writeAnthropicMessageEnd(c, flusher, fullText)
 				break
 			}
 		}
@@ -1975,7 +1652,7 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 	asyncIncrementTokenUsage(token, model)
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 		return
@@ -2003,6 +1680,7 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "5")
+	applyTokenHeaderOverrides(req, token)
 
 	// 生成请求ID
 	requestID := uuid.New().String()
@@ -2022,7 +1700,7 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 	req.Header.Set("x-request-session-id", sessionID)
 
 	client := createHTTPClient()
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		// 检查是否是连接错误，如果是则尝试切换Token重试
 		if shouldRetryError(err.Error()) {
@@ -2055,12 +1733,16 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 			}
 		}
 
+		if c.GetBool("upstream_overloaded") {
+			respondUpstreamOverloaded(c)
+			return
+		}
 		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 		return
 	}
 
 	// 读取完整响应
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	var fullText string
 
 	for {
@@ -2069,6 +1751,10 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 			if err == io.EOF {
 				break
 			}
+			if fullText != "" {
+				markPartialResponse(c, model, fullText, err)
+				break
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取响应失败: " + err.Error()})
 			return
 		}
@@ -2078,8 +1764,8 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
@@ -2107,8 +1793,10 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 		}
 	}
 
+	fullText = appendResponseFooter(c, cutAtStopSequence(c, filterOutputText(fullText)))
+
 	// 创建Anthropic兼容的响应
-	stopReason := "end_turn"
+	stopReason := responseStopReason(c)
 
 	// 估算token数量
 	inputTokens := estimateTokenCount(augmentReq.Message)
@@ -2117,6 +1805,7 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 		inputTokens += estimateTokenCount(history.ResponseText)
 	}
 	outputTokens := estimateTokenCount(fullText)
+	recordCompletionLength(c, fullText)
 
 	anthropicResp := AnthropicResponse{
 		ID:   fmt.Sprintf("msg_%d", time.Now().Unix()),
@@ -2130,7 +1819,7 @@ func handleAnthropicNonStreamRequest(c *gin.Context, augmentReq AugmentRequest,
 		},
 		Model:        model,
 		StopReason:   &stopReason,
-		StopSequence: nil,
+		StopSequence: responseStopSequence(c),
 		Usage: AnthropicUsage{
 			InputTokens:  inputTokens,
 			OutputTokens: outputTokens,
@@ -2221,7 +1910,7 @@ func tryStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string, c
 	asyncIncrementTokenUsage(token, model)
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		logger.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -2256,6 +1945,7 @@ func tryStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string, c
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "2")
+	applyTokenHeaderOverrides(req, token)
 
 	// 生成请求ID
 	requestID := uuid.New().String()
@@ -2272,7 +1962,7 @@ func tryStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string, c
 	req.Header.Set("x-request-session-id", sessionID)
 
 	client := createHTTPClient()
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		logger.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -2373,7 +2063,8 @@ func shouldRetryStatusCode(statusCode int) bool {
 		   statusCode == http.StatusInternalServerError ||
 		   statusCode == http.StatusBadGateway ||
 		   statusCode == http.StatusServiceUnavailable ||
-		   statusCode == http.StatusGatewayTimeout
+		   statusCode == http.StatusGatewayTimeout ||
+		   statusCode == statusOverloaded
 }
 
 // processStreamResponse 处理流式响应并转发给客户端
@@ -2389,8 +2080,11 @@ func processStreamResponse(c *gin.Context, resp *http.Response, model string) bo
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
+	var received string
+	output := newOutputFilter(c)
+	tools := newOpenAIToolStream(c, responseID, model)
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -2398,10 +2092,40 @@ func processStreamResponse(c *gin.Context, resp *http.Response, model string) bo
 			if err == io.EOF {
 				break
 			}
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-			}).Error("读取流式响应失败")
-			return false
+			// 尚未输出内容时交由降级逻辑处理
+			if received == "" {
+				logger.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("读取流式响应失败")
+				return false
+			}
+
+			// 已输出部分内容，以中断原因结束当前流
+			markPartialResponse(c, model, received, err)
+			finishReason := partialFinishReason()
+			delta := ChatMessage{}
+			if rest := output.Flush() + output.Footer(); rest != "" {
+				delta = ChatMessage{Role: "assistant", Content: rest}
+			}
+			streamResp := OpenAIStreamResponse{
+				ID:      responseID,
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   model,
+				Choices: []StreamChoice{
+					{
+						Index:        0,
+						Delta:        delta,
+						FinishReason: &finishReason,
+					},
+				},
+			}
+			if jsonResp, err := json.Marshal(streamResp); err == nil {
+				fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+			}
+			writeOpenAIStreamDone(c, responseID, model, received)
+			flusher.Flush()
+			return true
 		}
 
 		line = strings.TrimSpace(line)
@@ -2409,47 +2133,27 @@ func processStreamResponse(c *gin.Context, resp *http.Response, model string) bo
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
-		// 创建OpenAI兼容的流式响应
-		streamResp := OpenAIStreamResponse{
-			ID:      responseID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   model,
-			Choices: []StreamChoice{
-				{
-					Index: 0,
-					Delta: ChatMessage{
-						Role:    "assistant",
-						Content: augmentResp.Text,
-					},
-					FinishReason: nil,
-				},
-			},
-		}
+		received += augmentResp.Text
+		output.Apply(&augmentResp)
 
-		// 如果是最后一条消息，设置完成原因
-		if augmentResp.Done {
-			finishReason := "stop"
-			streamResp.Choices[0].FinishReason = &finishReason
-		}
-
-		// 序列化并发送响应
-		jsonResp, err := json.Marshal(streamResp)
-		if err != nil {
-			continue
+		// AGENT模式下收到完整的工具调用后立即结束，返回后关闭连接停止上游继续生成
+		if toolUse := completedToolUse(augmentResp); toolUse != nil && stopOnToolEnabled(c) {
+			writeOpenAIToolCallStop(c, flusher, tools, augmentResp.Text+output.Flush(), received, toolUse)
+			return true
 		}
 
-		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		// 创建OpenAI兼容的流式响应，AGENT模式的工具调用以增量的 tool_calls 输出，最后一条消息带有完成原因
+		tools.write(c, augmentResp)
 		flusher.Flush()
 
 		// 如果完成，发送最后的[DONE]标记
 		if augmentResp.Done {
-			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+			writeOpenAIStreamDone(c, responseID, model, received)
 			flusher.Flush()
 			break
 		}
@@ -2460,8 +2164,9 @@ func processStreamResponse(c *gin.Context, resp *http.Response, model string) bo
 
 // processStreamToNonStream 将流式响应收集为完整响应
 func processStreamToNonStream(c *gin.Context, resp *http.Response, model string) bool {
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	var fullText string
+	var toolUse *ToolUse
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -2469,10 +2174,14 @@ func processStreamToNonStream(c *gin.Context, resp *http.Response, model string)
 			if err == io.EOF {
 				break
 			}
-			logger.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-			}).Error("读取流式响应失败")
-			return false
+			if fullText == "" {
+				logger.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("读取流式响应失败")
+				return false
+			}
+			markPartialResponse(c, model, fullText, err)
+			break
 		}
 
 		line = strings.TrimSpace(line)
@@ -2480,20 +2189,42 @@ func processStreamToNonStream(c *gin.Context, resp *http.Response, model string)
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
 		fullText += augmentResp.Text
 
+		// AGENT模式下收到完整的工具调用后不再等待后续输出
+		if stopOnToolEnabled(c) {
+			if toolUse = completedToolUse(augmentResp); toolUse != nil {
+				break
+			}
+		}
+
 		if augmentResp.Done {
 			break
 		}
 	}
 
+	fullText = filterOutputText(fullText)
+
 	// 创建OpenAI兼容的非流式响应
-	finishReason := "stop"
+	finishReason := responseFinishReason(c)
+	message := ChatMessage{
+		Role:    "assistant",
+		Content: fullText,
+	}
+	if toolUse != nil {
+		finishReason = "tool_calls"
+		message.ToolCalls = []OpenAIToolCall{toOpenAIToolCall(toolUse, nil)}
+	} else {
+		fullText = appendResponseFooter(c, fullText)
+		message.Content = fullText
+		recordCompletionLength(c, fullText)
+	}
+
 	openAIResp := OpenAIResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
 		Object:  "chat.completion",
@@ -2501,11 +2232,8 @@ func processStreamToNonStream(c *gin.Context, resp *http.Response, model string)
 		Model:   model,
 		Choices: []Choice{
 			{
-				Index: 0,
-				Message: ChatMessage{
-					Role:    "assistant",
-					Content: fullText,
-				},
+				Index:        0,
+				Message:      message,
 				FinishReason: &finishReason,
 			},
 		},
@@ -2539,6 +2267,7 @@ func handleNonStreamAsStream(c *gin.Context, augmentReq AugmentRequest, model st
 	if fullResponse == "" {
 		return // 错误已在getNonStreamResponse中处理
 	}
+	fullResponse = appendResponseFooter(c, fullResponse)
 
 	// 设置流式响应头
 	flusher, ok := c.Writer.(http.Flusher)
@@ -2554,50 +2283,19 @@ func handleNonStreamAsStream(c *gin.Context, augmentReq AugmentRequest, model st
 	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
 	// 将完整响应分块发送，模拟流式输出
-	chunkSize := 50 // 每次发送50个字符
-	runes := []rune(fullResponse)
-
-	for i := 0; i < len(runes); i += chunkSize {
-		end := i + chunkSize
-		if end > len(runes) {
-			end = len(runes)
-		}
-
-		chunk := string(runes[i:end])
-		isLast := end >= len(runes)
-
-		streamResp := OpenAIStreamResponse{
-			ID:      responseID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   model,
-			Choices: []StreamChoice{
-				{
-					Index: 0,
-					Delta: ChatMessage{
-						Role:    "assistant",
-						Content: chunk,
-					},
-					FinishReason: nil,
-				},
-			},
-		}
+	chunks := convert.ChunkText(fullResponse, 50) // 每次发送50个字符
+	for i, chunk := range chunks {
+		isLast := i == len(chunks)-1
 
+		finishReason := ""
 		if isLast {
-			finishReason := "stop"
-			streamResp.Choices[0].FinishReason = &finishReason
+			finishReason = responseFinishReason(c)
 		}
-
-		jsonResp, err := json.Marshal(streamResp)
-		if err != nil {
-			continue
-		}
-
-		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+		c.Writer.Write(convert.NewOpenAIStream(responseID, model).Chunk(chunk, finishReason))
 		flusher.Flush()
 
 		if isLast {
-			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+			writeOpenAIStreamDone(c, responseID, model, fullResponse)
 			flusher.Flush()
 			break
 		}
@@ -2630,7 +2328,7 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 	}
 
 	// 准备请求数据
-	jsonData, err := json.Marshal(augmentReq)
+	jsonData, err := marshalAugmentPayload(augmentReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "序列化请求失败"})
 		return ""
@@ -2658,6 +2356,7 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 	req.Header.Set("x-api-version", "5")
+	applyTokenHeaderOverrides(req, token)
 
 	requestID := uuid.New().String()
 	req.Header.Set("x-request-id", requestID)
@@ -2672,7 +2371,7 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 	req.Header.Set("x-request-session-id", sessionID)
 
 	client := createHTTPClient()
-	resp, err := client.Do(req)
+	resp, err := doUpstream(c, client, req)
 	if err != nil {
 		// 检查是否是连接错误，如果是则尝试切换Token重试
 		if shouldRetryError(err.Error()) {
@@ -2703,12 +2402,16 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 			}
 		}
 
+		if c.GetBool("upstream_overloaded") {
+			respondUpstreamOverloaded(c)
+			return ""
+		}
 		c.JSON(resp.StatusCode, gin.H{"error": errMsg})
 		return ""
 	}
 
 	// 读取完整响应
-	reader := bufio.NewReader(resp.Body)
+	reader := newUpstreamReader(resp.Body)
 	var fullText string
 
 	for {
@@ -2717,6 +2420,10 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 			if err == io.EOF {
 				break
 			}
+			if fullText != "" {
+				markPartialResponse(c, model, fullText, err)
+				break
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取响应失败: " + err.Error()})
 			return ""
 		}
@@ -2726,8 +2433,8 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 			continue
 		}
 
-		var augmentResp AugmentResponse
-		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+		augmentResp, ok := reader.parse(line)
+		if !ok {
 			continue
 		}
 
@@ -2738,7 +2445,7 @@ func getNonStreamResponse(c *gin.Context, augmentReq AugmentRequest, model strin
 		}
 	}
 
-	return fullText
+	return filterOutputText(fullText)
 }
 
 // tryAnthropicStreamRequest 尝试Anthropic流式请求
@@ -2754,11 +2461,13 @@ func tryAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, model
 		if fullResponse == "" {
 			return false
 		}
+		fullResponse = appendResponseFooter(c, cutAtStopSequence(c, fullResponse))
 
 		// 创建Anthropic非流式响应
-		stopReason := "end_turn"
+		stopReason := responseStopReason(c)
 		inputTokens := estimateTokenCount("")
 		outputTokens := estimateTokenCount(fullResponse)
+		recordCompletionLength(c, fullResponse)
 
 		anthropicResp := AnthropicResponse{
 			ID:   fmt.Sprintf("msg_%d", time.Now().Unix()),
@@ -2772,7 +2481,7 @@ func tryAnthropicStreamRequest(c *gin.Context, augmentReq AugmentRequest, model
 			},
 			Model:        model,
 			StopReason:   &stopReason,
-			StopSequence: nil,
+			StopSequence: responseStopSequence(c),
 			Usage: AnthropicUsage{
 				InputTokens:  inputTokens,
 				OutputTokens: outputTokens,
@@ -2802,6 +2511,7 @@ func handleAnthropicNonStreamAsStream(c *gin.Context, augmentReq AugmentRequest,
 	if fullResponse == "" {
 		return // 错误已在函数中处理
 	}
+	fullResponse = appendResponseFooter(c, cutAtStopSequence(c, fullResponse))
 
 	// 设置Anthropic流式响应头
 	flusher, ok := c.Writer.(http.Flusher)
@@ -2813,48 +2523,21 @@ func handleAnthropicNonStreamAsStream(c *gin.Context, augmentReq AugmentRequest,
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
+	writeAnthropicMessageStart(c, flusher, model, estimatePromptTokens(augmentReq))
 
 	// 将完整响应分块发送，模拟流式输出
-	chunkSize := 50 // 每次发送50个字符
-	runes := []rune(fullResponse)
-
-	for i := 0; i < len(runes); i += chunkSize {
-		end := i + chunkSize
-		if end > len(runes) {
-			end = len(runes)
-		}
-
-		chunk := string(runes[i:end])
-		isLast := end >= len(runes)
+	chunks := convert.ChunkText(fullResponse, 50) // 每次发送50个字符
+	for i, chunk := range chunks {
+		isLast := i == len(chunks)-1
 
 		if chunk != "" {
-			streamResp := AnthropicStreamResponse{
-				Type: "content_block_delta",
-				Index: 0,
-				Delta: map[string]interface{}{
-					"type": "text_delta",
-					"text": chunk,
-				},
-			}
-
-			jsonResp, err := json.Marshal(streamResp)
-			if err != nil {
-				continue
-			}
-
-			fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", jsonResp)
+			c.Writer.Write(convert.AnthropicTextDelta(chunk))
 			flusher.Flush()
 		}
 
 		if isLast {
-			stopResp := AnthropicStreamResponse{
-				Type: "message_stop",
-			}
-			jsonResp, err := json.Marshal(stopResp)
-			if err == nil {
-				fmt.Fprintf(c.Writer, "event: message_stop\ndata: %s\n\n", jsonResp)
-				flusher.Flush()
-			}
+			recordCompletionLength(c, fullResponse)
+			writeAnthropicMessageEnd(c, flusher, fullResponse)
 			break
 		}
 
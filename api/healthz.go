@@ -0,0 +1,42 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/metrics"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var _ = metrics.NewGaugeFunc("augment2api_redis_degraded",
+	"Whether Redis latency has tripped the breaker and token selection is served from the in-memory cache.", func() float64 {
+		if config.RedisDegraded() {
+			return 1
+		}
+		return 0
+	})
+
+// HealthzHandler 健康检查，Redis降级时仍返回200：聊天请求改用内存缓存继续处理，降级状态在 details 中返回
+func HealthzHandler(c *gin.Context) {
+	if config.RDB == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "ok",
+			"details": gin.H{"redis": "disabled"},
+		})
+		return
+	}
+
+	redisHealth := config.GetRedisHealth()
+	status := "ok"
+	if redisHealth.Degraded {
+		status = "degraded"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": status,
+		"details": gin.H{
+			"redis":       redisHealth,
+			"token_cache": tokenmanager.GetTokenCacheStatus(),
+		},
+	})
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// activeRequest 正在处理中的请求
+type activeRequest struct {
+	id     string
+	c      *gin.Context
+	path   string
+	start  time.Time
+	writer *inspectedWriter
+	cancel context.CancelFunc
+}
+
+// ActiveRequestInfo 进行中请求的摘要
+type ActiveRequestInfo struct {
+	RequestID     string    `json:"request_id"`
+	Path          string    `json:"path"`
+	APIKey        string    `json:"api_key"`
+	Token         string    `json:"token"` // token指纹
+	TenantURL     string    `json:"tenant_url"`
+	Model         string    `json:"model"`
+	Mode          string    `json:"mode"`
+	StartedAt     time.Time `json:"started_at"`
+	ElapsedMs     int64     `json:"elapsed_ms"`
+	BytesStreamed int64     `json:"bytes_streamed"`
+	RetryCount    int       `json:"retry_count"`
+}
+
+var (
+	activeRequests      = make(map[string]*activeRequest)
+	activeRequestsGuard sync.Mutex
+)
+
+// inspectedWriter 统计已输出给客户端的字节数
+type inspectedWriter struct {
+	gin.ResponseWriter
+	written atomic.Int64
+}
+
+// Write 写入响应分块
+func (w *inspectedWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+// WriteString 写入字符串分块
+func (w *inspectedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// RequestInspectorMiddleware 登记进行中的生成请求，便于查看和取消长时间占用token的会话
+func RequestInspectorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		// 设置了总耗时预算时上游context在截止时间自动取消
+		ctx, cancel := withRequestDeadline(c, start)
+		request := &activeRequest{
+			id:     uuid.New().String(),
+			c:      c,
+			path:   c.Request.URL.Path,
+			start:  start,
+			writer: &inspectedWriter{ResponseWriter: c.Writer},
+			cancel: cancel,
+		}
+		c.Writer = request.writer
+		c.Header("X-Request-Id", request.id)
+		c.Set("upstream_ctx", ctx)
+
+		activeRequestsGuard.Lock()
+		activeRequests[request.id] = request
+		activeRequestsGuard.Unlock()
+
+		defer func() {
+			activeRequestsGuard.Lock()
+			delete(activeRequests, request.id)
+			activeRequestsGuard.Unlock()
+			cancel()
+		}()
+
+		c.Next()
+	}
+}
+
+// upstreamContext 返回上游请求使用的context，管理员取消请求或超出总耗时预算时会被取消
+func upstreamContext(c *gin.Context) context.Context {
+	if value, exists := c.Get("upstream_ctx"); exists {
+		if ctx, ok := value.(context.Context); ok {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// info 生成请求摘要，请求处理过程中上下文的键值可能仍在变化，需通过gin的并发安全方法读取
+func (r *activeRequest) info() ActiveRequestInfo {
+	apiKey := r.c.GetString("api_key")
+	if apiKey != "" {
+		apiKey = apikey.Mask(apiKey)
+	}
+	return ActiveRequestInfo{
+		RequestID:     r.id,
+		Path:          r.path,
+		APIKey:        apiKey,
+		Token:         tokenFingerprint(r.c.GetString("token")),
+		TenantURL:     r.c.GetString("tenant_url"),
+		Model:         r.c.GetString("model"),
+		Mode:          r.c.GetString("augment_mode"),
+		StartedAt:     r.start,
+		ElapsedMs:     time.Since(r.start).Milliseconds(),
+		BytesStreamed: r.writer.written.Load(),
+		RetryCount:    r.c.GetInt("retry_count"),
+	}
+}
+
+// ActiveRequestsHandler 列出本实例正在处理的请求，按耗时倒序
+func ActiveRequestsHandler(c *gin.Context) {
+	activeRequestsGuard.Lock()
+	requests := make([]ActiveRequestInfo, 0, len(activeRequests))
+	for _, request := range activeRequests {
+		requests = append(requests, request.info())
+	}
+	activeRequestsGuard.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ElapsedMs > requests[j].ElapsedMs
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"instance": leader.InstanceID(),
+		"requests": requests,
+	})
+}
+
+// CancelActiveRequestHandler 取消进行中的请求，中断其上游连接并释放占用的token
+func CancelActiveRequestHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	activeRequestsGuard.Lock()
+	request, exists := activeRequests[id]
+	activeRequestsGuard.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "请求不存在或已结束，多实例部署时请求只能在处理它的实例上取消",
+		})
+		return
+	}
+
+	info := request.info()
+	request.c.Set("error_class", "cancelled")
+	request.cancel()
+
+	logger.Log.WithFields(logrus.Fields{
+		"request_id": id,
+		"token":      info.Token,
+		"model":      info.Model,
+		"elapsed_ms": info.ElapsedMs,
+	}).Warn("管理员取消了进行中的请求")
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "request_cancelled",
+		Target: id,
+		Detail: map[string]interface{}{
+			"token":          info.Token,
+			"model":          info.Model,
+			"elapsed_ms":     info.ElapsedMs,
+			"bytes_streamed": info.BytesStreamed,
+		},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"request": info,
+	})
+}
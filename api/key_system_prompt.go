@@ -0,0 +1,141 @@
+package api
+
+import (
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/convert"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxKeySystemPromptBytes API密钥默认系统提示词的最大字节数
+const maxKeySystemPromptBytes = 32 << 10
+
+// KeySystemPromptRequest 设置默认系统提示词的请求体
+type KeySystemPromptRequest struct {
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// applyKeySystemPrompt 客户端没有传入系统提示词时使用API密钥的默认系统提示词，
+// 提示词中的占位符按本次请求展开，OpenAI请求作为第一条system消息插入，转换时与其他system消息一样放入指南
+func applyKeySystemPrompt(c *gin.Context, parsed interface{}) {
+	key := currentAPIKey(c)
+	if key == nil || key.SystemPrompt == "" {
+		return
+	}
+
+	switch req := parsed.(type) {
+	case *OpenAIRequest:
+		for _, message := range req.Messages {
+			if message.Role == "system" || message.Role == "developer" {
+				return
+			}
+		}
+		prompt := newTemplateVars(c, req.Model).expand(key.SystemPrompt)
+		req.Messages = append([]ChatMessage{{Role: "system", Content: prompt}}, req.Messages...)
+	case *AnthropicRequest:
+		if convert.SystemText(req.System) != "" {
+			return
+		}
+		req.System = newTemplateVars(c, req.Model).expand(key.SystemPrompt)
+	default:
+		return
+	}
+	c.Set("key_system_prompt", true)
+}
+
+// keySystemPromptView 默认系统提示词的响应
+func keySystemPromptView(key *apikey.APIKey) gin.H {
+	return gin.H{
+		"object":        "api_key.system_prompt",
+		"key":           apikey.Mask(key.Key),
+		"system_prompt": key.SystemPrompt,
+	}
+}
+
+// selfServiceAPIKey 返回当前请求使用的受管理API密钥，使用全局 AUTH_TOKEN 时写入错误响应
+func selfServiceAPIKey(c *gin.Context) (*apikey.APIKey, bool) {
+	key := currentAPIKey(c)
+	if key == nil {
+		respondOpenAIError(c, http.StatusForbidden, "permission_error", "api_key_required",
+			"This endpoint requires an API key issued by this deployment.")
+		return nil, false
+	}
+	return key, true
+}
+
+// GetKeySystemPromptHandler 查看当前API密钥的默认系统提示词
+func GetKeySystemPromptHandler(c *gin.Context) {
+	key, ok := selfServiceAPIKey(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, keySystemPromptView(key))
+}
+
+// SetKeySystemPromptHandler 设置当前API密钥的默认系统提示词，请求没有系统提示词时自动使用，
+// 提示词支持与前缀模板相同的占位符，例如 {{current_date}}
+func SetKeySystemPromptHandler(c *gin.Context) {
+	key, ok := selfServiceAPIKey(c)
+	if !ok {
+		return
+	}
+
+	var req KeySystemPromptRequest
+	if err := decodeRequestBody(c, &req); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_body",
+			"The request body must be a JSON object with a 'system_prompt' field.")
+		return
+	}
+	prompt := strings.TrimSpace(req.SystemPrompt)
+	if len(prompt) > maxKeySystemPromptBytes {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "system_prompt_too_long",
+			"'system_prompt' must not exceed "+strconv.Itoa(maxKeySystemPromptBytes)+" bytes.")
+		return
+	}
+	if !updateKeySystemPrompt(c, key, prompt) {
+		return
+	}
+	c.JSON(http.StatusOK, keySystemPromptView(key))
+}
+
+// DeleteKeySystemPromptHandler 清除当前API密钥的默认系统提示词
+func DeleteKeySystemPromptHandler(c *gin.Context) {
+	key, ok := selfServiceAPIKey(c)
+	if !ok {
+		return
+	}
+	if !updateKeySystemPrompt(c, key, "") {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":  "api_key.system_prompt",
+		"key":     apikey.Mask(key.Key),
+		"deleted": true,
+	})
+}
+
+// updateKeySystemPrompt 保存默认系统提示词并记录审计日志，失败时写入错误响应
+func updateKeySystemPrompt(c *gin.Context, key *apikey.APIKey, prompt string) bool {
+	if err := apikey.SetSystemPrompt(key.Key, prompt); err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to save the system prompt.")
+		return false
+	}
+	key.SystemPrompt = prompt
+
+	action := "api_key_system_prompt_updated"
+	if prompt == "" {
+		action = "api_key_system_prompt_cleared"
+	}
+	audit.Record(audit.Entry{
+		Actor:  apikey.Mask(key.Key),
+		Action: action,
+		Target: apikey.Mask(key.Key),
+		Detail: map[string]interface{}{"key_name": key.Name, "length": len(prompt)},
+	})
+	return true
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ShardLatency 租户分片延迟探测结果
+type ShardLatency struct {
+	TenantURL  string    `json:"tenant_url"`
+	LatencyMs  int64     `json:"latency_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ProbedAt   time.Time `json:"probed_at"`
+}
+
+var (
+	shardLatencies      = make(map[string]ShardLatency)
+	shardLatenciesGuard sync.RWMutex
+)
+
+// probeShardLatency 测量到单个租户分片的往返延迟
+func probeShardLatency(tenantURL string) ShardLatency {
+	result := ShardLatency{
+		TenantURL: tenantURL,
+		ProbedAt:  time.Now(),
+	}
+
+	req, err := http.NewRequest("HEAD", tenantURL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
+
+	client := createHTTPClient()
+	client.Timeout = 10 * time.Second
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	result.Protocol = resp.Proto
+
+	return result
+}
+
+// probeTenantURLs 返回需要探测的租户地址：候选分片加上token池中正在使用的地址
+func probeTenantURLs() []string {
+	urls := candidateTenantURLs()
+	unique := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		unique[u] = true
+	}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return urls
+	}
+	for _, key := range keys {
+		tenantURL, err := config.RedisHGet(key, "tenant_url")
+		if err != nil || tenantURL == "" || unique[tenantURL] {
+			continue
+		}
+		unique[tenantURL] = true
+		urls = append(urls, tenantURL)
+	}
+
+	return urls
+}
+
+// shardLatencyKey 主实例共享探测结果使用的Redis键
+const shardLatencyKey = "shard_latency"
+
+// publishShardLatencies 将探测结果写入Redis供其他实例读取
+func publishShardLatencies(ttl time.Duration) {
+	if config.RDB == nil {
+		return
+	}
+
+	shardLatenciesGuard.RLock()
+	data, err := json.Marshal(shardLatencies)
+	shardLatenciesGuard.RUnlock()
+	if err != nil {
+		return
+	}
+
+	if err := config.RedisSet(shardLatencyKey, string(data), ttl); err != nil {
+		logger.Upstream.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("共享租户分片延迟探测结果失败")
+	}
+}
+
+// loadShardLatencies 从Redis读取主实例的探测结果
+func loadShardLatencies() {
+	if config.RDB == nil {
+		return
+	}
+
+	data, err := config.RedisGet(shardLatencyKey)
+	if err != nil {
+		return
+	}
+
+	var results map[string]ShardLatency
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return
+	}
+
+	shardLatenciesGuard.Lock()
+	shardLatencies = results
+	shardLatenciesGuard.Unlock()
+}
+
+// runLatencyProbe 并发探测所有租户分片并更新结果
+func runLatencyProbe() {
+	urls := probeTenantURLs()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 5) // 限制并发数
+	for _, tenantURL := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tenantURL string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := probeShardLatency(tenantURL)
+
+			shardLatenciesGuard.Lock()
+			shardLatencies[tenantURL] = result
+			shardLatenciesGuard.Unlock()
+		}(tenantURL)
+	}
+	wg.Wait()
+
+	logger.Upstream.WithFields(logrus.Fields{
+		"shards": len(urls),
+	}).Debug("租户分片延迟探测完成")
+}
+
+// StartLatencyProber 启动租户分片延迟探测
+func StartLatencyProber() {
+	if config.AppConfig.LatencyProbeInterval == "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(config.AppConfig.LatencyProbeInterval)
+	if err != nil || interval <= 0 {
+		logger.Upstream.WithFields(logrus.Fields{
+			"interval": config.AppConfig.LatencyProbeInterval,
+		}).Error("LATENCY_PROBE_INTERVAL 格式错误，延迟探测未启动")
+		return
+	}
+
+	logger.Upstream.WithFields(logrus.Fields{
+		"interval": interval.String(),
+	}).Info("租户分片延迟探测启动成功!")
+
+	// 多实例部署时只由主实例探测，其他实例和部署了独立校验进程时读取共享结果
+	probe := func() {
+		if maintenanceActive() {
+			return
+		}
+		if !leader.IsLeader() || validatorActive() {
+			loadShardLatencies()
+			return
+		}
+		runLatencyProbe()
+		if leader.Enabled() {
+			publishShardLatencies(2 * interval)
+		}
+	}
+
+	probe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		probe()
+	}
+}
+
+// getShardLatency 获取租户分片最近一次成功探测的延迟
+func getShardLatency(tenantURL string) (int64, bool) {
+	shardLatenciesGuard.RLock()
+	defer shardLatenciesGuard.RUnlock()
+
+	result, ok := shardLatencies[tenantURL]
+	if !ok || result.Error != "" {
+		return 0, false
+	}
+	return result.LatencyMs, true
+}
+
+// sortTenantURLsByLatency 将探测成功的租户地址按延迟升序排到前面，其余保持原有顺序
+func sortTenantURLsByLatency(urls []string) {
+	sort.SliceStable(urls, func(i, j int) bool {
+		li, oki := getShardLatency(urls[i])
+		lj, okj := getShardLatency(urls[j])
+		if oki && okj {
+			return li < lj
+		}
+		return oki && !okj
+	})
+}
+
+// ShardLatencyHandler 返回租户分片延迟探测结果
+func ShardLatencyHandler(c *gin.Context) {
+	shardLatenciesGuard.RLock()
+	results := make([]ShardLatency, 0, len(shardLatencies))
+	for _, result := range shardLatencies {
+		results = append(results, result)
+	}
+	shardLatenciesGuard.RUnlock()
+
+	// 探测成功的按延迟排序，失败的排在最后
+	sort.Slice(results, func(i, j int) bool {
+		if (results[i].Error == "") != (results[j].Error == "") {
+			return results[i].Error == ""
+		}
+		return results[i].LatencyMs < results[j].LatencyMs
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"enabled": config.AppConfig.LatencyProbeInterval != "",
+		"shards":  results,
+	})
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"augment2api/pkg/leader"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LeaderStatusHandler 返回多实例选主状态
+func LeaderStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"enabled":   leader.Enabled(),
+		"instance":  leader.InstanceID(),
+		"is_leader": leader.IsLeader(),
+		"leader":    leader.CurrentLeader(),
+	})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"augment2api/pkg/audit"
+	"augment2api/pkg/logger"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// LoggingSettingsRequest 调整模块日志级别和采样比例的请求
+type LoggingSettingsRequest struct {
+	Levels   map[string]string  `json:"levels"`   // 模块 -> 日志级别
+	Sampling map[string]float64 `json:"sampling"` // 模块 -> info及以下级别日志的输出比例
+}
+
+// LoggingSettingsHandler 获取各模块的日志级别和采样比例
+func LoggingSettingsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"modules": logger.Settings(),
+	})
+}
+
+// UpdateLoggingSettingsHandler 运行时调整各模块的日志级别和采样比例，仅对当前实例生效，重启后恢复为环境变量配置
+func UpdateLoggingSettingsHandler(c *gin.Context) {
+	var req LoggingSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	// 全部校验通过后再生效，避免只调整了一部分
+	settings := logger.Settings()
+	for module, level := range req.Levels {
+		if _, ok := settings[module]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "未知的日志模块: " + module,
+			})
+			return
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "无效的日志级别: " + level,
+			})
+			return
+		}
+	}
+	for module, rate := range req.Sampling {
+		if _, ok := settings[module]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "未知的日志模块: " + module,
+			})
+			return
+		}
+		if rate <= 0 || rate > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "采样比例必须大于0且不超过1",
+			})
+			return
+		}
+	}
+
+	for module, level := range req.Levels {
+		logger.SetModuleLevel(module, level)
+	}
+	for module, rate := range req.Sampling {
+		logger.SetModuleSampling(module, rate)
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "logging_settings_updated",
+		Detail: map[string]interface{}{"levels": req.Levels, "sampling": req.Sampling},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"modules": logger.Settings(),
+	})
+}
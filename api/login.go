@@ -12,6 +12,11 @@ import (
 
 const (
 	TokenKey = "login:token:"
+
+	// sessionRoleAdmin 使用 ACCESS_PWD 登录的会话
+	sessionRoleAdmin = "admin"
+	// sessionRoleOwner 使用 TOKEN_REVEAL_PWD 登录的会话，可查看完整token
+	sessionRoleOwner = "owner"
 )
 
 // 生成随机会话令牌
@@ -36,14 +41,21 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
-	// 验证密码
-	if req.Password == config.AppConfig.AccessPwd {
+	// 验证密码，高级管理员密码优先
+	role := ""
+	switch {
+	case config.AppConfig.TokenRevealPwd != "" && req.Password == config.AppConfig.TokenRevealPwd:
+		role = sessionRoleOwner
+	case req.Password == config.AppConfig.AccessPwd:
+		role = sessionRoleAdmin
+	}
+	if role != "" {
 		// 生成会话令牌
 		token := generateSessionToken()
 
-		// 将会话令牌保存到Redis，有效期24小时
+		// 将会话令牌和角色保存到Redis，有效期24小时
 		sessionKey := TokenKey + token
-		err := config.RedisSet(sessionKey, "valid", 24*time.Hour)
+		err := config.RedisSet(sessionKey, role, 24*time.Hour)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
@@ -55,6 +67,7 @@ func LoginHandler(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status": "success",
 			"token":  token,
+			"role":   role,
 		})
 		return
 	}
@@ -82,6 +95,14 @@ func ValidateToken(token string) bool {
 	return true
 }
 
+// sessionRole 获取会话的角色，升级前创建的会话按普通管理员处理
+func sessionRole(token string) string {
+	if role, err := config.RedisGet(TokenKey + token); err == nil && role == sessionRoleOwner {
+		return sessionRoleOwner
+	}
+	return sessionRoleAdmin
+}
+
 // AuthTokenMiddleware 会话认证中间件
 func AuthTokenMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -108,6 +129,7 @@ func AuthTokenMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		c.Set("session_role", sessionRole(token))
 		c.Next()
 	}
 }
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// disabledTokenRetention 禁用token关联数据的保留时间，0表示只清理已删除token的数据
+func disabledTokenRetention() time.Duration {
+	days, err := strconv.Atoi(config.AppConfig.DisabledTokenRetentionDays)
+	if err != nil || days < 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// runKeyCleanup 执行一次关联数据清理
+func runKeyCleanup(dryRun bool) (tokenmanager.CleanupResult, error) {
+	result, err := tokenmanager.CleanupStaleTokenKeys(disabledTokenRetention(), dryRun)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("清理token关联数据失败")
+		return result, err
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"dry_run":      dryRun,
+		"archived":     len(result.Archived),
+		"deleted_keys": result.DeletedKeys,
+	}).Info("token关联数据清理完成")
+	return result, nil
+}
+
+// StartKeyCleanupScheduler 定时归档并清理已删除或长期禁用token的关联数据
+func StartKeyCleanupScheduler() {
+	if config.RDB == nil {
+		return
+	}
+
+	hours, err := strconv.Atoi(config.AppConfig.KeyCleanupInterval)
+	if err != nil || hours <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		// 多实例部署时只在主实例执行，维护期间跳过
+		if !leader.IsLeader() || maintenanceActive() {
+			continue
+		}
+		runKeyCleanup(false)
+	}
+}
+
+// KeyCleanupHandler 立即执行一次关联数据清理，dry_run=true 时只返回将被清理的token
+func KeyCleanupHandler(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+
+	result, err := runKeyCleanup(dryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "清理token关联数据失败: " + err.Error(),
+		})
+		return
+	}
+
+	if !dryRun {
+		audit.Record(audit.Entry{
+			Actor:  "admin",
+			Action: "token_keys_cleaned",
+			Detail: map[string]interface{}{"archived": len(result.Archived), "deleted_keys": result.DeletedKeys},
+		})
+	}
+
+	result.Archived = displayArchivedTokens(c, result.Archived)
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// TokenArchiveHandler 获取已归档的token使用数据
+func TokenArchiveHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		limit = 100
+	}
+
+	archived, err := tokenmanager.ListArchivedTokens(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取归档数据失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"archived": displayArchivedTokens(c, archived),
+	})
+}
+
+// displayArchivedTokens 按会话权限替换归档数据中的token
+func displayArchivedTokens(c *gin.Context, archived []tokenmanager.ArchivedToken) []tokenmanager.ArchivedToken {
+	result := make([]tokenmanager.ArchivedToken, len(archived))
+	for i, entry := range archived {
+		entry.Token = displayToken(c, entry.Token)
+		result[i] = entry
+	}
+	return result
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maintenanceKey 维护模式状态的Redis键，所有实例共享
+	maintenanceKey = "maintenance_mode"
+	// maintenanceSyncInterval 各实例同步维护模式状态的间隔
+	maintenanceSyncInterval = 5 * time.Second
+)
+
+// MaintenanceState 维护模式状态
+type MaintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after,omitempty"` // 秒
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+}
+
+var (
+	maintenance      MaintenanceState
+	maintenanceGuard sync.RWMutex
+)
+
+// currentMaintenance 返回本实例当前的维护模式状态
+func currentMaintenance() MaintenanceState {
+	maintenanceGuard.RLock()
+	defer maintenanceGuard.RUnlock()
+	return maintenance
+}
+
+// maintenanceActive 本实例是否处于维护模式，维护期间定时的后台任务应跳过本轮执行
+func maintenanceActive() bool {
+	return currentMaintenance().Enabled
+}
+
+// applyMaintenance 更新本实例的维护模式状态，维护期间暂停后台任务队列
+func applyMaintenance(state MaintenanceState) {
+	maintenanceGuard.Lock()
+	changed := maintenance.Enabled != state.Enabled
+	maintenance = state
+	maintenanceGuard.Unlock()
+
+	if !changed {
+		return
+	}
+	if state.Enabled {
+		job.Pause("")
+		logger.Log.WithFields(logrus.Fields{
+			"message":     state.Message,
+			"retry_after": state.RetryAfter,
+		}).Warn("已进入维护模式，新的生成请求将被拒绝")
+	} else {
+		job.Resume("")
+		logger.Log.Info("已退出维护模式")
+	}
+}
+
+// loadMaintenance 从Redis读取维护模式状态，读取失败时保持当前状态，
+// 维护期间Redis不可用时各实例仍然停留在维护模式
+func loadMaintenance() {
+	data, err := config.RedisGet(maintenanceKey)
+	if err == redis.Nil {
+		applyMaintenance(MaintenanceState{})
+		return
+	}
+	if err != nil {
+		return
+	}
+	var state MaintenanceState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return
+	}
+	applyMaintenance(state)
+}
+
+// StartMaintenanceSync 定期同步其他实例设置的维护模式状态
+func StartMaintenanceSync() {
+	if config.RDB == nil {
+		return
+	}
+	loadMaintenance()
+	go func() {
+		ticker := time.NewTicker(maintenanceSyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			loadMaintenance()
+		}
+	}()
+}
+
+// MaintenanceMiddleware 维护期间拒绝新的生成请求，已开始的请求和流式响应不受影响
+func MaintenanceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := currentMaintenance()
+		if !state.Enabled {
+			c.Next()
+			return
+		}
+
+		c.Set("error_class", "maintenance")
+		if state.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(state.RetryAfter))
+		}
+		if isAnthropicRoute(c) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"type": "error",
+				"error": gin.H{
+					"type":    "api_error",
+					"message": state.Message,
+				},
+			})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error": gin.H{
+				"message": state.Message,
+				"type":    "server_error",
+				"param":   nil,
+				"code":    "maintenance",
+			},
+		})
+	}
+}
+
+// MaintenanceRequest 切换维护模式的请求体，message和retry_after为空时使用配置的默认值
+type MaintenanceRequest struct {
+	Enabled    *bool  `json:"enabled"` // 默认为true
+	Message    string `json:"message"`
+	RetryAfter *int   `json:"retry_after"`
+}
+
+// maintenanceView 维护模式状态和本实例仍在进行的请求，用于判断何时可以开始维护操作
+func maintenanceView(state MaintenanceState) gin.H {
+	activeRequestsGuard.Lock()
+	inFlight := len(activeRequests)
+	activeRequestsGuard.Unlock()
+
+	return gin.H{
+		"status":       "success",
+		"maintenance":  state,
+		"in_flight":    inFlight,
+		"jobs_paused":  job.Paused(""),
+		"jobs_pending": job.Pending(""),
+	}
+}
+
+// GetMaintenanceHandler 查看维护模式状态
+func GetMaintenanceHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, maintenanceView(currentMaintenance()))
+}
+
+// SetMaintenanceHandler 开启或关闭维护模式，状态通过Redis同步到所有实例，
+// 维护期间生成请求返回503，进行中的请求继续完成，后台任务暂停，管理接口不受影响
+func SetMaintenanceHandler(c *gin.Context) {
+	var req MaintenanceRequest
+	if err := decodeRequestBody(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+	if req.RetryAfter != nil && *req.RetryAfter < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "retry_after 不能为负数",
+		})
+		return
+	}
+
+	state := MaintenanceState{}
+	if req.Enabled == nil || *req.Enabled {
+		state = currentMaintenance()
+		if !state.Enabled {
+			now := time.Now()
+			state = MaintenanceState{Enabled: true, StartedAt: &now}
+		}
+		state.Message = strings.TrimSpace(req.Message)
+		if state.Message == "" {
+			state.Message = config.AppConfig.MaintenanceMessage
+		}
+		state.RetryAfter, _ = strconv.Atoi(config.AppConfig.MaintenanceRetryAfter)
+		if req.RetryAfter != nil {
+			state.RetryAfter = *req.RetryAfter
+		}
+	}
+
+	// 先写入Redis再切换本实例，写入失败时其他实例不会同步，本实例仍按请求切换
+	var syncErr error
+	if config.RDB != nil {
+		if state.Enabled {
+			data, _ := json.Marshal(state)
+			syncErr = config.RedisSet(maintenanceKey, string(data), 0)
+		} else {
+			syncErr = config.RedisDel(maintenanceKey)
+		}
+	}
+	applyMaintenance(state)
+
+	action := "maintenance_disabled"
+	if state.Enabled {
+		action = "maintenance_enabled"
+	}
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: action,
+		Detail: map[string]interface{}{"message": state.Message, "retry_after": state.RetryAfter},
+	})
+
+	view := maintenanceView(state)
+	if syncErr != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": syncErr.Error(),
+		}).Error("同步维护模式状态失败")
+		view["warning"] = "维护模式状态未能写入Redis，只对当前实例生效: " + syncErr.Error()
+	}
+	c.JSON(http.StatusOK, view)
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/migration"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RegisterMigrations 注册所有Redis存储结构迁移，新增迁移时版本号递增
+func RegisterMigrations() {
+	migration.Register(migration.Migration{
+		Version: 1,
+		Name:    "token_session_id",
+		Up:      migrateTokensSessionID,
+	})
+}
+
+// RunMigrations 启动时执行所有待应用的迁移
+func RunMigrations() error {
+	// 未启用Redis（如调试模式）时无需迁移
+	if config.RDB == nil {
+		return nil
+	}
+
+	results, err := migration.Run(false)
+	for _, result := range results {
+		logger.Log.WithFields(logrus.Fields{
+			"version": result.Version,
+			"name":    result.Name,
+			"changes": len(result.Changes),
+		}).Info("Redis存储结构迁移完成")
+	}
+	return err
+}
+
+// RunMigrationCommand 以命令方式执行或预演待应用的迁移，报告以JSON输出到标准输出，返回进程退出码，
+// 升级前可先用 -mode migrate -dry-run 确认将要修改的key和字段
+func RunMigrationCommand(dryRun bool) int {
+	if config.RDB == nil {
+		logger.Log.Error("未连接Redis，无需迁移")
+		return 1
+	}
+
+	report, err := migration.RunReport(dryRun)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if err != nil {
+		logger.Log.Errorf("Redis存储结构迁移失败: %v", err)
+		return 1
+	}
+	logger.Log.WithFields(logrus.Fields{
+		"dry_run":      dryRun,
+		"migrations":   len(report.Results),
+		"keys_touched": report.Summary.KeysTouched,
+	}).Info("Redis存储结构迁移完成")
+	return 0
+}
+
+// migrateTokensSessionID 确保所有token都有session_id字段
+func migrateTokensSessionID(dryRun bool) ([]migration.Change, error) {
+	// 获取所有token的key
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, fmt.Errorf("获取token列表失败: %v", err)
+	}
+
+	var changes []migration.Change
+	for _, key := range keys {
+		// 检查token状态，跳过不可用的token
+		status, err := config.RedisHGet(key, "status")
+		if err == nil && status == "disabled" {
+			continue // 跳过被标记为不可用的token
+		}
+
+		// 检查是否已有session_id字段
+		exists, err := config.RedisHExists(key, "session_id")
+		if err != nil {
+			logger.Log.Errorf("check session_id field of token %s failed: %v", key, err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		changes = append(changes, migration.Change{
+			Key:    key,
+			Action: "hset",
+			Fields: []string{"session_id"},
+		})
+		if dryRun {
+			continue
+		}
+
+		// 如果没有session_id字段，生成一个新的session_id
+		err = config.RedisHSet(key, "session_id", uuid.New().String())
+		if err != nil {
+			return changes, fmt.Errorf("add session_id field to token %s failed: %v", key, err)
+		}
+	}
+
+	return changes, nil
+}
+
+// MigrationStatusHandler 返回迁移状态
+func MigrationStatusHandler(c *gin.Context) {
+	status, err := migration.GetStatus()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取迁移状态失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"migration": status,
+	})
+}
+
+// MigrationDryRunHandler 预演所有待应用的迁移，返回将要修改的key和字段及汇总，
+// summary_only=true 时不返回逐个key的变更，适用于token很多的部署
+func MigrationDryRunHandler(c *gin.Context) {
+	report, err := migration.RunReport(true)
+	if c.Query("summary_only") == "true" {
+		for i := range report.Results {
+			report.Results[i].Changes = nil
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":  "error",
+			"error":   err.Error(),
+			"results": report.Results,
+			"report":  report,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"results": report.Results,
+		"report":  report,
+	})
+}
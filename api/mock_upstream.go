@@ -0,0 +1,137 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 在消息中加入以下标记可让模拟上游返回对应的异常，便于调试重试和降级逻辑
+const (
+	mockTrigger429      = "[mock:429]"
+	mockTrigger500      = "[mock:500]"
+	mockTriggerBlocked  = "[mock:blocked]"
+	mockTriggerTruncate = "[mock:truncate]"
+	mockTriggerInvalid  = "[mock:invalid]"
+	mockTriggerTool     = "[mock:tool]"
+)
+
+// mockChunkDelay 模拟上游每个分块之间的间隔
+const mockChunkDelay = 20 * time.Millisecond
+
+// mockUpstreamTransport 模拟Augment上游的RoundTripper，不发起任何网络请求
+type mockUpstreamTransport struct{}
+
+// mockUpstreamEnabled 是否启用模拟上游
+func mockUpstreamEnabled() bool {
+	return config.AppConfig.MockUpstream == "true"
+}
+
+// RoundTrip 根据请求路径返回预置的响应
+func (mockUpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/chat-stream") {
+		return mockResponse(req, http.StatusOK, "{}"), nil
+	}
+
+	var augmentReq AugmentRequest
+	if req.Body != nil {
+		defer req.Body.Close()
+		if err := json.NewDecoder(req.Body).Decode(&augmentReq); err != nil {
+			return mockResponse(req, http.StatusBadRequest, "invalid request body"), nil
+		}
+	}
+
+	switch {
+	case strings.Contains(augmentReq.Message, mockTrigger429):
+		return mockResponse(req, http.StatusTooManyRequests, "Too many requests"), nil
+	case strings.Contains(augmentReq.Message, mockTrigger500):
+		return mockResponse(req, http.StatusInternalServerError, "Internal server error"), nil
+	case strings.Contains(augmentReq.Message, mockTriggerInvalid):
+		return mockResponse(req, http.StatusUnauthorized, "Invalid token"), nil
+	case strings.Contains(augmentReq.Message, mockTriggerBlocked):
+		line, _ := json.Marshal(AugmentResponse{Text: errBlocked, Done: true})
+		return mockResponse(req, http.StatusOK, string(line)+"\n"), nil
+	}
+
+	pr, pw := io.Pipe()
+	go writeMockStream(req.Context(), pw, augmentReq)
+
+	resp := mockResponse(req, http.StatusOK, "")
+	resp.Body = pr
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+// writeMockStream 按Augment的逐行JSON格式分块写出预置回复
+func writeMockStream(ctx context.Context, pw *io.PipeWriter, augmentReq AugmentRequest) {
+	message := []rune(augmentReq.Message)
+	if len(message) > 100 {
+		message = append(message[:100], []rune("...")...)
+	}
+
+	reply := fmt.Sprintf("这是来自模拟上游的回复。模式: %s，历史消息数: %d，收到的消息: %s",
+		augmentReq.Mode, len(augmentReq.ChatHistory), string(message))
+	words := strings.SplitAfter(reply, "，")
+	truncate := strings.Contains(augmentReq.Message, mockTriggerTruncate)
+	tool := strings.Contains(augmentReq.Message, mockTriggerTool)
+
+	for i, word := range words {
+		// 输出一半后模拟工具调用，之后的内容应被 STOP_ON_TOOL 丢弃
+		if tool && i == len(words)/2 {
+			line, _ := json.Marshal(AugmentResponse{Nodes: []Node{{
+				ID:   1,
+				Type: 5,
+				ToolUse: ToolUse{
+					ToolUseID: "toolu_mock",
+					ToolName:  "read_file",
+					InputJSON: `{"path":"README.md"}`,
+				},
+			}}})
+			if _, err := pw.Write(append(line, '\n')); err != nil {
+				return
+			}
+		}
+
+		// 输出一半后模拟上游连接中断
+		if truncate && i >= len(words)/2 && i > 0 {
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+			return
+		}
+
+		// 请求被取消时与真实连接一样中断
+		if err := ctx.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		line, _ := json.Marshal(AugmentResponse{Text: word})
+		if _, err := pw.Write(append(line, '\n')); err != nil {
+			return
+		}
+		time.Sleep(mockChunkDelay)
+	}
+
+	line, _ := json.Marshal(AugmentResponse{Done: true})
+	pw.Write(append(line, '\n'))
+	pw.Close()
+}
+
+// mockResponse 构建模拟响应
+func mockResponse(req *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
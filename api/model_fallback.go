@@ -0,0 +1,81 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	tokenmanager "augment2api/pkg/token"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// modelFallbackHeader 请求的模型换用备用模型时返回的响应头，值为 "原模型 -> 备用模型"
+const modelFallbackHeader = "X-Augment-Model-Fallback"
+
+var modelFallbacks = metrics.NewCounterVec("augment2api_model_fallbacks_total",
+	"Requests served by a fallback model because the requested mode had no available token.", "model")
+
+// modeForModel 根据模型名称后缀确定Augment请求模式，与请求转换时的规则一致
+func modeForModel(model string) string {
+	if strings.HasSuffix(strings.ToLower(model), "-agent") {
+		return "AGENT"
+	}
+	return "CHAT"
+}
+
+// parseModelFallbacks 解析 MODEL_FALLBACKS，格式为 原模型=备用模型，英文逗号分隔，原模型不区分大小写
+func parseModelFallbacks() map[string]string {
+	fallbacks := make(map[string]string)
+	for _, item := range strings.Split(config.AppConfig.ModelFallbacks, ",") {
+		model, fallback, ok := strings.Cut(strings.TrimSpace(item), "=")
+		model, fallback = strings.TrimSpace(model), strings.TrimSpace(fallback)
+		if !ok || model == "" || fallback == "" {
+			continue
+		}
+		fallbacks[strings.ToLower(model)] = fallback
+	}
+	return fallbacks
+}
+
+// resolveModel 请求模型对应的模式在请求所属分片中没有可用token时换用配置的备用模型，并通过响应头说明替换
+// 返回实际使用的模型，模式不可用且没有可用的备用模型时返回false
+func resolveModel(c *gin.Context, model string) (string, bool) {
+	if tokenmanager.ModeAvailable(modeForModel(model), c.GetString("token_shard")) {
+		return model, true
+	}
+
+	fallback, ok := parseModelFallbacks()[strings.ToLower(model)]
+	if !ok || !tokenmanager.ModeAvailable(modeForModel(fallback), c.GetString("token_shard")) {
+		return model, false
+	}
+
+	c.Set("requested_model", model)
+	c.Header(modelFallbackHeader, model+" -> "+fallback)
+	modelFallbacks.Inc(model)
+	logger.Log.WithFields(logrus.Fields{
+		"model":    model,
+		"fallback": fallback,
+	}).Info("请求模型的模式当前不可用，换用备用模型")
+	return fallback, true
+}
+
+// respondModelOverloaded 返回与OpenAI格式一致的模型过载错误
+func respondModelOverloaded(c *gin.Context, model string) {
+	c.Set("error_class", "model_overloaded")
+	if wait, ok := tokenmanager.RetryAfter(); ok {
+		c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": gin.H{
+			"message": "The model `" + model + "` is currently overloaded with other requests. You can retry your request later.",
+			"type":    "server_error",
+			"param":   nil,
+			"code":    "model_overloaded",
+		},
+	})
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// choiceResult 单个候选的生成结果
+type choiceResult struct {
+	text string
+	err  error
+}
+
+// maxCompletionChoices 返回n>1时允许扇出的最大候选数
+func maxCompletionChoices() int {
+	limit, err := strconv.Atoi(config.AppConfig.MaxCompletionChoices)
+	if err != nil || limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// handleMultiChoiceRequest 将n>1的请求扇出到多个token并行请求，合并为多个候选返回
+// 可用token不足时返回的候选数会少于n
+func handleMultiChoiceRequest(c *gin.Context, augmentReq AugmentRequest, req OpenAIRequest) {
+	defer cleanupRequestStatus(c)
+
+	n := req.N
+	if limit := maxCompletionChoices(); n > limit {
+		n = limit
+	}
+
+	token := c.GetString("token")
+	tenant := c.GetString("tenant_url")
+	sessionID := c.GetString("session_id")
+	if token == "" || tenant == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的请求"})
+		return
+	}
+
+	// 第一个候选使用当前请求占用的token，其余候选从池中另行获取，不使用冷却中的token，
+	// 没有空闲token时不再继续获取
+	leases := make([]*tokenmanager.TokenLease, 0, n-1)
+	used := map[string]bool{token: true}
+	for i := 1; i < n; i++ {
+		lease, ok := tokenmanager.AcquireSpareToken(augmentReq.Mode, c.GetString("token_shard"), used)
+		if !ok {
+			break
+		}
+		used[lease.Token] = true
+		leases = append(leases, lease)
+	}
+
+	if len(leases) < n-1 {
+		logger.Log.WithFields(logrus.Fields{
+			"requested": req.N,
+			"granted":   len(leases) + 1,
+		}).Info("可用token不足，减少候选数量")
+	}
+
+	// 客户端断开时取消所有候选请求
+	ctx := c.Request.Context()
+	results := make([]choiceResult, len(leases)+1)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		asyncIncrementTokenUsage(token, req.Model)
+		text, err := fetchAugmentText(ctx, token, tenant, sessionID, augmentReq)
+		results[0] = choiceResult{text: text, err: err}
+	}()
+
+	for i, lease := range leases {
+		wg.Add(1)
+		go func(i int, lease *tokenmanager.TokenLease) {
+			defer wg.Done()
+			defer lease.Release()
+			asyncIncrementTokenUsage(lease.Token, req.Model)
+			text, err := fetchAugmentText(ctx, lease.Token, lease.TenantURL, lease.SessionID, augmentReq)
+			if err != nil {
+				if ctx.Err() == nil {
+					tokenmanager.RecordGenerationFailure(lease.Token)
+				}
+			} else {
+				tokenmanager.ResetGenerationFailures(lease.Token)
+			}
+			results[i+1] = choiceResult{text: text, err: err}
+		}(i, lease)
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	var texts []string
+	for _, result := range results {
+		if result.err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": result.err.Error(),
+			}).Warn("候选请求失败")
+			continue
+		}
+		// 每个候选都是完整回复，与其他接口一样追加API密钥的说明
+		texts = append(texts, appendResponseFooter(c, result.text))
+	}
+
+	if len(texts) == 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "所有候选请求均失败"})
+		return
+	}
+
+	promptTokens := estimatePromptTokens(augmentReq)
+
+	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
+	finishReason := "stop"
+
+	if req.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+
+		for i, text := range texts {
+			for _, choice := range []StreamChoice{
+				{Index: i, Delta: ChatMessage{Role: "assistant", Content: text}},
+				{Index: i, Delta: ChatMessage{}, FinishReason: &finishReason},
+			} {
+				streamResp := OpenAIStreamResponse{
+					ID:      responseID,
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   req.Model,
+					Choices: []StreamChoice{choice},
+				}
+				jsonData, err := json.Marshal(streamResp)
+				if err != nil {
+					continue
+				}
+				c.Writer.Write([]byte("data: " + string(jsonData) + "\n\n"))
+			}
+			c.Writer.Flush()
+		}
+
+		writeOpenAIStreamDone(c, responseID, req.Model, strings.Join(texts, "\n"))
+		c.Writer.Flush()
+		return
+	}
+
+	choices := make([]Choice, 0, len(texts))
+	completionTokens := 0
+	for i, text := range texts {
+		completionTokens += estimateTokenCount(text)
+		choices = append(choices, Choice{
+			Index:        i,
+			Message:      ChatMessage{Role: "assistant", Content: text},
+			FinishReason: &finishReason,
+		})
+	}
+
+	c.JSON(http.StatusOK, OpenAIResponse{
+		ID:      responseID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: choices,
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	})
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"augment2api/config"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeDoc 路由的文档描述
+type routeDoc struct {
+	Summary string
+	Body    bool // 是否需要JSON请求体
+}
+
+// routeDocs 按 "METHOD 路径" 登记的路由描述，未登记的路由使用处理函数名作为摘要
+var routeDocs = map[string]routeDoc{
+	"GET /api/tokens":                  {Summary: "获取token列表，支持分页"},
+	"DELETE /api/token/:token":         {Summary: "删除指定token"},
+	"POST /api/token/:token/activate":  {Summary: "重新校验被禁用的token，需填写说明，校验通过后恢复可用", Body: true},
+	"PUT /api/token/:token/remark":     {Summary: "更新token备注", Body: true},
+	"PUT /api/token/:token/headers":    {Summary: "更新token自定义请求头", Body: true},
+	"PUT /api/token/:token/signer":     {Summary: "更新token使用的请求签名器", Body: true},
+	"GET /api/tokens/stream":           {Summary: "通过SSE订阅token状态变化"},
+	"GET /api/tokens/:token/history":   {Summary: "获取token最近的请求记录"},
+	"GET /api/tokens/:token/timeline":  {Summary: "按时间分桶汇总token的请求、冷却、禁用、检测和管理操作"},
+	"POST /api/tokens/retenant":        {Summary: "批量修改token的租户地址，可选先校验", Body: true},
+	"POST /api/tokens/dedupe":          {Summary: "检查token池中的重复token，dry_run=true 时只返回检查结果，否则提交后台任务禁用重复的token"},
+	"GET /api/tokens/dedupe/:id":       {Summary: "查询token去重任务的状态和结果"},
+	"GET /api/tokens/import/:id":       {Summary: "查询异步添加token任务的进度和每个token的检测结果"},
+	"GET /api/check-tokens":            {Summary: "批量检测token租户地址"},
+	"GET /api/pool/capacity":           {Summary: "获取token池容量统计"},
+	"GET /api/review/samples":          {Summary: "浏览输出质量抽样记录，可按模型、token和标签筛选"},
+	"GET /api/review/samples/:id":      {Summary: "获取单条抽样记录"},
+	"PUT /api/review/samples/:id/tags": {Summary: "设置抽样记录的标签和备注", Body: true},
+	"DELETE /api/review/samples/:id":   {Summary: "删除抽样记录"},
+	"GET /api/review/summary":          {Summary: "按模型和token汇总抽样记录的标签分布"},
+	"POST /api/pool/simulate":          {Summary: "按请求负载模拟token池的拒绝率、冷却情况和所需token数", Body: true},
+	"GET /api/probes/latency":          {Summary: "获取租户分片延迟探测结果"},
+	"GET /api/shards/concurrency":      {Summary: "获取本实例各上游分片的自适应并发上限和进行中的请求数"},
+	"GET /api/upstream/protocols":      {Summary: "获取上游HTTP/2配置和各租户分片协商的协议"},
+	"GET /api/startup-report":          {Summary: "获取启动时token池校验报告"},
+	"GET /api/migrations":              {Summary: "获取存储结构迁移状态"},
+	"POST /api/migrations/dry-run":     {Summary: "预演待应用的存储结构迁移，报告将要修改的key和字段，summary_only=true 时只返回汇总"},
+	"GET /api/keys":                    {Summary: "获取API密钥列表"},
+	"POST /api/keys":                   {Summary: "创建API密钥，可限制可用模型", Body: true},
+	"PUT /api/keys/:key":               {Summary: "更新API密钥的名称、可用模型和状态", Body: true},
+	"DELETE /api/keys/:key":            {Summary: "删除API密钥"},
+	"GET /api/audit":                   {Summary: "获取审计日志"},
+	"GET /api/leader":                  {Summary: "获取多实例选主状态"},
+	"GET /api/snapshots":               {Summary: "获取已保存的token池快照"},
+	"POST /api/snapshots":              {Summary: "保存当前token池状态的快照", Body: true},
+	"GET /api/snapshots/diff":          {Summary: "对比两次快照，to默认为当前状态"},
+	"GET /api/users/stats":             {Summary: "获取各终端用户的使用统计"},
+	"GET /api/stats/heatmap":           {Summary: "按小时和星期汇总最近的请求数，支持 days 和 tz 参数"},
+	"GET /api/latency/first-token":     {Summary: "获取各租户分片和token的首个分块延迟分位数及SLO状态"},
+	"GET /api/reservations":            {Summary: "获取计划任务额度预留及当前窗口的使用情况"},
+	"POST /api/reservations":           {Summary: "为API密钥在每天固定时段预留请求额度", Body: true},
+	"DELETE /api/reservations/:id":     {Summary: "删除额度预留"},
+	"PUT /api/users/:user/rate-limit":  {Summary: "设置终端用户每分钟请求数上限", Body: true},
+	"GET /api/maintenance":             {Summary: "查看维护模式状态、进行中的请求数和后台任务状态"},
+	"POST /api/maintenance":            {Summary: "开启或关闭维护模式，维护期间生成请求返回503，后台任务暂停", Body: true},
+	"POST /api/maintenance/cleanup":    {Summary: "归档并清理已删除或长期禁用token的关联数据"},
+	"GET /api/maintenance/archive":     {Summary: "获取已归档的token使用数据"},
+	"GET /api/requests/active":         {Summary: "列出本实例正在处理的请求"},
+	"DELETE /api/requests/active/:id":  {Summary: "取消进行中的请求并释放其占用的token"},
+	"GET /api/reports/rebalance":       {Summary: "获取最近的token池调整报告"},
+	"POST /api/reports/rebalance":      {Summary: "立即生成token池调整报告"},
+	"GET /api/debug/panics":            {Summary: "获取本实例最近的崩溃记录及请求上下文"},
+	"GET /api/debug/redis":             {Summary: "统计Redis各命名空间的键数量和估算内存，列出占用较多的键和慢操作"},
+	"POST /api/config/validate":        {Summary: "校验候选配置并返回与当前配置的差异，不会应用"},
+	"POST /api/token-links":            {Summary: "创建一次性、有过期时间的token提交链接", Body: true},
+	"DELETE /api/token-links/:id":      {Summary: "撤销尚未使用的token提交链接"},
+	"GET /submit-tokens":               {Summary: "通过签名链接提交token的页面"},
+	"POST /submit-tokens":              {Summary: "通过签名链接提交token，链接使用一次后失效", Body: true},
+	"GET /api/logging":                 {Summary: "获取各模块的日志级别和采样比例"},
+	"PUT /api/logging":                 {Summary: "运行时调整各模块的日志级别和采样比例", Body: true},
+	"GET /api/queue":                   {Summary: "获取请求队列状态和等待时间分位数"},
+	"PUT /api/queue":                   {Summary: "运行时调整请求队列长度和最长等待时间", Body: true},
+	"GET /metrics":                     {Summary: "Prometheus监控指标"},
+	"GET /healthz":                     {Summary: "健康检查，details 中返回Redis降级状态和token缓存"},
+	"GET /api/stats":                   {Summary: "所有实例汇总后的监控指标"},
+	"GET /api/version":                 {Summary: "获取构建版本、提交和启动时间"},
+	"GET /api/ui/version":              {Summary: "获取管理界面版本，页面据此判断升级后是否需要刷新"},
+	"GET /api/openapi.json":            {Summary: "获取OpenAPI规范"},
+	"POST /api/login":                  {Summary: "登录管理面板", Body: true},
+	"POST /api/logout":                 {Summary: "登出管理面板"},
+	"POST /api/add/tokens":             {Summary: "批量添加token，也可直接提交扩展状态或localStorage导出，async=true 时提交后台任务检测后启用", Body: true},
+	"POST /callback":                   {Summary: "处理授权回调", Body: true},
+	"GET /auth":                        {Summary: "获取授权地址"},
+	"GET /v1/models":                   {Summary: "获取模型列表"},
+	"GET /v1/capabilities":             {Summary: "获取当前部署支持的功能和限制"},
+	"POST /v1/chat/completions":        {Summary: "OpenAI兼容的聊天完成，设置 callback_url 时在后台执行并推送结果", Body: true},
+	"POST /v1":                         {Summary: "OpenAI兼容的聊天完成", Body: true},
+	"POST /v1/chat":                    {Summary: "OpenAI兼容的聊天完成", Body: true},
+	"POST /v1/messages":                {Summary: "Anthropic兼容的消息", Body: true},
+	"POST /v1/conversations/title":     {Summary: "根据对话开头的消息生成标题", Body: true},
+	"GET /v1/jobs/:id":                 {Summary: "查询带回调地址请求的执行状态"},
+	"GET /v1/requests/:id":             {Summary: "查询后台执行的聊天请求，wait 参数（如 30s，最长60秒）指定未完成时最多等待的时间"},
+	"POST /v1/tokens/contribution":     {Summary: "贡献自己的token，只供当前API密钥优先使用", Body: true},
+	"GET /v1/tokens/contribution":      {Summary: "查看当前API密钥贡献的token"},
+	"DELETE /v1/tokens/contribution":   {Summary: "撤回当前API密钥贡献的token"},
+	"GET /v1/key/system-prompt":        {Summary: "查看当前API密钥的默认系统提示词"},
+	"PUT /v1/key/system-prompt":        {Summary: "设置当前API密钥的默认系统提示词，请求没有系统提示词时自动使用", Body: true},
+	"DELETE /v1/key/system-prompt":     {Summary: "清除当前API密钥的默认系统提示词"},
+	"GET /v1/conversations/:id/export": {Summary: "导出对话记录，format 可选 openai、anthropic 或 markdown"},
+}
+
+// ginPathParam 匹配gin路由中的路径参数
+var ginPathParam = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// buildOpenAPISpec 根据已注册的路由生成OpenAPI 3规范
+func buildOpenAPISpec(routes gin.RoutesInfo) map[string]interface{} {
+	prefix := strings.TrimSuffix(config.AppConfig.RoutePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		// 静态资源和页面不属于API
+		if strings.HasPrefix(route.Path, "/static") || route.Method == "HEAD" {
+			continue
+		}
+
+		// 去掉自定义前缀后再查找描述
+		docPath := route.Path
+		if prefix != "" {
+			docPath = strings.TrimPrefix(docPath, prefix)
+		}
+		doc, ok := routeDocs[route.Method+" "+docPath]
+		if !ok {
+			if !strings.HasPrefix(docPath, "/api/") && !strings.HasPrefix(docPath, "/v1") {
+				continue
+			}
+			doc.Summary = route.Handler
+		}
+
+		tag := "admin"
+		security := []map[string][]string{{"sessionToken": {}}}
+		if strings.HasPrefix(docPath, "/v1") || docPath == "/api/add/tokens" {
+			tag = "v1"
+			security = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		operation := map[string]interface{}{
+			"summary":     doc.Summary,
+			"operationId": strings.ToLower(route.Method) + ginPathParam.ReplaceAllString(strings.ReplaceAll(route.Path, "/", "_"), "by_$1"),
+			"tags":        []string{tag},
+			"security":    security,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "成功"},
+			},
+		}
+
+		var params []map[string]interface{}
+		for _, match := range ginPathParam.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if doc.Body {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]string{"type": "object"},
+					},
+				},
+			}
+		}
+
+		openAPIPath := ginPathParam.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[openAPIPath].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[openAPIPath] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Augment2Api",
+			"version": config.Version,
+		},
+		"tags": []map[string]string{
+			{"name": "admin", "description": "管理接口，需要会话令牌"},
+			{"name": "v1", "description": "OpenAI/Anthropic兼容接口"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"sessionToken": map[string]string{"type": "apiKey", "in": "header", "name": "X-Auth-Token"},
+				"bearerAuth":   map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler 返回描述管理接口和v1接口的OpenAPI规范
+func OpenAPIHandler(engines ...*gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var routes gin.RoutesInfo
+		seen := make(map[*gin.Engine]bool)
+		for _, engine := range engines {
+			// 未拆分监听时API路由和管理路由是同一个engine
+			if seen[engine] {
+				continue
+			}
+			seen[engine] = true
+			routes = append(routes, engine.Routes()...)
+		}
+		c.JSON(http.StatusOK, buildOpenAPISpec(routes))
+	}
+}
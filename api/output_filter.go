@@ -0,0 +1,169 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// outputFilterHoldback 流式过滤时保留的尾部字节数，需不小于任一规则可能匹配的最大长度
+const outputFilterHoldback = 128
+
+// outputRule 输出过滤规则
+type outputRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// outputRules 已编译的输出过滤规则，为空表示未开启过滤
+var outputRules []outputRule
+
+// InitOutputFilter 根据配置编译输出过滤规则
+// 未配置人设名称时删除Augment的自我介绍，配置后将自称替换为人设名称
+func InitOutputFilter() error {
+	outputRules = nil
+	if config.AppConfig.OutputFilter != "true" {
+		return nil
+	}
+
+	persona := config.AppConfig.OutputPersona
+	introReplacement, introReplacementZh := "", ""
+	if persona != "" {
+		introReplacement = "I am " + persona + ". "
+		introReplacementZh = "我是" + persona + "。"
+	}
+
+	rules := []outputRule{
+		{
+			re:          regexp.MustCompile(`(?i)\bI(?:'m| am) Augment(?: Agent| Code| AI)?(?:,? (?:an? )?(?:agentic )?(?:AI )?(?:coding )?assistant)?(?:,? (?:developed|created|built|made) by Augment(?: Code)?)?[.!]?[ \t]*`),
+			replacement: introReplacement,
+		},
+		{
+			re:          regexp.MustCompile(`我是\s?Augment(?:\s?Agent|\s?Code)?(?:，|,)?(?:由\s?Augment(?:\s?Code)?\s?(?:开发|打造|创建)的)?(?:AI)?(?:编程|代码)?(?:助手|智能体)?[。！]?`),
+			replacement: introReplacementZh,
+		},
+	}
+	if persona != "" {
+		rules = append(rules, outputRule{
+			re:          regexp.MustCompile(`\bAugment (?:Agent|Code|AI)\b`),
+			replacement: persona,
+		})
+	}
+
+	// 额外需要删除的短语，英文逗号分隔
+	for _, phrase := range strings.Split(config.AppConfig.OutputFilterPhrases, ",") {
+		phrase = strings.TrimSpace(phrase)
+		if phrase == "" {
+			continue
+		}
+		if len(phrase) > outputFilterHoldback {
+			return fmt.Errorf("过滤短语过长(最多%d字节): %s", outputFilterHoldback, phrase)
+		}
+		rules = append(rules, outputRule{re: regexp.MustCompile(regexp.QuoteMeta(phrase))})
+	}
+
+	outputRules = rules
+
+	logger.Log.WithFields(logrus.Fields{
+		"rules":   len(rules),
+		"persona": persona,
+	}).Info("输出过滤规则加载完成")
+	return nil
+}
+
+// filterOutputText 对完整文本应用输出过滤
+func filterOutputText(text string) string {
+	for _, rule := range outputRules {
+		text = rule.re.ReplaceAllLiteralString(text, rule.replacement)
+	}
+	return text
+}
+
+// outputFilter 流式输出转换，依次执行过滤规则和追加API密钥的回复末尾说明，
+// 过滤时缓存可能跨分块的尾部内容
+type outputFilter struct {
+	pending string
+	footer  string // 尚未输出的回复末尾说明
+	written bool   // 已输出过正文
+}
+
+// newOutputFilter 创建流式输出转换，未开启过滤且API密钥没有配置回复末尾说明时返回nil
+func newOutputFilter(c *gin.Context) *outputFilter {
+	footer := keyResponseFooter(c)
+	if len(outputRules) == 0 && footer == "" {
+		return nil
+	}
+	return &outputFilter{footer: footer}
+}
+
+// Push 输入新的分块，返回可以安全输出的已过滤内容
+func (f *outputFilter) Push(text string) string {
+	if f == nil {
+		return text
+	}
+	if text != "" {
+		f.written = true
+	}
+	if len(outputRules) == 0 {
+		return text
+	}
+
+	buffer := f.pending + text
+	cut := len(buffer) - outputFilterHoldback
+	if cut <= 0 {
+		f.pending = buffer
+		return ""
+	}
+
+	// 不能从规则匹配的中间切开
+	for _, rule := range outputRules {
+		for _, loc := range rule.re.FindAllStringIndex(buffer, -1) {
+			if loc[0] < cut && loc[1] > cut {
+				cut = loc[0]
+			}
+		}
+	}
+	for cut > 0 && !utf8.RuneStart(buffer[cut]) {
+		cut--
+	}
+
+	f.pending = buffer[cut:]
+	return filterOutputText(buffer[:cut])
+}
+
+// Flush 输出剩余的缓冲内容
+func (f *outputFilter) Flush() string {
+	if f == nil {
+		return ""
+	}
+	text := filterOutputText(f.pending)
+	f.pending = ""
+	return text
+}
+
+// Footer 回复结束时输出的末尾说明，只输出一次，没有输出过正文时不输出
+func (f *outputFilter) Footer() string {
+	if f == nil || f.footer == "" || !f.written {
+		return ""
+	}
+	footer := "\n\n" + f.footer
+	f.footer = ""
+	return footer
+}
+
+// Apply 转换单个响应分块，完成时一并输出缓冲内容和回复末尾说明
+func (f *outputFilter) Apply(augmentResp *AugmentResponse) {
+	if f == nil {
+		return
+	}
+	augmentResp.Text = f.Push(augmentResp.Text)
+	if augmentResp.Done {
+		augmentResp.Text += f.Flush() + f.Footer()
+	}
+}
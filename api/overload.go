@@ -0,0 +1,93 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// statusOverloaded 上游过载时返回的状态码，与Anthropic接口一致
+const statusOverloaded = 529
+
+// maxOverloadBodyBytes 判断是否过载时最多读取的响应体字节数
+const maxOverloadBodyBytes = 64 << 10
+
+// isOverloadedResponse 判断上游响应是否为过载，529或响应体中带有 overloaded 的503
+func isOverloadedResponse(statusCode int, body []byte) bool {
+	if statusCode == statusOverloaded {
+		return true
+	}
+	return statusCode == http.StatusServiceUnavailable && bytes.Contains(bytes.ToLower(body), []byte("overloaded"))
+}
+
+// detectUpstreamOverload 检查上游是否返回过载，过载时让所在分片退避并标记本次请求，
+// 与429不同，过载只影响分片而不冷却token，重试时会优先选择其他分片的token
+func detectUpstreamOverload(c *gin.Context, req *http.Request, resp *http.Response) {
+	if resp.StatusCode != statusOverloaded && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+
+	// 读取响应体后放回，调用方仍按原逻辑读取错误信息
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOverloadBodyBytes))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil || !isOverloadedResponse(resp.StatusCode, body) {
+		return
+	}
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	backoff := tokenmanager.RecordShardOverload(req.URL.Host, retryAfter)
+	c.Set("upstream_overloaded", true)
+	c.Set("overload_backoff", backoff)
+
+	logger.Log.WithFields(logrus.Fields{
+		"shard":   req.URL.Host,
+		"status":  resp.StatusCode,
+		"token":   tokenFingerprint(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")),
+		"backoff": backoff.String(),
+	}).Warn("上游分片过载")
+}
+
+// respondUpstreamOverloaded 重试后上游仍然过载时，按调用方使用的接口格式返回过载错误
+// Anthropic客户端收到529和 overloaded_error，可按其SDK的过载策略自行重试
+func respondUpstreamOverloaded(c *gin.Context) {
+	c.Set("error_class", "upstream_overloaded")
+	if backoff, ok := c.Get("overload_backoff"); ok {
+		if wait, ok := backoff.(time.Duration); ok {
+			c.Header("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+		}
+	}
+
+	if isAnthropicRoute(c) {
+		c.JSON(statusOverloaded, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "overloaded_error",
+				"message": "Overloaded",
+			},
+		})
+		return
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": gin.H{
+			"message": "The upstream service is currently overloaded. Please retry your request later.",
+			"type":    "server_error",
+			"param":   nil,
+			"code":    "overloaded",
+		},
+	})
+}
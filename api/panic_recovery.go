@@ -0,0 +1,241 @@
+package api
+
+import (
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPanicRecords 崩溃记录环形缓冲区的容量
+const maxPanicRecords = 100
+
+// PanicRecord 一次请求处理中发生的panic及其请求上下文，敏感信息已脱敏
+type PanicRecord struct {
+	ID        string                 `json:"id"`
+	Time      time.Time              `json:"time"`
+	Instance  string                 `json:"instance"`
+	Method    string                 `json:"method"`
+	Path      string                 `json:"path"`
+	Query     map[string]string      `json:"query,omitempty"`
+	Headers   map[string]string      `json:"headers,omitempty"`
+	APIKey    string                 `json:"api_key,omitempty"`
+	Token     string                 `json:"token,omitempty"` // token指纹
+	Model     string                 `json:"model,omitempty"`
+	Mode      string                 `json:"mode,omitempty"`
+	Payload   map[string]interface{} `json:"payload,omitempty"` // 请求体摘要，不含消息内容
+	ElapsedMs int64                  `json:"elapsed_ms"`
+	Error     string                 `json:"error"`
+	Stack     string                 `json:"stack"`
+}
+
+var (
+	panicRecords      []PanicRecord
+	panicRecordsNext  int
+	panicRecordsGuard sync.Mutex
+
+	panicsTotal = metrics.NewCounterVec("augment2api_panics_total",
+		"Panics recovered while handling requests, by route.", "route")
+)
+
+// PanicRecoveryMiddleware 捕获请求处理中的panic，记录请求上下文和调用栈，
+// 释放请求占用的token并按调用方使用的接口格式返回500
+func PanicRecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			// 客户端断开连接导致的写入失败交给上层处理
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+
+			record := newPanicRecord(c, r, start)
+			storePanicRecord(record)
+			panicsTotal.Inc(c.FullPath())
+			logger.Log.WithFields(logrus.Fields{
+				"panic_id": record.ID,
+				"path":     record.Path,
+				"token":    record.Token,
+				"model":    record.Model,
+				"error":    record.Error,
+				"stack":    record.Stack,
+			}).Error("处理请求时发生panic")
+
+			c.Set("error_class", "panic")
+			cleanupRequestStatus(c)
+			respondPanic(c, record.ID)
+		}()
+		c.Next()
+	}
+}
+
+// newPanicRecord 收集panic发生时的请求上下文
+func newPanicRecord(c *gin.Context, r interface{}, start time.Time) PanicRecord {
+	record := PanicRecord{
+		ID:        uuid.New().String(),
+		Time:      time.Now(),
+		Instance:  leader.InstanceID(),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Query:     sanitizeValues(c.Request.URL.Query()),
+		Headers:   sanitizeValues(c.Request.Header),
+		Model:     c.GetString("model"),
+		Mode:      c.GetString("augment_mode"),
+		ElapsedMs: time.Since(start).Milliseconds(),
+		Error:     fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+	}
+	if key := c.GetString("api_key"); key != "" {
+		record.APIKey = apikey.Mask(key)
+	}
+	if token := c.GetString("token"); token != "" {
+		record.Token = tokenFingerprint(token)
+	}
+	if summary, ok := c.Get("request_summary"); ok {
+		record.Payload, _ = summary.(map[string]interface{})
+	}
+	return record
+}
+
+// isSensitiveName 请求头或查询参数名是否可能包含凭据
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "token", "key", "secret", "cookie", "password", "pwd"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeValues 将请求头或查询参数转为单值映射，可能包含凭据的值替换为占位符
+func sanitizeValues(values map[string][]string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(values))
+	for name, items := range values {
+		if isSensitiveName(name) {
+			result[name] = "[redacted]"
+			continue
+		}
+		result[name] = truncateRunes(strings.Join(items, ", "), 200)
+	}
+	return result
+}
+
+// summarizeRequest 生成请求体摘要，只保留模型、参数和消息角色，不记录消息内容
+func summarizeRequest(parsed interface{}) map[string]interface{} {
+	var model string
+	var stream bool
+	var maxTokens int
+	var messages []ChatMessage
+	switch req := parsed.(type) {
+	case *OpenAIRequest:
+		model, stream, maxTokens, messages = req.Model, req.Stream, req.MaxTokens, req.Messages
+	case *AnthropicRequest:
+		model, stream, maxTokens, messages = req.Model, req.Stream, req.MaxTokens, req.Messages
+	default:
+		return nil
+	}
+
+	roles := make([]string, len(messages))
+	for i, message := range messages {
+		roles[i] = message.Role
+	}
+	return map[string]interface{}{
+		"model":      model,
+		"stream":     stream,
+		"max_tokens": maxTokens,
+		"messages":   len(messages),
+		"roles":      roles,
+	}
+}
+
+// storePanicRecord 写入崩溃记录，超出容量时覆盖最早的记录
+func storePanicRecord(record PanicRecord) {
+	panicRecordsGuard.Lock()
+	defer panicRecordsGuard.Unlock()
+	if len(panicRecords) < maxPanicRecords {
+		panicRecords = append(panicRecords, record)
+		return
+	}
+	panicRecords[panicRecordsNext] = record
+	panicRecordsNext = (panicRecordsNext + 1) % maxPanicRecords
+}
+
+// recentPanicRecords 按时间倒序返回最近的崩溃记录
+func recentPanicRecords(limit int) []PanicRecord {
+	panicRecordsGuard.Lock()
+	defer panicRecordsGuard.Unlock()
+	result := make([]PanicRecord, 0, min(limit, len(panicRecords)))
+	for i := 0; i < len(panicRecords) && len(result) < limit; i++ {
+		index := (panicRecordsNext - 1 - i + 2*len(panicRecords)) % len(panicRecords)
+		result = append(result, panicRecords[index])
+	}
+	return result
+}
+
+// respondPanic 按调用方使用的接口格式返回500，已开始输出响应时只能中断连接
+func respondPanic(c *gin.Context, id string) {
+	if c.Writer.Written() {
+		c.Abort()
+		return
+	}
+
+	// 按路由模板判断接口格式，配置了 ROUTE_PREFIX 时同样适用
+	switch {
+	case isAnthropicRoute(c):
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "api_error",
+				"message": "The server had an error while processing your request. Reference: " + id,
+			},
+		})
+	case strings.Contains(c.FullPath(), "/v1/"):
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": gin.H{
+				"message": "The server had an error while processing your request. Reference: " + id,
+				"type":    "server_error",
+				"param":   nil,
+				"code":    "internal_error",
+			},
+		})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "服务器内部错误，记录编号: " + id,
+		})
+	}
+}
+
+// PanicRecordsHandler 获取本实例最近的崩溃记录
+func PanicRecordsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	limit = min(limit, maxPanicRecords)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"instance": leader.InstanceID(),
+		"panics":   recentPanicRecords(limit),
+	})
+}
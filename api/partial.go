@@ -0,0 +1,52 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// partialFinishReason 上游中断时部分响应使用的finish_reason，可配置为 length 或 error
+func partialFinishReason() string {
+	if config.AppConfig.PartialFinishReason == "error" {
+		return "error"
+	}
+	return "length"
+}
+
+// markPartialResponse 标记当前请求只收到了部分内容，并记录中断位置
+func markPartialResponse(c *gin.Context, model string, received string, err error) {
+	c.Set("partial_response", true)
+	c.Set("error_class", "truncated")
+
+	logger.Log.WithFields(logrus.Fields{
+		"model":           model,
+		"received_chars":  len([]rune(received)),
+		"received_tokens": estimateTokenCount(received),
+		"error":           err.Error(),
+	}).Warn("上游响应中断，返回已接收的部分内容")
+}
+
+// responseFinishReason 返回OpenAI格式的完成原因
+func responseFinishReason(c *gin.Context) string {
+	if c.GetBool("partial_response") {
+		return partialFinishReason()
+	}
+	return "stop"
+}
+
+// responseStopReason 返回Anthropic格式的停止原因
+func responseStopReason(c *gin.Context) string {
+	if c.GetString("stop_sequence") != "" {
+		return "stop_sequence"
+	}
+	if !c.GetBool("partial_response") {
+		return "end_turn"
+	}
+	if partialFinishReason() == "error" {
+		return "error"
+	}
+	return "max_tokens"
+}
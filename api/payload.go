@@ -0,0 +1,97 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/metrics"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	runtimemetrics "runtime/metrics"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heapObjectsMetric 运行时堆对象占用的内存，读取时不会暂停程序
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+var (
+	requestBodyBytes = metrics.NewSummary("augment2api_request_body_bytes",
+		"Size of decoded client request bodies.", 500, 0.5, 0.9, 0.99)
+	augmentPayloadBytes = metrics.NewSummary("augment2api_augment_payload_bytes",
+		"Size of encoded payloads sent to Augment.", 500, 0.5, 0.9, 0.99)
+	_ = metrics.NewGaugeFunc("augment2api_heap_objects_bytes",
+		"Heap memory occupied by live and not yet swept objects.", heapObjectsBytes)
+)
+
+// errRequestBodyTooLarge 请求体超过配置的上限
+var errRequestBodyTooLarge = errors.New("请求体过大")
+
+// heapObjectsBytes 读取当前堆对象占用的内存
+func heapObjectsBytes() float64 {
+	sample := []runtimemetrics.Sample{{Name: heapObjectsMetric}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return float64(sample[0].Value.Uint64())
+}
+
+// maxRequestBodyBytes 请求体大小上限，0表示不限制
+func maxRequestBodyBytes() int64 {
+	mb, err := strconv.ParseInt(config.AppConfig.MaxRequestBodyMB, 10, 64)
+	if err != nil || mb < 0 {
+		return 100 << 20
+	}
+	return mb << 20
+}
+
+// countingReader 统计已读取的字节数
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// decodeRequestBody 流式解析请求体，支持分块传输，不先将整个请求体读入内存
+func decodeRequestBody(c *gin.Context, v interface{}) error {
+	body := c.Request.Body
+	if limit := maxRequestBodyBytes(); limit > 0 {
+		body = http.MaxBytesReader(c.Writer, body, limit)
+	}
+	counter := &countingReader{reader: body}
+
+	err := json.NewDecoder(counter).Decode(v)
+	requestBodyBytes.Observe(float64(counter.n))
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errRequestBodyTooLarge
+	}
+	return err
+}
+
+// respondDecodeError 返回请求体解析失败的错误
+func respondDecodeError(c *gin.Context, err error) {
+	if errors.Is(err, errRequestBodyTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "请求体过大，上限为 " + config.AppConfig.MaxRequestBodyMB + "MB"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+}
+
+// marshalAugmentPayload 序列化发往Augment的请求并记录大小
+func marshalAugmentPayload(augmentReq AugmentRequest) ([]byte, error) {
+	payload, err := json.Marshal(augmentReq)
+	if err != nil {
+		return nil, err
+	}
+	augmentPayloadBytes.Observe(float64(len(payload)))
+	return payload, nil
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"augment2api/config"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PoolCapacity token池容量统计
+type PoolCapacity struct {
+	Total               int       `json:"total"`                 // token总数
+	Active              int       `json:"active"`                // 可用token数（未禁用且不在冷却中）
+	Cooling             int       `json:"cooling"`               // 冷却中的token数
+	Disabled            int       `json:"disabled"`              // 已禁用的token数
+	InFlight            int       `json:"in_flight"`             // 当前正在处理请求的token数
+	RemainingChatUsage  int       `json:"remaining_chat_usage"`  // 预估剩余CHAT请求次数
+	RemainingAgentUsage int       `json:"remaining_agent_usage"` // 预估剩余AGENT请求次数
+	ChatAvailable       int       `json:"chat_available"`        // 当前可以处理CHAT请求的token数
+	AgentAvailable      int       `json:"agent_available"`       // 当前可以处理AGENT请求的token数
+	GeneratedAt         time.Time `json:"generated_at"`
+}
+
+// computePoolCapacity 遍历所有token计算池容量
+func computePoolCapacity() (PoolCapacity, error) {
+	capacity := PoolCapacity{GeneratedAt: time.Now()}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return capacity, err
+	}
+
+	for _, key := range keys {
+		token := key[6:] // 去掉前缀 "token:"
+		capacity.Total++
+
+		status, err := config.RedisHGet(key, "status")
+		if err == nil && status == "disabled" {
+			capacity.Disabled++
+			continue
+		}
+
+		if requestStatus, err := tokenmanager.GetTokenRequestStatus(token); err == nil && requestStatus.InProgress {
+			capacity.InFlight++
+		}
+
+		coolStatus, _ := tokenmanager.GetTokenCoolStatus(token)
+		if coolStatus.InCool {
+			capacity.Cooling++
+		} else {
+			capacity.Active++
+			// 两种模式的次数分别计算，一种模式用完的token仍计入另一种模式
+			remark, _ := config.RedisHGet(key, "remark")
+			modes := tokenmanager.GetModeAvailability(token, remark)
+			if modes.Chat {
+				capacity.ChatAvailable++
+			}
+			if modes.Agent {
+				capacity.AgentAvailable++
+			}
+		}
+
+		// 冷却中的token在冷却结束后仍可使用，计入剩余次数
+		if remaining := tokenmanager.ChatUsageLimit - getTokenChatUsageCount(token); remaining > 0 {
+			capacity.RemainingChatUsage += remaining
+		}
+		if remaining := tokenmanager.AgentUsageLimit - getTokenAgentUsageCount(token); remaining > 0 {
+			capacity.RemainingAgentUsage += remaining
+		}
+	}
+
+	return capacity, nil
+}
+
+// PoolCapacityHandler 返回token池容量统计，供外部扩缩容和告警系统使用
+func PoolCapacityHandler(c *gin.Context) {
+	capacity, err := computePoolCapacity()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token列表失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"capacity": capacity,
+	})
+}
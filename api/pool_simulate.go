@@ -0,0 +1,170 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/queue"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultSimulationDuration 默认模拟时长
+	defaultSimulationDuration = time.Hour
+	// maxSimulationDuration 最长模拟时长
+	maxSimulationDuration = 7 * 24 * time.Hour
+	// maxSimulationWork 单次模拟的请求数与token数乘积的上限，避免长时间占用CPU
+	maxSimulationWork = 2e8
+	// defaultSimChatLatency 没有请求记录时CHAT请求的假定耗时
+	defaultSimChatLatency = 10 * time.Second
+	// defaultSimAgentLatency 没有请求记录时AGENT请求的假定耗时
+	defaultSimAgentLatency = 30 * time.Second
+)
+
+// PoolSimulationRequest 容量模拟的负载参数，未填写的耗时和拦截率按token池最近的请求记录估算
+type PoolSimulationRequest struct {
+	RPS              float64  `json:"rps"`
+	AgentRatio       float64  `json:"agent_ratio"`
+	DurationSeconds  int      `json:"duration_seconds"`
+	ChatLatencyMs    int      `json:"chat_latency_ms"`
+	AgentLatencyMs   int      `json:"agent_latency_ms"`
+	BlockRate        *float64 `json:"block_rate"`
+	Tokens           int      `json:"tokens"` // 大于0时使用指定数量的新token代替当前token池
+	Shard            string   `json:"shard"`
+	QueueLength      *int     `json:"queue_length"`
+	QueueWaitSeconds *int     `json:"queue_wait_seconds"`
+	Seed             int64    `json:"seed"`
+}
+
+// simulationPool 读取分片中参与调度的token的当前状态，已禁用和调用方贡献的token不计入
+func simulationPool(shard string) ([]tokenmanager.SimulatedToken, []string, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pool []tokenmanager.SimulatedToken
+	var tokens []string
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || fields["status"] == "disabled" || tokenmanager.IsContributed(fields) {
+			continue
+		}
+		if tokenmanager.ParseTokenHints(fields["remark"]).Shard != shard {
+			continue
+		}
+		token := key[6:] // 去掉前缀 "token:"
+		modes := tokenmanager.GetModeAvailability(token, fields["remark"])
+		simulated := tokenmanager.SimulatedToken{
+			Chat:      modes.Chat,
+			Agent:     modes.Agent,
+			ChatUsed:  getTokenChatUsageCount(token),
+			AgentUsed: getTokenAgentUsageCount(token),
+		}
+		if coolStatus, err := tokenmanager.GetTokenCoolStatus(token); err == nil && coolStatus.InCool {
+			simulated.CoolFor = time.Until(coolStatus.CoolEnd)
+		}
+		pool = append(pool, simulated)
+		tokens = append(tokens, token)
+	}
+	return pool, tokens, nil
+}
+
+// SimulatePoolHandler 按给定的请求负载模拟当前token池的调度，估算拒绝率、排队时间、冷却情况和所需token数
+// 模拟只在内存中进行，不会发送上游请求或修改token状态
+func SimulatePoolHandler(c *gin.Context) {
+	var req PoolSimulationRequest
+	if err := decodeRequestBody(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+	if req.RPS <= 0 || req.AgentRatio < 0 || req.AgentRatio > 1 || req.Tokens < 0 ||
+		(req.BlockRate != nil && (*req.BlockRate < 0 || *req.BlockRate > 1)) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "rps 应大于0，agent_ratio 和 block_rate 应在0到1之间，tokens 不能为负数",
+		})
+		return
+	}
+
+	duration := defaultSimulationDuration
+	if req.DurationSeconds > 0 {
+		duration = min(time.Duration(req.DurationSeconds)*time.Second, maxSimulationDuration)
+	}
+
+	pool, tokens, err := simulationPool(tokenmanager.NormalizeShard(req.Shard))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token列表失败: " + err.Error(),
+		})
+		return
+	}
+	chatLatency, agentLatency, refusalRate := tokenmanager.ObservedProfile(tokens)
+	if req.Tokens > 0 {
+		pool = make([]tokenmanager.SimulatedToken, req.Tokens)
+		for i := range pool {
+			pool[i] = tokenmanager.SimulatedToken{Chat: true, Agent: true}
+		}
+	}
+	if req.RPS*duration.Seconds()*float64(max(len(pool), 1)) > maxSimulationWork {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "模拟规模过大，请缩短 duration_seconds 或降低 rps",
+		})
+		return
+	}
+
+	profile := tokenmanager.SimulationProfile{
+		RPS:          req.RPS,
+		AgentRatio:   req.AgentRatio,
+		Duration:     duration,
+		ChatLatency:  chatLatency,
+		AgentLatency: agentLatency,
+		BlockRate:    refusalRate,
+		Seed:         req.Seed,
+	}
+	if req.ChatLatencyMs > 0 {
+		profile.ChatLatency = time.Duration(req.ChatLatencyMs) * time.Millisecond
+	} else if profile.ChatLatency == 0 {
+		profile.ChatLatency = defaultSimChatLatency
+	}
+	if req.AgentLatencyMs > 0 {
+		profile.AgentLatency = time.Duration(req.AgentLatencyMs) * time.Millisecond
+	} else if profile.AgentLatency == 0 {
+		profile.AgentLatency = defaultSimAgentLatency
+	}
+	if req.BlockRate != nil {
+		profile.BlockRate = *req.BlockRate
+	}
+	profile.QueueLength, profile.QueueWait = queue.Limits()
+	if req.QueueLength != nil {
+		profile.QueueLength = max(*req.QueueLength, 0)
+	}
+	if req.QueueWaitSeconds != nil {
+		profile.QueueWait = time.Duration(max(*req.QueueWaitSeconds, 0)) * time.Second
+	}
+
+	result := tokenmanager.SimulatePool(pool, profile)
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"profile": gin.H{
+			"rps":                profile.RPS,
+			"agent_ratio":        profile.AgentRatio,
+			"duration_seconds":   int64(profile.Duration.Seconds()),
+			"chat_latency_ms":    profile.ChatLatency.Milliseconds(),
+			"agent_latency_ms":   profile.AgentLatency.Milliseconds(),
+			"block_rate":         profile.BlockRate,
+			"queue_length":       profile.QueueLength,
+			"queue_wait_seconds": int64(profile.QueueWait.Seconds()),
+			"current_pool":       req.Tokens == 0,
+			"seed":               profile.Seed,
+		},
+		"result": result,
+	})
+}
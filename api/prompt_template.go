@@ -0,0 +1,80 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/convert"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templatePlaceholder 模板中的占位符，例如 {{current_date}}
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// countryHeaders CDN或反向代理写入的客户端国家代码请求头，按顺序取第一个非空值
+var countryHeaders = []string{
+	"CF-IPCountry",
+	"CloudFront-Viewer-Country",
+	"X-Vercel-IP-Country",
+	"X-Country-Code",
+}
+
+// templateVars 模板占位符的取值
+type templateVars map[string]string
+
+// newTemplateVars 根据当前请求生成占位符取值，时间使用服务器时区
+func newTemplateVars(c *gin.Context, model string) templateVars {
+	return templateVarsFor(model, clientIPCountry(c))
+}
+
+// templateVarsFor 生成占位符取值，用于不在请求上下文中执行的后台请求
+func templateVarsFor(model, country string) templateVars {
+	now := time.Now()
+	return templateVars{
+		"current_date":      now.Format("2006-01-02"),
+		"current_time":      now.Format("15:04"),
+		"weekday":           now.Weekday().String(),
+		"model":             model,
+		"client_ip_country": country,
+	}
+}
+
+// clientIPCountry 从CDN请求头中读取客户端所在国家，没有部署在CDN之后时为空
+func clientIPCountry(c *gin.Context) string {
+	for _, header := range countryHeaders {
+		country := strings.TrimSpace(c.GetHeader(header))
+		// Cloudflare 对无法识别的地址返回 XX，对Tor出口返回 T1
+		if country != "" && country != "XX" && country != "T1" {
+			return strings.ToUpper(country)
+		}
+	}
+	return ""
+}
+
+// expand 展开文本中的占位符，未知的占位符保持原样
+func (v templateVars) expand(text string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(text, func(match string) string {
+		name := templatePlaceholder.FindStringSubmatch(match)[1]
+		if value, ok := v[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// applyPromptTemplates 使用配置的模板替换默认的前缀和指南，模板在每次请求时展开
+// 客户端的系统提示词仍放在指南之前
+func applyPromptTemplates(augmentReq *AugmentRequest, vars templateVars) {
+	if config.AppConfig.PrefixTemplate != "" {
+		augmentReq.Prefix = vars.expand(config.AppConfig.PrefixTemplate)
+	}
+	if config.AppConfig.GuidelinesTemplate != "" {
+		augmentReq.CustomGuidelines = vars.expand(config.AppConfig.GuidelinesTemplate)
+		augmentReq.UserGuideLines = convert.WithSystemPrompt(augmentReq.SystemPrompt, augmentReq.CustomGuidelines)
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"augment2api/pkg/audit"
+	"augment2api/pkg/queue"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueueSettingsRequest 调整请求队列参数的请求
+type QueueSettingsRequest struct {
+	MaxLength      *int `json:"max_length"`
+	MaxWaitSeconds *int `json:"max_wait_seconds"`
+}
+
+// QueueStatusHandler 获取请求队列状态，包括本实例的排队状态和共享队列状态
+func QueueStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"queue":   queue.GetStats(),
+		"cluster": clusterQueueStatus(),
+	})
+}
+
+// UpdateQueueSettingsHandler 运行时调整请求队列长度和最长等待时间，仅对当前实例生效
+func UpdateQueueSettingsHandler(c *gin.Context) {
+	var req QueueSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	length, wait := queue.Limits()
+	if req.MaxLength != nil {
+		if *req.MaxLength < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "max_length 不能小于0",
+			})
+			return
+		}
+		length = *req.MaxLength
+	}
+	if req.MaxWaitSeconds != nil {
+		if *req.MaxWaitSeconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "max_wait_seconds 必须大于0",
+			})
+			return
+		}
+		wait = time.Duration(*req.MaxWaitSeconds) * time.Second
+	}
+	queue.SetLimits(length, wait)
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "queue_settings_updated",
+		Detail: map[string]interface{}{"max_length": length, "max_wait_seconds": wait.Seconds()},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"queue":  queue.GetStats(),
+	})
+}
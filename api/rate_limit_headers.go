@@ -0,0 +1,106 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"augment2api/pkg/userstats"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	rateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// rateLimit 返回给调用方的一项配额
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Duration // 距离配额恢复的时间
+}
+
+// rateLimitHeadersEnabled 是否返回配额提示，未连接Redis时无法统计
+func rateLimitHeadersEnabled() bool {
+	return config.AppConfig.RateLimitHeaders == "true" && config.RDB != nil
+}
+
+// RateLimitHeadersMiddleware 记录API密钥本分钟的请求数，并在响应中返回配额提示，
+// 客户端可据此提前降低请求频率；配额用完时只提示，不拒绝请求
+func RateLimitHeadersMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rateLimitHeadersEnabled() {
+			countKeyRequest(c)
+			writeRateLimitHeaders(c)
+		}
+		c.Next()
+	}
+}
+
+// countKeyRequest 记录设置了每分钟配额的API密钥的一次请求
+func countKeyRequest(c *gin.Context) {
+	key := currentAPIKey(c)
+	if key == nil || key.RateLimit <= 0 {
+		return
+	}
+	count, err := apikey.CountRequest(key.Key)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"key":   apikey.Mask(key.Key),
+			"error": err.Error(),
+		}).Warn("记录API密钥请求数失败")
+		return
+	}
+	c.Set("key_request_count", count)
+}
+
+// currentRateLimit 当前请求的配额：API密钥的每分钟配额和token池中该模式的剩余次数，取剩余较少的一项；
+// 请求模式未确定时按CHAT模式计算，都没有配额时返回false
+func currentRateLimit(c *gin.Context) (rateLimit, bool) {
+	var limit rateLimit
+	found := false
+	if key := currentAPIKey(c); key != nil && key.RateLimit > 0 {
+		limit = rateLimit{
+			Limit:     key.RateLimit,
+			Remaining: max(key.RateLimit-int(c.GetInt64("key_request_count")), 0),
+			Reset:     userstats.RetryAfter(),
+		}
+		found = true
+	}
+
+	mode := c.GetString("augment_mode")
+	if mode == "" {
+		mode = "CHAT"
+	}
+	poolLimit, poolRemaining := tokenmanager.ModeQuota(mode, c.GetString("token_shard"))
+	if poolLimit > 0 && (!found || poolRemaining < limit.Remaining) {
+		now := time.Now()
+		limit = rateLimit{
+			Limit:     poolLimit,
+			Remaining: poolRemaining,
+			Reset:     nextTokenUsageReset(now).Sub(now),
+		}
+		found = true
+	}
+	return limit, found
+}
+
+// writeRateLimitHeaders 设置 X-RateLimit-* 响应头，重置时间沿用OpenAI的格式，如 "1s"、"6m0s"
+func writeRateLimitHeaders(c *gin.Context) {
+	if !rateLimitHeadersEnabled() {
+		return
+	}
+	limit, ok := currentRateLimit(c)
+	if !ok {
+		return
+	}
+	c.Header(rateLimitLimitHeader, strconv.Itoa(limit.Limit))
+	c.Header(rateLimitRemainingHeader, strconv.Itoa(limit.Remaining))
+	c.Header(rateLimitResetHeader, max(limit.Reset.Round(time.Second), time.Second).String())
+}
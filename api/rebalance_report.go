@@ -0,0 +1,515 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rebalanceReportsKey 已生成的池调整报告列表，最新的在最前
+	rebalanceReportsKey = "rebalance_reports"
+	// rebalanceReportsKept 保留的报告数量
+	rebalanceReportsKept = 12
+	// rebalanceReportDays 报告统计的天数
+	rebalanceReportDays = 7
+	// rebalanceWebhookJobType 推送报告的后台任务
+	rebalanceWebhookJobType = "rebalance_report_webhook"
+)
+
+// UsageSkew 一种模式下各token使用次数的分布
+type UsageSkew struct {
+	Mean       float64  `json:"mean"`
+	StdDev     float64  `json:"stddev"`
+	Max        int      `json:"max"`
+	Min        int      `json:"min"`
+	Gini       float64  `json:"gini"`        // 0表示完全均匀，越接近1越集中在少数token
+	HotTokens  []string `json:"hot_tokens"`  // 使用次数超过均值两个标准差的token指纹
+	IdleTokens []string `json:"idle_tokens"` // 其他token有使用而自身未被使用的token指纹
+}
+
+// ShardRebalanceStats 租户分片的使用和冷却情况
+type ShardRebalanceStats struct {
+	TenantURL  string  `json:"tenant_url"`
+	Tokens     int     `json:"tokens"`
+	ChatUsage  int     `json:"chat_usage"`
+	AgentUsage int     `json:"agent_usage"`
+	Cooldowns  int     `json:"cooldowns"`
+	Disables   int     `json:"disables"`
+	UsageShare float64 `json:"usage_share"` // 占全池使用次数的比例
+	TokenShare float64 `json:"token_share"` // 占全池可用token数的比例
+}
+
+// RebalanceRecommendation 一条池调整建议
+type RebalanceRecommendation struct {
+	Kind   string `json:"kind"`   // retire / rebalance / adjust_limit
+	Target string `json:"target"` // token指纹、租户地址或配置项
+	Reason string `json:"reason"`
+}
+
+// RebalanceReport 最近一周的token池使用分析和调整建议
+type RebalanceReport struct {
+	ID              string                    `json:"id"`
+	GeneratedAt     time.Time                 `json:"generated_at"`
+	PeriodStart     time.Time                 `json:"period_start"`
+	PeriodEnd       time.Time                 `json:"period_end"`
+	Instance        string                    `json:"instance"`
+	ActiveTokens    int                       `json:"active_tokens"`
+	DisabledTokens  int                       `json:"disabled_tokens"`
+	ChatUsage       UsageSkew                 `json:"chat_usage"`
+	AgentUsage      UsageSkew                 `json:"agent_usage"`
+	Cooldowns       int                       `json:"cooldowns"`
+	DisableEvents   int                       `json:"disable_events"`
+	DisableReasons  map[string]int            `json:"disable_reasons"`
+	Shards          []ShardRebalanceStats     `json:"shards"`
+	Recommendations []RebalanceRecommendation `json:"recommendations"`
+}
+
+// rebalanceToken 生成报告时单个token的数据
+type rebalanceToken struct {
+	token      string
+	tenantURL  string
+	disabled   bool
+	chatUsage  int
+	agentUsage int
+	tier       string
+}
+
+// rebalanceWebhook 报告推送地址，未单独配置时使用告警Webhook
+func rebalanceWebhook() string {
+	if config.AppConfig.RebalanceWebhook != "" {
+		return config.AppConfig.RebalanceWebhook
+	}
+	return config.AppConfig.AlertWebhook
+}
+
+// usageSkew 计算使用次数的分布，usages 与 tokens 一一对应
+func usageSkew(tokens []string, usages []int) UsageSkew {
+	skew := UsageSkew{HotTokens: []string{}, IdleTokens: []string{}}
+	if len(usages) == 0 {
+		return skew
+	}
+
+	sorted := append([]int(nil), usages...)
+	sort.Ints(sorted)
+	skew.Min, skew.Max = sorted[0], sorted[len(sorted)-1]
+
+	total := 0
+	weighted := 0
+	for i, usage := range sorted {
+		total += usage
+		weighted += (i + 1) * usage
+	}
+	n := float64(len(sorted))
+	skew.Mean = float64(total) / n
+	if total > 0 {
+		skew.Gini = round2((2*float64(weighted))/(n*float64(total)) - (n+1)/n)
+	}
+
+	variance := 0.0
+	for _, usage := range usages {
+		variance += (float64(usage) - skew.Mean) * (float64(usage) - skew.Mean)
+	}
+	skew.StdDev = round2(math.Sqrt(variance / n))
+	skew.Mean = round2(skew.Mean)
+
+	for i, usage := range usages {
+		switch {
+		case skew.StdDev > 0 && float64(usage) > skew.Mean+2*skew.StdDev:
+			skew.HotTokens = append(skew.HotTokens, tokenFingerprint(tokens[i]))
+		case usage == 0 && total > 0:
+			skew.IdleTokens = append(skew.IdleTokens, tokenFingerprint(tokens[i]))
+		}
+	}
+	return skew
+}
+
+// round2 保留两位小数
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// buildRebalanceReport 分析最近一周的使用分布、冷却频率和禁用事件，生成调整建议
+func buildRebalanceReport() (*RebalanceReport, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+	events, err := tokenmanager.GetPoolEventCounts(rebalanceReportDays)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	report := &RebalanceReport{
+		ID:              uuid.New().String(),
+		GeneratedAt:     now,
+		PeriodStart:     now.AddDate(0, 0, -rebalanceReportDays),
+		PeriodEnd:       now,
+		Instance:        leader.InstanceID(),
+		DisableReasons:  events.DisableReasons,
+		Shards:          []ShardRebalanceStats{},
+		Recommendations: []RebalanceRecommendation{},
+	}
+
+	var tokens []rebalanceToken
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || len(fields) == 0 {
+			continue
+		}
+		token := key[6:] // 去掉前缀 "token:"
+		item := rebalanceToken{
+			token:     token,
+			tenantURL: fields["tenant_url"],
+			disabled:  fields["status"] == "disabled",
+		}
+		if item.disabled {
+			report.DisabledTokens++
+		} else {
+			item.chatUsage = getTokenChatUsageCount(token)
+			item.agentUsage = getTokenAgentUsageCount(token)
+			item.tier = tokenmanager.GetTokenScore(token).Tier
+			report.ActiveTokens++
+		}
+		tokens = append(tokens, item)
+	}
+	for _, count := range events.Cooldowns {
+		report.Cooldowns += count
+	}
+	for _, count := range events.Disables {
+		report.DisableEvents += count
+	}
+
+	// 使用次数分布只统计可用token
+	var activeTokens []string
+	var chatUsages, agentUsages []int
+	for _, item := range tokens {
+		if item.disabled {
+			continue
+		}
+		activeTokens = append(activeTokens, item.token)
+		chatUsages = append(chatUsages, item.chatUsage)
+		agentUsages = append(agentUsages, item.agentUsage)
+	}
+	report.ChatUsage = usageSkew(activeTokens, chatUsages)
+	report.AgentUsage = usageSkew(activeTokens, agentUsages)
+
+	report.Shards = rebalanceShards(tokens, events)
+	report.Recommendations = rebalanceRecommendations(report, tokens, events)
+	return report, nil
+}
+
+// rebalanceShards 按租户分片汇总使用次数和事件
+func rebalanceShards(tokens []rebalanceToken, events tokenmanager.PoolEventCounts) []ShardRebalanceStats {
+	shards := make(map[string]*ShardRebalanceStats)
+	totalUsage, totalTokens := 0, 0
+	for _, item := range tokens {
+		if item.tenantURL == "" {
+			continue
+		}
+		shard := shards[item.tenantURL]
+		if shard == nil {
+			shard = &ShardRebalanceStats{TenantURL: item.tenantURL}
+			shards[item.tenantURL] = shard
+		}
+		shard.Cooldowns += events.Cooldowns[item.token]
+		shard.Disables += events.Disables[item.token]
+		if item.disabled {
+			continue
+		}
+		shard.Tokens++
+		shard.ChatUsage += item.chatUsage
+		shard.AgentUsage += item.agentUsage
+		totalUsage += item.chatUsage + item.agentUsage
+		totalTokens++
+	}
+
+	result := make([]ShardRebalanceStats, 0, len(shards))
+	for _, shard := range shards {
+		if totalUsage > 0 {
+			shard.UsageShare = round2(float64(shard.ChatUsage+shard.AgentUsage) / float64(totalUsage))
+		}
+		if totalTokens > 0 {
+			shard.TokenShare = round2(float64(shard.Tokens) / float64(totalTokens))
+		}
+		result = append(result, *shard)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Cooldowns > result[j].Cooldowns
+	})
+	return result
+}
+
+// rebalanceRecommendations 根据统计结果生成调整建议
+func rebalanceRecommendations(report *RebalanceReport, tokens []rebalanceToken, events tokenmanager.PoolEventCounts) []RebalanceRecommendation {
+	recommendations := []RebalanceRecommendation{}
+	avgCooldowns := 0.0
+	if len(tokens) > 0 {
+		avgCooldowns = float64(report.Cooldowns) / float64(len(tokens))
+	}
+
+	// 长期禁用或冷却远多于其他token的token建议下线
+	for _, item := range tokens {
+		fingerprint := tokenFingerprint(item.token)
+		cooldowns := events.Cooldowns[item.token]
+		switch {
+		case item.disabled:
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "retire",
+				Target: fingerprint,
+				Reason: "token已禁用，建议删除或更换",
+			})
+		case cooldowns >= 5 && float64(cooldowns) >= 3*avgCooldowns:
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "retire",
+				Target: fingerprint,
+				Reason: fmt.Sprintf("近%d天冷却%d次，为池平均值的%.1f倍", rebalanceReportDays, cooldowns, float64(cooldowns)/avgCooldowns),
+			})
+		case item.tier == tokenmanager.TierLow:
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "retire",
+				Target: fingerprint,
+				Reason: "健康分处于低分级，请求成功率或剩余额度偏低",
+			})
+		}
+	}
+
+	// 使用次数占比明显高于token占比的分片建议补充token
+	for _, shard := range report.Shards {
+		if shard.Tokens == 0 || shard.TokenShare == 0 {
+			continue
+		}
+		if shard.UsageShare >= 2*shard.TokenShare && shard.UsageShare-shard.TokenShare >= 0.1 {
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "rebalance",
+				Target: shard.TenantURL,
+				Reason: fmt.Sprintf("承担%.0f%%的请求但只有%.0f%%的token，建议向该分片补充token", shard.UsageShare*100, shard.TokenShare*100),
+			})
+		}
+		if avgCooldowns > 0 && float64(shard.Cooldowns)/float64(shard.Tokens) >= 2*avgCooldowns && shard.Cooldowns >= 10 {
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "rebalance",
+				Target: shard.TenantURL,
+				Reason: fmt.Sprintf("每个token平均冷却%.1f次，为池平均值的两倍以上，建议将部分token迁移到其他分片", float64(shard.Cooldowns)/float64(shard.Tokens)),
+			})
+		}
+	}
+
+	// 使用次数接近上限或分布过于集中时建议调整限额和调度
+	for _, mode := range []struct {
+		name  string
+		skew  UsageSkew
+		limit int
+	}{
+		{"CHAT", report.ChatUsage, tokenmanager.ChatUsageLimit},
+		{"AGENT", report.AgentUsage, tokenmanager.AgentUsageLimit},
+	} {
+		if mode.limit > 0 && mode.skew.Mean >= 0.8*float64(mode.limit) {
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "adjust_limit",
+				Target: mode.name,
+				Reason: fmt.Sprintf("平均使用次数%.0f已超过上限%d的80%%，建议提高上限或增加token", mode.skew.Mean, mode.limit),
+			})
+		}
+		if mode.skew.Gini >= 0.5 {
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "adjust_limit",
+				Target: mode.name,
+				Reason: fmt.Sprintf("使用次数分布不均（基尼系数%.2f），建议开启 CLIENT_TOKEN_ROTATION 或 TOKEN_SCORING", mode.skew.Gini),
+			})
+		}
+	}
+	if report.ActiveTokens > 0 {
+		perDay := float64(report.Cooldowns) / float64(report.ActiveTokens) / rebalanceReportDays
+		if perDay >= 5 {
+			recommendations = append(recommendations, RebalanceRecommendation{
+				Kind:   "adjust_limit",
+				Target: "REQUEST_QUEUE_LENGTH",
+				Reason: fmt.Sprintf("每个token每天平均冷却%.1f次，建议开启请求排队或降低并发", perDay),
+			})
+		}
+	}
+	return recommendations
+}
+
+// saveRebalanceReport 保存报告，只保留最近的若干份
+func saveRebalanceReport(report *RebalanceReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := config.RedisLPush(rebalanceReportsKey, string(data)); err != nil {
+		return err
+	}
+	return config.RedisLTrim(rebalanceReportsKey, 0, rebalanceReportsKept-1)
+}
+
+// listRebalanceReports 获取最近的报告，按生成时间倒序
+func listRebalanceReports(limit int) ([]RebalanceReport, error) {
+	items, err := config.RedisLRange(rebalanceReportsKey, 0, int64(limit-1))
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]RebalanceReport, 0, len(items))
+	for _, item := range items {
+		var report RebalanceReport
+		if err := json.Unmarshal([]byte(item), &report); err != nil {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// generateRebalanceReport 生成并保存报告，配置了Webhook时提交推送任务
+func generateRebalanceReport() (*RebalanceReport, error) {
+	report, err := buildRebalanceReport()
+	if err != nil {
+		return nil, err
+	}
+	if err := saveRebalanceReport(report); err != nil {
+		return nil, err
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"report":          report.ID,
+		"active_tokens":   report.ActiveTokens,
+		"recommendations": len(report.Recommendations),
+	}).Info("token池调整报告已生成")
+
+	if rebalanceWebhook() != "" {
+		if _, err := job.Enqueue(rebalanceWebhookJobType, "", report); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"report": report.ID,
+				"error":  err.Error(),
+			}).Error("提交池调整报告推送任务失败")
+		}
+	}
+	return report, nil
+}
+
+// runRebalanceWebhookJob 推送池调整报告，失败时由后台任务重试
+func runRebalanceWebhookJob(ctx context.Context, j *job.Job) error {
+	url := rebalanceWebhook()
+	if url == "" {
+		return nil
+	}
+
+	var report RebalanceReport
+	if err := j.DecodePayload(&report); err != nil {
+		return job.Permanent(err)
+	}
+	payload, _ := json.Marshal(gin.H{
+		"event":  "pool_rebalance_report",
+		"report": report,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return job.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("推送池调整报告返回状态码 " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// StartRebalanceReportScheduler 按配置的周期生成token池调整报告，默认每周一9点
+func StartRebalanceReportScheduler() {
+	if config.RDB == nil || config.AppConfig.RebalanceReportCron == "" {
+		return
+	}
+
+	c := cron.New(cron.WithSeconds())
+	_, err := c.AddFunc(config.AppConfig.RebalanceReportCron, func() {
+		// 多实例部署时只在主实例执行，维护期间跳过
+		if !leader.IsLeader() || maintenanceActive() {
+			return
+		}
+		if _, err := generateRebalanceReport(); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("生成token池调整报告失败")
+		}
+	})
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"cron":  config.AppConfig.RebalanceReportCron,
+			"error": err.Error(),
+		}).Error("添加token池调整报告定时任务失败")
+		return
+	}
+	c.Start()
+}
+
+// RebalanceReportsHandler 获取最近的token池调整报告
+func RebalanceReportsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1"))
+	if err != nil || limit <= 0 {
+		limit = 1
+	}
+	limit = min(limit, rebalanceReportsKept)
+
+	reports, err := listRebalanceReports(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取池调整报告失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"reports": reports,
+	})
+}
+
+// GenerateRebalanceReportHandler 立即生成一份token池调整报告
+func GenerateRebalanceReportHandler(c *gin.Context) {
+	report, err := generateRebalanceReport()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "生成池调整报告失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "rebalance_report_generated",
+		Target: report.ID,
+		Detail: map[string]interface{}{"recommendations": len(report.Recommendations)},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"report": report,
+	})
+}
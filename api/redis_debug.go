@@ -0,0 +1,170 @@
+package api
+
+import (
+	"augment2api/config"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultRedisSampleSize 默认读取内存占用的键数，键很多时按固定间隔抽样估算
+	defaultRedisSampleSize = 2000
+	// maxRedisSampleSize 单次最多读取内存占用的键数
+	maxRedisSampleSize = 20000
+	// redisStatsBatchSize 每个管道读取的键数
+	redisStatsBatchSize = 500
+)
+
+// RedisNamespaceStats 一个命名空间的键数量和估算的内存占用
+type RedisNamespaceStats struct {
+	Namespace     string `json:"namespace"`
+	Keys          int    `json:"keys"`
+	Sampled       int    `json:"sampled"`
+	SampledBytes  int64  `json:"sampled_bytes"`
+	EstimateBytes int64  `json:"estimate_bytes"` // 按抽样的平均大小估算
+	Persistent    int    `json:"persistent"`     // 抽样中未设置过期时间的键数
+}
+
+// RedisKeySize 抽样中占用内存较多的键
+type RedisKeySize struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+	TTL   int64  `json:"ttl_seconds"` // -1表示永不过期
+}
+
+// maskRedisKey 隐藏键中可能是token或会话令牌的长片段
+func maskRedisKey(key string) string {
+	namespace := config.RedisKeyNamespace(key)
+	if len(key) <= len(namespace)+1 {
+		return key
+	}
+	rest := key[len(namespace)+1:]
+	if len(rest) <= 24 {
+		return key
+	}
+	return namespace + ":" + maskToken(rest)
+}
+
+// RedisDebugHandler 统计Redis中各命名空间的键数量和估算内存，列出占用较多的键和慢操作
+// 内存占用按抽样估算，可通过 sample 参数调整抽样数量
+func RedisDebugHandler(c *gin.Context) {
+	if config.RDB == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未启用Redis",
+		})
+		return
+	}
+
+	sampleSize, err := strconv.Atoi(c.DefaultQuery("sample", strconv.Itoa(defaultRedisSampleSize)))
+	if err != nil || sampleSize <= 0 {
+		sampleSize = defaultRedisSampleSize
+	}
+	sampleSize = min(sampleSize, maxRedisSampleSize)
+	top, err := strconv.Atoi(c.DefaultQuery("top", "20"))
+	if err != nil || top <= 0 {
+		top = 20
+	}
+
+	keys, err := config.RedisScan("*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "遍历Redis键失败: " + err.Error(),
+		})
+		return
+	}
+	sort.Strings(keys)
+
+	namespaces := make(map[string]*RedisNamespaceStats)
+	for _, key := range keys {
+		name := config.RedisKeyNamespace(key)
+		stats, ok := namespaces[name]
+		if !ok {
+			stats = &RedisNamespaceStats{Namespace: name}
+			namespaces[name] = stats
+		}
+		stats.Keys++
+	}
+
+	// 按固定间隔抽样，使各命名空间都有键被抽到
+	stride := max(1, (len(keys)+sampleSize-1)/sampleSize)
+	var sampled []string
+	for i := 0; i < len(keys); i += stride {
+		sampled = append(sampled, keys[i])
+	}
+
+	var largest []RedisKeySize
+	for start := 0; start < len(sampled); start += redisStatsBatchSize {
+		batch := sampled[start:min(start+redisStatsBatchSize, len(sampled))]
+		stats, err := config.RedisKeyStatsBatch(batch)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "读取键内存占用失败: " + err.Error(),
+			})
+			return
+		}
+		for i, key := range batch {
+			ns := namespaces[config.RedisKeyNamespace(key)]
+			ns.Sampled++
+			ns.SampledBytes += stats[i].Bytes
+			ttl := int64(-1)
+			if stats[i].TTL >= 0 {
+				ttl = int64(stats[i].TTL.Seconds())
+			} else {
+				ns.Persistent++
+			}
+			largest = append(largest, RedisKeySize{Key: key, Bytes: stats[i].Bytes, TTL: ttl})
+		}
+	}
+
+	sort.Slice(largest, func(i, j int) bool { return largest[i].Bytes > largest[j].Bytes })
+	largest = largest[:min(top, len(largest))]
+	for i := range largest {
+		largest[i].Key = maskRedisKey(largest[i].Key)
+	}
+
+	result := make([]RedisNamespaceStats, 0, len(namespaces))
+	for _, stats := range namespaces {
+		if stats.Sampled > 0 {
+			stats.EstimateBytes = stats.SampledBytes * int64(stats.Keys) / int64(stats.Sampled)
+		}
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].EstimateBytes != result[j].EstimateBytes {
+			return result[i].EstimateBytes > result[j].EstimateBytes
+		}
+		return result[i].Keys > result[j].Keys
+	})
+
+	response := gin.H{
+		"status":       "success",
+		"total_keys":   len(keys),
+		"sampled_keys": len(sampled),
+		"namespaces":   result,
+		"largest_keys": largest,
+		"slow_ops":     config.RecentSlowRedisOps(),
+	}
+	if memory, err := config.RedisMemoryInfo(); err == nil {
+		response["memory"] = gin.H{
+			"used_memory":         memory["used_memory"],
+			"used_memory_peak":    memory["used_memory_peak"],
+			"used_memory_dataset": memory["used_memory_dataset"],
+			"maxmemory":           memory["maxmemory"],
+		}
+	} else {
+		response["memory_error"] = err.Error()
+	}
+	if slowLog, err := config.RedisSlowLog(20); err == nil {
+		response["server_slowlog"] = slowLog
+	} else {
+		response["server_slowlog_error"] = err.Error()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
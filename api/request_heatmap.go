@@ -0,0 +1,205 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// activityKeyPrefix 每小时请求计数的键前缀，按UTC小时分桶，查询时再换算到指定时区
+	activityKeyPrefix = "request_activity:"
+	// activityRetention 每小时请求计数的保留时间
+	activityRetention = 92 * 24 * time.Hour
+	// defaultHeatmapDays 热力图默认统计的天数
+	defaultHeatmapDays = 28
+	// maxHeatmapDays 热力图最多统计的天数
+	maxHeatmapDays = 90
+	// quietSlotCount 返回的最空闲时段数量
+	quietSlotCount = 5
+)
+
+// HeatmapBucket 一个时段内的请求统计
+type HeatmapBucket struct {
+	Requests    int64   `json:"requests"`
+	Errors      int64   `json:"errors"`
+	AvgRequests float64 `json:"avg_requests"` // 统计窗口内该时段平均每次出现的请求数
+}
+
+// HourBucket 一天中某个小时的请求统计
+type HourBucket struct {
+	Hour int `json:"hour"`
+	HeatmapBucket
+}
+
+// WeekdayBucket 一周中某天的请求统计
+type WeekdayBucket struct {
+	Weekday int    `json:"weekday"` // 0为星期日
+	Name    string `json:"name"`
+	HeatmapBucket
+}
+
+// QuietSlot 请求较少的星期和小时组合
+type QuietSlot struct {
+	Weekday     int     `json:"weekday"`
+	Hour        int     `json:"hour"`
+	AvgRequests float64 `json:"avg_requests"`
+}
+
+// activityKey 指定时间所在UTC小时的计数键
+func activityKey(t time.Time) string {
+	return activityKeyPrefix + t.UTC().Format("2006010215")
+}
+
+// recordRequestActivity 在请求结束时按小时记录请求数和失败数
+func recordRequestActivity(c *gin.Context) {
+	if config.RDB == nil {
+		return
+	}
+
+	key := activityKey(time.Now())
+	_, err := config.RedisHIncrBy(key, "requests", 1)
+	if err == nil && classifyRequestError(c, c.Writer.Status()) != "" {
+		_, err = config.RedisHIncrBy(key, "errors", 1)
+	}
+	if err == nil {
+		err = config.RedisExpire(key, activityRetention)
+	}
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("记录每小时请求数失败")
+	}
+}
+
+// RequestHeatmapHandler 按一天中的小时和一周中的星期汇总最近一段时间的请求数，用于选择维护和额度重置的时间
+// 支持 days 指定统计天数，tz 指定换算时区（如 Asia/Shanghai），默认为服务器时区
+func RequestHeatmapHandler(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(defaultHeatmapDays)))
+	if err != nil || days < 1 || days > maxHeatmapDays {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "days 必须为 1 到 " + strconv.Itoa(maxHeatmapDays) + " 之间的整数",
+		})
+		return
+	}
+
+	location := time.Local
+	if tz := c.Query("tz"); tz != "" {
+		location, err = time.LoadLocation(tz)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "无效的时区: " + tz,
+			})
+			return
+		}
+	}
+
+	if config.RDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"error":  "请求统计需要Redis",
+		})
+		return
+	}
+
+	end := time.Now().Truncate(time.Hour)
+	start := end.Add(-time.Duration(days*24-1) * time.Hour)
+	hours := make([]time.Time, 0, days*24)
+	keys := make([]string, 0, days*24)
+	for t := start; !t.After(end); t = t.Add(time.Hour) {
+		hours = append(hours, t.In(location))
+		keys = append(keys, activityKey(t))
+	}
+
+	counts, err := config.RedisHGetAllBatch(keys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "读取请求统计失败: " + err.Error(),
+		})
+		return
+	}
+
+	byHour := make([]HourBucket, 24)
+	byWeekday := make([]WeekdayBucket, 7)
+	var matrix, errorMatrix [7][24]int64
+	// 每个时段在窗口内出现的次数，用于计算平均值
+	var slotSeen [7][24]int
+	var hourSeen [24]int
+	weekdaySeen := make(map[int]map[string]bool)
+	for i, t := range hours {
+		requests, _ := strconv.ParseInt(counts[i]["requests"], 10, 64)
+		errors, _ := strconv.ParseInt(counts[i]["errors"], 10, 64)
+		weekday, hour := int(t.Weekday()), t.Hour()
+
+		matrix[weekday][hour] += requests
+		errorMatrix[weekday][hour] += errors
+		slotSeen[weekday][hour]++
+		hourSeen[hour]++
+		if weekdaySeen[weekday] == nil {
+			weekdaySeen[weekday] = make(map[string]bool)
+		}
+		weekdaySeen[weekday][t.Format("2006-01-02")] = true
+	}
+
+	for weekday := 0; weekday < 7; weekday++ {
+		byWeekday[weekday].Weekday = weekday
+		byWeekday[weekday].Name = time.Weekday(weekday).String()
+		for hour := 0; hour < 24; hour++ {
+			byHour[hour].Hour = hour
+			byHour[hour].Requests += matrix[weekday][hour]
+			byHour[hour].Errors += errorMatrix[weekday][hour]
+			byWeekday[weekday].Requests += matrix[weekday][hour]
+			byWeekday[weekday].Errors += errorMatrix[weekday][hour]
+		}
+		if seen := len(weekdaySeen[weekday]); seen > 0 {
+			byWeekday[weekday].AvgRequests = float64(byWeekday[weekday].Requests) / float64(seen)
+		}
+	}
+	for hour := 0; hour < 24; hour++ {
+		if hourSeen[hour] > 0 {
+			byHour[hour].AvgRequests = float64(byHour[hour].Requests) / float64(hourSeen[hour])
+		}
+	}
+
+	// 按平均请求数从低到高选出最空闲的时段，窗口内未出现过的时段不参与
+	var quiet []QuietSlot
+	for weekday := 0; weekday < 7; weekday++ {
+		for hour := 0; hour < 24; hour++ {
+			if slotSeen[weekday][hour] == 0 {
+				continue
+			}
+			quiet = append(quiet, QuietSlot{
+				Weekday:     weekday,
+				Hour:        hour,
+				AvgRequests: float64(matrix[weekday][hour]) / float64(slotSeen[weekday][hour]),
+			})
+		}
+	}
+	sort.SliceStable(quiet, func(i, j int) bool {
+		return quiet[i].AvgRequests < quiet[j].AvgRequests
+	})
+	if len(quiet) > quietSlotCount {
+		quiet = quiet[:quietSlotCount]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"days":        days,
+		"timezone":    location.String(),
+		"from":        start.In(location),
+		"to":          end.Add(time.Hour).In(location),
+		"by_hour":     byHour,
+		"by_weekday":  byWeekday,
+		"matrix":      matrix,
+		"quiet_slots": quiet,
+	})
+}
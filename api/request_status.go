@@ -0,0 +1,97 @@
+package api
+
+import (
+	"augment2api/pkg/job"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxRequestStatusWait 查询后台请求状态时最长的等待时间
+	maxRequestStatusWait = 60 * time.Second
+	// requestStatusPollInterval 等待期间检查任务状态的间隔
+	requestStatusPollInterval = 500 * time.Millisecond
+)
+
+// parseStatusWait 解析 wait 参数，支持 "30s" 形式的时长和秒数，超过上限时按上限等待
+func parseStatusWait(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, false
+	}
+	return min(wait, maxRequestStatusWait), true
+}
+
+// jobFinished 任务是否已结束，重试中的任务仍可能成功
+func jobFinished(j *job.Job) bool {
+	return j.Status == job.StatusSucceeded || j.Status == job.StatusFailed
+}
+
+// RequestStatusHandler 查询后台执行的聊天请求的状态和结果，只能查询当前API密钥提交的请求；
+// wait 参数指定请求未结束时最多等待的时间，期间请求结束立即返回，超时或客户端断开时返回当前状态
+func RequestStatusHandler(c *gin.Context) {
+	wait, ok := parseStatusWait(c.Query("wait"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": "Invalid wait value '" + c.Query("wait") + "', expected a duration such as 30s.",
+				"type":    "invalid_request_error",
+				"param":   "wait",
+				"code":    "invalid_wait",
+			},
+		})
+		return
+	}
+
+	j, ok := ownedJob(c)
+	if !ok {
+		return
+	}
+	if j.Type != chatCallbackJobType {
+		respondJobNotFound(c)
+		return
+	}
+	if wait > 0 && !jobFinished(j) {
+		j = waitForJob(c.Request.Context(), j, wait)
+	}
+	c.JSON(http.StatusOK, chatJobStatus(j))
+}
+
+// waitForJob 等待任务结束，超时、客户端断开或读取任务失败时返回最后读取到的状态
+func waitForJob(ctx context.Context, j *job.Job, wait time.Duration) *job.Job {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	ticker := time.NewTicker(requestStatusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return j
+		case <-ticker.C:
+		}
+
+		latest, err := job.Get(j.ID)
+		if err != nil {
+			return j
+		}
+		j = latest
+		if jobFinished(j) {
+			return j
+		}
+	}
+}
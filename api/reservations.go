@@ -0,0 +1,131 @@
+package api
+
+import (
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	tokenmanager "augment2api/pkg/token"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReservationRequest 创建额度预留的请求
+type ReservationRequest struct {
+	Name     string `json:"name"`
+	APIKey   string `json:"api_key"`
+	Mode     string `json:"mode"`
+	Requests int    `json:"requests"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+}
+
+// ListReservationsHandler 获取所有额度预留、当前窗口的使用情况和池剩余额度
+func ListReservationsHandler(c *gin.Context) {
+	statuses, err := tokenmanager.ReservationStatuses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取额度预留失败: " + err.Error(),
+		})
+		return
+	}
+	for i := range statuses {
+		statuses[i].APIKey = apikey.Mask(statuses[i].APIKey)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"reservations": statuses,
+		"pool_capacity": gin.H{
+			"CHAT":  tokenmanager.PoolCapacity("CHAT"),
+			"AGENT": tokenmanager.PoolCapacity("AGENT"),
+		},
+	})
+}
+
+// CreateReservationHandler 为API密钥在每天固定时段预留请求额度，窗口内其他调用方不能占用这部分额度
+func CreateReservationHandler(c *gin.Context) {
+	var req ReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	reservation := &tokenmanager.Reservation{
+		Name:     strings.TrimSpace(req.Name),
+		APIKey:   strings.TrimSpace(req.APIKey),
+		Mode:     strings.ToUpper(strings.TrimSpace(req.Mode)),
+		Requests: req.Requests,
+		Start:    strings.TrimSpace(req.Start),
+		End:      strings.TrimSpace(req.End),
+	}
+	if err := reservation.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := tokenmanager.SaveReservation(reservation); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存额度预留失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "reservation_created",
+		Target: reservation.Name,
+		Detail: map[string]interface{}{
+			"id":       reservation.ID,
+			"api_key":  apikey.Mask(reservation.APIKey),
+			"mode":     reservation.Mode,
+			"requests": reservation.Requests,
+			"window":   reservation.Start + "-" + reservation.End,
+		},
+	})
+
+	result := *reservation
+	result.APIKey = apikey.Mask(result.APIKey)
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"reservation": result,
+	})
+}
+
+// DeleteReservationHandler 删除额度预留
+func DeleteReservationHandler(c *gin.Context) {
+	id := c.Param("id")
+	err := tokenmanager.DeleteReservation(id)
+	if errors.Is(err, tokenmanager.ErrReservationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除额度预留失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "reservation_deleted",
+		Target: id,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -0,0 +1,27 @@
+package api
+
+import "github.com/gin-gonic/gin"
+
+// maxResponseFooterBytes API密钥回复末尾说明的最大字节数
+const maxResponseFooterBytes = 1 << 10
+
+// keyResponseFooter 当前API密钥配置的回复末尾说明，未配置时返回空字符串
+func keyResponseFooter(c *gin.Context) string {
+	if key := currentAPIKey(c); key != nil {
+		return key.Footer
+	}
+	return ""
+}
+
+// withResponseFooter 在完整回复末尾追加说明，与正文之间空一行；回复为空时不追加
+func withResponseFooter(text, footer string) string {
+	if footer == "" || text == "" {
+		return text
+	}
+	return text + "\n\n" + footer
+}
+
+// appendResponseFooter 在完整回复末尾追加当前API密钥的说明
+func appendResponseFooter(c *gin.Context, text string) string {
+	return withResponseFooter(text, keyResponseFooter(c))
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"augment2api/pkg/metrics"
+	tokenmanager "augment2api/pkg/token"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	responseChars = metrics.NewSummary("augment2api_response_chars",
+		"Length in characters of completed text responses.", 500, 0.1, 0.5, 0.9)
+	_ = metrics.NewGaugeFunc("augment2api_suspect_tokens",
+		"Tokens flagged as possibly throttled because their responses became abnormally short.",
+		func() float64 { return float64(tokenmanager.CountSuspectTokens()) })
+)
+
+// recordCompletionLength 记录本次完整回复的字符数，用于统计token的回复长度分布
+// 以工具调用结束的回复本身就很短，不参与统计；被抽样和需要保存对话的请求同时保存完整回复
+func recordCompletionLength(c *gin.Context, text string) {
+	captureReviewResponse(c, text)
+	captureTranscriptResponse(c, text)
+	if c.GetBool("tool_use_stop") {
+		return
+	}
+	chars := utf8.RuneCountInString(text)
+	c.Set("completion_chars", chars)
+	responseChars.Observe(float64(chars))
+}
+
+// completionChars 返回本次请求记录的回复字符数，未完整生成回复时返回nil
+func completionChars(c *gin.Context) *int {
+	value, ok := c.Get("completion_chars")
+	if !ok {
+		return nil
+	}
+	chars, ok := value.(int)
+	if !ok {
+		return nil
+	}
+	return &chars
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// retenantConcurrency 批量迁移时并发校验的token数
+const retenantConcurrency = 5
+
+// RetenantRequest 批量修改token租户地址的请求
+type RetenantRequest struct {
+	Tokens        []string `json:"tokens"`          // 指定的token列表
+	FromTenantURL string   `json:"from_tenant_url"` // 或者选择当前位于该租户地址的所有token
+	TenantURL     string   `json:"tenant_url"`      // 新的租户地址
+	Validate      bool     `json:"validate"`        // 是否先校验token在新地址上可用
+}
+
+// RetenantResult 单个token的迁移结果
+type RetenantResult struct {
+	Token         string `json:"token"`
+	FromTenantURL string `json:"from_tenant_url"`
+	Updated       bool   `json:"updated"`
+	Error         string `json:"error,omitempty"`
+}
+
+// normalizeTenantURL 校验租户地址并补全结尾的 /
+func normalizeTenantURL(tenantURL string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(tenantURL))
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return "", fmt.Errorf("无效的租户地址: %s", tenantURL)
+	}
+	tenantURL = parsed.String()
+	if !strings.HasSuffix(tenantURL, "/") {
+		tenantURL += "/"
+	}
+	return tenantURL, nil
+}
+
+// probeTokenOnTenant 校验token能否在指定租户地址上使用
+func probeTokenOnTenant(token, tenantURL string) error {
+	jsonData, err := json.Marshal(tenantProbeMessage())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", tenantURL+"chat-stream", bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	sessionID, _ := config.RedisHGet("token:"+token, "session_id")
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
+	req.Header.Set("x-api-version", "2")
+	applyTokenHeaderOverrides(req, token)
+	req.Header.Set("x-request-id", uuid.New().String())
+	req.Header.Set("x-request-session-id", sessionID)
+
+	client := createHTTPClient()
+	client.Timeout = 30 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 402 表示账号在该分片上但额度不足，同样说明地址正确
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPaymentRequired {
+		return fmt.Errorf("新地址返回状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// selectRetenantTokens 根据请求选择需要迁移的token
+func selectRetenantTokens(req RetenantRequest) ([]string, error) {
+	if len(req.Tokens) > 0 {
+		return req.Tokens, nil
+	}
+
+	fromTenantURL, err := normalizeTenantURL(req.FromTenantURL)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, key := range keys {
+		tenantURL, err := config.RedisHGet(key, "tenant_url")
+		if err == nil && tenantURL == fromTenantURL {
+			tokens = append(tokens, key[6:]) // 去掉前缀 "token:"
+		}
+	}
+	return tokens, nil
+}
+
+// retenantToken 迁移单个token
+func retenantToken(token, tenantURL string, validate bool) RetenantResult {
+	result := RetenantResult{Token: token}
+	tokenKey := "token:" + token
+
+	fromTenantURL, err := config.RedisHGet(tokenKey, "tenant_url")
+	if err != nil {
+		result.Error = "token不存在"
+		return result
+	}
+	result.FromTenantURL = fromTenantURL
+
+	if validate {
+		if err := probeTokenOnTenant(token, tenantURL); err != nil {
+			result.Error = "校验失败: " + err.Error()
+			return result
+		}
+	}
+
+	if err := config.RedisHSet(tokenKey, "tenant_url", tenantURL); err != nil {
+		result.Error = "更新租户地址失败: " + err.Error()
+		return result
+	}
+	result.Updated = true
+	return result
+}
+
+// RetenantTokensHandler 批量修改token的租户地址，用于账号在分片之间迁移时快速修正
+func RetenantTokensHandler(c *gin.Context) {
+	var req RetenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	tenantURL, err := normalizeTenantURL(req.TenantURL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	if len(req.Tokens) == 0 && req.FromTenantURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "需要指定tokens或from_tenant_url",
+		})
+		return
+	}
+
+	tokens, err := selectRetenantTokens(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	results := make([]RetenantResult, len(tokens))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, retenantConcurrency)
+	for i, token := range tokens {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, token string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = retenantToken(token, tenantURL, req.Validate)
+		}(i, token)
+	}
+	wg.Wait()
+
+	updated := 0
+	for _, result := range results {
+		if result.Updated {
+			updated++
+		}
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "tokens_retenanted",
+		Target: tenantURL,
+		Detail: map[string]interface{}{
+			"selected": len(tokens),
+			"updated":  updated,
+			"validate": req.Validate,
+		},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"selected": len(tokens),
+		"updated":  updated,
+		"results":  results,
+	})
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/convert"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/review"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reviewConsentHeader 客户端声明是否同意请求被抽样，为 false 时始终不抽样
+	reviewConsentHeader = "X-Review-Consent"
+	// maxReviewTextBytes 抽样记录中单段文本的最大字节数，超出部分截断
+	maxReviewTextBytes = 256 << 10
+	// maxReviewTags 单条抽样记录的最大标签数
+	maxReviewTags = 10
+)
+
+// reviewTagPattern 标签只允许小写字母、数字、下划线和短横线
+var reviewTagPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// reviewScrubbers 保存抽样记录前依次执行的脱敏处理，REVIEW_SAMPLE_SCRUB 不为 false 时生效
+// 需要额外的脱敏规则时追加到这里
+var reviewScrubbers = []func(string) string{scrubPIIText}
+
+// scrubPIIText 使用内置的敏感信息规则脱敏文本
+func scrubPIIText(text string) string {
+	for _, p := range piiPatterns {
+		text = p.re.ReplaceAllString(text, p.replacement)
+	}
+	return text
+}
+
+// reviewSampleRate 请求被抽样的比例，0表示不抽样
+func reviewSampleRate() float64 {
+	rate, err := strconv.ParseFloat(config.AppConfig.ReviewSampleRate, 64)
+	if err != nil || rate <= 0 {
+		return 0
+	}
+	return min(rate, 1)
+}
+
+// reviewConsented 按 REVIEW_SAMPLE_CONSENT 和请求头判断调用方是否同意抽样
+// opt_in 时只抽样明确同意的请求，否则只排除明确拒绝的请求
+func reviewConsented(c *gin.Context) bool {
+	consent := strings.ToLower(strings.TrimSpace(c.GetHeader(reviewConsentHeader)))
+	if config.AppConfig.ReviewSampleConsent == "opt_in" {
+		return consent == "true"
+	}
+	return consent != "false"
+}
+
+// markReviewSample 按抽样比例决定是否记录本次请求，抽中时保存请求中的消息
+func markReviewSample(c *gin.Context, parsed interface{}) {
+	rate := reviewSampleRate()
+	if rate == 0 || config.RDB == nil || !reviewConsented(c) || rand.Float64() >= rate {
+		return
+	}
+
+	var messages []review.Message
+	switch req := parsed.(type) {
+	case *OpenAIRequest:
+		for _, message := range req.Messages {
+			messages = append(messages, review.Message{Role: message.Role, Content: message.GetContent()})
+		}
+	case *AnthropicRequest:
+		if system := convert.SystemText(req.System); system != "" {
+			messages = append(messages, review.Message{Role: "system", Content: system})
+		}
+		for _, message := range req.Messages {
+			messages = append(messages, review.Message{Role: message.Role, Content: message.GetContent()})
+		}
+	default:
+		return
+	}
+	c.Set("review_sampled", true)
+	c.Set("review_messages", messages)
+}
+
+// captureReviewResponse 抽中的请求保存完整回复，供请求结束时写入抽样记录
+func captureReviewResponse(c *gin.Context, text string) {
+	if c.GetBool("review_sampled") {
+		c.Set("review_response", text)
+	}
+}
+
+// reviewText 脱敏并截断抽样记录中的文本
+func reviewText(text string) string {
+	if config.AppConfig.ReviewSampleScrub != "false" {
+		for _, scrub := range reviewScrubbers {
+			text = scrub(text)
+		}
+	}
+	if len(text) > maxReviewTextBytes {
+		text = strings.ToValidUTF8(text[:maxReviewTextBytes], "") + "\n[truncated]"
+	}
+	return text
+}
+
+// recordReviewSample 请求结束时写入抽样记录，多次调用只记录一次
+func recordReviewSample(c *gin.Context) {
+	if !c.GetBool("review_sampled") || c.GetBool("review_recorded") {
+		return
+	}
+	c.Set("review_recorded", true)
+
+	value, _ := c.Get("review_messages")
+	messages, _ := value.([]review.Message)
+	for i := range messages {
+		messages[i].Content = reviewText(messages[i].Content)
+	}
+
+	sample := review.Sample{
+		Model:      c.GetString("model"),
+		Mode:       c.GetString("augment_mode"),
+		Token:      tokenFingerprint(c.GetString("token")),
+		Path:       c.Request.URL.Path,
+		StatusCode: c.Writer.Status(),
+		Messages:   messages,
+		Response:   reviewText(c.GetString("review_response")),
+	}
+	if key := c.GetString("api_key"); key != "" {
+		sample.APIKey = apikey.Mask(key)
+	}
+	if start, ok := c.Get("request_start"); ok {
+		if startTime, ok := start.(time.Time); ok {
+			sample.DurationMs = time.Since(startTime).Milliseconds()
+		}
+	}
+	if err := review.Save(sample); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("保存抽样记录失败")
+	}
+}
+
+// ListReviewSamplesHandler 分页浏览抽样记录，可按模型、token指纹和标签筛选
+func ListReviewSamplesHandler(c *gin.Context) {
+	filter := review.Filter{
+		Model:    c.Query("model"),
+		Token:    c.Query("token"),
+		Tag:      c.Query("tag"),
+		Untagged: c.Query("untagged") == "true",
+	}
+	samples, err := review.List(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取抽样记录失败: " + err.Error(),
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	start := min((page-1)*pageSize, len(samples))
+	end := min(start+pageSize, len(samples))
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"samples":   samples[start:end],
+		"total":     len(samples),
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// GetReviewSampleHandler 获取单条抽样记录
+func GetReviewSampleHandler(c *gin.Context) {
+	sample, err := review.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "抽样记录不存在或已过期",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"sample": sample,
+	})
+}
+
+// ReviewTagsRequest 设置抽样记录标签的请求体
+type ReviewTagsRequest struct {
+	Tags []string `json:"tags"`
+	Note *string  `json:"note"`
+}
+
+// TagReviewSampleHandler 替换抽样记录的标签和备注
+func TagReviewSampleHandler(c *gin.Context) {
+	var req ReviewTagsRequest
+	if err := decodeRequestBody(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	tags := make([]string, 0, len(req.Tags))
+	for _, tag := range req.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || containsString(tags, tag) {
+			continue
+		}
+		if !reviewTagPattern.MatchString(tag) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "标签只能包含小写字母、数字、下划线和短横线，且不超过32个字符: " + tag,
+			})
+			return
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxReviewTags {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "标签数量不能超过" + strconv.Itoa(maxReviewTags) + "个",
+		})
+		return
+	}
+
+	sample, err := review.SetTags(c.Param("id"), tags, req.Note)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "抽样记录不存在或已过期",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"sample": sample,
+	})
+}
+
+// DeleteReviewSampleHandler 删除一条抽样记录
+func DeleteReviewSampleHandler(c *gin.Context) {
+	if err := review.Delete(c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "删除抽样记录失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// ReviewSummaryHandler 按模型和token汇总抽样记录的数量和标签分布
+func ReviewSummaryHandler(c *gin.Context) {
+	samples, err := review.List(review.Filter{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取抽样记录失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"total":       len(samples),
+		"sample_rate": reviewSampleRate(),
+		"by_model":    review.Summarize(samples, func(s review.Sample) string { return s.Model }),
+		"by_token":    review.Summarize(samples, func(s review.Sample) string { return s.Token }),
+	})
+}
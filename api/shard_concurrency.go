@@ -0,0 +1,59 @@
+package api
+
+import (
+	tokenmanager "augment2api/pkg/token"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shardSlotBody 上游响应体关闭时结束分片的并发计数，流式响应在读取完毕前一直占用分片的并发额度
+type shardSlotBody struct {
+	io.ReadCloser
+	end func()
+}
+
+// Close 关闭响应体并结束分片的并发计数
+func (b *shardSlotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end()
+	return err
+}
+
+// beginShardSlot 在发送上游请求前占用分片的并发计数，返回的函数在得到响应后调用，
+// 按上游状态码调整分片并发上限，响应体关闭时结束计数；没有得到响应时直接结束计数
+func beginShardSlot(c *gin.Context, host string) func(*http.Response) {
+	end := tokenmanager.BeginShardRequest(host)
+	return func(resp *http.Response) {
+		if resp == nil {
+			end(0)
+			return
+		}
+		status := resp.StatusCode
+		release := func() { end(status) }
+		// 请求结束时兜底释放，避免响应体没有关闭导致分片一直被占用
+		releases, _ := c.Get("shard_releases")
+		list, _ := releases.([]func())
+		c.Set("shard_releases", append(list, release))
+		resp.Body = &shardSlotBody{ReadCloser: resp.Body, end: release}
+	}
+}
+
+// releaseShardSlots 请求结束时释放本次请求仍占用的分片并发计数，已释放的不会重复计算
+func releaseShardSlots(c *gin.Context) {
+	releases, _ := c.Get("shard_releases")
+	list, _ := releases.([]func())
+	for _, release := range list {
+		release()
+	}
+}
+
+// ShardConcurrencyHandler 查看本实例各上游分片的自适应并发上限和进行中的请求数
+func ShardConcurrencyHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"enabled": tokenmanager.ShardConcurrencyEnabled(),
+		"shards":  tokenmanager.ShardConcurrencySnapshot(),
+	})
+}
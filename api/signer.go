@@ -0,0 +1,303 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestSigner 为出站请求计算并附加客户端完整性请求头
+type RequestSigner interface {
+	Sign(req *http.Request, body []byte, token string) error
+}
+
+// SignerConfig 签名器配置
+type SignerConfig struct {
+	Type    string            `json:"type"`    // hmac_sha256 / headers，或通过 RegisterSignerType 注册的类型
+	Secret  string            `json:"secret"`  // hmac_sha256 签名密钥
+	Header  string            `json:"header"`  // hmac_sha256 签名写入的请求头，默认 x-signature
+	Headers map[string]string `json:"headers"` // headers 请求头模板，支持 {timestamp} {nonce} {body_sha256} {token_sha256}
+}
+
+// SignerFactory 根据配置创建签名器
+type SignerFactory func(cfg SignerConfig) (RequestSigner, error)
+
+var (
+	signerFactories = map[string]SignerFactory{
+		"hmac_sha256": newHMACSigner,
+		"headers":     newTemplateSigner,
+	}
+	signerFactoriesGuard sync.RWMutex
+
+	// requestSigners 按名称配置的签名器，"*" 对未指定签名器的token生效
+	requestSigners map[string]RequestSigner
+)
+
+// RegisterSignerType 注册新的签名器类型，需在 InitRequestSigners 之前调用
+func RegisterSignerType(name string, factory SignerFactory) {
+	signerFactoriesGuard.Lock()
+	defer signerFactoriesGuard.Unlock()
+	signerFactories[name] = factory
+}
+
+// InitRequestSigners 解析 REQUEST_SIGNERS 配置并创建签名器
+func InitRequestSigners() error {
+	requestSigners = nil
+	signers, err := buildRequestSigners(config.AppConfig.RequestSigners)
+	if err != nil || signers == nil {
+		return err
+	}
+	requestSigners = signers
+
+	logger.Upstream.WithFields(logrus.Fields{
+		"signers": len(signers),
+	}).Info("出站请求签名器加载完成")
+	return nil
+}
+
+// buildRequestSigners 按 REQUEST_SIGNERS 格式的配置创建签名器，未配置时返回nil
+func buildRequestSigners(raw string) (map[string]RequestSigner, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var configs map[string]SignerConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		return nil, fmt.Errorf("解析REQUEST_SIGNERS失败: %v", err)
+	}
+
+	signerFactoriesGuard.RLock()
+	defer signerFactoriesGuard.RUnlock()
+
+	signers := make(map[string]RequestSigner, len(configs))
+	for name, cfg := range configs {
+		factory, ok := signerFactories[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("签名器 %s 的类型未知: %s", name, cfg.Type)
+		}
+		signer, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("签名器 %s 配置无效: %v", name, err)
+		}
+		signers[name] = signer
+	}
+	return signers, nil
+}
+
+// signerForToken 获取token使用的签名器，未单独指定时使用默认签名器
+func signerForToken(token string) RequestSigner {
+	if len(requestSigners) == 0 {
+		return nil
+	}
+
+	name := "*"
+	if token != "" && config.RDB != nil {
+		if tokenSigner, err := config.RedisHGet("token:"+token, "signer"); err == nil && tokenSigner != "" {
+			name = tokenSigner
+		}
+	}
+	return requestSigners[name]
+}
+
+// signingTransport 在请求发出前附加签名请求头
+type signingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip 按token选择签名器并对请求签名
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	signer := signerForToken(token)
+	if signer == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		reader, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, err = io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// RoundTripper 不应修改原请求
+	signed := req.Clone(req.Context())
+	if err := signer.Sign(signed, body, token); err != nil {
+		return nil, fmt.Errorf("请求签名失败: %v", err)
+	}
+	return t.base.RoundTrip(signed)
+}
+
+// withRequestSigning 配置了签名器时为客户端包装签名传输层
+func withRequestSigning(client *http.Client) *http.Client {
+	if len(requestSigners) == 0 {
+		return client
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = signingTransport{base: base}
+	return client
+}
+
+// sha256Hex 计算SHA256并以十六进制返回
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSigner 使用HMAC-SHA256签名，附带时间戳和随机数防止重放
+type hmacSigner struct {
+	secret []byte
+	header string
+}
+
+func newHMACSigner(cfg SignerConfig) (RequestSigner, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("缺少secret")
+	}
+	header := cfg.Header
+	if header == "" {
+		header = "x-signature"
+	}
+	return &hmacSigner{secret: []byte(cfg.Secret), header: header}, nil
+}
+
+// Sign 对 方法、路径、时间戳、随机数和请求体摘要 签名
+func (s *hmacSigner) Sign(req *http.Request, body []byte, token string) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+
+	payload := strings.Join([]string{
+		req.Method,
+		req.URL.Path,
+		timestamp,
+		nonce,
+		sha256Hex(body),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+
+	req.Header.Set(s.header+"-timestamp", timestamp)
+	req.Header.Set(s.header+"-nonce", nonce)
+	req.Header.Set(s.header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// templateSigner 按模板生成请求头，用于只需附加固定格式字段的场景
+type templateSigner struct {
+	headers map[string]string
+}
+
+func newTemplateSigner(cfg SignerConfig) (RequestSigner, error) {
+	if len(cfg.Headers) == 0 {
+		return nil, fmt.Errorf("缺少headers")
+	}
+	for name := range cfg.Headers {
+		if reservedUpstreamHeaders[strings.ToLower(name)] {
+			return nil, fmt.Errorf("不允许覆盖请求头: %s", name)
+		}
+	}
+	return &templateSigner{headers: cfg.Headers}, nil
+}
+
+// Sign 替换模板中的占位符后写入请求头
+func (s *templateSigner) Sign(req *http.Request, body []byte, token string) error {
+	replacer := strings.NewReplacer(
+		"{timestamp}", strconv.FormatInt(time.Now().Unix(), 10),
+		"{nonce}", uuid.New().String(),
+		"{body_sha256}", sha256Hex(body),
+		"{token_sha256}", sha256Hex([]byte(token)),
+	)
+	for name, value := range s.headers {
+		req.Header.Set(name, replacer.Replace(value))
+	}
+	return nil
+}
+
+// UpdateTokenSigner 设置token使用的签名器，为空表示使用默认签名器
+func UpdateTokenSigner(c *gin.Context) {
+	token := tokenParam(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+
+	var req struct {
+		Signer string `json:"signer"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	if req.Signer != "" {
+		if _, ok := requestSigners[req.Signer]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "签名器未配置: " + req.Signer,
+			})
+			return
+		}
+	}
+
+	tokenKey := "token:" + token
+
+	// 检查token是否存在
+	exists, err := config.RedisExists(tokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "检查token失败: " + err.Error(),
+		})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+
+	if err := config.RedisHSet(tokenKey, "signer", req.Signer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新签名器失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	tokenmanager "augment2api/pkg/token"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// snapshotsKey token快照在Redis中的列表键，新快照在前
+	snapshotsKey = "token_snapshots"
+	// snapshotLimit 保留的快照数量
+	snapshotLimit = 20
+	// currentSnapshotID 对比时表示当前实时状态
+	currentSnapshotID = "current"
+)
+
+// TokenSnapshotEntry 快照中单个token的状态
+type TokenSnapshotEntry struct {
+	Token           string `json:"token"`
+	TenantURL       string `json:"tenant_url"`
+	Status          string `json:"status"` // active / cooling / disabled
+	ChatUsageCount  int    `json:"chat_usage_count"`
+	AgentUsageCount int    `json:"agent_usage_count"`
+	Remark          string `json:"remark,omitempty"`
+}
+
+// TokenSnapshot token池快照
+type TokenSnapshot struct {
+	ID        string               `json:"id"`
+	Name      string               `json:"name,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	Tokens    []TokenSnapshotEntry `json:"tokens,omitempty"`
+}
+
+// TokenStatusChange 两次快照之间token的状态变化
+type TokenStatusChange struct {
+	Token string `json:"token"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// TokenUsageDelta 两次快照之间token的使用次数变化，每日重置后可能为负数
+type TokenUsageDelta struct {
+	Token      string `json:"token"`
+	ChatDelta  int    `json:"chat_delta"`
+	AgentDelta int    `json:"agent_delta"`
+}
+
+// TokenSnapshotDiff 两次快照的差异
+type TokenSnapshotDiff struct {
+	From          string              `json:"from"`
+	To            string              `json:"to"`
+	Added         []string            `json:"added"`
+	Removed       []string            `json:"removed"`
+	Disabled      []string            `json:"disabled"`
+	StatusChanges []TokenStatusChange `json:"status_changes"`
+	UsageDeltas   []TokenUsageDelta   `json:"usage_deltas"`
+	ActiveBefore  int                 `json:"active_before"`
+	ActiveAfter   int                 `json:"active_after"`
+}
+
+// captureTokenSnapshot 读取当前所有token的状态
+func captureTokenSnapshot() (*TokenSnapshot, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &TokenSnapshot{
+		ID:        currentSnapshotID,
+		CreatedAt: time.Now(),
+		Tokens:    make([]TokenSnapshotEntry, 0, len(keys)),
+	}
+	for _, key := range keys {
+		token := key[6:] // 去掉前缀 "token:"
+
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || fields["tenant_url"] == "" {
+			continue
+		}
+
+		status := "active"
+		if fields["status"] == "disabled" {
+			status = "disabled"
+		} else if coolStatus, _ := tokenmanager.GetTokenCoolStatus(token); coolStatus.InCool {
+			status = "cooling"
+		}
+
+		snapshot.Tokens = append(snapshot.Tokens, TokenSnapshotEntry{
+			Token:           token,
+			TenantURL:       fields["tenant_url"],
+			Status:          status,
+			ChatUsageCount:  getTokenChatUsageCount(token),
+			AgentUsageCount: getTokenAgentUsageCount(token),
+			Remark:          fields["remark"],
+		})
+	}
+
+	sort.Slice(snapshot.Tokens, func(i, j int) bool {
+		return snapshot.Tokens[i].Token < snapshot.Tokens[j].Token
+	})
+	return snapshot, nil
+}
+
+// listTokenSnapshots 获取已保存的快照，按时间倒序
+func listTokenSnapshots() ([]TokenSnapshot, error) {
+	items, err := config.RedisLRange(snapshotsKey, 0, snapshotLimit-1)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]TokenSnapshot, 0, len(items))
+	for _, item := range items {
+		var snapshot TokenSnapshot
+		if err := json.Unmarshal([]byte(item), &snapshot); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// loadTokenSnapshot 按ID获取快照，current 表示当前实时状态
+func loadTokenSnapshot(id string) (*TokenSnapshot, error) {
+	if id == currentSnapshotID {
+		return captureTokenSnapshot()
+	}
+
+	snapshots, err := listTokenSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if snapshots[i].ID == id {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// diffTokenSnapshots 计算两次快照之间的差异
+func diffTokenSnapshots(from, to *TokenSnapshot) TokenSnapshotDiff {
+	diff := TokenSnapshotDiff{
+		From:          from.ID,
+		To:            to.ID,
+		Added:         []string{},
+		Removed:       []string{},
+		Disabled:      []string{},
+		StatusChanges: []TokenStatusChange{},
+		UsageDeltas:   []TokenUsageDelta{},
+	}
+
+	before := make(map[string]TokenSnapshotEntry, len(from.Tokens))
+	for _, entry := range from.Tokens {
+		before[entry.Token] = entry
+		if entry.Status == "active" {
+			diff.ActiveBefore++
+		}
+	}
+
+	seen := make(map[string]bool, len(to.Tokens))
+	for _, entry := range to.Tokens {
+		seen[entry.Token] = true
+		if entry.Status == "active" {
+			diff.ActiveAfter++
+		}
+
+		old, ok := before[entry.Token]
+		if !ok {
+			diff.Added = append(diff.Added, entry.Token)
+			continue
+		}
+
+		if old.Status != entry.Status {
+			diff.StatusChanges = append(diff.StatusChanges, TokenStatusChange{
+				Token: entry.Token,
+				From:  old.Status,
+				To:    entry.Status,
+			})
+			if entry.Status == "disabled" {
+				diff.Disabled = append(diff.Disabled, entry.Token)
+			}
+		}
+
+		chatDelta := entry.ChatUsageCount - old.ChatUsageCount
+		agentDelta := entry.AgentUsageCount - old.AgentUsageCount
+		if chatDelta != 0 || agentDelta != 0 {
+			diff.UsageDeltas = append(diff.UsageDeltas, TokenUsageDelta{
+				Token:      entry.Token,
+				ChatDelta:  chatDelta,
+				AgentDelta: agentDelta,
+			})
+		}
+	}
+
+	for _, entry := range from.Tokens {
+		if !seen[entry.Token] {
+			diff.Removed = append(diff.Removed, entry.Token)
+		}
+	}
+	return diff
+}
+
+// CreateTokenSnapshotHandler 保存当前token池状态的快照
+func CreateTokenSnapshotHandler(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	// 请求体可选
+	_ = c.ShouldBindJSON(&req)
+
+	snapshot, err := captureTokenSnapshot()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token列表失败: " + err.Error(),
+		})
+		return
+	}
+	snapshot.ID = time.Now().Format("20060102-150405") + "-" + uuid.New().String()[:4]
+	snapshot.Name = req.Name
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = config.RedisLPush(snapshotsKey, string(data))
+	}
+	if err == nil {
+		err = config.RedisLTrim(snapshotsKey, 0, snapshotLimit-1)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "保存快照失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "token_snapshot_created",
+		Target: snapshot.ID,
+		Detail: map[string]interface{}{"name": snapshot.Name, "tokens": len(snapshot.Tokens)},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"snapshot": displaySnapshot(c, snapshot),
+	})
+}
+
+// ListTokenSnapshotsHandler 获取已保存的快照列表，不包含token明细
+func ListTokenSnapshotsHandler(c *gin.Context) {
+	snapshots, err := listTokenSnapshots()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取快照列表失败: " + err.Error(),
+		})
+		return
+	}
+
+	type snapshotSummary struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		Tokens    int       `json:"tokens"`
+	}
+	summaries := make([]snapshotSummary, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		summaries = append(summaries, snapshotSummary{
+			ID:        snapshot.ID,
+			Name:      snapshot.Name,
+			CreatedAt: snapshot.CreatedAt,
+			Tokens:    len(snapshot.Tokens),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"snapshots": summaries,
+	})
+}
+
+// DiffTokenSnapshotsHandler 对比两次快照，to 默认为当前实时状态
+func DiffTokenSnapshotsHandler(c *gin.Context) {
+	fromID := c.Query("from")
+	toID := c.DefaultQuery("to", currentSnapshotID)
+	if fromID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定from快照",
+		})
+		return
+	}
+
+	snapshots := make([]*TokenSnapshot, 0, 2)
+	for _, id := range []string{fromID, toID} {
+		snapshot, err := loadTokenSnapshot(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "获取快照失败: " + err.Error(),
+			})
+			return
+		}
+		if snapshot == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"error":  "快照不存在: " + id,
+			})
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"diff":   displaySnapshotDiff(c, diffTokenSnapshots(snapshots[0], snapshots[1])),
+	})
+}
+
+// displaySnapshot 按会话权限替换快照中的token，不修改原快照
+func displaySnapshot(c *gin.Context, snapshot *TokenSnapshot) *TokenSnapshot {
+	result := *snapshot
+	result.Tokens = make([]TokenSnapshotEntry, len(snapshot.Tokens))
+	for i, entry := range snapshot.Tokens {
+		entry.Token = displayToken(c, entry.Token)
+		result.Tokens[i] = entry
+	}
+	return &result
+}
+
+// displaySnapshotDiff 按会话权限替换快照差异中的token
+func displaySnapshotDiff(c *gin.Context, diff TokenSnapshotDiff) TokenSnapshotDiff {
+	diff.Added = displayTokens(c, diff.Added)
+	diff.Removed = displayTokens(c, diff.Removed)
+	diff.Disabled = displayTokens(c, diff.Disabled)
+	for i := range diff.StatusChanges {
+		diff.StatusChanges[i].Token = displayToken(c, diff.StatusChanges[i].Token)
+	}
+	for i := range diff.UsageDeltas {
+		diff.UsageDeltas[i].Token = displayToken(c, diff.UsageDeltas[i].Token)
+	}
+	return diff
+}
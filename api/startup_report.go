@@ -0,0 +1,170 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// PoolValidationReport token池校验报告
+type PoolValidationReport struct {
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Total         int       `json:"total"`          // 参与校验的token数
+	Skipped       int       `json:"skipped"`        // 已禁用而跳过的token数
+	Valid         int       `json:"valid"`          // 校验通过的token数
+	Invalid       int       `json:"invalid"`        // 被标记为不可用的token数
+	Suspect       int       `json:"suspect"`        // 首次返回401，等待再次确认的token数
+	TenantChanged int       `json:"tenant_changed"` // 租户地址发生变化的token数
+	Failed        int       `json:"failed"`         // 未找到有效租户地址的token数
+}
+
+var (
+	startupReport      *PoolValidationReport
+	startupReportGuard sync.RWMutex
+)
+
+// validateTokenPool 以有限并发校验token池中所有未禁用的token
+func validateTokenPool(concurrency int) (PoolValidationReport, error) {
+	report := PoolValidationReport{StartedAt: time.Now()}
+
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return report, err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+
+	for _, key := range keys {
+		status, err := config.RedisHGet(key, "status")
+		if err == nil && status == "disabled" {
+			report.Skipped++
+			continue
+		}
+		report.Total++
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			token := key[6:] // 去掉前缀 "token:"
+			oldTenantURL, _ := config.RedisHGet(key, "tenant_url")
+			sessionID, err := config.RedisHGet(key, "session_id")
+			if err != nil {
+				sessionID = uuid.New().String()
+			}
+
+			newTenantURL, err := CheckTokenTenantURL(token, sessionID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, errTokenInvalid):
+				report.Invalid++
+			case errors.Is(err, errTokenSuspect):
+				report.Suspect++
+			case err != nil:
+				report.Failed++
+			default:
+				report.Valid++
+				if newTenantURL != oldTenantURL {
+					report.TenantChanged++
+				}
+			}
+		}(key)
+	}
+
+	wg.Wait()
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// RunStartupValidation 启动时校验token池并记录报告，需开启 STARTUP_VALIDATION
+func RunStartupValidation() {
+	if config.AppConfig.StartupValidation != "true" {
+		return
+	}
+
+	// 多实例部署时只由主实例校验，避免重复探测消耗额度
+	if !leader.IsLeader() {
+		logger.Log.Info("当前实例不是主实例，跳过启动时token池校验")
+		return
+	}
+
+	// 已部署独立校验进程时由其负责校验
+	if validatorActive() {
+		logger.Log.Info("检测到独立校验进程，跳过启动时token池校验")
+		return
+	}
+
+	concurrency, err := strconv.Atoi(config.AppConfig.StartupValidationConcurrency)
+	if err != nil {
+		concurrency = 5
+	}
+
+	logger.Log.Info("开始校验token池，校验完成前不对外提供服务")
+
+	report, err := validateTokenPool(concurrency)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("启动时校验token池失败")
+		return
+	}
+
+	startupReportGuard.Lock()
+	startupReport = &report
+	startupReportGuard.Unlock()
+
+	logger.Log.WithFields(logrus.Fields{
+		"total":          report.Total,
+		"skipped":        report.Skipped,
+		"valid":          report.Valid,
+		"invalid":        report.Invalid,
+		"tenant_changed": report.TenantChanged,
+		"failed":         report.Failed,
+		"duration":       report.FinishedAt.Sub(report.StartedAt).String(),
+	}).Info("启动时token池校验完成")
+}
+
+// StartupReportHandler 返回启动时或独立校验进程最近一次的token池校验报告
+func StartupReportHandler(c *gin.Context) {
+	startupReportGuard.RLock()
+	report := startupReport
+	startupReportGuard.RUnlock()
+
+	// 本实例未校验时使用独立校验进程共享的报告
+	if report == nil {
+		report = loadPoolValidationReport()
+	}
+
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "未执行启动校验，请设置 STARTUP_VALIDATION=true",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"report": report,
+	})
+}
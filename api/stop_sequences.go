@@ -0,0 +1,136 @@
+package api
+
+import (
+	"augment2api/pkg/convert"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stopSequenceScanner 在流式输出中查找停止序列，可能是停止序列开头的尾部内容会暂缓输出，
+// 匹配后只输出停止序列之前的内容，停止序列本身不输出
+type stopSequenceScanner struct {
+	sequences []string
+	pending   string
+	matched   string
+}
+
+// newStopSequenceScanner 按请求的 stop_sequences 创建扫描器，未设置时返回nil
+func newStopSequenceScanner(c *gin.Context) *stopSequenceScanner {
+	value, _ := c.Get("stop_sequences")
+	sequences, _ := value.([]string)
+	if len(sequences) == 0 {
+		return nil
+	}
+	return &stopSequenceScanner{sequences: sequences}
+}
+
+// Push 输入新的分块，返回可以安全输出的内容，匹配到停止序列后返回true
+func (s *stopSequenceScanner) Push(text string) (string, bool) {
+	if s == nil {
+		return text, false
+	}
+	if s.matched != "" {
+		return "", true
+	}
+
+	buffer := s.pending + text
+	first := -1
+	for _, sequence := range s.sequences {
+		if index := strings.Index(buffer, sequence); index >= 0 && (first < 0 || index < first) {
+			first = index
+			s.matched = sequence
+		}
+	}
+	if first >= 0 {
+		s.pending = ""
+		return buffer[:first], true
+	}
+
+	// 保留可能是停止序列开头的最长尾部，停止序列的开头总在字符边界上，不会切开多字节字符
+	hold := 0
+	for _, sequence := range s.sequences {
+		for n := min(len(sequence)-1, len(buffer)); n > hold; n-- {
+			if strings.HasSuffix(buffer, sequence[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	s.pending = buffer[len(buffer)-hold:]
+	return buffer[:len(buffer)-hold], false
+}
+
+// Flush 输出剩余的缓冲内容
+func (s *stopSequenceScanner) Flush() string {
+	if s == nil {
+		return ""
+	}
+	text := s.pending
+	s.pending = ""
+	return text
+}
+
+// Apply 处理单个响应分块，完成时一并输出缓冲内容，匹配到停止序列后返回true
+func (s *stopSequenceScanner) Apply(augmentResp *AugmentResponse) bool {
+	if s == nil {
+		return false
+	}
+	text, matched := s.Push(augmentResp.Text)
+	if !matched && augmentResp.Done {
+		text += s.Flush()
+	}
+	augmentResp.Text = text
+	return matched
+}
+
+// Matched 匹配到的停止序列
+func (s *stopSequenceScanner) Matched() string {
+	if s == nil {
+		return ""
+	}
+	return s.matched
+}
+
+// applyStopSequences 扫描响应分块，匹配到停止序列时记录到上下文，返回是否应结束输出
+func applyStopSequences(c *gin.Context, stops *stopSequenceScanner, augmentResp *AugmentResponse) bool {
+	if !stops.Apply(augmentResp) {
+		return false
+	}
+	c.Set("stop_sequence", stops.Matched())
+	return true
+}
+
+// cutAtStopSequence 在完整回复中第一个停止序列处截断，用于非流式响应
+func cutAtStopSequence(c *gin.Context, text string) string {
+	stops := newStopSequenceScanner(c)
+	if stops == nil {
+		return text
+	}
+	augmentResp := AugmentResponse{Text: text, Done: true}
+	applyStopSequences(c, stops, &augmentResp)
+	return augmentResp.Text
+}
+
+// responseStopSequence 返回Anthropic格式中匹配到的停止序列，未匹配时为nil
+func responseStopSequence(c *gin.Context) *string {
+	if sequence := c.GetString("stop_sequence"); sequence != "" {
+		return &sequence
+	}
+	return nil
+}
+
+// writeAnthropicMessageStart 输出 message_start 和文本内容块的 content_block_start 事件
+func writeAnthropicMessageStart(c *gin.Context, flusher http.Flusher, model string, inputTokens int) {
+	c.Writer.Write(convert.AnthropicMessageStart(fmt.Sprintf("msg_%d", time.Now().Unix()), model, inputTokens))
+	flusher.Flush()
+}
+
+// writeAnthropicMessageEnd 结束文本内容块并输出 message_delta 和 message_stop 事件，message_delta 中带有停止原因和输出用量
+func writeAnthropicMessageEnd(c *gin.Context, flusher http.Flusher, fullText string) {
+	c.Writer.Write(convert.AnthropicMessageEnd(responseStopReason(c), responseStopSequence(c), estimateTokenCount(fullText)))
+	flusher.Flush()
+}
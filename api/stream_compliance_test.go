@@ -0,0 +1,413 @@
+package api
+
+import (
+	"augment2api/config"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流式输出兼容性测试：把 testdata/stream_compliance 中的上游输出交给处理函数，
+// 与从 OpenAI 和 Anthropic 接口录制的参考流比较。只比较分块种类的顺序和每类分块必须带有的字段，
+// 文本内容、ID和时间戳不参与比较
+
+const complianceDir = "testdata/stream_compliance"
+
+// complianceIgnoredFields 参考流中有、本服务不输出的字段，上游没有对应的信息
+var complianceIgnoredFields = map[string]bool{
+	"system_fingerprint":                        true,
+	"service_tier":                              true,
+	"choices[].logprobs":                        true,
+	"message.usage.cache_creation_input_tokens": true,
+	"message.usage.cache_read_input_tokens":     true,
+	"message.usage.service_tier":                true,
+}
+
+// sseFrame 流中的一个事件
+type sseFrame struct {
+	Event string
+	Data  map[string]interface{}
+	Done  bool // data: [DONE]
+}
+
+// parseSSE 解析SSE输出
+func parseSSE(t *testing.T, body []byte) []sseFrame {
+	t.Helper()
+	var frames []sseFrame
+	for _, block := range strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+		var frame sseFrame
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				frame.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data := strings.TrimPrefix(line, "data: ")
+				if data == "[DONE]" {
+					frame.Done = true
+					continue
+				}
+				if err := json.Unmarshal([]byte(data), &frame.Data); err != nil {
+					t.Fatalf("无效的事件数据 %q: %v", data, err)
+				}
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// firstChoice 返回OpenAI分块的第一个choice，没有时返回nil
+func firstChoice(f sseFrame) map[string]interface{} {
+	choices, _ := f.Data["choices"].([]interface{})
+	if len(choices) == 0 {
+		return nil
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	return choice
+}
+
+// openAIKind OpenAI分块的种类
+func openAIKind(f sseFrame) string {
+	if f.Done {
+		return "[DONE]"
+	}
+	choice := firstChoice(f)
+	if choice == nil {
+		return "usage"
+	}
+	if reason, ok := choice["finish_reason"].(string); ok {
+		return "finish:" + reason
+	}
+	if delta, _ := choice["delta"].(map[string]interface{}); delta["tool_calls"] != nil {
+		return "tool_calls"
+	}
+	return "content"
+}
+
+// anthropicKind Anthropic事件的种类，ping 可以出现在任意位置，不参与比较
+func anthropicKind(f sseFrame) string {
+	switch f.Event {
+	case "ping":
+		return ""
+	case "content_block_start":
+		block, _ := f.Data["content_block"].(map[string]interface{})
+		return f.Event + ":" + stringField(block, "type")
+	case "content_block_delta":
+		delta, _ := f.Data["delta"].(map[string]interface{})
+		return f.Event + ":" + stringField(delta, "type")
+	case "message_delta":
+		delta, _ := f.Data["delta"].(map[string]interface{})
+		return f.Event + ":" + stringField(delta, "stop_reason")
+	}
+	return f.Event
+}
+
+func stringField(m map[string]interface{}, name string) string {
+	s, _ := m[name].(string)
+	return s
+}
+
+// kindSequence 分块种类的序列，连续相同的种类合并为一个
+func kindSequence(frames []sseFrame, kind func(sseFrame) string) []string {
+	var seq []string
+	for _, f := range frames {
+		k := kind(f)
+		if k == "" || (len(seq) > 0 && seq[len(seq)-1] == k) {
+			continue
+		}
+		seq = append(seq, k)
+	}
+	return seq
+}
+
+// fieldPaths 收集JSON中所有字段的路径，数组元素记为 name[]
+func fieldPaths(value interface{}, prefix string, paths map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			paths[path] = true
+			fieldPaths(child, path, paths)
+		}
+	case []interface{}:
+		for _, child := range v {
+			fieldPaths(child, prefix+"[]", paths)
+		}
+	}
+}
+
+// requiredFields 每类分块必须带有的字段：参考流中该类所有分块都带有的字段
+func requiredFields(frames []sseFrame, kind func(sseFrame) string) map[string]map[string]bool {
+	required := make(map[string]map[string]bool)
+	for _, f := range frames {
+		k := kind(f)
+		if k == "" || f.Done {
+			continue
+		}
+		paths := make(map[string]bool)
+		fieldPaths(f.Data, "", paths)
+		common, ok := required[k]
+		if !ok {
+			required[k] = paths
+			continue
+		}
+		for path := range common {
+			if !paths[path] {
+				delete(common, path)
+			}
+		}
+	}
+	return required
+}
+
+// compareStreams 比较输出与参考流的分块种类顺序和必需字段
+func compareStreams(t *testing.T, got, want []sseFrame, kind func(sseFrame) string) {
+	t.Helper()
+	gotSeq, wantSeq := kindSequence(got, kind), kindSequence(want, kind)
+	if !reflect.DeepEqual(gotSeq, wantSeq) {
+		t.Errorf("分块顺序与参考流不一致\n got: %v\nwant: %v", gotSeq, wantSeq)
+	}
+
+	required := requiredFields(want, kind)
+	for i, f := range got {
+		k := kind(f)
+		if k == "" || f.Done {
+			continue
+		}
+		paths := make(map[string]bool)
+		fieldPaths(f.Data, "", paths)
+		for path := range required[k] {
+			if !paths[path] && !complianceIgnoredFields[path] {
+				t.Errorf("第%d个分块(%s)缺少字段 %s", i, k, path)
+			}
+		}
+	}
+}
+
+// checkOpenAISemantics 检查OpenAI流的角色、结束原因和工具调用参数
+func checkOpenAISemantics(t *testing.T, frames []sseFrame, model string) {
+	t.Helper()
+	if len(frames) == 0 || !frames[len(frames)-1].Done {
+		t.Fatal("流没有以 [DONE] 结束")
+	}
+
+	var id string
+	lastChoice, finishes := -1, 0
+	arguments := make(map[float64]string)
+	for i, f := range frames[:len(frames)-1] {
+		if f.Done {
+			t.Errorf("第%d个分块: [DONE] 不在最后", i)
+			continue
+		}
+		if i == 0 {
+			id = stringField(f.Data, "id")
+		}
+		if stringField(f.Data, "id") != id || id == "" {
+			t.Errorf("第%d个分块: id %q 与第一个分块 %q 不一致", i, f.Data["id"], id)
+		}
+		if object := stringField(f.Data, "object"); object != "chat.completion.chunk" {
+			t.Errorf("第%d个分块: object 为 %q", i, object)
+		}
+		if got := stringField(f.Data, "model"); got != model {
+			t.Errorf("第%d个分块: model 为 %q，请求的是 %q", i, got, model)
+		}
+
+		choice := firstChoice(f)
+		if choice == nil {
+			continue
+		}
+		lastChoice = i
+		if _, ok := choice["finish_reason"]; !ok {
+			t.Errorf("第%d个分块: 缺少 finish_reason", i)
+		}
+		if choice["finish_reason"] != nil {
+			finishes++
+		}
+		delta, _ := choice["delta"].(map[string]interface{})
+		if i == 0 && stringField(delta, "role") != "assistant" {
+			t.Errorf("第一个分块的 role 为 %q", delta["role"])
+		}
+
+		calls, _ := delta["tool_calls"].([]interface{})
+		for _, item := range calls {
+			call, _ := item.(map[string]interface{})
+			index, _ := call["index"].(float64)
+			function, _ := call["function"].(map[string]interface{})
+			if _, seen := arguments[index]; !seen {
+				if stringField(call, "id") == "" || stringField(call, "type") != "function" || stringField(function, "name") == "" {
+					t.Errorf("第%d个分块: 工具调用 %v 的第一个分块缺少 id、type 或 name", i, index)
+				}
+			}
+			arguments[index] += stringField(function, "arguments")
+		}
+	}
+
+	if finishes != 1 {
+		t.Errorf("finish_reason 出现了%d次", finishes)
+	}
+	if lastChoice >= 0 && firstChoice(frames[lastChoice])["finish_reason"] == nil {
+		t.Error("finish_reason 不在最后一个分块")
+	}
+	for index, args := range arguments {
+		if !json.Valid([]byte(args)) {
+			t.Errorf("工具调用 %v 的参数不是有效的JSON: %q", index, args)
+		}
+	}
+}
+
+// checkAnthropicSemantics 检查Anthropic流的事件类型、内容块索引和结束原因
+func checkAnthropicSemantics(t *testing.T, frames []sseFrame, model string) {
+	t.Helper()
+	if len(frames) == 0 || frames[0].Event != "message_start" || frames[len(frames)-1].Event != "message_stop" {
+		t.Fatal("流没有以 message_start 开始、message_stop 结束")
+	}
+	message, _ := frames[0].Data["message"].(map[string]interface{})
+	if got := stringField(message, "model"); got != model {
+		t.Errorf("message_start 的 model 为 %q，请求的是 %q", got, model)
+	}
+	if got := stringField(message, "role"); got != "assistant" {
+		t.Errorf("message_start 的 role 为 %q", got)
+	}
+
+	open, next, stops := -1, 0, 0
+	var partialJSON string
+	var toolBlock bool
+	for i, f := range frames {
+		if got := stringField(f.Data, "type"); got != f.Event {
+			t.Errorf("第%d个事件: 事件名 %q 与 type %q 不一致", i, f.Event, got)
+		}
+		index := -1
+		if v, ok := f.Data["index"].(float64); ok {
+			index = int(v)
+		}
+		switch f.Event {
+		case "content_block_start":
+			if open >= 0 || index != next {
+				t.Errorf("第%d个事件: 内容块 %d 开始时 %d 未结束或索引不连续", i, index, open)
+			}
+			block, _ := f.Data["content_block"].(map[string]interface{})
+			open, toolBlock, partialJSON = index, stringField(block, "type") == "tool_use", ""
+		case "content_block_delta":
+			if index != open {
+				t.Errorf("第%d个事件: 内容块 %d 的增量不在该内容块内", i, index)
+			}
+			delta, _ := f.Data["delta"].(map[string]interface{})
+			partialJSON += stringField(delta, "partial_json")
+		case "content_block_stop":
+			if index != open {
+				t.Errorf("第%d个事件: 结束的内容块 %d 不是当前内容块 %d", i, index, open)
+			}
+			if toolBlock && !json.Valid([]byte(partialJSON)) {
+				t.Errorf("内容块 %d 的工具参数不是有效的JSON: %q", index, partialJSON)
+			}
+			open, next = -1, index+1
+		case "message_delta":
+			if open >= 0 {
+				t.Errorf("第%d个事件: message_delta 时内容块 %d 未结束", i, open)
+			}
+			delta, _ := f.Data["delta"].(map[string]interface{})
+			if stringField(delta, "stop_reason") != "" {
+				stops++
+			}
+		}
+	}
+	if stops != 1 {
+		t.Errorf("stop_reason 出现了%d次", stops)
+	}
+}
+
+// readFixture 读取 testdata/stream_compliance 中的文件
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(complianceDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newComplianceRouter 创建直接使用指定上游地址的路由，跳过鉴权和token调度
+func newComplianceRouter(tenantURL string) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("token", "test-token")
+		c.Set("tenant_url", tenantURL)
+		c.Set("session_id", "test-session")
+		c.Next()
+	})
+	r.POST("/v1/chat/completions", ChatCompletionsHandler)
+	r.POST("/v1/messages", AnthropicMessagesHandler)
+	return r
+}
+
+// streamFixture 用指定的上游输出处理一次流式请求，返回解析后的输出
+func streamFixture(t *testing.T, upstream []byte, path, body string) []sseFrame {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(upstream)
+	}))
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	newComplianceRouter(server.URL+"/").ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d: %s", w.Code, w.Body.String())
+	}
+	return parseSSE(t, bytes.TrimSpace(w.Body.Bytes()))
+}
+
+func TestStreamCompliance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stopOnTool := config.AppConfig.StopOnTool
+	defer func() { config.AppConfig.StopOnTool = stopOnTool }()
+
+	for _, stop := range []string{"false", "true"} {
+		for _, model := range knownModels {
+			for _, fixture := range []string{"text", "tool_use"} {
+				t.Run(model+"/"+fixture+"/stop_on_tool="+stop, func(t *testing.T) {
+					config.AppConfig.StopOnTool = stop
+					upstream := readFixture(t, fixture+".ndjson")
+
+					// CHAT模式不输出工具调用；AGENT模式的OpenAI流总是输出工具调用，
+					// Anthropic流只在开启 STOP_ON_TOOL 时输出 tool_use 内容块
+					openAIRef, anthropicRef := "openai_text.sse", "anthropic_text.sse"
+					if fixture == "tool_use" && modeForModel(model) == "AGENT" {
+						openAIRef = "openai_tool_calls.sse"
+						if stop == "true" {
+							anthropicRef = "anthropic_tool_use.sse"
+						}
+					}
+
+					t.Run("openai", func(t *testing.T) {
+						got := streamFixture(t, upstream, "/v1/chat/completions",
+							`{"model":"`+model+`","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+						compareStreams(t, got, parseSSE(t, readFixture(t, openAIRef)), openAIKind)
+						checkOpenAISemantics(t, got, model)
+					})
+					t.Run("anthropic", func(t *testing.T) {
+						got := streamFixture(t, upstream, "/v1/messages",
+							`{"model":"`+model+`","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+						compareStreams(t, got, parseSSE(t, readFixture(t, anthropicRef)), anthropicKind)
+						checkAnthropicSemantics(t, got, model)
+					})
+				})
+			}
+		}
+	}
+}
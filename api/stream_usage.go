@@ -0,0 +1,33 @@
+package api
+
+import (
+	"augment2api/pkg/convert"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamOptions OpenAI流式请求的选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// estimatePromptTokens 粗略估计Augment请求的输入token数
+func estimatePromptTokens(augmentReq AugmentRequest) int {
+	promptTokens := estimateTokenCount(augmentReq.Message)
+	for _, history := range augmentReq.ChatHistory {
+		promptTokens += estimateTokenCount(history.RequestMessage)
+		promptTokens += estimateTokenCount(history.ResponseText)
+	}
+	return promptTokens
+}
+
+// writeOpenAIStreamDone 结束OpenAI流式响应，completion为本次输出的全部文本
+// 客户端设置了 stream_options.include_usage 时，按规范在 [DONE] 之前输出一个choices为空、带有用量的分块
+func writeOpenAIStreamDone(c *gin.Context, responseID, model, completion string) {
+	recordCompletionLength(c, completion)
+	stream := convert.NewOpenAIStream(responseID, model)
+	if c.GetBool("include_usage") {
+		c.Writer.Write(stream.Usage(c.GetInt("prompt_tokens"), estimateTokenCount(completion)))
+	}
+	c.Writer.Write(stream.Done())
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// strictParamsHeader 客户端单独指定本次请求是否使用严格模式，覆盖 STRICT_PARAMS
+	strictParamsHeader = "X-Strict-Params"
+	// ignoredParamsHeader 宽松模式下返回被忽略的参数，便于客户端发现未生效的功能
+	ignoredParamsHeader = "X-Ignored-Params"
+)
+
+var (
+	openAIRequestParams    = jsonFieldNames(reflect.TypeOf(OpenAIRequest{}))
+	anthropicRequestParams = jsonFieldNames(reflect.TypeOf(AnthropicRequest{}))
+	titleRequestParams     = jsonFieldNames(reflect.TypeOf(ConversationTitleRequest{}))
+)
+
+// jsonFieldNames 结构体可以解析的JSON字段名
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// strictParams 本次请求是否拒绝不支持的参数，请求头优先于 STRICT_PARAMS
+func strictParams(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(strictParamsHeader))) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return config.AppConfig.StrictParams == "true"
+}
+
+// decodeRequestParams 解析请求体，并返回请求中不支持的顶层参数，按字母排序
+func decodeRequestParams(c *gin.Context, v interface{}) ([]string, error) {
+	var raw bytes.Buffer
+	c.Request.Body = io.NopCloser(io.TeeReader(c.Request.Body, &raw))
+	if err := decodeRequestBody(c, v); err != nil {
+		return nil, err
+	}
+
+	known := openAIRequestParams
+	switch v.(type) {
+	case *AnthropicRequest:
+		known = anthropicRequestParams
+	case *ConversationTitleRequest:
+		known = titleRequestParams
+	}
+	// 解析器可能多读了请求体后面的内容，只取第一个JSON值
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(&raw).Decode(&fields); err != nil {
+		return nil, nil
+	}
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// checkUnknownParams 处理请求中不支持的参数：严格模式下返回错误并列出这些参数，
+// 宽松模式下忽略它们并通过 X-Ignored-Params 响应头告知客户端；请求可以继续处理时返回true
+func checkUnknownParams(c *gin.Context, unknown []string) bool {
+	if len(unknown) == 0 {
+		return true
+	}
+	if strictParams(c) {
+		respondUnsupportedParams(c, unknown)
+		return false
+	}
+
+	c.Header(ignoredParamsHeader, strings.Join(unknown, ","))
+	logger.Log.WithFields(logrus.Fields{
+		"path":   c.FullPath(),
+		"params": unknown,
+	}).Debug("忽略请求中不支持的参数")
+	return true
+}
+
+// respondUnsupportedParams 返回不支持参数的错误，details 中逐个列出
+func respondUnsupportedParams(c *gin.Context, unknown []string) {
+	fieldErrors := make([]FieldError, 0, len(unknown))
+	for _, name := range unknown {
+		fieldErrors = append(fieldErrors, FieldError{Field: name, Message: "不支持的参数"})
+	}
+	c.Set("error_class", "invalid_request")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"message": "不支持的参数: " + strings.Join(unknown, ", "),
+			"type":    "invalid_request_error",
+			"param":   unknown[0],
+			"code":    "unsupported_parameter",
+			"details": fieldErrors,
+		},
+	})
+}
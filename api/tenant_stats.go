@@ -0,0 +1,107 @@
+package api
+
+import (
+	"augment2api/config"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// tenantStatsKeyPrefix 按天记录各租户地址检测成功次数的键前缀，后接日期
+	tenantStatsKeyPrefix = "tenant_url_stats:"
+	// tenantStatsDays 参与排序的天数，越近的成功记录权重越高
+	tenantStatsDays = 7
+	// tenantStatsCacheTTL 成功统计在本实例的缓存时间，批量检测时避免每个token都读取Redis
+	tenantStatsCacheTTL = 30 * time.Second
+)
+
+var (
+	tenantScores      map[string]float64
+	tenantScoresAt    time.Time
+	tenantScoresGuard sync.Mutex
+)
+
+// tenantCheckMaxCandidates 每次检测最多尝试的租户地址数，0表示不限制
+func tenantCheckMaxCandidates() int {
+	limit, err := strconv.Atoi(config.AppConfig.TenantCheckMaxCandidates)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// tenantStatsKey 指定日期的成功统计键
+func tenantStatsKey(day time.Time) string {
+	return tenantStatsKeyPrefix + day.Format("20060102")
+}
+
+// recordTenantURLSuccess 记录一次租户地址检测成功
+func recordTenantURLSuccess(tenantURL string) {
+	if config.RDB == nil {
+		return
+	}
+	key := tenantStatsKey(time.Now())
+	if _, err := config.RedisHIncrBy(key, tenantURL, 1); err != nil {
+		return
+	}
+	config.RedisExpire(key, (tenantStatsDays+1)*24*time.Hour)
+}
+
+// tenantURLScores 返回最近几天各租户地址的加权成功次数，n天前的记录权重为 1/(n+1)
+func tenantURLScores() map[string]float64 {
+	tenantScoresGuard.Lock()
+	defer tenantScoresGuard.Unlock()
+	if tenantScores != nil && time.Since(tenantScoresAt) < tenantStatsCacheTTL {
+		return tenantScores
+	}
+
+	scores := make(map[string]float64)
+	if config.RDB != nil {
+		now := time.Now()
+		for days := 0; days < tenantStatsDays; days++ {
+			counts, err := config.RedisHGetAll(tenantStatsKey(now.AddDate(0, 0, -days)))
+			if err != nil {
+				continue
+			}
+			for tenantURL, value := range counts {
+				count, _ := strconv.ParseFloat(value, 64)
+				scores[tenantURL] += count / float64(days+1)
+			}
+		}
+	}
+	tenantScores, tenantScoresAt = scores, time.Now()
+	return scores
+}
+
+// orderTenantCandidates 确定检测租户地址的顺序：token当前的地址最先，其余按最近的成功次数从高到低，
+// 次数相同时按延迟探测结果；超过每次检测的上限时保留排在前面的地址，
+// 并从剩余地址中随机补充一个，使很少成功的地址也有机会被检测到
+func orderTenantCandidates(current string, candidates []string) []string {
+	var ordered []string
+	for _, tenantURL := range candidates {
+		if tenantURL != current {
+			ordered = append(ordered, tenantURL)
+		}
+	}
+	sortTenantURLsByLatency(ordered)
+	scores := tenantURLScores()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return scores[ordered[i]] > scores[ordered[j]]
+	})
+	if current != "" {
+		ordered = append([]string{current}, ordered...)
+	}
+
+	limit := tenantCheckMaxCandidates()
+	if limit == 0 || len(ordered) <= limit {
+		return ordered
+	}
+	if limit == 1 {
+		return ordered[:1]
+	}
+	rest := ordered[limit-1:]
+	return append(ordered[:limit-1:limit-1], rest[rand.Intn(len(rest))])
+}
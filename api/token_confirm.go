@@ -0,0 +1,79 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenConfirmJobType 再次确认疑似失效token的后台任务
+const tokenConfirmJobType = "token_invalid_confirm"
+
+// errTokenSuspect token第一次返回 Invalid token，等待确认探测
+var errTokenSuspect = errors.New("token疑似失效，等待再次确认")
+
+// errTokenInvalid token确认失效，已被标记为不可用
+var errTokenInvalid = errors.New("token被标记为不可用")
+
+// tokenConfirmPayload 确认探测任务的参数
+type tokenConfirmPayload struct {
+	Token string `json:"token"`
+}
+
+// invalidTokenConfirmDelay 第一次返回 Invalid token 后等待多久再次探测
+func invalidTokenConfirmDelay() time.Duration {
+	seconds, err := strconv.Atoi(config.AppConfig.InvalidTokenConfirmDelay)
+	if err != nil || seconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// scheduleInvalidTokenProbe 延迟再次探测疑似失效的token，后台任务不可用时在本实例内定时执行
+func scheduleInvalidTokenProbe(token, sessionID string) {
+	delay := invalidTokenConfirmDelay()
+	if _, err := job.EnqueueIn(tokenConfirmJobType, "", tokenConfirmPayload{Token: token}, delay); err == nil {
+		return
+	}
+	time.AfterFunc(delay, func() {
+		probeSuspectToken(token, sessionID)
+	})
+}
+
+// runTokenConfirmJob 执行确认探测，token在等待期间被删除时直接结束
+func runTokenConfirmJob(ctx context.Context, j *job.Job) error {
+	var payload tokenConfirmPayload
+	if err := j.DecodePayload(&payload); err != nil || payload.Token == "" {
+		return job.Permanent(errors.New("无效的任务参数"))
+	}
+
+	sessionID, err := config.RedisHGet("token:"+payload.Token, "session_id")
+	if err != nil {
+		return nil
+	}
+	probeSuspectToken(payload.Token, sessionID)
+	return nil
+}
+
+// probeSuspectToken 再次检测token，连续第二次返回 Invalid token 时由 CheckTokenTenantURL 禁用，成功时清除记录
+func probeSuspectToken(token, sessionID string) {
+	_, err := CheckTokenTenantURL(token, sessionID)
+	fields := logrus.Fields{
+		"token": tokenFingerprint(token),
+	}
+	switch {
+	case err == nil:
+		logger.Log.WithFields(fields).Info("疑似失效的token再次检测通过")
+	case errors.Is(err, errTokenInvalid):
+		logger.Log.WithFields(fields).Warn("token连续两次返回401，已禁用")
+	default:
+		fields["error"] = err.Error()
+		logger.Log.WithFields(fields).Warn("疑似失效的token再次检测未完成")
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/apikey"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ContributeTokenRequest 调用方贡献token的请求体，tenant_url为空时自动检测
+type ContributeTokenRequest struct {
+	Token     string `json:"token"`
+	TenantURL string `json:"tenant_url"`
+}
+
+// respondOpenAIError 返回OpenAI格式的错误，用于调用方自助管理的接口
+func respondOpenAIError(c *gin.Context, status int, errType, code, message string) {
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+}
+
+// contributionAPIKey 返回可以贡献token的API密钥，未开启贡献或不是后台创建的密钥时写入错误响应
+func contributionAPIKey(c *gin.Context) (*apikey.APIKey, bool) {
+	if config.AppConfig.TokenContribution != "true" || config.RDB == nil {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", "contribution_disabled",
+			"Token contribution is not enabled on this deployment.")
+		return nil, false
+	}
+	key := currentAPIKey(c)
+	if key == nil {
+		respondOpenAIError(c, http.StatusForbidden, "permission_error", "api_key_required",
+			"Token contribution requires an API key issued by this deployment.")
+		return nil, false
+	}
+	return key, true
+}
+
+// contributionView 贡献记录和对应token的当前状态
+func contributionView(contribution *tokenmanager.Contribution) gin.H {
+	token := contribution.Token
+	fields, _ := config.RedisHGetAll("token:" + token)
+	view := gin.H{
+		"object":        "token.contribution",
+		"fingerprint":   tokenmanager.Fingerprint(token),
+		"token":         maskToken(token),
+		"created":       contribution.CreatedAt.Unix(),
+		"in_pool":       len(fields) > 0,
+		"status":        fields["status"],
+		"tenant_url":    fields["tenant_url"],
+		"own_requests":  contribution.OwnRequests,
+		"pool_requests": contribution.PoolRequests,
+		"token_usage": gin.H{
+			"chat":  tokenmanager.GetUsage("token_usage_chat:" + token),
+			"agent": tokenmanager.GetUsage("token_usage_agent:" + token),
+		},
+	}
+	if coolStatus, err := tokenmanager.GetTokenCoolStatus(token); err == nil && coolStatus.InCool {
+		view["cool_until"] = coolStatus.CoolEnd.Unix()
+	}
+	return view
+}
+
+// removeContributedToken 从token池中删除贡献的token及其使用次数
+func removeContributedToken(token string) error {
+	if err := config.RedisDel("token:" + token); err != nil {
+		return err
+	}
+	usageKeys := []string{"token_usage:" + token, "token_usage_chat:" + token, "token_usage_agent:" + token}
+	for _, key := range usageKeys {
+		config.RedisDel(key)
+	}
+	tokenmanager.DiscardUsage(usageKeys...)
+	tokenmanager.RemoveTokenLock(token)
+	tokenmanager.PublishTokenEvent(tokenmanager.EventDeleted, token, nil)
+	return nil
+}
+
+// ContributeTokenHandler 调用方贡献自己的token，检测通过后只供该API密钥使用，
+// 该密钥的请求优先使用这个token，不可用时再从共享池分配；重复贡献时替换之前的token
+func ContributeTokenHandler(c *gin.Context) {
+	key, ok := contributionAPIKey(c)
+	if !ok {
+		return
+	}
+
+	var req ContributeTokenRequest
+	if err := decodeRequestBody(c, &req); err != nil || strings.TrimSpace(req.Token) == "" {
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "invalid_token",
+			"A non-empty 'token' field is required.")
+		return
+	}
+	token := strings.TrimSpace(req.Token)
+	contributor := tokenmanager.Fingerprint(key.Key)
+	tokenKey := "token:" + token
+
+	fields, err := config.RedisHGetAll(tokenKey)
+	if err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to read the token pool.")
+		return
+	}
+	if len(fields) > 0 && fields["contributor"] != contributor {
+		respondOpenAIError(c, http.StatusConflict, "invalid_request_error", "token_exists",
+			"This token is already registered on this deployment.")
+		return
+	}
+
+	previous, err := tokenmanager.GetContribution(key.Key)
+	if err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to read the current contribution.")
+		return
+	}
+
+	// 先标记贡献者再检测，检测写入的租户地址不会让token短暂进入共享池
+	if len(fields) == 0 {
+		if err := config.RedisHSet(tokenKey, "contributor", contributor); err != nil {
+			respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+				"Failed to save the token.")
+			return
+		}
+		if tenantURL := strings.TrimSpace(req.TenantURL); tenantURL != "" {
+			config.RedisHSet(tokenKey, "tenant_url", strings.TrimSuffix(tenantURL, "/")+"/")
+		}
+	}
+	sessionID := fields["session_id"]
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	tenantURL, err := CheckTokenTenantURL(token, sessionID)
+	if err != nil {
+		if len(fields) == 0 {
+			removeContributedToken(token)
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"api_key": apikey.Mask(key.Key),
+			"token":   tokenmanager.Fingerprint(token),
+			"error":   err.Error(),
+		}).Warn("贡献的token检测未通过")
+		respondOpenAIError(c, http.StatusBadRequest, "invalid_request_error", "token_invalid",
+			"The token could not be validated against any tenant.")
+		return
+	}
+	config.RedisHSet(tokenKey, "session_id", sessionID)
+	if len(fields) == 0 {
+		config.RedisHSet(tokenKey, "remark", "")
+	}
+
+	// 替换之前贡献的token
+	if previous != nil && previous.Token != token {
+		if previousFields, _ := config.RedisHGetAll("token:" + previous.Token); previousFields["contributor"] == contributor {
+			removeContributedToken(previous.Token)
+		}
+	}
+	if previous == nil || previous.Token != token {
+		if err := tokenmanager.SetContribution(key.Key, token); err != nil {
+			respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+				"Failed to save the contribution.")
+			return
+		}
+		tokenmanager.PublishTokenEvent(tokenmanager.EventAdded, token, map[string]interface{}{
+			"tenant_url":  tenantURL,
+			"contributor": contributor,
+		})
+		audit.Record(audit.Entry{
+			Actor:  apikey.Mask(key.Key),
+			Action: "token_contributed",
+			Target: tokenmanager.Fingerprint(token),
+			Detail: map[string]interface{}{
+				"key_name":   key.Name,
+				"tenant_url": tenantURL,
+			},
+		})
+	}
+
+	contribution, err := tokenmanager.GetContribution(key.Key)
+	if err != nil || contribution == nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to read the contribution.")
+		return
+	}
+	c.JSON(http.StatusOK, contributionView(contribution))
+}
+
+// GetContributionHandler 查看当前API密钥贡献的token状态和请求计数
+func GetContributionHandler(c *gin.Context) {
+	key, ok := contributionAPIKey(c)
+	if !ok {
+		return
+	}
+
+	contribution, err := tokenmanager.GetContribution(key.Key)
+	if err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to read the contribution.")
+		return
+	}
+	if contribution == nil {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", "contribution_not_found",
+			"This API key has not contributed a token.")
+		return
+	}
+	c.JSON(http.StatusOK, contributionView(contribution))
+}
+
+// WithdrawContributionHandler 撤回当前API密钥贡献的token，token从池中删除
+func WithdrawContributionHandler(c *gin.Context) {
+	key, ok := contributionAPIKey(c)
+	if !ok {
+		return
+	}
+
+	contribution, err := tokenmanager.GetContribution(key.Key)
+	if err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to read the contribution.")
+		return
+	}
+	if contribution == nil {
+		respondOpenAIError(c, http.StatusNotFound, "invalid_request_error", "contribution_not_found",
+			"This API key has not contributed a token.")
+		return
+	}
+
+	// token被管理员删除后又作为共享token添加时不再属于该密钥，此时只删除贡献记录
+	if fields, _ := config.RedisHGetAll("token:" + contribution.Token); fields["contributor"] == tokenmanager.Fingerprint(key.Key) {
+		if err := removeContributedToken(contribution.Token); err != nil {
+			respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+				"Failed to remove the token.")
+			return
+		}
+	}
+	if err := tokenmanager.RemoveContribution(key.Key); err != nil {
+		respondOpenAIError(c, http.StatusInternalServerError, "api_error", "internal_error",
+			"Failed to remove the contribution.")
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  apikey.Mask(key.Key),
+		Action: "token_contribution_withdrawn",
+		Target: tokenmanager.Fingerprint(contribution.Token),
+		Detail: map[string]interface{}{"key_name": key.Name},
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"object":      "token.contribution",
+		"fingerprint": tokenmanager.Fingerprint(contribution.Token),
+		"deleted":     true,
+	})
+}
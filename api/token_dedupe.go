@@ -0,0 +1,144 @@
+package api
+
+import (
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenDedupeJobType 全池token去重的后台任务
+	tokenDedupeJobType = "token_dedupe"
+	// adminJobOwner 管理员提交的后台任务的所有者，只能通过管理接口查询
+	adminJobOwner = "admin"
+)
+
+// runTokenDedupe 执行一次全池去重并记录结果
+func runTokenDedupe(dryRun bool) (tokenmanager.DedupeResult, error) {
+	result, err := tokenmanager.DedupePool(dryRun)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("token去重检查失败")
+		return result, err
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"dry_run":    dryRun,
+		"scanned":    result.Scanned,
+		"collisions": len(result.Collisions),
+		"disabled":   len(result.Disabled),
+	}).Info("token去重检查完成")
+	if !dryRun && len(result.Disabled) > 0 {
+		audit.Record(audit.Entry{
+			Actor:  "admin",
+			Action: "tokens_deduplicated",
+			Detail: map[string]interface{}{"collisions": len(result.Collisions), "disabled": len(result.Disabled)},
+		})
+	}
+	return result, nil
+}
+
+// runTokenDedupeJob 后台执行全池去重
+func runTokenDedupeJob(ctx context.Context, j *job.Job) error {
+	result, err := runTokenDedupe(false)
+	if err != nil {
+		return err
+	}
+	return j.SetResult(result)
+}
+
+// TokenDedupeHandler 检查token池中的重复token，dry_run=true 时同步返回检查结果，
+// 否则提交后台任务，禁用带空白的副本和被截断的token，后台任务不可用时同步执行
+func TokenDedupeHandler(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+	if dryRun || !job.Enabled() {
+		result, err := runTokenDedupe(dryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "token去重检查失败: " + err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+			"result": displayDedupeResult(c, result),
+		})
+		return
+	}
+
+	j, err := job.Enqueue(tokenDedupeJobType, adminJobOwner, struct{}{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "提交去重任务失败: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"status": "success",
+		"job_id": j.ID,
+	})
+}
+
+// TokenDedupeJobHandler 查询去重任务的状态和结果
+func TokenDedupeJobHandler(c *gin.Context) {
+	j, err := job.Get(c.Param("id"))
+	if err != nil || j.Type != tokenDedupeJobType {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "去重任务不存在",
+		})
+		return
+	}
+
+	response := gin.H{
+		"status":     "success",
+		"job_id":     j.ID,
+		"job_status": j.Status,
+		"attempts":   j.Attempts,
+		"created_at": j.CreatedAt,
+		"updated_at": j.UpdatedAt,
+	}
+	if len(j.Result) > 0 {
+		var result tokenmanager.DedupeResult
+		if json.Unmarshal(j.Result, &result) == nil {
+			response["result"] = displayDedupeResult(c, result)
+		}
+	}
+	if j.Error != "" {
+		response["last_error"] = j.Error
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// displayCollisions 对冲突中池里已有的token调用 displayToken，提交的token由调用方提供，原样返回
+func displayCollisions(c *gin.Context, collisions []tokenmanager.TokenCollision) []tokenmanager.TokenCollision {
+	result := make([]tokenmanager.TokenCollision, len(collisions))
+	for i, collision := range collisions {
+		collision.Existing = displayToken(c, collision.Existing)
+		result[i] = collision
+	}
+	return result
+}
+
+// displayDedupeResult 按会话权限替换去重结果中的token
+func displayDedupeResult(c *gin.Context, result tokenmanager.DedupeResult) tokenmanager.DedupeResult {
+	collisions := make([]tokenmanager.TokenCollision, len(result.Collisions))
+	for i, collision := range result.Collisions {
+		collision.Token = displayToken(c, collision.Token)
+		collision.Existing = displayToken(c, collision.Existing)
+		collisions[i] = collision
+	}
+	result.Collisions = collisions
+	result.Disabled = displayTokens(c, result.Disabled)
+	return result
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"augment2api/config"
+	tokenmanager "augment2api/pkg/token"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenEventsHeartbeat SSE心跳间隔，避免连接被代理断开
+const tokenEventsHeartbeat = 30 * time.Second
+
+// TokenEventsHandler 通过SSE实时推送token状态变化
+func TokenEventsHandler(c *gin.Context) {
+	if config.RDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"error":  "未启用Redis，无法订阅token事件",
+		})
+		return
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "流式传输不支持",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	pubsub, err := config.RedisSubscribe(ctx, tokenmanager.EventChannel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "订阅token事件失败: " + err.Error(),
+		})
+		return
+	}
+	defer pubsub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	fmt.Fprintf(c.Writer, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(tokenEventsHeartbeat)
+	defer heartbeat.Stop()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprintf(c.Writer, ": ping\n\n")
+			flusher.Flush()
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(c.Writer, "event: token\ndata: %s\n\n", displayTokenEvent(c, msg.Payload))
+			flusher.Flush()
+		}
+	}
+}
+
+// displayTokenEvent 按会话权限替换事件中的token，无法解析的事件不推送完整内容
+func displayTokenEvent(c *gin.Context, payload string) string {
+	var event tokenmanager.TokenEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return "{}"
+	}
+	event.Token = displayToken(c, event.Token)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
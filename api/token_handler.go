@@ -2,10 +2,13 @@ package api
 
 import (
 	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
 	"augment2api/pkg/logger"
 	tokenmanager "augment2api/pkg/token"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -21,27 +24,87 @@ import (
 
 // TokenInfo 存储token信息
 type TokenInfo struct {
-	Token           string    `json:"token"`
-	TenantURL       string    `json:"tenant_url"`
-	SessionID       string    `json:"session_id"`         // 绑定的会话ID
-	UsageCount      int       `json:"usage_count"`        // 总对话次数
-	ChatUsageCount  int       `json:"chat_usage_count"`   // CHAT模式对话次数
-	AgentUsageCount int       `json:"agent_usage_count"`  // AGENT模式对话次数
-	Remark          string    `json:"remark"`             // 备注字段
-	InCool          bool      `json:"in_cool"`            // 是否在冷却中
-	CoolEnd         time.Time `json:"cool_end,omitempty"` // 冷却结束时间
+	ID              string                         `json:"id"`    // token指纹，可代替token用于管理接口
+	Token           string                         `json:"token"` // 默认只返回部分内容，reveal=true 时返回完整token
+	TenantURL       string                         `json:"tenant_url"`
+	SessionID       string                         `json:"session_id"`              // 绑定的会话ID
+	UsageCount      int                            `json:"usage_count"`             // 总对话次数
+	ChatUsageCount  int                            `json:"chat_usage_count"`        // CHAT模式对话次数
+	AgentUsageCount int                            `json:"agent_usage_count"`       // AGENT模式对话次数
+	Remark          string                         `json:"remark"`                  // 备注字段
+	InCool          bool                           `json:"in_cool"`                 // 是否在冷却中
+	CoolEnd         time.Time                      `json:"cool_end,omitempty"`      // 冷却结束时间
+	UserAgent       string                         `json:"user_agent,omitempty"`    // 自定义User-Agent
+	APIVersion      string                         `json:"api_version,omitempty"`   // 自定义x-api-version
+	ExtraHeaders    string                         `json:"extra_headers,omitempty"` // 自定义额外请求头(JSON)
+	Signer          string                         `json:"signer,omitempty"`        // 使用的请求签名器
+	Health          tokenmanager.TokenScore        `json:"health"`                  // 健康分和分级
+	Hints           tokenmanager.TokenHints        `json:"hints"`                   // 备注中的调度提示
+	OutputLength    tokenmanager.OutputLengthStats `json:"output_length"`           // 最近成功回复的长度分布
+	Suspect         *tokenmanager.SuspectStatus    `json:"suspect,omitempty"`       // 回复长度异常缩短时的疑似限流标记
+	Modes           tokenmanager.ModeAvailability  `json:"modes"`                   // CHAT和AGENT模式是否还能接受请求
 }
 
 // TokenItem token项结构
 type TokenItem struct {
 	Token     string `json:"token"`
 	TenantUrl string `json:"tenantUrl"`
+	Remark    string `json:"remark,omitempty"` // 添加时写入的备注，可包含调度提示
 }
 
+// maskToken 隐藏token的中间部分，用于列表展示
+func maskToken(token string) string {
+	if len(token) <= 12 {
+		return "***"
+	}
+	return token[:6] + "..." + token[len(token)-4:]
+}
+
+// displayToken 快照、事件、去重和归档等接口中展示的token，高级管理员返回完整token，
+// 其他会话返回token指纹，指纹可直接用于按token操作的接口
+func displayToken(c *gin.Context, token string) string {
+	if c.GetString("session_role") == sessionRoleOwner {
+		return token
+	}
+	return tokenmanager.Fingerprint(token)
+}
 
+// displayTokens 对一组token调用 displayToken
+func displayTokens(c *gin.Context, tokens []string) []string {
+	result := make([]string, len(tokens))
+	for i, token := range tokens {
+		result[i] = displayToken(c, token)
+	}
+	return result
+}
+
+// tokenParam 读取路径中的token，接受完整token或列表接口返回的token指纹
+func tokenParam(c *gin.Context) string {
+	value := c.Param("token")
+	if value == "" || config.RDB == nil {
+		return value
+	}
+	if exists, err := config.RedisExists("token:" + value); err == nil && exists {
+		return value
+	}
+	if token, err := tokenmanager.FindByFingerprint(value); err == nil {
+		return token
+	}
+	return value
+}
 
 // GetRedisTokenHandler 从Redis获取token列表，支持分页
+// 默认只返回部分token内容，reveal=true 时返回完整token，需要使用高级管理员密码登录
 func GetRedisTokenHandler(c *gin.Context) {
+	reveal := c.Query("reveal") == "true"
+	if reveal && c.GetString("session_role") != sessionRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "error",
+			"error":  "查看完整token需要使用高级管理员密码登录",
+		})
+		return
+	}
+
 	// 获取分页参数（可选）
 	page := c.DefaultQuery("page", "1")
 	pageSize := c.DefaultQuery("page_size", "0") // 0表示不分页，返回所有
@@ -131,6 +194,7 @@ func GetRedisTokenHandler(c *gin.Context) {
 
 			// 构建token信息并发送到channel
 			tokenListChan <- TokenInfo{
+				ID:              tokenmanager.Fingerprint(tokenValue),
 				Token:           tokenValue,
 				TenantURL:       tenantURL,
 				SessionID:       sessionID,
@@ -140,6 +204,15 @@ func GetRedisTokenHandler(c *gin.Context) {
 				Remark:          remark,
 				InCool:          coolStatus.InCool,
 				CoolEnd:         coolStatus.CoolEnd,
+				UserAgent:       fields["user_agent"],
+				APIVersion:      fields["api_version"],
+				ExtraHeaders:    fields["extra_headers"],
+				Signer:          fields["signer"],
+				Health:          tokenmanager.GetTokenScore(tokenValue),
+				Hints:           tokenmanager.ParseTokenHints(remark),
+				OutputLength:    tokenmanager.GetOutputLengthStats(tokenValue),
+				Suspect:         tokenmanager.GetSuspectStatus(tokenValue),
+				Modes:           tokenmanager.GetModeAvailability(tokenValue, remark),
 			}
 		}(key, token)
 	}
@@ -187,6 +260,19 @@ func GetRedisTokenHandler(c *gin.Context) {
 		}
 	}
 
+	if reveal {
+		audit.Record(audit.Entry{
+			Actor:  c.GetString("session_role"),
+			Action: "tokens_revealed",
+			Target: "tokens",
+			Detail: map[string]interface{}{"count": len(tokenList), "page": pageNum},
+		})
+	} else {
+		for i := range tokenList {
+			tokenList[i].Token = maskToken(tokenList[i].Token)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status":      "success",
 		"tokens":      tokenList,
@@ -231,12 +317,20 @@ func SaveTokenToRedis(token, tenantURL string) error {
 	}
 
 	// 初始化备注为空字符串
-	return config.RedisHSet(tokenKey, "remark", "")
+	err = config.RedisHSet(tokenKey, "remark", "")
+	if err != nil {
+		return err
+	}
+
+	tokenmanager.PublishTokenEvent(tokenmanager.EventAdded, token, map[string]interface{}{
+		"tenant_url": tenantURL,
+	})
+	return nil
 }
 
 // DeleteTokenHandler 删除指定的token
 func DeleteTokenHandler(c *gin.Context) {
-	token := c.Param("token")
+	token := tokenParam(c)
 	if token == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
@@ -308,15 +402,29 @@ func DeleteTokenHandler(c *gin.Context) {
 		config.RedisDel(tokenAgentUsageKey)
 	}
 
+	tokenmanager.DiscardUsage(tokenUsageKey, tokenChatUsageKey, tokenAgentUsageKey)
+	tokenmanager.RemoveTokenLock(token)
+	tokenmanager.PublishTokenEvent(tokenmanager.EventDeleted, token, nil)
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "success",
 	})
 }
 
-// AddTokenHandler 批量添加token到Redis
+// AddTokenHandler 批量添加token到Redis，async=true 时不阻塞请求，
+// 通过检查的token提交后台任务检测租户地址和订阅信息后再启用，租户地址可以为空
 func AddTokenHandler(c *gin.Context) {
-	var tokens []TokenItem
-	if err := c.ShouldBindJSON(&tokens); err != nil {
+	async := c.Query("async") == "true"
+	if async && !job.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"error":  "后台任务不可用，无法异步添加token",
+		})
+		return
+	}
+
+	var body json.RawMessage
+	if err := decodeRequestBody(c, &body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
 			"error":  "无效的请求数据",
@@ -324,6 +432,20 @@ func AddTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// 优先按token列表解析，其他格式的导出内容从中提取token和租户地址
+	var tokens []TokenItem
+	format := tokenFormatList
+	if err := json.Unmarshal(body, &tokens); err != nil || !hasTokenItems(tokens) {
+		tokens, format, err = parseTokenDump(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "无效的请求数据",
+			})
+			return
+		}
+	}
+
 	// 检查是否有token数据
 	if len(tokens) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -333,45 +455,146 @@ func AddTokenHandler(c *gin.Context) {
 		return
 	}
 
-	// 批量保存token
+	pool, err := tokenmanager.PoolTenantURLs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token列表失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 批量保存token，重复和疑似粘贴错误的token分别报告，不保存
 	successCount := 0
 	failedTokens := make([]string, 0)
+	var duplicates, existing []string
+	var conflicts, nearDuplicates []tokenmanager.TokenCollision
+	imported := make(map[string]string)
+	var pipeline []TokenItem
 
 	for _, item := range tokens {
-		// 验证token格式
-		if item.Token == "" || item.TenantUrl == "" {
+		token := tokenmanager.NormalizeToken(item.Token)
+		tenantURL := strings.TrimSpace(item.TenantUrl)
+		// 验证token格式，异步添加时租户地址由后台任务检测
+		if token == "" || (tenantURL == "" && !async) {
 			failedTokens = append(failedTokens, item.Token)
 			continue
 		}
 
+		// 本次导入中重复出现的token，租户地址不同时作为冲突报告
+		if previous, ok := imported[token]; ok {
+			if sameTenantURL(previous, tenantURL) {
+				duplicates = append(duplicates, token)
+			} else {
+				conflicts = append(conflicts, tokenmanager.TokenCollision{
+					Token: token, TenantURL: tenantURL, Existing: token, ExistingTenantURL: previous, Kind: tokenmanager.CollisionExact,
+				})
+			}
+			continue
+		}
+
+		// 与池中已有token或本次导入的token重复
+		collision, found := tokenmanager.FindCollision(token, pool)
+		if !found {
+			collision, found = tokenmanager.FindCollision(token, imported)
+		}
+		if found {
+			collision.TenantURL = tenantURL
+			switch {
+			case collision.Kind == tokenmanager.CollisionExact && sameTenantURL(collision.ExistingTenantURL, tenantURL):
+				existing = append(existing, token)
+			case collision.Kind == tokenmanager.CollisionExact:
+				conflicts = append(conflicts, collision)
+			default:
+				nearDuplicates = append(nearDuplicates, collision)
+			}
+			continue
+		}
+
+		imported[token] = tenantURL
+		if async {
+			pipeline = append(pipeline, TokenItem{Token: token, TenantUrl: tenantURL, Remark: item.Remark})
+			continue
+		}
+
 		// 保存到Redis
-		err := SaveTokenToRedis(item.Token, item.TenantUrl)
-		if err != nil {
+		if err := SaveTokenToRedis(token, tenantURL); err != nil {
+			delete(imported, token)
 			failedTokens = append(failedTokens, item.Token)
 			continue
 		}
+		if item.Remark != "" {
+			config.RedisHSet("token:"+token, "remark", item.Remark)
+		}
 		successCount++
 	}
 
 	// 返回处理结果
 	result := gin.H{
 		"status":        "success",
+		"format":        format,
 		"total":         len(tokens),
 		"success_count": successCount,
 	}
+	if len(pipeline) > 0 {
+		j, err := enqueueTokenImport(pipeline, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "提交导入任务失败: " + err.Error(),
+			})
+			return
+		}
+		result["job_id"] = j.ID
+		result["queued_count"] = len(pipeline)
+	}
 
 	if len(failedTokens) > 0 {
 		result["failed_tokens"] = failedTokens
 		result["failed_count"] = len(failedTokens)
 	}
+	if len(duplicates) > 0 {
+		result["duplicate_tokens"] = duplicates
+		result["duplicate_count"] = len(duplicates)
+	}
+	if len(existing) > 0 {
+		result["existing_tokens"] = existing
+		result["existing_count"] = len(existing)
+	}
+	// 同一token对应不同的租户地址，需要人工确认哪个正确
+	if len(conflicts) > 0 {
+		result["tenant_conflicts"] = displayCollisions(c, conflicts)
+		result["tenant_conflict_count"] = len(conflicts)
+	}
+	// 与已有token只差空白、前缀或个别字符，通常是粘贴错误
+	if len(nearDuplicates) > 0 {
+		result["near_duplicates"] = displayCollisions(c, nearDuplicates)
+		result["near_duplicate_count"] = len(nearDuplicates)
+	}
 
 	c.JSON(http.StatusOK, result)
 }
 
-// CheckTokenTenantURL 检测token的租户地址
-func CheckTokenTenantURL(token string, sessionID string) (string, error) {
-	// 构建测试消息
-	testMsg := map[string]interface{}{
+// sameTenantURL 两个租户地址是否相同，忽略末尾的斜杠
+func sameTenantURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// candidateTenantURLs 返回所有候选租户地址 (d20-d0, i5-i0)
+func candidateTenantURLs() []string {
+	urls := make([]string, 0, 27)
+	for i := 20; i >= 0; i-- {
+		urls = append(urls, fmt.Sprintf("https://d%d.api.augmentcode.com/", i))
+	}
+	for i := 5; i >= 0; i-- {
+		urls = append(urls, fmt.Sprintf("https://i%d.api.augmentcode.com/", i))
+	}
+	return urls
+}
+
+// tenantProbeMessage 检测token与租户地址是否匹配时发送的测试消息
+func tenantProbeMessage() map[string]interface{} {
+	return map[string]interface{}{
 		"message":              "hello，what is your name",
 		"mode":                 "CHAT",
 		"prefix":               "You are AI assistant,help me to solve problems!",
@@ -389,8 +612,37 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 			"deleted_blobs": []string{},
 		},
 	}
+}
 
-	jsonData, err := json.Marshal(testMsg)
+// CheckTokenTenantURL 检测token的租户地址，并将检测结果记录到token的时间线
+func CheckTokenTenantURL(token string, sessionID string) (string, error) {
+	tenantURL, err := checkTokenTenantURL(token, sessionID)
+
+	detail := map[string]interface{}{"result": "valid"}
+	switch {
+	case errors.Is(err, errTokenInvalid):
+		detail["result"] = "invalid"
+	case errors.Is(err, errTokenSuspect):
+		detail["result"] = "suspect"
+	case err != nil:
+		detail["result"] = "failed"
+		detail["error"] = err.Error()
+	default:
+		detail["tenant_url"] = tenantURL
+	}
+	if recordErr := tokenmanager.RecordTokenEvent(token, tokenmanager.EventChecked, detail); recordErr != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token": tokenFingerprint(token),
+			"error": recordErr.Error(),
+		}).Error("记录token检测结果失败")
+	}
+	return tenantURL, err
+}
+
+// checkTokenTenantURL 依次测试租户地址，返回可用的地址
+func checkTokenTenantURL(token string, sessionID string) (string, error) {
+	// 构建测试消息
+	jsonData, err := json.Marshal(tenantProbeMessage())
 	if err != nil {
 		return "", fmt.Errorf("序列化测试消息失败: %v", err)
 	}
@@ -401,38 +653,12 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 
 	var tenantURLResult string
 	var foundValid bool
-	var tenantURLsToTest []string
 
-	// 如果Redis中有有效的租户地址，优先测试该地址
-	if err == nil && currentTenantURL != "" {
-		tenantURLsToTest = append(tenantURLsToTest, currentTenantURL)
-	}
-
-	// 创建一个map来跟踪已添加的URL，避免重复
-	uniqueTenantURLs := make(map[string]bool)
-	if currentTenantURL != "" {
-		uniqueTenantURLs[currentTenantURL] = true
-	}
-
-	// 添加其他租户地址
-	// 添加 d1-d20 地址
-	for i := 20; i >= 0; i-- {
-		newTenantURL := fmt.Sprintf("https://d%d.api.augmentcode.com/", i)
-		// 避免重复测试已有的租户地址
-		if !uniqueTenantURLs[newTenantURL] {
-			tenantURLsToTest = append(tenantURLsToTest, newTenantURL)
-			uniqueTenantURLs[newTenantURL] = true
-		}
-	}
-
-	// 添加 i0-i5 地址
-	for i := 5; i >= 0; i-- {
-		newTenantURL := fmt.Sprintf("https://i%d.api.augmentcode.com/", i)
-		if !uniqueTenantURLs[newTenantURL] {
-			tenantURLsToTest = append(tenantURLsToTest, newTenantURL)
-			uniqueTenantURLs[newTenantURL] = true
-		}
+	// 如果Redis中有有效的租户地址，优先测试该地址，其余按最近的检测成功次数排序，并限制每次测试的数量
+	if err != nil {
+		currentTenantURL = ""
 	}
+	tenantURLsToTest := orderTenantCandidates(currentTenantURL, candidateTenantURLs())
 
 	// 测试租户地址
 	for _, tenantURL := range tenantURLsToTest {
@@ -446,6 +672,7 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("User-Agent", config.AppConfig.UserAgent)
 		req.Header.Set("x-api-version", "2")
+		applyTokenHeaderOverrides(req, token)
 		req.Header.Set("x-request-id", uuid.New().String())
 		req.Header.Set("x-request-session-id", sessionID)
 
@@ -457,6 +684,7 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 		}
 
 		isInvalid := false
+		isSuspect := false
 		func() {
 			defer resp.Body.Close()
 
@@ -470,17 +698,25 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 					responseBody = string(buf[:n])
 				}
 
-				// 只有当响应中包含"Invalid token"时才标记为不可用
+				// 只有当响应中包含"Invalid token"时才标记为不可用，连续两次才禁用
 				if readErr == nil && n > 0 && bytes.Contains(buf[:n], []byte("Invalid token")) {
-					// 将token标记为不可用
-					err = config.RedisHSet(tokenKey, "status", "disabled")
+					confirmed, err := tokenmanager.RecordInvalidToken(token, invalidTokenConfirmDelay())
 					if err != nil {
 						fmt.Printf("标记token为不可用失败: %v\n", err)
 					}
+					if !confirmed {
+						logger.Log.WithFields(logrus.Fields{
+							"token":         tokenFingerprint(token),
+							"response_body": responseBody,
+						}).Warn("token: 返回401未授权，稍后再次确认")
+						scheduleInvalidTokenProbe(token, sessionID)
+						isSuspect = true
+						return
+					}
 					logger.Log.WithFields(logrus.Fields{
-						"token":         token,
+						"token":         tokenFingerprint(token),
 						"response_body": responseBody,
-					}).Info("token: 已被标记为不可用,返回401未授权")
+					}).Info("token: 已被标记为不可用,连续两次返回401未授权")
 					isInvalid = true
 				}
 				return
@@ -508,12 +744,12 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 							(strings.Contains(responseContent, inactiveMsg) || strings.Contains(responseContent, suspendedMsg))) ||
 							strings.Contains(responseContent, outOfMessagesMsg) {
 							// 将token标记为不可用
-							err = config.RedisHSet(tokenKey, "status", "disabled")
+							err = tokenmanager.DisableToken(token, "subscription_inactive")
 							if err != nil {
 								fmt.Printf("标记token为不可用失败: %v\n", err)
 							}
 							logger.Log.WithFields(logrus.Fields{
-								"token":         token,
+								"token":         tokenFingerprint(token),
 								"response_body": responseContent,
 							}).Info("token: 检测到订阅异状态，TOKEN已标记为不可用")
 							isInvalid = true
@@ -532,18 +768,23 @@ func CheckTokenTenantURL(token string, sessionID string) (string, error) {
 						fmt.Printf("标记token为可用失败: %v\n", err)
 					}
 					logger.Log.WithFields(logrus.Fields{
-						"token":          token,
+						"token":          tokenFingerprint(token),
 						"new_tenant_url": tenantURL,
 					}).Info("token: 更新租户地址成功")
 					tenantURLResult = tenantURL
 					foundValid = true
+					recordTenantURLSuccess(tenantURL)
+					tokenmanager.ClearInvalidToken(token)
 				}
 			}
 		}()
 
 		// 如果token无效，立即返回错误，不再测试其他地址
 		if isInvalid {
-			return "", fmt.Errorf("token被标记为不可用")
+			return "", errTokenInvalid
+		}
+		if isSuspect {
+			return "", errTokenSuspect
 		}
 
 		// 如果找到有效的租户地址，跳出循环
@@ -582,6 +823,7 @@ func CheckAllTokensHandler(c *gin.Context) {
 	var mu sync.Mutex
 	var updatedCount int
 	var disabledCount int
+	var suspectCount int
 	var validTokenCount int
 
 	for _, key := range keys {
@@ -615,14 +857,16 @@ func CheckAllTokensHandler(c *gin.Context) {
 			// 检测租户地址
 			newTenantURL, err := CheckTokenTenantURL(token, sessionID)
 			logger.Log.WithFields(logrus.Fields{
-				"token":          token,
+				"token":          tokenFingerprint(token),
 				"old_tenant_url": oldTenantURL,
 				"new_tenant_url": newTenantURL,
 			}).Info("检测token租户地址")
 
 			mu.Lock()
-			if err != nil && err.Error() == "token被标记为不可用" {
+			if errors.Is(err, errTokenInvalid) {
 				disabledCount++
+			} else if errors.Is(err, errTokenSuspect) {
+				suspectCount++
 			} else if err == nil && newTenantURL != oldTenantURL {
 				updatedCount++
 			}
@@ -637,49 +881,23 @@ func CheckAllTokensHandler(c *gin.Context) {
 		"total":    validTokenCount,
 		"updated":  updatedCount,
 		"disabled": disabledCount,
+		"suspect":  suspectCount,
 	})
 }
 
-
-
-
-
-
 // getTokenChatUsageCount 获取token的CHAT模式使用次数
 func getTokenChatUsageCount(token string) int {
-	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_chat:" + token
-	count, err := config.RedisGet(countKey)
-	if err != nil {
-		return 0 // 如果出错或不存在，返回0
-	}
-	countInt, err := strconv.Atoi(count)
-	if err != nil {
-		return 0
-	}
-
-	return countInt
+	return tokenmanager.GetUsage("token_usage_chat:" + token)
 }
 
 // getTokenAgentUsageCount 获取token的AGENT模式使用次数
 func getTokenAgentUsageCount(token string) int {
-	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_agent:" + token
-	count, err := config.RedisGet(countKey)
-	if err != nil {
-		return 0 // 如果出错或不存在，返回0
-	}
-	countInt, err := strconv.Atoi(count)
-	if err != nil {
-		return 0
-	}
-
-	return countInt
+	return tokenmanager.GetUsage("token_usage_agent:" + token)
 }
 
 // UpdateTokenRemark 更新token的备注信息
 func UpdateTokenRemark(c *gin.Context) {
-	token := c.Param("token")
+	token := tokenParam(c)
 	if token == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
@@ -733,41 +951,3 @@ func UpdateTokenRemark(c *gin.Context) {
 		"status": "success",
 	})
 }
-
-// MigrateTokensSessionID 确保所有token都有session_id字段
-func MigrateTokensSessionID() error {
-	// 获取所有token的key
-	keys, err := config.RedisKeys("token:*")
-	if err != nil {
-		return fmt.Errorf("获取token列表失败: %v", err)
-	}
-
-	for _, key := range keys {
-		// 检查token状态，跳过不可用的token
-		status, err := config.RedisHGet(key, "status")
-		if err == nil && status == "disabled" {
-			continue // 跳过被标记为不可用的token
-		}
-
-		// 检查是否已有session_id字段
-		exists, err := config.RedisHExists(key, "session_id")
-		if err != nil {
-			logger.Log.Error("check session_id field of token %s failed: %v", key, err)
-			continue
-		}
-
-		// 如果没有session_id字段，生成一个新的session_id
-		if !exists {
-			sessionID := uuid.New().String()
-			err = config.RedisHSet(key, "session_id", sessionID)
-			if err != nil {
-				logger.Log.Error("add session_id field to token %s failed: %v", key, err)
-				continue
-			}
-			logger.Log.Info("add session_id field to token %s success", key)
-		}
-	}
-	logger.Log.Info("migrate session_id field to all tokens success!")
-
-	return nil
-}
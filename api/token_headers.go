@@ -0,0 +1,199 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenHeaderOverrides token级别的上游请求头覆盖配置
+type TokenHeaderOverrides struct {
+	UserAgent    string            `json:"user_agent"`
+	APIVersion   string            `json:"api_version"`
+	ExtraHeaders map[string]string `json:"extra_headers"`
+}
+
+// reservedUpstreamHeaders 不允许被token配置覆盖的请求头
+var reservedUpstreamHeaders = map[string]bool{
+	"host":                 true,
+	"content-length":       true,
+	"content-type":         true,
+	"authorization":        true,
+	"x-request-id":         true,
+	"x-request-session-id": true,
+}
+
+var (
+	upstreamHeaders     map[string]string
+	upstreamHeadersOnce sync.Once
+)
+
+// globalUpstreamHeaders 解析 UPSTREAM_HEADERS 中配置的请求头，保留的请求头会被忽略
+func globalUpstreamHeaders() map[string]string {
+	upstreamHeadersOnce.Do(func() {
+		raw := strings.TrimSpace(config.AppConfig.UpstreamHeaders)
+		if raw == "" {
+			return
+		}
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("解析 UPSTREAM_HEADERS 失败，格式应为JSON对象")
+			return
+		}
+		upstreamHeaders = make(map[string]string, len(headers))
+		for name, value := range headers {
+			name = strings.TrimSpace(name)
+			if name == "" || reservedUpstreamHeaders[strings.ToLower(name)] {
+				logger.Log.WithFields(logrus.Fields{
+					"header": name,
+				}).Warn("UPSTREAM_HEADERS 中的请求头不允许覆盖，已忽略")
+				continue
+			}
+			upstreamHeaders[name] = value
+		}
+	})
+	return upstreamHeaders
+}
+
+// getTokenHeaderOverrides 从token哈希表中读取请求头覆盖配置
+func getTokenHeaderOverrides(token string) TokenHeaderOverrides {
+	var overrides TokenHeaderOverrides
+	if token == "" || config.RDB == nil {
+		return overrides
+	}
+
+	fields, err := config.RedisHGetAll("token:" + token)
+	if err != nil {
+		return overrides
+	}
+
+	overrides.UserAgent = fields["user_agent"]
+	overrides.APIVersion = fields["api_version"]
+	if extra := fields["extra_headers"]; extra != "" {
+		if err := json.Unmarshal([]byte(extra), &overrides.ExtraHeaders); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Warn("解析token自定义请求头失败")
+		}
+	}
+
+	return overrides
+}
+
+// applyTokenHeaderOverrides 将部署级别的自定义请求头和token级别的请求头覆盖应用到上游请求，
+// token配置的同名请求头优先，值为空时表示该token不发送此请求头
+func applyTokenHeaderOverrides(req *http.Request, token string) {
+	for name, value := range globalUpstreamHeaders() {
+		req.Header.Set(name, value)
+	}
+
+	overrides := getTokenHeaderOverrides(token)
+
+	if overrides.UserAgent != "" {
+		req.Header.Set("User-Agent", overrides.UserAgent)
+	}
+	if overrides.APIVersion != "" {
+		req.Header.Set("x-api-version", overrides.APIVersion)
+	}
+	for name, value := range overrides.ExtraHeaders {
+		if reservedUpstreamHeaders[strings.ToLower(name)] {
+			continue
+		}
+		if value == "" {
+			req.Header.Del(name)
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// UpdateTokenHeaders 更新token的请求头覆盖配置
+func UpdateTokenHeaders(c *gin.Context) {
+	token := tokenParam(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+
+	var req TokenHeaderOverrides
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	for name := range req.ExtraHeaders {
+		if reservedUpstreamHeaders[strings.ToLower(name)] {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "不允许覆盖请求头: " + name,
+			})
+			return
+		}
+	}
+
+	tokenKey := "token:" + token
+
+	// 检查token是否存在
+	exists, err := config.RedisExists(tokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "检查token失败: " + err.Error(),
+		})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+
+	extraHeaders := ""
+	if len(req.ExtraHeaders) > 0 {
+		data, err := json.Marshal(req.ExtraHeaders)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error":  "无效的请求数据",
+			})
+			return
+		}
+		extraHeaders = string(data)
+	}
+
+	// 空值表示恢复使用全局默认配置，三个字段一次写入，不会只更新其中一部分
+	err = config.RedisHSetFields(tokenKey, map[string]string{
+		"user_agent":    req.UserAgent,
+		"api_version":   req.APIVersion,
+		"extra_headers": extraHeaders,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新请求头配置失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
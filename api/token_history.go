@@ -0,0 +1,135 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// classifyRequestError 根据响应状态码归类请求错误
+func classifyRequestError(c *gin.Context, statusCode int) string {
+	if errorClass := c.GetString("error_class"); errorClass != "" {
+		return errorClass
+	}
+
+	switch {
+	case statusCode < 400:
+		return ""
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limited"
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return "unauthorized"
+	case statusCode == http.StatusPaymentRequired:
+		return "payment_required"
+	case statusCode < 500:
+		return "client_error"
+	default:
+		return "upstream_error"
+	}
+}
+
+// generationFailureClasses 计入token连续生成失败的错误类别
+var generationFailureClasses = map[string]bool{
+	"rate_limited":     true,
+	"unauthorized":     true,
+	"payment_required": true,
+	"upstream_error":   true,
+	"truncated":        true,
+}
+
+// trackGenerationOutcome 根据请求结果更新token的连续生成失败计数
+func trackGenerationOutcome(c *gin.Context, token string) {
+	if token == "" || config.RDB == nil {
+		return
+	}
+
+	errorClass := classifyRequestError(c, c.Writer.Status())
+	switch {
+	case errorClass == "":
+		if err := tokenmanager.ResetGenerationFailures(token); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Error("重置token失败计数失败")
+		}
+	case c.GetString(tokenmanager.GenerationFailureRecordedKey) == token:
+		// 切换token时已计入本次失败
+	case generationFailureClasses[errorClass]:
+		if _, _, err := tokenmanager.RecordGenerationFailure(token); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Error("记录token生成失败失败")
+		}
+	}
+}
+
+// recordTokenRequestHistory 在请求结束时记录token的请求摘要
+func recordTokenRequestHistory(c *gin.Context, token string) {
+	if token == "" || config.RDB == nil {
+		return
+	}
+
+	var durationMs int64
+	if start, ok := c.Get("request_start"); ok {
+		if startTime, ok := start.(time.Time); ok {
+			durationMs = time.Since(startTime).Milliseconds()
+		}
+	}
+
+	statusCode := c.Writer.Status()
+	record := tokenmanager.TokenRequestRecord{
+		Timestamp:  time.Now(),
+		Model:      c.GetString("model"),
+		Mode:       c.GetString("augment_mode"),
+		DurationMs: durationMs,
+		StatusCode: statusCode,
+		ErrorClass: classifyRequestError(c, statusCode),
+	}
+	if record.ErrorClass == "" {
+		record.ResponseChars = completionChars(c)
+	}
+
+	if err := tokenmanager.RecordTokenRequest(token, record); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("记录token请求历史失败")
+		return
+	}
+	if record.ResponseChars != nil {
+		tokenmanager.CheckOutputAnomaly(token, record.Mode)
+	}
+}
+
+// GetTokenHistoryHandler 获取指定token最近的请求记录
+func GetTokenHistoryHandler(c *gin.Context) {
+	token := tokenParam(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+
+	history, err := tokenmanager.GetTokenHistory(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token请求历史失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"token":   token,
+		"history": history,
+	})
+}
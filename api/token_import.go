@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// 可识别的token导出格式
+const (
+	// tokenFormatList 本项目的 [{"token": "...", "tenantUrl": "..."}] 格式
+	tokenFormatList = "token_list"
+	// tokenFormatSession Augment扩展保存的单个会话 {"accessToken": "...", "tenantURL": "..."}
+	tokenFormatSession = "session"
+	// tokenFormatVSCodeState VSCode扩展状态导出，会话以JSON字符串保存在 augment.sessions 等键下
+	tokenFormatVSCodeState = "vscode_state"
+	// tokenFormatLocalStorage 浏览器localStorage导出，所有值都是字符串
+	tokenFormatLocalStorage = "local_storage"
+	// tokenFormatJSON 其他结构的JSON，按字段名查找token
+	tokenFormatJSON = "json"
+)
+
+// vscodeSessionsKey Augment扩展保存会话使用的键
+const vscodeSessionsKey = "augment.sessions"
+
+var (
+	// dumpTokenFields 导出内容中可能保存token的字段名
+	dumpTokenFields = []string{"token", "accessToken", "access_token"}
+	// dumpTenantFields 导出内容中可能保存租户地址的字段名
+	dumpTenantFields = []string{"tenantUrl", "tenantURL", "tenant_url"}
+)
+
+// parseTokenDump 识别导出内容的格式并提取其中的token和租户地址，按token去重
+// 字符串形式保存的JSON会继续展开解析，因此可以直接粘贴扩展状态或localStorage的原始导出
+func parseTokenDump(body []byte) ([]TokenItem, string, error) {
+	var dump interface{}
+	if err := json.Unmarshal(body, &dump); err != nil {
+		return nil, "", err
+	}
+
+	var items []TokenItem
+	seen := make(map[string]bool)
+	collectDumpTokens(dump, 0, func(item TokenItem) {
+		if seen[item.Token] {
+			return
+		}
+		seen[item.Token] = true
+		items = append(items, item)
+	})
+	format := detectTokenDumpFormat(dump)
+	if strings.Contains(string(body), vscodeSessionsKey) {
+		format = tokenFormatVSCodeState
+	}
+	return items, format, nil
+}
+
+// hasTokenItems 列表中是否有带token的项，其他结构的数组也能解析为空的 TokenItem
+func hasTokenItems(items []TokenItem) bool {
+	for _, item := range items {
+		if item.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectTokenDumpFormat 根据导出内容的结构判断格式
+func detectTokenDumpFormat(dump interface{}) string {
+	object, ok := dump.(map[string]interface{})
+	if !ok || len(object) == 0 {
+		return tokenFormatJSON
+	}
+	if _, ok := dumpField(object, dumpTokenFields); ok {
+		return tokenFormatSession
+	}
+	for key, item := range object {
+		if strings.HasPrefix(strings.ToLower(key), "augment.") {
+			return tokenFormatVSCodeState
+		}
+		if _, ok := item.(string); !ok {
+			return tokenFormatJSON
+		}
+	}
+	return tokenFormatLocalStorage
+}
+
+// collectDumpTokens 递归查找同时带有token和租户地址字段的对象
+func collectDumpTokens(value interface{}, depth int, add func(TokenItem)) {
+	// 导出内容层级不会太深，限制深度避免异常输入
+	if depth > 8 {
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		token, hasToken := dumpField(v, dumpTokenFields)
+		tenantURL, hasTenant := dumpField(v, dumpTenantFields)
+		if hasToken && hasTenant {
+			if normalized, err := normalizeTenantURL(tenantURL); err == nil {
+				add(TokenItem{Token: token, TenantUrl: normalized})
+			}
+			return
+		}
+		for _, item := range v {
+			collectDumpTokens(item, depth+1, add)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectDumpTokens(item, depth+1, add)
+		}
+	case string:
+		// 扩展状态和localStorage中的会话以JSON字符串保存
+		trimmed := strings.TrimSpace(v)
+		if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+			return
+		}
+		var nested interface{}
+		if err := json.Unmarshal([]byte(trimmed), &nested); err == nil {
+			collectDumpTokens(nested, depth+1, add)
+		}
+	}
+}
+
+// dumpField 按候选字段名读取非空字符串字段
+func dumpField(object map[string]interface{}, names []string) (string, bool) {
+	for _, name := range names {
+		if value, ok := object[name].(string); ok && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
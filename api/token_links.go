@@ -0,0 +1,333 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
+	tokenmanager "augment2api/pkg/token"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// tokenLinkKeyPrefix 提交链接在Redis中的键前缀，链接使用后即删除
+	tokenLinkKeyPrefix = "token_link:"
+	// augmentTenantDomain 通过链接提交的token允许使用的租户域名
+	augmentTenantDomain = ".api.augmentcode.com"
+	// tokenLinkPath 第三方提交token的页面和接口路径
+	tokenLinkPath = "/submit-tokens"
+	// defaultTokenLinkTTL 提交链接默认有效期
+	defaultTokenLinkTTL = time.Hour
+	// maxTokenLinkTTL 提交链接最长有效期
+	maxTokenLinkTTL = 7 * 24 * time.Hour
+	// defaultTokenLinkMaxTokens 单个链接默认最多可提交的token数
+	defaultTokenLinkMaxTokens = 100
+)
+
+// TokenLinkRequest 创建提交链接的请求
+type TokenLinkRequest struct {
+	ExpiresIn int    `json:"expires_in"` // 有效期（分钟）
+	MaxTokens int    `json:"max_tokens"` // 最多可提交的token数
+	Remark    string `json:"remark"`     // 写入新增token的备注，例如供应商名称
+}
+
+// TokenLink 已创建的提交链接
+type TokenLink struct {
+	ID        string    `json:"id"`
+	MaxTokens int       `json:"max_tokens"`
+	Remark    string    `json:"remark,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenLinkSignature 计算提交链接的签名，密钥为访问密码，修改访问密码后所有链接失效
+func tokenLinkSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.AccessPwd))
+	mac.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyTokenLink 校验链接参数的签名和有效期，返回链接ID
+func verifyTokenLink(c *gin.Context) (string, bool) {
+	id := c.Query("id")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if id == "" || err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	expected := tokenLinkSignature(id, expires)
+	if !hmac.Equal([]byte(expected), []byte(c.Query("sig"))) {
+		return "", false
+	}
+	return id, true
+}
+
+// CreateTokenLinkHandler 创建一次性、有过期时间的签名链接，供第三方提交token而无需管理权限
+func CreateTokenLinkHandler(c *gin.Context) {
+	var req TokenLinkRequest
+	// 请求体可以为空，全部使用默认值
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	ttl := defaultTokenLinkTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Minute
+	}
+	if ttl > maxTokenLinkTTL {
+		ttl = maxTokenLinkTTL
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = defaultTokenLinkMaxTokens
+	}
+
+	now := time.Now()
+	link := TokenLink{
+		ID:        uuid.New().String(),
+		MaxTokens: req.MaxTokens,
+		Remark:    req.Remark,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	data, err := json.Marshal(link)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "创建提交链接失败: " + err.Error(),
+		})
+		return
+	}
+	if err := config.RedisSet(tokenLinkKeyPrefix+link.ID, string(data), ttl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "创建提交链接失败: " + err.Error(),
+		})
+		return
+	}
+
+	expires := link.ExpiresAt.Unix()
+	query := url.Values{}
+	query.Set("id", link.ID)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", tokenLinkSignature(link.ID, expires))
+	path := tokenLinkPath + "?" + query.Encode()
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "token_link_created",
+		Target: link.ID,
+		Detail: map[string]interface{}{
+			"max_tokens": link.MaxTokens,
+			"remark":     link.Remark,
+			"expires_at": link.ExpiresAt,
+		},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"link":   link,
+		"path":   path,
+	})
+}
+
+// RevokeTokenLinkHandler 撤销尚未使用的提交链接
+func RevokeTokenLinkHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := config.RedisDel(tokenLinkKeyPrefix + id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "撤销提交链接失败: " + err.Error(),
+		})
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "token_link_revoked",
+		Target: id,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// tokenLinkFormHTML 第三方提交token的最简页面，每行一个 token,tenant_url
+const tokenLinkFormHTML = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>Augment2Api - 提交token</title>
+<style>
+body { font-family: 'PingFang SC', 'Microsoft YaHei', -apple-system, sans-serif; max-width: 640px; margin: 40px auto; padding: 0 20px; color: #333; }
+textarea { width: 100%; height: 240px; font-family: monospace; }
+button { margin-top: 12px; padding: 8px 24px; background: #4361ee; color: #fff; border: none; border-radius: 6px; cursor: pointer; }
+#result { margin-top: 12px; }
+</style>
+</head>
+<body>
+<h2>提交token</h2>
+<p>每行一个，格式为 <code>token,tenant_url</code>。链接只能提交一次。</p>
+<textarea id="tokens" placeholder="token,https://d1.api.augmentcode.com/"></textarea>
+<button id="submit">提交</button>
+<div id="result"></div>
+<script>
+document.getElementById('submit').onclick = function () {
+  var items = document.getElementById('tokens').value.split('\n').map(function (line) {
+    var parts = line.split(',');
+    return { token: (parts[0] || '').trim(), tenantUrl: (parts[1] || '').trim() };
+  }).filter(function (item) { return item.token; });
+  this.disabled = true;
+  fetch(location.href, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(items) })
+    .then(function (resp) { return resp.json(); })
+    .then(function (data) {
+      document.getElementById('result').textContent = data.status === 'success'
+        ? '已提交 ' + data.accepted + ' / ' + data.total + ' 个token，正在后台检测'
+        : '提交失败: ' + data.error;
+    });
+};
+</script>
+</body>
+</html>`
+
+// TokenLinkFormHandler 展示提交token的页面，链接无效或已使用时返回404
+func TokenLinkFormHandler(c *gin.Context) {
+	id, ok := verifyTokenLink(c)
+	if ok {
+		ok, _ = config.RedisExists(tokenLinkKeyPrefix + id)
+	}
+	if !ok {
+		c.String(http.StatusNotFound, "链接无效、已过期或已被使用")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(tokenLinkFormHTML))
+}
+
+// SubmitTokensViaLinkHandler 通过提交链接添加token，链接使用一次后失效；token由后台导入任务检测，接口返回任务ID，
+// 且不会返回池中已有token的任何信息
+func SubmitTokensViaLinkHandler(c *gin.Context) {
+	id, ok := verifyTokenLink(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "链接无效或已过期",
+		})
+		return
+	}
+
+	var tokens []TokenItem
+	if err := c.ShouldBindJSON(&tokens); err != nil || len(tokens) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	// 检测在后台任务中完成，任务不可用时不使链接失效
+	if !job.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "error",
+			"error":  "后台任务不可用，请稍后再试",
+		})
+		return
+	}
+
+	// 校验请求后再使链接失效，避免格式错误浪费链接
+	data, err := config.RedisGetDel(tokenLinkKeyPrefix + id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "链接已被使用或已撤销",
+		})
+		return
+	}
+	var link TokenLink
+	if err := json.Unmarshal([]byte(data), &link); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "读取提交链接失败",
+		})
+		return
+	}
+
+	if len(tokens) > link.MaxTokens {
+		tokens = tokens[:link.MaxTokens]
+	}
+
+	// 提交时只检查格式和租户域名，检测和查重由后台导入任务完成，返回结果不透露池中已有哪些token
+	items := make([]TokenItem, 0, len(tokens))
+	for _, item := range tokens {
+		if item, ok := linkTokenItem(item, link.Remark); ok {
+			items = append(items, item)
+		}
+	}
+
+	response := gin.H{
+		"status":   "success",
+		"total":    len(tokens),
+		"accepted": len(items),
+	}
+	detail := map[string]interface{}{
+		"total":     len(tokens),
+		"accepted":  len(items),
+		"client_ip": c.ClientIP(),
+	}
+	if len(items) > 0 {
+		j, err := enqueueTokenImport(items, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error":  "提交检测任务失败",
+			})
+			return
+		}
+		response["job_id"] = j.ID
+		detail["job_id"] = j.ID
+	}
+
+	audit.Record(audit.Entry{
+		Actor:  tokenLinkKeyPrefix + id,
+		Action: "tokens_submitted",
+		Target: link.Remark,
+		Detail: detail,
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+// augmentTenantURL 租户地址是否为Augment的API域名，提交链接不需要登录，不能让提交者指定任意上游地址
+func augmentTenantURL(tenantURL string) bool {
+	parsed, err := url.Parse(tenantURL)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(parsed.Hostname()), augmentTenantDomain)
+}
+
+// linkTokenItem 整理通过链接提交的token，token为空或租户地址不是Augment的API域名时返回false
+func linkTokenItem(item TokenItem, remark string) (TokenItem, bool) {
+	token := tokenmanager.NormalizeToken(item.Token)
+	if token == "" || item.TenantUrl == "" {
+		return TokenItem{}, false
+	}
+	tenantURL, err := normalizeTenantURL(item.TenantUrl)
+	if err != nil || !augmentTenantURL(tenantURL) {
+		return TokenItem{}, false
+	}
+	return TokenItem{Token: token, TenantUrl: tenantURL, Remark: remark}, true
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/job"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenImportJobType 后台添加并校验token的任务
+	tokenImportJobType = "token_import"
+	// maxSubscriptionInfoBytes 保存的订阅信息最大字节数
+	maxSubscriptionInfoBytes = 4 << 10
+)
+
+// 后台导入中每个token的处理结果
+const (
+	importStatusPending   = "pending"
+	importStatusActive    = "active"
+	importStatusInvalid   = "invalid"
+	importStatusSuspect   = "suspect"
+	importStatusDepleted  = "depleted"
+	importStatusNoTenant  = "tenant_not_found"
+	importStatusSaveError = "save_failed"
+	importStatusExisting  = "existing"
+)
+
+// tokenImportPayload 后台导入任务的参数
+type tokenImportPayload struct {
+	Items []TokenItem `json:"items"`
+	// Link 通过提交链接提交时为链接ID，与池中已有token重复的不保存，检测未通过的token删除
+	Link string `json:"link,omitempty"`
+}
+
+// TokenImportItem 后台导入中一个token的处理结果
+type TokenImportItem struct {
+	Token        string `json:"token"` // 隐藏中间部分的token
+	Status       string `json:"status"`
+	TenantURL    string `json:"tenant_url,omitempty"`
+	Subscription string `json:"subscription,omitempty"` // 订阅到期时间，获取失败时为空
+	Error        string `json:"error,omitempty"`
+}
+
+// TokenImportResult 后台导入任务的进度和结果
+type TokenImportResult struct {
+	Total     int               `json:"total"`
+	Processed int               `json:"processed"`
+	Active    int               `json:"active"`
+	Items     []TokenImportItem `json:"items"`
+}
+
+// enqueueTokenImport 提交后台导入任务，link为提交链接的ID，管理员导入时为空
+func enqueueTokenImport(items []TokenItem, link string) (*job.Job, error) {
+	return job.Enqueue(tokenImportJobType, adminJobOwner, tokenImportPayload{Items: items, Link: link})
+}
+
+// runTokenImportJob 依次处理每个token：以禁用状态保存并写入备注，检测租户地址，检测通过时启用，
+// 再获取订阅信息，额度已用完时按 REMOVE_FREE 禁用；每处理完一个保存进度，重试时跳过已处理的token
+func runTokenImportJob(ctx context.Context, j *job.Job) error {
+	var payload tokenImportPayload
+	if err := j.DecodePayload(&payload); err != nil || len(payload.Items) == 0 {
+		return job.Permanent(errors.New("无效的任务参数"))
+	}
+
+	result := TokenImportResult{Total: len(payload.Items)}
+	if len(j.Result) > 0 {
+		json.Unmarshal(j.Result, &result)
+	}
+	if len(result.Items) != len(payload.Items) {
+		result.Items = make([]TokenImportItem, len(payload.Items))
+		for i, item := range payload.Items {
+			result.Items[i] = TokenImportItem{Token: maskToken(item.Token), Status: importStatusPending}
+		}
+	}
+
+	// 链接提交的token需要与池中已有token查重
+	var pool map[string]string
+	if payload.Link != "" {
+		var err error
+		if pool, err = tokenmanager.PoolTenantURLs(); err != nil {
+			return err
+		}
+	}
+
+	for i, item := range payload.Items {
+		if result.Items[i].Status != importStatusPending {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if payload.Link != "" {
+			result.Items[i] = importLinkToken(item, pool)
+		} else {
+			result.Items[i] = importToken(item)
+		}
+		result.Processed++
+		if result.Items[i].Status == importStatusActive {
+			result.Active++
+		}
+		if err := j.Checkpoint(result); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"job":   j.ID,
+				"error": err.Error(),
+			}).Warn("保存导入进度失败")
+		}
+	}
+
+	actor := "admin"
+	if payload.Link != "" {
+		actor = tokenLinkKeyPrefix + payload.Link
+	}
+	audit.Record(audit.Entry{
+		Actor:  actor,
+		Action: "tokens_imported",
+		Target: j.ID,
+		Detail: map[string]interface{}{"total": result.Total, "active": result.Active},
+	})
+	return j.SetResult(result)
+}
+
+// importToken 处理后台导入的一个token
+func importToken(item TokenItem) TokenImportItem {
+	result := TokenImportItem{Token: maskToken(item.Token)}
+	tokenKey := "token:" + item.Token
+
+	// 校验通过前保持禁用，不参与调度
+	sessionID := uuid.New().String()
+	fields := map[string]string{
+		"tenant_url": item.TenantUrl,
+		"session_id": sessionID,
+		"status":     "disabled",
+		"remark":     item.Remark,
+	}
+	if err := config.RedisHSetFields(tokenKey, fields); err != nil {
+		result.Status, result.Error = importStatusSaveError, err.Error()
+		return result
+	}
+
+	tenantURL, err := CheckTokenTenantURL(item.Token, sessionID)
+	switch {
+	case errors.Is(err, errTokenSuspect):
+		result.Status = importStatusSuspect
+		return result
+	case errors.Is(err, errTokenInvalid):
+		result.Status = importStatusInvalid
+		return result
+	case err != nil:
+		result.Status, result.Error = importStatusNoTenant, err.Error()
+		tokenmanager.DisableToken(item.Token, "tenant_url_not_found")
+		return result
+	}
+	result.TenantURL = tenantURL
+	result.Status = importStatusActive
+	tokenmanager.PublishTokenEvent(tokenmanager.EventAdded, item.Token, map[string]interface{}{
+		"tenant_url": tenantURL,
+	})
+
+	info, err := fetchSubscriptionInfo(item.Token, tenantURL, sessionID)
+	if err != nil {
+		result.Error = "获取订阅信息失败: " + err.Error()
+		return result
+	}
+	result.Subscription = info.EndDate
+	if info.Depleted && config.AppConfig.RemoveFree == "true" {
+		tokenmanager.DisableToken(item.Token, "subscription_depleted")
+		result.Status = importStatusDepleted
+	}
+	return result
+}
+
+// importLinkToken 处理通过提交链接提交的一个token：池中已有或与已有token相近的不保存，
+// 检测未通过时删除，不在池中留下提交者的无效token；检测通过的token记入pool，用于后续token查重
+func importLinkToken(item TokenItem, pool map[string]string) TokenImportItem {
+	if collision, found := tokenmanager.FindCollision(item.Token, pool); found {
+		if collision.Kind != tokenmanager.CollisionExact {
+			logger.Log.WithFields(logrus.Fields{
+				"token":    tokenmanager.Fingerprint(item.Token),
+				"existing": tokenmanager.Fingerprint(collision.Existing),
+				"kind":     collision.Kind,
+			}).Warn("通过提交链接提交的token与已有token相近，未保存")
+		}
+		return TokenImportItem{Token: maskToken(item.Token), Status: importStatusExisting}
+	}
+
+	result := importToken(item)
+	switch result.Status {
+	case importStatusActive, importStatusDepleted:
+		pool[item.Token] = result.TenantURL
+	default:
+		config.RedisDel("token:" + item.Token)
+	}
+	return result
+}
+
+// subscriptionInfo 从订阅信息中提取的字段
+type subscriptionInfo struct {
+	EndDate  string
+	Depleted bool
+}
+
+// fetchSubscriptionInfo 获取token的订阅信息并保存到token记录，提取到期时间和额度是否已用完
+func fetchSubscriptionInfo(token, tenantURL, sessionID string) (subscriptionInfo, error) {
+	var info subscriptionInfo
+	req, err := http.NewRequest("POST", tenantURL+"subscription-info", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
+	applyTokenHeaderOverrides(req, token)
+	req.Header.Set("x-request-id", uuid.New().String())
+	req.Header.Set("x-request-session-id", sessionID)
+
+	resp, err := createHTTPClient().Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionInfoBytes))
+	if err != nil {
+		return info, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return info, err
+	}
+	info.EndDate, _ = findJSONValue(parsed, "end_date").(string)
+	info.Depleted, _ = findJSONValue(parsed, "usage_balance_depleted").(bool)
+
+	tokenKey := "token:" + token
+	config.RedisHSet(tokenKey, "subscription_info", string(body))
+	config.RedisHSet(tokenKey, "subscription_checked_at", time.Now().Format(time.RFC3339))
+	return info, nil
+}
+
+// findJSONValue 在JSON中按字段名查找第一个值，订阅信息的结构可能嵌套在不同层级
+func findJSONValue(value interface{}, name string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if found, ok := v[name]; ok {
+			return found
+		}
+		for _, child := range v {
+			if found := findJSONValue(child, name); found != nil {
+				return found
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if found := findJSONValue(child, name); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// TokenImportJobHandler 查询后台导入任务的进度和结果
+func TokenImportJobHandler(c *gin.Context) {
+	j, err := job.Get(c.Param("id"))
+	if err != nil || j.Type != tokenImportJobType {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "导入任务不存在",
+		})
+		return
+	}
+
+	response := gin.H{
+		"status":     "success",
+		"job_id":     j.ID,
+		"job_status": j.Status,
+		"attempts":   j.Attempts,
+		"created_at": j.CreatedAt,
+		"updated_at": j.UpdatedAt,
+	}
+	if len(j.Result) > 0 {
+		var result TokenImportResult
+		if json.Unmarshal(j.Result, &result) == nil {
+			response["result"] = result
+			response["progress"] = strconv.Itoa(result.Processed) + "/" + strconv.Itoa(result.Total)
+		}
+	}
+	if j.Error != "" {
+		response["last_error"] = j.Error
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/audit"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// maxReactivationNoteBytes 重新启用说明的最大字节数
+const maxReactivationNoteBytes = 1000
+
+// TokenReactivateRequest 重新启用token的请求体
+type TokenReactivateRequest struct {
+	Note  string `json:"note"`  // 重新启用的原因，必填
+	Force bool   `json:"force"` // 订阅额度已用完时仍然启用
+}
+
+// ReactivationEvidence 重新启用前的校验结果，随审计日志一起保存
+type ReactivationEvidence struct {
+	CheckedAt            time.Time `json:"checked_at"`
+	DisabledAt           string    `json:"disabled_at,omitempty"`
+	DisableReason        string    `json:"disable_reason,omitempty"` // 最近一次禁用的原因
+	CheckResult          string    `json:"check_result"`             // valid / invalid / suspect / failed / skipped
+	CheckError           string    `json:"check_error,omitempty"`
+	TenantURL            string    `json:"tenant_url,omitempty"`
+	SubscriptionEndDate  string    `json:"subscription_end_date,omitempty"`
+	SubscriptionDepleted bool      `json:"subscription_depleted"`
+	SubscriptionError    string    `json:"subscription_error,omitempty"`
+}
+
+// lastDisableReason token最近一次禁用的原因
+func lastDisableReason(token string) string {
+	records, err := tokenmanager.GetTokenEvents(token)
+	if err != nil {
+		return ""
+	}
+	for _, record := range records {
+		if record.Type == tokenmanager.EventDisabled {
+			reason, _ := record.Detail["reason"].(string)
+			return reason
+		}
+	}
+	return ""
+}
+
+// ReactivateTokenHandler 重新校验被禁用的token，校验通过后恢复为可用
+// 必须填写说明；订阅额度已用完时除非指定 force 否则不启用，校验结果和说明记录到审计日志
+func ReactivateTokenHandler(c *gin.Context) {
+	token := tokenParam(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+
+	var req TokenReactivateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if req.Note == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "必须填写重新启用的原因",
+		})
+		return
+	}
+	if len(req.Note) > maxReactivationNoteBytes {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "说明过长，最多 " + strconv.Itoa(maxReactivationNoteBytes) + " 字节",
+		})
+		return
+	}
+
+	tokenKey := "token:" + token
+	fields, err := config.RedisHGetAll(tokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token信息失败: " + err.Error(),
+		})
+		return
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+	if fields["status"] != "disabled" {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  "token未被禁用",
+		})
+		return
+	}
+
+	evidence := ReactivationEvidence{
+		CheckedAt:     time.Now(),
+		DisabledAt:    fields["disabled_at"],
+		DisableReason: lastDisableReason(token),
+		CheckResult:   "skipped",
+	}
+	sessionID := fields["session_id"]
+
+	// 先检查订阅，额度已用完的token启用后也无法使用
+	if tenantURL := fields["tenant_url"]; tenantURL != "" {
+		info, err := fetchSubscriptionInfo(token, tenantURL, sessionID)
+		if err != nil {
+			evidence.SubscriptionError = err.Error()
+		}
+		evidence.SubscriptionEndDate = info.EndDate
+		evidence.SubscriptionDepleted = info.Depleted
+	}
+	if evidence.SubscriptionDepleted && !req.Force {
+		rejectReactivation(c, token, req, evidence, "订阅额度已用完，确认需要启用时请指定 force")
+		return
+	}
+
+	// 检测通过时 CheckTokenTenantURL 会更新租户地址并将token标记为可用
+	tenantURL, err := CheckTokenTenantURL(token, sessionID)
+	switch {
+	case err == nil:
+		evidence.CheckResult = "valid"
+		evidence.TenantURL = tenantURL
+	case errors.Is(err, errTokenSuspect):
+		evidence.CheckResult = "suspect"
+	case errors.Is(err, errTokenInvalid):
+		evidence.CheckResult = "invalid"
+	default:
+		evidence.CheckResult = "failed"
+		evidence.CheckError = err.Error()
+	}
+	if err != nil {
+		rejectReactivation(c, token, req, evidence, "token校验未通过，保持禁用")
+		return
+	}
+
+	config.RedisHDel(tokenKey, "disabled_at")
+	tokenmanager.PublishTokenEvent(tokenmanager.EventReactivated, token, map[string]interface{}{
+		"note":       req.Note,
+		"tenant_url": tenantURL,
+	})
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "token_reactivated",
+		Target: tokenFingerprint(token),
+		Detail: map[string]interface{}{"note": req.Note, "force": req.Force, "evidence": evidence},
+	})
+	logger.Log.WithFields(logrus.Fields{
+		"token":          maskToken(token),
+		"disable_reason": evidence.DisableReason,
+		"tenant_url":     tenantURL,
+	}).Info("token已重新启用")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"evidence": evidence,
+	})
+}
+
+// rejectReactivation 校验未通过时不启用token，同样记录审计日志便于追溯
+func rejectReactivation(c *gin.Context, token string, req TokenReactivateRequest, evidence ReactivationEvidence, message string) {
+	audit.Record(audit.Entry{
+		Actor:  "admin",
+		Action: "token_reactivation_rejected",
+		Target: tokenFingerprint(token),
+		Detail: map[string]interface{}{"note": req.Note, "force": req.Force, "evidence": evidence},
+	})
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"status":   "error",
+		"error":    message,
+		"evidence": evidence,
+	})
+}
@@ -2,12 +2,28 @@ package api
 
 import (
 	"augment2api/config"
+	"augment2api/pkg/leader"
 	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"time"
 
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 )
 
+// tokenUsageResetSpec 重置token使用次数的cron表达式，每月1号零点一分执行
+// 格式：秒 分 时 日 月 周
+const tokenUsageResetSpec = "0 1 0 1 * *"
+
+// nextTokenUsageReset 下一次重置token使用次数的时间
+func nextTokenUsageReset(now time.Time) time.Time {
+	schedule, err := cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow).Parse(tokenUsageResetSpec)
+	if err != nil {
+		return now
+	}
+	return schedule.Next(now)
+}
+
 // ResetTokenUsage 重置所有token的使用次数
 func ResetTokenUsage() error {
 	// 获取所有token的key
@@ -16,6 +32,13 @@ func ResetTokenUsage() error {
 		return err
 	}
 
+	// 先写入内存中累加的计数，避免重置后再被写回
+	if err := tokenmanager.FlushUsage(); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("重置前写入使用计数失败")
+	}
+
 	for _, key := range keys {
 		// 从key中提取token
 		token := key[6:] // 去掉前缀 "token:"
@@ -52,6 +75,7 @@ func ResetTokenUsage() error {
 			}).Error("重置Token AGENT模式使用次数失败")
 			continue
 		}
+		tokenmanager.DiscardUsage(totalUsageKey, chatUsageKey, agentUsageKey)
 
 		logger.Log.WithFields(logrus.Fields{
 			"token": token,
@@ -67,8 +91,12 @@ func StartTokenUsageResetScheduler() {
 	c := cron.New(cron.WithSeconds()) // 启用秒级精度
 
 	// 添加定时任务，每月1号零点一分执行
-	// 格式：秒 分 时 日 月 周
-	_, err := c.AddFunc("0 1 0 1 * *", func() {
+	_, err := c.AddFunc(tokenUsageResetSpec, func() {
+		// 多实例部署时只在主实例执行
+		if !leader.IsLeader() {
+			return
+		}
+
 		logger.Log.Info("开始执行Token使用次数重置任务")
 		err := ResetTokenUsage()
 		if err != nil {
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"augment2api/pkg/audit"
+	tokenmanager "augment2api/pkg/token"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultTimelineBuckets 未指定分桶大小时的分桶数
+	defaultTimelineBuckets = 48
+	// maxTimelineBuckets 单次返回的最大分桶数
+	maxTimelineBuckets = 1000
+	// maxTimelineHours 时间线最长覆盖的小时数
+	maxTimelineHours = 30 * 24
+)
+
+// TimelineBucket 时间线中一个时间段内各类事件的次数
+type TimelineBucket struct {
+	Start         time.Time `json:"start"`
+	Requests      int       `json:"requests"`
+	Errors        int       `json:"errors"`
+	Cooldowns     int       `json:"cooldowns"`
+	Disables      int       `json:"disables"`
+	Checks        int       `json:"checks"`
+	CheckFailures int       `json:"check_failures"`
+	AdminActions  int       `json:"admin_actions"`
+}
+
+// TimelineEvent 时间线中的非请求事件，用于在图表上标注
+type TimelineEvent struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Type      string                 `json:"type"`
+	Source    string                 `json:"source"` // token 或 audit
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+}
+
+// timelineRange 解析时间线的时间范围和分桶大小
+func timelineRange(c *gin.Context) (time.Duration, time.Duration) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	span := time.Duration(min(hours, maxTimelineHours)) * time.Hour
+
+	bucket, err := time.ParseDuration(c.Query("bucket"))
+	if err != nil || bucket <= 0 {
+		bucket = span / defaultTimelineBuckets
+	}
+	bucket = max(bucket.Truncate(time.Minute), time.Minute)
+	// 分桶过小时放大到最大分桶数
+	if span/bucket > maxTimelineBuckets {
+		bucket = (span + maxTimelineBuckets - 1) / maxTimelineBuckets
+	}
+	return span, bucket
+}
+
+// auditTargetsToken 审计日志是否与该token相关，审计日志中的token以指纹记录
+func auditTargetsToken(entry audit.Entry, fingerprint string) bool {
+	if entry.Target == fingerprint {
+		return true
+	}
+	value, ok := entry.Detail["token"].(string)
+	return ok && value == fingerprint
+}
+
+// GetTokenTimelineHandler 按时间分桶汇总token的请求、冷却、禁用、检测和管理操作，供管理页面绘制图表
+// 请求和状态变化记录只保留最近若干条，coverage 给出各类记录实际覆盖的起始时间
+func GetTokenTimelineHandler(c *gin.Context) {
+	token := tokenParam(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+
+	span, bucketSize := timelineRange(c)
+	to := time.Now().Truncate(bucketSize).Add(bucketSize)
+	from := to.Add(-span).Truncate(bucketSize)
+	buckets := make([]TimelineBucket, int(to.Sub(from)/bucketSize))
+	for i := range buckets {
+		buckets[i].Start = from.Add(time.Duration(i) * bucketSize)
+	}
+	bucketAt := func(t time.Time) *TimelineBucket {
+		if t.Before(from) || !t.Before(to) {
+			return nil
+		}
+		return &buckets[int(t.Sub(from)/bucketSize)]
+	}
+
+	history, err := tokenmanager.GetTokenHistory(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token请求历史失败: " + err.Error(),
+		})
+		return
+	}
+	tokenEvents, err := tokenmanager.GetTokenEvents(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token状态变化记录失败: " + err.Error(),
+		})
+		return
+	}
+	auditEntries, err := audit.List(audit.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取审计日志失败: " + err.Error(),
+		})
+		return
+	}
+
+	coverage := gin.H{}
+	for _, record := range history {
+		if bucket := bucketAt(record.Timestamp); bucket != nil {
+			bucket.Requests++
+			if record.ErrorClass != "" || record.StatusCode >= 400 {
+				bucket.Errors++
+			}
+		}
+	}
+	if len(history) >= tokenmanager.HistoryLimit {
+		coverage["requests_since"] = history[len(history)-1].Timestamp
+	}
+
+	var events []TimelineEvent
+	for i := len(tokenEvents) - 1; i >= 0; i-- {
+		record := tokenEvents[i]
+		bucket := bucketAt(record.Timestamp)
+		if bucket == nil {
+			continue
+		}
+		switch record.Type {
+		case tokenmanager.EventCooled:
+			bucket.Cooldowns++
+		case tokenmanager.EventDisabled:
+			bucket.Disables++
+		case tokenmanager.EventChecked:
+			bucket.Checks++
+			if record.Detail["result"] != "valid" {
+				bucket.CheckFailures++
+			}
+		}
+		events = append(events, TimelineEvent{
+			Timestamp: record.Timestamp,
+			Type:      record.Type,
+			Source:    "token",
+			Detail:    record.Detail,
+		})
+	}
+	if len(tokenEvents) >= tokenmanager.EventLogLimit {
+		coverage["events_since"] = tokenEvents[len(tokenEvents)-1].Timestamp
+	}
+
+	fingerprint := tokenFingerprint(token)
+	for i := len(auditEntries) - 1; i >= 0; i-- {
+		entry := auditEntries[i]
+		bucket := bucketAt(entry.Timestamp)
+		if bucket == nil || !auditTargetsToken(entry, fingerprint) {
+			continue
+		}
+		bucket.AdminActions++
+		events = append(events, TimelineEvent{
+			Timestamp: entry.Timestamp,
+			Type:      entry.Action,
+			Source:    "audit",
+			Detail:    entry.Detail,
+		})
+	}
+	if len(auditEntries) >= audit.Limit {
+		coverage["audit_since"] = auditEntries[len(auditEntries)-1].Timestamp
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "success",
+		"token":          fingerprint,
+		"from":           from,
+		"to":             to,
+		"bucket_seconds": int64(bucketSize.Seconds()),
+		"buckets":        buckets,
+		"events":         events,
+		"coverage":       coverage,
+	})
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/convert"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Augment响应节点中与工具调用相关的类型
+const (
+	// nodeTypeToolUse 参数已完整输出的工具调用
+	nodeTypeToolUse = 5
+	// nodeTypeToolUseStart 工具调用开始，参数可能还未输出或只输出了一部分
+	nodeTypeToolUseStart = 7
+)
+
+// OpenAIToolCall OpenAI格式的工具调用
+type OpenAIToolCall struct {
+	Index    *int                   `json:"index,omitempty"`
+	ID       string                 `json:"id"`
+	Type     string                 `json:"type"`
+	Function OpenAIToolCallFunction `json:"function"`
+}
+
+// OpenAIToolCallFunction 工具调用的函数名和参数
+type OpenAIToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// stopOnToolEnabled AGENT模式下是否在收到完整的工具调用后立即结束上游输出
+func stopOnToolEnabled(c *gin.Context) bool {
+	return config.AppConfig.StopOnTool == "true" && c.GetString("augment_mode") == "AGENT"
+}
+
+// completedToolUse 返回响应分块中已完整输出的工具调用
+func completedToolUse(augmentResp AugmentResponse) *ToolUse {
+	for _, node := range augmentResp.Nodes {
+		if node.ToolUse.ToolName != "" && node.Type != nodeTypeToolUseStart {
+			toolUse := node.ToolUse
+			if toolUse.ToolUseID == "" {
+				toolUse.ToolUseID = fmt.Sprintf("call_%d", time.Now().UnixNano())
+			}
+			if toolUse.InputJSON == "" {
+				toolUse.InputJSON = "{}"
+			}
+			return &toolUse
+		}
+	}
+	return nil
+}
+
+// toOpenAIToolCall 转换为OpenAI格式的工具调用
+func toOpenAIToolCall(toolUse *ToolUse, index *int) OpenAIToolCall {
+	return OpenAIToolCall{
+		Index: index,
+		ID:    toolUse.ToolUseID,
+		Type:  "function",
+		Function: OpenAIToolCallFunction{
+			Name:      toolUse.ToolName,
+			Arguments: toolUse.InputJSON,
+		},
+	}
+}
+
+// toolEvents 提取响应分块中的工具调用数据
+func toolEvents(augmentResp AugmentResponse) []convert.ToolEvent {
+	var events []convert.ToolEvent
+	for _, node := range augmentResp.Nodes {
+		if node.ToolUse.ToolName == "" && node.ToolUse.ToolUseID == "" {
+			continue
+		}
+		events = append(events, convert.ToolEvent{
+			ID:       node.ToolUse.ToolUseID,
+			Name:     node.ToolUse.ToolName,
+			Input:    node.ToolUse.InputJSON,
+			Complete: node.Type != nodeTypeToolUseStart,
+		})
+	}
+	return events
+}
+
+// openAIToolStream 将上游输出转换为OpenAI流式分块，AGENT模式下的工具调用转换为增量的 tool_calls，
+// 第一个分块带有id和函数名，之后按 index 输出参数片段，便于客户端SDK逐步解析工具调用
+type openAIToolStream struct {
+	stream  *convert.OpenAIStream
+	enabled bool
+	calls   convert.ToolCallTranscriber
+}
+
+// newOpenAIToolStream 创建流式输出，只有AGENT模式才输出工具调用
+func newOpenAIToolStream(c *gin.Context, responseID, model string) *openAIToolStream {
+	return &openAIToolStream{
+		stream:  convert.NewOpenAIStream(responseID, model),
+		enabled: c.GetString("augment_mode") == "AGENT",
+	}
+}
+
+// write 输出一个上游分块，文本在工具调用之前输出，上游结束时带上完成原因
+func (s *openAIToolStream) write(c *gin.Context, augmentResp AugmentResponse) {
+	var deltas []convert.ToolCallDelta
+	if s.enabled {
+		for _, event := range toolEvents(augmentResp) {
+			deltas = append(deltas, s.calls.Transcribe(event)...)
+		}
+	}
+	finishReason := ""
+	if augmentResp.Done {
+		finishReason = s.finishReason(c)
+	}
+
+	if len(deltas) == 0 {
+		c.Writer.Write(s.stream.Chunk(augmentResp.Text, finishReason))
+		return
+	}
+	if augmentResp.Text != "" {
+		c.Writer.Write(s.stream.Chunk(augmentResp.Text, ""))
+	}
+	c.Writer.Write(s.stream.ToolCalls(deltas))
+	if finishReason != "" {
+		c.Writer.Write(s.stream.Chunk("", finishReason))
+	}
+}
+
+// finishReason 输出过工具调用时以 tool_calls 结束，这类回复不参与回复长度统计
+func (s *openAIToolStream) finishReason(c *gin.Context) string {
+	if s.calls.Count() == 0 {
+		return "stop"
+	}
+	c.Set("tool_use_stop", true)
+	return "tool_calls"
+}
+
+// writeOpenAIToolCallStop 输出剩余文本和工具调用尚未输出的部分，并以 tool_calls 结束流，completion为本次已生成的全部文本
+func writeOpenAIToolCallStop(c *gin.Context, flusher http.Flusher, tools *openAIToolStream, text, completion string, toolUse *ToolUse) {
+	if text != "" {
+		c.Writer.Write(tools.stream.Chunk(text, ""))
+	}
+	deltas := tools.calls.Transcribe(convert.ToolEvent{
+		ID:       toolUse.ToolUseID,
+		Name:     toolUse.ToolName,
+		Input:    toolUse.InputJSON,
+		Complete: true,
+	})
+	if len(deltas) > 0 {
+		c.Writer.Write(tools.stream.ToolCalls(deltas))
+	}
+	c.Writer.Write(tools.stream.Chunk("", tools.finishReason(c)))
+	writeOpenAIStreamDone(c, tools.stream.ID, tools.stream.Model, completion)
+	flusher.Flush()
+}
+
+// writeAnthropicToolUseStop 输出剩余文本和tool_use内容块，并以 tool_use 结束消息，completion为本次已生成的全部文本
+func writeAnthropicToolUseStop(c *gin.Context, flusher http.Flusher, text, completion string, toolUse *ToolUse) {
+	var input interface{}
+	if err := json.Unmarshal([]byte(toolUse.InputJSON), &input); err != nil {
+		input = map[string]interface{}{}
+	}
+
+	c.Writer.Write(convert.AnthropicToolUseStop(text, convert.ToolUse{
+		ID:    toolUse.ToolUseID,
+		Name:  toolUse.ToolName,
+		Input: input,
+	}, estimateTokenCount(completion+text)))
+	flusher.Flush()
+}
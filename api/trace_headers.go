@@ -0,0 +1,97 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/apikey"
+	tokenmanager "augment2api/pkg/token"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDebugPayloadSize 调试响应头中返回的请求体最大长度，base64编码后约5.5KB，低于常见代理8KB的响应头上限
+const maxDebugPayloadSize = 4 * 1024
+
+// traceHeadersEnabled 是否在响应头中返回请求追踪信息，开启调试开关或使用管理密钥时返回
+func traceHeadersEnabled(c *gin.Context) bool {
+	if config.AppConfig.TraceHeaders == "true" {
+		return true
+	}
+	return apikey.IsPrivileged(currentAPIKey(c), c.GetString("api_key"))
+}
+
+// tokenFingerprint 返回token的短指纹，用于关联请求而不暴露token
+func tokenFingerprint(token string) string {
+	return tokenmanager.Fingerprint(token)
+}
+
+// doUpstream 发送上游请求，记录上游耗时并按需写入追踪响应头，请求被管理员取消时中断上游连接
+// 响应体开始输出前最后一次写入的值生效，即最终使用的token和分片
+// 已超出总耗时预算时不再发送，重试和降级请求都受同一个截止时间约束
+// 每次请求单独计算空闲超时，上游长时间没有输出时中断该次请求
+// 开启分片并发限制时，请求在响应体关闭前计入所在分片的并发数
+func doUpstream(c *gin.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx := upstreamContext(c)
+	if err := budgetError(ctx, nil); err != nil {
+		return nil, err
+	}
+	c.Set("upstream_overloaded", false)
+	start := time.Now()
+	attemptCtx, watch := startIdleWatch(ctx)
+	endShardSlot := beginShardSlot(c, req.URL.Host)
+	setPayloadDebugHeader(c, req)
+	resp, err := client.Do(req.WithContext(attemptCtx))
+	if err != nil {
+		err = budgetError(ctx, watch.wrapErr(err))
+		watch.stop()
+		endShardSlot(nil)
+	} else {
+		watch.wrapBody(resp)
+		endShardSlot(resp)
+	}
+	upstreamMs := time.Since(start).Milliseconds()
+	c.Set("upstream_ms", upstreamMs)
+	if err == nil {
+		detectUpstreamOverload(c, req, resp)
+		watchFirstToken(c, resp, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), req.URL.Host, start)
+	}
+
+	if traceHeadersEnabled(c) {
+		header := c.Writer.Header()
+		header.Set("X-Augment-Shard", req.URL.Host)
+		header.Set("X-Augment-Token", tokenFingerprint(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")))
+		header.Set("X-Retry-Count", strconv.Itoa(c.GetInt("retry_count")))
+		header.Set("X-Upstream-Ms", strconv.FormatInt(upstreamMs, 10))
+	}
+	return resp, err
+}
+
+// setPayloadDebugHeader 开启调试时通过响应头返回实际发往上游的请求体，重试和降级时以最后一次请求为准
+func setPayloadDebugHeader(c *gin.Context, req *http.Request) {
+	if config.AppConfig.DebugPayloadHeader != "true" || req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	payload, err := io.ReadAll(io.LimitReader(body, maxDebugPayloadSize+1))
+	if err != nil {
+		return
+	}
+
+	// 响应头长度有限，过长时截断并返回截断标记
+	header := c.Writer.Header()
+	header.Del("X-Augment-Payload-Truncated")
+	if len(payload) > maxDebugPayloadSize {
+		header.Set("X-Augment-Payload-Truncated", "true")
+		payload = payload[:maxDebugPayloadSize]
+	}
+	header.Set("X-Augment-Payload", base64.StdEncoding.EncodeToString(payload))
+}
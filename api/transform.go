@@ -0,0 +1,161 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TransformRule 出站请求预处理规则
+type TransformRule struct {
+	Type        string `json:"type"`        // regex_replace / inject / scrub_pii
+	Pattern     string `json:"pattern"`     // regex_replace 使用的正则
+	Replacement string `json:"replacement"` // regex_replace 替换内容
+	Position    string `json:"position"`    // inject 注入位置: prefix / suffix
+	Text        string `json:"text"`        // inject 注入文本
+
+	re *regexp.Regexp
+}
+
+// piiPatterns 内置的敏感信息匹配规则
+var piiPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), "[REDACTED_PRIVATE_KEY]"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`), "[REDACTED_EMAIL]"},
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), "[REDACTED_AWS_KEY]"},
+	{regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}\b`), "[REDACTED_GITHUB_TOKEN]"},
+	{regexp.MustCompile(`\bsk-[A-Za-z0-9_\-]{20,}\b`), "[REDACTED_API_KEY]"},
+	{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._\-]{20,}`), "Bearer [REDACTED_TOKEN]"},
+}
+
+// requestTransforms 按模型别名(小写)分组的预处理规则，"*" 对所有模型生效
+var requestTransforms map[string][]TransformRule
+
+// InitRequestTransforms 解析并编译出站请求预处理规则
+func InitRequestTransforms() error {
+	requestTransforms = nil
+	compiled, err := compileRequestTransforms(config.AppConfig.RequestTransforms)
+	if err != nil || compiled == nil {
+		return err
+	}
+	requestTransforms = compiled
+
+	logger.Log.WithFields(logrus.Fields{
+		"models": len(compiled),
+	}).Info("出站请求预处理规则加载完成")
+	return nil
+}
+
+// compileRequestTransforms 解析并编译 REQUEST_TRANSFORMS 格式的规则，未配置时返回nil
+func compileRequestTransforms(raw string) (map[string][]TransformRule, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var rules map[string][]TransformRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("解析REQUEST_TRANSFORMS失败: %v", err)
+	}
+
+	compiled := make(map[string][]TransformRule, len(rules))
+	for model, list := range rules {
+		for i := range list {
+			switch list[i].Type {
+			case "regex_replace":
+				re, err := regexp.Compile(list[i].Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("模型 %s 的第%d条规则正则无效: %v", model, i+1, err)
+				}
+				list[i].re = re
+			case "inject":
+				if list[i].Position != "prefix" && list[i].Position != "suffix" {
+					return nil, fmt.Errorf("模型 %s 的第%d条规则注入位置无效: %s", model, i+1, list[i].Position)
+				}
+			case "scrub_pii":
+			default:
+				return nil, fmt.Errorf("模型 %s 的第%d条规则类型未知: %s", model, i+1, list[i].Type)
+			}
+		}
+		compiled[strings.ToLower(model)] = list
+	}
+	return compiled, nil
+}
+
+// transformRulesForModel 获取指定模型适用的规则，通用规则在前
+func transformRulesForModel(model string) []TransformRule {
+	if len(requestTransforms) == 0 {
+		return nil
+	}
+	rules := append([]TransformRule{}, requestTransforms["*"]...)
+	return append(rules, requestTransforms[strings.ToLower(model)]...)
+}
+
+// applyTextRules 对单段文本应用替换类规则
+func applyTextRules(text string, rules []TransformRule) string {
+	if text == "" {
+		return text
+	}
+	for _, rule := range rules {
+		switch rule.Type {
+		case "regex_replace":
+			text = rule.re.ReplaceAllString(text, rule.Replacement)
+		case "scrub_pii":
+			for _, p := range piiPatterns {
+				text = p.re.ReplaceAllString(text, p.replacement)
+			}
+		}
+	}
+	return text
+}
+
+// applyNodeRules 对节点中的文本、工具调用参数和记忆应用替换类规则，工具结果也以节点发送
+func applyNodeRules(nodes []Node, rules []TransformRule) {
+	for i := range nodes {
+		node := &nodes[i]
+		node.Content = applyTextRules(node.Content, rules)
+		node.ToolUse.InputJSON = applyTextRules(node.ToolUse.InputJSON, rules)
+		node.AgentMemory.Content = applyTextRules(node.AgentMemory.Content, rules)
+	}
+}
+
+// applyRequestTransforms 在发往Augment之前对请求中的文本执行预处理
+// 注入文本中的占位符在注入前展开，客户端消息中的占位符保持原样
+func applyRequestTransforms(augmentReq *AugmentRequest, model string, vars templateVars) {
+	rules := transformRulesForModel(model)
+	if len(rules) == 0 {
+		return
+	}
+
+	augmentReq.Message = applyTextRules(augmentReq.Message, rules)
+	augmentReq.AgentMemories = applyTextRules(augmentReq.AgentMemories, rules)
+	// 系统提示词放在指南中，降级时会用保存的系统提示词重新生成指南，两处都要处理
+	augmentReq.UserGuideLines = applyTextRules(augmentReq.UserGuideLines, rules)
+	augmentReq.SystemPrompt = applyTextRules(augmentReq.SystemPrompt, rules)
+	applyNodeRules(augmentReq.Nodes, rules)
+	for i := range augmentReq.ChatHistory {
+		history := &augmentReq.ChatHistory[i]
+		history.RequestMessage = applyTextRules(history.RequestMessage, rules)
+		history.ResponseText = applyTextRules(history.ResponseText, rules)
+		applyNodeRules(history.RequestNodes, rules)
+		applyNodeRules(history.ResponseNodes, rules)
+	}
+
+	// 注入类规则只作用于当前消息
+	for _, rule := range rules {
+		if rule.Type != "inject" {
+			continue
+		}
+		if rule.Position == "prefix" {
+			augmentReq.Message = vars.expand(rule.Text) + augmentReq.Message
+		} else {
+			augmentReq.Message = augmentReq.Message + vars.expand(rule.Text)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"augment2api/pkg/webui"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// hashedAssetCacheControl 带内容哈希的资源内容不会变化，可以长期缓存
+	hashedAssetCacheControl = "public, max-age=31536000, immutable"
+	// plainAssetCacheControl 不带哈希的资源每次使用前需要按ETag重新验证
+	plainAssetCacheControl = "no-cache"
+)
+
+// uiAssets 管理界面的静态资源，由 LoadUI 加载
+var uiAssets *webui.Assets
+
+// LoadUI 加载管理界面的静态资源和页面模板，模板中可以使用 asset 函数引用带内容哈希的资源路径，
+// 使用 uiVersion 函数获取界面版本
+func LoadUI(fsys fs.FS) (*template.Template, error) {
+	assets, err := webui.Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	uiAssets = assets
+
+	return template.New("").Funcs(template.FuncMap{
+		"asset":     assets.Path,
+		"uiVersion": assets.Version,
+	}).ParseFS(fsys, "templates/*")
+}
+
+// StaticAssetHandler 提供管理界面的静态资源，带内容哈希的文件名长期缓存，
+// 原始文件名按ETag协商缓存，客户端支持gzip时返回预压缩的版本
+func StaticAssetHandler(c *gin.Context) {
+	if uiAssets == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	asset, hashed := uiAssets.Lookup(strings.TrimPrefix(c.Param("filepath"), "/"))
+	if asset == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if hashed {
+		c.Header("Cache-Control", hashedAssetCacheControl)
+	} else {
+		c.Header("Cache-Control", plainAssetCacheControl)
+	}
+	// 压缩和未压缩的内容使用不同的ETag
+	data, etag := asset.Data, asset.ETag
+	if asset.Gzip != nil {
+		c.Header("Vary", "Accept-Encoding")
+		if acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Header("Content-Encoding", "gzip")
+			data, etag = asset.Gzip, strings.TrimSuffix(etag, `"`)+`-gzip"`
+		}
+	}
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Header("Content-Length", strconv.Itoa(len(data)))
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", asset.ContentType)
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, asset.ContentType, data)
+}
+
+// etagMatches If-None-Match 中是否包含资源的ETag，弱校验的 W/ 前缀按相同处理
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip 客户端是否接受gzip编码，q=0 表示明确拒绝
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(name) != "gzip" && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// UIVersionHandler 返回管理界面的版本，页面发现版本变化时提示刷新，避免升级后继续使用旧页面
+func UIVersionHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	if uiAssets == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "success", "version": ""})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"version": uiAssets.Version(),
+	})
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	tokenmanager "augment2api/pkg/token"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// newAugmentChatRequest 构建发往Augment chat-stream接口的请求
+func newAugmentChatRequest(token, tenant, sessionID string, augmentReq AugmentRequest) (*http.Request, error) {
+	jsonData, err := marshalAugmentPayload(augmentReq)
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求失败: %v", err)
+	}
+
+	parsedURL, err := url.Parse(tenant)
+	if err != nil {
+		return nil, fmt.Errorf("解析租户URL失败: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", tenant+"chat-stream", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	req.Header.Set("Host", parsedURL.Host)
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", config.AppConfig.UserAgent)
+	req.Header.Set("x-api-version", "5")
+	applyTokenHeaderOverrides(req, token)
+	req.Header.Set("x-request-id", uuid.New().String())
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	req.Header.Set("x-request-session-id", sessionID)
+
+	return req, nil
+}
+
+// fetchAugmentText 调用Augment并读取完整回复文本，ctx取消时中止请求
+func fetchAugmentText(ctx context.Context, token, tenant, sessionID string, augmentReq AugmentRequest) (string, error) {
+	req, err := newAugmentChatRequest(token, tenant, sessionID, augmentReq)
+	if err != nil {
+		return "", err
+	}
+
+	// 后台请求没有客户端超时，依靠空闲超时避免上游无输出时一直等待
+	ctx, watch := startIdleWatch(ctx)
+	defer watch.stop()
+
+	client := createHTTPClient()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("请求失败: %v", watch.wrapErr(err))
+	}
+	watch.wrapBody(resp)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Augment response error(%d): %s", resp.StatusCode, string(body))
+	}
+
+	reader := newUpstreamReader(resp.Body)
+	var fullText string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fullText, fmt.Errorf("读取响应失败: %v", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		augmentResp, ok := reader.parse(line)
+		if !ok {
+			continue
+		}
+
+		// 检查响应内容是否包含错误信息
+		if strings.Contains(augmentResp.Text, errBlocked) {
+			logger.Upstream.WithFields(logrus.Fields{
+				"token": token,
+				"mode":  augmentReq.Mode,
+			}).Info("检测到block信息，将token加入冷却队列10分钟")
+
+			if err := tokenmanager.SetTokenCoolStatus(token, 10*time.Minute); err != nil {
+				logger.Upstream.WithFields(logrus.Fields{
+					"token": token,
+					"error": err.Error(),
+				}).Error("将token加入冷却队列失败")
+			}
+			return "", fmt.Errorf("请求被Augment拦截")
+		}
+
+		fullText += augmentResp.Text
+
+		if augmentResp.Done {
+			break
+		}
+	}
+
+	return filterOutputText(fullText), nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxPendingFragment 跨行拼接的JSON片段上限，超过后丢弃，避免异常响应占用过多内存
+const maxPendingFragment = 1 << 20
+
+var (
+	upstreamContentEncodings = metrics.NewCounterVec("augment2api_upstream_content_encoding_total",
+		"Upstream responses by Content-Encoding.", "encoding")
+	upstreamParseErrors = metrics.NewCounterVec("augment2api_upstream_parse_errors_total",
+		"Upstream stream lines that could not be parsed.", "reason")
+)
+
+// decodeContentEncoding 透明解压上游返回的gzip/deflate响应体，
+// 传输层只会自动解压自己请求的gzip，上游主动压缩或使用deflate时需要在这里处理
+func decodeContentEncoding(resp *http.Response) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return
+	}
+	upstreamContentEncodings.Inc(encoding)
+
+	var newReader func(io.Reader) (io.ReadCloser, error)
+	switch encoding {
+	case "gzip", "x-gzip":
+		newReader = func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	case "deflate":
+		newReader = newDeflateReader
+	default:
+		upstreamParseErrors.Inc("unsupported_encoding")
+		logger.Upstream.WithFields(logrus.Fields{
+			"encoding": encoding,
+		}).Warn("上游返回了不支持的压缩格式")
+		return
+	}
+
+	resp.Body = &lazyDecoder{body: resp.Body, newFunc: newReader}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// newDeflateReader deflate按规范应为zlib封装，部分服务端直接发送原始deflate数据，两种都支持
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// lazyDecoder 在第一次读取时才创建解压器，避免读取压缩头时阻塞到上游开始输出
+type lazyDecoder struct {
+	body    io.ReadCloser
+	newFunc func(io.Reader) (io.ReadCloser, error)
+	reader  io.ReadCloser
+	err     error
+}
+
+// Read 读取解压后的数据
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.reader == nil && d.err == nil {
+		d.reader, d.err = d.newFunc(d.body)
+		if d.err != nil {
+			upstreamParseErrors.Inc("decode_error")
+		}
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.reader.Read(p)
+}
+
+// Close 关闭解压器和原始响应体
+func (d *lazyDecoder) Close() error {
+	if d.reader != nil {
+		d.reader.Close()
+	}
+	return d.body.Close()
+}
+
+// upstreamReader 按行读取上游流式响应并解析为 AugmentResponse
+// 兼容SSE格式（data: 前缀、注释和事件行）、被拆成多行的JSON以及末尾没有换行的最后一行，
+// 无法解析的行会被跳过并从下一行重新同步
+type upstreamReader struct {
+	*bufio.Reader
+	pending string
+	// onFirstText 解析出第一段非空文本时调用一次
+	onFirstText func()
+}
+
+// newUpstreamReader 创建上游响应读取器
+func newUpstreamReader(body io.Reader) *upstreamReader {
+	r := &upstreamReader{Reader: bufio.NewReader(body)}
+	if watched, ok := body.(*firstTokenBody); ok {
+		r.onFirstText = watched.mark
+	}
+	return r
+}
+
+// ReadString 与 bufio.Reader 相同，但响应末尾没有换行的最后一行会先正常返回，下一次读取才返回 io.EOF
+func (r *upstreamReader) ReadString(delim byte) (string, error) {
+	line, err := r.Reader.ReadString(delim)
+	if errors.Is(err, io.EOF) && line != "" {
+		return line, nil
+	}
+	return line, err
+}
+
+// parse 解析一行上游数据，返回false表示该行不是完整的响应片段
+func (r *upstreamReader) parse(line string) (AugmentResponse, bool) {
+	resp, ok := r.parseLine(line)
+	if ok && resp.Text != "" && r.onFirstText != nil {
+		r.onFirstText()
+		r.onFirstText = nil
+	}
+	return resp, ok
+}
+
+// parseLine 解析一行上游数据
+func (r *upstreamReader) parseLine(line string) (AugmentResponse, bool) {
+	var resp AugmentResponse
+
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return resp, false
+	case strings.HasPrefix(line, ":"):
+		// SSE注释，常用作心跳
+		return resp, false
+	case strings.HasPrefix(line, "data:"):
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "[DONE]" {
+			return AugmentResponse{Done: true}, true
+		}
+	case strings.HasPrefix(line, "event:"), strings.HasPrefix(line, "id:"), strings.HasPrefix(line, "retry:"):
+		return resp, false
+	}
+
+	candidate := line
+	if r.pending != "" {
+		candidate = r.pending + line
+	}
+	err := json.Unmarshal([]byte(candidate), &resp)
+	if err == nil {
+		r.pending = ""
+		return resp, true
+	}
+
+	// JSON被拆到多行时先缓存，等待后续行补齐
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(candidate)) && strings.HasPrefix(candidate, "{") {
+		if len(candidate) > maxPendingFragment {
+			upstreamParseErrors.Inc("oversized_fragment")
+			r.pending = ""
+			return resp, false
+		}
+		r.pending = candidate
+		return resp, false
+	}
+
+	// 拼接后仍无法解析时丢弃缓存的片段，从当前行重新同步
+	if r.pending != "" {
+		r.pending = ""
+		upstreamParseErrors.Inc("malformed_json")
+		return r.parseLine(line)
+	}
+
+	// 同一行中有多个JSON对象时逐个解析合并
+	if merged, ok := parseConcatenated(line); ok {
+		return merged, true
+	}
+
+	upstreamParseErrors.Inc("malformed_json")
+	logger.Upstream.WithFields(logrus.Fields{
+		"error": err.Error(),
+		"line":  truncateRunes(line, 200),
+	}).Debug("跳过无法解析的上游响应行")
+	return resp, false
+}
+
+// parseConcatenated 解析同一行中连续的多个JSON对象，合并文本和节点
+func parseConcatenated(line string) (AugmentResponse, bool) {
+	var merged AugmentResponse
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	count := 0
+	for decoder.More() {
+		var part AugmentResponse
+		if err := decoder.Decode(&part); err != nil {
+			return merged, false
+		}
+		merged.Text += part.Text
+		merged.Nodes = append(merged.Nodes, part.Nodes...)
+		merged.Done = merged.Done || part.Done
+		count++
+	}
+	return merged, count > 1
+}
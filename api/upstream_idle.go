@@ -0,0 +1,118 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// errUpstreamIdleTimeout 上游超过空闲超时没有任何输出，包含 timeout 以便按网络错误切换token重试
+var errUpstreamIdleTimeout = errors.New("upstream idle timeout")
+
+var upstreamIdleTimeouts = metrics.NewCounterVec("augment2api_upstream_idle_timeouts_total",
+	"Upstream requests aborted after the idle timeout, by stage.", "stage")
+
+// upstreamIdleTimeout 上游两次输出之间允许的最长间隔，0表示不限制
+// 与总耗时预算相互独立，长时间持续输出的生成不会因空闲超时中断
+func upstreamIdleTimeout() time.Duration {
+	seconds, err := strconv.Atoi(config.AppConfig.UpstreamIdleTimeout)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// idleWatch 监视单次上游请求的空闲时间，超时后取消该次请求
+type idleWatch struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	fired    atomic.Bool
+	received atomic.Bool // 是否已读到响应体数据
+}
+
+// startIdleWatch 为单次上游请求开始计时，未配置空闲超时时返回原context和nil
+// 从发出请求开始计时，等待响应头和读取响应体时每收到数据都会重新计时
+func startIdleWatch(parent context.Context) (context.Context, *idleWatch) {
+	timeout := upstreamIdleTimeout()
+	if timeout <= 0 {
+		return parent, nil
+	}
+	ctx, cancel := context.WithCancel(parent)
+	w := &idleWatch{timeout: timeout, cancel: cancel}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.fired.Store(true)
+		stage := "headers"
+		if w.received.Load() {
+			stage = "stream"
+		}
+		upstreamIdleTimeouts.Inc(stage)
+		cancel()
+	})
+	return ctx, w
+}
+
+// touch 收到数据后重新计时
+func (w *idleWatch) touch() {
+	if w == nil {
+		return
+	}
+	w.received.Store(true)
+	w.timer.Reset(w.timeout)
+}
+
+// stop 结束计时并释放context
+func (w *idleWatch) stop() {
+	if w == nil {
+		return
+	}
+	w.timer.Stop()
+	w.cancel()
+}
+
+// wrapErr 空闲超时导致的错误替换为明确的空闲超时错误
+func (w *idleWatch) wrapErr(err error) error {
+	if w == nil || err == nil || !w.fired.Load() {
+		return err
+	}
+	return fmt.Errorf("%w: 上游超过%d秒没有输出", errUpstreamIdleTimeout, int(w.timeout.Seconds()))
+}
+
+// wrapBody 读取响应体时继续计时，响应体关闭时结束计时
+func (w *idleWatch) wrapBody(resp *http.Response) {
+	if w == nil {
+		return
+	}
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, watch: w}
+}
+
+// idleTimeoutBody 读取上游响应体时刷新空闲计时
+type idleTimeoutBody struct {
+	io.ReadCloser
+	watch *idleWatch
+}
+
+// Read 读取响应体，读到数据时重新计时
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watch.touch()
+	}
+	if err != nil && err != io.EOF {
+		err = b.watch.wrapErr(err)
+	}
+	return n, err
+}
+
+// Close 关闭响应体并结束计时
+func (b *idleTimeoutBody) Close() error {
+	b.watch.stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"crypto/tls"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// upstreamHTTP2PingTimeout HTTP/2健康检查等待PING响应的时间，超时后关闭连接
+const upstreamHTTP2PingTimeout = 15 * time.Second
+
+// ShardProtocol 与租户分片协商的协议
+type ShardProtocol struct {
+	Host        string           `json:"host"`
+	Protocol    string           `json:"protocol"`     // 最近一次请求使用的协议
+	ForcedHTTP1 bool             `json:"forced_http1"` // 是否按配置强制使用HTTP/1.1
+	Requests    map[string]int64 `json:"requests"`     // 各协议的请求数
+	LastSeen    time.Time        `json:"last_seen"`
+}
+
+var (
+	shardProtocols      = make(map[string]*ShardProtocol)
+	shardProtocolsGuard sync.Mutex
+
+	upstreamProtocolRequests = metrics.NewCounterVec("augment2api_upstream_requests_by_protocol_total",
+		"Upstream requests by negotiated HTTP protocol.", "protocol")
+)
+
+// upstreamHTTP2Enabled 是否允许与上游协商HTTP/2
+func upstreamHTTP2Enabled() bool {
+	return config.AppConfig.UpstreamHTTP2 != "false"
+}
+
+// upstreamHTTP2PingInterval HTTP/2连接空闲多久后发送PING检查连接是否可用，0为不检查
+func upstreamHTTP2PingInterval() time.Duration {
+	seconds, err := strconv.Atoi(config.AppConfig.UpstreamHTTP2PingInterval)
+	if err != nil || seconds < 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// forcedHTTP1Hosts 按配置强制使用HTTP/1.1的租户地址，不区分大小写
+func forcedHTTP1Hosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(config.AppConfig.UpstreamHTTP1Hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		// 兼容直接填写租户地址的情况
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		hosts[strings.TrimSuffix(host, "/")] = true
+	}
+	return hosts
+}
+
+// isForcedHTTP1 租户地址是否强制使用HTTP/1.1
+func isForcedHTTP1(host string) bool {
+	hosts := forcedHTTP1Hosts()
+	host = strings.ToLower(host)
+	if hosts[host] {
+		return true
+	}
+	if hostname, _, ok := strings.Cut(host, ":"); ok {
+		return hosts[hostname]
+	}
+	return false
+}
+
+// disableHTTP2 使传输层只使用HTTP/1.1
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+}
+
+// configureHTTP2 开启HTTP/2，同一租户分片的请求复用同一条连接的多个流，并定期检查空闲连接是否可用
+func configureHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = true
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		logger.Upstream.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("配置上游HTTP/2参数失败，使用默认参数")
+		return
+	}
+	if interval := upstreamHTTP2PingInterval(); interval > 0 {
+		h2.ReadIdleTimeout = interval
+		h2.PingTimeout = upstreamHTTP2PingTimeout
+	}
+}
+
+// protocolTransport 按租户地址选择HTTP/2或强制HTTP/1.1的传输层
+type protocolTransport struct {
+	http2 http.RoundTripper
+	http1 http.RoundTripper
+}
+
+// RoundTrip 将请求交给对应协议的传输层
+func (t protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isForcedHTTP1(req.URL.Host) {
+		return t.http1.RoundTrip(req)
+	}
+	return t.http2.RoundTrip(req)
+}
+
+// recordUpstreamProtocol 记录与租户分片协商的协议
+func recordUpstreamProtocol(host, protocol string) {
+	upstreamProtocolRequests.Inc(protocol)
+
+	shardProtocolsGuard.Lock()
+	defer shardProtocolsGuard.Unlock()
+	shard, ok := shardProtocols[host]
+	if !ok {
+		shard = &ShardProtocol{Host: host, Requests: make(map[string]int64)}
+		shardProtocols[host] = shard
+	}
+	shard.Protocol = protocol
+	shard.Requests[protocol]++
+	shard.LastSeen = time.Now()
+}
+
+// UpstreamProtocolsHandler 返回上游HTTP/2配置和各租户分片实际协商的协议
+func UpstreamProtocolsHandler(c *gin.Context) {
+	shardProtocolsGuard.Lock()
+	shards := make([]ShardProtocol, 0, len(shardProtocols))
+	for _, shard := range shardProtocols {
+		snapshot := *shard
+		snapshot.Requests = make(map[string]int64, len(shard.Requests))
+		for protocol, count := range shard.Requests {
+			snapshot.Requests[protocol] = count
+		}
+		snapshot.ForcedHTTP1 = isForcedHTTP1(shard.Host)
+		shards = append(shards, snapshot)
+	}
+	shardProtocolsGuard.Unlock()
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Host < shards[j].Host
+	})
+
+	forced := make([]string, 0)
+	for host := range forcedHTTP1Hosts() {
+		forced = append(forced, host)
+	}
+	sort.Strings(forced)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":             "success",
+		"http2_enabled":      upstreamHTTP2Enabled(),
+		"ping_interval_secs": int(upstreamHTTP2PingInterval().Seconds()),
+		"forced_http1_hosts": forced,
+		"shards":             shards,
+	})
+}
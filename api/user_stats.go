@@ -0,0 +1,125 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	"augment2api/pkg/userstats"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// setEndUser 记录客户端传入的终端用户标识，并检查该用户的请求频率
+func setEndUser(c *gin.Context, user string) bool {
+	user = userstats.NormalizeUserID(user)
+	if user == "" {
+		return true
+	}
+	c.Set("end_user", user)
+
+	allowed, limit, err := userstats.Allow(user)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"user":  user,
+			"error": err.Error(),
+		}).Error("检查终端用户请求频率失败")
+	}
+	if allowed {
+		return true
+	}
+
+	c.Set("error_class", "user_rate_limited")
+	c.Header("Retry-After", strconv.Itoa(int(userstats.RetryAfter().Seconds())))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": gin.H{
+			"message": "Rate limit reached for user " + user + ": " + strconv.Itoa(limit) + " requests per minute",
+			"type":    "rate_limit_error",
+			"code":    "user_rate_limit_exceeded",
+		},
+	})
+	recordEndUserStats(c)
+	return false
+}
+
+// recordEndUserStats 在请求结束时记录终端用户的使用统计，每个请求只记录一次
+func recordEndUserStats(c *gin.Context) {
+	user := c.GetString("end_user")
+	if user == "" || c.GetBool("end_user_recorded") {
+		return
+	}
+	c.Set("end_user_recorded", true)
+
+	failed := classifyRequestError(c, c.Writer.Status()) != ""
+	if err := userstats.Record(user, c.GetString("model"), failed); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"user":  user,
+			"error": err.Error(),
+		}).Error("记录终端用户统计失败")
+	}
+}
+
+// UserStatsHandler 获取指定日期各终端用户的使用统计，默认为当天
+func UserStatsHandler(c *gin.Context) {
+	date := c.DefaultQuery("date", time.Now().Format("2006-01-02"))
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的日期: " + date,
+		})
+		return
+	}
+
+	stats, err := userstats.List(date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取终端用户统计失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"date":   date,
+		"users":  stats,
+	})
+}
+
+// UpdateUserRateLimitHandler 设置终端用户的每分钟请求数上限，-1 表示恢复默认值
+func UpdateUserRateLimitHandler(c *gin.Context) {
+	user := userstats.NormalizeUserID(c.Param("user"))
+	if user == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定用户",
+		})
+		return
+	}
+
+	var req struct {
+		Limit *int `json:"limit"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Limit == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据",
+		})
+		return
+	}
+
+	if err := userstats.SetLimit(user, *req.Limit); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新请求频率上限失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"user":   user,
+		"limit":  userstats.Limit(user),
+	})
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"augment2api/pkg/convert"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFieldErrors 单次最多返回的字段错误数
+const maxFieldErrors = 10
+
+var (
+	// openAIRoles OpenAI消息允许的角色
+	openAIRoles = []string{"system", "developer", "user", "assistant", "tool", "function"}
+	// openAIContentParts OpenAI消息内容分块允许的类型
+	openAIContentParts = []string{"text", "image_url", "input_audio", "file", "refusal"}
+	// anthropicRoles Anthropic消息允许的角色
+	anthropicRoles = []string{"user", "assistant"}
+	// anthropicContentBlocks Anthropic消息内容块允许的类型
+	anthropicContentBlocks = []string{"text", "image", "document", "tool_use", "tool_result", "thinking", "redacted_thinking", "search_result"}
+)
+
+// FieldError 请求字段的校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// requestValidator 收集字段错误
+type requestValidator struct {
+	errors []FieldError
+}
+
+// add 记录一个字段错误
+func (v *requestValidator) add(field, format string, args ...interface{}) {
+	if len(v.errors) >= maxFieldErrors {
+		return
+	}
+	v.errors = append(v.errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// oneOf 检查取值是否在允许的枚举中
+func (v *requestValidator) oneOf(field, value string, allowed []string) bool {
+	for _, item := range allowed {
+		if value == item {
+			return true
+		}
+	}
+	v.add(field, "取值 %q 无效，可选值: %s", value, strings.Join(allowed, ", "))
+	return false
+}
+
+// contentBlocks 检查内容分块数组，每个分块必须是带有合法type的对象，text分块必须带有字符串text
+func (v *requestValidator) contentBlocks(field string, blocks []interface{}, allowed []string) {
+	for i, item := range blocks {
+		blockField := fmt.Sprintf("%s[%d]", field, i)
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			v.add(blockField, "类型应为 object，实际为 %s", jsonTypeOf(item))
+			continue
+		}
+		blockType, ok := block["type"].(string)
+		if !ok {
+			v.add(blockField+".type", "缺少必填字段")
+			continue
+		}
+		if !v.oneOf(blockField+".type", blockType, allowed) {
+			continue
+		}
+		if blockType == "text" {
+			if _, ok := block["text"].(string); !ok {
+				v.add(blockField+".text", "text 分块的 text 字段必须为 string")
+			}
+		}
+	}
+}
+
+// jsonTypeOf 返回解析后的JSON值的类型名
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// jsonTypeOfGo 返回Go类型对应的JSON类型名
+func jsonTypeOfGo(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Ptr:
+		return jsonTypeOfGo(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+// validateOpenAIRequest 校验OpenAI聊天请求的字段类型、取值范围和消息顺序
+func validateOpenAIRequest(req *OpenAIRequest) []FieldError {
+	v := &requestValidator{}
+
+	if strings.TrimSpace(req.Model) == "" {
+		v.add("model", "缺少必填字段")
+	}
+	if req.Temperature < 0 || req.Temperature > 2 {
+		v.add("temperature", "取值必须在 0 到 2 之间")
+	}
+	if req.MaxTokens < 0 {
+		v.add("max_tokens", "不能小于0")
+	}
+	if req.N < 0 {
+		v.add("n", "不能小于0")
+	}
+	if req.StreamOptions != nil && !req.Stream {
+		v.add("stream_options", "仅在 stream 为 true 时可以设置")
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			v.add("callback_url", err.Error())
+		}
+	}
+	if req.CallbackURL != "" || req.Async {
+		if req.Stream {
+			v.add("stream", "后台执行的请求不能使用流式输出")
+		}
+		if req.N > 1 {
+			v.add("n", "后台执行的请求只支持生成一个候选")
+		}
+	}
+
+	if len(req.Messages) == 0 {
+		v.add("messages", "至少需要一条消息")
+		return v.errors
+	}
+
+	hasUser := false
+	for i, msg := range req.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
+		if msg.Role == "" {
+			v.add(field+".role", "缺少必填字段")
+			continue
+		}
+		if !v.oneOf(field+".role", msg.Role, openAIRoles) {
+			continue
+		}
+		if msg.Role == "user" {
+			hasUser = true
+		}
+
+		switch content := msg.Content.(type) {
+		case string:
+		case []interface{}:
+			v.contentBlocks(field+".content", content, openAIContentParts)
+		case nil:
+			if msg.Role != "assistant" || len(msg.ToolCalls) == 0 {
+				v.add(field+".content", "只有带 tool_calls 的 assistant 消息可以省略 content")
+			}
+		default:
+			v.add(field+".content", "类型应为 string 或 array，实际为 %s", jsonTypeOf(content))
+		}
+
+		// tool消息必须紧跟在发起工具调用的assistant消息或其他tool消息之后
+		if msg.Role == "tool" {
+			valid := false
+			if i > 0 {
+				prev := req.Messages[i-1]
+				valid = prev.Role == "tool" || (prev.Role == "assistant" && len(prev.ToolCalls) > 0)
+			}
+			if !valid {
+				v.add(field+".role", "tool 消息必须跟在带 tool_calls 的 assistant 消息之后")
+			}
+		}
+	}
+	if !hasUser {
+		v.add("messages", "至少需要一条 user 消息")
+	}
+
+	return v.errors
+}
+
+// validateAnthropicRequest 校验Anthropic消息请求的字段类型、取值范围和消息顺序
+func validateAnthropicRequest(req *AnthropicRequest) []FieldError {
+	v := &requestValidator{}
+
+	if strings.TrimSpace(req.Model) == "" {
+		v.add("model", "缺少必填字段")
+	}
+	if req.MaxTokens < 0 {
+		v.add("max_tokens", "不能小于0")
+	}
+	if req.Temperature < 0 || req.Temperature > 1 {
+		v.add("temperature", "取值必须在 0 到 1 之间")
+	}
+
+	for i, sequence := range req.StopSequences {
+		if sequence == "" {
+			v.add(fmt.Sprintf("stop_sequences[%d]", i), "不能为空字符串")
+		}
+	}
+
+	switch system := req.System.(type) {
+	case nil, string:
+	case []interface{}:
+		v.contentBlocks("system", system, []string{"text"})
+	default:
+		v.add("system", "类型应为 string 或 array，实际为 %s", jsonTypeOf(system))
+	}
+
+	if len(req.Messages) == 0 {
+		v.add("messages", "至少需要一条消息")
+		return v.errors
+	}
+	if req.Messages[0].Role != "user" {
+		v.add("messages[0].role", "第一条消息必须为 user")
+	}
+
+	for i, msg := range req.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
+		if msg.Role == "" {
+			v.add(field+".role", "缺少必填字段")
+		} else {
+			v.oneOf(field+".role", msg.Role, anthropicRoles)
+		}
+
+		switch content := msg.Content.(type) {
+		case string:
+		case []interface{}:
+			v.contentBlocks(field+".content", content, anthropicContentBlocks)
+		case nil:
+			v.add(field+".content", "缺少必填字段")
+		default:
+			v.add(field+".content", "类型应为 string 或 array，实际为 %s", jsonTypeOf(content))
+		}
+	}
+
+	return v.errors
+}
+
+// validateTitleRequest 校验生成对话标题的请求
+func validateTitleRequest(req *ConversationTitleRequest) []FieldError {
+	v := &requestValidator{}
+	if len(req.Messages) == 0 {
+		v.add("messages", "至少需要一条消息")
+	}
+	if req.MaxLength < 0 {
+		v.add("max_length", "不能小于0")
+	}
+	return v.errors
+}
+
+// decodeFieldErrors 将请求体解析错误转换为字段错误，无法定位字段时返回nil
+func decodeFieldErrors(err error) []FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		return []FieldError{{
+			Field:   field,
+			Message: fmt.Sprintf("类型应为 %s，实际为 %s", jsonTypeOfGo(typeErr.Type), typeErr.Value),
+		}}
+	}
+	if errors.Is(err, io.EOF) {
+		return []FieldError{{Field: "body", Message: "请求体为空"}}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return []FieldError{{Field: "body", Message: "JSON不完整"}}
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return []FieldError{{
+			Field:   "body",
+			Message: fmt.Sprintf("JSON格式错误（第 %d 字节）: %s", syntaxErr.Offset, syntaxErr.Error()),
+		}}
+	}
+	return nil
+}
+
+// respondInvalidRequest 返回字段级的校验错误，格式与OpenAI的错误响应一致
+func respondInvalidRequest(c *gin.Context, fieldErrors []FieldError) {
+	first := fieldErrors[0]
+	c.Set("error_class", "invalid_request")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"message": first.Field + ": " + first.Message,
+			"type":    "invalid_request_error",
+			"param":   first.Field,
+			"code":    "invalid_request",
+			"details": fieldErrors,
+		},
+	})
+}
+
+// isAnthropicRoute 请求是否匹配Anthropic兼容的消息接口，按路由模板判断，配置了 ROUTE_PREFIX 时同样适用
+func isAnthropicRoute(c *gin.Context) bool {
+	return strings.HasSuffix(c.FullPath(), "/v1/messages")
+}
+
+// RequestValidationMiddleware 在获取token之前解析并校验生成类请求的请求体
+// 格式错误的请求直接返回字段级错误，不占用token和上游额度；解析结果通过 request_body 交给处理函数
+func RequestValidationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var parsed interface{}
+		var fieldErrors []FieldError
+		var unknownParams []string
+		var err error
+
+		switch {
+		case isAnthropicRoute(c):
+			req := &AnthropicRequest{}
+			if unknownParams, err = decodeRequestParams(c, req); err == nil {
+				fieldErrors = validateAnthropicRequest(req)
+			}
+			parsed = req
+		case strings.HasSuffix(c.FullPath(), "/v1/conversations/title"):
+			req := &ConversationTitleRequest{}
+			if unknownParams, err = decodeRequestParams(c, req); err == nil {
+				fieldErrors = validateTitleRequest(req)
+			}
+			parsed = req
+		default:
+			req := &OpenAIRequest{}
+			if unknownParams, err = decodeRequestParams(c, req); err == nil {
+				fieldErrors = validateOpenAIRequest(req)
+			}
+			parsed = req
+		}
+
+		if err != nil {
+			fieldErrors = decodeFieldErrors(err)
+			if fieldErrors == nil {
+				respondDecodeError(c, err)
+				c.Abort()
+				return
+			}
+		}
+		if len(fieldErrors) > 0 {
+			respondInvalidRequest(c, fieldErrors)
+			c.Abort()
+			return
+		}
+		if !checkUnknownParams(c, unknownParams) {
+			c.Abort()
+			return
+		}
+		// 标题请求使用固定的模型并自行截断消息，不需要换用备用模型和检查上下文长度
+		if req, ok := parsed.(*ConversationTitleRequest); ok {
+			c.Set("request_body", req)
+			c.Next()
+			return
+		}
+		// 客户端没有传入系统提示词时使用API密钥的默认系统提示词
+		applyKeySystemPrompt(c, parsed)
+		if limit := maxContextTokens(); limit > 0 {
+			if tokens := requestContextTokens(parsed); tokens > limit {
+				respondContextLengthExceeded(c, tokens, limit)
+				c.Abort()
+				return
+			}
+		}
+
+		// 请求模式不可用时换用备用模型，记录AGENT请求所属的对话，并在调度token前确定请求模式
+		var model string
+		var available bool
+		switch req := parsed.(type) {
+		case *OpenAIRequest:
+			model, available = resolveModel(c, req.Model)
+			req.Model = model
+			markConversation(c, req.Model, "", req.Messages)
+		case *AnthropicRequest:
+			model, available = resolveModel(c, req.Model)
+			req.Model = model
+			markConversation(c, req.Model, convert.SystemText(req.System), req.Messages)
+		}
+		if !available {
+			respondModelOverloaded(c, model)
+			c.Abort()
+			return
+		}
+		c.Set("augment_mode", modeForModel(model))
+		// 请求模式确定后按该模式的token池剩余次数更新配额提示
+		writeRateLimitHeaders(c)
+
+		c.Set("request_body", parsed)
+		c.Set("request_summary", summarizeRequest(parsed))
+		markReviewSample(c, parsed)
+		markTranscript(c, parsed)
+		c.Next()
+	}
+}
+
+// takeValidatedRequest 取出校验中间件已解析的请求体，取出后从上下文中移除，便于处理函数释放原始消息
+func takeValidatedRequest(c *gin.Context) (interface{}, bool) {
+	parsed, ok := c.Get("request_body")
+	if !ok || parsed == nil {
+		return nil, false
+	}
+	c.Set("request_body", nil)
+	return parsed, true
+}
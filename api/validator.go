@@ -0,0 +1,127 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// validatorHeartbeatKey 独立校验进程的心跳，存在时服务实例不再自行校验和探测
+	validatorHeartbeatKey = "validator_heartbeat"
+	// validatorRunLockKey 多个校验进程同时运行时，每轮只由一个进程执行
+	validatorRunLockKey = "validator_run_lock"
+	// poolValidationReportKey 最近一次token池校验报告，供服务实例读取
+	poolValidationReportKey = "pool_validation_report"
+	// validatorHeartbeatTTL 心跳有效期
+	validatorHeartbeatTTL = time.Minute
+)
+
+// validatorActive 是否有独立校验进程在运行
+func validatorActive() bool {
+	if config.RDB == nil {
+		return false
+	}
+	exists, err := config.RedisExists(validatorHeartbeatKey)
+	return err == nil && exists
+}
+
+// loadPoolValidationReport 从Redis读取校验进程共享的校验报告
+func loadPoolValidationReport() *PoolValidationReport {
+	if config.RDB == nil {
+		return nil
+	}
+	data, err := config.RedisGet(poolValidationReportKey)
+	if err != nil {
+		return nil
+	}
+	var report PoolValidationReport
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// runValidationCycle 执行一轮token池校验和分片延迟探测，并共享结果
+func runValidationCycle(interval time.Duration, concurrency int) {
+	acquired, err := config.RedisSetNX(validatorRunLockKey, leader.InstanceID(), interval)
+	if err != nil || !acquired {
+		return
+	}
+
+	report, err := validateTokenPool(concurrency)
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("校验token池失败")
+	} else {
+		startupReportGuard.Lock()
+		startupReport = &report
+		startupReportGuard.Unlock()
+
+		if data, err := json.Marshal(report); err == nil {
+			config.RedisSet(poolValidationReportKey, string(data), 0)
+		}
+
+		logger.Log.WithFields(logrus.Fields{
+			"total":          report.Total,
+			"valid":          report.Valid,
+			"invalid":        report.Invalid,
+			"tenant_changed": report.TenantChanged,
+			"failed":         report.Failed,
+			"duration":       report.FinishedAt.Sub(report.StartedAt).String(),
+		}).Info("token池校验完成")
+	}
+
+	runLatencyProbe()
+	publishShardLatencies(2 * interval)
+}
+
+// RunValidator 以独立校验进程运行，只对共享的Redis执行token校验和分片探测，不提供HTTP服务
+// 服务实例检测到校验进程的心跳后不再自行校验，校验负载可与服务实例分开部署和扩缩
+func RunValidator() {
+	if config.RDB == nil {
+		logger.Log.Fatalln("校验模式需要连接Redis，不支持调试模式")
+	}
+
+	interval, err := time.ParseDuration(config.AppConfig.ValidatorInterval)
+	if err != nil || interval <= 0 {
+		logger.Log.Fatalln("VALIDATOR_INTERVAL 格式错误: " + config.AppConfig.ValidatorInterval)
+	}
+	concurrency, err := strconv.Atoi(config.AppConfig.StartupValidationConcurrency)
+	if err != nil {
+		concurrency = 5
+	}
+	StartMaintenanceSync()
+
+	logger.Log.WithFields(logrus.Fields{
+		"interval":    interval.String(),
+		"concurrency": concurrency,
+		"instance":    leader.InstanceID(),
+	}).Info("token校验进程启动成功")
+
+	// 心跳独立于校验轮次，校验耗时较长时服务实例也不会误判校验进程已退出
+	go func() {
+		ticker := time.NewTicker(validatorHeartbeatTTL / 3)
+		defer ticker.Stop()
+		for {
+			config.RedisSet(validatorHeartbeatKey, leader.InstanceID(), validatorHeartbeatTTL)
+			<-ticker.C
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// 维护期间跳过校验，避免在迁移Redis时写入数据
+		if !maintenanceActive() {
+			runValidationCycle(interval, concurrency)
+		}
+		<-ticker.C
+	}
+}
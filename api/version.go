@@ -0,0 +1,214 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/leader"
+	"augment2api/pkg/logger"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// updateCheckInterval 检查新版本的间隔
+const updateCheckInterval = 6 * time.Hour
+
+// ReleaseInfo 上游发布的版本信息
+type ReleaseInfo struct {
+	TagName     string    `json:"tag_name"`
+	HTMLURL     string    `json:"html_url"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+var (
+	latestRelease      *ReleaseInfo
+	latestReleaseGuard sync.RWMutex
+)
+
+// buildCommit 返回构建时的提交，优先使用 -ldflags 指定的值
+func buildCommit() (string, bool) {
+	if config.Commit != "" {
+		return config.Commit, false
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown", false
+	}
+
+	commit, modified := "unknown", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+			if len(commit) > 12 {
+				commit = commit[:12]
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return commit, modified
+}
+
+// isNewerVersion 比较形如 v1.2.3 的版本号，latest 更新时返回true
+func isNewerVersion(latest, current string) bool {
+	parse := func(v string) []int {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		parts := strings.Split(v, ".")
+		nums := make([]int, len(parts))
+		for i, part := range parts {
+			fmt.Sscanf(part, "%d", &nums[i])
+		}
+		return nums
+	}
+
+	l, c := parse(latest), parse(current)
+	for i := 0; i < len(l) || i < len(c); i++ {
+		var lv, cv int
+		if i < len(l) {
+			lv = l[i]
+		}
+		if i < len(c) {
+			cv = c[i]
+		}
+		if lv != cv {
+			return lv > cv
+		}
+	}
+	return false
+}
+
+// fetchLatestRelease 从GitHub获取最新发布的版本
+func fetchLatestRelease() (*ReleaseInfo, error) {
+	url := "https://api.github.com/repos/" + config.AppConfig.UpdateCheckRepo + "/releases/latest"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取最新版本失败，状态码: %d", resp.StatusCode)
+	}
+
+	var release ReleaseInfo
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// notifyNewRelease 通过Webhook通知新版本，多实例部署时同一版本只通知一次
+func notifyNewRelease(release *ReleaseInfo) {
+	if config.AppConfig.UpdateWebhook == "" {
+		return
+	}
+	if config.RDB != nil {
+		first, err := config.RedisSetNX("update_notified:"+release.TagName, leader.InstanceID(), 30*24*time.Hour)
+		if err != nil || !first {
+			return
+		}
+	}
+
+	payload, _ := json.Marshal(gin.H{
+		"event":           "new_release",
+		"current_version": config.Version,
+		"latest_version":  release.TagName,
+		"url":             release.HTMLURL,
+		"published_at":    release.PublishedAt,
+		"instance":        leader.InstanceID(),
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(config.AppConfig.UpdateWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("发送新版本通知失败")
+		return
+	}
+	resp.Body.Close()
+}
+
+// checkForUpdate 检查一次新版本
+func checkForUpdate() {
+	release, err := fetchLatestRelease()
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("检查新版本失败")
+		return
+	}
+
+	latestReleaseGuard.Lock()
+	latestRelease = release
+	latestReleaseGuard.Unlock()
+
+	if isNewerVersion(release.TagName, config.Version) {
+		logger.Log.WithFields(logrus.Fields{
+			"current": config.Version,
+			"latest":  release.TagName,
+			"url":     release.HTMLURL,
+		}).Warn("发现新版本")
+		notifyNewRelease(release)
+	}
+}
+
+// StartUpdateChecker 定期检查上游是否发布了新版本
+func StartUpdateChecker() {
+	if config.AppConfig.UpdateCheck != "true" {
+		return
+	}
+
+	ticker := time.NewTicker(updateCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkForUpdate()
+		<-ticker.C
+	}
+}
+
+// VersionHandler 返回当前实例的构建版本、提交和启动时间
+func VersionHandler(c *gin.Context) {
+	commit, modified := buildCommit()
+	response := gin.H{
+		"status":     "success",
+		"version":    config.Version,
+		"commit":     commit,
+		"modified":   modified,
+		"go_version": runtime.Version(),
+		"start_time": config.StartTime,
+		"uptime":     time.Since(config.StartTime).Truncate(time.Second).String(),
+		"instance":   leader.InstanceID(),
+	}
+
+	latestReleaseGuard.RLock()
+	release := latestRelease
+	latestReleaseGuard.RUnlock()
+	if release != nil {
+		response["latest_version"] = release.TagName
+		response["latest_url"] = release.HTMLURL
+		response["update_available"] = isNewerVersion(release.TagName, config.Version)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
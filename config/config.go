@@ -3,6 +3,8 @@ package config
 import (
 	"augment2api/pkg/logger"
 	"os"
+	"reflect"
+	"time"
 )
 
 type Config struct {
@@ -16,15 +18,213 @@ type Config struct {
 	ProxyURL        string
 	RemoveFree      string
 	UserAgent       string
+	// RequestTransforms 出站请求预处理规则(JSON)，按模型别名配置
+	RequestTransforms string
+	// LatencyProbeInterval 租户分片延迟探测间隔，为空则不探测
+	LatencyProbeInterval string
+	// SessionStrategy 上游会话ID生成策略: token / api_key
+	SessionStrategy string
+	// StartupValidation 启动时是否校验token池
+	StartupValidation            string
+	StartupValidationConcurrency string
+	// DisableInjection 关闭默认的前缀、后缀和指南注入
+	DisableInjection string
+	// DebugPayloadHeader 通过响应头返回最终发往上游的请求体
+	DebugPayloadHeader string
+	// MaxCompletionChoices n>1 时单个请求最多扇出的上游请求数
+	MaxCompletionChoices string
+	// PartialFinishReason 上游中断时返回部分内容使用的finish_reason: length / error
+	PartialFinishReason string
+	// LeaderElection 多实例部署时是否选主，后台任务只在主实例执行
+	LeaderElection string
+	// MockUpstream 使用内置的模拟上游，无需真实token和网络
+	MockUpstream string
+	// RequestSigners 出站请求签名器配置(JSON)，按名称配置，"*" 为默认签名器
+	RequestSigners string
+	// OutputFilter 过滤输出中Augment的自我介绍，OutputPersona 为替换的人设名称
+	OutputFilter        string
+	OutputPersona       string
+	OutputFilterPhrases string
+	// StopOnTool AGENT模式下收到完整的工具调用后立即结束上游输出
+	StopOnTool string
+	// RequestQueueLength 没有可用token时最多排队的请求数，0表示不排队
+	RequestQueueLength string
+	// RequestQueueMaxWait 请求排队的最长等待时间（秒）
+	RequestQueueMaxWait string
+	// ChaosMode 调试用的故障注入，用于测试下游客户端的重试逻辑
+	ChaosMode string
+	// ChaosRates 各类故障的注入比例
+	ChaosRates string
+	// ChaosSlowDelay 慢速流每个分块的延迟（毫秒）
+	ChaosSlowDelay string
+	// UserRateLimit 每个终端用户每分钟的默认请求数上限，0表示不限制
+	UserRateLimit string
+	// ClientTokenRotation 同一API密钥的连续请求尽量分配不同的token
+	ClientTokenRotation string
+	// UpstreamIdleConns 每个租户地址保留的空闲连接数
+	UpstreamIdleConns string
+	// UpstreamWarmInterval 上游连接预热间隔（秒），0表示不预热
+	UpstreamWarmInterval string
+	// MaxRequestBodyMB 请求体大小上限（MB），0表示不限制
+	MaxRequestBodyMB string
+	// KeyCleanupInterval token关联数据清理间隔（小时），0表示不自动清理
+	KeyCleanupInterval string
+	// DisabledTokenRetentionDays 禁用token的关联数据保留天数
+	DisabledTokenRetentionDays string
+	// UpdateCheck 定期检查是否有新版本发布
+	UpdateCheck string
+	// UpdateCheckRepo 检查新版本的GitHub仓库
+	UpdateCheckRepo string
+	// UpdateWebhook 发现新版本时通知的Webhook地址
+	UpdateWebhook string
+	// TraceHeaders 在响应头中返回token指纹、租户分片、重试次数和上游耗时
+	TraceHeaders string
+	// AdminListen 管理页面和管理接口的单独监听地址，为空时与API共用端口
+	AdminListen string
+	// TokenScoring 调度时优先选择健康分高的token
+	TokenScoring string
+	// TokenScoreExploration 开启评分调度时随机选择token的比例，避免低分token永远得不到重新评估
+	TokenScoreExploration string
+	// ValidatorInterval 独立校验进程校验token池的间隔
+	ValidatorInterval string
+	// PrefixTemplate 自定义前缀模板，支持 {{current_date}} 等占位符
+	PrefixTemplate string
+	// GuidelinesTemplate 自定义指南模板，支持 {{current_date}} 等占位符
+	GuidelinesTemplate string
+	// SharedMetrics 多实例部署时通过Redis汇总各实例的监控指标
+	SharedMetrics string
+	// AgentConversationAffinity 将AGENT对话保持在同一个token上，接近使用上限时自动迁移
+	AgentConversationAffinity string
+	// AgentMigrateThreshold token的AGENT使用次数达到该值时迁移绑定在其上的对话
+	AgentMigrateThreshold string
+	// SuspectOutputRatio 最近回复长度中位数低于基线的该比例时标记token为疑似限流
+	SuspectOutputRatio string
+	// UsageCounterStore token使用计数的存储方式: redis 每次直接写入 / memory 内存累加后定期写入
+	UsageCounterStore string
+	// UsageFlushInterval 内存使用计数写入Redis的间隔（秒）
+	UsageFlushInterval string
+	// UsageJournalPath 内存使用计数的本地日志文件，用于崩溃后补写计数
+	UsageJournalPath string
+	// ModelFallbacks 请求模型对应的模式没有可用token时换用的备用模型，格式为 原模型=备用模型，英文逗号分隔
+	ModelFallbacks string
+	// UpstreamHTTP2 是否允许与上游协商HTTP/2
+	UpstreamHTTP2 string
+	// UpstreamHTTP1Hosts 强制使用HTTP/1.1的租户地址，英文逗号分隔
+	UpstreamHTTP1Hosts string
+	// UpstreamHTTP2PingInterval 上游HTTP/2连接空闲多久（秒）后发送PING检查连接，0为不检查
+	UpstreamHTTP2PingInterval string
+	// JobWorkers 每个实例执行后台任务的工作协程数，0为不执行
+	JobWorkers string
+	// CallbackSecret 回调请求的签名密钥，未设置时使用 AUTH_TOKEN
+	CallbackSecret string
+	// CallbackAllowedHosts 允许的回调域名，英文逗号分隔，以点开头时匹配其子域名；设置后只能回调这些域名
+	CallbackAllowedHosts string
+	// FirstTokenSLOMs 首个分块延迟p95的目标值（毫秒），为空不告警
+	FirstTokenSLOMs string
+	// FirstTokenSLOSustain p95持续超过目标多少分钟后告警
+	FirstTokenSLOSustain string
+	// AlertWebhook 运行告警通知的Webhook地址
+	AlertWebhook string
+	// InvalidTokenConfirmDelay 首次返回 Invalid token 后再次确认的等待秒数
+	InvalidTokenConfirmDelay string
+	// UpstreamHeaders 附加到所有上游请求的自定义请求头，JSON对象格式，token级别的同名请求头优先
+	UpstreamHeaders string
+	// RebalanceReportCron 生成token池调整报告的cron表达式（含秒），为空时不定期生成
+	RebalanceReportCron string
+	// RebalanceWebhook token池调整报告的推送地址，为空时使用 AlertWebhook
+	RebalanceWebhook string
+	// MaxContextTokens 单个请求允许的估算上下文token数，0表示不限制
+	MaxContextTokens string
+	// ShardHeader 指定token分片的请求头名称，为空表示不接受请求头指定，只对管理密钥和 AUTH_TOKEN 生效，API密钥设置的分片优先
+	ShardHeader string
+	// LanguageDetection 按用户消息语言调整默认指南的模型别名，英文逗号分隔，* 表示所有模型，为空表示关闭
+	LanguageDetection string
+	// TokenRevealPwd 高级管理员密码，使用该密码登录的会话才能在列表中查看完整token
+	TokenRevealPwd string
+	// RequestTimeout 单个请求的总耗时预算（秒），包含排队、选择token、重试和上游响应，0表示不限制
+	RequestTimeout string
+	// ClusterQueue 是否将非流式聊天请求提交到Redis共享队列，由所有实例的工作协程执行
+	ClusterQueue string
+	// ClusterQueueWorkers 每个实例执行共享队列请求的工作协程数，0表示只提交不执行
+	ClusterQueueWorkers string
+	// UpstreamIdleTimeout 上游两次输出之间允许的最长间隔（秒），超过后中断该次上游请求，0表示不限制
+	UpstreamIdleTimeout string
+	// TokenContribution 是否允许调用方通过API密钥贡献自己的token
+	TokenContribution string
+	// ReviewSampleRate 请求被抽样保存完整提示词和回复的比例，0表示不抽样
+	ReviewSampleRate string
+	// ReviewSampleConsent 抽样是否需要调用方同意：all 排除明确拒绝的请求，opt_in 只抽样明确同意的请求
+	ReviewSampleConsent string
+	// ReviewSampleScrub 保存抽样记录前是否脱敏
+	ReviewSampleScrub string
+	// MaintenanceMessage 维护模式下生成请求返回的默认提示
+	MaintenanceMessage string
+	// MaintenanceRetryAfter 维护模式下返回给客户端的默认 Retry-After（秒）
+	MaintenanceRetryAfter string
+	// ConversationStore 是否在服务端保存对话记录，保存后可通过 /v1/conversations/:id/export 导出
+	ConversationStore string
+	// ConversationRetentionDays 对话记录在最后一次请求后的保留天数
+	ConversationRetentionDays string
+	// ShardConcurrencyLimit 每个上游分片在本实例的最大并发请求数，按上游返回的错误自适应降低，0表示不限制
+	ShardConcurrencyLimit string
+	// ShardConcurrencyMin 上游分片出错时并发上限降低的下限
+	ShardConcurrencyMin string
+	// TenantCheckMaxCandidates 检测token租户地址时每次最多尝试的地址数，0表示尝试全部
+	TenantCheckMaxCandidates string
+	// StrictParams 是否拒绝包含不支持参数的请求，默认忽略这些参数
+	StrictParams string
+	// RedisUsername Redis的ACL用户名，覆盖连接地址中的用户名
+	RedisUsername string
+	// RedisPassword Redis的密码，覆盖连接地址中的密码
+	RedisPassword string
+	// RedisTLS 是否通过TLS连接Redis，连接地址使用 rediss:// 时自动开启
+	RedisTLS string
+	// RedisTLSCAFile 校验Redis服务端证书的CA证书文件，为空时使用系统证书
+	RedisTLSCAFile string
+	// RedisTLSCertFile 连接Redis使用的客户端证书文件
+	RedisTLSCertFile string
+	// RedisTLSKeyFile 客户端证书的私钥文件
+	RedisTLSKeyFile string
+	// RateLimitHeaders 是否在响应中返回 X-RateLimit-* 配额提示
+	RateLimitHeaders string
+	// GuidelineGuard 是否在客户端系统提示词放入指南前删除改写注入指令的内容
+	GuidelineGuard string
+	// GuidelineMaxLength 放入指南的系统提示词最大字符数，0表示不限制
+	GuidelineMaxLength string
+	// GuidelineBannedPatterns 禁止出现在系统提示词中的正则，JSON数组，匹配的行会被删除
+	GuidelineBannedPatterns string
+	// RedisDegrade 是否在Redis延迟过高时降级：从内存缓存选择token，使用计数暂存在内存中
+	RedisDegrade string
+	// RedisDegradeLatency 判定为慢操作的Redis命令耗时（毫秒）
+	RedisDegradeLatency string
+	// RedisDegradeTrips 连续多少次慢操作或失败后进入降级
+	RedisDegradeTrips string
+	// RedisDegradeCooldown 降级后Redis持续正常多少秒恢复
+	RedisDegradeCooldown string
 }
 
-const version = "v1.0.9"
+// Version 当前版本号
+const Version = "v1.0.9"
+
+// Commit 构建时的提交，可通过 -ldflags "-X augment2api/config.Commit=xxx" 指定，
+// 未指定时从Go构建信息中读取
+var Commit = ""
+
+// StartTime 进程启动时间
+var StartTime = time.Now()
 
 var AppConfig Config
 
-func InitConfig() error {
-	// 从环境变量读取配置
-	AppConfig = Config{
+// Load 按查找函数读取各配置项，未设置的项使用默认值，不做必填校验
+func Load(lookup func(key string) string) Config {
+	getEnv := func(key, defaultValue string) string {
+		if value := lookup(key); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+
+	return Config{
 		// 必填配置
 		RedisConnString: getEnv("REDIS_CONN_STRING", ""),
 		AccessPwd:       getEnv("ACCESS_PWD", ""),
@@ -37,6 +237,214 @@ func InitConfig() error {
 		ProxyURL:    getEnv("PROXY_URL", ""),       // 代理URL配置
 		RemoveFree:  getEnv("REMOVE_FREE", "true"), // 是否移除免费账户
 		UserAgent:   getEnv("USER_AGENT", "Augment.vscode-augment/0.521.1 (darwin; arm64; 24.2.0) vscode/1.98.2"),
+		// 出站请求预处理规则，示例: {"*":[{"type":"scrub_pii"}],"claude-4-agent":[{"type":"regex_replace","pattern":"secret","replacement":"***"}]}
+		RequestTransforms: getEnv("REQUEST_TRANSFORMS", ""),
+		// 租户分片延迟探测间隔，示例: 10m
+		LatencyProbeInterval: getEnv("LATENCY_PROBE_INTERVAL", ""),
+		// 上游会话ID策略，token: 每个token共用一个会话；api_key: 按(token, API密钥)隔离会话
+		SessionStrategy: getEnv("SESSION_STRATEGY", "token"),
+		// 启动时校验token池，校验完成后才开始提供服务
+		StartupValidation:            getEnv("STARTUP_VALIDATION", "false"),
+		StartupValidationConcurrency: getEnv("STARTUP_VALIDATION_CONCURRENCY", "5"),
+		// 关闭默认注入，完全使用客户端消息
+		DisableInjection:   getEnv("DISABLE_INJECTION", "false"),
+		DebugPayloadHeader: getEnv("DEBUG_PAYLOAD_HEADER", "false"),
+		// n>1 时最多返回的候选数
+		MaxCompletionChoices: getEnv("MAX_COMPLETION_CHOICES", "4"),
+		// 上游中断时已接收内容的完成原因
+		PartialFinishReason: getEnv("PARTIAL_FINISH_REASON", "length"),
+		// 多实例共用一个Redis时开启，避免重复执行定时任务
+		LeaderElection: getEnv("LEADER_ELECTION", "false"),
+		// 开发调试用，开启后所有上游请求由本地模拟响应
+		MockUpstream: getEnv("MOCK_UPSTREAM", "false"),
+		// 出站请求签名器，示例: {"*":{"type":"hmac_sha256","secret":"xxx","header":"x-signature"}}
+		RequestSigners: getEnv("REQUEST_SIGNERS", ""),
+		// 白标部署时过滤上游的自我介绍，额外短语用英文逗号分隔
+		OutputFilter:        getEnv("OUTPUT_FILTER", "false"),
+		OutputPersona:       getEnv("OUTPUT_PERSONA", ""),
+		OutputFilterPhrases: getEnv("OUTPUT_FILTER_PHRASES", ""),
+		// 与Anthropic tool_choice语义一致，工具调用即为本轮输出的结尾
+		StopOnTool: getEnv("STOP_ON_TOOL", "false"),
+		// 请求排队，可通过 /api/queue 运行时调整
+		RequestQueueLength:  getEnv("REQUEST_QUEUE_LENGTH", "0"),
+		RequestQueueMaxWait: getEnv("REQUEST_QUEUE_MAX_WAIT", "30"),
+		// 故障注入比例，示例: 429=0.1,slow=0.1,drop=0.05,malformed=0.05
+		ChaosMode:      getEnv("CHAOS_MODE", "false"),
+		ChaosRates:     getEnv("CHAOS_RATES", "429=0.1,slow=0.1,drop=0.05,malformed=0.05"),
+		ChaosSlowDelay: getEnv("CHAOS_SLOW_DELAY_MS", "500"),
+		// 终端用户取自OpenAI的user字段或Anthropic的metadata.user_id，可通过 /api/users/:user/rate-limit 单独调整
+		UserRateLimit: getEnv("USER_RATE_LIMIT", "0"),
+		// 避免单个高频调用方始终落在同一个账号上，没有其他可用token时仍会复用
+		ClientTokenRotation: getEnv("CLIENT_TOKEN_ROTATION", "true"),
+		// 保持到各租户分片的长连接，减少流式请求首个分块的握手延迟
+		UpstreamIdleConns:    getEnv("UPSTREAM_IDLE_CONNS", "4"),
+		UpstreamWarmInterval: getEnv("UPSTREAM_WARM_INTERVAL", "60"),
+		// 超长对话的请求体上限，请求体按流解析，支持分块传输
+		MaxRequestBodyMB: getEnv("MAX_REQUEST_BODY_MB", "100"),
+		// 已删除或长期禁用token的使用次数等数据归档后删除，避免键空间无限增长
+		KeyCleanupInterval:         getEnv("KEY_CLEANUP_INTERVAL", "24"),
+		DisabledTokenRetentionDays: getEnv("DISABLED_TOKEN_RETENTION_DAYS", "30"),
+		// 多实例部署时便于确认各实例运行的版本，发现新版本时通过Webhook通知
+		UpdateCheck:     getEnv("UPDATE_CHECK", "false"),
+		UpdateCheckRepo: getEnv("UPDATE_CHECK_REPO", "hideonfate/augment2api"),
+		UpdateWebhook:   getEnv("UPDATE_WEBHOOK", ""),
+		// 调试开关，关闭时仅对管理密钥返回追踪响应头
+		TraceHeaders: getEnv("TRACE_HEADERS", "false"),
+		// 公网部署时可只在本机开放管理接口，示例: 127.0.0.1:27081
+		AdminListen: getEnv("ADMIN_LISTEN", ""),
+		// 按最近成功率、延迟、拒绝率和剩余额度为token评分分级，高分级优先调度
+		TokenScoring:          getEnv("TOKEN_SCORING", "false"),
+		TokenScoreExploration: getEnv("TOKEN_SCORE_EXPLORATION", "0.1"),
+		// 以 --mode=validator 启动时生效，校验并发数沿用 STARTUP_VALIDATION_CONCURRENCY
+		ValidatorInterval: getEnv("VALIDATOR_INTERVAL", "30m"),
+		// 替换默认的前缀和指南，可用占位符: {{current_date}} {{current_time}} {{weekday}} {{model}} {{client_ip_country}}
+		PrefixTemplate:     getEnv("PREFIX_TEMPLATE", ""),
+		GuidelinesTemplate: getEnv("GUIDELINES_TEMPLATE", ""),
+		// 开启后 /metrics 和 /api/stats 返回所有实例的合计，并通过 replica 标签区分各实例
+		SharedMetrics: getEnv("SHARED_METRICS", "false"),
+		// 对话由调用方、系统提示词和第一条用户消息识别，迁移阈值应小于单token的AGENT上限50
+		AgentConversationAffinity: getEnv("AGENT_CONVERSATION_AFFINITY", "false"),
+		AgentMigrateThreshold:     getEnv("AGENT_MIGRATE_THRESHOLD", "45"),
+		// 账号被限流时上游常返回异常简短的回复，设为0关闭检测
+		SuspectOutputRatio: getEnv("SUSPECT_OUTPUT_RATIO", "0.3"),
+		// 高并发部署可设为memory以减少每个请求的Redis写入，日志文件应放在持久化的目录中
+		UsageCounterStore:  getEnv("USAGE_COUNTER_STORE", "redis"),
+		UsageFlushInterval: getEnv("USAGE_FLUSH_INTERVAL", "5"),
+		UsageJournalPath:   getEnv("USAGE_JOURNAL_PATH", "usage.journal"),
+		// 示例: MODEL_FALLBACKS=claude-4-agent=claude-4-chat,gpt-4o=claude-4-chat
+		ModelFallbacks: getEnv("MODEL_FALLBACKS", ""),
+		// 个别租户分片的HTTP/2表现异常时，可将其加入 UPSTREAM_HTTP1_HOSTS 单独降级
+		UpstreamHTTP2:             getEnv("UPSTREAM_HTTP2", "true"),
+		UpstreamHTTP1Hosts:        getEnv("UPSTREAM_HTTP1_HOSTS", ""),
+		UpstreamHTTP2PingInterval: getEnv("UPSTREAM_HTTP2_PING_INTERVAL", "15"),
+		// 后台任务保存在Redis中，由所有实例共同领取执行
+		JobWorkers:     getEnv("JOB_WORKERS", "2"),
+		CallbackSecret: getEnv("CALLBACK_SECRET", ""),
+		// 回调地址不能指向内网、回环和链路本地地址，需要回调内部服务时将其域名加入 CALLBACK_ALLOWED_HOSTS
+		CallbackAllowedHosts: getEnv("CALLBACK_ALLOWED_HOSTS", ""),
+		// 按租户分片统计首个分块延迟，p95持续超过目标时通过Webhook告警
+		FirstTokenSLOMs:      getEnv("FIRST_TOKEN_SLO_MS", ""),
+		FirstTokenSLOSustain: getEnv("FIRST_TOKEN_SLO_SUSTAIN", "5"),
+		AlertWebhook:         getEnv("ALERT_WEBHOOK", ""),
+		// 连续两次返回 Invalid token 才禁用，避免上游鉴权短暂异常误删可用token
+		InvalidTokenConfirmDelay: getEnv("INVALID_TOKEN_CONFIRM_DELAY", "60"),
+		// 示例: UPSTREAM_HEADERS={"X-Gateway-Key":"secret","X-Team":"infra"}
+		UpstreamHeaders: getEnv("UPSTREAM_HEADERS", ""),
+
+		// 默认每周一9点生成token池调整报告
+		RebalanceReportCron: getEnv("REBALANCE_REPORT_CRON", "0 0 9 * * 1"),
+		RebalanceWebhook:    getEnv("REBALANCE_WEBHOOK", ""),
+
+		MaxContextTokens: getEnv("MAX_CONTEXT_TOKENS", "0"),
+		// 指定token分片的请求头
+		ShardHeader: getEnv("SHARD_HEADER", ""),
+		// 共用部署中非中文用户较多时开启，示例: LANGUAGE_DETECTION=claude-4-chat,claude-4-agent
+		LanguageDetection: getEnv("LANGUAGE_DETECTION", ""),
+		// 为空表示不允许通过接口查看完整token，应与 ACCESS_PWD 不同
+		TokenRevealPwd: getEnv("TOKEN_REVEAL_PWD", ""),
+		// 客户端可通过 X-Request-Timeout 请求头缩短预算
+		RequestTimeout: getEnv("REQUEST_TIMEOUT", "0"),
+		// 多实例部署时开启，突发请求由各实例分担，实例重启时排队中的请求由其他实例继续执行
+		ClusterQueue:        getEnv("CLUSTER_QUEUE", "false"),
+		ClusterQueueWorkers: getEnv("CLUSTER_QUEUE_WORKERS", "4"),
+		// 与 REQUEST_TIMEOUT 分开配置，持续输出的长回答不受影响
+		UpstreamIdleTimeout: getEnv("UPSTREAM_IDLE_TIMEOUT", "60"),
+		// 贡献的token只供该API密钥使用，不可用时该密钥的请求仍由共享池处理
+		TokenContribution: getEnv("TOKEN_CONTRIBUTION", "false"),
+		// 抽样记录可在 /api/review/samples 浏览和打标签，调用方可通过 X-Review-Consent 请求头声明是否同意
+		ReviewSampleRate:    getEnv("REVIEW_SAMPLE_RATE", "0"),
+		ReviewSampleConsent: getEnv("REVIEW_SAMPLE_CONSENT", "all"),
+		ReviewSampleScrub:   getEnv("REVIEW_SAMPLE_SCRUB", "true"),
+		// 开启维护模式时可以在请求中单独指定
+		MaintenanceMessage:    getEnv("MAINTENANCE_MESSAGE", "The service is under maintenance. Please retry later."),
+		MaintenanceRetryAfter: getEnv("MAINTENANCE_RETRY_AFTER", "300"),
+		// 对话ID通过 X-Conversation-ID 响应头返回给客户端
+		ConversationStore:         getEnv("CONVERSATION_STORE", "false"),
+		ConversationRetentionDays: getEnv("CONVERSATION_RETENTION_DAYS", "30"),
+		// 上游返回529过载或5xx时分片并发上限减半（429只冷却对应token），之后随成功请求逐步恢复
+		ShardConcurrencyLimit: getEnv("SHARD_CONCURRENCY_LIMIT", "0"),
+		ShardConcurrencyMin:   getEnv("SHARD_CONCURRENCY_MIN", "1"),
+		// 候选地址按最近的检测成功次数排序，超出上限的地址每次随机检测一个
+		TenantCheckMaxCandidates: getEnv("TENANT_CHECK_MAX_CANDIDATES", "8"),
+		// 客户端可通过 X-Strict-Params 请求头单独指定
+		StrictParams: getEnv("STRICT_PARAMS", "false"),
+		// 证书文件更新后新建的连接自动使用新证书，无需重启
+		RedisUsername:    getEnv("REDIS_USERNAME", ""),
+		RedisPassword:    getEnv("REDIS_PASSWORD", ""),
+		RedisTLS:         getEnv("REDIS_TLS", "false"),
+		RedisTLSCAFile:   getEnv("REDIS_TLS_CA_FILE", ""),
+		RedisTLSCertFile: getEnv("REDIS_TLS_CERT_FILE", ""),
+		RedisTLSKeyFile:  getEnv("REDIS_TLS_KEY_FILE", ""),
+		// 按API密钥的每分钟配额和token池剩余次数计算，只提示不拒绝请求
+		RateLimitHeaders: getEnv("RATE_LIMIT_HEADERS", "true"),
+		// 被修改的系统提示词按原因计入 augment2api_guideline_sanitizations_total
+		GuidelineGuard:          getEnv("GUIDELINE_GUARD", "false"),
+		GuidelineMaxLength:      getEnv("GUIDELINE_MAX_LENGTH", "8000"),
+		GuidelineBannedPatterns: getEnv("GUIDELINE_BANNED_PATTERNS", ""),
+		// 降级状态通过 /healthz 返回
+		RedisDegrade:         getEnv("REDIS_DEGRADE", "false"),
+		RedisDegradeLatency:  getEnv("REDIS_DEGRADE_LATENCY_MS", "200"),
+		RedisDegradeTrips:    getEnv("REDIS_DEGRADE_TRIPS", "5"),
+		RedisDegradeCooldown: getEnv("REDIS_DEGRADE_COOLDOWN", "30"),
+	}
+}
+
+// EnvField 一个环境变量对应的配置字段
+type EnvField struct {
+	Env   string `json:"env"`
+	Field string `json:"field"`
+}
+
+// EnvFields 环境变量名到配置字段名的映射，按配置项读取顺序排列
+func EnvFields() []EnvField {
+	var keys []string
+	Load(func(key string) string {
+		keys = append(keys, key)
+		return ""
+	})
+
+	// 逐个设置配置项，值发生变化的字段即为该配置项对应的字段
+	const marker = "\x00augment2api-config-field"
+	fields := make([]EnvField, 0, len(keys))
+	for _, key := range keys {
+		cfg := reflect.ValueOf(Load(func(k string) string {
+			if k == key {
+				return marker
+			}
+			return ""
+		}))
+		for i := 0; i < cfg.NumField(); i++ {
+			if cfg.Field(i).Kind() == reflect.String && cfg.Field(i).String() == marker {
+				fields = append(fields, EnvField{Env: key, Field: cfg.Type().Field(i).Name})
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// FieldValue 按字段名读取配置值，字段不存在时返回false
+func (c Config) FieldValue(field string) (string, bool) {
+	value := reflect.ValueOf(c).FieldByName(field)
+	if !value.IsValid() || value.Kind() != reflect.String {
+		return "", false
+	}
+	return value.String(), true
+}
+
+func InitConfig() error {
+	// 从环境变量读取配置
+	AppConfig = Load(os.Getenv)
+
+	// 模拟上游配合调试模式使用时，补全调试token，无需Redis即可启动
+	if AppConfig.MockUpstream == "true" {
+		logger.Log.Warn("已开启模拟上游，所有上游请求将返回预置响应")
+		if AppConfig.CodingMode == "true" && AppConfig.CodingToken == "" {
+			AppConfig.CodingToken = "mock-token"
+		}
+		if AppConfig.CodingMode == "true" && AppConfig.TenantURL == "" {
+			AppConfig.TenantURL = "https://mock.augmentcode.local/"
+		}
 	}
 
 	if AppConfig.CodingMode == "false" {
@@ -53,7 +461,7 @@ func InitConfig() error {
 		logger.Log.Fatalln("未配置环境变量 ACCESS_PWD")
 	}
 
-	logger.Log.Info("Welcome to use Augment2Api! Current Version: " + version)
+	logger.Log.Info("Welcome to use Augment2Api! Current Version: " + Version)
 
 	logger.Log.Info("Augment2Api配置加载完成:\n" +
 		"----------------------------------------\n" +
@@ -69,11 +477,3 @@ func InitConfig() error {
 
 	return nil
 }
-
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	return value
-}
@@ -3,6 +3,7 @@ package config
 import (
 	"augment2api/pkg/logger"
 	"context"
+	"errors"
 	"os"
 	"time"
 
@@ -20,11 +21,13 @@ func InitRedisClient() (err error) {
 		return nil
 	}
 
-	opt, err := redis.ParseURL(RedisConnString)
+	opt, err := redisOptions(RedisConnString)
 	if err != nil {
 		logger.Log.Fatalln("failed to parse Redis connection string: " + err.Error())
 	}
-	RDB = redis.NewClient(opt)
+	client := redis.NewClient(opt)
+	client.AddHook(slowOpHook{})
+	RDB = client
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -37,7 +40,7 @@ func InitRedisClient() (err error) {
 }
 
 func ParseRedisOption() *redis.Options {
-	opt, err := redis.ParseURL(os.Getenv("REDIS_CONN_STRING"))
+	opt, err := redisOptions(os.Getenv("REDIS_CONN_STRING"))
 	if err != nil {
 		logger.Log.Fatalln("failed to parse Redis connection string: " + err.Error())
 	}
@@ -65,6 +68,16 @@ func RedisHSet(key, field, value string) error {
 	return RDB.HSet(ctx, key, field, value).Err()
 }
 
+// RedisHSetFields 通过一条命令设置哈希表的多个字段，所有字段同时生效
+func RedisHSetFields(key string, fields map[string]string) error {
+	ctx := context.Background()
+	values := make([]interface{}, 0, 2*len(fields))
+	for field, value := range fields {
+		values = append(values, field, value)
+	}
+	return RDB.HSet(ctx, key, values...).Err()
+}
+
 // RedisHGet 获取哈希表字段值
 func RedisHGet(key, field string) (string, error) {
 	ctx := context.Background()
@@ -77,6 +90,12 @@ func RedisExpire(key string, expiration time.Duration) error {
 	return RDB.Expire(ctx, key, expiration).Err()
 }
 
+// RedisTTL 获取键的剩余有效期，键不存在或未设置过期时间时返回负数
+func RedisTTL(key string) (time.Duration, error) {
+	ctx := context.Background()
+	return RDB.TTL(ctx, key).Result()
+}
+
 // RedisKeys 获取匹配指定模式的所有键
 func RedisKeys(pattern string) ([]string, error) {
 	ctx := context.Background()
@@ -111,3 +130,183 @@ func RedisHGetAll(key string) (map[string]string, error) {
 	ctx := context.Background()
 	return RDB.HGetAll(ctx, key).Result()
 }
+
+// RedisLPush 将值插入列表头部
+func RedisLPush(key string, values ...interface{}) error {
+	ctx := context.Background()
+	return RDB.LPush(ctx, key, values...).Err()
+}
+
+// RedisLTrim 裁剪列表，只保留指定区间内的元素
+func RedisLTrim(key string, start, stop int64) error {
+	ctx := context.Background()
+	return RDB.LTrim(ctx, key, start, stop).Err()
+}
+
+// RedisLRange 获取列表指定区间内的元素
+func RedisLRange(key string, start, stop int64) ([]string, error) {
+	ctx := context.Background()
+	return RDB.LRange(ctx, key, start, stop).Result()
+}
+
+// RedisGetDel 获取并删除键，用于一次性凭证
+func RedisGetDel(key string) (string, error) {
+	ctx := context.Background()
+	return RDB.GetDel(ctx, key).Result()
+}
+
+// RedisSetNX 仅当键不存在时设置值，返回是否设置成功
+func RedisSetNX(key string, value string, expiration time.Duration) (bool, error) {
+	ctx := context.Background()
+	return RDB.SetNX(ctx, key, value, expiration).Result()
+}
+
+// RedisIncrValue 增加计数器并返回增加后的值
+func RedisIncrValue(key string) (int64, error) {
+	ctx := context.Background()
+	return RDB.Incr(ctx, key).Result()
+}
+
+// RedisRenewIfOwner 仅当键的值与owner一致时续期，返回是否续期成功
+func RedisRenewIfOwner(key, owner string, expiration time.Duration) (bool, error) {
+	ctx := context.Background()
+	script := `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	result, err := RDB.Eval(ctx, script, []string{key}, owner, expiration.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// RedisPublish 向频道发布消息
+func RedisPublish(channel string, message string) error {
+	ctx := context.Background()
+	return RDB.Publish(ctx, channel, message).Err()
+}
+
+// RedisSubscribe 订阅频道，调用方负责关闭返回的订阅
+func RedisSubscribe(ctx context.Context, channel string) (*redis.PubSub, error) {
+	client, ok := RDB.(*redis.Client)
+	if !ok {
+		return nil, errors.New("当前Redis客户端不支持订阅")
+	}
+
+	pubsub := client.Subscribe(ctx, channel)
+	// 等待订阅确认，确保之后发布的消息不会丢失
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// RedisHIncrBy 增加哈希表字段的计数并返回增加后的值
+func RedisHIncrBy(key, field string, incr int64) (int64, error) {
+	ctx := context.Background()
+	return RDB.HIncrBy(ctx, key, field, incr).Result()
+}
+
+// RedisHDel 删除哈希表中的字段
+func RedisHDel(key string, fields ...string) error {
+	ctx := context.Background()
+	return RDB.HDel(ctx, key, fields...).Err()
+}
+
+// RedisScan 使用SCAN遍历匹配的键，避免KEYS在键很多时阻塞Redis
+func RedisScan(pattern string) ([]string, error) {
+	ctx := context.Background()
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := RDB.Scan(ctx, cursor, pattern, 500).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		cursor = next
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// RedisIncrByBatchMarked 在一个事务中批量增加多个计数器并将markerKey设置为marker，
+// 调用方据此判断批次是否已写入，避免重复写入
+func RedisIncrByBatchMarked(deltas map[string]int64, markerKey, marker string) error {
+	ctx := context.Background()
+	_, err := RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, delta := range deltas {
+			pipe.IncrBy(ctx, key, delta)
+		}
+		pipe.Set(ctx, markerKey, marker, 0)
+		return nil
+	})
+	return err
+}
+
+// RedisHGetAllBatch 通过一次管道读取多个哈希表，不存在的键返回空表
+func RedisHGetAllBatch(keys []string) ([]map[string]string, error) {
+	ctx := context.Background()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err := RDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]string, len(keys))
+	for i, cmd := range cmds {
+		results[i] = cmd.Val()
+	}
+	return results, nil
+}
+
+// RedisMGet 一次读取多个字符串键，不存在的键返回空字符串
+func RedisMGet(keys ...string) ([]string, error) {
+	ctx := context.Background()
+	values, err := RDB.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]string, len(values))
+	for i, value := range values {
+		if str, ok := value.(string); ok {
+			results[i] = str
+		}
+	}
+	return results, nil
+}
+
+// RedisZAdd 向有序集合添加成员或更新其分数
+func RedisZAdd(key string, score float64, member string) error {
+	ctx := context.Background()
+	return RDB.ZAdd(ctx, key, &redis.Z{Score: score, Member: member}).Err()
+}
+
+// RedisZRem 从有序集合中删除成员
+func RedisZRem(key string, member string) error {
+	ctx := context.Background()
+	return RDB.ZRem(ctx, key, member).Err()
+}
+
+// RedisZCard 返回有序集合的成员数
+func RedisZCard(key string) (int64, error) {
+	ctx := context.Background()
+	return RDB.ZCard(ctx, key).Result()
+}
+
+// RedisZClaimDue 原子地取出有序集合中分数不大于due的第一个成员，并将其分数改为leaseUntil
+// 多个实例同时领取时每个成员只会被一个实例取到，没有到期成员时返回空字符串
+func RedisZClaimDue(key string, due, leaseUntil float64) (string, error) {
+	ctx := context.Background()
+	script := `local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 1)
+if #ids == 0 then return "" end
+redis.call("ZADD", KEYS[1], ARGV[2], ids[1])
+return ids[1]`
+	return RDB.Eval(ctx, script, []string{key}, due, leaseUntil).Text()
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"augment2api/pkg/logger"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// redisProbeInterval 降级期间探测Redis的间隔，热路径不再访问Redis时由探测提供恢复依据
+const redisProbeInterval = 5 * time.Second
+
+// RedisHealth Redis熔断器的当前状态
+type RedisHealth struct {
+	Degraded        bool       `json:"degraded"`
+	Since           *time.Time `json:"since,omitempty"` // 进入降级的时间
+	LastLatencyMs   int64      `json:"last_latency_ms"`
+	ThresholdMs     int64      `json:"threshold_ms"`
+	ConsecutiveSlow int        `json:"consecutive_slow"`
+	Trips           int64      `json:"trips"` // 启动以来进入降级的次数
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// redisBreaker 根据每条Redis命令的耗时和错误判断是否降级：
+// 连续多次慢操作或失败后进入降级，降级期间持续一段时间没有慢操作或失败后恢复
+type redisBreaker struct {
+	mu              sync.Mutex
+	degraded        bool
+	since           time.Time
+	lastBad         time.Time
+	lastLatency     time.Duration
+	consecutiveSlow int
+	trips           int64
+	lastError       string
+}
+
+var breaker redisBreaker
+
+// redisDegradeEnabled 是否开启Redis降级，未连接Redis时无需降级
+func redisDegradeEnabled() bool {
+	return AppConfig.RedisDegrade == "true" && RDB != nil
+}
+
+// redisDegradeLatency 判定为慢操作的耗时
+func redisDegradeLatency() time.Duration {
+	ms, err := strconv.Atoi(AppConfig.RedisDegradeLatency)
+	if err != nil || ms <= 0 {
+		return 200 * time.Millisecond
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// redisDegradeTrips 进入降级需要的连续慢操作次数
+func redisDegradeTrips() int {
+	trips, err := strconv.Atoi(AppConfig.RedisDegradeTrips)
+	if err != nil || trips <= 0 {
+		return 5
+	}
+	return trips
+}
+
+// redisDegradeCooldown 降级后恢复需要的持续正常时间
+func redisDegradeCooldown() time.Duration {
+	seconds, err := strconv.Atoi(AppConfig.RedisDegradeCooldown)
+	if err != nil || seconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// redisFailure 命令是否因连接或超时失败，键不存在和业务错误不计入
+func redisFailure(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var redisErr redis.Error
+	return !errors.As(err, &redisErr)
+}
+
+// observeRedisOp 记录一次Redis命令或管道的耗时和结果，由命令钩子调用
+func observeRedisOp(elapsed time.Duration, err error) {
+	if !redisDegradeEnabled() {
+		return
+	}
+	failed := redisFailure(err)
+	bad := failed || elapsed >= redisDegradeLatency()
+	now := time.Now()
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.lastLatency = elapsed
+	if failed {
+		breaker.lastError = err.Error()
+	}
+
+	if !bad {
+		breaker.consecutiveSlow = 0
+		if breaker.degraded && now.Sub(breaker.lastBad) >= redisDegradeCooldown() {
+			breaker.degraded = false
+			logger.Log.WithFields(logrus.Fields{
+				"degraded_for": now.Sub(breaker.since).Round(time.Second).String(),
+			}).Info("Redis延迟恢复正常，退出降级")
+		}
+		return
+	}
+
+	breaker.lastBad = now
+	breaker.consecutiveSlow++
+	if !breaker.degraded && breaker.consecutiveSlow >= redisDegradeTrips() {
+		breaker.degraded = true
+		breaker.since = now
+		breaker.trips++
+		logger.Log.WithFields(logrus.Fields{
+			"latency_ms": elapsed.Milliseconds(),
+			"slow_ops":   breaker.consecutiveSlow,
+			"error":      breaker.lastError,
+		}).Warn("Redis延迟过高，进入降级：从内存缓存选择token，使用计数暂存在内存中")
+	}
+}
+
+// RedisDegraded Redis当前是否处于降级状态
+func RedisDegraded() bool {
+	if !redisDegradeEnabled() {
+		return false
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.degraded
+}
+
+// GetRedisHealth 返回Redis熔断器的当前状态
+func GetRedisHealth() RedisHealth {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	health := RedisHealth{
+		Degraded:        breaker.degraded && redisDegradeEnabled(),
+		LastLatencyMs:   breaker.lastLatency.Milliseconds(),
+		ThresholdMs:     redisDegradeLatency().Milliseconds(),
+		ConsecutiveSlow: breaker.consecutiveSlow,
+		Trips:           breaker.trips,
+		LastError:       breaker.lastError,
+	}
+	if health.Degraded {
+		since := breaker.since
+		health.Since = &since
+	}
+	return health
+}
+
+// StartRedisProbe 降级期间定期探测Redis，探测结果经命令钩子计入熔断器
+func StartRedisProbe() {
+	if !redisDegradeEnabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(redisProbeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !RedisDegraded() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			RDB.Ping(ctx)
+			cancel()
+		}
+	}()
+}
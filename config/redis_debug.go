@@ -0,0 +1,221 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// slowRedisThreshold 耗时超过该值的Redis操作记为慢操作
+	slowRedisThreshold = 50 * time.Millisecond
+	// maxSlowRedisOps 保留的慢操作记录数
+	maxSlowRedisOps = 50
+)
+
+// SlowRedisOp 本实例观察到的一次Redis慢操作，只记录命令名和键的命名空间，不记录参数
+type SlowRedisOp struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Commands   int       `json:"commands,omitempty"` // 管道中的命令数
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// SlowLogEntry Redis服务端慢查询日志中的一条记录，只保留命令名和键的命名空间
+type SlowLogEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Namespace  string    `json:"namespace,omitempty"`
+	DurationUs int64     `json:"duration_us"`
+}
+
+// RedisKeyStats 单个键的内存占用和剩余有效期
+type RedisKeyStats struct {
+	Bytes int64
+	TTL   time.Duration // 小于0表示永不过期
+}
+
+var (
+	slowRedisOps      []SlowRedisOp
+	slowRedisOpsNext  int
+	slowRedisOpsGuard sync.Mutex
+)
+
+// RedisKeyNamespace 键的命名空间，即第一个冒号之前的部分，没有冒号时为键本身
+func RedisKeyNamespace(key string) string {
+	namespace, _, _ := strings.Cut(key, ":")
+	return namespace
+}
+
+// slowOpHook 记录耗时超过阈值的Redis命令和管道，同时将耗时和结果计入熔断器
+type slowOpHook struct{}
+
+type slowOpStartKey struct{}
+
+func (slowOpHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, slowOpStartKey{}, time.Now()), nil
+}
+
+func (slowOpHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(slowOpStartKey{}).(time.Time); ok {
+		elapsed := time.Since(start)
+		observeRedisOp(elapsed, cmd.Err())
+		if elapsed >= slowRedisThreshold {
+			recordSlowRedisOp(SlowRedisOp{
+				Time:       start,
+				Command:    cmd.Name(),
+				Namespace:  cmdNamespace(cmd.Args()),
+				DurationMs: elapsed.Milliseconds(),
+			})
+		}
+	}
+	return nil
+}
+
+func (slowOpHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, slowOpStartKey{}, time.Now()), nil
+}
+
+func (slowOpHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if start, ok := ctx.Value(slowOpStartKey{}).(time.Time); ok && len(cmds) > 0 {
+		elapsed := time.Since(start)
+		observeRedisOp(elapsed, pipelineErr(cmds))
+		if elapsed >= slowRedisThreshold {
+			recordSlowRedisOp(SlowRedisOp{
+				Time:       start,
+				Command:    "pipeline:" + cmds[0].Name(),
+				Namespace:  cmdNamespace(cmds[0].Args()),
+				Commands:   len(cmds),
+				DurationMs: elapsed.Milliseconds(),
+			})
+		}
+	}
+	return nil
+}
+
+// pipelineErr 管道中第一条命令的连接或超时错误
+func pipelineErr(cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); redisFailure(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmdNamespace 命令第一个参数（通常是键）的命名空间
+func cmdNamespace(args []interface{}) string {
+	if len(args) < 2 {
+		return ""
+	}
+	key, ok := args[1].(string)
+	if !ok {
+		return ""
+	}
+	return RedisKeyNamespace(key)
+}
+
+// recordSlowRedisOp 写入慢操作记录，超出容量时覆盖最早的记录
+func recordSlowRedisOp(op SlowRedisOp) {
+	slowRedisOpsGuard.Lock()
+	defer slowRedisOpsGuard.Unlock()
+	if len(slowRedisOps) < maxSlowRedisOps {
+		slowRedisOps = append(slowRedisOps, op)
+		return
+	}
+	slowRedisOps[slowRedisOpsNext] = op
+	slowRedisOpsNext = (slowRedisOpsNext + 1) % maxSlowRedisOps
+}
+
+// RecentSlowRedisOps 按时间倒序返回本实例观察到的Redis慢操作
+func RecentSlowRedisOps() []SlowRedisOp {
+	slowRedisOpsGuard.Lock()
+	defer slowRedisOpsGuard.Unlock()
+	result := make([]SlowRedisOp, 0, len(slowRedisOps))
+	for i := 0; i < len(slowRedisOps); i++ {
+		index := (slowRedisOpsNext - 1 - i + 2*len(slowRedisOps)) % len(slowRedisOps)
+		result = append(result, slowRedisOps[index])
+	}
+	return result
+}
+
+// RedisKeyStatsBatch 通过一次管道读取多个键的内存占用和剩余有效期，读取失败的键返回零值
+func RedisKeyStatsBatch(keys []string) ([]RedisKeyStats, error) {
+	ctx := context.Background()
+	memory := make([]*redis.IntCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := RDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			memory[i] = pipe.MemoryUsage(ctx, key)
+			ttls[i] = pipe.TTL(ctx, key)
+		}
+		return nil
+	})
+	// 键在读取前过期时单条命令返回nil，不影响其他结果
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	stats := make([]RedisKeyStats, len(keys))
+	for i := range keys {
+		stats[i] = RedisKeyStats{Bytes: memory[i].Val(), TTL: ttls[i].Val()}
+	}
+	return stats, nil
+}
+
+// RedisMemoryInfo 读取Redis INFO memory 中的数值字段
+func RedisMemoryInfo() (map[string]int64, error) {
+	ctx := context.Background()
+	info, err := RDB.Info(ctx, "memory").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int64)
+	for _, line := range strings.Split(info, "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			result[name] = n
+		}
+	}
+	return result, nil
+}
+
+// RedisSlowLog 读取Redis服务端最近的慢查询日志，托管Redis可能禁用该命令
+func RedisSlowLog(limit int64) ([]SlowLogEntry, error) {
+	client, ok := RDB.(interface {
+		SlowLogGet(ctx context.Context, num int64) *redis.SlowLogCmd
+	})
+	if !ok {
+		return nil, errors.New("当前Redis客户端不支持读取慢查询日志")
+	}
+
+	ctx := context.Background()
+	logs, err := client.SlowLogGet(ctx, limit).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]SlowLogEntry, len(logs))
+	for i, log := range logs {
+		entry := SlowLogEntry{ID: log.ID, Time: log.Time, DurationUs: log.Duration.Microseconds()}
+		if len(log.Args) > 0 {
+			entry.Command = strings.ToLower(log.Args[0])
+		}
+		if len(log.Args) > 1 {
+			entry.Namespace = RedisKeyNamespace(log.Args[1])
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
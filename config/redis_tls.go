@@ -0,0 +1,180 @@
+package config
+
+import (
+	"augment2api/pkg/logger"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// redisTLSCheckInterval 检查证书文件是否更新的最短间隔
+const redisTLSCheckInterval = 30 * time.Second
+
+// redisOptions 解析Redis连接地址，REDIS_USERNAME、REDIS_PASSWORD 覆盖地址中的ACL用户和密码，
+// 使用 rediss:// 或开启 REDIS_TLS 时通过TLS连接，可配置CA证书和客户端证书
+func redisOptions(connString string) (*redis.Options, error) {
+	opt, err := redis.ParseURL(connString)
+	if err != nil {
+		return nil, err
+	}
+	if AppConfig.RedisUsername != "" {
+		opt.Username = AppConfig.RedisUsername
+	}
+	if AppConfig.RedisPassword != "" {
+		opt.Password = AppConfig.RedisPassword
+	}
+	if opt.TLSConfig == nil && AppConfig.RedisTLS != "true" {
+		return opt, nil
+	}
+
+	serverName := ""
+	if opt.TLSConfig != nil {
+		serverName = opt.TLSConfig.ServerName
+	} else if host, _, err := net.SplitHostPort(opt.Addr); err == nil {
+		serverName = host
+	}
+	certs := &redisTLSCerts{
+		serverName: serverName,
+		caFile:     AppConfig.RedisTLSCAFile,
+		certFile:   AppConfig.RedisTLSCertFile,
+		keyFile:    AppConfig.RedisTLSKeyFile,
+	}
+	if (certs.certFile == "") != (certs.keyFile == "") {
+		return nil, errors.New("REDIS_TLS_CERT_FILE 和 REDIS_TLS_KEY_FILE 需要同时配置")
+	}
+	if _, err := certs.current(); err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: opt.DialTimeout, KeepAlive: 5 * time.Minute}
+	opt.TLSConfig = nil
+	opt.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return certs.dial(ctx, dialer, network, addr)
+	}
+	return opt, nil
+}
+
+// redisTLSCerts Redis的TLS证书，证书文件更新后在新建连接时重新加载，已建立的连接不受影响
+type redisTLSCerts struct {
+	serverName string
+	caFile     string
+	certFile   string
+	keyFile    string
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time // 加载时各证书文件的修改时间
+	checkedAt time.Time
+}
+
+// fileModTimes 各证书文件当前的修改时间，文件不存在时为零值
+func (r *redisTLSCerts) fileModTimes() []time.Time {
+	var times []time.Time
+	for _, name := range []string{r.caFile, r.certFile, r.keyFile} {
+		var modTime time.Time
+		if name != "" {
+			if info, err := os.Stat(name); err == nil {
+				modTime = info.ModTime()
+			}
+		}
+		times = append(times, modTime)
+	}
+	return times
+}
+
+// current 返回当前的TLS配置，证书文件有更新时重新加载，加载失败时继续使用之前的配置
+func (r *redisTLSCerts) current() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config != nil && time.Since(r.checkedAt) < redisTLSCheckInterval {
+		return r.config, nil
+	}
+	r.checkedAt = time.Now()
+
+	modTimes := r.fileModTimes()
+	if r.config != nil && sameModTimes(modTimes, r.modTimes) {
+		return r.config, nil
+	}
+	config, err := r.load()
+	if err != nil {
+		if r.config == nil {
+			return nil, err
+		}
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("重新加载Redis证书失败，继续使用之前的证书")
+		return r.config, nil
+	}
+
+	if r.config != nil {
+		logger.Log.Info("Redis证书已更新，新建连接将使用新证书")
+	}
+	r.config, r.modTimes = config, modTimes
+	return config, nil
+}
+
+// load 读取证书文件生成TLS配置
+func (r *redisTLSCerts) load() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: r.serverName,
+	}
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA证书文件中没有有效的证书: " + r.caFile)
+		}
+		config.RootCAs = pool
+	}
+	if r.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dial 建立到Redis的TLS连接
+func (r *redisTLSCerts) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	config, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// sameModTimes 两组修改时间是否相同
+func sameModTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
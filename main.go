@@ -4,15 +4,22 @@ import (
 	"augment2api/api"
 	"augment2api/config"
 	"augment2api/middleware"
+	"augment2api/pkg/job"
+	"augment2api/pkg/leader"
 	"augment2api/pkg/logger"
+	"augment2api/pkg/queue"
+	tokenmanager "augment2api/pkg/token"
 	"crypto/rand"
 	"crypto/sha256"
+	"embed"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -34,6 +41,11 @@ var (
 	globalOAuthState OAuthState
 )
 
+// uiFiles 编译进二进制的管理界面页面模板和静态资源
+//
+//go:embed static templates
+var uiFiles embed.FS
+
 // base64URLEncode 编码Buffer为base64 URL安全格式
 func base64URLEncode(data []byte) string {
 	encoded := base64.StdEncoding.EncodeToString(data)
@@ -122,19 +134,37 @@ func getAccessToken(tenantURL, codeVerifier, code string) (string, error) {
 	return token, nil
 }
 
-// 初始化路由
-func setupRouter() *gin.Engine {
+// 初始化路由，返回 (API路由, 管理路由)，未配置 ADMIN_LISTEN 时两者为同一个engine
+func setupRouter() (*gin.Engine, *gin.Engine) {
 	r := gin.Default()
 
 	// 跨域
 	r.Use(middleware.CORS())
+	// 捕获panic并记录请求上下文
+	r.Use(api.PanicRecoveryMiddleware())
+
+	// 配置了单独的管理监听时，对外的v1接口使用独立的engine
+	apiRouter := r
+	if config.AppConfig.AdminListen != "" {
+		apiRouter = gin.Default()
+		apiRouter.Use(middleware.CORS())
+		apiRouter.Use(api.PanicRecoveryMiddleware())
+	}
 
 	// 初始化OAuth状态
 	globalOAuthState = createOAuthState()
 
-	// 静态文件服务
-	r.Static("/static", "./static")
-	r.LoadHTMLGlob("templates/*")
+	// 静态文件服务，页面通过带内容哈希的路径引用资源，升级后浏览器不会使用旧的缓存
+	templates, err := api.LoadUI(uiFiles)
+	if err != nil {
+		logger.Log.Fatalln("failed to load admin UI: " + err.Error())
+	}
+	r.SetHTMLTemplate(templates)
+	r.GET("/static/*filepath", api.StaticAssetHandler)
+	r.HEAD("/static/*filepath", api.StaticAssetHandler)
+
+	// 管理界面版本，页面据此判断是否需要刷新
+	r.GET("/api/ui/version", api.UIVersionHandler)
 
 	// 登录页面
 	r.GET("/login", func(c *gin.Context) {
@@ -189,12 +219,150 @@ func setupRouter() *gin.Engine {
 	// 删除token - 需要会话验证
 	r.DELETE("/api/token/:token", api.AuthTokenMiddleware(), api.DeleteTokenHandler)
 
+	// 重新校验并启用被禁用的token - 需要会话验证
+	r.POST("/api/token/:token/activate", api.AuthTokenMiddleware(), api.ReactivateTokenHandler)
+
 	// 更新token备注 - 需要会话验证
 	r.PUT("/api/token/:token/remark", api.AuthTokenMiddleware(), api.UpdateTokenRemark)
 
+	// 更新token自定义请求头 - 需要会话验证
+	r.PUT("/api/token/:token/headers", api.AuthTokenMiddleware(), api.UpdateTokenHeaders)
+
+	// 更新token签名器 - 需要会话验证
+	r.PUT("/api/token/:token/signer", api.AuthTokenMiddleware(), api.UpdateTokenSigner)
+
+	// token状态变化实时推送 - 需要会话验证
+	r.GET("/api/tokens/stream", api.AuthTokenMiddleware(), api.TokenEventsHandler)
+
+	// 获取token请求历史 - 需要会话验证
+	r.GET("/api/tokens/:token/history", api.AuthTokenMiddleware(), api.GetTokenHistoryHandler)
+
+	// 获取token活动时间线 - 需要会话验证
+	r.GET("/api/tokens/:token/timeline", api.AuthTokenMiddleware(), api.GetTokenTimelineHandler)
+
+	// 批量修改token租户地址 - 需要会话验证
+	r.POST("/api/tokens/retenant", api.AuthTokenMiddleware(), api.RetenantTokensHandler)
+	// 全池token去重 - 需要会话验证
+	r.POST("/api/tokens/dedupe", api.AuthTokenMiddleware(), api.TokenDedupeHandler)
+	r.GET("/api/tokens/dedupe/:id", api.AuthTokenMiddleware(), api.TokenDedupeJobHandler)
+	// 异步添加token的后台任务进度 - 需要会话验证
+	r.GET("/api/tokens/import/:id", api.AuthTokenMiddleware(), api.TokenImportJobHandler)
+
 	// 批量检测token - 需要会话验证
 	r.GET("/api/check-tokens", api.AuthTokenMiddleware(), api.CheckAllTokensHandler)
 
+	// token池容量统计 - 需要会话验证
+	r.GET("/api/pool/capacity", api.AuthTokenMiddleware(), api.PoolCapacityHandler)
+
+	// token池容量模拟 - 需要会话验证
+	r.POST("/api/pool/simulate", api.AuthTokenMiddleware(), api.SimulatePoolHandler)
+
+	// 输出质量抽样记录 - 需要会话验证
+	r.GET("/api/review/samples", api.AuthTokenMiddleware(), api.ListReviewSamplesHandler)
+	r.GET("/api/review/samples/:id", api.AuthTokenMiddleware(), api.GetReviewSampleHandler)
+	r.PUT("/api/review/samples/:id/tags", api.AuthTokenMiddleware(), api.TagReviewSampleHandler)
+	r.DELETE("/api/review/samples/:id", api.AuthTokenMiddleware(), api.DeleteReviewSampleHandler)
+	r.GET("/api/review/summary", api.AuthTokenMiddleware(), api.ReviewSummaryHandler)
+
+	// 租户分片延迟探测结果 - 需要会话验证
+	r.GET("/api/probes/latency", api.AuthTokenMiddleware(), api.ShardLatencyHandler)
+	// 上游分片自适应并发上限 - 需要会话验证
+	r.GET("/api/shards/concurrency", api.AuthTokenMiddleware(), api.ShardConcurrencyHandler)
+
+	// 上游HTTP协议协商情况 - 需要会话验证
+	r.GET("/api/upstream/protocols", api.AuthTokenMiddleware(), api.UpstreamProtocolsHandler)
+
+	// 启动时token池校验报告 - 需要会话验证
+	r.GET("/api/startup-report", api.AuthTokenMiddleware(), api.StartupReportHandler)
+
+	// 存储结构迁移状态与预演 - 需要会话验证
+	r.GET("/api/migrations", api.AuthTokenMiddleware(), api.MigrationStatusHandler)
+	r.POST("/api/migrations/dry-run", api.AuthTokenMiddleware(), api.MigrationDryRunHandler)
+
+	// API密钥管理 - 需要会话验证
+	r.GET("/api/keys", api.AuthTokenMiddleware(), api.ListAPIKeysHandler)
+	r.POST("/api/keys", api.AuthTokenMiddleware(), api.CreateAPIKeyHandler)
+	r.PUT("/api/keys/:key", api.AuthTokenMiddleware(), api.UpdateAPIKeyHandler)
+	r.DELETE("/api/keys/:key", api.AuthTokenMiddleware(), api.DeleteAPIKeyHandler)
+
+	// 审计日志 - 需要会话验证
+	r.GET("/api/audit", api.AuthTokenMiddleware(), api.AuditLogHandler)
+
+	// 多实例选主状态 - 需要会话验证
+	r.GET("/api/leader", api.AuthTokenMiddleware(), api.LeaderStatusHandler)
+
+	// token池快照与对比 - 需要会话验证
+	r.GET("/api/snapshots", api.AuthTokenMiddleware(), api.ListTokenSnapshotsHandler)
+	r.POST("/api/snapshots", api.AuthTokenMiddleware(), api.CreateTokenSnapshotHandler)
+	r.GET("/api/snapshots/diff", api.AuthTokenMiddleware(), api.DiffTokenSnapshotsHandler)
+
+	// 终端用户统计与请求频率上限 - 需要会话验证
+	r.GET("/api/users/stats", api.AuthTokenMiddleware(), api.UserStatsHandler)
+	r.PUT("/api/users/:user/rate-limit", api.AuthTokenMiddleware(), api.UpdateUserRateLimitHandler)
+
+	// 按小时和星期汇总的请求热力图 - 需要会话验证
+	r.GET("/api/stats/heatmap", api.AuthTokenMiddleware(), api.RequestHeatmapHandler)
+
+	// 首个分块延迟分位数与SLO状态 - 需要会话验证
+	r.GET("/api/latency/first-token", api.AuthTokenMiddleware(), api.FirstTokenLatencyHandler)
+
+	// 计划任务额度预留 - 需要会话验证
+	r.GET("/api/reservations", api.AuthTokenMiddleware(), api.ListReservationsHandler)
+	r.POST("/api/reservations", api.AuthTokenMiddleware(), api.CreateReservationHandler)
+	r.DELETE("/api/reservations/:id", api.AuthTokenMiddleware(), api.DeleteReservationHandler)
+
+	// 维护模式 - 需要会话验证，维护期间管理接口仍然可用
+	r.GET("/api/maintenance", api.AuthTokenMiddleware(), api.GetMaintenanceHandler)
+	r.POST("/api/maintenance", api.AuthTokenMiddleware(), api.SetMaintenanceHandler)
+
+	// token关联数据清理与归档 - 需要会话验证
+	r.POST("/api/maintenance/cleanup", api.AuthTokenMiddleware(), api.KeyCleanupHandler)
+	r.GET("/api/maintenance/archive", api.AuthTokenMiddleware(), api.TokenArchiveHandler)
+
+	// 进行中的请求与取消 - 需要会话验证
+	r.GET("/api/requests/active", api.AuthTokenMiddleware(), api.ActiveRequestsHandler)
+	r.DELETE("/api/requests/active/:id", api.AuthTokenMiddleware(), api.CancelActiveRequestHandler)
+
+	// token池调整报告 - 需要会话验证
+	r.GET("/api/reports/rebalance", api.AuthTokenMiddleware(), api.RebalanceReportsHandler)
+	r.POST("/api/reports/rebalance", api.AuthTokenMiddleware(), api.GenerateRebalanceReportHandler)
+
+	// 最近的崩溃记录 - 需要会话验证
+	r.GET("/api/debug/panics", api.AuthTokenMiddleware(), api.PanicRecordsHandler)
+
+	// Redis存储占用 - 需要会话验证
+	r.GET("/api/debug/redis", api.AuthTokenMiddleware(), api.RedisDebugHandler)
+
+	// 配置校验 - 需要会话验证
+	r.POST("/api/config/validate", api.AuthTokenMiddleware(), api.ValidateConfigHandler)
+
+	// token提交链接 - 需要会话验证
+	r.POST("/api/token-links", api.AuthTokenMiddleware(), api.CreateTokenLinkHandler)
+	r.DELETE("/api/token-links/:id", api.AuthTokenMiddleware(), api.RevokeTokenLinkHandler)
+
+	// 模块日志级别与采样 - 需要会话验证
+	r.GET("/api/logging", api.AuthTokenMiddleware(), api.LoggingSettingsHandler)
+	r.PUT("/api/logging", api.AuthTokenMiddleware(), api.UpdateLoggingSettingsHandler)
+
+	// 请求队列状态与运行时调整 - 需要会话验证
+	r.GET("/api/queue", api.AuthTokenMiddleware(), api.QueueStatusHandler)
+	r.PUT("/api/queue", api.AuthTokenMiddleware(), api.UpdateQueueSettingsHandler)
+
+	// Prometheus监控指标
+	r.GET("/metrics", api.MetricsHandler)
+
+	// 健康检查，包含Redis降级状态
+	r.GET("/healthz", api.HealthzHandler)
+
+	// 汇总后的监控指标 - 需要会话验证
+	r.GET("/api/stats", api.AuthTokenMiddleware(), api.StatsHandler)
+
+	// 版本信息 - 需要会话验证
+	r.GET("/api/version", api.AuthTokenMiddleware(), api.VersionHandler)
+
+	// OpenAPI规范
+	r.GET("/api/openapi.json", api.OpenAPIHandler(r, apiRouter))
+
 	// 回调端点，用于处理授权码 - 需要会话验证
 	r.POST("/callback", api.AuthTokenMiddleware(), func(c *gin.Context) {
 		api.CallbackHandler(c, func(tenantURL, _, code string) (string, error) {
@@ -202,15 +370,32 @@ func setupRouter() *gin.Engine {
 		})
 	})
 
+	// 通过签名链接提交token，链接本身即凭证，与v1接口一同对外开放
+	apiRouter.GET("/submit-tokens", api.TokenLinkFormHandler)
+	apiRouter.POST("/submit-tokens", api.SubmitTokensViaLinkHandler)
+
 	// 鉴权路由组
-	authGroup := r.Group(ProcessPath(config.AppConfig.RoutePrefix))
+	authGroup := apiRouter.Group(ProcessPath(config.AppConfig.RoutePrefix))
 	authGroup.Use(api.AuthMiddleware())
+	// 在响应中返回配额提示
+	authGroup.Use(api.RateLimitHeadersMiddleware())
 	{
-		// OpenAI兼容的聊天端点
+		// 生成类端点，组内的请求都会独占一个token
 		chatGroup := authGroup.Group("/")
+		// 维护期间拒绝新的生成请求
+		chatGroup.Use(api.MaintenanceMiddleware())
+		// 故障注入，仅调试时开启
+		chatGroup.Use(middleware.ChaosMiddleware())
+		// 登记进行中的请求
+		chatGroup.Use(api.RequestInspectorMiddleware())
+		// 在获取token之前校验请求体
+		chatGroup.Use(api.RequestValidationMiddleware())
+		// 开启共享队列时非流式请求交由集群执行
+		chatGroup.Use(api.ClusterQueueMiddleware())
 		// 并发控制
 		chatGroup.Use(middleware.TokenConcurrencyMiddleware())
 		{
+			// OpenAI兼容的聊天端点
 			chatGroup.POST("/v1/chat/completions", api.ChatCompletionsHandler)
 			chatGroup.POST("/v1", api.ChatCompletionsHandler)
 			chatGroup.POST("/v1/chat", api.ChatCompletionsHandler)
@@ -218,11 +403,37 @@ func setupRouter() *gin.Engine {
 			chatGroup.POST("/v1/messages", api.AnthropicMessagesHandler)
 		}
 
+		// 非生成类端点不占用token，需要访问上游时使用 middleware.TokenLookupMiddleware
 		authGroup.GET("/v1/models", api.ModelsHandler)
-		authGroup.POST("/api/add/tokens", api.AddTokenHandler)
+		// 当前部署支持的功能和限制
+		authGroup.GET("/v1/capabilities", api.CapabilitiesHandler)
+		// 对话标题生成，自行获取低优先级token，不经过并发控制中间件
+		titleGroup := authGroup.Group("/")
+		titleGroup.Use(api.MaintenanceMiddleware())
+		titleGroup.Use(api.RequestValidationMiddleware())
+		titleGroup.POST("/v1/conversations/title", api.ConversationTitleHandler)
+		// 查询带回调地址请求的执行状态
+		authGroup.GET("/v1/jobs/:id", api.JobStatusHandler)
+		// 查询后台执行的聊天请求，wait 参数指定未完成时最多等待的时间
+		authGroup.GET("/v1/requests/:id", api.RequestStatusHandler)
+		// 调用方贡献自己的token，需开启 TOKEN_CONTRIBUTION
+		authGroup.POST("/v1/tokens/contribution", api.ContributeTokenHandler)
+		authGroup.GET("/v1/tokens/contribution", api.GetContributionHandler)
+		authGroup.DELETE("/v1/tokens/contribution", api.WithdrawContributionHandler)
+		// API密钥的默认系统提示词
+		authGroup.GET("/v1/key/system-prompt", api.GetKeySystemPromptHandler)
+		authGroup.PUT("/v1/key/system-prompt", api.SetKeySystemPromptHandler)
+		authGroup.DELETE("/v1/key/system-prompt", api.DeleteKeySystemPromptHandler)
+		// 导出服务端保存的对话记录，需开启 CONVERSATION_STORE
+		authGroup.GET("/v1/conversations/:id/export", api.ExportConversationHandler)
 	}
 
-	return r
+	// 通过管理密钥批量添加token，属于token管理，配置了 ADMIN_LISTEN 时只在管理监听上提供
+	tokenAdminGroup := r.Group(ProcessPath(config.AppConfig.RoutePrefix))
+	tokenAdminGroup.Use(api.AuthMiddleware(), api.PrivilegedKeyMiddleware())
+	tokenAdminGroup.POST("/api/add/tokens", api.AddTokenHandler)
+
+	return apiRouter, r
 }
 
 func ProcessPath(path string) string {
@@ -245,6 +456,11 @@ func ProcessPath(path string) string {
 }
 
 func main() {
+	// 运行模式: server 提供API服务，validator 只运行token校验和分片探测，migrate 执行存储结构迁移后退出
+	mode := flag.String("mode", "server", "运行模式: server / validator / migrate")
+	dryRun := flag.Bool("dry-run", false, "migrate 模式下只报告将要发生的变更，不写入Redis")
+	flag.Parse()
+
 	// 设置全局时区为东八区（CST）
 	time.Local = time.FixedZone("CST", 8*3600)
 
@@ -267,16 +483,114 @@ func main() {
 		logger.Log.Fatalln("failed to initialize Redis: " + err.Error())
 	}
 
-	// token session_id字段迁移
-	err = api.MigrateTokensSessionID()
+	// 独立校验进程不参与选主，也不提供HTTP服务
+	if *mode == "validator" {
+		api.RunValidator()
+		return
+	}
+	// 独立执行或预演迁移，报告输出到标准输出
+	if *mode == "migrate" {
+		api.RegisterMigrations()
+		os.Exit(api.RunMigrationCommand(*dryRun))
+	}
+	if *mode != "server" {
+		logger.Log.Fatalln("未知的运行模式: " + *mode)
+	}
+
+	// 多实例选主
+	leader.Start()
+
+	// 初始化请求队列
+	queue.Init()
+
+	// 加载出站请求预处理规则
+	err = api.InitRequestTransforms()
+	if err != nil {
+		logger.Log.Fatalln("failed to load request transforms: " + err.Error())
+	}
+
+	// 加载出站请求签名器
+	err = api.InitRequestSigners()
+	if err != nil {
+		logger.Log.Fatalln("failed to load request signers: " + err.Error())
+	}
+
+	// 加载输出过滤规则
+	err = api.InitOutputFilter()
+	if err != nil {
+		logger.Log.Fatalln("failed to load output filter: " + err.Error())
+	}
+
+	// 加载系统提示词检查规则
+	err = api.InitGuidelineGuard()
 	if err != nil {
-		logger.Log.Error("Token session_id字段迁移失败: %v", err)
+		logger.Log.Fatalln("failed to load guideline guard: " + err.Error())
 	}
 
+	// Redis存储结构迁移
+	api.RegisterMigrations()
+	err = api.RunMigrations()
+	if err != nil {
+		logger.Log.Errorf("Redis存储结构迁移失败: %v", err)
+	}
+
+	// 启动时校验token池
+	api.RunStartupValidation()
+
+	// 按配置启用内存使用计数
+	tokenmanager.StartUsageStore()
+
+	// Redis延迟过高时降级使用的token缓存
+	tokenmanager.StartTokenCache()
+
+	// 定期回收空闲的token锁
+	tokenmanager.StartTokenLockEviction()
+
+	// 同步维护模式状态，维护期间暂停后台任务
+	api.StartMaintenanceSync()
+
+	// 启动后台任务工作协程
+	api.RegisterJobs()
+	job.Start()
+	api.StartClusterQueue()
+
 	// 启动token使用次数重置调度器
 	go api.StartTokenUsageResetScheduler()
 
-	r := setupRouter()
+	// 启动租户分片延迟探测
+	go api.StartLatencyProber()
+
+	// 启动首个分块延迟SLO检查
+	go api.StartFirstTokenSLOMonitor()
+
+	// 启动上游连接预热
+	go api.StartConnectionWarmer()
+
+	// 启动token关联数据清理
+	go api.StartKeyCleanupScheduler()
+
+	// 启动token池调整报告
+	api.StartRebalanceReportScheduler()
+
+	// 启动新版本检查
+	go api.StartUpdateChecker()
+
+	// 启动指标快照发布
+	go api.StartMetricsPublisher()
+
+	r, admin := setupRouter()
+
+	// 管理页面和管理接口单独监听
+	if admin != r {
+		go func() {
+			logger.Log.WithFields(map[string]interface{}{
+				"listen": config.AppConfig.AdminListen,
+			}).Info("管理接口单独监听")
+			if err := admin.Run(config.AppConfig.AdminListen); err != nil {
+				logger.Log.Fatalf("启动管理接口失败: %v", err)
+			}
+		}()
+	}
 
 	// 启动服务器
 	if err := r.Run(":27080"); err != nil {
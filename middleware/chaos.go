@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 故障注入类型
+const (
+	chaosFault429       = "429"
+	chaosFaultSlow      = "slow"
+	chaosFaultDrop      = "drop"
+	chaosFaultMalformed = "malformed"
+)
+
+// chaosFaults 按固定顺序参与随机选择，保证同样的配置行为一致
+var chaosFaults = []string{chaosFault429, chaosFaultSlow, chaosFaultDrop, chaosFaultMalformed}
+
+// parseChaosRates 解析故障比例配置，示例: 429=0.1,slow=0.1,drop=0.05,malformed=0.05
+func parseChaosRates(value string) map[string]float64 {
+	rates := make(map[string]float64)
+	for _, item := range strings.Split(value, ",") {
+		name, rate, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if err != nil || r <= 0 {
+			continue
+		}
+		rates[strings.TrimSpace(name)] = r
+	}
+	return rates
+}
+
+// pickChaosFault 按比例随机选择本次请求注入的故障，请求头 X-Chaos-Fault 可指定故障
+func pickChaosFault(c *gin.Context, rates map[string]float64) string {
+	if fault := c.GetHeader("X-Chaos-Fault"); fault != "" {
+		for _, known := range chaosFaults {
+			if fault == known {
+				return fault
+			}
+		}
+		return ""
+	}
+
+	roll := rand.Float64()
+	for _, fault := range chaosFaults {
+		roll -= rates[fault]
+		if roll < 0 {
+			return fault
+		}
+	}
+	return ""
+}
+
+// ChaosMiddleware 调试用的故障注入中间件，用于测试下游客户端的重试逻辑
+func ChaosMiddleware() gin.HandlerFunc {
+	if config.AppConfig.ChaosMode != "true" {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	rates := parseChaosRates(config.AppConfig.ChaosRates)
+	delayMs, err := strconv.Atoi(config.AppConfig.ChaosSlowDelay)
+	if err != nil || delayMs <= 0 {
+		delayMs = 500
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+
+	logger.Middleware.WithFields(logrus.Fields{
+		"rates":      rates,
+		"slow_delay": delay.String(),
+	}).Warn("已开启故障注入，请勿在生产环境使用")
+
+	return func(c *gin.Context) {
+		fault := pickChaosFault(c, rates)
+		if fault == "" {
+			c.Next()
+			return
+		}
+
+		logger.Middleware.WithFields(logrus.Fields{
+			"fault": fault,
+			"path":  c.Request.URL.Path,
+		}).Warn("注入故障")
+		c.Set("error_class", "chaos_"+fault)
+
+		switch fault {
+		case chaosFault429:
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error": gin.H{
+					"message": "Rate limit exceeded (injected by chaos mode)",
+					"type":    "rate_limit_error",
+					"code":    "rate_limit_exceeded",
+				},
+			})
+			c.Abort()
+			return
+		case chaosFaultSlow:
+			c.Writer = &chaosWriter{ResponseWriter: c.Writer, delay: delay}
+		case chaosFaultDrop:
+			// 输出一部分内容后断开连接
+			c.Writer = &chaosWriter{ResponseWriter: c.Writer, dropAfter: 1 + rand.Intn(3)}
+		case chaosFaultMalformed:
+			c.Writer = &chaosWriter{ResponseWriter: c.Writer, malformAt: 1 + rand.Intn(3)}
+		}
+		c.Next()
+	}
+}
+
+// chaosWriter 包装响应写入，按故障类型延迟、截断或破坏输出
+type chaosWriter struct {
+	gin.ResponseWriter
+	delay     time.Duration
+	dropAfter int
+	malformAt int
+	writes    int
+	dropped   bool
+}
+
+// Write 写入响应分块
+func (w *chaosWriter) Write(data []byte) (int, error) {
+	if w.dropped {
+		return 0, http.ErrHijacked
+	}
+	w.writes++
+
+	if w.delay > 0 {
+		time.Sleep(w.delay)
+	}
+
+	// 非流式响应只有一次写入，直接在第一次写入时注入
+	stream := strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+	due := !stream || w.writes >= w.malformAt
+	if w.dropAfter > 0 {
+		due = !stream || w.writes >= w.dropAfter
+	}
+
+	switch {
+	case w.malformAt > 0 && due:
+		// 截断为不完整的JSON，流式响应保留分块边界以便客户端按行解析
+		malformed := append([]byte{}, data[:len(data)/2]...)
+		if stream {
+			malformed = append(malformed, "\n\n"...)
+		}
+		w.malformAt = 0
+		if _, err := w.ResponseWriter.Write(malformed); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	case w.dropAfter > 0 && due:
+		if !stream {
+			data = data[:len(data)/2]
+		}
+		n, err := w.ResponseWriter.Write(data)
+		w.drop()
+		return n, err
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString 写入字符串分块
+func (w *chaosWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush 连接断开后不再刷新，底层writer已随hijack释放
+func (w *chaosWriter) Flush() {
+	if w.dropped {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+// drop 发送已写入的内容后直接关闭底层连接
+func (w *chaosWriter) drop() {
+	w.ResponseWriter.Flush()
+	conn, _, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+	w.dropped = true
+}
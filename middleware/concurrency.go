@@ -2,10 +2,15 @@ package middleware
 
 import (
 	"augment2api/config"
+	"augment2api/pkg/apikey"
 	"augment2api/pkg/logger"
+	"augment2api/pkg/queue"
 	tokenmanager "augment2api/pkg/token"
+	"context"
+	"errors"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,14 +20,9 @@ import (
 
 
 // TokenConcurrencyMiddleware 控制Redis中token的使用频率
+// 只挂载在生成类接口的路由组上，组内每个请求都会独占一个token直到请求结束
 func TokenConcurrencyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 只对聊天完成请求和消息请求进行并发控制
-		if !strings.HasSuffix(c.Request.URL.Path, "/chat/completions") && !strings.HasSuffix(c.Request.URL.Path, "/messages") {
-			c.Next()
-			return
-		}
-
 		// 调试模式无需限制
 		if config.AppConfig.CodingMode == "true" {
 			token := config.AppConfig.CodingToken
@@ -33,14 +33,76 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 获取一个可用的token
-		tokenStr, tenantURL, sessionID := tokenmanager.GetAvailableToken()
+		// 获取一个可用的token，尽量不与该调用方上一次使用的token相同
+		apiKey := c.GetString("api_key")
+		conversationID := c.GetString("conversation_id")
+		mode := c.GetString("augment_mode")
+		shard := c.GetString("token_shard")
+		// 预留窗口内为计划任务保留的额度不分配给其他调用方，预留额度在获取到token后才计数
+		allowed, wait, reservation := tokenmanager.AdmitReservation(apiKey, mode)
+		if !allowed {
+			setRetryAfter(c, wait)
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前额度已为计划任务预留，请稍后再试"})
+			c.Abort()
+			return
+		}
+		var tokenStr, tenantURL, sessionID string
+		ownToken := false
+		if fingerprint := c.GetHeader(tokenPinHeader); fingerprint != "" {
+			// 管理密钥可指定token，用于排查账号相关的输出差异
+			var ok bool
+			if tokenStr, tenantURL, sessionID, ok = pinnedToken(c, apiKey, fingerprint); !ok {
+				c.Abort()
+				return
+			}
+		} else if conversationID != "" {
+			// 调用方贡献了token时优先使用自己的token，否则AGENT对话尽量保持在同一个token上，接近使用上限时迁移到其他token
+			tokenStr, tenantURL, sessionID, ownToken = tokenmanager.GetTokenForContributorConversation(apiKey, conversationID, shard)
+		} else {
+			// 调用方贡献了token时优先使用自己的token
+			tokenStr, tenantURL, sessionID, ownToken = tokenmanager.GetAvailableTokenForContributor(apiKey, mode, shard)
+		}
 		if tokenStr == "No token" {
 			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前无可用token，请在页面添加"})
 			c.Abort()
 			return
 		}
+		// 开启排队时等待token空闲，用于吸收突发流量
+		if (tokenStr == "No available token" || tenantURL == "") && queue.Enabled() {
+			// 排队时间计入请求的总耗时预算
+			ctx := c.Request.Context()
+			if deadline, ok := tokenmanager.RequestDeadline(c); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, deadline)
+				defer cancel()
+			}
+			err := queue.Wait(ctx, func() bool {
+				tokenStr, tenantURL, sessionID, ownToken = tokenmanager.GetAvailableTokenForContributor(apiKey, mode, shard)
+				return tokenStr != "No token" && tokenStr != "No available token" && tenantURL != ""
+			})
+			if err != nil {
+				logger.Middleware.WithFields(logrus.Fields{
+					"error": err.Error(),
+					"path":  c.Request.URL.Path,
+				}).Warn("请求排队失败")
+				if errors.Is(err, context.DeadlineExceeded) {
+					tokenmanager.RecordBudgetExhausted("queue")
+					c.JSON(http.StatusGatewayTimeout, gin.H{"error": "排队等待超出请求的总耗时预算"})
+					c.Abort()
+					return
+				}
+				if wait, ok := tokenmanager.RetryAfter(); ok {
+					setRetryAfter(c, wait)
+				}
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
+				c.Abort()
+				return
+			}
+		}
 		if tokenStr == "No available token" || tenantURL == "" {
+			if wait, ok := tokenmanager.RetryAfter(); ok {
+				setRetryAfter(c, wait)
+			}
 			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
 			c.Abort()
 			return
@@ -49,8 +111,12 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 		// 获取该token的锁
 		lock := tokenmanager.GetTokenLock(tokenStr)
 
-		// 尝试获取锁，会阻塞直到获取到锁
-		lock.Lock()
+		// 尝试获取锁，会阻塞直到获取到锁，设置了时间预算时最多等待到截止时间
+		if !tokenmanager.LockWithinBudget(c, lock) {
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "等待token超出请求的总耗时预算"})
+			c.Abort()
+			return
+		}
 
 		// 更新请求状态
 		err := tokenmanager.SetTokenRequestStatus(tokenStr, tokenmanager.TokenRequestStatus{
@@ -65,12 +131,22 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		logger.Log.WithFields(logrus.Fields{
+		// 按会话策略计算上游session_id
+		sessionID = tokenmanager.ResolveSessionID(tokenStr, sessionID, apiKey)
+		tokenmanager.RememberClientToken(apiKey, tokenStr)
+		tokenmanager.RecordContributionUsage(apiKey, ownToken)
+		tokenmanager.CommitReservation(reservation)
+		if conversationID != "" && !c.GetBool("token_pinned") {
+			tokenmanager.RecordConversationRequest(conversationID, tokenStr)
+		}
+
+		logger.Middleware.WithFields(logrus.Fields{
 			"token":      tokenStr,
 			"session_id": sessionID,
 		}).Info("本次请求使用的token: ")
 
 		// 在请求完成后释放锁
+		c.Set("request_start", time.Now())
 		c.Set("token_lock", lock)
 		c.Set("token", tokenStr)
 		c.Set("tenant_url", tenantURL)
@@ -80,6 +156,80 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 	}
 }
 
+// setRetryAfter 按预计可用时间设置 Retry-After 响应头，向上取整到秒且至少为1秒
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
+
+// tokenPinHeader 指定本次请求使用的token指纹
+const tokenPinHeader = "X-Augment-Token-Fingerprint"
+
+// pinnedToken 获取请求指定的token，失败时写入错误响应
+func pinnedToken(c *gin.Context, apiKey, fingerprint string) (string, string, string, bool) {
+	info, _ := c.Get("api_key_info")
+	apiKeyInfo, _ := info.(*apikey.APIKey)
+	if !apikey.IsPrivileged(apiKeyInfo, apiKey) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有管理密钥可以指定token"})
+		return "", "", "", false
+	}
+
+	tokenStr, tenantURL, sessionID, err := tokenmanager.GetPinnedToken(fingerprint)
+	switch {
+	case errors.Is(err, tokenmanager.ErrPinnedTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return "", "", "", false
+	case errors.Is(err, tokenmanager.ErrPinnedTokenUnavailable):
+		if tokenStr != "" {
+			setRetryAfter(c, tokenmanager.TokenAvailableIn(tokenStr))
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return "", "", "", false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取指定token失败"})
+		return "", "", "", false
+	}
+
+	// 指定token的请求失败时不切换到其他token
+	c.Set("token_pinned", true)
+	logger.Middleware.WithFields(logrus.Fields{
+		"fingerprint": fingerprint,
+	}).Info("请求指定了token")
+	return tokenStr, tenantURL, sessionID, true
+}
+
+// TokenLookupMiddleware 轻量的token分配，只选出一个可用token供上游只读请求使用，
+// 不加锁、不标记使用中，也不计入调用方轮换，用于模型列表、额度查询等非生成接口
+func TokenLookupMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.AppConfig.CodingMode == "true" {
+			c.Set("token", config.AppConfig.CodingToken)
+			c.Set("tenant_url", config.AppConfig.TenantURL)
+			c.Next()
+			return
+		}
+
+		// 只读请求不计入使用次数，任一模式还有次数的token都可以使用
+		tokenStr, tenantURL, sessionID := tokenmanager.GetAvailableToken("CHAT", c.GetString("token_shard"))
+		if tenantURL == "" {
+			tokenStr, tenantURL, sessionID = tokenmanager.GetAvailableToken("AGENT", c.GetString("token_shard"))
+		}
+		if tokenStr == "No token" || tokenStr == "No available token" || tenantURL == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "当前无可用token"})
+			c.Abort()
+			return
+		}
+
+		c.Set("token", tokenStr)
+		c.Set("tenant_url", tenantURL)
+		c.Set("session_id", sessionID)
+		c.Next()
+	}
+}
+
 // SwitchTokenAndRetry 当遇到429错误时切换Token并重试
 func SwitchTokenAndRetry(c *gin.Context, maxRetries int) bool {
 	return tokenmanager.SwitchTokenAndRetry(c, maxRetries)
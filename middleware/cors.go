@@ -11,5 +11,7 @@ func CORS() gin.HandlerFunc {
 	config.AllowCredentials = true
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"*"}
+	// 请求追踪、重试提示和备用模型响应头需要暴露给浏览器端
+	config.ExposeHeaders = []string{"X-Augment-Shard", "X-Augment-Token", "X-Retry-Count", "X-Upstream-Ms", "Retry-After", "X-Augment-Model-Fallback", "X-Conversation-ID", "X-Ignored-Params", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
 	return cors.New(config)
 }
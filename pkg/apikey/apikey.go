@@ -0,0 +1,186 @@
+package apikey
+
+import (
+	"augment2api/config"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyPrefix API密钥在Redis中的键前缀
+const keyPrefix = "api_key:"
+
+// ErrNotFound API密钥不存在
+var ErrNotFound = errors.New("API密钥不存在")
+
+// APIKey 调用方API密钥及其访问限制
+type APIKey struct {
+	Key          string    `json:"key"`
+	Name         string    `json:"name"`
+	Models       []string  `json:"models"`                  // 允许使用的模型别名，为空表示不限制
+	Status       string    `json:"status"`                  // active / disabled
+	Admin        bool      `json:"admin,omitempty"`         // 管理密钥可获取请求追踪等调试信息
+	Shard        string    `json:"shard,omitempty"`         // 请求只使用该分片中的token，为空表示使用未划分分片的token
+	SystemPrompt string    `json:"system_prompt,omitempty"` // 客户端没有传入系统提示词时使用的默认系统提示词
+	Footer       string    `json:"footer,omitempty"`        // 追加在每次回复末尾的说明文字，为空表示不追加
+	RateLimit    int       `json:"rate_limit,omitempty"`    // 每分钟请求数配额，只通过响应头提示调用方，不拒绝请求，0表示不限制
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Generate 生成新的API密钥
+func Generate() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
+
+// Get 获取API密钥，不存在时返回 ErrNotFound
+func Get(key string) (*APIKey, error) {
+	if key == "" || config.RDB == nil {
+		return nil, ErrNotFound
+	}
+
+	fields, err := config.RedisHGetAll(keyPrefix + key)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+
+	apiKey := &APIKey{
+		Key:          key,
+		Name:         fields["name"],
+		Status:       fields["status"],
+		Admin:        fields["admin"] == "true",
+		Shard:        fields["shard"],
+		SystemPrompt: fields["system_prompt"],
+		Footer:       fields["footer"],
+	}
+	apiKey.RateLimit, _ = strconv.Atoi(fields["rate_limit"])
+	if models := fields["models"]; models != "" {
+		json.Unmarshal([]byte(models), &apiKey.Models)
+	}
+	if createdAt, err := time.Parse(time.RFC3339, fields["created_at"]); err == nil {
+		apiKey.CreatedAt = createdAt
+	}
+	return apiKey, nil
+}
+
+// Save 保存API密钥
+func Save(apiKey *APIKey) error {
+	models, err := json.Marshal(apiKey.Models)
+	if err != nil {
+		return err
+	}
+	if apiKey.Status == "" {
+		apiKey.Status = "active"
+	}
+	if apiKey.CreatedAt.IsZero() {
+		apiKey.CreatedAt = time.Now()
+	}
+
+	// 所有字段一次写入，写入失败时不会留下只更新了部分字段的密钥
+	return config.RedisHSetFields(keyPrefix+apiKey.Key, map[string]string{
+		"name":          apiKey.Name,
+		"models":        string(models),
+		"status":        apiKey.Status,
+		"admin":         strconv.FormatBool(apiKey.Admin),
+		"shard":         apiKey.Shard,
+		"system_prompt": apiKey.SystemPrompt,
+		"footer":        apiKey.Footer,
+		"rate_limit":    strconv.Itoa(apiKey.RateLimit),
+		"created_at":    apiKey.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+// SetSystemPrompt 设置API密钥的默认系统提示词，prompt为空时清除
+func SetSystemPrompt(key, prompt string) error {
+	if prompt == "" {
+		return config.RedisHDel(keyPrefix+key, "system_prompt")
+	}
+	return config.RedisHSet(keyPrefix+key, "system_prompt", prompt)
+}
+
+// Delete 删除API密钥
+func Delete(key string) error {
+	return config.RedisDel(keyPrefix + key)
+}
+
+// List 获取所有API密钥
+func List() ([]*APIKey, error) {
+	keys, err := config.RedisKeys(keyPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*APIKey, 0, len(keys))
+	for _, key := range keys {
+		apiKey, err := Get(strings.TrimPrefix(key, keyPrefix))
+		if err != nil {
+			continue
+		}
+		result = append(result, apiKey)
+	}
+	return result, nil
+}
+
+// Active API密钥是否可用
+func (k *APIKey) Active() bool {
+	return k.Status != "disabled"
+}
+
+// AllowsModel 是否允许使用指定模型，比较时不区分大小写
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, allowed := range k.Models {
+		if strings.EqualFold(allowed, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountRequest 记录API密钥本分钟的一次请求，返回本分钟的请求数，统计窗口与终端用户频率限制相同
+func CountRequest(key string) (int64, error) {
+	if config.RDB == nil {
+		return 0, nil
+	}
+	rateKey := fmt.Sprintf("api_key_rate:%s:%d", key, time.Now().Unix()/60)
+	count, err := config.RedisIncrValue(rateKey)
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		if err := config.RedisExpire(rateKey, 2*time.Minute); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// IsPrivileged 请求使用的密钥是否具有管理权限，info为请求匹配到的受管理密钥，
+// 未匹配时全局 AUTH_TOKEN 视为管理密钥，未配置鉴权时不视为管理密钥
+func IsPrivileged(info *APIKey, key string) bool {
+	if info != nil {
+		return info.Admin
+	}
+	return config.AppConfig.AuthToken != "" && key == config.AppConfig.AuthToken
+}
+
+// Mask 返回脱敏后的密钥，用于日志和审计
+func Mask(key string) string {
+	if len(key) <= 10 {
+		return "***"
+	}
+	return key[:6] + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// logKey 审计日志在Redis中的列表键
+	logKey = "audit_log"
+	// Limit 审计日志保留条数
+	Limit = 1000
+)
+
+// Entry 审计日志条目
+type Entry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Actor     string                 `json:"actor"`  // 操作方，API密钥已脱敏，管理操作为 admin
+	Action    string                 `json:"action"` // 操作类型
+	Target    string                 `json:"target,omitempty"`
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+}
+
+// Record 记录一条审计日志，失败只记录错误日志
+func Record(entry Entry) {
+	if config.RDB == nil {
+		return
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = config.RedisLPush(logKey, string(data))
+	}
+	if err == nil {
+		err = config.RedisLTrim(logKey, 0, Limit-1)
+	}
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"action": entry.Action,
+			"error":  err.Error(),
+		}).Error("记录审计日志失败")
+	}
+}
+
+// List 获取最近的审计日志，按时间倒序
+func List(limit int) ([]Entry, error) {
+	if limit <= 0 || limit > Limit {
+		limit = Limit
+	}
+
+	items, err := config.RedisLRange(logKey, 0, int64(limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(items))
+	for _, item := range items {
+		var entry Entry
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
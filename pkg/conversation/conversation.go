@@ -0,0 +1,114 @@
+package conversation
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// keyPrefix 对话记录在Redis中的键前缀
+const keyPrefix = "conversation:"
+
+// ErrNotFound 对话记录不存在或已过期
+var ErrNotFound = errors.New("对话记录不存在")
+
+// Message 对话中的一条消息
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Transcript 一段对话的完整记录，客户端每次请求都会带上完整历史，保存的是最近一次请求的历史和回复
+type Transcript struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"` // 调用方API密钥的指纹
+	Model     string    `json:"model"`
+	System    string    `json:"system,omitempty"`
+	Messages  []Message `json:"messages"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Save 保存对话记录，已有记录时保留其创建时间
+func Save(transcript *Transcript, ttl time.Duration) error {
+	now := time.Now()
+	transcript.CreatedAt = now
+	if existing, err := Get(transcript.ID); err == nil {
+		transcript.CreatedAt = existing.CreatedAt
+	}
+	transcript.UpdatedAt = now
+
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		return err
+	}
+	return config.RedisSet(keyPrefix+transcript.ID, string(data), ttl)
+}
+
+// Get 获取对话记录
+func Get(id string) (*Transcript, error) {
+	data, err := config.RedisGet(keyPrefix + id)
+	if err != nil || data == "" {
+		return nil, ErrNotFound
+	}
+	var transcript Transcript
+	if err := json.Unmarshal([]byte(data), &transcript); err != nil {
+		return nil, err
+	}
+	return &transcript, nil
+}
+
+// OpenAIMessages 按OpenAI格式返回消息列表，系统提示词作为第一条system消息
+func (t *Transcript) OpenAIMessages() []Message {
+	messages := make([]Message, 0, len(t.Messages)+1)
+	if t.System != "" {
+		messages = append(messages, Message{Role: "system", Content: t.System})
+	}
+	return append(messages, t.Messages...)
+}
+
+// AnthropicMessages 按Anthropic格式返回系统提示词和消息列表，
+// system和developer消息合并到系统提示词，连续的同角色消息合并为一条
+func (t *Transcript) AnthropicMessages() (string, []Message) {
+	var system []string
+	if t.System != "" {
+		system = append(system, t.System)
+	}
+	var messages []Message
+	for _, message := range t.Messages {
+		if message.Role == "system" || message.Role == "developer" {
+			system = append(system, message.Content)
+			continue
+		}
+		role := "user"
+		if message.Role == "assistant" {
+			role = "assistant"
+		}
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content += "\n\n" + message.Content
+			continue
+		}
+		messages = append(messages, Message{Role: role, Content: message.Content})
+	}
+	return strings.Join(system, "\n\n"), messages
+}
+
+// Markdown 将对话记录导出为Markdown文本
+func (t *Transcript) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Conversation %s\n\n", t.ID)
+	fmt.Fprintf(&b, "- Model: %s\n", t.Model)
+	fmt.Fprintf(&b, "- Created: %s\n", t.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- Updated: %s\n", t.UpdatedAt.Format(time.RFC3339))
+	for _, message := range t.OpenAIMessages() {
+		title := message.Role
+		if title != "" {
+			title = strings.ToUpper(title[:1]) + title[1:]
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", title, strings.TrimSpace(message.Content))
+	}
+	return b.String()
+}
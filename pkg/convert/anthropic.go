@@ -0,0 +1,129 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ToolUse 结束消息时输出的工具调用内容块
+type ToolUse struct {
+	ID    string
+	Name  string
+	Input interface{}
+}
+
+// anthropicContentDelta content_block_delta 事件的数据，使用结构体保证type字段在前
+type anthropicContentDelta struct {
+	Type  string                 `json:"type"`
+	Index int                    `json:"index"`
+	Delta map[string]interface{} `json:"delta"`
+}
+
+// 消息中内容块的位置，文本固定为第一个内容块，工具调用在文本之后
+const (
+	anthropicTextBlock = 0
+	anthropicToolBlock = 1
+)
+
+// anthropicEvent 序列化一个Anthropic SSE事件
+func anthropicEvent(name string, data interface{}) []byte {
+	jsonResp, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, jsonResp))
+}
+
+// contentBlockStop 编码 content_block_stop 事件
+func contentBlockStop(index int) []byte {
+	return anthropicEvent("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": index})
+}
+
+// AnthropicMessageStart 编码 message_start 事件和文本内容块的 content_block_start 事件，在输出任何内容之前发送
+func AnthropicMessageStart(id, model string, inputTokens int) []byte {
+	out := anthropicEvent("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         map[string]interface{}{"input_tokens": inputTokens, "output_tokens": 0},
+		},
+	})
+	return append(out, anthropicEvent("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         anthropicTextBlock,
+		"content_block": map[string]interface{}{"type": "text", "text": ""},
+	})...)
+}
+
+// AnthropicTextDelta 编码一段文本输出为 content_block_delta 事件，文本为空时不输出
+func AnthropicTextDelta(text string) []byte {
+	if text == "" {
+		return nil
+	}
+	return anthropicEvent("content_block_delta", anthropicContentDelta{
+		Type:  "content_block_delta",
+		Index: anthropicTextBlock,
+		Delta: map[string]interface{}{
+			"type": "text_delta",
+			"text": text,
+		},
+	})
+}
+
+// AnthropicMessageEnd 编码结束文本内容块的 content_block_stop 以及 message_delta 和 message_stop 事件，
+// message_delta 中带有停止原因和输出用量
+func AnthropicMessageEnd(stopReason string, stopSequence *string, outputTokens int) []byte {
+	out := contentBlockStop(anthropicTextBlock)
+	out = append(out, anthropicEvent("message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   stopReason,
+			"stop_sequence": stopSequence,
+		},
+		"usage": map[string]interface{}{"output_tokens": outputTokens},
+	})...)
+	return append(out, anthropicEvent("message_stop", map[string]interface{}{"type": "message_stop"})...)
+}
+
+// AnthropicToolUseStop 编码剩余文本、tool_use内容块和以 tool_use 结束的消息事件，
+// 与官方接口一致，工具参数通过 input_json_delta 输出，content_block_start 中的 input 为空对象
+func AnthropicToolUseStop(text string, toolUse ToolUse, outputTokens int) []byte {
+	input, err := json.Marshal(toolUse.Input)
+	if err != nil || toolUse.Input == nil {
+		input = []byte("{}")
+	}
+
+	out := AnthropicTextDelta(text)
+	out = append(out, contentBlockStop(anthropicTextBlock)...)
+	out = append(out, anthropicEvent("content_block_start", map[string]interface{}{
+		"type":  "content_block_start",
+		"index": anthropicToolBlock,
+		"content_block": map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolUse.ID,
+			"name":  toolUse.Name,
+			"input": map[string]interface{}{},
+		},
+	})...)
+	out = append(out, anthropicEvent("content_block_delta", anthropicContentDelta{
+		Type:  "content_block_delta",
+		Index: anthropicToolBlock,
+		Delta: map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": string(input),
+		},
+	})...)
+	out = append(out, contentBlockStop(anthropicToolBlock)...)
+	out = append(out, anthropicEvent("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": "tool_use", "stop_sequence": nil},
+		"usage": map[string]interface{}{"output_tokens": outputTokens},
+	})...)
+	return append(out, anthropicEvent("message_stop", map[string]interface{}{"type": "message_stop"})...)
+}
@@ -0,0 +1,126 @@
+// Package convert 负责OpenAI、Anthropic格式与Augment格式之间的转换
+// 只处理数据结构和输出字节，不依赖gin和Redis，上游格式变化时在这里调整并更新 testdata 中的快照
+package convert
+
+import "strings"
+
+// Turn 一轮历史对话，Request为用户消息，Response为助手回复
+type Turn struct {
+	Request  string
+	Response string
+}
+
+// ContentText 将OpenAI或Anthropic消息的content展开为纯文本
+// content可以是字符串或内容块数组，数组中只拼接带有text字段的块
+func ContentText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var result string
+		for _, item := range v {
+			if contentMap, ok := item.(map[string]interface{}); ok {
+				if text, exists := contentMap["text"]; exists {
+					if textStr, ok := text.(string); ok {
+						result += textStr
+					}
+				}
+			}
+		}
+		return result
+	default:
+		return ""
+	}
+}
+
+// SystemText 将Anthropic的system参数展开为纯文本
+// 新版SDK会以内容块数组发送，并可能带有 cache_control 标注，这里只保留文本块
+func SystemText(system interface{}) string {
+	switch v := system.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if blockType, _ := block["type"].(string); blockType != "" && blockType != "text" {
+				continue
+			}
+			if text, _ := block["text"].(string); strings.TrimSpace(text) != "" {
+				parts = append(parts, strings.TrimSpace(text))
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	default:
+		return ""
+	}
+}
+
+// languageKeywords 按顺序匹配的编程语言关键字，先匹配到的优先
+var languageKeywords = []struct {
+	keyword string
+	lang    string
+}{
+	{"html", "HTML"},
+	{"python", "Python"},
+	{"javascript", "JavaScript"},
+	{"go", "Go"},
+	{"rust", "Rust"},
+	{"java", "Java"},
+	{"c++", "C++"},
+	{"c#", "C#"},
+	{"php", "PHP"},
+	{"ruby", "Ruby"},
+	{"swift", "Swift"},
+	{"kotlin", "Kotlin"},
+	{"typescript", "TypeScript"},
+	{"c", "C"},
+}
+
+// DetectLanguage 按消息中的关键字简单判断对话涉及的编程语言，没有匹配时返回HTML
+func DetectLanguage(content string) string {
+	content = strings.ToLower(content)
+	for _, item := range languageKeywords {
+		if strings.Contains(content, item.keyword) {
+			return item.lang
+		}
+	}
+	return "HTML"
+}
+
+// ModeForModel 按模型名称后缀（不区分大小写）决定Augment的对话模式，-agent 为AGENT，其余为CHAT
+func ModeForModel(model string) string {
+	if strings.HasSuffix(strings.ToLower(model), "-agent") {
+		return "AGENT"
+	}
+	return "CHAT"
+}
+
+// SplitHistory 将按顺序排列的消息文本两两配对为历史对话，最后一条作为当前消息
+// 消息数为偶数时最后一条消息既作为历史中的回复，也作为当前消息
+func SplitHistory(messages []string) ([]Turn, string) {
+	if len(messages) == 0 {
+		return nil, ""
+	}
+	var history []Turn
+	for i := 0; i < len(messages)-1; i += 2 {
+		history = append(history, Turn{Request: messages[i], Response: messages[i+1]})
+	}
+	return history, messages[len(messages)-1]
+}
+
+// ChunkText 按字符数切分文本，用于将完整回复模拟为流式输出
+func ChunkText(text string, size int) []string {
+	runes := []rune(text)
+	if size <= 0 || len(runes) <= size {
+		return []string{text}
+	}
+	chunks := make([]string, 0, (len(runes)+size-1)/size)
+	for i := 0; i < len(runes); i += size {
+		chunks = append(chunks, string(runes[i:min(i+size, len(runes))]))
+	}
+	return chunks
+}
@@ -0,0 +1,107 @@
+package convert
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContentText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content interface{}
+		want    string
+	}{
+		{"string", "hello", "hello"},
+		{"blocks", []interface{}{
+			map[string]interface{}{"type": "text", "text": "a"},
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "x"}},
+			map[string]interface{}{"type": "text", "text": "b"},
+		}, "ab"},
+		{"nil", nil, ""},
+		{"number", 42.0, ""},
+	}
+	for _, tt := range tests {
+		if got := ContentText(tt.content); got != tt.want {
+			t.Errorf("%s: ContentText() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSystemText(t *testing.T) {
+	system := []interface{}{
+		map[string]interface{}{"type": "text", "text": "  first  ", "cache_control": map[string]interface{}{"type": "ephemeral"}},
+		map[string]interface{}{"type": "image", "text": "skipped"},
+		map[string]interface{}{"text": "second"},
+		map[string]interface{}{"type": "text", "text": "   "},
+	}
+	if got, want := SystemText(system), "first\n\nsecond"; got != want {
+		t.Errorf("SystemText() = %q, want %q", got, want)
+	}
+	if got := SystemText(" plain "); got != "plain" {
+		t.Errorf("SystemText(string) = %q, want %q", got, "plain")
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := map[string]string{
+		"Write a Python script":      "Python",
+		"explain this HTML and java": "HTML",
+		"golang channels":            "Go",
+		"typescript generics":        "TypeScript",
+		"a c program":                "C",
+		"你好":                         "HTML",
+	}
+	for content, want := range tests {
+		if got := DetectLanguage(content); got != want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
+
+func TestModeForModel(t *testing.T) {
+	tests := map[string]string{
+		"claude-3.7-chat":  "CHAT",
+		"claude-3.7-AGENT": "AGENT",
+		"claude-3.7":       "CHAT",
+	}
+	for model, want := range tests {
+		if got := ModeForModel(model); got != want {
+			t.Errorf("ModeForModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
+
+func TestSplitHistory(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		history  []Turn
+		current  string
+	}{
+		{"empty", nil, nil, ""},
+		{"single", []string{"q"}, nil, "q"},
+		{"odd", []string{"q1", "a1", "q2"}, []Turn{{"q1", "a1"}}, "q2"},
+		{"even", []string{"q1", "a1", "q2", "a2"}, []Turn{{"q1", "a1"}, {"q2", "a2"}}, "a2"},
+	}
+	for _, tt := range tests {
+		history, current := SplitHistory(tt.messages)
+		if !reflect.DeepEqual(history, tt.history) || current != tt.current {
+			t.Errorf("%s: SplitHistory() = %v, %q; want %v, %q", tt.name, history, current, tt.history, tt.current)
+		}
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	if got, want := ChunkText("你好世界abc", 3), []string{"你好世", "界ab", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ChunkText() = %q, want %q", got, want)
+	}
+	if got := ChunkText("", 3); !reflect.DeepEqual(got, []string{""}) {
+		t.Errorf("ChunkText(\"\") = %q", got)
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	if got := EstimateTokens("hello world 你好世界"); got != 6 {
+		t.Errorf("EstimateTokens() = %d, want 6", got)
+	}
+}
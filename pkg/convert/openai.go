@@ -0,0 +1,122 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OpenAIStream 将Augment的流式输出编码为OpenAI的 chat.completion.chunk 事件
+type OpenAIStream struct {
+	ID    string
+	Model string
+	// Now 返回分块的创建时间，为nil时使用当前时间
+	Now func() time.Time
+}
+
+// NewOpenAIStream 创建OpenAI流式编码器
+func NewOpenAIStream(id, model string) *OpenAIStream {
+	return &OpenAIStream{ID: id, Model: model}
+}
+
+type openAIChunk struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int         `json:"index"`
+	Delta        interface{} `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type openAIDelta struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIToolCallsDelta struct {
+	Role      string          `json:"role"`
+	Content   *string         `json:"content"`
+	ToolCalls []ToolCallDelta `json:"tool_calls"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// created 分块的创建时间戳
+func (s *OpenAIStream) created() int64 {
+	if s.Now != nil {
+		return s.Now().Unix()
+	}
+	return time.Now().Unix()
+}
+
+// encode 序列化一个分块为SSE数据行
+func (s *OpenAIStream) encode(chunk openAIChunk) []byte {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
+
+// Chunk 编码一段助手输出，finishReason为空时表示还未结束
+func (s *OpenAIStream) Chunk(text, finishReason string) []byte {
+	choice := openAIChoice{
+		Index: 0,
+		Delta: openAIDelta{Role: "assistant", Content: text},
+	}
+	if finishReason != "" {
+		choice.FinishReason = &finishReason
+	}
+	return s.encode(openAIChunk{
+		ID:      s.ID,
+		Object:  "chat.completion.chunk",
+		Created: s.created(),
+		Model:   s.Model,
+		Choices: []openAIChoice{choice},
+	})
+}
+
+// ToolCalls 编码一组增量的工具调用，content为null
+func (s *OpenAIStream) ToolCalls(deltas []ToolCallDelta) []byte {
+	return s.encode(openAIChunk{
+		ID:      s.ID,
+		Object:  "chat.completion.chunk",
+		Created: s.created(),
+		Model:   s.Model,
+		Choices: []openAIChoice{{
+			Index: 0,
+			Delta: openAIToolCallsDelta{Role: "assistant", ToolCalls: deltas},
+		}},
+	})
+}
+
+// Usage 编码 stream_options.include_usage 要求的用量分块，choices为空数组
+func (s *OpenAIStream) Usage(promptTokens, completionTokens int) []byte {
+	return s.encode(openAIChunk{
+		ID:      s.ID,
+		Object:  "chat.completion.chunk",
+		Created: s.created(),
+		Model:   s.Model,
+		Choices: []openAIChoice{},
+		Usage: &openAIUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	})
+}
+
+// Done 流结束标记
+func (s *OpenAIStream) Done() []byte {
+	return []byte("data: [DONE]\n\n")
+}
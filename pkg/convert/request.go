@@ -0,0 +1,256 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultPrompt 默认提示，不加这个会导致Agent触发文件创建，回复截断
+	DefaultPrompt = "Your are claude4, All replies cannot create, modify, or delete files, and must provide content directly!"
+	// DefaultPrefix 默认上下文，影响模型回复风格
+	DefaultPrefix = "You are AI assistant,help me to solve problems!"
+	// DefaultAnswerLanguage 未开启检测或无法判断语言时，默认指南要求的回答语言
+	DefaultAnswerLanguage = "Chinese"
+)
+
+// ToolDefinition 工具定义结构
+type ToolDefinition struct {
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	InputSchemaJSON string `json:"input_schema_json"`
+	ToolSafety      int    `json:"tool_safety"`
+}
+
+// Node 节点结构
+type Node struct {
+	ID          int         `json:"id"`
+	Type        int         `json:"type"`
+	Content     string      `json:"content"`
+	ToolUse     NodeToolUse `json:"tool_use"`
+	AgentMemory AgentMemory `json:"agent_memory"`
+}
+
+// NodeToolUse 节点中的工具调用
+type NodeToolUse struct {
+	ToolUseID string `json:"tool_use_id"`
+	ToolName  string `json:"tool_name"`
+	InputJSON string `json:"input_json"`
+}
+
+// AgentMemory 节点中的Agent记忆
+type AgentMemory struct {
+	Content string `json:"content"`
+}
+
+// AugmentRequest Augment API请求结构
+type AugmentRequest struct {
+	ChatHistory    []AugmentChatHistory `json:"chat_history"`
+	Message        string               `json:"message"`
+	AgentMemories  string               `json:"agent_memories"`
+	Mode           string               `json:"mode"`
+	Prefix         string               `json:"prefix"`
+	Suffix         string               `json:"suffix"`
+	Lang           string               `json:"lang"`
+	Path           string               `json:"path"`
+	UserGuideLines string               `json:"user_guidelines"`
+	Blobs          struct {
+		CheckpointID string        `json:"checkpoint_id"`
+		AddedBlobs   []interface{} `json:"added_blobs"`
+		DeletedBlobs []interface{} `json:"deleted_blobs"`
+	} `json:"blobs"`
+	UserGuidedBlobs       []interface{} `json:"user_guided_blobs"`
+	ExternalSourceIds     []interface{} `json:"external_source_ids"`
+	FeatureDetectionFlags struct {
+		SupportRawOutput bool `json:"support_raw_output"`
+	} `json:"feature_detection_flags"`
+	ToolDefinitions []ToolDefinition `json:"tool_definitions"`
+	Nodes           []Node           `json:"nodes"`
+
+	// SystemPrompt 客户端传入的系统提示词，不发送给上游，降级时用于重新生成指南
+	SystemPrompt string `json:"-"`
+	// CustomGuidelines 按模板展开后的自定义指南，降级时替换默认指南
+	CustomGuidelines string `json:"-"`
+	// AnswerLanguage 按用户消息检测出的回答语言，为空时默认指南要求使用中文回答
+	AnswerLanguage string `json:"-"`
+}
+
+// AugmentChatHistory 一轮历史对话
+type AugmentChatHistory struct {
+	ResponseText   string `json:"response_text"`
+	RequestMessage string `json:"request_message"`
+	RequestID      string `json:"request_id"`
+	RequestNodes   []Node `json:"request_nodes"`
+	ResponseNodes  []Node `json:"response_nodes"`
+}
+
+// Message 转换所需的一条客户端消息，Text为展开后的纯文本
+type Message struct {
+	Role string
+	Text string
+}
+
+// RequestOptions 转换时由调用方按配置决定的参数
+type RequestOptions struct {
+	// AnswerLanguage 检测出的回答语言，为空时使用 DefaultAnswerLanguage
+	AnswerLanguage string
+	// DisableInjection 关闭默认的前缀、后缀、提示和指南，只保留客户端消息和系统提示词
+	DisableInjection bool
+	// GuardSystem 系统提示词放入指南前的检查，为nil时原样使用
+	GuardSystem func(string) string
+}
+
+// FromOpenAI 将OpenAI请求转换为Augment请求，system和developer消息与Anthropic的system参数一样放入指南，不参与对话配对
+func FromOpenAI(model string, messages []Message, opts RequestOptions) AugmentRequest {
+	system, rest := SplitSystemMessages(messages)
+	return buildRequest(model, system, rest, lastMessageLanguage(messages), opts)
+}
+
+// FromAnthropic 将Anthropic请求转换为Augment请求，system为字符串或内容块数组
+func FromAnthropic(model string, system interface{}, messages []Message, opts RequestOptions) AugmentRequest {
+	return buildRequest(model, SystemText(system), messages, lastMessageLanguage(messages), opts)
+}
+
+// SplitSystemMessages 拆出system和developer消息，返回合并后的系统提示词和其余消息
+func SplitSystemMessages(messages []Message) (string, []Message) {
+	var system []string
+	rest := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		if message.Role == "system" || message.Role == "developer" {
+			if text := strings.TrimSpace(message.Text); text != "" {
+				system = append(system, text)
+			}
+			continue
+		}
+		rest = append(rest, message)
+	}
+	return strings.Join(system, "\n\n"), rest
+}
+
+// WithSystemPrompt 将客户端的系统提示词放在默认指南之前
+func WithSystemPrompt(systemPrompt, guidelines string) string {
+	if systemPrompt == "" {
+		return guidelines
+	}
+	if guidelines == "" {
+		return systemPrompt
+	}
+	return systemPrompt + "\n\n" + guidelines
+}
+
+// buildRequest 按模型名称和对话内容构建Augment请求，lang为检测出的编程语言
+func buildRequest(model, system string, messages []Message, lang string, opts RequestOptions) AugmentRequest {
+	answerLanguage := opts.AnswerLanguage
+	if answerLanguage == "" {
+		answerLanguage = DefaultAnswerLanguage
+	}
+	userGuideLines := "must answer in " + answerLanguage + "."
+	includeToolDefinitions := false
+	includeDefaultPrompt := false
+
+	// 按模型名称后缀决定模式，AGENT模式附带工具定义和默认提示词
+	mode := ModeForModel(model)
+	if mode == "AGENT" {
+		userGuideLines = "must answer in " + answerLanguage + ", do not use tools, and for questions involving internet searches, please answer based on your existing knowledge."
+		includeToolDefinitions = true
+		includeDefaultPrompt = true
+	}
+
+	augmentReq := AugmentRequest{
+		Path:           "",             // 这个是关联的项目文件路径，暂时传空，不影响对话
+		Mode:           mode,           // 根据模型名称决定模式
+		Prefix:         DefaultPrefix,  // 固定前缀，影响模型回复风格
+		Suffix:         " ",            // 固定后缀，暂时传空，不影响对话
+		Lang:           lang,           // 简单检测当前对话语言类型，不传好像回答有问题
+		Message:        "",             // 当前对话消息
+		UserGuideLines: userGuideLines, // 根据模型类型设置指南
+		// 初始化为空列表
+		ChatHistory:       make([]AugmentChatHistory, 0),
+		UserGuidedBlobs:   make([]interface{}, 0),
+		ExternalSourceIds: make([]interface{}, 0),
+		ToolDefinitions:   []ToolDefinition{}, // 初始化为空
+		Nodes:             make([]Node, 0),
+		AnswerLanguage:    opts.AnswerLanguage,
+	}
+	augmentReq.Blobs.CheckpointID = newCheckpointID()
+	augmentReq.Blobs.AddedBlobs = make([]interface{}, 0)
+	augmentReq.Blobs.DeletedBlobs = make([]interface{}, 0)
+	augmentReq.FeatureDetectionFlags.SupportRawOutput = true
+
+	// 根据模型类型决定是否包含工具定义
+	if includeToolDefinitions {
+		augmentReq.ToolDefinitions = ToolDefinitions()
+	}
+
+	// 处理消息历史，每次处理一对消息（用户问题和助手回答）
+	texts := make([]string, len(messages))
+	for i, message := range messages {
+		texts[i] = message.Text
+	}
+	history, current := SplitHistory(texts)
+	for _, turn := range history {
+		augmentReq.ChatHistory = append(augmentReq.ChatHistory, historyTurn(turn))
+	}
+
+	// 设置当前消息
+	if len(messages) > 0 {
+		if includeDefaultPrompt && !opts.DisableInjection {
+			augmentReq.Message = DefaultPrompt + "\n" + current
+		} else {
+			augmentReq.Message = current
+		}
+	}
+
+	// 关闭默认注入时只保留客户端消息
+	if opts.DisableInjection {
+		augmentReq.Prefix = ""
+		augmentReq.Suffix = ""
+		augmentReq.UserGuideLines = ""
+	}
+
+	// 系统提示词检查后放入指南，关闭默认注入时同样保留
+	if opts.GuardSystem != nil {
+		system = opts.GuardSystem(system)
+	}
+	augmentReq.SystemPrompt = system
+	augmentReq.UserGuideLines = WithSystemPrompt(system, augmentReq.UserGuideLines)
+
+	return augmentReq
+}
+
+// historyTurn 将一轮历史对话转换为Augment的历史记录
+func historyTurn(turn Turn) AugmentChatHistory {
+	return AugmentChatHistory{
+		RequestMessage: turn.Request,
+		ResponseText:   turn.Response,
+		RequestID:      uuid.New().String(), // 生成唯一的请求ID
+		RequestNodes:   make([]Node, 0),
+		ResponseNodes: []Node{
+			{
+				ID:      0,
+				Type:    0,
+				Content: turn.Response,
+			},
+		},
+	}
+}
+
+// lastMessageLanguage 按最后一条消息检测编程语言，没有消息时返回空
+func lastMessageLanguage(messages []Message) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return DetectLanguage(messages[len(messages)-1].Text)
+}
+
+// newCheckpointID 生成一个基于时间戳的SHA-256哈希值作为CheckpointID
+func newCheckpointID() string {
+	timestamp := fmt.Sprintf("%d", time.Now().UnixNano())
+	hash := sha256.New()
+	hash.Write([]byte(timestamp))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
@@ -0,0 +1,81 @@
+package convert
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stableRequest 序列化请求用于快照比较，清空随机生成的编号，工具定义只保留名称
+func stableRequest(t *testing.T, req AugmentRequest) []byte {
+	t.Helper()
+	req.Blobs.CheckpointID = ""
+	for i := range req.ChatHistory {
+		req.ChatHistory[i].RequestID = ""
+	}
+	for i := range req.ToolDefinitions {
+		req.ToolDefinitions[i] = ToolDefinition{Name: req.ToolDefinitions[i].Name}
+	}
+	data, err := json.MarshalIndent(struct {
+		Request        AugmentRequest `json:"request"`
+		SystemPrompt   string         `json:"system_prompt"`
+		AnswerLanguage string         `json:"answer_language"`
+	}{req, req.SystemPrompt, req.AnswerLanguage}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, '\n')
+}
+
+func TestRequestGolden(t *testing.T) {
+	conversation := []Message{
+		{Role: "user", Text: "What does this Go function do?"},
+		{Role: "assistant", Text: "It parses the config."},
+		{Role: "user", Text: "Rewrite it in python"},
+	}
+	anthropicSystem := []interface{}{
+		map[string]interface{}{"type": "text", "text": "You are terse.", "cache_control": map[string]interface{}{"type": "ephemeral"}},
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{}},
+		map[string]interface{}{"type": "text", "text": "Answer in one line."},
+	}
+
+	tests := []struct {
+		name string
+		req  AugmentRequest
+	}{
+		{"openai_chat", FromOpenAI("claude-3.7-chat", append([]Message{
+			{Role: "system", Text: "You are terse."},
+			{Role: "developer", Text: "  Answer in one line.  "},
+		}, conversation...), RequestOptions{})},
+		{"openai_agent", FromOpenAI("claude-3.7-agent", conversation, RequestOptions{AnswerLanguage: "English"})},
+		{"openai_no_injection", FromOpenAI("claude-3.7-agent", append([]Message{
+			{Role: "system", Text: "You are terse."},
+		}, conversation...), RequestOptions{DisableInjection: true})},
+		{"openai_empty", FromOpenAI("claude-3.7-chat", nil, RequestOptions{})},
+		{"anthropic_system_blocks", FromAnthropic("claude-3.7-chat", anthropicSystem, conversation, RequestOptions{
+			GuardSystem: strings.ToUpper,
+		})},
+		{"anthropic_even_messages", FromAnthropic("claude-3.7-chat", "Be brief.", conversation[:2], RequestOptions{})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, filepath.Join("testdata", "request_"+tt.name+".golden"), stableRequest(t, tt.req))
+		})
+	}
+}
+
+func TestSplitSystemMessages(t *testing.T) {
+	system, rest := SplitSystemMessages([]Message{
+		{Role: "system", Text: "a"},
+		{Role: "user", Text: "hi"},
+		{Role: "developer", Text: "   "},
+		{Role: "developer", Text: "b"},
+	})
+	if system != "a\n\nb" {
+		t.Errorf("system = %q, want %q", system, "a\n\nb")
+	}
+	if len(rest) != 1 || rest[0].Text != "hi" {
+		t.Errorf("rest = %+v", rest)
+	}
+}
@@ -0,0 +1,57 @@
+package convert
+
+import "strings"
+
+// Event Augment流式响应中的一行，只保留格式转换需要的字段
+type Event struct {
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
+
+// EstimateTokens 粗略估计文本中的token数量
+// 英文单词按1个token计算，中文字符按0.75个token计算，实际数量取决于具体的分词算法
+func EstimateTokens(text string) int {
+	chineseCount := 0
+	for _, r := range text {
+		if r >= 0x4E00 && r <= 0x9FFF {
+			chineseCount++
+		}
+	}
+	return len(strings.Fields(text)) + int(float64(chineseCount)*0.75)
+}
+
+// EncodeOpenAI 将Augment的输出序列编码为完整的OpenAI流，收到done后以 stop 结束，
+// promptTokens不小于0时在 [DONE] 之前输出用量分块
+func EncodeOpenAI(stream *OpenAIStream, events []Event, promptTokens int) []byte {
+	var out []byte
+	var fullText string
+	for _, event := range events {
+		fullText += event.Text
+		finishReason := ""
+		if event.Done {
+			finishReason = "stop"
+		}
+		out = append(out, stream.Chunk(event.Text, finishReason)...)
+		if event.Done {
+			break
+		}
+	}
+	if promptTokens >= 0 {
+		out = append(out, stream.Usage(promptTokens, EstimateTokens(fullText))...)
+	}
+	return append(out, stream.Done()...)
+}
+
+// EncodeAnthropic 将Augment的输出序列编码为Anthropic的内容事件，收到done后以 end_turn 结束消息
+func EncodeAnthropic(events []Event) []byte {
+	var out []byte
+	var fullText string
+	for _, event := range events {
+		fullText += event.Text
+		out = append(out, AnthropicTextDelta(event.Text)...)
+		if event.Done {
+			break
+		}
+	}
+	return append(out, AnthropicMessageEnd("end_turn", nil, EstimateTokens(fullText))...)
+}
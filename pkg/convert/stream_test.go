@@ -0,0 +1,135 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update 为true时用当前输出覆盖快照：go test ./pkg/convert -update
+var update = flag.Bool("update", false, "update golden files")
+
+// fixedStream 创建时间固定的OpenAI编码器，保证快照输出稳定
+func fixedStream() *OpenAIStream {
+	stream := NewOpenAIStream("chatcmpl-1700000000", "claude-3.7-chat")
+	stream.Now = func() time.Time { return time.Unix(1700000000, 0) }
+	return stream
+}
+
+// loadEvents 读取 testdata 中的Augment输出序列
+func loadEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return events
+}
+
+// checkGolden 比较输出与快照，-update 时写入快照
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
+
+func TestStreamGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no stream fixtures found: %v", err)
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			events := loadEvents(t, input)
+			checkGolden(t, filepath.Join("testdata", name+".openai.golden"), EncodeOpenAI(fixedStream(), events, -1))
+			checkGolden(t, filepath.Join("testdata", name+".openai_usage.golden"), EncodeOpenAI(fixedStream(), events, 12))
+			checkGolden(t, filepath.Join("testdata", name+".anthropic.golden"), EncodeAnthropic(events))
+		})
+	}
+}
+
+func TestOpenAIChunkFinishReason(t *testing.T) {
+	stream := fixedStream()
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+
+	decode := func(data []byte) {
+		t.Helper()
+		if !bytes.HasPrefix(data, []byte("data: ")) || !bytes.HasSuffix(data, []byte("\n\n")) {
+			t.Fatalf("not an SSE data line: %q", data)
+		}
+		if err := json.Unmarshal(bytes.TrimSpace(data[len("data: "):]), &chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decode(stream.Chunk("hi", ""))
+	if chunk.Choices[0].FinishReason != nil {
+		t.Errorf("finish_reason = %q, want null", *chunk.Choices[0].FinishReason)
+	}
+	if chunk.Choices[0].Delta.Role != "assistant" || chunk.Choices[0].Delta.Content != "hi" {
+		t.Errorf("delta = %+v", chunk.Choices[0].Delta)
+	}
+
+	decode(stream.Chunk("", "length"))
+	if chunk.Choices[0].FinishReason == nil || *chunk.Choices[0].FinishReason != "length" {
+		t.Errorf("finish_reason = %v, want length", chunk.Choices[0].FinishReason)
+	}
+}
+
+func TestAnthropicTextDeltaSkipsEmpty(t *testing.T) {
+	if out := AnthropicTextDelta(""); out != nil {
+		t.Errorf("AnthropicTextDelta(\"\") = %q, want nil", out)
+	}
+}
+
+func TestAnthropicToolUseStop(t *testing.T) {
+	out := AnthropicToolUseStop("checking", ToolUse{
+		ID:    "toolu_1",
+		Name:  "read-file",
+		Input: map[string]interface{}{"path": "main.go"},
+	}, 4)
+	checkGolden(t, filepath.Join("testdata", "tool_use_stop.anthropic.golden"), out)
+}
+
+func TestAnthropicMessageEndStopSequence(t *testing.T) {
+	sequence := "END"
+	out := string(AnthropicMessageEnd("stop_sequence", &sequence, 3))
+	want := "event: content_block_stop\n" +
+		`data: {"index":0,"type":"content_block_stop"}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"delta":{"stop_reason":"stop_sequence","stop_sequence":"END"},"type":"message_delta","usage":{"output_tokens":3}}` + "\n\n" +
+		"event: message_stop\n" +
+		`data: {"type":"message_stop"}` + "\n\n"
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ToolEvent 上游输出的一次工具调用数据，Input可以是截至目前的完整参数，也可以是新增的片段
+type ToolEvent struct {
+	ID       string
+	Name     string
+	Input    string
+	Complete bool // 参数已全部输出
+}
+
+// ToolCallDelta OpenAI流式响应 delta.tool_calls 中的一项，同一工具调用的第一项带有id、类型和函数名，
+// 之后只带 index 和新增的参数片段，客户端按 index 拼接参数
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function ToolCallFuncDelta `json:"function"`
+}
+
+// ToolCallFuncDelta 工具调用的函数名和参数片段
+type ToolCallFuncDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// toolCallState 已开始输出的工具调用
+type toolCallState struct {
+	id        string
+	index     int
+	arguments string
+	complete  bool
+}
+
+// ToolCallTranscriber 将上游的工具调用数据转换为OpenAI的增量 tool_calls，
+// 按工具调用编号分配 index，同一调用的参数只输出尚未输出的部分
+type ToolCallTranscriber struct {
+	calls []*toolCallState
+}
+
+// Count 已开始输出的工具调用数量
+func (t *ToolCallTranscriber) Count() int {
+	return len(t.calls)
+}
+
+// lookup 按编号查找工具调用，编号为空时使用最近一个未完成的调用
+func (t *ToolCallTranscriber) lookup(id string) *toolCallState {
+	for i := len(t.calls) - 1; i >= 0; i-- {
+		call := t.calls[i]
+		if id == call.id || (id == "" && !call.complete) {
+			return call
+		}
+	}
+	return nil
+}
+
+// Transcribe 转换一次工具调用数据，返回需要输出的增量，已完成的调用再次出现时不再输出
+func (t *ToolCallTranscriber) Transcribe(event ToolEvent) []ToolCallDelta {
+	var deltas []ToolCallDelta
+	call := t.lookup(event.ID)
+	if call == nil {
+		id := event.ID
+		if id == "" {
+			id = fmt.Sprintf("call_%d", len(t.calls))
+		}
+		call = &toolCallState{id: id, index: len(t.calls)}
+		t.calls = append(t.calls, call)
+		deltas = append(deltas, ToolCallDelta{
+			Index:    call.index,
+			ID:       call.id,
+			Type:     "function",
+			Function: ToolCallFuncDelta{Name: event.Name},
+		})
+	}
+	if call.complete {
+		return deltas
+	}
+
+	// 参数是截至目前的完整内容时只输出新增部分，否则作为新增片段
+	var piece string
+	if strings.HasPrefix(event.Input, call.arguments) {
+		piece = event.Input[len(call.arguments):]
+		call.arguments = event.Input
+	} else {
+		piece = event.Input
+		call.arguments += event.Input
+	}
+	if event.Complete {
+		call.complete = true
+		// 没有参数的调用补全为空对象，与非流式响应一致
+		if call.arguments == "" {
+			piece, call.arguments = "{}", "{}"
+		}
+	}
+	if piece != "" {
+		deltas = append(deltas, ToolCallDelta{
+			Index:    call.index,
+			Function: ToolCallFuncDelta{Arguments: piece},
+		})
+	}
+	return deltas
+}
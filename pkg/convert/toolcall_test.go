@@ -0,0 +1,94 @@
+package convert
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestToolCallTranscriberCumulativeInput(t *testing.T) {
+	var calls ToolCallTranscriber
+	var deltas []ToolCallDelta
+	for _, event := range []ToolEvent{
+		{ID: "toolu_1", Name: "view"},
+		{ID: "toolu_1", Name: "view", Input: `{"path":`},
+		{ID: "toolu_1", Name: "view", Input: `{"path":"a.go"}`, Complete: true},
+		{ID: "toolu_1", Name: "view", Input: `{"path":"a.go"}`, Complete: true},
+	} {
+		deltas = append(deltas, calls.Transcribe(event)...)
+	}
+
+	if len(deltas) != 3 {
+		t.Fatalf("got %d deltas, want 3: %+v", len(deltas), deltas)
+	}
+	first := deltas[0]
+	if first.ID != "toolu_1" || first.Type != "function" || first.Function.Name != "view" || first.Function.Arguments != "" {
+		t.Errorf("first delta = %+v", first)
+	}
+	var arguments strings.Builder
+	for _, delta := range deltas[1:] {
+		if delta.ID != "" || delta.Type != "" || delta.Function.Name != "" || delta.Index != 0 {
+			t.Errorf("continuation delta carries header fields: %+v", delta)
+		}
+		arguments.WriteString(delta.Function.Arguments)
+	}
+	if got := arguments.String(); got != `{"path":"a.go"}` {
+		t.Errorf("arguments = %q", got)
+	}
+}
+
+func TestToolCallTranscriberFragmentsAndIndexes(t *testing.T) {
+	var calls ToolCallTranscriber
+	var deltas []ToolCallDelta
+	for _, event := range []ToolEvent{
+		{ID: "a", Name: "first", Input: `{"x":`},
+		{ID: "a", Name: "first", Input: `1}`, Complete: true},
+		{ID: "b", Name: "second", Complete: true},
+	} {
+		deltas = append(deltas, calls.Transcribe(event)...)
+	}
+
+	arguments := map[int]string{}
+	for _, delta := range deltas {
+		arguments[delta.Index] += delta.Function.Arguments
+	}
+	if arguments[0] != `{"x":1}` {
+		t.Errorf("call 0 arguments = %q", arguments[0])
+	}
+	if arguments[1] != "{}" {
+		t.Errorf("call 1 arguments = %q, want {}", arguments[1])
+	}
+	if calls.Count() != 2 {
+		t.Errorf("Count() = %d, want 2", calls.Count())
+	}
+}
+
+func TestOpenAIStreamToolCalls(t *testing.T) {
+	stream := NewOpenAIStream("chatcmpl-1", "m")
+	chunk := stream.ToolCalls([]ToolCallDelta{
+		{Index: 0, ID: "call_1", Type: "function", Function: ToolCallFuncDelta{Name: "view"}},
+		{Index: 0, Function: ToolCallFuncDelta{Arguments: `{}`}},
+	})
+	data := strings.TrimSuffix(strings.TrimPrefix(string(chunk), "data: "), "\n\n")
+	var decoded struct {
+		Choices []struct {
+			Delta struct {
+				Content   *string                  `json:"content"`
+				ToolCalls []map[string]interface{} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+		t.Fatalf("invalid chunk %q: %v", chunk, err)
+	}
+	delta := decoded.Choices[0].Delta
+	if delta.Content != nil {
+		t.Errorf("content = %q, want null", *delta.Content)
+	}
+	if _, ok := delta.ToolCalls[1]["id"]; ok {
+		t.Errorf("continuation delta has id: %v", delta.ToolCalls[1])
+	}
+	if _, ok := delta.ToolCalls[1]["index"]; !ok {
+		t.Errorf("continuation delta is missing index: %v", delta.ToolCalls[1])
+	}
+}
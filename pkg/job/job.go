@@ -0,0 +1,458 @@
+package job
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// queueKey 待执行任务的有序集合，分数为下次执行时间（毫秒）
+	queueKey = "job_queue"
+	// jobKeyPrefix 任务记录的键前缀
+	jobKeyPrefix = "job:"
+	// jobRetention 任务结束后记录的保留时间
+	jobRetention = 24 * time.Hour
+	// pollInterval 空闲时检查到期任务的间隔
+	pollInterval = time.Second
+	// retryBaseDelay 第一次重试的等待时间，之后每次翻倍
+	retryBaseDelay = 5 * time.Second
+	// retryMaxDelay 重试等待时间上限
+	retryMaxDelay = 5 * time.Minute
+	// cancelKeyPrefix 任务取消标记的键前缀
+	cancelKeyPrefix = "job_cancel:"
+
+	// StatusQueued 等待执行
+	StatusQueued = "queued"
+	// StatusRunning 执行中
+	StatusRunning = "running"
+	// StatusRetrying 执行失败，等待重试
+	StatusRetrying = "retrying"
+	// StatusSucceeded 执行成功
+	StatusSucceeded = "succeeded"
+	// StatusFailed 重试次数用尽或不可重试的失败
+	StatusFailed = "failed"
+)
+
+// Job 后台任务
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Owner       string          `json:"owner,omitempty"` // 提交任务的调用方标识，用于限制查询
+	Payload     json.RawMessage `json:"payload"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	NextRunAt   time.Time       `json:"next_run_at,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// SetResult 保存任务的阶段性结果，失败重试时结果会保留，处理函数可据此跳过已完成的步骤
+func (j *Job) SetResult(result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	j.Result = data
+	return nil
+}
+
+// Checkpoint 立即保存任务的阶段性结果，执行时间较长的任务可据此让查询方看到进度
+func (j *Job) Checkpoint(result interface{}) error {
+	if err := j.SetResult(result); err != nil {
+		return err
+	}
+	return save(j, 0)
+}
+
+// DecodePayload 解析任务参数
+func (j *Job) DecodePayload(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Handler 任务处理函数，返回错误时按退避时间重试，Permanent 包装的错误不再重试
+type Handler func(ctx context.Context, j *Job) error
+
+// Options 任务类型的执行参数
+type Options struct {
+	MaxAttempts int           // 最多执行次数
+	Timeout     time.Duration // 单次执行超时，超时未结束的任务在其他实例上可被重新领取
+	Queue       string        // 独立队列名称，为空时使用默认队列，独立队列只由 StartQueue 启动的工作协程领取
+}
+
+// queueKey 任务类型使用的队列键
+func (o Options) queueKey() string {
+	return QueueKey(o.Queue)
+}
+
+// QueueKey 队列在Redis中的键，name为空时为默认队列
+func QueueKey(name string) string {
+	if name == "" {
+		return queueKey
+	}
+	return queueKey + ":" + name
+}
+
+type registration struct {
+	handler Handler
+	options Options
+}
+
+// permanentError 不可重试的错误
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent 将错误标记为不可重试
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// deferredError 暂时无法执行、需要稍后重新执行的错误
+type deferredError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e deferredError) Error() string { return e.err.Error() }
+func (e deferredError) Unwrap() error { return e.err }
+
+// Defer 将任务放回队列，delay之后重新领取，不计入执行次数；
+// 用于等待资源空闲，避免处理函数在工作协程中轮询等待
+func Defer(err error, delay time.Duration) error {
+	return deferredError{err: err, delay: delay}
+}
+
+var (
+	handlers      = make(map[string]registration)
+	handlersGuard sync.RWMutex
+	// pausedQueues 暂停领取任务的队列
+	pausedQueues sync.Map
+
+	// ErrNotFound 任务不存在或已过期
+	ErrNotFound = errors.New("任务不存在或已过期")
+	// ErrUnavailable 未启用Redis时无法执行后台任务
+	ErrUnavailable = errors.New("后台任务需要Redis")
+	// ErrCancelled 任务已被取消
+	ErrCancelled = errors.New("任务已取消")
+
+	jobOutcomes = metrics.NewCounterVec("augment2api_jobs_total",
+		"Background job attempts by outcome.", "outcome")
+	_ = metrics.NewGaugeFunc("augment2api_jobs_pending",
+		"Background jobs waiting to run or being retried.", func() float64 {
+			return float64(Pending(""))
+		})
+)
+
+// Enabled 是否可以提交后台任务
+func Enabled() bool {
+	return config.RDB != nil
+}
+
+// Register 注册任务类型的处理函数，应在 Start 之前调用
+func Register(jobType string, handler Handler, options Options) {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Minute
+	}
+	handlersGuard.Lock()
+	handlers[jobType] = registration{handler: handler, options: options}
+	handlersGuard.Unlock()
+}
+
+// lookup 查找任务类型的处理函数
+func lookup(jobType string) (registration, bool) {
+	handlersGuard.RLock()
+	defer handlersGuard.RUnlock()
+	reg, ok := handlers[jobType]
+	return reg, ok
+}
+
+// Enqueue 提交后台任务，任务由任意实例的工作协程执行
+func Enqueue(jobType, owner string, payload interface{}) (*Job, error) {
+	return EnqueueIn(jobType, owner, payload, 0)
+}
+
+// EnqueueIn 提交延迟执行的后台任务，delay之后才会被领取
+func EnqueueIn(jobType, owner string, payload interface{}, delay time.Duration) (*Job, error) {
+	if !Enabled() {
+		return nil, ErrUnavailable
+	}
+	reg, ok := lookup(jobType)
+	if !ok {
+		return nil, fmt.Errorf("未注册的任务类型: %s", jobType)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	j := &Job{
+		ID:          uuid.New().String(),
+		Type:        jobType,
+		Status:      StatusQueued,
+		Owner:       owner,
+		Payload:     data,
+		MaxAttempts: reg.options.MaxAttempts,
+		NextRunAt:   now.Add(delay),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := save(j, 0); err != nil {
+		return nil, err
+	}
+	if err := config.RedisZAdd(reg.options.queueKey(), float64(j.NextRunAt.UnixMilli()), j.ID); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Get 获取任务记录
+func Get(id string) (*Job, error) {
+	if !Enabled() {
+		return nil, ErrUnavailable
+	}
+	data, err := config.RedisGet(jobKeyPrefix + id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var j Job
+	if err := json.Unmarshal([]byte(data), &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// save 保存任务记录，ttl为0表示不过期
+func save(j *Job, ttl time.Duration) error {
+	j.UpdatedAt = time.Now()
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return config.RedisSet(jobKeyPrefix+j.ID, string(data), ttl)
+}
+
+// retryDelay 第n次失败后的重试等待时间
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// workerCount 每个实例的任务工作协程数
+func workerCount() int {
+	workers, err := strconv.Atoi(config.AppConfig.JobWorkers)
+	if err != nil || workers < 0 {
+		return 2
+	}
+	return workers
+}
+
+// Start 启动任务工作协程，所有实例都会领取到期任务，同一任务同一时间只会被一个实例执行
+func Start() {
+	StartQueue("", workerCount())
+}
+
+// StartQueue 启动领取指定队列的工作协程，name为空时为默认队列
+func StartQueue(name string, workers int) {
+	if !Enabled() || workers <= 0 {
+		return
+	}
+	key := QueueKey(name)
+	for i := 0; i < workers; i++ {
+		go work(key)
+	}
+	logger.Log.WithFields(logrus.Fields{
+		"queue":   key,
+		"workers": workers,
+	}).Info("后台任务工作协程已启动")
+}
+
+// Pending 队列中等待执行或等待重试的任务数，name为空时为默认队列
+func Pending(name string) int64 {
+	if !Enabled() {
+		return 0
+	}
+	count, _ := config.RedisZCard(QueueKey(name))
+	return count
+}
+
+// Pause 暂停本实例领取指定队列的任务，执行中的任务继续执行到结束，name为空时为默认队列
+func Pause(name string) {
+	pausedQueues.Store(QueueKey(name), true)
+}
+
+// Resume 恢复领取指定队列的任务
+func Resume(name string) {
+	pausedQueues.Delete(QueueKey(name))
+}
+
+// Paused 本实例是否暂停了指定队列
+func Paused(name string) bool {
+	_, paused := pausedQueues.Load(QueueKey(name))
+	return paused
+}
+
+// work 循环领取并执行队列中的到期任务，队列暂停时不领取新任务
+func work(key string) {
+	for {
+		if _, paused := pausedQueues.Load(key); paused || !runNext(key) {
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+// runNext 领取并执行队列中的一个到期任务，没有到期任务时返回false
+func runNext(key string) bool {
+	now := time.Now()
+	// 领取时先将任务延后到超时之后，执行中的实例退出时任务会在超时后被重新领取
+	id, err := config.RedisZClaimDue(key, float64(now.UnixMilli()), float64(now.Add(maxTimeout()).UnixMilli()))
+	if err != nil || id == "" {
+		return false
+	}
+
+	j, err := Get(id)
+	if err != nil {
+		// 记录已过期的任务不再执行
+		config.RedisZRem(key, id)
+		return true
+	}
+	reg, ok := lookup(j.Type)
+	if !ok {
+		finish(key, j, StatusFailed, "未注册的任务类型: "+j.Type)
+		return true
+	}
+
+	if Cancelled(j.ID) {
+		jobOutcomes.Inc("cancelled")
+		finish(key, j, StatusFailed, ErrCancelled.Error())
+		return true
+	}
+
+	j.Status = StatusRunning
+	j.Attempts++
+	save(j, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), reg.options.Timeout)
+	go watchCancel(ctx, j.ID, cancel)
+	err = runHandler(ctx, reg.handler, j)
+	cancel()
+
+	var permanent permanentError
+	var deferred deferredError
+	switch {
+	case err == nil:
+		jobOutcomes.Inc("succeeded")
+		finish(key, j, StatusSucceeded, "")
+	case errors.As(err, &permanent) || j.Attempts >= j.MaxAttempts:
+		jobOutcomes.Inc("failed")
+		finish(key, j, StatusFailed, err.Error())
+		logger.Log.WithFields(logrus.Fields{
+			"job":      j.ID,
+			"type":     j.Type,
+			"attempts": j.Attempts,
+			"error":    err.Error(),
+		}).Warn("后台任务执行失败")
+	case errors.As(err, &deferred) && !Cancelled(j.ID):
+		jobOutcomes.Inc("deferred")
+		j.Attempts--
+		j.Status = StatusQueued
+		j.NextRunAt = time.Now().Add(deferred.delay)
+		save(j, 0)
+		config.RedisZAdd(key, float64(j.NextRunAt.UnixMilli()), j.ID)
+	case errors.As(err, &deferred):
+		jobOutcomes.Inc("cancelled")
+		finish(key, j, StatusFailed, ErrCancelled.Error())
+	default:
+		jobOutcomes.Inc("retried")
+		j.Status = StatusRetrying
+		j.Error = err.Error()
+		j.NextRunAt = time.Now().Add(retryDelay(j.Attempts))
+		save(j, 0)
+		config.RedisZAdd(key, float64(j.NextRunAt.UnixMilli()), j.ID)
+	}
+	return true
+}
+
+// runHandler 执行处理函数，处理函数panic时视为可重试的失败
+func runHandler(ctx context.Context, handler Handler, j *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("任务执行panic: %v", r)
+		}
+	}()
+	return handler(ctx, j)
+}
+
+// Cancel 取消任务：排队中的任务不再执行，执行中的任务的上下文被取消，由处理函数自行结束
+func Cancel(id string) error {
+	if !Enabled() {
+		return ErrUnavailable
+	}
+	return config.RedisSet(cancelKeyPrefix+id, "1", maxTimeout())
+}
+
+// Cancelled 任务是否已被取消
+func Cancelled(id string) bool {
+	exists, err := config.RedisExists(cancelKeyPrefix + id)
+	return err == nil && exists
+}
+
+// watchCancel 任务执行期间定期检查取消标记，任务被取消时取消执行上下文
+func watchCancel(ctx context.Context, id string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if Cancelled(id) {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// finish 结束任务并设置记录的保留时间
+func finish(key string, j *Job, status, errMsg string) {
+	j.Status = status
+	j.Error = errMsg
+	j.NextRunAt = time.Time{}
+	save(j, jobRetention)
+	config.RedisZRem(key, j.ID)
+}
+
+// maxTimeout 所有任务类型中最长的执行超时，领取任务时按此延后
+func maxTimeout() time.Duration {
+	handlersGuard.RLock()
+	defer handlersGuard.RUnlock()
+	longest := time.Minute
+	for _, reg := range handlers {
+		longest = max(longest, reg.options.Timeout)
+	}
+	return longest + 30*time.Second
+}
@@ -0,0 +1,113 @@
+package leader
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// lockKey 选主使用的Redis锁
+	lockKey = "leader_lock"
+	// lockTTL 锁的过期时间，主实例失联超过该时间后由其他实例接管
+	lockTTL = 15 * time.Second
+	// heartbeatInterval 续期与抢锁的间隔
+	heartbeatInterval = 5 * time.Second
+)
+
+var (
+	instanceID = newInstanceID()
+	isLeader   atomic.Bool
+)
+
+// newInstanceID 生成当前实例的唯一标识
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	return hostname + "-" + uuid.New().String()[:8]
+}
+
+// Enabled 是否开启多实例选主，未开启时当前实例始终视为主实例
+func Enabled() bool {
+	return config.AppConfig.LeaderElection == "true" && config.RDB != nil
+}
+
+// IsLeader 当前实例是否为主实例，后台任务只应在主实例上执行
+func IsLeader() bool {
+	if !Enabled() {
+		return true
+	}
+	return isLeader.Load()
+}
+
+// InstanceID 返回当前实例标识
+func InstanceID() string {
+	return instanceID
+}
+
+// CurrentLeader 返回当前持有锁的实例标识
+func CurrentLeader() string {
+	if !Enabled() {
+		return instanceID
+	}
+	owner, err := config.RedisGet(lockKey)
+	if err != nil {
+		return ""
+	}
+	return owner
+}
+
+// Start 启动选主，首次抢锁同步完成，之后在后台定期续期或抢锁
+func Start() {
+	if !Enabled() {
+		return
+	}
+
+	heartbeat()
+	logger.Log.WithFields(logrus.Fields{
+		"instance": instanceID,
+		"leader":   isLeader.Load(),
+	}).Info("多实例选主启动成功!")
+
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			heartbeat()
+		}
+	}()
+}
+
+// heartbeat 主实例续期锁，其他实例尝试抢锁
+func heartbeat() {
+	var leading bool
+	var err error
+
+	if isLeader.Load() {
+		leading, err = config.RedisRenewIfOwner(lockKey, instanceID, lockTTL)
+	}
+	if err == nil && !leading {
+		leading, err = config.RedisSetNX(lockKey, instanceID, lockTTL)
+	}
+	if err != nil {
+		// Redis不可用时无法确认锁的归属，保守地放弃主实例身份
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("选主心跳失败")
+		leading = false
+	}
+
+	if previous := isLeader.Swap(leading); previous != leading {
+		logger.Log.WithFields(logrus.Fields{
+			"instance": instanceID,
+			"leader":   leading,
+		}).Info("主实例身份发生变化")
+	}
+}
@@ -44,18 +44,12 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 var Log = logrus.New()
 
 func Init() {
-	// 使用自定义格式化器
-	Log.SetFormatter(&CustomFormatter{
-		TimestampFormat: "2006-01-02 15:04:05",
-	})
-
-	// 设置输出到标准输出
-	Log.SetOutput(os.Stdout)
-
-	// 设置日志级别
+	// 设置日志级别，各模块可通过 LOG_LEVELS 单独调整
+	level := logrus.InfoLevel
 	if os.Getenv("DEBUG") == "true" {
-		Log.SetLevel(logrus.DebugLevel)
-	} else {
-		Log.SetLevel(logrus.InfoLevel)
+		level = logrus.DebugLevel
 	}
+
+	// 使用自定义格式化器并输出到标准输出
+	initModules(level)
 }
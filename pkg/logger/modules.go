@@ -0,0 +1,166 @@
+package logger
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ModuleAPI 接口处理，对应 Log
+	ModuleAPI = "api"
+	// ModuleToken token调度和状态管理
+	ModuleToken = "token"
+	// ModuleMiddleware 中间件
+	ModuleMiddleware = "middleware"
+	// ModuleUpstream 上游请求、连接池和签名
+	ModuleUpstream = "upstream"
+)
+
+var (
+	// Token token调度和状态管理的日志
+	Token = logrus.New()
+	// Middleware 中间件的日志
+	Middleware = logrus.New()
+	// Upstream 上游请求的日志
+	Upstream = logrus.New()
+
+	modules = map[string]*logrus.Logger{
+		ModuleAPI:        Log,
+		ModuleToken:      Token,
+		ModuleMiddleware: Middleware,
+		ModuleUpstream:   Upstream,
+	}
+
+	sampleRates      = make(map[string]float64)
+	sampleRatesGuard sync.RWMutex
+)
+
+// ModuleSettings 模块的日志级别和采样比例
+type ModuleSettings struct {
+	Level      string  `json:"level"`
+	SampleRate float64 `json:"sample_rate"` // info及以下级别日志的输出比例，warn及以上始终输出
+}
+
+// samplingFormatter 按模块的采样比例丢弃info及以下级别的日志，返回空内容即不输出
+type samplingFormatter struct {
+	module string
+	inner  logrus.Formatter
+}
+
+func (f *samplingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level >= logrus.InfoLevel {
+		if rate := sampleRate(f.module); rate < 1 && rand.Float64() >= rate {
+			return nil, nil
+		}
+	}
+	return f.inner.Format(entry)
+}
+
+// sampleRate 返回模块的采样比例，未设置时为1
+func sampleRate(module string) float64 {
+	sampleRatesGuard.RLock()
+	defer sampleRatesGuard.RUnlock()
+	if rate, ok := sampleRates[module]; ok {
+		return rate
+	}
+	return 1
+}
+
+// initModules 为各模块设置格式、输出和级别，并读取 LOG_LEVELS 和 LOG_SAMPLING
+func initModules(level logrus.Level) {
+	for name, module := range modules {
+		module.SetFormatter(&samplingFormatter{
+			module: name,
+			inner:  &CustomFormatter{TimestampFormat: "2006-01-02 15:04:05"},
+		})
+		module.SetOutput(os.Stdout)
+		module.SetLevel(level)
+	}
+
+	// 示例: LOG_LEVELS=token=debug,upstream=warn
+	for name, value := range parseModuleList(os.Getenv("LOG_LEVELS")) {
+		if err := SetModuleLevel(name, value); err != nil {
+			Log.Warn("忽略无效的日志级别配置: " + err.Error())
+		}
+	}
+	// 示例: LOG_SAMPLING=middleware=0.1
+	for name, value := range parseModuleList(os.Getenv("LOG_SAMPLING")) {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			err = SetModuleSampling(name, rate)
+		}
+		if err != nil {
+			Log.Warn("忽略无效的日志采样配置: " + name + "=" + value)
+		}
+	}
+}
+
+// parseModuleList 解析 module=value 形式、英文逗号分隔的配置
+func parseModuleList(raw string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		result[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return result
+}
+
+// Modules 返回所有模块名
+func Modules() []string {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetModuleLevel 设置模块的日志级别，运行时生效
+func SetModuleLevel(module, level string) error {
+	target, ok := modules[module]
+	if !ok {
+		return fmt.Errorf("未知的日志模块: %s", module)
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("无效的日志级别: %s", level)
+	}
+	target.SetLevel(parsed)
+	return nil
+}
+
+// SetModuleSampling 设置模块info及以下级别日志的输出比例，1为全部输出
+func SetModuleSampling(module string, rate float64) error {
+	if _, ok := modules[module]; !ok {
+		return fmt.Errorf("未知的日志模块: %s", module)
+	}
+	if rate <= 0 || rate > 1 {
+		return fmt.Errorf("采样比例必须在 (0, 1] 之间: %v", rate)
+	}
+	sampleRatesGuard.Lock()
+	sampleRates[module] = rate
+	sampleRatesGuard.Unlock()
+	return nil
+}
+
+// Settings 返回各模块当前的日志级别和采样比例
+func Settings() map[string]ModuleSettings {
+	settings := make(map[string]ModuleSettings, len(modules))
+	for name, module := range modules {
+		settings[name] = ModuleSettings{
+			Level:      module.GetLevel().String(),
+			SampleRate: sampleRate(name),
+		}
+	}
+	return settings
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ReplicaLabel 按实例区分指标时使用的标签名，避免与Prometheus抓取时附加的instance标签冲突
+const ReplicaLabel = "replica"
+
+// Family 单个指标的快照，可序列化后在实例之间共享
+type Family struct {
+	Name      string             `json:"name"`
+	Help      string             `json:"help"`
+	Kind      string             `json:"kind"`                // counter / gauge / summary
+	Label     string             `json:"label,omitempty"`     // 标签名，无标签时为空
+	Values    map[string]float64 `json:"values,omitempty"`    // 标签值 -> 当前值，无标签时键为空字符串
+	Quantiles map[string]float64 `json:"quantiles,omitempty"` // summary 的分位数，没有观测时为空
+	Count     uint64             `json:"count,omitempty"`     // summary 的累计观测次数
+	Sum       float64            `json:"sum,omitempty"`       // summary 的累计总和
+}
+
+// Snapshot 返回所有已注册指标的快照
+func Snapshot() []Family {
+	registryGuard.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryGuard.Unlock()
+
+	families := make([]Family, 0, len(collectors))
+	for _, c := range collectors {
+		families = append(families, c.snapshot())
+	}
+	return families
+}
+
+func (c *Counter) snapshot() Family {
+	return Family{
+		Name:   c.name,
+		Help:   c.help,
+		Kind:   "counter",
+		Values: map[string]float64{"": float64(c.Value())},
+	}
+}
+
+func (c *CounterVec) snapshot() Family {
+	values := make(map[string]float64)
+	for key, value := range c.Values() {
+		values[key] = float64(value)
+	}
+	return Family{
+		Name:   c.name,
+		Help:   c.help,
+		Kind:   "counter",
+		Label:  c.label,
+		Values: values,
+	}
+}
+
+func (g *GaugeFunc) snapshot() Family {
+	family := Family{Name: g.name, Help: g.help, Kind: "gauge"}
+	// JSON无法表示NaN和Inf，此类值不共享
+	if v := g.fn(); !math.IsNaN(v) && !math.IsInf(v, 0) {
+		family.Values = map[string]float64{"": v}
+	}
+	return family
+}
+
+func (s *Summary) snapshot() Family {
+	family := Family{Name: s.name, Help: s.help, Kind: "summary"}
+	for q, v := range s.Quantiles() {
+		if math.IsNaN(v) {
+			continue
+		}
+		if family.Quantiles == nil {
+			family.Quantiles = make(map[string]float64)
+		}
+		family.Quantiles[formatFloat(q)] = v
+	}
+	family.Count, family.Sum = s.CountAndSum()
+	return family
+}
+
+// WriteCluster 以Prometheus文本格式输出多个实例汇总后的指标
+// 不带 replica 标签的序列为所有实例的合计，带 replica 标签的序列为各实例的值；
+// summary 的分位数无法合并，只按实例输出
+func WriteCluster(w io.Writer, replicas map[string][]Family) {
+	names := make([]string, 0, len(replicas))
+	for replica := range replicas {
+		names = append(names, replica)
+	}
+	sort.Strings(names)
+
+	// 按首次出现的顺序输出指标，各实例版本不同时也能输出全部指标
+	var order []string
+	byName := make(map[string]map[string]Family)
+	for _, replica := range names {
+		for _, family := range replicas[replica] {
+			if byName[family.Name] == nil {
+				byName[family.Name] = make(map[string]Family)
+				order = append(order, family.Name)
+			}
+			byName[family.Name][replica] = family
+		}
+	}
+
+	for _, name := range order {
+		perReplica := byName[name]
+		var first Family
+		for _, replica := range names {
+			if family, ok := perReplica[replica]; ok {
+				first = family
+				break
+			}
+		}
+		writeHeader(w, first.Name, first.Help, first.Kind)
+		if first.Kind == "summary" {
+			writeClusterSummary(w, first.Name, names, perReplica)
+		} else {
+			writeClusterValues(w, first.Name, first.Label, names, perReplica)
+		}
+	}
+}
+
+// writeClusterValues 输出计数器和仪表的合计及各实例的值
+func writeClusterValues(w io.Writer, name, label string, replicas []string, perReplica map[string]Family) {
+	totals := make(map[string]float64)
+	for _, family := range perReplica {
+		for key, value := range family.Values {
+			totals[key] += value
+		}
+	}
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labels := ""
+		if label != "" {
+			labels = fmt.Sprintf("%s=\"%s\"", label, escapeLabel(key))
+		}
+		if labels == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatFloat(totals[key]))
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(totals[key]))
+		}
+		for _, replica := range replicas {
+			value, ok := perReplica[replica].Values[key]
+			if !ok {
+				continue
+			}
+			replicaLabels := fmt.Sprintf("%s=\"%s\"", ReplicaLabel, escapeLabel(replica))
+			if labels != "" {
+				replicaLabels = labels + "," + replicaLabels
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", name, replicaLabels, formatFloat(value))
+		}
+	}
+}
+
+// writeClusterSummary 输出摘要各实例的分位数，以及合计和各实例的观测次数与总和
+func writeClusterSummary(w io.Writer, name string, replicas []string, perReplica map[string]Family) {
+	var count uint64
+	var sum float64
+	for _, replica := range replicas {
+		family, ok := perReplica[replica]
+		if !ok {
+			continue
+		}
+		quantiles := make([]string, 0, len(family.Quantiles))
+		for q := range family.Quantiles {
+			quantiles = append(quantiles, q)
+		}
+		sort.Strings(quantiles)
+		for _, q := range quantiles {
+			fmt.Fprintf(w, "%s{quantile=\"%s\",%s=\"%s\"} %s\n", name, q, ReplicaLabel, escapeLabel(replica), formatFloat(family.Quantiles[q]))
+		}
+		count += family.Count
+		sum += family.Sum
+	}
+
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(sum), name, count)
+	for _, replica := range replicas {
+		family, ok := perReplica[replica]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, ReplicaLabel, escapeLabel(replica), formatFloat(family.Sum))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, ReplicaLabel, escapeLabel(replica), family.Count)
+	}
+}
@@ -0,0 +1,243 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector 以Prometheus文本格式输出的指标
+type collector interface {
+	write(w io.Writer)
+	snapshot() Family
+}
+
+var (
+	registry      []collector
+	registryNames = make(map[string]bool)
+	registryGuard sync.Mutex
+)
+
+// register 注册指标，名称重复时panic，便于在启动阶段发现问题
+func register(name string, c collector) {
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+	if registryNames[name] {
+		panic("metrics: 指标重复注册: " + name)
+	}
+	registryNames[name] = true
+	registry = append(registry, c)
+}
+
+// WriteText 以Prometheus文本格式输出所有已注册的指标
+func WriteText(w io.Writer) {
+	registryGuard.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryGuard.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// writeHeader 输出指标的HELP和TYPE行
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatFloat 按Prometheus格式输出浮点数
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// escapeLabel 转义标签值
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Counter 单调递增的计数器
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// NewCounter 创建并注册计数器
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+// Inc 计数加一
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value 返回当前计数
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// CounterVec 按单个标签区分的一组计数器
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	values sync.Map // label value -> *atomic.Uint64
+}
+
+// NewCounterVec 创建并注册带标签的计数器
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label}
+	register(name, c)
+	return c
+}
+
+// Inc 指定标签值的计数加一
+func (c *CounterVec) Inc(value string) {
+	counter, _ := c.values.LoadOrStore(value, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// Values 返回各标签值的当前计数
+func (c *CounterVec) Values() map[string]uint64 {
+	values := make(map[string]uint64)
+	c.values.Range(func(key, counter interface{}) bool {
+		values[key.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return values
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	values := c.Values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, escapeLabel(key), values[key])
+	}
+}
+
+// GaugeFunc 在输出时通过回调读取当前值的仪表
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc 创建并注册回调仪表
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// Summary 保留最近若干次观测值并计算分位数
+type Summary struct {
+	name      string
+	help      string
+	quantiles []float64
+
+	mu     sync.Mutex
+	window []float64
+	next   int
+	full   bool
+	count  uint64
+	sum    float64
+}
+
+// NewSummary 创建并注册摘要，分位数基于最近 window 次观测计算
+func NewSummary(name, help string, window int, quantiles ...float64) *Summary {
+	s := &Summary{
+		name:      name,
+		help:      help,
+		quantiles: quantiles,
+		window:    make([]float64, window),
+	}
+	register(name, s)
+	return s
+}
+
+// Observe 记录一次观测值
+func (s *Summary) Observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window[s.next] = v
+	s.next++
+	if s.next == len(s.window) {
+		s.next = 0
+		s.full = true
+	}
+	s.count++
+	s.sum += v
+}
+
+// Quantiles 返回各分位数的当前值，没有观测时为NaN
+func (s *Summary) Quantiles() map[float64]float64 {
+	s.mu.Lock()
+	size := s.next
+	if s.full {
+		size = len(s.window)
+	}
+	values := append([]float64(nil), s.window[:size]...)
+	s.mu.Unlock()
+
+	sort.Float64s(values)
+	result := make(map[float64]float64, len(s.quantiles))
+	for _, q := range s.quantiles {
+		if len(values) == 0 {
+			result[q] = math.NaN()
+			continue
+		}
+		index := int(math.Ceil(q*float64(len(values)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		result[q] = values[index]
+	}
+	return result
+}
+
+// CountAndSum 返回累计观测次数和总和
+func (s *Summary) CountAndSum() (uint64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.sum
+}
+
+func (s *Summary) write(w io.Writer) {
+	writeHeader(w, s.name, s.help, "summary")
+	quantiles := s.Quantiles()
+	for _, q := range s.quantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%s\"} %s\n", s.name, formatFloat(q), formatFloat(quantiles[q]))
+	}
+	count, sum := s.CountAndSum()
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", s.name, formatFloat(sum), s.name, count)
+}
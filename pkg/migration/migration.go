@@ -0,0 +1,272 @@
+package migration
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// versionKey 记录当前已应用的迁移版本
+	versionKey = "schema_version"
+	// historyKey 记录每个迁移的执行信息
+	historyKey = "schema_migrations"
+	// lockKey 防止多个实例同时执行迁移
+	lockKey = "schema_migration_lock"
+)
+
+// Change 迁移对单个key的变更描述
+type Change struct {
+	Key    string   `json:"key"`
+	Action string   `json:"action"`           // 变更类型，如 hset / del / expire
+	Fields []string `json:"fields,omitempty"` // 涉及的哈希字段
+}
+
+// Migration 一次存储结构迁移
+type Migration struct {
+	Version int
+	Name    string
+	// Up 执行迁移，dryRun为true时只返回将要发生的变更，不写入Redis
+	Up func(dryRun bool) ([]Change, error)
+}
+
+// Result 单个迁移的执行结果
+type Result struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	DryRun    bool      `json:"dry_run"`
+	Changes   []Change  `json:"changes,omitempty"`
+	Summary   Summary   `json:"summary"`
+	Error     string    `json:"error,omitempty"`
+	AppliedAt time.Time `json:"applied_at,omitempty"`
+}
+
+// Summary 变更的汇总
+type Summary struct {
+	KeysTouched int            `json:"keys_touched"`     // 涉及的不同key数
+	Actions     map[string]int `json:"actions"`          // 每种变更类型的次数
+	Fields      map[string]int `json:"fields,omitempty"` // 每个哈希字段被写入或删除的key数
+}
+
+// Report 预演或执行所有待应用迁移的报告
+type Report struct {
+	DryRun         bool      `json:"dry_run"`
+	CurrentVersion int       `json:"current_version"`
+	TargetVersion  int       `json:"target_version"` // 最后一个成功的迁移的版本，没有待应用的迁移时与当前版本相同
+	Results        []Result  `json:"results"`
+	Summary        Summary   `json:"summary"` // 所有迁移合计
+	Error          string    `json:"error,omitempty"`
+	GeneratedAt    time.Time `json:"generated_at"`
+}
+
+// AppliedRecord 已应用迁移的记录
+type AppliedRecord struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Changes   int       `json:"changes"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// Status 迁移状态
+type Status struct {
+	CurrentVersion int             `json:"current_version"`
+	LatestVersion  int             `json:"latest_version"`
+	Applied        []AppliedRecord `json:"applied"`
+	Pending        []string        `json:"pending"`
+}
+
+var (
+	registry      []Migration
+	registryGuard sync.Mutex
+)
+
+// Register 注册迁移，版本号必须唯一
+func Register(m Migration) {
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+
+	for _, existing := range registry {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("迁移版本重复: %d", m.Version))
+		}
+	}
+	registry = append(registry, m)
+	sort.Slice(registry, func(i, j int) bool {
+		return registry[i].Version < registry[j].Version
+	})
+}
+
+// CurrentVersion 获取当前已应用的迁移版本，未执行过迁移时为0
+func CurrentVersion() (int, error) {
+	value, err := config.RedisGet(versionKey)
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Pending 获取尚未应用的迁移
+func Pending() ([]Migration, error) {
+	current, err := CurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+
+	var pending []Migration
+	for _, m := range registry {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Run 按版本顺序执行所有待应用的迁移，遇到错误立即停止
+func Run(dryRun bool) ([]Result, error) {
+	if !dryRun {
+		locked, err := config.RedisSetNX(lockKey, strconv.FormatInt(time.Now().Unix(), 10), 10*time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, fmt.Errorf("其他实例正在执行迁移")
+		}
+		defer config.RedisDel(lockKey)
+	}
+
+	pending, err := Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(pending))
+	for _, m := range pending {
+		result := Result{
+			Version: m.Version,
+			Name:    m.Name,
+			DryRun:  dryRun,
+		}
+
+		changes, err := m.Up(dryRun)
+		result.Changes = changes
+		result.Summary = summarize(changes)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			return results, fmt.Errorf("迁移 %d(%s) 执行失败: %v", m.Version, m.Name, err)
+		}
+
+		if !dryRun {
+			result.AppliedAt = time.Now()
+			record, _ := json.Marshal(AppliedRecord{
+				Version:   m.Version,
+				Name:      m.Name,
+				Changes:   len(changes),
+				AppliedAt: result.AppliedAt,
+			})
+			if err := config.RedisHSet(historyKey, strconv.Itoa(m.Version), string(record)); err != nil {
+				return results, err
+			}
+			if err := config.RedisSet(versionKey, strconv.Itoa(m.Version), 0); err != nil {
+				return results, err
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// summarize 汇总变更涉及的key、变更类型和字段
+func summarize(changes []Change) Summary {
+	summary := Summary{Actions: make(map[string]int)}
+	keys := make(map[string]bool)
+	for _, change := range changes {
+		keys[change.Key] = true
+		summary.Actions[change.Action]++
+		for _, field := range change.Fields {
+			if summary.Fields == nil {
+				summary.Fields = make(map[string]int)
+			}
+			summary.Fields[field]++
+		}
+	}
+	summary.KeysTouched = len(keys)
+	return summary
+}
+
+// RunReport 执行所有待应用的迁移并生成报告，dryRun为true时只报告每个迁移将要修改的key和字段，不写入Redis
+func RunReport(dryRun bool) (Report, error) {
+	report := Report{DryRun: dryRun, GeneratedAt: time.Now()}
+	current, err := CurrentVersion()
+	if err != nil {
+		return report, err
+	}
+	report.CurrentVersion, report.TargetVersion = current, current
+
+	results, err := Run(dryRun)
+	report.Results = results
+	var all []Change
+	for _, result := range results {
+		all = append(all, result.Changes...)
+		if result.Error == "" {
+			report.TargetVersion = result.Version
+		}
+	}
+	report.Summary = summarize(all)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+// GetStatus 获取当前迁移状态
+func GetStatus() (Status, error) {
+	var status Status
+
+	current, err := CurrentVersion()
+	if err != nil {
+		return status, err
+	}
+	status.CurrentVersion = current
+
+	history, err := config.RedisHGetAll(historyKey)
+	if err != nil {
+		return status, err
+	}
+	for _, item := range history {
+		var record AppliedRecord
+		if err := json.Unmarshal([]byte(item), &record); err == nil {
+			status.Applied = append(status.Applied, record)
+		}
+	}
+	sort.Slice(status.Applied, func(i, j int) bool {
+		return status.Applied[i].Version < status.Applied[j].Version
+	})
+
+	registryGuard.Lock()
+	defer registryGuard.Unlock()
+	for _, m := range registry {
+		if m.Version > status.LatestVersion {
+			status.LatestVersion = m.Version
+		}
+		if m.Version > current {
+			status.Pending = append(status.Pending, fmt.Sprintf("%d_%s", m.Version, m.Name))
+		}
+	}
+
+	return status, nil
+}
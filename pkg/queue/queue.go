@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pollInterval 排队期间重新尝试获取token的间隔
+const pollInterval = 200 * time.Millisecond
+
+var (
+	// ErrQueueFull 队列已满，请求被直接拒绝
+	ErrQueueFull = errors.New("请求队列已满")
+	// ErrQueueTimeout 排队超过最长等待时间
+	ErrQueueTimeout = errors.New("排队等待超时")
+)
+
+var (
+	mu       sync.Mutex
+	waiting  int
+	maxLen   int
+	maxWait  = 30 * time.Second
+	enqueued uint64
+)
+
+var (
+	waitSeconds = metrics.NewSummary("augment2api_request_queue_wait_seconds",
+		"Time requests spent waiting in the request queue.", 1000, 0.5, 0.9, 0.99)
+	rejections = metrics.NewCounterVec("augment2api_request_queue_rejections_total",
+		"Requests rejected by the request queue.", "reason")
+	_ = metrics.NewGaugeFunc("augment2api_request_queue_depth",
+		"Requests currently waiting in the request queue.", func() float64 { return float64(Depth()) })
+	_ = metrics.NewGaugeFunc("augment2api_request_queue_max_length",
+		"Configured maximum request queue length.", func() float64 {
+			length, _ := Limits()
+			return float64(length)
+		})
+)
+
+// Stats 请求队列状态
+type Stats struct {
+	Depth          int                `json:"depth"`
+	MaxLength      int                `json:"max_length"`
+	MaxWaitSeconds float64            `json:"max_wait_seconds"`
+	Enqueued       uint64             `json:"enqueued"`
+	Rejections     map[string]uint64  `json:"rejections"`
+	WaitSeconds    map[string]float64 `json:"wait_seconds"`
+}
+
+// Init 从配置读取队列长度和最长等待时间
+func Init() {
+	length, err := strconv.Atoi(config.AppConfig.RequestQueueLength)
+	if err != nil || length < 0 {
+		length = 0
+	}
+	seconds, err := strconv.Atoi(config.AppConfig.RequestQueueMaxWait)
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	SetLimits(length, time.Duration(seconds)*time.Second)
+}
+
+// Enabled 是否开启请求排队，队列长度为0时没有可用token的请求直接拒绝
+func Enabled() bool {
+	length, _ := Limits()
+	return length > 0
+}
+
+// Limits 返回当前的队列长度和最长等待时间
+func Limits() (int, time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	return maxLen, maxWait
+}
+
+// SetLimits 运行时调整队列长度和最长等待时间，已在排队的请求不受影响
+func SetLimits(length int, wait time.Duration) {
+	mu.Lock()
+	maxLen = length
+	maxWait = wait
+	mu.Unlock()
+
+	logger.Log.WithFields(logrus.Fields{
+		"max_length": length,
+		"max_wait":   wait.String(),
+	}).Info("请求队列参数已更新")
+}
+
+// Depth 返回当前排队的请求数
+func Depth() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return waiting
+}
+
+// Wait 排队等待直到 tryAcquire 成功、超时或请求被取消
+func Wait(ctx context.Context, tryAcquire func() bool) error {
+	mu.Lock()
+	if waiting >= maxLen {
+		mu.Unlock()
+		rejections.Inc("full")
+		return ErrQueueFull
+	}
+	waiting++
+	enqueued++
+	wait := maxWait
+	mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		mu.Lock()
+		waiting--
+		mu.Unlock()
+		waitSeconds.Observe(time.Since(start).Seconds())
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			rejections.Inc("canceled")
+			return ctx.Err()
+		case <-timer.C:
+			rejections.Inc("timeout")
+			return ErrQueueTimeout
+		case <-ticker.C:
+			if tryAcquire() {
+				return nil
+			}
+		}
+	}
+}
+
+// GetStats 返回队列状态和等待时间分位数
+func GetStats() Stats {
+	mu.Lock()
+	stats := Stats{
+		Depth:          waiting,
+		MaxLength:      maxLen,
+		MaxWaitSeconds: maxWait.Seconds(),
+		Enqueued:       enqueued,
+	}
+	mu.Unlock()
+
+	stats.Rejections = rejections.Values()
+	stats.WaitSeconds = make(map[string]float64)
+	for q, v := range waitSeconds.Quantiles() {
+		if math.IsNaN(v) {
+			continue
+		}
+		stats.WaitSeconds["p"+strconv.Itoa(int(q*100))] = v
+	}
+	return stats
+}
@@ -0,0 +1,224 @@
+package review
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// indexKey 抽样记录ID的列表键，最新的在前
+	indexKey = "review_samples"
+	// samplePrefix 单条抽样记录的键前缀
+	samplePrefix = "review_sample:"
+	// Limit 保留的抽样记录条数
+	Limit = 1000
+	// sampleTTL 抽样记录的保留时间
+	sampleTTL = 14 * 24 * time.Hour
+)
+
+// ErrNotFound 抽样记录不存在或已过期
+var ErrNotFound = errors.New("抽样记录不存在")
+
+// Message 抽样请求中的一条消息
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Sample 一次被抽样的请求及其回复，用于人工评估输出质量
+type Sample struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Model      string    `json:"model"`
+	Mode       string    `json:"mode"`
+	Token      string    `json:"token,omitempty"`   // token指纹
+	APIKey     string    `json:"api_key,omitempty"` // 脱敏后的API密钥
+	Path       string    `json:"path"`
+	StatusCode int       `json:"status_code"`
+	DurationMs int64     `json:"duration_ms"`
+	Messages   []Message `json:"messages"`
+	Response   string    `json:"response"`
+	Tags       []string  `json:"tags"`
+	Note       string    `json:"note,omitempty"`
+}
+
+// Filter 查询抽样记录的条件，空值表示不限制
+type Filter struct {
+	Model    string
+	Token    string
+	Tag      string
+	Untagged bool // 只返回尚未打标签的记录
+}
+
+// matches 记录是否满足查询条件
+func (f Filter) matches(sample Sample) bool {
+	if f.Model != "" && sample.Model != f.Model {
+		return false
+	}
+	if f.Token != "" && sample.Token != f.Token {
+		return false
+	}
+	if f.Untagged && len(sample.Tags) > 0 {
+		return false
+	}
+	if f.Tag != "" {
+		for _, tag := range sample.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Save 保存一条抽样记录，只保留最近 Limit 条
+func Save(sample Sample) error {
+	if sample.ID == "" {
+		sample.ID = uuid.New().String()
+	}
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = time.Now()
+	}
+	if sample.Tags == nil {
+		sample.Tags = []string{}
+	}
+	if err := write(sample, sampleTTL); err != nil {
+		return err
+	}
+	if err := config.RedisLPush(indexKey, sample.ID); err != nil {
+		return err
+	}
+	return config.RedisLTrim(indexKey, 0, Limit-1)
+}
+
+// write 写入抽样记录
+func write(sample Sample, ttl time.Duration) error {
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	return config.RedisSet(samplePrefix+sample.ID, string(data), ttl)
+}
+
+// Get 获取一条抽样记录
+func Get(id string) (*Sample, error) {
+	data, err := config.RedisGet(samplePrefix + id)
+	if err != nil || data == "" {
+		return nil, ErrNotFound
+	}
+	var sample Sample
+	if err := json.Unmarshal([]byte(data), &sample); err != nil {
+		return nil, err
+	}
+	return &sample, nil
+}
+
+// List 按时间倒序返回满足条件的抽样记录，已过期的记录会被跳过
+func List(filter Filter) ([]Sample, error) {
+	ids, err := config.RedisLRange(indexKey, 0, Limit-1)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = samplePrefix + id
+	}
+	items, err := config.RedisMGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, 0, len(items))
+	for _, item := range items {
+		if item == "" {
+			continue
+		}
+		var sample Sample
+		if err := json.Unmarshal([]byte(item), &sample); err != nil {
+			continue
+		}
+		if filter.matches(sample) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+// SetTags 替换抽样记录的标签，note不为nil时同时更新备注，保留原有的过期时间
+func SetTags(id string, tags []string, note *string) (*Sample, error) {
+	sample, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	sample.Tags = tags
+	if note != nil {
+		sample.Note = *note
+	}
+
+	ttl, err := config.RedisTTL(samplePrefix + id)
+	if err != nil || ttl <= 0 {
+		ttl = sampleTTL
+	}
+	if err := write(*sample, ttl); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// Delete 删除一条抽样记录
+func Delete(id string) error {
+	return config.RedisDel(samplePrefix + id)
+}
+
+// GroupSummary 按模型或token汇总的抽样数量和各标签的数量
+type GroupSummary struct {
+	Key      string         `json:"key"`
+	Samples  int            `json:"samples"`
+	Tagged   int            `json:"tagged"`
+	Failed   int            `json:"failed"` // 状态码不是200的记录数
+	Tags     map[string]int `json:"tags"`
+	TagRatio float64        `json:"tagged_ratio"`
+}
+
+// Summarize 按分组函数汇总抽样记录，按抽样数量倒序排列
+func Summarize(samples []Sample, group func(Sample) string) []GroupSummary {
+	groups := make(map[string]*GroupSummary)
+	for _, sample := range samples {
+		key := group(sample)
+		summary, ok := groups[key]
+		if !ok {
+			summary = &GroupSummary{Key: key, Tags: map[string]int{}}
+			groups[key] = summary
+		}
+		summary.Samples++
+		if len(sample.Tags) > 0 {
+			summary.Tagged++
+		}
+		if sample.StatusCode != 200 {
+			summary.Failed++
+		}
+		for _, tag := range sample.Tags {
+			summary.Tags[tag]++
+		}
+	}
+
+	result := make([]GroupSummary, 0, len(groups))
+	for _, summary := range groups {
+		summary.TagRatio = float64(summary.Tagged) / float64(summary.Samples)
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Samples != result[j].Samples {
+			return result[i].Samples > result[j].Samples
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
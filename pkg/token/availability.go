@@ -0,0 +1,147 @@
+package token
+
+import (
+	"augment2api/config"
+	"sync"
+	"time"
+)
+
+// modeAvailabilityTTL 模式可用性的缓存时间，避免每个请求都遍历token池
+const modeAvailabilityTTL = 10 * time.Second
+
+type cachedAvailability struct {
+	available bool
+	expiresAt time.Time
+}
+
+var (
+	modeAvailability      = make(map[string]cachedAvailability)
+	modeAvailabilityGuard sync.Mutex
+)
+
+// ModeAvailable 分片中是否有可以处理该模式请求的token，shard为空表示未划分分片的token
+// 已禁用、冷却中、该模式使用次数已达上限或备注不允许该模式的token不计入，暂时繁忙的token仍计入
+func ModeAvailable(mode, shard string) bool {
+	if config.AppConfig.CodingMode == "true" || config.RDB == nil {
+		return true
+	}
+
+	cacheKey := mode + "|" + shard
+	modeAvailabilityGuard.Lock()
+	cached, ok := modeAvailability[cacheKey]
+	modeAvailabilityGuard.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.available
+	}
+
+	available := scanModeAvailable(mode, shard)
+	modeAvailabilityGuard.Lock()
+	modeAvailability[cacheKey] = cachedAvailability{available: available, expiresAt: time.Now().Add(modeAvailabilityTTL)}
+	modeAvailabilityGuard.Unlock()
+	return available
+}
+
+// scanModeAvailable 遍历token池检查分片中是否有可以处理该模式请求的token
+func scanModeAvailable(mode, shard string) bool {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		// 无法判断时按可用处理，由后续调度返回实际结果
+		return true
+	}
+
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || fields["status"] == "disabled" || fields["tenant_url"] == "" || IsContributed(fields) {
+			continue
+		}
+		token := key[6:] // 去掉前缀 "token:"
+		if ParseTokenHints(fields["remark"]).Shard != shard || !servesMode(token, fields["remark"], mode) {
+			continue
+		}
+		if coolStatus, err := GetTokenCoolStatus(token); err != nil || coolStatus.InCool {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// ModeAvailability token在两种模式下是否还能接受请求，一种模式的次数用完不影响另一种模式
+type ModeAvailability struct {
+	Chat  bool `json:"chat"`
+	Agent bool `json:"agent"`
+}
+
+// GetModeAvailability 按备注中的调度提示和各模式的使用次数判断token可以处理哪些模式的请求，不考虑冷却和禁用状态
+func GetModeAvailability(token, remark string) ModeAvailability {
+	return ModeAvailability{
+		Chat:  servesMode(token, remark, "CHAT"),
+		Agent: servesMode(token, remark, "AGENT"),
+	}
+}
+
+// servesMode token的调度提示是否允许该模式且该模式的使用次数未达上限
+func servesMode(token, remark, mode string) bool {
+	return ParseTokenHints(remark).rank(mode) != rankDisallowed && withinUsageLimit(token, mode)
+}
+
+// ModeQuota 分片中该模式的使用次数配额，limit 为允许该模式的token的次数上限之和，remaining 为剩余次数之和，
+// 冷却中的token冷却结束后仍可使用，计入配额；结果缓存时间与 ModeAvailable 相同
+func ModeQuota(mode, shard string) (limit, remaining int) {
+	if config.AppConfig.CodingMode == "true" || config.RDB == nil {
+		return 0, 0
+	}
+
+	cacheKey := mode + "|" + shard
+	modeQuotaGuard.Lock()
+	cached, ok := modeQuotas[cacheKey]
+	modeQuotaGuard.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.limit, cached.remaining
+	}
+
+	limit, remaining = scanModeQuota(mode, shard)
+	modeQuotaGuard.Lock()
+	modeQuotas[cacheKey] = cachedQuota{limit: limit, remaining: remaining, expiresAt: time.Now().Add(modeAvailabilityTTL)}
+	modeQuotaGuard.Unlock()
+	return limit, remaining
+}
+
+type cachedQuota struct {
+	limit     int
+	remaining int
+	expiresAt time.Time
+}
+
+var (
+	modeQuotas     = make(map[string]cachedQuota)
+	modeQuotaGuard sync.Mutex
+)
+
+// scanModeQuota 遍历token池累加分片中该模式的次数上限和剩余次数
+func scanModeQuota(mode, shard string) (limit, remaining int) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return 0, 0
+	}
+
+	usageLimit, usagePrefix := ChatUsageLimit, "token_usage_chat:"
+	if mode == "AGENT" {
+		usageLimit, usagePrefix = AgentUsageLimit, "token_usage_agent:"
+	}
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || fields["status"] == "disabled" || fields["tenant_url"] == "" || IsContributed(fields) {
+			continue
+		}
+		hints := ParseTokenHints(fields["remark"])
+		if hints.Shard != shard || hints.rank(mode) == rankDisallowed {
+			continue
+		}
+		limit += usageLimit
+		if left := usageLimit - GetUsage(usagePrefix+key[6:]); left > 0 {
+			remaining += left
+		}
+	}
+	return limit, remaining
+}
@@ -0,0 +1,187 @@
+package token
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// archiveKey 已清理token的使用数据归档列表
+	archiveKey = "token_archive"
+	// ArchiveLimit 归档保留条数
+	ArchiveLimit = 1000
+)
+
+// relatedKeyPrefixes token关联数据的键前缀
+var relatedKeyPrefixes = []string{
+	"token_usage:",
+	"token_usage_chat:",
+	"token_usage_agent:",
+	"token_status:",
+	"token_cool_status:",
+	"token_history:",
+	"token_event_log:",
+	"token_failures:",
+	"token_suspect:",
+	"token_invalid:",
+}
+
+// ArchivedToken 清理前保存的token使用数据
+type ArchivedToken struct {
+	Token           string    `json:"token"`
+	Reason          string    `json:"reason"` // deleted / disabled
+	ChatUsageCount  int       `json:"chat_usage_count"`
+	AgentUsageCount int       `json:"agent_usage_count"`
+	TotalUsageCount int       `json:"total_usage_count"`
+	DisabledAt      string    `json:"disabled_at,omitempty"`
+	ArchivedAt      time.Time `json:"archived_at"`
+}
+
+// CleanupResult 一次清理的结果
+type CleanupResult struct {
+	DryRun      bool            `json:"dry_run"`
+	Archived    []ArchivedToken `json:"archived"`
+	DeletedKeys int             `json:"deleted_keys"`
+}
+
+// staleReason 判断token的关联数据是否需要清理，返回清理原因
+func staleReason(token string, retention time.Duration, dryRun bool) (string, string) {
+	fields, err := config.RedisHGetAll("token:" + token)
+	if err != nil {
+		return "", ""
+	}
+	if len(fields) == 0 {
+		return "deleted", ""
+	}
+	if fields["status"] != "disabled" || retention <= 0 {
+		return "", ""
+	}
+
+	// 没有禁用时间的旧数据从本次清理开始计时
+	disabledAt, err := time.Parse(time.RFC3339, fields["disabled_at"])
+	if err != nil {
+		if !dryRun {
+			config.RedisHSet("token:"+token, "disabled_at", time.Now().Format(time.RFC3339))
+		}
+		return "", ""
+	}
+	if time.Since(disabledAt) < retention {
+		return "", ""
+	}
+	return "disabled", fields["disabled_at"]
+}
+
+// lastCounts 最近一次从Redis读取到的计数，Redis降级期间代替读取Redis
+var lastCounts sync.Map
+
+// readCount 读取计数键的值，不存在时为0；Redis降级期间返回最近一次读取到的值
+func readCount(key string) int {
+	if config.RedisDegraded() {
+		if count, ok := lastCounts.Load(key); ok {
+			return count.(int)
+		}
+		return 0
+	}
+	value, err := config.RedisGet(key)
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			lastCounts.Store(key, 0)
+		}
+		return 0
+	}
+	count, _ := strconv.Atoi(value)
+	lastCounts.Store(key, count)
+	return count
+}
+
+// CleanupStaleTokenKeys 归档并删除已删除或长期禁用token的关联数据
+// 长期禁用的token本身保留在池中，只清理使用次数等关联数据
+func CleanupStaleTokenKeys(retention time.Duration, dryRun bool) (CleanupResult, error) {
+	result := CleanupResult{DryRun: dryRun, Archived: []ArchivedToken{}}
+
+	related := make(map[string][]string)
+	for _, prefix := range relatedKeyPrefixes {
+		keys, err := config.RedisScan(prefix + "*")
+		if err != nil {
+			return result, err
+		}
+		for _, key := range keys {
+			token := strings.TrimPrefix(key, prefix)
+			related[token] = append(related[token], key)
+		}
+	}
+
+	for token, keys := range related {
+		reason, disabledAt := staleReason(token, retention, dryRun)
+		if reason == "" {
+			continue
+		}
+
+		chatCount := GetUsage("token_usage_chat:" + token)
+		agentCount := GetUsage("token_usage_agent:" + token)
+		archived := ArchivedToken{
+			Token:           token,
+			Reason:          reason,
+			ChatUsageCount:  chatCount,
+			AgentUsageCount: agentCount,
+			TotalUsageCount: chatCount + agentCount,
+			DisabledAt:      disabledAt,
+			ArchivedAt:      time.Now(),
+		}
+		result.Archived = append(result.Archived, archived)
+		result.DeletedKeys += len(keys)
+		if dryRun {
+			continue
+		}
+
+		data, err := json.Marshal(archived)
+		if err != nil {
+			return result, err
+		}
+		if err := config.RedisLPush(archiveKey, string(data)); err != nil {
+			return result, err
+		}
+		for _, key := range keys {
+			if err := config.RedisDel(key); err != nil {
+				return result, err
+			}
+		}
+		DiscardUsage(keys...)
+	}
+
+	if !dryRun && len(result.Archived) > 0 {
+		if err := config.RedisLTrim(archiveKey, 0, ArchiveLimit-1); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// ListArchivedTokens 获取最近归档的token使用数据，按时间倒序
+func ListArchivedTokens(limit int) ([]ArchivedToken, error) {
+	if limit <= 0 || limit > ArchiveLimit {
+		limit = ArchiveLimit
+	}
+
+	items, err := config.RedisLRange(archiveKey, 0, int64(limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	archived := make([]ArchivedToken, 0, len(items))
+	for _, item := range items {
+		var entry ArchivedToken
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			continue
+		}
+		archived = append(archived, entry)
+	}
+	return archived, nil
+}
@@ -0,0 +1,150 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// contributionKeyPrefix API密钥贡献的token，键中只保存密钥的指纹
+const contributionKeyPrefix = "token_contribution:"
+
+// Contribution API密钥贡献的token及其请求计数
+type Contribution struct {
+	Token        string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	OwnRequests  int       `json:"own_requests"`  // 使用自己贡献的token处理的请求数
+	PoolRequests int       `json:"pool_requests"` // 自己的token不可用时由共享池处理的请求数
+}
+
+// contributionKey API密钥贡献记录的键
+func contributionKey(apiKey string) string {
+	return contributionKeyPrefix + Fingerprint(apiKey)
+}
+
+// contributionEnabled 是否开启token贡献
+func contributionEnabled(apiKey string) bool {
+	return config.AppConfig.TokenContribution == "true" && apiKey != "" && config.RDB != nil
+}
+
+// GetContribution 获取API密钥贡献的token，没有贡献时返回nil
+func GetContribution(apiKey string) (*Contribution, error) {
+	fields, err := config.RedisHGetAll(contributionKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	if fields["token"] == "" {
+		return nil, nil
+	}
+
+	contribution := &Contribution{Token: fields["token"]}
+	contribution.CreatedAt, _ = time.Parse(time.RFC3339, fields["created_at"])
+	contribution.OwnRequests, _ = strconv.Atoi(fields["own_requests"])
+	contribution.PoolRequests, _ = strconv.Atoi(fields["pool_requests"])
+	return contribution, nil
+}
+
+// SetContribution 记录API密钥贡献的token并重置请求计数
+func SetContribution(apiKey, token string) error {
+	key := contributionKey(apiKey)
+	if err := config.RedisDel(key); err != nil {
+		return err
+	}
+	if err := config.RedisHSet(key, "token", token); err != nil {
+		return err
+	}
+	return config.RedisHSet(key, "created_at", time.Now().Format(time.RFC3339))
+}
+
+// RemoveContribution 删除API密钥的贡献记录
+func RemoveContribution(apiKey string) error {
+	return config.RedisDel(contributionKey(apiKey))
+}
+
+// IsContributed token是否由调用方贡献，贡献的token不进入共享池调度
+func IsContributed(fields map[string]string) bool {
+	return fields["contributor"] != ""
+}
+
+// GetAvailableTokenForContributor 优先使用调用方贡献的token，不可用时从共享池中分配，
+// 第四个返回值表示是否使用了调用方自己的token
+func GetAvailableTokenForContributor(apiKey, mode, shard string) (string, string, string, bool) {
+	if contributionEnabled(apiKey) {
+		if token, tenantURL, sessionID, ok := contributedToken(apiKey, mode); ok {
+			return token, tenantURL, sessionID, true
+		}
+	}
+	token, tenantURL, sessionID := GetAvailableTokenForClient(apiKey, mode, shard)
+	return token, tenantURL, sessionID, false
+}
+
+// GetTokenForContributorConversation 为AGENT对话获取token，调用方贡献的token可用时优先使用，否则按对话绑定获取，
+// 最后一个返回值表示是否使用了调用方自己的token
+func GetTokenForContributorConversation(apiKey, conversationID, shard string) (string, string, string, bool) {
+	if contributionEnabled(apiKey) {
+		if token, tenantURL, sessionID, ok := contributedToken(apiKey, "AGENT"); ok {
+			return token, tenantURL, sessionID, true
+		}
+	}
+	token, tenantURL, sessionID := GetTokenForConversation(conversationID, shard)
+	return token, tenantURL, sessionID, false
+}
+
+// contributedToken 检查调用方贡献的token当前能否处理该模式的请求，不受分片和调度提示限制
+func contributedToken(apiKey, mode string) (string, string, string, bool) {
+	contribution, err := GetContribution(apiKey)
+	if err != nil || contribution == nil {
+		return "", "", "", false
+	}
+
+	token := contribution.Token
+	key := "token:" + token
+	fields, err := config.RedisHGetAll(key)
+	if err != nil || fields["contributor"] != Fingerprint(apiKey) {
+		return "", "", "", false
+	}
+	if fields["status"] == "disabled" || fields["tenant_url"] == "" || !withinUsageLimit(token, mode) {
+		return "", "", "", false
+	}
+	requestStatus, err := GetTokenRequestStatus(token)
+	if err != nil || requestStatus.InProgress {
+		return "", "", "", false
+	}
+	coolStatus, err := GetTokenCoolStatus(token)
+	if err != nil || coolStatus.InCool {
+		return "", "", "", false
+	}
+
+	sessionID := fields["session_id"]
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+		config.RedisHSet(key, "session_id", sessionID)
+	}
+	return token, fields["tenant_url"], sessionID, true
+}
+
+// RecordContributionUsage 按是否使用了自己的token分别累计贡献者的请求数，未贡献token的调用方不记录
+func RecordContributionUsage(apiKey string, own bool) {
+	if !contributionEnabled(apiKey) {
+		return
+	}
+	key := contributionKey(apiKey)
+	if exists, err := config.RedisHExists(key, "token"); err != nil || !exists {
+		return
+	}
+
+	field := "pool_requests"
+	if own {
+		field = "own_requests"
+	}
+	if _, err := config.RedisHIncrBy(key, field, 1); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"api_key": Fingerprint(apiKey),
+			"error":   err.Error(),
+		}).Error("记录贡献者请求数失败")
+	}
+}
@@ -0,0 +1,136 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// conversationKeyPrefix AGENT对话绑定token的记录在Redis中的键前缀
+	conversationKeyPrefix = "conversation_token:"
+	// conversationTTL 对话绑定在最后一次请求后的保留时间
+	conversationTTL = 2 * time.Hour
+)
+
+// ConversationBinding AGENT对话当前绑定的token及其在该token上消耗的请求数
+type ConversationBinding struct {
+	Token         string    `json:"token"`
+	AgentRequests int       `json:"agent_requests"` // 本对话在当前token上的AGENT请求数
+	Migrations    int       `json:"migrations"`     // 迁移到其他token的次数
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ConversationAffinityEnabled 是否将AGENT对话保持在同一个token上
+func ConversationAffinityEnabled() bool {
+	return config.AppConfig.AgentConversationAffinity == "true" && config.RDB != nil
+}
+
+// agentMigrateThreshold token的AGENT使用次数达到该值时，绑定在其上的对话迁移到其他token
+func agentMigrateThreshold() int {
+	threshold, err := strconv.Atoi(config.AppConfig.AgentMigrateThreshold)
+	if err != nil || threshold <= 0 || threshold > AgentUsageLimit {
+		return AgentUsageLimit - 5
+	}
+	return threshold
+}
+
+// loadConversationBinding 读取对话绑定
+func loadConversationBinding(conversationID string) (ConversationBinding, bool) {
+	data, err := config.RedisGet(conversationKeyPrefix + conversationID)
+	if err != nil {
+		return ConversationBinding{}, false
+	}
+	var binding ConversationBinding
+	if err := json.Unmarshal([]byte(data), &binding); err != nil || binding.Token == "" {
+		return ConversationBinding{}, false
+	}
+	return binding, true
+}
+
+// saveConversationBinding 保存对话绑定并刷新过期时间
+func saveConversationBinding(conversationID string, binding ConversationBinding) {
+	binding.UpdatedAt = time.Now()
+	data, err := json.Marshal(binding)
+	if err != nil {
+		return
+	}
+	if err := config.RedisSet(conversationKeyPrefix+conversationID, string(data), conversationTTL); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"conversation": conversationID,
+			"error":        err.Error(),
+		}).Error("保存对话绑定失败")
+	}
+}
+
+// conversationTokenUsable 对话绑定的token是否仍可继续承载该对话
+// 已禁用、冷却中或AGENT使用次数接近上限时需要迁移；busy为true时还要求token当前空闲，
+// 同一对话的连续请求不受调度时的3秒间隔限制
+func conversationTokenUsable(token string, busy bool) (string, string, bool) {
+	fields, err := config.RedisHGetAll("token:" + token)
+	if err != nil || len(fields) == 0 || fields["status"] == "disabled" || fields["tenant_url"] == "" {
+		return "", "", false
+	}
+	if getTokenAgentUsageCount(token) >= agentMigrateThreshold() || getTokenChatUsageCount(token) >= ChatUsageLimit {
+		return "", "", false
+	}
+	if coolStatus, err := GetTokenCoolStatus(token); err != nil || coolStatus.InCool {
+		return "", "", false
+	}
+	if busy {
+		requestStatus, err := GetTokenRequestStatus(token)
+		if err != nil || requestStatus.InProgress {
+			return "", "", false
+		}
+	}
+	return fields["tenant_url"], fields["session_id"], true
+}
+
+// GetTokenForConversation 为AGENT对话获取token：优先使用对话绑定的token，
+// 绑定的token不可用、接近AGENT使用上限、已不属于请求的分片或所在上游分片并发已满时，按调度提示在分片中选择其他token
+func GetTokenForConversation(conversationID, shard string) (string, string, string) {
+	var exclude map[string]bool
+	if binding, ok := loadConversationBinding(conversationID); ok {
+		if tenantURL, sessionID, usable := conversationTokenUsable(binding.Token, true); usable && GetTokenHints(binding.Token).Shard == shard &&
+			!ShardSaturated(TenantHost(tenantURL)) {
+			return binding.Token, tenantURL, sessionID
+		}
+		exclude = map[string]bool{binding.Token: true}
+	}
+
+	token, tenantURL, sessionID := GetAvailableTokenForMode("AGENT", shard, exclude)
+	if token == "No available token" && exclude != nil {
+		return GetAvailableTokenForMode("AGENT", shard, nil)
+	}
+	return token, tenantURL, sessionID
+}
+
+// RecordConversationRequest 记录对话在token上的一次AGENT请求
+// 对话改用其他token时，只有原token已无法继续承载该对话才迁移绑定，原token仅是暂时繁忙时保持绑定不变
+// 迁移后使用新token的会话，检查点每次请求都会重新生成，无需额外迁移
+func RecordConversationRequest(conversationID, token string) {
+	binding, exists := loadConversationBinding(conversationID)
+	switch {
+	case !exists:
+		binding = ConversationBinding{Token: token, AgentRequests: 1}
+	case binding.Token == token:
+		binding.AgentRequests++
+	default:
+		if _, _, usable := conversationTokenUsable(binding.Token, false); usable {
+			return
+		}
+		logger.Token.WithFields(logrus.Fields{
+			"conversation":   conversationID,
+			"old_token":      binding.Token,
+			"new_token":      token,
+			"agent_requests": binding.AgentRequests,
+			"migrations":     binding.Migrations + 1,
+		}).Info("AGENT对话迁移到新的token")
+		binding = ConversationBinding{Token: token, AgentRequests: 1, Migrations: binding.Migrations + 1}
+	}
+	saveConversationBinding(conversationID, binding)
+}
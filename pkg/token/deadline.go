@@ -0,0 +1,43 @@
+package token
+
+import (
+	"augment2api/pkg/metrics"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minRetryBudget 剩余时间预算少于该值时不再切换token重试，重试请求发出后很快就会超时
+const minRetryBudget = 2 * time.Second
+
+var budgetExhausted = metrics.NewCounterVec("augment2api_request_budget_exhausted_total",
+	"Requests that ran out of their overall timeout budget, by stage.", "stage")
+
+// RequestDeadline 返回请求的总耗时截止时间，未设置时间预算时返回false
+func RequestDeadline(c *gin.Context) (time.Time, bool) {
+	value, exists := c.Get("request_deadline")
+	if !exists {
+		return time.Time{}, false
+	}
+	deadline, ok := value.(time.Time)
+	return deadline, ok
+}
+
+// RecordBudgetExhausted 记录请求在某个阶段耗尽了时间预算，stage 为 queue、lock、retry 或 upstream
+func RecordBudgetExhausted(stage string) {
+	budgetExhausted.Inc(stage)
+}
+
+// LockWithinBudget 在请求的时间预算内获取token锁，未设置预算时一直等待，超出预算返回false
+func LockWithinBudget(c *gin.Context, lock *TokenLock) bool {
+	deadline, ok := RequestDeadline(c)
+	if !ok {
+		lock.Lock()
+		return true
+	}
+	if lock.LockUntil(deadline) {
+		return true
+	}
+	RecordBudgetExhausted("lock")
+	return false
+}
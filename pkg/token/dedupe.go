@@ -0,0 +1,222 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// token之间的重复关系
+const (
+	// CollisionExact 同一个token
+	CollisionExact = "exact"
+	// CollisionWhitespace 去掉首尾空白、引号或 Bearer 前缀后相同
+	CollisionWhitespace = "whitespace"
+	// CollisionPrefix 一个token是另一个的前缀，通常是复制时被截断
+	CollisionPrefix = "prefix"
+	// CollisionNear 长度相同且只有个别字符不同，通常是手动输入错误
+	CollisionNear = "near"
+)
+
+const (
+	// minCollisionLength 短于该长度的token不判断前缀和相近关系，避免误报
+	minCollisionLength = 16
+	// maxNearDistance 判定为相近的最多不同字符数
+	maxNearDistance = 2
+)
+
+// TokenCollision 两个token之间的重复关系
+type TokenCollision struct {
+	Token             string `json:"token"`
+	TenantURL         string `json:"tenant_url,omitempty"`
+	Existing          string `json:"existing"`
+	ExistingTenantURL string `json:"existing_tenant_url,omitempty"`
+	Kind              string `json:"kind"`
+}
+
+// NormalizeToken 去掉粘贴时常带上的首尾空白、引号和 Bearer 前缀
+func NormalizeToken(token string) string {
+	token = strings.Trim(strings.TrimSpace(token), `"'`+"`")
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	}
+	return strings.TrimSpace(token)
+}
+
+// CompareTokens 判断两个token的重复关系，没有关系时返回空
+func CompareTokens(a, b string) string {
+	if a == b {
+		return CollisionExact
+	}
+	na, nb := NormalizeToken(a), NormalizeToken(b)
+	if na == nb {
+		return CollisionWhitespace
+	}
+	if min(len(na), len(nb)) < minCollisionLength {
+		return ""
+	}
+	if strings.HasPrefix(na, nb) || strings.HasPrefix(nb, na) {
+		return CollisionPrefix
+	}
+	if len(na) == len(nb) && withinDistance(na, nb, maxNearDistance) {
+		return CollisionNear
+	}
+	return ""
+}
+
+// withinDistance 两个等长字符串不同的字符数是否不超过limit
+func withinDistance(a, b string, limit int) bool {
+	diff := 0
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			diff++
+			if diff > limit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FindCollision 在已有token中查找与token重复的一个，优先返回完全相同的token
+func FindCollision(token string, existing map[string]string) (TokenCollision, bool) {
+	if tenantURL, ok := existing[token]; ok {
+		return TokenCollision{Token: token, Existing: token, ExistingTenantURL: tenantURL, Kind: CollisionExact}, true
+	}
+	for other, tenantURL := range existing {
+		if kind := CompareTokens(token, other); kind != "" {
+			return TokenCollision{Token: token, Existing: other, ExistingTenantURL: tenantURL, Kind: kind}, true
+		}
+	}
+	return TokenCollision{}, false
+}
+
+// PoolTenantURLs 返回token池中所有token及其租户地址
+func PoolTenantURLs() (map[string]string, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+	pool := make(map[string]string, len(keys))
+	for _, key := range keys {
+		tenantURL, _ := config.RedisHGet(key, "tenant_url")
+		pool[strings.TrimPrefix(key, "token:")] = tenantURL
+	}
+	return pool, nil
+}
+
+// DedupeResult 一次全池去重检查的结果
+type DedupeResult struct {
+	DryRun     bool             `json:"dry_run"`
+	Scanned    int              `json:"scanned"`
+	Collisions []TokenCollision `json:"collisions"`
+	Disabled   []string         `json:"disabled"`
+}
+
+// DedupePool 检查token池中的重复token：带空白或前缀的副本和被截断的token会被禁用，保留完整的token；
+// 只有个别字符不同的token无法判断哪个正确，只报告不处理；dryRun 为true时只报告
+func DedupePool(dryRun bool) (DedupeResult, error) {
+	result := DedupeResult{DryRun: dryRun, Collisions: []TokenCollision{}, Disabled: []string{}}
+	pool, err := PoolTenantURLs()
+	if err != nil {
+		return result, err
+	}
+	result.Scanned = len(pool)
+
+	tokens := make([]string, 0, len(pool))
+	for token := range pool {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	// 规范化后相同的token，保留本身已经规范的那个，没有时保留最短的
+	byNormalized := make(map[string][]string)
+	for _, token := range tokens {
+		normalized := NormalizeToken(token)
+		byNormalized[normalized] = append(byNormalized[normalized], token)
+	}
+	collide := func(token, existing, kind string) {
+		result.Collisions = append(result.Collisions, TokenCollision{
+			Token: token, TenantURL: pool[token], Existing: existing, ExistingTenantURL: pool[existing], Kind: kind,
+		})
+	}
+	redundant := make(map[string]string)
+	normalizedTokens := make([]string, 0, len(byNormalized))
+	for normalized, group := range byNormalized {
+		keep := group[0]
+		for _, token := range group {
+			if token == normalized {
+				keep = token
+			}
+		}
+		for _, token := range group {
+			if token != keep {
+				collide(token, keep, CollisionWhitespace)
+				redundant[token] = keep
+			}
+		}
+		normalizedTokens = append(normalizedTokens, keep)
+	}
+	sort.Slice(normalizedTokens, func(i, j int) bool {
+		return NormalizeToken(normalizedTokens[i]) < NormalizeToken(normalizedTokens[j])
+	})
+
+	// 排序后以某个token为前缀的token紧跟在它后面，被截断的是较短的那个
+	for i, token := range normalizedTokens {
+		short := NormalizeToken(token)
+		if len(short) < minCollisionLength {
+			continue
+		}
+		for _, other := range normalizedTokens[i+1:] {
+			if !strings.HasPrefix(NormalizeToken(other), short) {
+				break
+			}
+			collide(token, other, CollisionPrefix)
+			if _, ok := redundant[token]; !ok {
+				redundant[token] = other
+			}
+		}
+	}
+
+	// 相近的token只能是等长的
+	byLength := make(map[int][]string)
+	for _, token := range normalizedTokens {
+		if _, ok := redundant[token]; !ok {
+			byLength[len(NormalizeToken(token))] = append(byLength[len(NormalizeToken(token))], token)
+		}
+	}
+	for length, group := range byLength {
+		if length < minCollisionLength {
+			continue
+		}
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				if withinDistance(NormalizeToken(group[i]), NormalizeToken(group[j]), maxNearDistance) {
+					collide(group[i], group[j], CollisionNear)
+				}
+			}
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	for token, keep := range redundant {
+		if status, _ := config.RedisHGet("token:"+token, "status"); status == "disabled" {
+			continue
+		}
+		if err := DisableToken(token, "duplicate_of:"+Fingerprint(keep)); err != nil {
+			logger.Token.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Error("禁用重复token失败")
+			continue
+		}
+		result.Disabled = append(result.Disabled, token)
+	}
+	sort.Strings(result.Disabled)
+	return result, nil
+}
@@ -0,0 +1,103 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventChannel token状态变化的发布频道
+const EventChannel = "token_events"
+
+// token状态变化事件类型
+const (
+	EventAdded          = "added"
+	EventDeleted        = "deleted"
+	EventDisabled       = "disabled"
+	EventCooled         = "cooled"
+	EventUsageMilestone = "usage_milestone"
+	EventReactivated    = "reactivated" // 管理员校验后重新启用
+)
+
+// usageMilestones 使用次数达到上限的这些比例时发布事件
+var usageMilestones = []int{50, 80, 100}
+
+// TokenEvent token状态变化事件
+type TokenEvent struct {
+	Type      string                 `json:"type"`
+	Token     string                 `json:"token"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// PublishTokenEvent 发布token状态变化事件，发布失败只记录日志
+func PublishTokenEvent(eventType, token string, data map[string]interface{}) {
+	if config.RDB == nil {
+		return
+	}
+	countPoolEvent(eventType, token, data)
+	// 删除的token不再需要时间线，其记录会随关联数据一起清理
+	if eventType != EventDeleted {
+		if err := RecordTokenEvent(token, eventType, data); err != nil {
+			logger.Token.WithFields(logrus.Fields{
+				"type":  eventType,
+				"token": token,
+				"error": err.Error(),
+			}).Error("记录token状态变化失败")
+		}
+	}
+
+	event, err := json.Marshal(TokenEvent{
+		Type:      eventType,
+		Token:     token,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	if err := config.RedisPublish(EventChannel, string(event)); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"type":  eventType,
+			"token": token,
+			"error": err.Error(),
+		}).Error("发布token事件失败")
+	}
+}
+
+// DisableToken 将token标记为不可用并发布事件
+func DisableToken(token, reason string) error {
+	if err := config.RedisHSet("token:"+token, "status", "disabled"); err != nil {
+		return err
+	}
+	// 记录禁用时间，长期禁用的token关联数据会被定期归档清理
+	if err := config.RedisHSet("token:"+token, "disabled_at", time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	PublishTokenEvent(EventDisabled, token, map[string]interface{}{"reason": reason})
+	return nil
+}
+
+// NotifyUsage 使用次数恰好达到上限的里程碑比例时发布事件，mode 为 chat 或 agent
+func NotifyUsage(token, mode string, count int64) {
+	limit := ChatUsageLimit
+	if mode == "agent" {
+		limit = AgentUsageLimit
+	}
+
+	for _, percent := range usageMilestones {
+		if count == int64(limit*percent/100) {
+			PublishTokenEvent(EventUsageMilestone, token, map[string]interface{}{
+				"mode":    mode,
+				"count":   count,
+				"limit":   limit,
+				"percent": percent,
+			})
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failureCooldowns 连续生成失败时依次使用的冷却时长，超出后禁用token
+var failureCooldowns = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+}
+
+// failureCountTTL 失败计数的保留时间，长时间没有失败视为恢复
+const failureCountTTL = 24 * time.Hour
+
+// RecordGenerationFailure 记录一次生成失败并按连续失败次数递增冷却，
+// 返回本次冷却时长；连续失败超过冷却档位后token会被禁用，此时 disabled 为 true
+func RecordGenerationFailure(token string) (cooldown time.Duration, disabled bool, err error) {
+	key := "token_failures:" + token
+
+	count, err := config.RedisIncrValue(key)
+	if err != nil {
+		return 0, false, err
+	}
+	config.RedisExpire(key, failureCountTTL)
+
+	if int(count) > len(failureCooldowns) {
+		if err := DisableToken(token, "consecutive_failures"); err != nil {
+			return 0, false, err
+		}
+		config.RedisDel(key)
+
+		logger.Token.WithFields(logrus.Fields{
+			"token":    Fingerprint(token),
+			"failures": count,
+		}).Warn("token连续生成失败，已被禁用")
+		return 0, true, nil
+	}
+
+	cooldown = failureCooldowns[count-1]
+	if err := SetTokenCoolStatus(token, cooldown); err != nil {
+		return 0, false, err
+	}
+
+	logger.Token.WithFields(logrus.Fields{
+		"token":    Fingerprint(token),
+		"failures": count,
+		"cooldown": cooldown.String(),
+	}).Info("token生成失败，已加入冷却")
+	return cooldown, false, nil
+}
+
+// ResetGenerationFailures 生成成功后清零连续失败计数
+func ResetGenerationFailures(token string) error {
+	return config.RedisDel("token_failures:" + token)
+}
+
+// invalidCountTTL 首次 Invalid token 记录的保留时间，超过后重新计数
+const invalidCountTTL = 24 * time.Hour
+
+// RecordInvalidToken 记录一次上游返回的 Invalid token，连续第二次时禁用token并返回true，
+// 第一次只让token冷却到确认探测之后，避免上游鉴权短暂异常误删可用token
+func RecordInvalidToken(token string, confirmDelay time.Duration) (bool, error) {
+	key := "token_invalid:" + token
+
+	count, err := config.RedisIncrValue(key)
+	if err != nil {
+		return false, err
+	}
+	config.RedisExpire(key, invalidCountTTL)
+
+	if count >= 2 {
+		if err := DisableToken(token, "invalid_token"); err != nil {
+			return false, err
+		}
+		config.RedisDel(key)
+		return true, nil
+	}
+	return false, SetTokenCoolStatus(token, confirmDelay)
+}
+
+// ClearInvalidToken 校验通过后清除 Invalid token 记录
+func ClearInvalidToken(token string) error {
+	return config.RedisDel("token_invalid:" + token)
+}
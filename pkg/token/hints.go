@@ -0,0 +1,152 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rankDisallowed token不允许处理该模式的请求
+	rankDisallowed = -1
+	// rankPreferred token专用于该模式，优先调度
+	rankPreferred = 0
+	// rankNormal 未限制模式的token
+	rankNormal = 1
+	// rankRestricted 请求模式未知时，限制了模式的token放在最后，避免占用预留的账号
+	rankRestricted = 2
+	// lowPriorityOffset priority=low 的token排在所有普通优先级token之后
+	lowPriorityOffset = 3
+	// rankCooldown 冷却中的token，只在没有其他token时使用
+	rankCooldown = 100
+)
+
+// hintsInUse 最近一次调度时池中是否有token设置了调度提示，没有时跳过按模式换token
+var hintsInUse atomic.Bool
+
+// TokenHints token备注中的调度提示，格式为 key=value，可与其他备注内容混写
+// 例如 "供应商A priority=low chat_only=true shard=team-a"
+type TokenHints struct {
+	LowPriority bool   `json:"low_priority,omitempty"` // priority=low
+	AgentOnly   bool   `json:"agent_only,omitempty"`   // agent_only=true
+	ChatOnly    bool   `json:"chat_only,omitempty"`    // chat_only=true
+	Shard       string `json:"shard,omitempty"`        // shard=<分片> 或 region=<分片>，只处理路由到该分片的请求
+}
+
+// ParseTokenHints 从备注中解析调度提示，无法识别的内容忽略
+// 同时设置 agent_only 和 chat_only 视为未限制模式
+func ParseTokenHints(remark string) TokenHints {
+	var hints TokenHints
+	fields := strings.FieldsFunc(remark, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == ',' || r == ';' || r == '，' || r == '；'
+	})
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch key {
+		case "priority":
+			hints.LowPriority = value == "low"
+		case "agent_only":
+			hints.AgentOnly = value == "true"
+		case "chat_only":
+			hints.ChatOnly = value == "true"
+		case "shard", "region":
+			hints.Shard = value
+		}
+	}
+	if hints.AgentOnly && hints.ChatOnly {
+		hints.AgentOnly, hints.ChatOnly = false, false
+	}
+	return hints
+}
+
+// GetTokenHints 读取token备注中的调度提示
+func GetTokenHints(token string) TokenHints {
+	remark, err := config.RedisHGet("token:"+token, "remark")
+	if err != nil {
+		return TokenHints{}
+	}
+	return ParseTokenHints(remark)
+}
+
+// rank 按调度提示计算token处理指定模式请求的排序，越小越优先，mode为空表示模式未知
+func (h TokenHints) rank(mode string) int {
+	rank := rankNormal
+	switch {
+	case mode == "" && (h.AgentOnly || h.ChatOnly):
+		rank = rankRestricted
+	case h.AgentOnly:
+		if mode != "AGENT" {
+			return rankDisallowed
+		}
+		rank = rankPreferred
+	case h.ChatOnly:
+		if mode != "CHAT" {
+			return rankDisallowed
+		}
+		rank = rankPreferred
+	}
+	if h.LowPriority {
+		rank += lowPriorityOffset
+	}
+	return rank
+}
+
+// lowFirst 将排序调整为 priority=low 的token在前
+func (h TokenHints) lowFirst(rank int) int {
+	if h.LowPriority {
+		return rank - lowPriorityOffset
+	}
+	return rank + lowPriorityOffset
+}
+
+// NormalizeShard 统一分片名称的格式，与备注中解析出的分片一致
+func NormalizeShard(shard string) string {
+	return strings.ToLower(strings.TrimSpace(shard))
+}
+
+// GetAvailableTokenForMode 按请求模式在指定分片中获取可用token，遵守token备注中的调度提示
+// shard为空时只使用未划分分片的token
+func GetAvailableTokenForMode(mode, shard string, exclude map[string]bool) (string, string, string) {
+	token, tenantURL, sessionID, _ := selectAvailableToken(exclude, mode, shard, false)
+	return token, tenantURL, sessionID
+}
+
+// EnsureTokenForMode 请求模式确定后，按调度提示检查当前token是否合适，有更合适的空闲token时更换
+// 当前token不允许处理该模式且没有其他空闲token时返回false
+func EnsureTokenForMode(c *gin.Context, mode string) bool {
+	// 绑定对话的token在调度时已按AGENT模式选择，不再更换
+	if config.AppConfig.CodingMode == "true" || c.GetBool("token_pinned") || c.GetString("conversation_id") != "" || !hintsInUse.Load() {
+		return true
+	}
+
+	currentToken := c.GetString("token")
+	rank := GetTokenHints(currentToken).rank(mode)
+	if rank == rankPreferred {
+		return true
+	}
+
+	nextToken, nextTenantURL, nextSessionID, nextRank := selectAvailableToken(map[string]bool{currentToken: true}, mode, c.GetString("token_shard"), false)
+	if nextTenantURL == "" || nextRank == rankCooldown || (rank != rankDisallowed && nextRank >= rank) {
+		return rank != rankDisallowed
+	}
+
+	if !reassignToken(c, currentToken, nextToken, nextTenantURL, nextSessionID) {
+		return rank != rankDisallowed
+	}
+
+	logger.Token.WithFields(logrus.Fields{
+		"old_token": currentToken,
+		"new_token": nextToken,
+		"mode":      mode,
+	}).Info("按调度提示更换token")
+	return true
+}
@@ -0,0 +1,105 @@
+package token
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"time"
+)
+
+// HistoryLimit 每个token保留的请求记录条数
+const HistoryLimit = 50
+
+// TokenRequestRecord token单次请求摘要
+type TokenRequestRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Model      string    `json:"model"`
+	Mode       string    `json:"mode"`
+	DurationMs int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	// ResponseChars 回复文本的字符数，以工具调用结束或未完成的请求不记录
+	ResponseChars *int `json:"response_chars,omitempty"`
+}
+
+// RecordTokenRequest 记录一次请求摘要，只保留最近 HistoryLimit 条
+func RecordTokenRequest(token string, record TokenRequestRecord) error {
+	key := "token_history:" + token
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := config.RedisLPush(key, string(recordJSON)); err != nil {
+		return err
+	}
+	return config.RedisLTrim(key, 0, HistoryLimit-1)
+}
+
+// GetTokenHistory 获取token最近的请求记录，按时间倒序
+func GetTokenHistory(token string) ([]TokenRequestRecord, error) {
+	items, err := config.RedisLRange("token_history:"+token, 0, HistoryLimit-1)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]TokenRequestRecord, 0, len(items))
+	for _, item := range items {
+		var record TokenRequestRecord
+		if err := json.Unmarshal([]byte(item), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// EventLogLimit 每个token保留的状态变化记录条数
+const EventLogLimit = 200
+
+// EventChecked token检测事件，只记录到token的状态变化记录中，不发布
+const EventChecked = "checked"
+
+// TokenEventRecord token的一次状态变化，包括冷却、禁用和检测等
+type TokenEventRecord struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Type      string                 `json:"type"`
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+}
+
+// RecordTokenEvent 记录token的一次状态变化，只保留最近 EventLogLimit 条
+func RecordTokenEvent(token, eventType string, detail map[string]interface{}) error {
+	key := "token_event_log:" + token
+
+	recordJSON, err := json.Marshal(TokenEventRecord{
+		Timestamp: time.Now(),
+		Type:      eventType,
+		Detail:    detail,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := config.RedisLPush(key, string(recordJSON)); err != nil {
+		return err
+	}
+	return config.RedisLTrim(key, 0, EventLogLimit-1)
+}
+
+// GetTokenEvents 获取token最近的状态变化记录，按时间倒序
+func GetTokenEvents(token string) ([]TokenEventRecord, error) {
+	items, err := config.RedisLRange("token_event_log:"+token, 0, EventLogLimit-1)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]TokenEventRecord, 0, len(items))
+	for _, item := range items {
+		var record TokenEventRecord
+		if err := json.Unmarshal([]byte(item), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
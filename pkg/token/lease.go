@@ -0,0 +1,81 @@
+package token
+
+import (
+	"time"
+)
+
+// TokenLease 不依赖请求上下文占用的token，用于并发扇出等后台请求
+type TokenLease struct {
+	Token     string
+	TenantURL string
+	SessionID string
+
+	lock *TokenLock
+}
+
+// AcquireToken 按请求模式在指定分片中获取并锁定一个可用token（排除指定集合），锁已被占用的token会被跳过
+func AcquireToken(mode, shard string, exclude map[string]bool) (*TokenLease, bool) {
+	return acquireToken(mode, shard, exclude, false, false)
+}
+
+// AcquireLowPriorityToken 与 AcquireToken 相同，但优先使用 priority=low 的token，用于标题生成等辅助请求
+func AcquireLowPriorityToken(mode, shard string, exclude map[string]bool) (*TokenLease, bool) {
+	return acquireToken(mode, shard, exclude, true, false)
+}
+
+// AcquireSpareToken 与 AcquireToken 相同，但不使用冷却中或所在分片过载的token，
+// 用于n>1的额外候选等可有可无的请求，避免加重受限token和分片的负担
+func AcquireSpareToken(mode, shard string, exclude map[string]bool) (*TokenLease, bool) {
+	return acquireToken(mode, shard, exclude, false, true)
+}
+
+// acquireToken 获取并锁定一个可用token，skipCooldown为true时只剩冷却中的token时不获取
+func acquireToken(mode, shard string, exclude map[string]bool, preferLow, skipCooldown bool) (*TokenLease, bool) {
+	tried := make(map[string]bool, len(exclude))
+	for token := range exclude {
+		tried[token] = true
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		token, tenantURL, sessionID, rank := selectAvailableToken(tried, mode, shard, preferLow)
+		if token == "No token" || token == "No available token" || tenantURL == "" {
+			return nil, false
+		}
+		if skipCooldown && rank == rankCooldown {
+			return nil, false
+		}
+
+		lock := GetTokenLock(token)
+		if !lock.TryLock() {
+			tried[token] = true
+			continue
+		}
+
+		err := SetTokenRequestStatus(token, TokenRequestStatus{
+			InProgress:    true,
+			LastRequestAt: time.Now(),
+		})
+		if err != nil {
+			lock.Unlock()
+			return nil, false
+		}
+
+		return &TokenLease{
+			Token:     token,
+			TenantURL: tenantURL,
+			SessionID: sessionID,
+			lock:      lock,
+		}, true
+	}
+
+	return nil, false
+}
+
+// Release 更新请求状态并释放token锁
+func (l *TokenLease) Release() {
+	SetTokenRequestStatus(l.Token, TokenRequestStatus{
+		InProgress:    false,
+		LastRequestAt: time.Now(),
+	})
+	l.lock.Unlock()
+}
@@ -0,0 +1,138 @@
+package token
+
+import (
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenLockIdleTTL 锁空闲超过该时间后回收，需长于单个请求的最长处理时间
+	tokenLockIdleTTL = 30 * time.Minute
+	// tokenLockSweepInterval 回收空闲锁的间隔
+	tokenLockSweepInterval = 5 * time.Minute
+	// tokenLockPollInterval 限时获取锁时重试的间隔
+	tokenLockPollInterval = 20 * time.Millisecond
+)
+
+// 全局锁映射，用于控制每个 token 的并发请求
+var (
+	tokenLocks      = make(map[string]*TokenLock)
+	tokenLocksGuard = sync.Mutex{}
+
+	_ = metrics.NewGaugeFunc("augment2api_token_locks",
+		"Per-token request locks currently held in memory.", func() float64 {
+			tokenLocksGuard.Lock()
+			defer tokenLocksGuard.Unlock()
+			return float64(len(tokenLocks))
+		})
+)
+
+// TokenLock 单个token的请求锁，记录持有和等待该锁的请求数，空闲的锁会被定期回收
+type TokenLock struct {
+	mu       sync.Mutex
+	users    atomic.Int32 // 持有或正在等待该锁的请求数
+	lastUsed atomic.Int64 // 最近一次获取或释放该锁的时间（UnixNano）
+}
+
+// Lock 获取锁，锁被占用时阻塞等待
+func (l *TokenLock) Lock() {
+	l.users.Add(1)
+	l.mu.Lock()
+}
+
+// TryLock 尝试获取锁，锁被占用时立即返回false
+func (l *TokenLock) TryLock() bool {
+	l.users.Add(1)
+	if l.mu.TryLock() {
+		return true
+	}
+	l.users.Add(-1)
+	return false
+}
+
+// LockUntil 在截止时间前获取锁，到期仍未获取到时返回false
+func (l *TokenLock) LockUntil(deadline time.Time) bool {
+	for !l.TryLock() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		time.Sleep(min(remaining, tokenLockPollInterval))
+	}
+	return true
+}
+
+// Unlock 释放锁
+func (l *TokenLock) Unlock() {
+	l.lastUsed.Store(time.Now().UnixNano())
+	l.mu.Unlock()
+	l.users.Add(-1)
+}
+
+// idle 锁没有请求持有或等待，且超过指定时间未被获取
+func (l *TokenLock) idle(now time.Time, ttl time.Duration) bool {
+	return l.users.Load() == 0 && now.Sub(time.Unix(0, l.lastUsed.Load())) > ttl
+}
+
+// GetTokenLock 获取指定 token 的锁
+// 获取锁时刷新使用时间，拿到锁到加锁之间的短暂间隔内锁不会被回收
+func GetTokenLock(token string) *TokenLock {
+	tokenLocksGuard.Lock()
+	defer tokenLocksGuard.Unlock()
+
+	if lock, exists := tokenLocks[token]; exists {
+		lock.lastUsed.Store(time.Now().UnixNano())
+		return lock
+	}
+
+	lock := &TokenLock{}
+	lock.lastUsed.Store(time.Now().UnixNano())
+	tokenLocks[token] = lock
+	return lock
+}
+
+// RemoveTokenLock token被删除时移除其锁，仍有请求持有或等待时保留，由定期回收处理
+func RemoveTokenLock(token string) {
+	tokenLocksGuard.Lock()
+	defer tokenLocksGuard.Unlock()
+
+	if lock, exists := tokenLocks[token]; exists && lock.users.Load() == 0 {
+		delete(tokenLocks, token)
+	}
+}
+
+// evictIdleTokenLocks 回收空闲超过指定时间的锁，返回回收的数量
+func evictIdleTokenLocks(ttl time.Duration) int {
+	tokenLocksGuard.Lock()
+	defer tokenLocksGuard.Unlock()
+
+	now := time.Now()
+	evicted := 0
+	for token, lock := range tokenLocks {
+		if lock.idle(now, ttl) {
+			delete(tokenLocks, token)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// StartTokenLockEviction 定期回收长时间未使用的token锁，避免已删除或长期不用的token的锁一直占用内存
+func StartTokenLockEviction() {
+	go func() {
+		ticker := time.NewTicker(tokenLockSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if evicted := evictIdleTokenLocks(tokenLockIdleTTL); evicted > 0 {
+				logger.Token.WithFields(logrus.Fields{
+					"evicted": evicted,
+				}).Debug("已回收空闲的token锁")
+			}
+		}
+	}()
+}
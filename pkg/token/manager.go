@@ -5,8 +5,6 @@ import (
 	"augment2api/pkg/logger"
 	"encoding/json"
 	"math/rand"
-	"strconv"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,10 +12,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// 全局锁映射，用于控制每个 token 的并发请求
-var (
-	tokenLocks      = make(map[string]*sync.Mutex)
-	tokenLocksGuard = sync.Mutex{}
+const (
+	// ChatUsageLimit 单个token的CHAT模式使用次数上限
+	ChatUsageLimit = 3000
+	// AgentUsageLimit 单个token的AGENT模式使用次数上限
+	AgentUsageLimit = 50
 )
 
 // TokenRequestStatus 记录 token 请求状态
@@ -32,22 +31,13 @@ type TokenCoolStatus struct {
 	CoolEnd time.Time `json:"cool_end"`
 }
 
-// GetTokenLock 获取指定 token 的锁
-func GetTokenLock(token string) *sync.Mutex {
-	tokenLocksGuard.Lock()
-	defer tokenLocksGuard.Unlock()
-
-	if lock, exists := tokenLocks[token]; exists {
-		return lock
-	}
-
-	lock := &sync.Mutex{}
-	tokenLocks[token] = lock
-	return lock
-}
-
 // SetTokenRequestStatus 设置token请求状态
 func SetTokenRequestStatus(token string, status TokenRequestStatus) error {
+	// Redis降级期间只记录在本实例，恢复后写入
+	if trackRequestStatus(token, status) {
+		return nil
+	}
+
 	// 使用Redis存储token请求状态
 	key := "token_status:" + token
 
@@ -101,7 +91,14 @@ func SetTokenCoolStatus(token string, duration time.Duration) error {
 	}
 
 	// 存储到Redis，设置过期时间与冷却时间相同
-	return config.RedisSet(key, string(coolStatusJSON), duration)
+	if err := config.RedisSet(key, string(coolStatusJSON), duration); err != nil {
+		return err
+	}
+
+	PublishTokenEvent(EventCooled, token, map[string]interface{}{
+		"cool_end": coolStatus.CoolEnd,
+	})
+	return nil
 }
 
 // GetTokenCoolStatus 获取token冷却状态
@@ -134,47 +131,60 @@ func GetTokenCoolStatus(token string) (TokenCoolStatus, error) {
 
 // getTokenChatUsageCount 获取token的CHAT模式使用次数
 func getTokenChatUsageCount(token string) int {
-	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_chat:" + token
-	count, err := config.RedisGet(countKey)
-	if err != nil {
-		return 0 // 如果出错或不存在，返回0
-	}
-
-	countInt, _ := strconv.Atoi(count)
-
-	return countInt
+	return GetUsage("token_usage_chat:" + token)
 }
 
 // getTokenAgentUsageCount 获取token的AGENT模式使用次数
 func getTokenAgentUsageCount(token string) int {
-	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_agent:" + token
-	count, err := config.RedisGet(countKey)
-	if err != nil {
-		return 0 // 如果出错或不存在，返回0
-	}
+	return GetUsage("token_usage_agent:" + token)
+}
 
-	countInt, _ := strconv.Atoi(count)
+// GetAvailableToken 按请求模式获取一个可用的token（未在使用中且冷却时间已过），同时返回token、tenant_url和session_id
+// 只检查该模式的使用次数，AGENT次数用完的token仍可处理CHAT请求，反之亦然
+func GetAvailableToken(mode, shard string) (string, string, string) {
+	return GetAvailableTokenForMode(mode, shard, nil)
+}
+
+// GetNextAvailableToken 按请求模式获取下一个可用的token（排除指定token），用于重试机制
+func GetNextAvailableToken(mode, shard, excludeToken string) (string, string, string) {
+	return GetAvailableTokenForMode(mode, shard, map[string]bool{excludeToken: true})
+}
 
-	return countInt
+// GetAvailableTokenExcluding 获取一个可用的token（排除指定的token集合），同时返回token、tenant_url和session_id
+func GetAvailableTokenExcluding(exclude map[string]bool) (string, string, string) {
+	token, tenantURL, sessionID, _ := selectAvailableToken(exclude, "", "", false)
+	return token, tenantURL, sessionID
 }
 
-// GetAvailableToken 获取一个可用的token（未在使用中且冷却时间已过），同时返回token、tenant_url和session_id
-func GetAvailableToken() (string, string, string) {
-	// 获取所有token的key
+// selectAvailableToken 按请求模式和调度提示选择token，mode为空表示模式未知，同时返回所选token的调度排序
+// 只在请求所属的分片中选择，shard为空时只使用未划分分片的token
+// preferLow 为true时优先选择 priority=low 的token，用于不重要的辅助请求
+func selectAvailableToken(exclude map[string]bool, mode, shard string, preferLow bool) (string, string, string, int) {
+	// Redis降级期间从内存缓存选择token
+	if config.RedisDegraded() {
+		return selectCachedToken(exclude, mode, shard, preferLow)
+	}
+
+	// 获取所有token的key，读取失败时同样使用缓存
 	keys, err := config.RedisKeys("token:*")
+	if err != nil && tokenCache.Load() != nil {
+		return selectCachedToken(exclude, mode, shard, preferLow)
+	}
 	if err != nil || len(keys) == 0 {
-		return "No token", "", ""
+		return "No token", "", "", rankCooldown
 	}
 
-	// 筛选可用的token
+	// 筛选可用的token（排除指定的token集合）
 	var availableTokens []string
 	var availableTenantURLs []string
 	var availableSessionIDs []string
+	var availableRanks []int
 	var cooldownTokens []string
 	var cooldownTenantURLs []string
 	var cooldownSessionIDs []string
+	sawHints := false
+	// 过载退避中的上游分片上的token与冷却中的token同等对待，只在没有其他token时使用
+	overloaded := OverloadedShards()
 
 	for _, key := range keys {
 		// 获取token状态
@@ -186,116 +196,31 @@ func GetAvailableToken() (string, string, string) {
 		// 从key中提取token
 		token := key[6:] // 去掉前缀 "token:"
 
-		// 获取token的请求状态
-		requestStatus, err := GetTokenRequestStatus(token)
-		if err != nil {
-			continue
-		}
-
-		// 如果token正在使用中，跳过
-		if requestStatus.InProgress {
-			continue
-		}
-
-		// 如果距离上次请求不足3秒，跳过
-		if time.Since(requestStatus.LastRequestAt) < 3*time.Second {
+		// 排除指定的token
+		if exclude[token] {
 			continue
 		}
 
-		// 检查CHAT模式和AGENT模式的使用次数限制
-		chatUsageCount := getTokenChatUsageCount(token)
-		agentUsageCount := getTokenAgentUsageCount(token)
-
-		// 如果CHAT模式已达到3000次限制，跳过
-		if chatUsageCount >= 3000 {
+		// 调用方贡献的token只供其本人使用，不进入共享池
+		if contributor, _ := config.RedisHGet(key, "contributor"); contributor != "" {
 			continue
 		}
 
-		// 如果AGENT模式已达到50次限制，跳过
-		if agentUsageCount >= 50 {
-			continue
+		// 按备注中的调度提示排序，不允许处理该模式的token跳过
+		remark, _ := config.RedisHGet(key, "remark")
+		hints := ParseTokenHints(remark)
+		if hints != (TokenHints{}) {
+			sawHints = true
 		}
-
-		// 获取对应的tenant_url
-		tenantURL, err := config.RedisHGet(key, "tenant_url")
-		if err != nil {
+		if hints.Shard != shard {
 			continue
 		}
-
-		// 获取对应的session_id
-		sessionID, err := config.RedisHGet(key, "session_id")
-		if err != nil {
-			// 如果没有session_id，生成一个新的
-			sessionID = uuid.New().String()
-			config.RedisHSet(key, "session_id", sessionID)
-		}
-
-		// 检查token是否在冷却中
-		coolStatus, err := GetTokenCoolStatus(token)
-		if err != nil {
+		rank := hints.rank(mode)
+		if rank == rankDisallowed {
 			continue
 		}
-
-		// 如果token在冷却中，放入冷却队列
-		if coolStatus.InCool {
-			cooldownTokens = append(cooldownTokens, token)
-			cooldownTenantURLs = append(cooldownTenantURLs, tenantURL)
-			cooldownSessionIDs = append(cooldownSessionIDs, sessionID)
-		} else {
-			// 否则放入可用队列
-			availableTokens = append(availableTokens, token)
-			availableTenantURLs = append(availableTenantURLs, tenantURL)
-			availableSessionIDs = append(availableSessionIDs, sessionID)
-		}
-	}
-
-	// 优先从可用队列中选择token
-	if len(availableTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(availableTokens))
-		return availableTokens[randomIndex], availableTenantURLs[randomIndex], availableSessionIDs[randomIndex]
-	}
-
-	// 如果没有非冷却token可用，则从冷却队列中选择
-	if len(cooldownTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(cooldownTokens))
-		return cooldownTokens[randomIndex], cooldownTenantURLs[randomIndex], cooldownSessionIDs[randomIndex]
-	}
-
-	// 如果没有任何可用的token
-	return "No available token", "", ""
-}
-
-// GetNextAvailableToken 获取下一个可用的token（排除指定token），用于重试机制
-func GetNextAvailableToken(excludeToken string) (string, string, string) {
-	// 获取所有token的key
-	keys, err := config.RedisKeys("token:*")
-	if err != nil || len(keys) == 0 {
-		return "No token", "", ""
-	}
-
-	// 筛选可用的token（排除指定的token）
-	var availableTokens []string
-	var availableTenantURLs []string
-	var availableSessionIDs []string
-	var cooldownTokens []string
-	var cooldownTenantURLs []string
-	var cooldownSessionIDs []string
-
-	for _, key := range keys {
-		// 获取token状态
-		status, err := config.RedisHGet(key, "status")
-		if err == nil && status == "disabled" {
-			continue // 跳过被标记为不可用的token
-		}
-
-		// 从key中提取token
-		token := key[6:] // 去掉前缀 "token:"
-
-		// 排除指定的token
-		if token == excludeToken {
-			continue
+		if preferLow {
+			rank = hints.lowFirst(rank)
 		}
 
 		// 获取token的请求状态
@@ -314,17 +239,8 @@ func GetNextAvailableToken(excludeToken string) (string, string, string) {
 			continue
 		}
 
-		// 检查CHAT模式和AGENT模式的使用次数限制
-		chatUsageCount := getTokenChatUsageCount(token)
-		agentUsageCount := getTokenAgentUsageCount(token)
-
-		// 如果CHAT模式已达到3000次限制，跳过
-		if chatUsageCount >= 3000 {
-			continue
-		}
-
-		// 如果AGENT模式已达到50次限制，跳过
-		if agentUsageCount >= 50 {
+		// 检查CHAT模式和AGENT模式的使用次数限制，模式已知时只检查该模式
+		if !withinUsageLimit(token, mode) {
 			continue
 		}
 
@@ -334,6 +250,11 @@ func GetNextAvailableToken(excludeToken string) (string, string, string) {
 			continue
 		}
 
+		// 所在分片进行中的请求已达到并发上限，暂不分配，避免突发流量触发整个分片限流
+		if ShardSaturated(TenantHost(tenantURL)) {
+			continue
+		}
+
 		// 获取对应的session_id
 		sessionID, err := config.RedisHGet(key, "session_id")
 		if err != nil {
@@ -348,8 +269,8 @@ func GetNextAvailableToken(excludeToken string) (string, string, string) {
 			continue
 		}
 
-		// 如果token在冷却中，放入冷却队列
-		if coolStatus.InCool {
+		// 如果token在冷却中或所在分片过载，放入冷却队列
+		if coolStatus.InCool || overloaded[TenantHost(tenantURL)] > 0 {
 			cooldownTokens = append(cooldownTokens, token)
 			cooldownTenantURLs = append(cooldownTenantURLs, tenantURL)
 			cooldownSessionIDs = append(cooldownSessionIDs, sessionID)
@@ -358,28 +279,67 @@ func GetNextAvailableToken(excludeToken string) (string, string, string) {
 			availableTokens = append(availableTokens, token)
 			availableTenantURLs = append(availableTenantURLs, tenantURL)
 			availableSessionIDs = append(availableSessionIDs, sessionID)
+			availableRanks = append(availableRanks, rank)
 		}
 	}
+	hintsInUse.Store(sawHints)
 
 	// 优先从可用队列中选择token
 	if len(availableTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(availableTokens))
-		return availableTokens[randomIndex], availableTenantURLs[randomIndex], availableSessionIDs[randomIndex]
+		// 只在调度排序最靠前的token中选择
+		bestRank := rankCooldown
+		var bestIndexes []int
+		for i, rank := range availableRanks {
+			if rank < bestRank {
+				bestRank = rank
+				bestIndexes = bestIndexes[:0]
+			}
+			if rank == bestRank {
+				bestIndexes = append(bestIndexes, i)
+			}
+		}
+		bestTokens := make([]string, len(bestIndexes))
+		for i, index := range bestIndexes {
+			bestTokens[i] = availableTokens[index]
+		}
+
+		// 开启评分调度时优先选择高分级token，否则随机选择一个token
+		var randomIndex int
+		if ScoringEnabled() {
+			randomIndex = pickByScore(bestTokens)
+		} else {
+			randomIndex = rand.Intn(len(bestTokens))
+		}
+		index := bestIndexes[randomIndex]
+		return availableTokens[index], availableTenantURLs[index], availableSessionIDs[index], bestRank
 	}
 
 	// 如果没有非冷却token可用，则从冷却队列中选择
 	if len(cooldownTokens) > 0 {
 		// 随机选择一个token
 		randomIndex := rand.Intn(len(cooldownTokens))
-		return cooldownTokens[randomIndex], cooldownTenantURLs[randomIndex], cooldownSessionIDs[randomIndex]
+		return cooldownTokens[randomIndex], cooldownTenantURLs[randomIndex], cooldownSessionIDs[randomIndex], rankCooldown
 	}
 
 	// 如果没有任何可用的token
-	return "No available token", "", ""
+	return "No available token", "", "", rankCooldown
 }
 
-// SwitchTokenAndRetry 当遇到429错误时切换Token并重试
+// withinUsageLimit token在该模式下的使用次数是否未达上限，mode为空时要求两种模式都未达上限
+func withinUsageLimit(token, mode string) bool {
+	if mode != "AGENT" && getTokenChatUsageCount(token) >= ChatUsageLimit {
+		return false
+	}
+	if mode != "CHAT" && getTokenAgentUsageCount(token) >= AgentUsageLimit {
+		return false
+	}
+	return true
+}
+
+// GenerationFailureRecordedKey Context中已计入生成失败的token，切换重试时设置
+const GenerationFailureRecordedKey = "generation_failure_recorded"
+
+// SwitchTokenAndRetry 当遇到429等可重试错误时切换Token并重试，失败的Token按连续失败次数冷却
 func SwitchTokenAndRetry(c *gin.Context, maxRetries int) bool {
 	// 获取当前Token
 	currentTokenInterface, exists := c.Get("token")
@@ -400,39 +360,82 @@ func SwitchTokenAndRetry(c *gin.Context, maxRetries int) bool {
 
 	// 检查是否超过最大重试次数
 	if retryCount >= maxRetries {
-		logger.Log.WithFields(logrus.Fields{
+		logger.Token.WithFields(logrus.Fields{
 			"current_token": currentToken,
 			"retry_count":   retryCount,
 		}).Warn("已达到最大重试次数，停止重试")
 		return false
 	}
 
-	// 将当前Token加入短期冷却（5分钟）
-	err := SetTokenCoolStatus(currentToken, 5*time.Minute)
-	if err != nil {
-		logger.Log.WithFields(logrus.Fields{
-			"token": currentToken,
-			"error": err.Error(),
-		}).Error("设置Token冷却状态失败")
-	} else {
-		logger.Log.WithFields(logrus.Fields{
-			"token": currentToken,
-		}).Info("Token因429错误被加入5分钟冷却")
+	// 按连续失败次数将当前Token加入递增冷却，上游分片过载时已对整个分片退避，不冷却token
+	if !c.GetBool("upstream_overloaded") {
+		if _, _, err := RecordGenerationFailure(currentToken); err != nil {
+			logger.Token.WithFields(logrus.Fields{
+				"token": currentToken,
+				"error": err.Error(),
+			}).Error("设置Token冷却状态失败")
+		}
+		// 请求结束时不再重复计入该token的失败
+		c.Set(GenerationFailureRecordedKey, currentToken)
+	}
+
+	// 请求指定了token时不切换
+	if c.GetBool("token_pinned") {
+		return false
+	}
+
+	// 剩余时间预算不足以完成一次重试时不再切换
+	if deadline, ok := RequestDeadline(c); ok && time.Until(deadline) < minRetryBudget {
+		RecordBudgetExhausted("retry")
+		logger.Token.WithFields(logrus.Fields{
+			"current_token": currentToken,
+			"retry_count":   retryCount,
+		}).Warn("请求剩余时间预算不足，停止重试")
+		return false
 	}
 
 	// 获取下一个可用Token
-	nextToken, nextTenantURL, nextSessionID := GetNextAvailableToken(currentToken)
+	nextToken, nextTenantURL, nextSessionID := GetAvailableTokenForMode(c.GetString("augment_mode"), c.GetString("token_shard"), map[string]bool{currentToken: true})
 	if nextToken == "No token" || nextToken == "No available token" {
-		logger.Log.WithFields(logrus.Fields{
+		logger.Token.WithFields(logrus.Fields{
 			"current_token": currentToken,
 		}).Warn("没有其他可用Token进行重试")
 		return false
 	}
 
+	if !reassignToken(c, currentToken, nextToken, nextTenantURL, nextSessionID) {
+		return false
+	}
+	c.Set("retry_count", retryCount+1)
+	if conversationID := c.GetString("conversation_id"); conversationID != "" {
+		RecordConversationRequest(conversationID, nextToken)
+	}
+
+	logger.Token.WithFields(logrus.Fields{
+		"old_token":   currentToken,
+		"new_token":   nextToken,
+		"retry_count": retryCount + 1,
+	}).Info("Token切换成功，准备重试")
+
+	return true
+}
+
+// reassignToken 释放当前token并改用指定的token，更新Context中的token信息
+// 设置了时间预算的请求先在预算内获取新token的锁，超时则保留当前token，等待有上限因此不会互相死锁
+func reassignToken(c *gin.Context, currentToken, nextToken, nextTenantURL, nextSessionID string) bool {
+	newLock := GetTokenLock(nextToken)
+	_, budgeted := RequestDeadline(c)
+	if budgeted && !LockWithinBudget(c, newLock) {
+		logger.Token.WithFields(logrus.Fields{
+			"token": nextToken,
+		}).Warn("请求时间预算内未能获取新Token的锁")
+		return false
+	}
+
 	// 释放当前Token的锁
 	currentLockInterface, exists := c.Get("token_lock")
 	if exists {
-		if currentLock, ok := currentLockInterface.(*sync.Mutex); ok {
+		if currentLock, ok := currentLockInterface.(*TokenLock); ok {
 			// 更新当前Token的请求状态为已完成
 			SetTokenRequestStatus(currentToken, TokenRequestStatus{
 				InProgress:    false,
@@ -443,17 +446,18 @@ func SwitchTokenAndRetry(c *gin.Context, maxRetries int) bool {
 	}
 
 	// 获取新Token的锁
-	newLock := GetTokenLock(nextToken)
-	newLock.Lock()
+	if !budgeted {
+		newLock.Lock()
+	}
 
 	// 更新新Token的请求状态
-	err = SetTokenRequestStatus(nextToken, TokenRequestStatus{
+	err := SetTokenRequestStatus(nextToken, TokenRequestStatus{
 		InProgress:    true,
 		LastRequestAt: time.Now(),
 	})
 	if err != nil {
 		newLock.Unlock()
-		logger.Log.WithFields(logrus.Fields{
+		logger.Token.WithFields(logrus.Fields{
 			"token": nextToken,
 			"error": err.Error(),
 		}).Error("更新新Token请求状态失败")
@@ -463,15 +467,9 @@ func SwitchTokenAndRetry(c *gin.Context, maxRetries int) bool {
 	// 更新Context中的Token信息
 	c.Set("token", nextToken)
 	c.Set("tenant_url", nextTenantURL)
-	c.Set("session_id", nextSessionID)
+	c.Set("session_id", ResolveSessionID(nextToken, nextSessionID, c.GetString("api_key")))
 	c.Set("token_lock", newLock)
-	c.Set("retry_count", retryCount+1)
-
-	logger.Log.WithFields(logrus.Fields{
-		"old_token":   currentToken,
-		"new_token":   nextToken,
-		"retry_count": retryCount + 1,
-	}).Info("Token切换成功，准备重试")
+	RememberClientToken(c.GetString("api_key"), nextToken)
 
 	return true
 }
@@ -0,0 +1,171 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// suspectKeyPrefix 疑似被限流的token在Redis中的键前缀
+	suspectKeyPrefix = "token_suspect:"
+	// outputRecentSamples 判断回复长度异常时参与比较的最近回复数
+	outputRecentSamples = 5
+	// outputBaselineSamples 建立回复长度基线至少需要的更早回复数
+	outputBaselineSamples = 10
+	// suspectRecoverFactor 最近中位数恢复到阈值的该倍数以上时解除疑似状态，避免在阈值附近反复切换
+	suspectRecoverFactor = 1.5
+)
+
+// OutputLengthStats token最近成功回复的长度分布
+type OutputLengthStats struct {
+	Samples   int `json:"samples"`    // 参与统计的回复数
+	P50       int `json:"p50"`        // 回复字符数中位数
+	P90       int `json:"p90"`        // 回复字符数90分位
+	RecentP50 int `json:"recent_p50"` // 最近几次回复的字符数中位数
+}
+
+// SuspectStatus token因回复长度异常被标记为疑似限流的状态
+type SuspectStatus struct {
+	Mode           string    `json:"mode"`            // 出现异常的模式
+	RecentP50      int       `json:"recent_p50"`      // 标记时最近回复的字符数中位数
+	BaselineP50    int       `json:"baseline_p50"`    // 标记时更早回复的字符数中位数
+	SuspectedSince time.Time `json:"suspected_since"` // 标记时间
+}
+
+// suspectOutputRatio 最近回复长度中位数低于基线的该比例时标记为疑似限流，0为关闭检测
+func suspectOutputRatio() float64 {
+	ratio, err := strconv.ParseFloat(config.AppConfig.SuspectOutputRatio, 64)
+	if err != nil || ratio < 0 || ratio >= 1 {
+		return 0.3
+	}
+	return ratio
+}
+
+// outputLengths 按时间倒序返回指定模式下成功回复的字符数，mode为空时不区分模式
+func outputLengths(records []TokenRequestRecord, mode string) []int {
+	lengths := make([]int, 0, len(records))
+	for _, record := range records {
+		if record.ResponseChars == nil || record.ErrorClass != "" || record.StatusCode >= 400 {
+			continue
+		}
+		if mode != "" && record.Mode != mode {
+			continue
+		}
+		lengths = append(lengths, *record.ResponseChars)
+	}
+	return lengths
+}
+
+// percentile 返回字符数的分位值
+func percentile(lengths []int, q float64) int {
+	if len(lengths) == 0 {
+		return 0
+	}
+	sorted := append([]int(nil), lengths...)
+	sort.Ints(sorted)
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// GetOutputLengthStats 统计token最近成功回复的长度分布
+func GetOutputLengthStats(token string) OutputLengthStats {
+	records, err := GetTokenHistory(token)
+	if err != nil {
+		return OutputLengthStats{}
+	}
+	lengths := outputLengths(records, "")
+	return OutputLengthStats{
+		Samples:   len(lengths),
+		P50:       percentile(lengths, 0.5),
+		P90:       percentile(lengths, 0.9),
+		RecentP50: percentile(lengths[:min(len(lengths), outputRecentSamples)], 0.5),
+	}
+}
+
+// GetSuspectStatus 获取token的疑似限流状态，未被标记时返回nil
+func GetSuspectStatus(token string) *SuspectStatus {
+	data, err := config.RedisGet(suspectKeyPrefix + token)
+	if err != nil {
+		return nil
+	}
+	var status SuspectStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		return nil
+	}
+	return &status
+}
+
+// CountSuspectTokens 统计当前被标记为疑似限流的token数
+func CountSuspectTokens() int {
+	if config.RDB == nil {
+		return 0
+	}
+	keys, err := config.RedisScan(suspectKeyPrefix + "*")
+	if err != nil {
+		return 0
+	}
+	return len(keys)
+}
+
+// CheckOutputAnomaly 比较token在该模式下最近几次回复与更早回复的长度中位数，
+// 最近的回复突然变得异常简短时标记为疑似限流，恢复正常后解除标记
+func CheckOutputAnomaly(token, mode string) {
+	ratio := suspectOutputRatio()
+	if ratio == 0 {
+		return
+	}
+	records, err := GetTokenHistory(token)
+	if err != nil {
+		return
+	}
+	lengths := outputLengths(records, mode)
+	if len(lengths) < outputRecentSamples+outputBaselineSamples {
+		return
+	}
+
+	recent := percentile(lengths[:outputRecentSamples], 0.5)
+	baseline := percentile(lengths[outputRecentSamples:], 0.5)
+	threshold := float64(baseline) * ratio
+	current := GetSuspectStatus(token)
+
+	switch {
+	case current == nil && float64(recent) < threshold:
+		status := SuspectStatus{
+			Mode:           mode,
+			RecentP50:      recent,
+			BaselineP50:    baseline,
+			SuspectedSince: time.Now(),
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			return
+		}
+		if err := config.RedisSet(suspectKeyPrefix+token, string(data), 0); err != nil {
+			logger.Token.WithFields(logrus.Fields{
+				"token": token,
+				"error": err.Error(),
+			}).Error("标记疑似限流token失败")
+			return
+		}
+		logger.Token.WithFields(logrus.Fields{
+			"token":        token,
+			"mode":         mode,
+			"recent_p50":   recent,
+			"baseline_p50": baseline,
+		}).Warn("token回复长度异常缩短，标记为疑似限流")
+	case current != nil && current.Mode == mode && float64(recent) >= threshold*suspectRecoverFactor:
+		if err := config.RedisDel(suspectKeyPrefix + token); err != nil {
+			return
+		}
+		logger.Token.WithFields(logrus.Fields{
+			"token":      token,
+			"mode":       mode,
+			"recent_p50": recent,
+		}).Info("token回复长度恢复正常，解除疑似限流标记")
+	}
+}
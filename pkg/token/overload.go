@@ -0,0 +1,91 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// overloadBackoffs 上游分片连续过载时依次使用的退避时长
+var overloadBackoffs = []time.Duration{
+	15 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+}
+
+const (
+	// maxOverloadBackoff 上游通过 Retry-After 指定的退避时长上限
+	maxOverloadBackoff = 5 * time.Minute
+	// overloadCountTTL 过载计数的保留时间，超过后重新从第一档退避
+	overloadCountTTL = 10 * time.Minute
+)
+
+var overloadEvents = metrics.NewCounterVec("augment2api_upstream_overloaded_total",
+	"Overloaded (529) responses received from upstream, by shard host.", "shard")
+
+// TenantHost 租户地址的主机名，即上游分片
+func TenantHost(tenantURL string) string {
+	parsed, err := url.Parse(tenantURL)
+	if err != nil || parsed.Host == "" {
+		return strings.TrimSuffix(tenantURL, "/")
+	}
+	return parsed.Host
+}
+
+// RecordShardOverload 上游分片返回过载时让整个分片退避，该分片上的token仍可在其他分片都不可用时使用，
+// 过载与token本身无关，不计入token的失败冷却；返回本次退避时长
+func RecordShardOverload(host string, retryAfter time.Duration) time.Duration {
+	overloadEvents.Inc(host)
+	// 调试模式只使用一个token，无需记录退避状态
+	if config.RDB == nil {
+		return max(overloadBackoffs[0], min(retryAfter, maxOverloadBackoff))
+	}
+
+	count, err := config.RedisIncrValue("shard_overload_count:" + host)
+	if err != nil {
+		count = 1
+	}
+	config.RedisExpire("shard_overload_count:"+host, overloadCountTTL)
+
+	backoff := overloadBackoffs[min(int(count), len(overloadBackoffs))-1]
+	if retryAfter > backoff {
+		backoff = min(retryAfter, maxOverloadBackoff)
+	}
+	if err := config.RedisSet("shard_overload:"+host, "1", backoff); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"shard": host,
+			"error": err.Error(),
+		}).Error("设置上游分片退避状态失败")
+	}
+
+	logger.Token.WithFields(logrus.Fields{
+		"shard":    host,
+		"overload": count,
+		"backoff":  backoff.String(),
+	}).Warn("上游分片过载，暂时优先使用其他分片的token")
+	return backoff
+}
+
+// OverloadedShards 返回当前处于退避中的上游分片及剩余退避时长
+func OverloadedShards() map[string]time.Duration {
+	keys, err := config.RedisKeys("shard_overload:*")
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+
+	shards := make(map[string]time.Duration, len(keys))
+	for _, key := range keys {
+		ttl, err := config.RedisTTL(key)
+		if err != nil || ttl <= 0 {
+			continue
+		}
+		shards[strings.TrimPrefix(key, "shard_overload:")] = ttl
+	}
+	return shards
+}
@@ -0,0 +1,83 @@
+package token
+
+import (
+	"augment2api/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrPinnedTokenNotFound 指定指纹的token不存在
+	ErrPinnedTokenNotFound = errors.New("指定的token不存在")
+	// ErrPinnedTokenUnavailable 指定的token已禁用、冷却中或已达到使用上限
+	ErrPinnedTokenUnavailable = errors.New("指定的token当前不可用")
+)
+
+// Fingerprint 返回token的短指纹，用于关联请求而不暴露token
+func Fingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// FindByFingerprint 根据指纹查找token，不存在时返回 ErrPinnedTokenNotFound
+func FindByFingerprint(fingerprint string) (string, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if token := key[6:]; Fingerprint(token) == fingerprint { // 去掉前缀 "token:"
+			return token, nil
+		}
+	}
+	return "", ErrPinnedTokenNotFound
+}
+
+// GetPinnedToken 根据指纹获取指定的token，跳过调度但仍遵守禁用、冷却和使用次数限制
+// token冷却中时仍返回token本身，便于调用方估算重试时间
+func GetPinnedToken(fingerprint string) (string, string, string, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return "", "", "", err
+	}
+
+	for _, key := range keys {
+		token := key[6:] // 去掉前缀 "token:"
+		if Fingerprint(token) != fingerprint {
+			continue
+		}
+
+		fields, err := config.RedisHGetAll(key)
+		if err != nil {
+			return "", "", "", err
+		}
+		if fields["status"] == "disabled" || fields["tenant_url"] == "" {
+			return "", "", "", ErrPinnedTokenUnavailable
+		}
+		if getTokenChatUsageCount(token) >= ChatUsageLimit || getTokenAgentUsageCount(token) >= AgentUsageLimit {
+			return "", "", "", ErrPinnedTokenUnavailable
+		}
+		coolStatus, err := GetTokenCoolStatus(token)
+		if err != nil {
+			return "", "", "", err
+		}
+		if coolStatus.InCool && time.Now().Before(coolStatus.CoolEnd) {
+			return token, "", "", ErrPinnedTokenUnavailable
+		}
+
+		sessionID := fields["session_id"]
+		if sessionID == "" {
+			sessionID = uuid.New().String()
+			config.RedisHSet(key, "session_id", sessionID)
+		}
+		return token, fields["tenant_url"], sessionID, nil
+	}
+	return "", "", "", ErrPinnedTokenNotFound
+}
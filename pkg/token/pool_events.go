@@ -0,0 +1,75 @@
+package token
+
+import (
+	"augment2api/config"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// poolEventsTTL 每日事件计数的保留时间
+const poolEventsTTL = 35 * 24 * time.Hour
+
+// PoolEventCounts 一段时间内token冷却和禁用事件的次数
+type PoolEventCounts struct {
+	Cooldowns      map[string]int `json:"cooldowns"`       // 按token统计的冷却次数
+	Disables       map[string]int `json:"disables"`        // 按token统计的禁用次数
+	DisableReasons map[string]int `json:"disable_reasons"` // 按原因统计的禁用次数
+}
+
+// poolEventsKey 某一天的事件计数哈希表，字段为 事件类型:token 或 reason:原因
+func poolEventsKey(day time.Time) string {
+	return "pool_events:" + day.Format("20060102")
+}
+
+// countPoolEvent 按天累计冷却和禁用事件，用于定期生成池调整建议
+func countPoolEvent(eventType, token string, data map[string]interface{}) {
+	if eventType != EventCooled && eventType != EventDisabled {
+		return
+	}
+	key := poolEventsKey(time.Now())
+	config.RedisHIncrBy(key, eventType+":"+token, 1)
+	if eventType == EventDisabled {
+		config.RedisHIncrBy(key, "reason:"+fmt.Sprint(data["reason"]), 1)
+	}
+	config.RedisExpire(key, poolEventsTTL)
+}
+
+// GetPoolEventCounts 汇总最近若干天的冷却和禁用事件
+func GetPoolEventCounts(days int) (PoolEventCounts, error) {
+	counts := PoolEventCounts{
+		Cooldowns:      make(map[string]int),
+		Disables:       make(map[string]int),
+		DisableReasons: make(map[string]int),
+	}
+
+	now := time.Now()
+	keys := make([]string, days)
+	for i := range keys {
+		keys[i] = poolEventsKey(now.AddDate(0, 0, -i))
+	}
+	hashes, err := config.RedisHGetAllBatch(keys)
+	if err != nil {
+		return counts, err
+	}
+
+	for _, fields := range hashes {
+		for field, value := range fields {
+			n, _ := strconv.Atoi(value)
+			kind, name, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			switch kind {
+			case EventCooled:
+				counts.Cooldowns[name] += n
+			case EventDisabled:
+				counts.Disables[name] += n
+			case "reason":
+				counts.DisableReasons[name] += n
+			}
+		}
+	}
+	return counts, nil
+}
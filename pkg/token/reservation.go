@@ -0,0 +1,314 @@
+package token
+
+import (
+	"augment2api/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// reservationsKey 额度预留的哈希表，字段为预留ID
+	reservationsKey = "token_reservations"
+	// reservationUsedTTL 每个窗口已使用次数的保留时间
+	reservationUsedTTL = 48 * time.Hour
+	// poolCapacityTTL 池剩余额度的缓存时间，避免每个请求都遍历token池
+	poolCapacityTTL = 10 * time.Second
+)
+
+// Reservation 为指定API密钥在每天固定时段预留的请求额度
+type Reservation struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`     // 计划任务名称
+	APIKey    string    `json:"api_key"`  // 可以使用预留额度的API密钥
+	Mode      string    `json:"mode"`     // CHAT 或 AGENT
+	Requests  int       `json:"requests"` // 每个窗口预留的请求数
+	Start     string    `json:"start"`    // 窗口开始时间 HH:MM，服务器时区
+	End       string    `json:"end"`      // 窗口结束时间 HH:MM，早于开始时间表示跨零点
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReservationStatus 预留在当前时间的使用情况
+type ReservationStatus struct {
+	Reservation
+	Active      bool       `json:"active"`
+	WindowStart *time.Time `json:"window_start,omitempty"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+	Used        int        `json:"used"`
+	Remaining   int        `json:"remaining"`
+}
+
+var (
+	// ErrReservationNotFound 预留不存在
+	ErrReservationNotFound = errors.New("预留不存在")
+
+	poolCapacityCache      = make(map[string]cachedCapacity)
+	poolCapacityCacheGuard sync.Mutex
+)
+
+type cachedCapacity struct {
+	value     int
+	expiresAt time.Time
+}
+
+// parseClock 解析 HH:MM 格式的时间，返回距零点的分钟数
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("无效的时间 %q，格式应为 HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate 校验预留参数
+func (r *Reservation) Validate() error {
+	if r.Name == "" {
+		return errors.New("缺少预留名称")
+	}
+	if r.APIKey == "" {
+		return errors.New("缺少使用预留额度的API密钥")
+	}
+	if r.Mode != "CHAT" && r.Mode != "AGENT" {
+		return errors.New("模式必须为 CHAT 或 AGENT")
+	}
+	if r.Requests <= 0 {
+		return errors.New("预留请求数必须大于0")
+	}
+	start, err := parseClock(r.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(r.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errors.New("开始时间和结束时间不能相同")
+	}
+	return nil
+}
+
+// window 当前时间所在的预留窗口，不在窗口内时返回false
+func (r Reservation) window(now time.Time) (time.Time, time.Time, bool) {
+	start, err := parseClock(r.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err := parseClock(r.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	length := time.Duration((end-start+24*60)%(24*60)) * time.Minute
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// 跨零点的窗口可能开始于前一天
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		windowStart := day.Add(time.Duration(start) * time.Minute)
+		windowEnd := windowStart.Add(length)
+		if !now.Before(windowStart) && now.Before(windowEnd) {
+			return windowStart, windowEnd, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// reservationUsedKey 预留在某个窗口内已使用次数的键
+func reservationUsedKey(id string, windowStart time.Time) string {
+	return "reservation_used:" + id + ":" + windowStart.Format("2006-01-02")
+}
+
+// reservationUsed 预留在某个窗口内已使用的次数
+func reservationUsed(id string, windowStart time.Time) int {
+	value, err := config.RedisGet(reservationUsedKey(id, windowStart))
+	if err != nil {
+		return 0
+	}
+	used, _ := strconv.Atoi(value)
+	return used
+}
+
+// SaveReservation 创建额度预留
+func SaveReservation(r *Reservation) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.ID == "" {
+		r.ID = uuid.New().String()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return config.RedisHSet(reservationsKey, r.ID, string(data))
+}
+
+// DeleteReservation 删除额度预留
+func DeleteReservation(id string) error {
+	if exists, err := config.RedisHExists(reservationsKey, id); err != nil {
+		return err
+	} else if !exists {
+		return ErrReservationNotFound
+	}
+	return config.RedisHDel(reservationsKey, id)
+}
+
+// ListReservations 获取所有额度预留，按创建时间排序
+func ListReservations() ([]Reservation, error) {
+	items, err := config.RedisHGetAll(reservationsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make([]Reservation, 0, len(items))
+	for _, item := range items {
+		var r Reservation
+		if err := json.Unmarshal([]byte(item), &r); err != nil {
+			continue
+		}
+		reservations = append(reservations, r)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].CreatedAt.Before(reservations[j].CreatedAt)
+	})
+	return reservations, nil
+}
+
+// ReservationStatuses 获取所有额度预留及其在当前窗口的使用情况
+func ReservationStatuses() ([]ReservationStatus, error) {
+	reservations, err := ListReservations()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]ReservationStatus, 0, len(reservations))
+	for _, r := range reservations {
+		status := ReservationStatus{Reservation: r, Remaining: r.Requests}
+		if start, end, ok := r.window(now); ok {
+			status.Active = true
+			status.WindowStart = &start
+			status.WindowEnd = &end
+			status.Used = reservationUsed(r.ID, start)
+			status.Remaining = max(r.Requests-status.Used, 0)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// AdmitReservation 检查预留窗口内是否可以为该调用方分配token，只检查不计数
+// 预留所属的API密钥优先使用预留额度，返回应计入的预留ID，获取到token后调用 CommitReservation 计数；
+// 其他调用方只有在池剩余额度超过尚未用完的预留时才放行，拒绝时返回距离最早的预留窗口结束的时间
+func AdmitReservation(apiKey, mode string) (bool, time.Duration, string) {
+	if config.RDB == nil || mode == "" {
+		return true, 0, ""
+	}
+	reservations, err := ListReservations()
+	if err != nil || len(reservations) == 0 {
+		return true, 0, ""
+	}
+
+	now := time.Now()
+	held := 0
+	var retryAfter time.Duration
+	for _, r := range reservations {
+		if r.Mode != mode {
+			continue
+		}
+		start, end, ok := r.window(now)
+		if !ok {
+			continue
+		}
+		remaining := r.Requests - reservationUsed(r.ID, start)
+		if remaining <= 0 {
+			continue
+		}
+		if r.APIKey == apiKey {
+			// 使用自己的预留额度，用完后与其他请求一样按池剩余额度调度
+			return true, 0, r.ID
+		}
+		held += remaining
+		if wait := end.Sub(now); retryAfter == 0 || wait < retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	if held == 0 || PoolCapacity(mode) > held {
+		return true, 0, ""
+	}
+	return false, retryAfter, ""
+}
+
+// CommitReservation 请求获取到token后计入预留在当前窗口的使用次数，id为空或窗口已结束时不计数
+func CommitReservation(id string) {
+	if id == "" || config.RDB == nil {
+		return
+	}
+	data, err := config.RedisHGet(reservationsKey, id)
+	if err != nil {
+		return
+	}
+	var r Reservation
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return
+	}
+	start, _, ok := r.window(time.Now())
+	if !ok {
+		return
+	}
+	key := reservationUsedKey(r.ID, start)
+	if _, err := config.RedisIncrValue(key); err == nil {
+		config.RedisExpire(key, reservationUsedTTL)
+	}
+}
+
+// PoolCapacity 池中所有可用token在该模式下的剩余使用次数之和
+func PoolCapacity(mode string) int {
+	poolCapacityCacheGuard.Lock()
+	cached, ok := poolCapacityCache[mode]
+	poolCapacityCacheGuard.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.value
+	}
+
+	value := scanPoolCapacity(mode)
+	poolCapacityCacheGuard.Lock()
+	poolCapacityCache[mode] = cachedCapacity{value: value, expiresAt: time.Now().Add(poolCapacityTTL)}
+	poolCapacityCacheGuard.Unlock()
+	return value
+}
+
+// scanPoolCapacity 遍历token池统计该模式的剩余使用次数，已禁用或备注不允许该模式的token不计入
+func scanPoolCapacity(mode string) int {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return 0
+	}
+
+	capacity := 0
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil || fields["status"] == "disabled" || fields["tenant_url"] == "" {
+			continue
+		}
+		if ParseTokenHints(fields["remark"]).rank(mode) == rankDisallowed {
+			continue
+		}
+		token := key[6:] // 去掉前缀 "token:"
+		if mode == "AGENT" {
+			capacity += max(AgentUsageLimit-getTokenAgentUsageCount(token), 0)
+		} else {
+			capacity += max(ChatUsageLimit-getTokenChatUsageCount(token), 0)
+		}
+	}
+	return capacity
+}
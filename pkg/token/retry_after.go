@@ -0,0 +1,60 @@
+package token
+
+import (
+	"augment2api/config"
+	"time"
+)
+
+// requestInterval 同一token两次请求之间的最小间隔，与调度时的判断保持一致
+const requestInterval = 3 * time.Second
+
+// TokenAvailableIn 估算token多久后可再次被调度，0表示当前即可使用
+// 冷却中的token以冷却结束时间为准，使用中的token按其最近请求的平均耗时估算
+func TokenAvailableIn(token string) time.Duration {
+	var wait time.Duration
+
+	if coolStatus, err := GetTokenCoolStatus(token); err == nil && coolStatus.InCool {
+		wait = time.Until(coolStatus.CoolEnd)
+	}
+
+	if status, err := GetTokenRequestStatus(token); err == nil {
+		ready := status.LastRequestAt.Add(requestInterval)
+		if status.InProgress {
+			ready = status.LastRequestAt.Add(time.Duration(GetTokenScore(token).AvgLatencyMs)*time.Millisecond + requestInterval)
+		}
+		if until := time.Until(ready); until > wait {
+			wait = until
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// RetryAfter 估算token池中最快多久会有token可用，没有可恢复的token时返回false
+// 已禁用或已达到使用次数上限的token需等待人工处理或次数重置，不参与估算
+func RetryAfter() (time.Duration, bool) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return 0, false
+	}
+
+	soonest, found := time.Duration(0), false
+	for _, key := range keys {
+		if status, err := config.RedisHGet(key, "status"); err == nil && status == "disabled" {
+			continue
+		}
+		token := key[6:] // 去掉前缀 "token:"
+		if getTokenChatUsageCount(token) >= ChatUsageLimit || getTokenAgentUsageCount(token) >= AgentUsageLimit {
+			continue
+		}
+
+		wait := TokenAvailableIn(token)
+		if !found || wait < soonest {
+			soonest, found = wait, true
+		}
+	}
+	return soonest, found
+}
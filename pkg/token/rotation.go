@@ -0,0 +1,57 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientTokenTTL 调用方上次使用token的记录保留时间
+const clientTokenTTL = time.Hour
+
+// clientTokenKey 记录调用方上次使用token的键，API密钥只保存摘要
+func clientTokenKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return "client_last_token:" + hex.EncodeToString(sum[:8])
+}
+
+// clientRotationEnabled 是否避免同一调用方连续使用同一个token
+func clientRotationEnabled(apiKey string) bool {
+	return config.AppConfig.ClientTokenRotation == "true" && apiKey != "" && config.RDB != nil
+}
+
+// GetAvailableTokenForClient 按请求模式在指定分片中为调用方获取可用token，优先避开其上一次请求使用的token，
+// 没有其他可用token时才会再次分配同一个，mode为空表示模式未知
+func GetAvailableTokenForClient(apiKey, mode, shard string) (string, string, string) {
+	if !clientRotationEnabled(apiKey) {
+		return GetAvailableTokenForMode(mode, shard, nil)
+	}
+
+	lastToken, err := config.RedisGet(clientTokenKey(apiKey))
+	if err != nil || lastToken == "" {
+		return GetAvailableTokenForMode(mode, shard, nil)
+	}
+
+	token, tenantURL, sessionID := GetAvailableTokenForMode(mode, shard, map[string]bool{lastToken: true})
+	if token == "No token" || token == "No available token" || tenantURL == "" {
+		return GetAvailableTokenForMode(mode, shard, nil)
+	}
+	return token, tenantURL, sessionID
+}
+
+// RememberClientToken 记录调用方本次使用的token
+func RememberClientToken(apiKey, token string) {
+	if !clientRotationEnabled(apiKey) {
+		return
+	}
+	if err := config.RedisSet(clientTokenKey(apiKey), token, clientTokenTTL); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"token": token,
+			"error": err.Error(),
+		}).Error("记录调用方使用的token失败")
+	}
+}
@@ -0,0 +1,155 @@
+package token
+
+import (
+	"augment2api/config"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// scoreCacheTTL 健康分缓存时间，避免每次调度都读取全部请求记录
+	scoreCacheTTL = 30 * time.Second
+	// scoreLatencyCeiling 延迟达到该值时延迟分为0
+	scoreLatencyCeiling = 30 * time.Second
+
+	// TierHigh 高分级
+	TierHigh = "high"
+	// TierMedium 中分级
+	TierMedium = "medium"
+	// TierLow 低分级
+	TierLow = "low"
+)
+
+// refusalClasses 上游拒绝为token提供服务的错误类别
+var refusalClasses = map[string]bool{
+	"rate_limited":     true,
+	"unauthorized":     true,
+	"payment_required": true,
+}
+
+// TokenScore token的健康分
+type TokenScore struct {
+	Score          float64 `json:"score"`           // 综合得分 0~1
+	Tier           string  `json:"tier"`            // 分级 high / medium / low
+	Samples        int     `json:"samples"`         // 参与计算的请求记录数
+	SuccessRate    float64 `json:"success_rate"`    // 最近请求成功率
+	RefusalRate    float64 `json:"refusal_rate"`    // 最近请求被上游拒绝的比例
+	AvgLatencyMs   int64   `json:"avg_latency_ms"`  // 最近成功请求的平均耗时
+	QuotaRemaining float64 `json:"quota_remaining"` // 剩余额度比例
+}
+
+type cachedScore struct {
+	score     TokenScore
+	expiresAt time.Time
+}
+
+var (
+	scoreCache      = make(map[string]cachedScore)
+	scoreCacheGuard sync.Mutex
+)
+
+// ScoringEnabled 是否按健康分调度token
+func ScoringEnabled() bool {
+	return config.AppConfig.TokenScoring == "true"
+}
+
+// scoreExploration 随机选择token的比例
+func scoreExploration() float64 {
+	rate, err := strconv.ParseFloat(config.AppConfig.TokenScoreExploration, 64)
+	if err != nil || rate < 0 {
+		return 0.1
+	}
+	return math.Min(rate, 1)
+}
+
+// tierOf 根据综合得分分级
+func tierOf(score float64) string {
+	switch {
+	case score >= 0.75:
+		return TierHigh
+	case score >= 0.5:
+		return TierMedium
+	default:
+		return TierLow
+	}
+}
+
+// computeTokenScore 根据最近的请求记录和使用次数计算健康分
+// 成功率和拒绝率做平滑处理，记录较少的新token不会因一两次失败被压到低分级
+func computeTokenScore(token string) TokenScore {
+	history, _ := GetTokenHistory(token)
+
+	var successes, refusals int
+	var latencyTotal int64
+	for _, record := range history {
+		if record.ErrorClass == "" {
+			successes++
+			latencyTotal += record.DurationMs
+		} else if refusalClasses[record.ErrorClass] {
+			refusals++
+		}
+	}
+
+	samples := len(history)
+	score := TokenScore{
+		Samples:     samples,
+		SuccessRate: float64(successes+1) / float64(samples+2),
+		RefusalRate: float64(refusals) / float64(samples+2),
+	}
+	latencyScore := 0.5
+	if successes > 0 {
+		score.AvgLatencyMs = latencyTotal / int64(successes)
+		latencyScore = math.Max(0, 1-float64(score.AvgLatencyMs)/float64(scoreLatencyCeiling.Milliseconds()))
+	}
+
+	chatRemaining := 1 - float64(getTokenChatUsageCount(token))/ChatUsageLimit
+	agentRemaining := 1 - float64(getTokenAgentUsageCount(token))/AgentUsageLimit
+	score.QuotaRemaining = math.Max(0, math.Min(chatRemaining, agentRemaining))
+
+	score.Score = 0.4*score.SuccessRate + 0.2*(1-score.RefusalRate) + 0.2*latencyScore + 0.2*score.QuotaRemaining
+	score.Score = math.Round(score.Score*1000) / 1000
+	score.Tier = tierOf(score.Score)
+	return score
+}
+
+// GetTokenScore 获取token的健康分，结果会缓存一小段时间
+func GetTokenScore(token string) TokenScore {
+	scoreCacheGuard.Lock()
+	cached, ok := scoreCache[token]
+	scoreCacheGuard.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.score
+	}
+
+	score := computeTokenScore(token)
+
+	scoreCacheGuard.Lock()
+	scoreCache[token] = cachedScore{score: score, expiresAt: time.Now().Add(scoreCacheTTL)}
+	scoreCacheGuard.Unlock()
+	return score
+}
+
+// pickByScore 从候选token中选择一个：按探索比例随机选择，其余情况在最高分级内随机选择
+func pickByScore(tokens []string) int {
+	if len(tokens) == 1 || rand.Float64() < scoreExploration() {
+		return rand.Intn(len(tokens))
+	}
+
+	tierRank := map[string]int{TierHigh: 0, TierMedium: 1, TierLow: 2}
+	bestRank := len(tierRank)
+	var best []int
+	for i, token := range tokens {
+		rank := tierRank[GetTokenScore(token).Tier]
+		if rank < bestRank {
+			bestRank = rank
+			best = best[:0]
+		}
+		if rank == bestRank {
+			best = append(best, i)
+		}
+	}
+	return best[rand.Intn(len(best))]
+}
@@ -0,0 +1,20 @@
+package token
+
+import (
+	"augment2api/config"
+
+	"github.com/google/uuid"
+)
+
+// sessionNamespace 派生会话ID使用的UUID命名空间
+var sessionNamespace = uuid.MustParse("6f1c1f3e-5b0a-4f43-9a55-2c1e7d0b8a61")
+
+// ResolveSessionID 根据会话策略计算发往上游的session_id
+// token 策略直接使用token绑定的session_id；api_key 策略由(token, API密钥)稳定派生，
+// 保证同一调用方在同一token上的会话不变，而不同调用方互不共享
+func ResolveSessionID(token, tokenSessionID, apiKey string) string {
+	if config.AppConfig.SessionStrategy != "api_key" || apiKey == "" {
+		return tokenSessionID
+	}
+	return uuid.NewSHA1(sessionNamespace, []byte(token+":"+apiKey)).String()
+}
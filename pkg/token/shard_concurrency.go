@@ -0,0 +1,169 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/metrics"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// shardDecreaseFactor 上游分片过载或返回服务端错误时并发上限的缩小比例
+	shardDecreaseFactor = 0.5
+	// shardDecreaseInterval 两次缩小并发上限的最小间隔，同一波失败只缩小一次
+	shardDecreaseInterval = 2 * time.Second
+)
+
+var shardLimitDecreases = metrics.NewCounterVec("augment2api_shard_concurrency_decreases_total",
+	"Times the adaptive concurrency limit of an upstream shard was reduced, by shard host.", "shard")
+
+// ShardConcurrency 上游分片的自适应并发状态
+type ShardConcurrency struct {
+	Shard        string     `json:"shard"`
+	InFlight     int        `json:"in_flight"`
+	Limit        int        `json:"limit"`
+	Successes    uint64     `json:"successes"`
+	Failures     uint64     `json:"failures"`
+	LastDecrease *time.Time `json:"last_decrease,omitempty"`
+}
+
+// shardConcurrency 本实例记录的分片并发状态，上限使用浮点数以便逐步增长
+type shardConcurrency struct {
+	inFlight     int
+	limit        float64
+	successes    uint64
+	failures     uint64
+	lastDecrease time.Time
+}
+
+var (
+	shardStates      = make(map[string]*shardConcurrency)
+	shardStatesGuard sync.Mutex
+)
+
+// shardConcurrencyBounds 返回分片并发上限的范围，上限为0表示不限制
+func shardConcurrencyBounds() (float64, float64) {
+	maxLimit, err := strconv.Atoi(config.AppConfig.ShardConcurrencyLimit)
+	if err != nil || maxLimit <= 0 {
+		return 0, 0
+	}
+	minLimit, err := strconv.Atoi(config.AppConfig.ShardConcurrencyMin)
+	if err != nil || minLimit <= 0 {
+		minLimit = 1
+	}
+	return float64(min(minLimit, maxLimit)), float64(maxLimit)
+}
+
+// ShardConcurrencyEnabled 是否按上游分片限制并发
+func ShardConcurrencyEnabled() bool {
+	_, maxLimit := shardConcurrencyBounds()
+	return maxLimit > 0
+}
+
+// shardState 返回分片的并发状态，不存在时按上限创建，调用方需持有 shardStatesGuard
+func shardState(host string, maxLimit float64) *shardConcurrency {
+	state, ok := shardStates[host]
+	if !ok {
+		state = &shardConcurrency{limit: maxLimit}
+		shardStates[host] = state
+	}
+	return state
+}
+
+// ShardSaturated 上游分片在本实例进行中的请求是否已达到当前并发上限，达到上限的分片不再分配新请求
+func ShardSaturated(host string) bool {
+	_, maxLimit := shardConcurrencyBounds()
+	if maxLimit == 0 {
+		return false
+	}
+	shardStatesGuard.Lock()
+	defer shardStatesGuard.Unlock()
+	state := shardState(host, maxLimit)
+	return float64(state.inFlight) >= state.limit
+}
+
+// BeginShardRequest 记录发往上游分片的请求，返回的函数在请求结束时调用一次，传入上游状态码用于调整并发上限：
+// 成功时上限加性增长，每完成约一个上限数量的请求加1；限流、过载或服务端错误时上限减半，不低于下限；
+// 状态码为0表示没有得到上游响应，只减少进行中的请求数
+func BeginShardRequest(host string) func(statusCode int) {
+	_, maxLimit := shardConcurrencyBounds()
+	if maxLimit == 0 || host == "" {
+		return func(int) {}
+	}
+	shardStatesGuard.Lock()
+	shardState(host, maxLimit).inFlight++
+	shardStatesGuard.Unlock()
+
+	var once sync.Once
+	return func(statusCode int) {
+		once.Do(func() { endShardRequest(host, statusCode) })
+	}
+}
+
+// endShardRequest 结束一次上游请求并按结果调整分片的并发上限
+func endShardRequest(host string, statusCode int) {
+	minLimit, maxLimit := shardConcurrencyBounds()
+	shardStatesGuard.Lock()
+	defer shardStatesGuard.Unlock()
+
+	state, ok := shardStates[host]
+	if !ok {
+		return
+	}
+	state.inFlight = max(state.inFlight-1, 0)
+	if maxLimit == 0 {
+		return
+	}
+
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		state.successes++
+		state.limit = min(state.limit+1/state.limit, maxLimit)
+	case statusCode >= 500:
+		// 429是单个token的限流，由token冷却处理，不缩小整个分片的并发上限；529过载和其他服务端错误才视为分片压力
+		state.failures++
+		if time.Since(state.lastDecrease) < shardDecreaseInterval {
+			return
+		}
+		previous := state.limit
+		state.limit = max(state.limit*shardDecreaseFactor, minLimit)
+		state.lastDecrease = time.Now()
+		shardLimitDecreases.Inc(host)
+		logger.Token.WithFields(logrus.Fields{
+			"shard":     host,
+			"status":    statusCode,
+			"limit":     int(state.limit),
+			"previous":  int(previous),
+			"in_flight": state.inFlight,
+		}).Warn("上游分片返回错误，降低该分片的并发上限")
+	}
+}
+
+// ShardConcurrencySnapshot 返回本实例各上游分片的并发状态，按分片排序
+func ShardConcurrencySnapshot() []ShardConcurrency {
+	shardStatesGuard.Lock()
+	defer shardStatesGuard.Unlock()
+
+	states := make([]ShardConcurrency, 0, len(shardStates))
+	for host, state := range shardStates {
+		view := ShardConcurrency{
+			Shard:     host,
+			InFlight:  state.inFlight,
+			Limit:     int(state.limit),
+			Successes: state.successes,
+			Failures:  state.failures,
+		}
+		if !state.lastDecrease.IsZero() {
+			lastDecrease := state.lastDecrease
+			view.LastDecrease = &lastDecrease
+		}
+		states = append(states, view)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Shard < states[j].Shard })
+	return states
+}
@@ -0,0 +1,333 @@
+package token
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// simulatedBlockCooldown 模拟中请求被上游拦截后token的冷却时间，与实际处理一致
+	simulatedBlockCooldown = 10 * time.Minute
+	// simulationBuckets 模拟结果时间线的分段数
+	simulationBuckets = 60
+	// simulationHeadroom 建议token数在理论需求之上保留的余量
+	simulationHeadroom = 1.2
+)
+
+// SimulationProfile 模拟的请求负载和队列设置
+type SimulationProfile struct {
+	RPS          float64       // 平均每秒请求数，按泊松过程生成请求
+	AgentRatio   float64       // AGENT请求的比例
+	Duration     time.Duration // 模拟时长
+	ChatLatency  time.Duration // CHAT请求的平均耗时
+	AgentLatency time.Duration // AGENT请求的平均耗时
+	BlockRate    float64       // 请求被上游拦截导致token冷却的概率
+	QueueLength  int           // 排队长度，0表示不排队
+	QueueWait    time.Duration // 最长排队时间
+	Seed         int64
+}
+
+// SimulatedToken 参与模拟的token的初始状态
+type SimulatedToken struct {
+	Chat      bool          // 调度提示是否允许CHAT请求
+	Agent     bool          // 调度提示是否允许AGENT请求
+	ChatUsed  int           // 已使用的CHAT次数
+	AgentUsed int           // 已使用的AGENT次数
+	CoolFor   time.Duration // 剩余冷却时间
+}
+
+// SimulationBucket 模拟时间线中的一段
+type SimulationBucket struct {
+	Offset   int64 `json:"offset_seconds"`
+	Requests int   `json:"requests"`
+	Rejected int   `json:"rejected"`
+	Queued   int   `json:"queued"`
+	Cooling  int   `json:"cooling_tokens"` // 该段结束时冷却中的token数
+}
+
+// SimulationResult 模拟结果
+type SimulationResult struct {
+	Tokens            int                `json:"tokens"`
+	Requests          int                `json:"requests"`
+	ChatRequests      int                `json:"chat_requests"`
+	AgentRequests     int                `json:"agent_requests"`
+	Served            int                `json:"served"`
+	Queued            int                `json:"queued"`            // 排队后得到处理的请求数
+	ServedOnCooling   int                `json:"served_on_cooling"` // 只剩冷却中的token时仍分配给冷却token的请求数
+	RejectedBusy      int                `json:"rejected_busy"`     // 所有token繁忙且无法排队而被拒绝
+	RejectedQuota     int                `json:"rejected_quota"`    // 没有剩余使用次数的token而被拒绝
+	RejectionRate     float64            `json:"rejection_rate"`
+	AvgQueueWaitMs    int64              `json:"avg_queue_wait_ms"`
+	P95QueueWaitMs    int64              `json:"p95_queue_wait_ms"`
+	Cooldowns         int                `json:"cooldowns"`
+	PeakCooling       int                `json:"peak_cooling_tokens"`
+	Utilization       float64            `json:"utilization"`                          // token处于占用状态的时间比例，含两次请求之间的最小间隔
+	ChatExhaustedAt   *int64             `json:"chat_exhausted_at_seconds,omitempty"`  // CHAT次数用完的时间
+	AgentExhaustedAt  *int64             `json:"agent_exhausted_at_seconds,omitempty"` // AGENT次数用完的时间
+	RecommendedTokens int                `json:"recommended_tokens"`                   // 按负载和使用次数上限估算的建议token数
+	Timeline          []SimulationBucket `json:"timeline"`
+}
+
+// simToken 模拟过程中token的状态
+type simToken struct {
+	SimulatedToken
+	freeAt    time.Duration // 可以再次调度的时间，即上次请求结束后再加最小请求间隔
+	coolUntil time.Duration
+	busyTotal time.Duration
+}
+
+// serves token在该模式下是否允许且仍有使用次数
+func (t *simToken) serves(agent bool) bool {
+	if agent {
+		return t.Agent && t.AgentUsed < AgentUsageLimit
+	}
+	return t.Chat && t.ChatUsed < ChatUsageLimit
+}
+
+// SimulatePool 按负载模拟token池的调度：请求优先分配给空闲且不在冷却中的token，
+// 只剩冷却中的token时与实际调度一样分配给冷却token，都繁忙时按队列设置排队或拒绝
+func SimulatePool(tokens []SimulatedToken, profile SimulationProfile) SimulationResult {
+	rng := rand.New(rand.NewSource(profile.Seed))
+	pool := make([]*simToken, len(tokens))
+	for i, t := range tokens {
+		pool[i] = &simToken{SimulatedToken: t, coolUntil: t.CoolFor}
+	}
+
+	result := SimulationResult{Tokens: len(tokens), Timeline: make([]SimulationBucket, simulationBuckets)}
+	bucketSize := profile.Duration / simulationBuckets
+	if bucketSize <= 0 {
+		bucketSize = time.Second
+	}
+	for i := range result.Timeline {
+		result.Timeline[i].Offset = int64((time.Duration(i) * bucketSize).Seconds())
+	}
+
+	var waits []time.Duration
+	var queuedStarts []time.Duration // 排队中请求的开始时间，用于计算当前队列长度
+	lastBucket := -1
+	now := time.Duration(0)
+	for {
+		now += time.Duration(rng.ExpFloat64() / profile.RPS * float64(time.Second))
+		if now >= profile.Duration {
+			break
+		}
+
+		// 进入新的时间段时记录上一段结束时的冷却token数
+		bucket := min(int(now/bucketSize), simulationBuckets-1)
+		for ; lastBucket < bucket; lastBucket++ {
+			if lastBucket >= 0 {
+				result.Timeline[lastBucket].Cooling = countCooling(pool, time.Duration(lastBucket+1)*bucketSize)
+			}
+		}
+		result.Timeline[bucket].Requests++
+
+		agent := rng.Float64() < profile.AgentRatio
+		result.Requests++
+		latency := profile.ChatLatency
+		if agent {
+			result.AgentRequests++
+			latency = profile.AgentLatency
+		} else {
+			result.ChatRequests++
+		}
+
+		index, start, cooling := pickSimToken(rng, pool, agent, now)
+		if index < 0 {
+			result.RejectedQuota++
+			result.Timeline[bucket].Rejected++
+			markExhausted(&result, agent, now)
+			continue
+		}
+
+		if start > now {
+			// 没有空闲token，按队列设置排队
+			active := queuedStarts[:0]
+			for _, s := range queuedStarts {
+				if s > now {
+					active = append(active, s)
+				}
+			}
+			queuedStarts = active
+			if len(queuedStarts) >= profile.QueueLength || start-now > profile.QueueWait {
+				result.RejectedBusy++
+				result.Timeline[bucket].Rejected++
+				continue
+			}
+			queuedStarts = append(queuedStarts, start)
+			waits = append(waits, start-now)
+			result.Queued++
+			result.Timeline[bucket].Queued++
+		}
+
+		// 实际耗时在平均值的0.5~1.5倍之间波动
+		duration := time.Duration(float64(latency) * (0.5 + rng.Float64()))
+		token := pool[index]
+		token.freeAt = start + duration + requestInterval
+		token.busyTotal += duration + requestInterval
+		if agent {
+			token.AgentUsed++
+		} else {
+			token.ChatUsed++
+		}
+		if cooling {
+			result.ServedOnCooling++
+		}
+		if rng.Float64() < profile.BlockRate {
+			token.coolUntil = start + duration + simulatedBlockCooldown
+			result.Cooldowns++
+		}
+		result.Served++
+	}
+	for ; lastBucket < simulationBuckets-1; lastBucket++ {
+		if lastBucket >= 0 {
+			result.Timeline[lastBucket].Cooling = countCooling(pool, time.Duration(lastBucket+1)*bucketSize)
+		}
+	}
+	result.Timeline[simulationBuckets-1].Cooling = countCooling(pool, profile.Duration)
+	for _, bucket := range result.Timeline {
+		result.PeakCooling = max(result.PeakCooling, bucket.Cooling)
+	}
+
+	if result.Requests > 0 {
+		result.RejectionRate = float64(result.RejectedBusy+result.RejectedQuota) / float64(result.Requests)
+	}
+	if len(waits) > 0 {
+		var total time.Duration
+		for _, wait := range waits {
+			total += wait
+		}
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+		result.AvgQueueWaitMs = (total / time.Duration(len(waits))).Milliseconds()
+		result.P95QueueWaitMs = waits[(len(waits)-1)*95/100].Milliseconds()
+	}
+	if len(pool) > 0 && profile.Duration > 0 {
+		var busy time.Duration
+		for _, token := range pool {
+			busy += min(token.busyTotal, profile.Duration)
+		}
+		result.Utilization = float64(busy) / float64(profile.Duration) / float64(len(pool))
+	}
+	result.RecommendedTokens = recommendedTokens(tokens, profile)
+	return result
+}
+
+// pickSimToken 选择处理请求的token，返回token下标、开始处理的时间和是否分配给了冷却中的token
+// 当前没有空闲token时返回最早可用的token，没有剩余使用次数的token时下标为-1
+func pickSimToken(rng *rand.Rand, pool []*simToken, agent bool, now time.Duration) (int, time.Duration, bool) {
+	var ready, coolingReady []int
+	earliest, earliestAt, earliestCooling := -1, time.Duration(0), false
+	for i, token := range pool {
+		if !token.serves(agent) {
+			continue
+		}
+		at := max(token.freeAt, now)
+		cooling := token.coolUntil > at
+		if at == now {
+			if cooling {
+				coolingReady = append(coolingReady, i)
+			} else {
+				ready = append(ready, i)
+			}
+			continue
+		}
+		// 排队的请求分配给最早空闲的token，同时空闲时优先不在冷却中的token
+		if earliest < 0 || at < earliestAt || (at == earliestAt && earliestCooling && !cooling) {
+			earliest, earliestAt, earliestCooling = i, at, cooling
+		}
+	}
+
+	switch {
+	case len(ready) > 0:
+		return ready[rng.Intn(len(ready))], now, false
+	case len(coolingReady) > 0:
+		return coolingReady[rng.Intn(len(coolingReady))], now, true
+	default:
+		return earliest, earliestAt, earliestCooling
+	}
+}
+
+// countCooling 统计指定时间冷却中的token数
+func countCooling(pool []*simToken, at time.Duration) int {
+	count := 0
+	for _, token := range pool {
+		if token.coolUntil > at {
+			count++
+		}
+	}
+	return count
+}
+
+// markExhausted 记录某种模式的使用次数第一次用完的时间
+func markExhausted(result *SimulationResult, agent bool, now time.Duration) {
+	seconds := int64(now.Seconds())
+	if agent && result.AgentExhaustedAt == nil {
+		result.AgentExhaustedAt = &seconds
+	} else if !agent && result.ChatExhaustedAt == nil {
+		result.ChatExhaustedAt = &seconds
+	}
+}
+
+// recommendedTokens 按负载占用的token时间和两种模式的使用次数上限估算所需的token数
+// 每个请求占用token的时间为平均耗时加最小请求间隔，被拦截的请求再占用一次冷却时间
+func recommendedTokens(tokens []SimulatedToken, profile SimulationProfile) int {
+	occupancy := (1-profile.AgentRatio)*(profile.ChatLatency+requestInterval).Seconds() +
+		profile.AgentRatio*(profile.AgentLatency+requestInterval).Seconds() +
+		profile.BlockRate*simulatedBlockCooldown.Seconds()
+	byLoad := profile.RPS * occupancy * simulationHeadroom
+
+	// 现有token已用掉的次数不能再用，按新token的完整次数估算还需补充的数量
+	requests := profile.RPS * profile.Duration.Seconds()
+	chatNeeded := requests * (1 - profile.AgentRatio)
+	agentNeeded := requests * profile.AgentRatio
+	for _, token := range tokens {
+		if token.Chat {
+			chatNeeded -= float64(max(ChatUsageLimit-token.ChatUsed, 0))
+		}
+		if token.Agent {
+			agentNeeded -= float64(max(AgentUsageLimit-token.AgentUsed, 0))
+		}
+	}
+	byQuota := float64(len(tokens)) + math.Max(chatNeeded/ChatUsageLimit, agentNeeded/AgentUsageLimit)
+
+	return int(math.Ceil(math.Max(byLoad, byQuota)))
+}
+
+// ObservedProfile 按token最近的请求记录统计两种模式成功请求的平均耗时和被上游拒绝的比例，没有记录时对应值为0
+func ObservedProfile(tokens []string) (time.Duration, time.Duration, float64) {
+	var chatTotal, agentTotal, chatCount, agentCount int64
+	var samples, refusals int
+	for _, token := range tokens {
+		history, _ := GetTokenHistory(token)
+		for _, record := range history {
+			samples++
+			if refusalClasses[record.ErrorClass] {
+				refusals++
+			}
+			if record.ErrorClass != "" {
+				continue
+			}
+			if record.Mode == "AGENT" {
+				agentTotal += record.DurationMs
+				agentCount++
+			} else {
+				chatTotal += record.DurationMs
+				chatCount++
+			}
+		}
+	}
+
+	var chatLatency, agentLatency time.Duration
+	if chatCount > 0 {
+		chatLatency = time.Duration(chatTotal/chatCount) * time.Millisecond
+	}
+	if agentCount > 0 {
+		agentLatency = time.Duration(agentTotal/agentCount) * time.Millisecond
+	}
+	refusalRate := 0.0
+	if samples > 0 {
+		refusalRate = float64(refusals) / float64(samples)
+	}
+	return chatLatency, agentLatency, refusalRate
+}
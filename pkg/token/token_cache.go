@@ -0,0 +1,277 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// tokenCacheRefreshInterval Redis正常时刷新token缓存的间隔
+const tokenCacheRefreshInterval = 15 * time.Second
+
+// cachedToken 缓存的共享池token，只包含选择token所需的字段
+type cachedToken struct {
+	token     string
+	tenantURL string
+	sessionID string
+	hints     TokenHints
+	coolEnd   time.Time
+}
+
+// tokenSnapshot 最近一次从Redis读取的token池快照
+type tokenSnapshot struct {
+	tokens      []cachedToken
+	overloaded  map[string]time.Time // 过载退避中的上游分片及退避结束时间
+	refreshedAt time.Time
+}
+
+// TokenCacheStatus token缓存和降级期间暂存的写入
+type TokenCacheStatus struct {
+	Tokens            int        `json:"tokens"`
+	RefreshedAt       *time.Time `json:"refreshed_at,omitempty"`
+	DeferredStatuses  int        `json:"deferred_request_statuses"`
+	DeferredUsageKeys int        `json:"deferred_usage_keys"`
+}
+
+var (
+	tokenCache atomic.Pointer[tokenSnapshot]
+
+	// localRequestStatus 本实例设置的token请求状态，降级期间代替Redis中的请求状态
+	localRequestStatus = make(map[string]TokenRequestStatus)
+	// deferredRequestStatus 降级期间未写入Redis的请求状态，恢复后写入
+	deferredRequestStatus = make(map[string]TokenRequestStatus)
+	requestStatusGuard    sync.Mutex
+)
+
+// trackRequestStatus 记录本实例设置的请求状态，返回是否推迟写入Redis
+func trackRequestStatus(token string, status TokenRequestStatus) bool {
+	degraded := config.RedisDegraded()
+
+	requestStatusGuard.Lock()
+	defer requestStatusGuard.Unlock()
+	localRequestStatus[token] = status
+	if degraded {
+		deferredRequestStatus[token] = status
+	} else {
+		delete(deferredRequestStatus, token)
+	}
+	return degraded
+}
+
+// localRequestStatusOf 本实例最近设置的token请求状态
+func localRequestStatusOf(token string) TokenRequestStatus {
+	requestStatusGuard.Lock()
+	defer requestStatusGuard.Unlock()
+	return localRequestStatus[token]
+}
+
+// flushDeferredRequestStatus 将降级期间暂存的请求状态写入Redis，写入失败的状态保留到下次写入
+func flushDeferredRequestStatus() {
+	requestStatusGuard.Lock()
+	batch := deferredRequestStatus
+	deferredRequestStatus = make(map[string]TokenRequestStatus)
+	requestStatusGuard.Unlock()
+
+	failed := 0
+	for token, status := range batch {
+		// 恢复后已直接写入了更新的状态
+		if localRequestStatusOf(token) != status {
+			continue
+		}
+		statusJSON, err := json.Marshal(status)
+		if err == nil {
+			err = config.RedisSet("token_status:"+token, string(statusJSON), time.Hour)
+		}
+		if err == nil {
+			continue
+		}
+		failed++
+		requestStatusGuard.Lock()
+		// 写入期间设置了更新的状态时不再放回
+		if _, exists := deferredRequestStatus[token]; !exists {
+			deferredRequestStatus[token] = status
+		}
+		requestStatusGuard.Unlock()
+	}
+	if len(batch) > 0 {
+		logger.Token.WithFields(logrus.Fields{
+			"statuses": len(batch),
+			"failed":   failed,
+		}).Info("已写入Redis降级期间暂存的token请求状态")
+	}
+}
+
+// refreshTokenCache 从Redis读取共享池token的快照，并预先读取使用计数，降级期间据此检查使用上限
+func refreshTokenCache() error {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return err
+	}
+	snapshot := &tokenSnapshot{refreshedAt: time.Now()}
+	if len(keys) > 0 {
+		fields, err := config.RedisHGetAllBatch(keys)
+		if err != nil {
+			return err
+		}
+		coolKeys := make([]string, len(keys))
+		usageKeys := make([]string, 0, 2*len(keys))
+		for i, key := range keys {
+			token := key[6:]
+			coolKeys[i] = "token_cool_status:" + token
+			usageKeys = append(usageKeys, "token_usage_chat:"+token, "token_usage_agent:"+token)
+		}
+		cools, err := config.RedisMGet(coolKeys...)
+		if err != nil {
+			return err
+		}
+		usages, err := config.RedisMGet(usageKeys...)
+		if err != nil {
+			return err
+		}
+		for i, key := range usageKeys {
+			count, _ := strconv.Atoi(usages[i])
+			lastCounts.Store(key, count)
+		}
+
+		for i, key := range keys {
+			hash := fields[i]
+			if hash["status"] == "disabled" || hash["contributor"] != "" || hash["tenant_url"] == "" {
+				continue
+			}
+			entry := cachedToken{
+				token:     key[6:],
+				tenantURL: hash["tenant_url"],
+				sessionID: hash["session_id"],
+				hints:     ParseTokenHints(hash["remark"]),
+			}
+			var cool TokenCoolStatus
+			if cools[i] != "" && json.Unmarshal([]byte(cools[i]), &cool) == nil && cool.InCool {
+				entry.coolEnd = cool.CoolEnd
+			}
+			snapshot.tokens = append(snapshot.tokens, entry)
+		}
+	}
+
+	now := time.Now()
+	overloaded := OverloadedShards()
+	snapshot.overloaded = make(map[string]time.Time, len(overloaded))
+	for host, remaining := range overloaded {
+		snapshot.overloaded[host] = now.Add(remaining)
+	}
+	tokenCache.Store(snapshot)
+	return nil
+}
+
+// selectCachedToken 按与 selectAvailableToken 相同的规则从缓存的快照中选择token，不访问Redis；
+// 请求状态只包含本实例设置的部分，冷却和过载状态为快照时的状态
+func selectCachedToken(exclude map[string]bool, mode, shard string, preferLow bool) (string, string, string, int) {
+	snapshot := tokenCache.Load()
+	if snapshot == nil || len(snapshot.tokens) == 0 {
+		return "No token", "", "", rankCooldown
+	}
+
+	now := time.Now()
+	bestRank := rankCooldown
+	var best, cooldown []cachedToken
+	for _, entry := range snapshot.tokens {
+		if exclude[entry.token] || entry.hints.Shard != shard {
+			continue
+		}
+		rank := entry.hints.rank(mode)
+		if rank == rankDisallowed {
+			continue
+		}
+		if preferLow {
+			rank = entry.hints.lowFirst(rank)
+		}
+
+		status := localRequestStatusOf(entry.token)
+		if status.InProgress || now.Sub(status.LastRequestAt) < 3*time.Second {
+			continue
+		}
+		if !withinUsageLimit(entry.token, mode) {
+			continue
+		}
+		host := TenantHost(entry.tenantURL)
+		if ShardSaturated(host) {
+			continue
+		}
+
+		if now.Before(entry.coolEnd) || now.Before(snapshot.overloaded[host]) {
+			cooldown = append(cooldown, entry)
+			continue
+		}
+		if rank < bestRank {
+			bestRank = rank
+			best = best[:0]
+		}
+		if rank == bestRank {
+			best = append(best, entry)
+		}
+	}
+
+	var picked cachedToken
+	switch {
+	case len(best) > 0:
+		picked = best[rand.Intn(len(best))]
+	case len(cooldown) > 0:
+		picked, bestRank = cooldown[rand.Intn(len(cooldown))], rankCooldown
+	default:
+		return "No available token", "", "", rankCooldown
+	}
+	if picked.sessionID == "" {
+		picked.sessionID = uuid.New().String()
+	}
+	return picked.token, picked.tenantURL, picked.sessionID, bestRank
+}
+
+// GetTokenCacheStatus 返回token缓存和降级期间暂存写入的状态
+func GetTokenCacheStatus() TokenCacheStatus {
+	status := TokenCacheStatus{DeferredUsageKeys: DeferredUsageCount()}
+	if snapshot := tokenCache.Load(); snapshot != nil {
+		status.Tokens = len(snapshot.tokens)
+		refreshedAt := snapshot.refreshedAt
+		status.RefreshedAt = &refreshedAt
+	}
+	requestStatusGuard.Lock()
+	status.DeferredStatuses = len(deferredRequestStatus)
+	requestStatusGuard.Unlock()
+	return status
+}
+
+// StartTokenCache 开启Redis降级时定期刷新token缓存，Redis降级期间暂停刷新，恢复后先写入暂存的请求状态
+func StartTokenCache() {
+	if config.RDB == nil || config.AppConfig.RedisDegrade != "true" {
+		return
+	}
+	if err := refreshTokenCache(); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("读取token缓存失败，将在下次刷新时重试")
+	}
+	config.StartRedisProbe()
+
+	go func() {
+		ticker := time.NewTicker(tokenCacheRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if config.RedisDegraded() {
+				continue
+			}
+			flushDeferredRequestStatus()
+			if err := refreshTokenCache(); err != nil {
+				logger.Token.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Warn("刷新token缓存失败")
+			}
+		}
+	}()
+}
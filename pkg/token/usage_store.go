@@ -0,0 +1,448 @@
+package token
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// usageBatchKeyPrefix Redis中记录每个日志最后写入的批次编号的键前缀，后接日志的存储编号
+	usageBatchKeyPrefix = "usage_batch:"
+	// usageBatchMarker 写入中的日志里记录批次编号的行前缀
+	usageBatchMarker = "batch"
+)
+
+// UsageStore token使用计数的存储
+type UsageStore interface {
+	// Incr 计数加一并返回增加后的值
+	Incr(key string) (int64, error)
+	// Get 返回计数的当前值，包含尚未写入Redis的部分
+	Get(key string) int
+	// Discard 丢弃尚未写入Redis的计数，计数在Redis中被重置或删除时调用
+	Discard(keys ...string)
+	// Flush 将尚未写入的计数写入Redis
+	Flush() error
+}
+
+// usageStore 当前使用的计数存储，默认每次直接写入Redis
+var usageStore UsageStore = redisUsageStore{}
+
+// deferredUsage Redis降级期间暂存计数的内存存储，由定期写入任务在Redis恢复后批量写入；
+// 使用内存计数存储时与 usageStore 相同
+var deferredUsage *bufferedUsageStore
+
+// separateDeferredUsage 是否另有降级期间暂存的计数，即 usageStore 直接写入Redis时
+func separateDeferredUsage() bool {
+	return deferredUsage != nil && UsageStore(deferredUsage) != usageStore
+}
+
+// IncrUsage 增加token的使用计数并返回增加后的值，Redis降级期间计数暂存在内存中
+func IncrUsage(key string) (int64, error) {
+	if deferredUsage != nil && config.RedisDegraded() {
+		return deferredUsage.Incr(key)
+	}
+	return usageStore.Incr(key)
+}
+
+// GetUsage 获取token的使用计数
+func GetUsage(key string) int {
+	count := usageStore.Get(key)
+	if separateDeferredUsage() {
+		count += deferredUsage.unflushed(key)
+	}
+	return count
+}
+
+// DiscardUsage 丢弃尚未写入Redis的使用计数
+func DiscardUsage(keys ...string) {
+	usageStore.Discard(keys...)
+	if separateDeferredUsage() {
+		deferredUsage.Discard(keys...)
+	}
+	for _, key := range keys {
+		lastCounts.Delete(key)
+	}
+}
+
+// FlushUsage 立即将尚未写入的使用计数写入Redis，重置计数前调用
+func FlushUsage() error {
+	if separateDeferredUsage() {
+		if err := deferredUsage.Flush(); err != nil {
+			return err
+		}
+	}
+	return usageStore.Flush()
+}
+
+// DeferredUsageCount 尚未写入Redis的计数键数量
+func DeferredUsageCount() int {
+	if deferredUsage == nil {
+		return 0
+	}
+	return deferredUsage.pendingKeys()
+}
+
+// redisUsageStore 每次计数直接写入Redis
+type redisUsageStore struct{}
+
+func (redisUsageStore) Incr(key string) (int64, error) {
+	return config.RedisIncrValue(key)
+}
+
+func (redisUsageStore) Get(key string) int {
+	return readCount(key)
+}
+
+func (redisUsageStore) Discard(keys ...string) {}
+
+func (redisUsageStore) Flush() error {
+	return nil
+}
+
+// bufferedUsageStore 在内存中累加计数并定期批量写入Redis
+// 每次计数先追加到本地日志文件，进程崩溃后重启时根据日志补写尚未写入Redis的计数；
+// 每批计数与批次编号在同一个事务中写入Redis，重启时已写入的批次不再补写
+type bufferedUsageStore struct {
+	mu        sync.Mutex
+	pending   map[string]int64 // 尚未写入Redis的计数
+	inflight  map[string]int64 // 正在写入Redis的计数
+	discarded map[string]bool  // 写入期间被丢弃的计数键，写入结束后删除
+	id        string           // 日志的存储编号，用于在Redis中记录最后写入的批次
+	path      string
+	journal   *os.File
+	flushMu   sync.Mutex
+}
+
+// newBufferedUsageStore 创建内存计数存储，并将上次未写入Redis的日志合并到新的日志文件中
+func newBufferedUsageStore(path string) (*bufferedUsageStore, error) {
+	id, err := loadUsageStoreID(path + ".id")
+	if err != nil {
+		return nil, err
+	}
+	s := &bufferedUsageStore{
+		pending:   make(map[string]int64),
+		inflight:  make(map[string]int64),
+		discarded: make(map[string]bool),
+		id:        id,
+		path:      path,
+	}
+
+	// 先读取上次写入中途中断的日志，该批次已写入Redis时不再补写，再读取当前日志
+	flushing := make(map[string]int64)
+	batch, err := replayUsageJournal(path+".flushing", flushing)
+	if err != nil {
+		return nil, err
+	}
+	if len(flushing) > 0 && !s.batchApplied(batch) {
+		for key, delta := range flushing {
+			s.pending[key] += delta
+		}
+	}
+	if _, err := replayUsageJournal(path, s.pending); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	for key, delta := range s.pending {
+		if delta == 0 {
+			delete(s.pending, key)
+			continue
+		}
+		if _, err := fmt.Fprintf(journal, "%d %s\n", delta, key); err != nil {
+			journal.Close()
+			return nil, err
+		}
+	}
+	if err := journal.Sync(); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	os.Remove(path + ".flushing")
+
+	s.journal = journal
+	return s, nil
+}
+
+// loadUsageStoreID 读取日志的存储编号，不存在时生成并保存
+func loadUsageStoreID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id := uuid.New().String()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// batchApplied 批次是否已写入Redis，无法确认时按未写入处理，计数可能被重复写入
+func (s *bufferedUsageStore) batchApplied(batch string) bool {
+	if batch == "" {
+		return false
+	}
+	applied, err := config.RedisGet(usageBatchKeyPrefix + s.id)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logger.Token.WithFields(logrus.Fields{
+			"batch": batch,
+			"error": err.Error(),
+		}).Warn("无法确认上次中断的使用计数是否已写入，将重新写入")
+	}
+	return applied == batch
+}
+
+// replayUsageJournal 读取日志文件中的计数，每行为 "增量 键"，返回日志中记录的批次编号
+func replayUsageJournal(path string, deltas map[string]int64) (string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var batch string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		deltaText, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue // 崩溃时未写完的最后一行
+		}
+		if deltaText == usageBatchMarker {
+			batch = key
+			continue
+		}
+		delta, err := strconv.ParseInt(deltaText, 10, 64)
+		if err != nil || key == "" {
+			continue
+		}
+		deltas[key] += delta
+	}
+	return batch, scanner.Err()
+}
+
+// appendJournal 追加一行计数日志，调用方持有锁
+func (s *bufferedUsageStore) appendJournal(delta int64, key string) {
+	if _, err := fmt.Fprintf(s.journal, "%d %s\n", delta, key); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("写入使用计数日志失败")
+	}
+}
+
+func (s *bufferedUsageStore) Incr(key string) (int64, error) {
+	base := int64(readCount(key))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[key]++
+	s.appendJournal(1, key)
+	return base + s.pending[key] + s.inflight[key], nil
+}
+
+func (s *bufferedUsageStore) Get(key string) int {
+	base := readCount(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return base + int(s.pending[key]+s.inflight[key])
+}
+
+// unflushed 尚未写入Redis的计数
+func (s *bufferedUsageStore) unflushed(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.pending[key] + s.inflight[key])
+}
+
+// pendingKeys 尚未写入Redis的计数键数量
+func (s *bufferedUsageStore) pendingKeys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending) + len(s.inflight)
+}
+
+func (s *bufferedUsageStore) Discard(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if delta := s.pending[key]; delta != 0 {
+			// 记录抵消的增量，重启回放日志时不会再写回被重置的计数
+			s.appendJournal(-delta, key)
+			delete(s.pending, key)
+		}
+		// 正在写入的计数无法撤回，写入结束后删除该键，避免被重置的计数又被写回
+		if _, ok := s.inflight[key]; ok {
+			delete(s.inflight, key)
+			s.discarded[key] = true
+		}
+	}
+}
+
+// Flush 将累加的计数切换到新的日志文件后与批次编号一起写入Redis，写入失败时放回内存等待下次写入
+func (s *bufferedUsageStore) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	batchID := uuid.New().String()
+	if err := s.rotateJournal(batchID); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	batch := s.pending
+	s.pending = make(map[string]int64)
+	s.inflight = batch
+	s.mu.Unlock()
+
+	err := config.RedisIncrByBatchMarked(batch, usageBatchKeyPrefix+s.id, batchID)
+
+	s.mu.Lock()
+	discarded := s.discarded
+	s.inflight = make(map[string]int64)
+	s.discarded = make(map[string]bool)
+	if err != nil {
+		for key, delta := range batch {
+			if discarded[key] {
+				continue
+			}
+			s.pending[key] += delta
+			s.appendJournal(delta, key)
+		}
+	}
+	// 写入失败时计数已重新记入当前日志，两种情况下旧日志都不再需要
+	os.Remove(s.path + ".flushing")
+	s.mu.Unlock()
+
+	if err == nil {
+		for key := range discarded {
+			config.RedisDel(key)
+		}
+	}
+	return err
+}
+
+// rotateJournal 将当前日志改名为写入中的日志并记录批次编号，再打开新的日志文件，调用方持有锁
+// 已打开的文件改名后仍可写入和关闭，改名失败时继续使用当前日志
+func (s *bufferedUsageStore) rotateJournal(batchID string) error {
+	if err := os.Rename(s.path, s.path+".flushing"); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		os.Rename(s.path+".flushing", s.path)
+		return err
+	}
+	// 批次编号写入失败时重启后按未写入处理
+	fmt.Fprintf(s.journal, "%s %s\n", usageBatchMarker, batchID)
+	s.journal.Sync()
+	s.journal.Close()
+	s.journal = journal
+	return nil
+}
+
+// usageFlushInterval 内存计数写入Redis的间隔
+func usageFlushInterval() time.Duration {
+	seconds, err := strconv.Atoi(config.AppConfig.UsageFlushInterval)
+	if err != nil || seconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// StartUsageStore 按配置启用内存计数存储，定期将计数写入Redis，收到退出信号时写入剩余计数后退出
+// 多实例部署时其他实例最多延迟一个写入间隔才能看到本实例的计数，使用上限可能被略微超出；
+// 开启Redis降级时即使直接写入Redis也创建内存计数存储，只用于暂存降级期间的计数，降级期间暂停写入，恢复后一并写入
+func StartUsageStore() {
+	memory := config.AppConfig.UsageCounterStore == "memory"
+	if config.RDB == nil || (!memory && config.AppConfig.RedisDegrade != "true") {
+		return
+	}
+
+	store, err := newBufferedUsageStore(config.AppConfig.UsageJournalPath)
+	if err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"journal": config.AppConfig.UsageJournalPath,
+			"error":   err.Error(),
+		}).Error("初始化内存使用计数失败，继续直接写入Redis")
+		return
+	}
+	// 补写上次未写入Redis的计数
+	if err := store.Flush(); err != nil {
+		logger.Token.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("补写使用计数失败，将在下次写入时重试")
+	}
+	deferredUsage = store
+
+	interval := usageFlushInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if config.RedisDegraded() {
+				continue
+			}
+			if err := store.Flush(); err != nil {
+				logger.Token.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("写入使用计数失败")
+			}
+		}
+	}()
+	if !memory {
+		return
+	}
+
+	usageStore = store
+	logger.Token.WithFields(logrus.Fields{
+		"journal":  config.AppConfig.UsageJournalPath,
+		"interval": interval.String(),
+	}).Info("已启用内存使用计数")
+
+	// 只有内存计数模式需要在退出前写入，降级暂存的计数保留在日志中，重启后补写
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		if err := store.Flush(); err != nil {
+			logger.Token.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("退出前写入使用计数失败，计数保留在日志中")
+		}
+		logger.Token.WithFields(logrus.Fields{
+			"signal": sig.String(),
+		}).Info("使用计数已写入，进程退出")
+		os.Exit(0)
+	}()
+}
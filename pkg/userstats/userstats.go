@@ -0,0 +1,159 @@
+package userstats
+
+import (
+	"augment2api/config"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// statsRetention 每日统计的保留时间
+	statsRetention = 31 * 24 * time.Hour
+	// limitsKey 按终端用户单独配置的每分钟请求数上限
+	limitsKey = "user_rate_limits"
+	// MaxUserIDLength 终端用户标识的最大长度，超出部分截断
+	MaxUserIDLength = 128
+)
+
+// UserStats 终端用户单日的使用统计
+type UserStats struct {
+	User     string         `json:"user"`
+	Date     string         `json:"date"`
+	Requests int64          `json:"requests"`
+	Errors   int64          `json:"errors"`
+	Models   map[string]int `json:"models"`
+}
+
+// NormalizeUserID 规范化客户端传入的终端用户标识
+func NormalizeUserID(user string) string {
+	user = strings.TrimSpace(user)
+	if len(user) > MaxUserIDLength {
+		user = user[:MaxUserIDLength]
+	}
+	return user
+}
+
+// statsKey 终端用户单日统计的键
+func statsKey(date, user string) string {
+	return "user_stats:" + date + ":" + user
+}
+
+// Record 记录终端用户的一次请求
+func Record(user, model string, failed bool) error {
+	if user == "" || config.RDB == nil {
+		return nil
+	}
+
+	key := statsKey(time.Now().Format("2006-01-02"), user)
+	if _, err := config.RedisHIncrBy(key, "requests", 1); err != nil {
+		return err
+	}
+	if failed {
+		if _, err := config.RedisHIncrBy(key, "errors", 1); err != nil {
+			return err
+		}
+	}
+	if model != "" {
+		if _, err := config.RedisHIncrBy(key, "model:"+model, 1); err != nil {
+			return err
+		}
+	}
+	return config.RedisExpire(key, statsRetention)
+}
+
+// List 获取指定日期所有终端用户的统计，按请求数倒序
+func List(date string) ([]UserStats, error) {
+	prefix := statsKey(date, "")
+	keys, err := config.RedisKeys(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]UserStats, 0, len(keys))
+	for _, key := range keys {
+		fields, err := config.RedisHGetAll(key)
+		if err != nil {
+			continue
+		}
+
+		item := UserStats{
+			User:   strings.TrimPrefix(key, prefix),
+			Date:   date,
+			Models: make(map[string]int),
+		}
+		for field, value := range fields {
+			count, _ := strconv.ParseInt(value, 10, 64)
+			switch {
+			case field == "requests":
+				item.Requests = count
+			case field == "errors":
+				item.Errors = count
+			case strings.HasPrefix(field, "model:"):
+				item.Models[strings.TrimPrefix(field, "model:")] = int(count)
+			}
+		}
+		stats = append(stats, item)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].User < stats[j].User
+	})
+	return stats, nil
+}
+
+// Limit 获取终端用户的每分钟请求数上限，0表示不限制
+func Limit(user string) int {
+	if config.RDB != nil {
+		if value, err := config.RedisHGet(limitsKey, user); err == nil && value != "" {
+			if limit, err := strconv.Atoi(value); err == nil {
+				return limit
+			}
+		}
+	}
+	limit, _ := strconv.Atoi(config.AppConfig.UserRateLimit)
+	return limit
+}
+
+// SetLimit 设置终端用户单独的每分钟请求数上限，小于0时恢复为默认值
+func SetLimit(user string, limit int) error {
+	if limit < 0 {
+		return config.RedisHDel(limitsKey, user)
+	}
+	return config.RedisHSet(limitsKey, user, strconv.Itoa(limit))
+}
+
+// RetryAfter 距离当前频率统计窗口结束的时间
+func RetryAfter() time.Duration {
+	now := time.Now()
+	return time.Duration(60-now.Unix()%60) * time.Second
+}
+
+// Allow 检查终端用户本分钟的请求数是否超过上限，返回是否允许和当前上限
+func Allow(user string) (bool, int, error) {
+	if user == "" || config.RDB == nil {
+		return true, 0, nil
+	}
+
+	limit := Limit(user)
+	if limit <= 0 {
+		return true, limit, nil
+	}
+
+	key := fmt.Sprintf("user_rate:%s:%d", user, time.Now().Unix()/60)
+	count, err := config.RedisIncrValue(key)
+	if err != nil {
+		return true, limit, err
+	}
+	if count == 1 {
+		if err := config.RedisExpire(key, 2*time.Minute); err != nil {
+			return true, limit, err
+		}
+	}
+	return count <= int64(limit), limit, nil
+}
@@ -0,0 +1,140 @@
+package webui
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// StaticDir 静态资源在文件系统中的目录
+	StaticDir = "static"
+	// hashLength 文件名中内容哈希的长度
+	hashLength = 10
+	// minGzipSize 小于该大小的文件不预压缩
+	minGzipSize = 512
+)
+
+// Asset 一个静态资源及其预压缩版本
+type Asset struct {
+	Name        string // 原始文件名，相对于 static 目录
+	HashedName  string // 带内容哈希的文件名，如 augment.1a2b3c4d5e.svg
+	ContentType string
+	ETag        string
+	Data        []byte
+	Gzip        []byte // 预压缩的gzip版本，压缩后没有变小时为nil
+}
+
+// Assets 启动时加载的管理界面静态资源
+type Assets struct {
+	byName   map[string]*Asset
+	byHashed map[string]*Asset
+	version  string
+}
+
+// Load 读取文件系统中的静态资源并计算内容哈希和gzip版本，
+// 界面版本由全部文件（包括模板）的内容决定，任何文件变化都会得到新的版本
+func Load(fsys fs.FS) (*Assets, error) {
+	assets := &Assets{
+		byName:   make(map[string]*Asset),
+		byHashed: make(map[string]*Asset),
+	}
+
+	var files []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		files = append(files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	version := sha256.New()
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:hashLength]
+		version.Write([]byte(name + "\x00" + hash + "\n"))
+
+		rel, ok := strings.CutPrefix(name, StaticDir+"/")
+		if !ok {
+			continue
+		}
+		asset := &Asset{
+			Name:        rel,
+			HashedName:  hashedName(rel, hash),
+			ContentType: contentType(rel, data),
+			ETag:        `"` + hash + `"`,
+			Data:        data,
+			Gzip:        compress(data),
+		}
+		assets.byName[asset.Name] = asset
+		assets.byHashed[asset.HashedName] = asset
+	}
+	assets.version = hex.EncodeToString(version.Sum(nil))[:12]
+	return assets, nil
+}
+
+// hashedName 在扩展名前插入内容哈希
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// contentType 按扩展名确定类型，未知扩展名时按内容检测
+func contentType(name string, data []byte) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(data)
+}
+
+// compress 返回数据的gzip版本，文件太小或压缩后没有变小时返回nil
+func compress(data []byte) []byte {
+	if len(data) < minGzipSize {
+		return nil
+	}
+	var buf bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	writer.Write(data)
+	writer.Close()
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Version 界面版本，升级后页面可以据此判断是否需要刷新
+func (a *Assets) Version() string {
+	return a.version
+}
+
+// Path 返回资源带内容哈希的访问路径，资源不存在时返回原始路径
+func (a *Assets) Path(name string) string {
+	if asset, ok := a.byName[strings.TrimPrefix(name, "/")]; ok {
+		return "/" + StaticDir + "/" + asset.HashedName
+	}
+	return "/" + StaticDir + "/" + strings.TrimPrefix(name, "/")
+}
+
+// Lookup 按文件名查找资源，hashed 表示请求使用的是带内容哈希的文件名
+func (a *Assets) Lookup(name string) (asset *Asset, hashed bool) {
+	if asset, ok := a.byHashed[name]; ok {
+		return asset, true
+	}
+	return a.byName[name], false
+}